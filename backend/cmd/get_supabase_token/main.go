@@ -23,7 +23,7 @@ func main() {
 	supabaseKey := os.Getenv("SUPABASE_API_KEY")
 
 	if len(os.Args) < 3 {
-		fmt.Println("Usage: go run get_supabase_token.go <email> <password>")
+		fmt.Println("Usage: go run ./cmd/get_supabase_token <email> <password>")
 		os.Exit(1)
 	}
 
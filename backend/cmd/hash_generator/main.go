@@ -9,7 +9,7 @@ import (
 
 func main() {
 	if len(os.Args) < 2 {
-		fmt.Println("Usage: go run hash_generator.go <password>")
+		fmt.Println("Usage: go run ./cmd/hash_generator <password>")
 		os.Exit(1)
 	}
 
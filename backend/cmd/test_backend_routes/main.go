@@ -47,7 +47,8 @@ func main() {
 	// Rotas públicas
 	testRoute("GET", baseURL+"/api/status", "", 200)
 	testRoute("GET", baseURL+"/", "", 200)
-	testRoute("POST", baseURL+"/webhook/mercadopago", "", 200)
+	// Sem x-signature o webhook é recusado
+	testRoute("POST", baseURL+"/api/webhook/mercadopago", "", 401)
 
 	// Rotas de streaming
 	testRoute("POST", baseURL+"/api/streaming/proxy", superadminJWT, 200)
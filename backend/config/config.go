@@ -3,23 +3,59 @@ package config
 import (
 	"log"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/joho/godotenv"
 )
 
 // Config struct holds all configuration for the application
 type Config struct {
-	DatabaseURL              string
-	SupabaseURL              string
-	SupabaseAPIKey           string
-	SupabaseJWTSigningKey    string
-	SMTPAddress              string
-	SMTPPort                 string
-	SMTPDomain               string
-	SMTPUsername             string
-	SMTPPassword             string
-	MercadoPagoAccessToken   string
-	MercadoPagoWebhookSecret string
+	DatabaseURL               string
+	SupabaseURL               string
+	SupabaseAPIKey            string
+	SupabaseServiceRoleKey    string
+	SupabaseJWTSigningKey     string
+	SupabaseJWTIssuer         string
+	SupabaseJWTAudience       string
+	JWKSRefreshMinutes        int
+	AuthProvider              string
+	AuthJWTSecret             string
+	AuthJWTIssuer             string
+	AuthTokenTTLMinutes       int
+	AuthRefreshTTLDays        int
+	SMTPAddress               string
+	SMTPPort                  string
+	SMTPDomain                string
+	SMTPUsername              string
+	SMTPPassword              string
+	MercadoPagoAccessToken    string
+	MercadoPagoWebhookSecret  string
+	MercadoPagoBaseURL        string
+	MercadoPagoCurrency       string
+	StripeSecretKey           string
+	StripeWebhookSecret       string
+	StripeBaseURL             string
+	StripeCurrency            string
+	StripeCurrencies          string
+	PaymentProvider           string
+	PixExpirationMinutes      int
+	InvoiceEmailEnabled       bool
+	WalletAutoRenewDays       int
+	TrustedProxies            string
+	AccessLogRetentionDays    int
+	HourlyRollupRetentionDays int
+	RequestLogFormat          string
+	RequestLogOutput          string
+	RequestLogMaxSizeMB       int
+	RequestLogMaxBackups      int
+	MetricsToken              string
+	MetricsMaxDomainLabels    int
+	LockoutEmailFailures      int
+	LockoutIPFailures         int
+	LockoutBaseSeconds        int
+	LockoutMaxMinutes         int
+	LockoutWindowMinutes      int
 }
 
 // LoadConfig loads config from .env file and environment variables
@@ -31,18 +67,101 @@ func LoadConfig() (*Config, error) {
 	}
 
 	cfg := &Config{
-		DatabaseURL:              os.Getenv("DATABASE_URL"),
-		SupabaseURL:              os.Getenv("SUPABASE_URL"),
-		SupabaseAPIKey:           os.Getenv("SUPABASE_API_KEY"),
-		SupabaseJWTSigningKey:    os.Getenv("SUPABASE_JWT_SIGNING_KEY"),
-		SMTPAddress:              os.Getenv("SMTP_ADDRESS"),
-		SMTPPort:                 os.Getenv("SMTP_PORT"),
-		SMTPDomain:               os.Getenv("SMTP_DOMAIN"),
-		SMTPUsername:             os.Getenv("SMTP_USERNAME"),
-		SMTPPassword:             os.Getenv("SMTP_PASSWORD"),
-		MercadoPagoAccessToken:   os.Getenv("MERCADOPAGO_ACCESS_TOKEN"),
-		MercadoPagoWebhookSecret: os.Getenv("MERCADOPAGO_WEBHOOK_SECRET"),
+		DatabaseURL:               os.Getenv("DATABASE_URL"),
+		SupabaseURL:               os.Getenv("SUPABASE_URL"),
+		SupabaseAPIKey:            os.Getenv("SUPABASE_API_KEY"),
+		SupabaseServiceRoleKey:    os.Getenv("SUPABASE_SERVICE_ROLE_KEY"),
+		SupabaseJWTSigningKey:     os.Getenv("SUPABASE_JWT_SIGNING_KEY"),
+		SupabaseJWTIssuer:         os.Getenv("SUPABASE_JWT_ISSUER"),
+		SupabaseJWTAudience:       getEnvDefault("SUPABASE_JWT_AUDIENCE", "authenticated"),
+		JWKSRefreshMinutes:        getEnvInt("JWKS_REFRESH_INTERVAL_MINUTES", 15),
+		AuthProvider:              getEnvDefault("AUTH_PROVIDER", "supabase"),
+		AuthJWTSecret:             os.Getenv("AUTH_JWT_SECRET"),
+		AuthJWTIssuer:             getEnvDefault("AUTH_JWT_ISSUER", "cdnproxy"),
+		AuthTokenTTLMinutes:       getEnvInt("AUTH_TOKEN_TTL_MINUTES", 60),
+		AuthRefreshTTLDays:        getEnvInt("AUTH_REFRESH_TTL_DAYS", 30),
+		SMTPAddress:               os.Getenv("SMTP_ADDRESS"),
+		SMTPPort:                  os.Getenv("SMTP_PORT"),
+		SMTPDomain:                os.Getenv("SMTP_DOMAIN"),
+		SMTPUsername:              os.Getenv("SMTP_USERNAME"),
+		SMTPPassword:              os.Getenv("SMTP_PASSWORD"),
+		MercadoPagoAccessToken:    os.Getenv("MERCADOPAGO_ACCESS_TOKEN"),
+		MercadoPagoWebhookSecret:  os.Getenv("MERCADOPAGO_WEBHOOK_SECRET"),
+		MercadoPagoBaseURL:        getEnvDefault("MERCADOPAGO_BASE_URL", "https://api.mercadopago.com"),
+		MercadoPagoCurrency:       getEnvDefault("MERCADOPAGO_CURRENCY", "BRL"),
+		StripeSecretKey:           os.Getenv("STRIPE_SECRET_KEY"),
+		StripeWebhookSecret:       os.Getenv("STRIPE_WEBHOOK_SECRET"),
+		StripeBaseURL:             getEnvDefault("STRIPE_BASE_URL", "https://api.stripe.com"),
+		StripeCurrency:            getEnvDefault("STRIPE_CURRENCY", "USD"),
+		StripeCurrencies:          getEnvDefault("STRIPE_CURRENCIES", "USD,EUR"),
+		PaymentProvider:           getEnvDefault("PAYMENT_PROVIDER", "mercadopago"),
+		PixExpirationMinutes:      getEnvInt("PIX_EXPIRATION_MINUTES", 30),
+		InvoiceEmailEnabled:       getEnvBool("INVOICE_EMAIL_ENABLED", false),
+		WalletAutoRenewDays:       getEnvInt("WALLET_AUTO_RENEW_DAYS", 3),
+		TrustedProxies:            os.Getenv("TRUSTED_PROXIES"),
+		AccessLogRetentionDays:    getEnvInt("ACCESS_LOG_RETENTION_DAYS", 90),
+		HourlyRollupRetentionDays: getEnvInt("ACCESS_LOG_HOURLY_ROLLUP_RETENTION_DAYS", 30),
+		RequestLogFormat:          os.Getenv("REQUEST_LOG_FORMAT"),
+		RequestLogOutput:          os.Getenv("REQUEST_LOG_OUTPUT"),
+		RequestLogMaxSizeMB:       getEnvInt("REQUEST_LOG_MAX_SIZE_MB", 100),
+		RequestLogMaxBackups:      getEnvInt("REQUEST_LOG_MAX_BACKUPS", 7),
+		MetricsToken:              os.Getenv("METRICS_TOKEN"),
+		MetricsMaxDomainLabels:    getEnvInt("METRICS_MAX_DOMAIN_LABELS", 100),
+		LockoutEmailFailures:      getEnvInt("AUTH_LOCKOUT_EMAIL_FAILURES", 5),
+		LockoutIPFailures:         getEnvInt("AUTH_LOCKOUT_IP_FAILURES", 20),
+		LockoutBaseSeconds:        getEnvInt("AUTH_LOCKOUT_BASE_SECONDS", 60),
+		LockoutMaxMinutes:         getEnvInt("AUTH_LOCKOUT_MAX_MINUTES", 60),
+		LockoutWindowMinutes:      getEnvInt("AUTH_LOCKOUT_WINDOW_MINUTES", 60),
+	}
+
+	// Instalações antigas usam SUPABASE_SECRET_KEY para a service role
+	if cfg.SupabaseServiceRoleKey == "" {
+		cfg.SupabaseServiceRoleKey = os.Getenv("SUPABASE_SECRET_KEY")
+	}
+
+	// Tokens do Supabase usam "<SUPABASE_URL>/auth/v1" como issuer
+	if _, set := os.LookupEnv("SUPABASE_JWT_ISSUER"); !set && cfg.SupabaseURL != "" {
+		cfg.SupabaseJWTIssuer = strings.TrimRight(cfg.SupabaseURL, "/") + "/auth/v1"
 	}
 
 	return cfg, nil
 }
+
+// getEnvDefault returns def only when key is unset, so an explicitly empty
+// value can be used to disable a check.
+func getEnvDefault(key, def string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return def
+}
+
+// getEnvInt reads an integer environment variable, falling back to def when it
+// is unset or invalid.
+func getEnvInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("Invalid value for %s, using default %d", key, def)
+		return def
+	}
+	return n
+}
+
+// getEnvBool reads a boolean environment variable ("true", "1", "false"...),
+// falling back to def when it is unset or invalid.
+func getEnvBool(key string, def bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("Invalid value for %s, using default %t", key, def)
+		return def
+	}
+	return b
+}
@@ -0,0 +1,83 @@
+-- 014_partition_streaming_access_logs.sql
+
+-- Converte streaming_access_logs em tabela particionada por mês (created_at, UTC).
+-- As partições futuras e a retenção são gerenciadas pela aplicação
+-- (services/accesslogs). Se a tabela já estiver particionada, nada é feito.
+DO $$
+DECLARE
+    table_kind "char";
+    first_month date;
+    last_month date;
+    m date;
+BEGIN
+    SELECT c.relkind INTO table_kind
+    FROM pg_class c
+    JOIN pg_namespace n ON n.oid = c.relnamespace
+    WHERE n.nspname = 'public' AND c.relname = 'streaming_access_logs';
+
+    IF table_kind IS NULL OR table_kind = 'p' THEN
+        RETURN;
+    END IF;
+
+    ALTER TABLE public.streaming_access_logs RENAME TO streaming_access_logs_legacy;
+
+    IF EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'streaming_access_logs_pkey') THEN
+        ALTER TABLE public.streaming_access_logs_legacy RENAME CONSTRAINT streaming_access_logs_pkey TO streaming_access_logs_legacy_pkey;
+    END IF;
+
+    -- Mantém a sequência de IDs existente sem que ela seja removida junto com a tabela antiga
+    CREATE SEQUENCE IF NOT EXISTS public.streaming_access_logs_id_seq;
+    ALTER SEQUENCE public.streaming_access_logs_id_seq OWNED BY NONE;
+
+    CREATE TABLE public.streaming_access_logs (
+        id BIGINT NOT NULL DEFAULT nextval('public.streaming_access_logs_id_seq'),
+        streaming_proxy_id INTEGER NOT NULL,
+        client_ip VARCHAR(45),
+        user_agent TEXT,
+        device_type VARCHAR(50),
+        country_code VARCHAR(10),
+        country_name VARCHAR(100),
+        city VARCHAR(100),
+        latitude DOUBLE PRECISION,
+        longitude DOUBLE PRECISION,
+        created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+        PRIMARY KEY (id, created_at),
+        FOREIGN KEY (streaming_proxy_id) REFERENCES streaming_proxies(id) ON DELETE CASCADE
+    ) PARTITION BY RANGE (created_at);
+
+    SELECT
+        date_trunc('month', MIN(created_at) AT TIME ZONE 'UTC')::date,
+        date_trunc('month', MAX(created_at) AT TIME ZONE 'UTC')::date
+    INTO first_month, last_month
+    FROM public.streaming_access_logs_legacy;
+
+    m := LEAST(COALESCE(first_month, date_trunc('month', NOW() AT TIME ZONE 'UTC')::date),
+               date_trunc('month', NOW() AT TIME ZONE 'UTC')::date);
+    last_month := GREATEST(COALESCE(last_month, m),
+                           (date_trunc('month', NOW() AT TIME ZONE 'UTC') + INTERVAL '2 months')::date);
+
+    WHILE m <= last_month LOOP
+        EXECUTE format(
+            'CREATE TABLE IF NOT EXISTS public.%I PARTITION OF public.streaming_access_logs FOR VALUES FROM (%L) TO (%L)',
+            'streaming_access_logs_p' || to_char(m, 'YYYYMM'),
+            m::text || ' 00:00:00+00',
+            (m + INTERVAL '1 month')::date::text || ' 00:00:00+00'
+        );
+        m := (m + INTERVAL '1 month')::date;
+    END LOOP;
+
+    INSERT INTO public.streaming_access_logs
+        (id, streaming_proxy_id, client_ip, user_agent, device_type, country_code, country_name, city, latitude, longitude, created_at)
+    SELECT id, streaming_proxy_id, client_ip, user_agent, device_type, country_code, country_name, city, latitude, longitude, created_at
+    FROM public.streaming_access_logs_legacy;
+
+    PERFORM setval('public.streaming_access_logs_id_seq',
+                   GREATEST((SELECT COALESCE(MAX(id), 0) FROM public.streaming_access_logs), 1));
+
+    DROP TABLE public.streaming_access_logs_legacy;
+
+    ALTER SEQUENCE public.streaming_access_logs_id_seq OWNED BY public.streaming_access_logs.id;
+END $$;
+
+CREATE INDEX IF NOT EXISTS idx_streaming_access_logs_proxy_created ON public.streaming_access_logs (streaming_proxy_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_streaming_access_logs_created ON public.streaming_access_logs (created_at);
@@ -0,0 +1,25 @@
+-- 015_create_access_log_rollups.sql
+
+-- Agregados de streaming_access_logs usados pelos endpoints de analytics.
+-- Preenchidos periodicamente pela aplicação (services/accesslogs).
+CREATE TABLE IF NOT EXISTS public.access_log_rollups_hourly (
+    bucket TIMESTAMPTZ NOT NULL,
+    domain_id BIGINT NOT NULL,
+    device_type VARCHAR(50) NOT NULL DEFAULT '',
+    country_code VARCHAR(10) NOT NULL DEFAULT '',
+    hits BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (bucket, domain_id, device_type, country_code)
+);
+
+CREATE INDEX IF NOT EXISTS idx_access_log_rollups_hourly_domain ON public.access_log_rollups_hourly (domain_id, bucket);
+
+CREATE TABLE IF NOT EXISTS public.access_log_rollups_daily (
+    day DATE NOT NULL,
+    domain_id BIGINT NOT NULL,
+    device_type VARCHAR(50) NOT NULL DEFAULT '',
+    country_code VARCHAR(10) NOT NULL DEFAULT '',
+    hits BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (day, domain_id, device_type, country_code)
+);
+
+CREATE INDEX IF NOT EXISTS idx_access_log_rollups_daily_domain ON public.access_log_rollups_daily (domain_id, day);
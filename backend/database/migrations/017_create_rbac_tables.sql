@@ -0,0 +1,23 @@
+-- 017_create_rbac_tables.sql
+
+-- Controle de acesso por permissões. public.users.role referencia roles.id;
+-- o catálogo de permissões e as roles padrão (superadmin, admin, support e
+-- finance) são gravados pela aplicação a cada inicialização
+-- (middleware.SeedPermissions).
+CREATE TABLE IF NOT EXISTS public.roles (
+    id INTEGER PRIMARY KEY,
+    name VARCHAR(50) NOT NULL UNIQUE,
+    description TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS public.permissions (
+    name VARCHAR(100) PRIMARY KEY,
+    description TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS public.role_permissions (
+    role_id INTEGER NOT NULL REFERENCES public.roles(id) ON DELETE CASCADE,
+    permission VARCHAR(100) NOT NULL REFERENCES public.permissions(name) ON DELETE CASCADE,
+    PRIMARY KEY (role_id, permission)
+);
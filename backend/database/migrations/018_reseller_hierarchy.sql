@@ -0,0 +1,19 @@
+-- 018_reseller_hierarchy.sql
+
+-- Revendedores e subcontas. Um usuário com domain_quota definido é revendedor
+-- e pode criar subcontas (parent_id aponta para ele). A cota limita o total de
+-- domínios do revendedor somado ao das subcontas.
+ALTER TABLE public.users ADD COLUMN IF NOT EXISTS parent_id BIGINT REFERENCES public.users(id) ON DELETE RESTRICT;
+ALTER TABLE public.users ADD COLUMN IF NOT EXISTS domain_quota INTEGER;
+
+CREATE INDEX IF NOT EXISTS idx_users_parent_id ON public.users (parent_id);
+
+-- Preço cobrado pelo revendedor das suas subcontas em cada plano. Sem linha,
+-- vale o preço de public.plans.
+CREATE TABLE IF NOT EXISTS public.reseller_prices (
+    reseller_id BIGINT NOT NULL REFERENCES public.users(id) ON DELETE CASCADE,
+    plan_id BIGINT NOT NULL REFERENCES public.plans(id) ON DELETE CASCADE,
+    price NUMERIC(10, 2) NOT NULL CHECK (price > 0),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (reseller_id, plan_id)
+);
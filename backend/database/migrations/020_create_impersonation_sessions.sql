@@ -0,0 +1,26 @@
+-- 020_create_impersonation_sessions.sql
+
+-- Sessões em que um Superadmin age como outro usuário em /api/admin, para
+-- reproduzir o que o cliente vê. Guarda só o hash do token; a sessão é curta
+-- e, sem allow_writes, somente leitura.
+CREATE TABLE IF NOT EXISTS public.impersonation_sessions (
+    id BIGSERIAL PRIMARY KEY,
+    actor_id BIGINT NOT NULL REFERENCES public.users(id) ON DELETE CASCADE,
+    actor_role VARCHAR(20) NOT NULL,
+    target_id BIGINT NOT NULL REFERENCES public.users(id) ON DELETE CASCADE,
+    token_hash VARCHAR(64) NOT NULL UNIQUE,
+    allow_writes BOOLEAN NOT NULL DEFAULT FALSE,
+    reason TEXT NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    ended_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_impersonation_sessions_actor ON public.impersonation_sessions (actor_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_impersonation_sessions_target ON public.impersonation_sessions (target_id, created_at);
+
+-- Em requisições personificadas, actor_id continua sendo o Superadmin e
+-- impersonated_id é o usuário em nome de quem ele agiu.
+ALTER TABLE public.audit_log ADD COLUMN IF NOT EXISTS impersonation_id BIGINT;
+ALTER TABLE public.audit_log ADD COLUMN IF NOT EXISTS impersonated_id BIGINT;
+CREATE INDEX IF NOT EXISTS idx_audit_log_impersonation ON public.audit_log (impersonation_id) WHERE impersonation_id IS NOT NULL;
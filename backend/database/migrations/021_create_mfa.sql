@@ -0,0 +1,32 @@
+-- 021_create_mfa.sql
+
+-- Autenticação em dois fatores (TOTP). totp_secret fica gravado desde o
+-- início do cadastro; o fator só vale depois da confirmação (totp_enabled_at).
+-- totp_last_step é o último intervalo de 30 s aceito, para que um código não
+-- seja usado duas vezes.
+ALTER TABLE public.users ADD COLUMN IF NOT EXISTS totp_secret VARCHAR(64);
+ALTER TABLE public.users ADD COLUMN IF NOT EXISTS totp_enabled_at TIMESTAMPTZ;
+ALTER TABLE public.users ADD COLUMN IF NOT EXISTS totp_last_step BIGINT NOT NULL DEFAULT 0;
+
+-- Códigos de recuperação de uso único (apenas o hash SHA-256).
+CREATE TABLE IF NOT EXISTS public.user_recovery_codes (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES public.users(id) ON DELETE CASCADE,
+    code_hash VARCHAR(64) NOT NULL,
+    used_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (user_id, code_hash)
+);
+
+-- Sessões (claim session_id do access token) que já passaram pelo segundo
+-- fator. step_up_at é a verificação mais recente, exigida pelas ações
+-- sensíveis (middleware.RequireStepUp).
+CREATE TABLE IF NOT EXISTS public.mfa_sessions (
+    session_id VARCHAR(100) NOT NULL,
+    user_id BIGINT NOT NULL REFERENCES public.users(id) ON DELETE CASCADE,
+    verified_at TIMESTAMPTZ NOT NULL,
+    step_up_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (user_id, session_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_mfa_sessions_verified_at ON public.mfa_sessions (verified_at);
@@ -0,0 +1,34 @@
+-- 022_create_auth_throttle.sql
+
+-- Contadores de tentativas de login, de recuperação de senha e de códigos do
+-- segundo fator, por IP, e-mail ou usuário (middleware/throttle.go). Depois
+-- do limite, cada falha dobra o bloqueio (locked_until).
+CREATE TABLE IF NOT EXISTS public.auth_throttle (
+    id BIGSERIAL PRIMARY KEY,
+    action VARCHAR(20) NOT NULL,
+    kind VARCHAR(10) NOT NULL,
+    key VARCHAR(255) NOT NULL,
+    failures INTEGER NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMPTZ NOT NULL,
+    locked_until TIMESTAMPTZ,
+    UNIQUE (action, kind, key)
+);
+
+CREATE INDEX IF NOT EXISTS idx_auth_throttle_locked_until ON public.auth_throttle (locked_until) WHERE locked_until IS NOT NULL;
+
+-- Histórico das tentativas que falharam ou foram barradas pelo bloqueio.
+CREATE TABLE IF NOT EXISTS public.auth_failures (
+    id BIGSERIAL PRIMARY KEY,
+    action VARCHAR(20) NOT NULL,
+    ip VARCHAR(45) NOT NULL DEFAULT '',
+    email VARCHAR(255) NOT NULL DEFAULT '',
+    user_id BIGINT,
+    reason VARCHAR(50) NOT NULL,
+    user_agent TEXT NOT NULL DEFAULT '',
+    locked_until TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_auth_failures_created_at ON public.auth_failures (created_at);
+CREATE INDEX IF NOT EXISTS idx_auth_failures_email ON public.auth_failures (email, created_at);
+CREATE INDEX IF NOT EXISTS idx_auth_failures_ip ON public.auth_failures (ip, created_at);
@@ -0,0 +1,26 @@
+-- 023_create_auth_sessions.sql
+
+-- Sessões de login (claim session_id do access token), para renovar, encerrar
+-- e revogar tokens antes de expirarem (middleware/sessions.go). No modo local,
+-- refresh_token_hash guarda o hash SHA-256 do refresh token atual; no
+-- Supabase, o refresh token fica com o provedor. Uma sessão revogada
+-- (revoked_at) é recusada mesmo com o token ainda válido.
+CREATE TABLE IF NOT EXISTS public.auth_sessions (
+    id BIGSERIAL PRIMARY KEY,
+    session_id VARCHAR(100) NOT NULL UNIQUE,
+    user_id BIGINT NOT NULL REFERENCES public.users(id) ON DELETE CASCADE,
+    refresh_token_hash VARCHAR(64) UNIQUE,
+    refresh_expires_at TIMESTAMPTZ,
+    ip VARCHAR(45) NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_refreshed_at TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ,
+    revoked_reason VARCHAR(50)
+);
+
+CREATE INDEX IF NOT EXISTS idx_auth_sessions_user_id ON public.auth_sessions (user_id, created_at);
+
+-- "Encerrar todas as sessões": tokens de sessões iniciadas antes deste
+-- instante são recusados, inclusive os que o backend nunca viu.
+ALTER TABLE public.users ADD COLUMN IF NOT EXISTS sessions_revoked_at TIMESTAMPTZ;
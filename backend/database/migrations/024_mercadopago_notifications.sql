@@ -0,0 +1,32 @@
+-- 024_mercadopago_notifications.sql
+
+-- Toda notificação recebida em /api/webhook/mercadopago é gravada como
+-- chegou (payload e query), com o resultado da verificação de assinatura e do
+-- processamento, para auditoria e reprocessamento pelo Superadmin.
+CREATE TABLE IF NOT EXISTS public.mercadopago_notifications (
+    id BIGSERIAL PRIMARY KEY,
+    payload JSONB,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+ALTER TABLE public.mercadopago_notifications ADD COLUMN IF NOT EXISTS query TEXT NOT NULL DEFAULT '';
+ALTER TABLE public.mercadopago_notifications ADD COLUMN IF NOT EXISTS request_id VARCHAR(100) NOT NULL DEFAULT '';
+ALTER TABLE public.mercadopago_notifications ADD COLUMN IF NOT EXISTS topic VARCHAR(50) NOT NULL DEFAULT '';
+ALTER TABLE public.mercadopago_notifications ADD COLUMN IF NOT EXISTS resource_id VARCHAR(100) NOT NULL DEFAULT '';
+ALTER TABLE public.mercadopago_notifications ADD COLUMN IF NOT EXISTS signature_valid BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE public.mercadopago_notifications ADD COLUMN IF NOT EXISTS status VARCHAR(20) NOT NULL DEFAULT 'received';
+ALTER TABLE public.mercadopago_notifications ADD COLUMN IF NOT EXISTS error TEXT;
+ALTER TABLE public.mercadopago_notifications ADD COLUMN IF NOT EXISTS payment_id BIGINT;
+ALTER TABLE public.mercadopago_notifications ADD COLUMN IF NOT EXISTS mp_status VARCHAR(50);
+ALTER TABLE public.mercadopago_notifications ADD COLUMN IF NOT EXISTS attempts INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE public.mercadopago_notifications ADD COLUMN IF NOT EXISTS processed_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS idx_mercadopago_notifications_resource ON public.mercadopago_notifications (resource_id);
+CREATE INDEX IF NOT EXISTS idx_mercadopago_notifications_created_at ON public.mercadopago_notifications (created_at);
+
+-- Idempotência: mp_payment_id liga o pagamento local ao do MercadoPago e
+-- fulfilled_at marca que as renovações já foram aplicadas, uma única vez.
+ALTER TABLE public.payments ADD COLUMN IF NOT EXISTS mp_payment_id BIGINT;
+ALTER TABLE public.payments ADD COLUMN IF NOT EXISTS fulfilled_at TIMESTAMPTZ;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_payments_mp_payment_id ON public.payments (mp_payment_id) WHERE mp_payment_id IS NOT NULL;
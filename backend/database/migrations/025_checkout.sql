@@ -0,0 +1,6 @@
+-- 025_checkout.sql
+
+-- Preferência do MercadoPago criada no checkout de cada pagamento.
+ALTER TABLE public.payments ADD COLUMN IF NOT EXISTS mp_preference_id VARCHAR(100);
+
+CREATE INDEX IF NOT EXISTS idx_payments_user_id ON public.payments (user_id, created_at DESC);
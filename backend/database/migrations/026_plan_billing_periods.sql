@@ -0,0 +1,21 @@
+-- 026_plan_billing_periods.sql
+
+-- Período de cobrança de cada plano: monthly, quarterly, yearly ou custom
+-- (period_days dias). A renovação paga estende o domínio por esse período.
+ALTER TABLE public.plans ADD COLUMN IF NOT EXISTS billing_period VARCHAR(20) NOT NULL DEFAULT 'monthly';
+ALTER TABLE public.plans ADD COLUMN IF NOT EXISTS period_days INTEGER;
+
+-- Garante que cart_items exista (checagem de segurança)
+CREATE TABLE IF NOT EXISTS public.cart_items (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL,
+    product_type VARCHAR(50) NOT NULL,
+    product_identifier VARCHAR(255) NOT NULL,
+    price NUMERIC(10, 2) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Quantidade de períodos comprados (ex: 3 meses de um plano mensal). price é
+-- o total do item: preço do plano × periods.
+ALTER TABLE public.cart_items ADD COLUMN IF NOT EXISTS periods INTEGER NOT NULL DEFAULT 1;
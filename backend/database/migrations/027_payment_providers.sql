@@ -0,0 +1,19 @@
+-- 027_payment_providers.sql
+
+-- Pagamentos passam a ser de qualquer provedor (payment_method guarda o nome
+-- dele). provider_payment_id e provider_checkout_id substituem mp_payment_id
+-- e mp_preference_id, que ficam só para os pagamentos antigos.
+ALTER TABLE public.payments ADD COLUMN IF NOT EXISTS provider_payment_id VARCHAR(100);
+ALTER TABLE public.payments ADD COLUMN IF NOT EXISTS provider_checkout_id VARCHAR(255);
+ALTER TABLE public.payments ADD COLUMN IF NOT EXISTS currency VARCHAR(3) NOT NULL DEFAULT 'BRL';
+
+UPDATE public.payments SET provider_payment_id = mp_payment_id::text
+WHERE provider_payment_id IS NULL AND mp_payment_id IS NOT NULL;
+UPDATE public.payments SET provider_checkout_id = mp_preference_id
+WHERE provider_checkout_id IS NULL AND mp_preference_id IS NOT NULL;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_payments_provider_payment_id ON public.payments (payment_method, provider_payment_id) WHERE provider_payment_id IS NOT NULL;
+
+-- As notificações de todos os provedores ficam em mercadopago_notifications
+ALTER TABLE public.mercadopago_notifications ADD COLUMN IF NOT EXISTS provider VARCHAR(20) NOT NULL DEFAULT 'mercadopago';
+CREATE INDEX IF NOT EXISTS idx_mercadopago_notifications_provider ON public.mercadopago_notifications (provider, created_at);
@@ -0,0 +1,24 @@
+-- 028_pix_transactions.sql
+
+-- Cobranças PIX criadas pelo checkout (/api/admin/checkout/pix). Cada uma
+-- pertence a um pagamento e acompanha o status dele; expires_at é a validade
+-- do código.
+CREATE TABLE IF NOT EXISTS public.pix_transactions (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL,
+    amount NUMERIC(10, 2) NOT NULL,
+    status VARCHAR(20),
+    pix_key TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+ALTER TABLE public.pix_transactions ADD COLUMN IF NOT EXISTS payment_id BIGINT;
+ALTER TABLE public.pix_transactions ADD COLUMN IF NOT EXISTS provider VARCHAR(20);
+ALTER TABLE public.pix_transactions ADD COLUMN IF NOT EXISTS provider_payment_id VARCHAR(100);
+ALTER TABLE public.pix_transactions ADD COLUMN IF NOT EXISTS qr_code TEXT;
+ALTER TABLE public.pix_transactions ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ;
+ALTER TABLE public.pix_transactions ADD COLUMN IF NOT EXISTS paid_at TIMESTAMPTZ;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_pix_transactions_payment_id ON public.pix_transactions (payment_id) WHERE payment_id IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_pix_transactions_pending ON public.pix_transactions (expires_at) WHERE status = 'pending';
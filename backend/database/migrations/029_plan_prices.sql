@@ -0,0 +1,12 @@
+-- 029_plan_prices.sql
+
+-- Preço de cada plano em outras moedas. plans.price continua sendo o preço
+-- na moeda base (BRL); sem linha aqui, o plano não pode ser cobrado na moeda.
+-- Os preços de revenda (reseller_prices) valem só na moeda base.
+CREATE TABLE IF NOT EXISTS public.plan_prices (
+    plan_id BIGINT NOT NULL REFERENCES public.plans(id) ON DELETE CASCADE,
+    currency VARCHAR(3) NOT NULL,
+    price NUMERIC(10, 2) NOT NULL CHECK (price > 0),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (plan_id, currency)
+);
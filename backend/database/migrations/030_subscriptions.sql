@@ -0,0 +1,32 @@
+-- 030_subscriptions.sql
+
+-- Assinaturas: renovação automática de um domínio, cobrada pelo provedor a
+-- cada período do plano (MercadoPago: preapproval). Cada cobrança gera um
+-- pagamento em payments, com subscription_id, que renova o domínio.
+CREATE TABLE IF NOT EXISTS public.subscriptions (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES public.users(id) ON DELETE CASCADE,
+    domain_id BIGINT REFERENCES public.domains(id) ON DELETE SET NULL,
+    plan_id BIGINT REFERENCES public.plans(id) ON DELETE SET NULL,
+    provider VARCHAR(20) NOT NULL,
+    provider_subscription_id VARCHAR(100),
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    amount NUMERIC(10, 2) NOT NULL,
+    currency VARCHAR(3) NOT NULL DEFAULT 'BRL',
+    billing_period VARCHAR(20) NOT NULL,
+    period_days INTEGER,
+    checkout_url TEXT,
+    next_charge_at TIMESTAMPTZ,
+    last_charged_at TIMESTAMPTZ,
+    cancelled_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_subscriptions_user_id ON public.subscriptions (user_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_subscriptions_provider_id ON public.subscriptions (provider, provider_subscription_id) WHERE provider_subscription_id IS NOT NULL;
+-- Um domínio tem no máximo uma assinatura em vigor
+CREATE UNIQUE INDEX IF NOT EXISTS idx_subscriptions_active_domain ON public.subscriptions (domain_id) WHERE status IN ('pending', 'authorized', 'paused');
+
+ALTER TABLE public.payments ADD COLUMN IF NOT EXISTS subscription_id BIGINT REFERENCES public.subscriptions(id) ON DELETE SET NULL;
+CREATE INDEX IF NOT EXISTS idx_payments_subscription_id ON public.payments (subscription_id) WHERE subscription_id IS NOT NULL;
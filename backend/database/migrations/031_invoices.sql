@@ -0,0 +1,33 @@
+-- 031_invoices.sql
+
+-- Recibos dos pagamentos aprovados. Cada recibo guarda uma cópia dos itens,
+-- do cliente e dos dados da empresa no momento da emissão, para não mudar
+-- depois. payment_id fica nulo se o pagamento for apagado; o recibo continua.
+CREATE TABLE IF NOT EXISTS public.invoices (
+    id BIGSERIAL PRIMARY KEY,
+    number BIGINT NOT NULL UNIQUE,
+    payment_id BIGINT REFERENCES public.payments(id) ON DELETE SET NULL,
+    user_id BIGINT NOT NULL,
+    customer_name TEXT NOT NULL DEFAULT '',
+    customer_email TEXT NOT NULL DEFAULT '',
+    business JSONB NOT NULL DEFAULT '{}'::jsonb,
+    items JSONB NOT NULL DEFAULT '[]'::jsonb,
+    amount NUMERIC(10, 2) NOT NULL,
+    currency VARCHAR(3) NOT NULL DEFAULT 'BRL',
+    payment_method VARCHAR(20) NOT NULL DEFAULT '',
+    paid_at TIMESTAMPTZ,
+    issued_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    emailed_at TIMESTAMPTZ
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_invoices_payment_id ON public.invoices (payment_id) WHERE payment_id IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_invoices_user_id ON public.invoices (user_id);
+
+-- Numeração sequencial sem lacunas: a linha única é travada até o fim da
+-- transação que emite o recibo.
+CREATE TABLE IF NOT EXISTS public.invoice_counter (
+    id SMALLINT PRIMARY KEY CHECK (id = 1),
+    last_number BIGINT NOT NULL DEFAULT 0
+);
+
+INSERT INTO public.invoice_counter (id) VALUES (1) ON CONFLICT (id) DO NOTHING;
@@ -0,0 +1,45 @@
+-- 032_coupons.sql
+
+-- Cupons de desconto do carrinho. plan_ids vazio vale para todos os planos;
+-- max_uses e per_user_limit nulos não limitam. currency só importa para
+-- descontos fixos.
+CREATE TABLE IF NOT EXISTS public.coupons (
+    id BIGSERIAL PRIMARY KEY,
+    code VARCHAR(32) NOT NULL UNIQUE,
+    description TEXT,
+    discount_type VARCHAR(20) NOT NULL CHECK (discount_type IN ('percentage', 'fixed')),
+    value NUMERIC(10, 2) NOT NULL CHECK (value > 0),
+    currency VARCHAR(3) NOT NULL DEFAULT 'BRL',
+    expires_at TIMESTAMPTZ,
+    max_uses INTEGER CHECK (max_uses > 0),
+    per_user_limit INTEGER CHECK (per_user_limit > 0),
+    plan_ids BIGINT[] NOT NULL DEFAULT '{}',
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Cupom aplicado ao carrinho de cada usuário
+CREATE TABLE IF NOT EXISTS public.cart_coupons (
+    user_id BIGINT PRIMARY KEY REFERENCES public.users(id) ON DELETE CASCADE,
+    coupon_id BIGINT NOT NULL REFERENCES public.coupons(id) ON DELETE CASCADE,
+    applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Uso de um cupom em um pagamento. Conta para os limites enquanto o
+-- pagamento não falha, é cancelado ou devolvido. Cupons já usados não podem
+-- ser apagados, só desativados.
+CREATE TABLE IF NOT EXISTS public.coupon_redemptions (
+    id BIGSERIAL PRIMARY KEY,
+    coupon_id BIGINT NOT NULL REFERENCES public.coupons(id),
+    user_id BIGINT NOT NULL,
+    payment_id BIGINT NOT NULL UNIQUE REFERENCES public.payments(id) ON DELETE CASCADE,
+    discount NUMERIC(10, 2) NOT NULL,
+    currency VARCHAR(3) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_coupon_redemptions_coupon_user ON public.coupon_redemptions (coupon_id, user_id);
+
+ALTER TABLE public.payments ADD COLUMN IF NOT EXISTS discount NUMERIC(10, 2) NOT NULL DEFAULT 0;
+ALTER TABLE public.payments ADD COLUMN IF NOT EXISTS coupon_code VARCHAR(32);
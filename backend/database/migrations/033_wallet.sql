@@ -0,0 +1,42 @@
+-- 033_wallet.sql
+
+-- Carteira pré-paga de cada usuário, em reais. balance é o saldo atual;
+-- a linha é travada a cada lançamento. Com auto_renew, os domínios perto do
+-- vencimento são renovados com o saldo.
+CREATE TABLE IF NOT EXISTS public.wallets (
+    user_id BIGINT PRIMARY KEY REFERENCES public.users(id) ON DELETE CASCADE,
+    balance NUMERIC(12, 2) NOT NULL DEFAULT 0 CHECK (balance >= 0),
+    auto_renew BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Extrato da carteira: créditos (amount > 0) e débitos (amount < 0), com o
+-- saldo depois de cada lançamento, o motivo e a referência (payment:<id>
+-- do pagamento que o causou). created_by é o superadmin dos ajustes manuais.
+CREATE TABLE IF NOT EXISTS public.wallet_entries (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES public.users(id) ON DELETE CASCADE,
+    amount NUMERIC(12, 2) NOT NULL CHECK (amount <> 0),
+    balance NUMERIC(12, 2) NOT NULL CHECK (balance >= 0),
+    reason VARCHAR(20) NOT NULL CHECK (reason IN ('top_up', 'adjustment', 'checkout', 'reversal', 'refund', 'renewal', 'top_up_reversal')),
+    reference VARCHAR(64),
+    description TEXT,
+    created_by BIGINT REFERENCES public.users(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_wallet_entries_user ON public.wallet_entries (user_id, id DESC);
+-- Cada pagamento credita a recarga, devolve o saldo (antes da aprovação ou
+-- no reembolso) e estorna a recarga no máximo uma vez
+CREATE UNIQUE INDEX IF NOT EXISTS idx_wallet_entries_payment ON public.wallet_entries (reason, reference)
+    WHERE reason IN ('top_up', 'reversal', 'refund', 'top_up_reversal');
+
+-- Parte do pagamento paga com o saldo da carteira, e quando ela foi
+-- devolvida porque o pagamento não foi aprovado ou foi reembolsado
+ALTER TABLE public.payments ADD COLUMN IF NOT EXISTS wallet_amount NUMERIC(10, 2) NOT NULL DEFAULT 0;
+ALTER TABLE public.payments ADD COLUMN IF NOT EXISTS wallet_released_at TIMESTAMPTZ;
+
+-- Parte do estorno de uma recarga reembolsada ou contestada que o saldo não
+-- cobria mais; fica para acerto manual do superadmin
+ALTER TABLE public.payments ADD COLUMN IF NOT EXISTS wallet_shortfall NUMERIC(10, 2) NOT NULL DEFAULT 0;
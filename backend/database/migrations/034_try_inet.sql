@@ -0,0 +1,12 @@
+-- 034_try_inet.sql
+
+-- streaming_access_logs.client_ip é VARCHAR e pode guardar valores que não
+-- são IPs. try_inet converte para inet e retorna NULL quando a conversão
+-- falha, para que o filtro por CIDR da busca de logs não quebre a consulta.
+CREATE OR REPLACE FUNCTION public.try_inet(value TEXT) RETURNS inet AS $$
+BEGIN
+    RETURN value::inet;
+EXCEPTION WHEN invalid_text_representation THEN
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql IMMUTABLE;
@@ -0,0 +1,71 @@
+package admin
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"CDNProxy_v2/backend/middleware"
+	"CDNProxy_v2/backend/services/accesslogs"
+)
+
+// AccessLogsHandler busca os logs de acesso dos domínios do usuário logado e
+// das suas subcontas. O filtro user_id restringe a uma das subcontas.
+func AccessLogsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(middleware.UserIDKey).(int64)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
+		return
+	}
+
+	filter, err := accesslogs.ParseFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.ScopeUserID = userID
+	filter.IncludeSubAccounts = true
+
+	page, err := accesslogs.Search(r.Context(), filter)
+	if err != nil {
+		http.Error(w, "Error searching access logs", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// ExportAccessLogsHandler exporta em CSV ou NDJSON os logs dos domínios do
+// usuário logado e das suas subcontas.
+func ExportAccessLogsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(middleware.UserIDKey).(int64)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
+		return
+	}
+
+	filter, err := accesslogs.ParseFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.ScopeUserID = userID
+	filter.IncludeSubAccounts = true
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "ndjson" {
+		http.Error(w, "Invalid format: use csv or ndjson", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", accesslogs.ContentType(format))
+	w.Header().Set("Content-Disposition", "attachment; filename=access_logs."+format)
+
+	if err := accesslogs.Export(r.Context(), w, filter, format); err != nil {
+		log.Printf("Error exporting access logs for user %d: %v", userID, err)
+	}
+}
@@ -0,0 +1,25 @@
+package admin
+
+import (
+	"context"
+
+	"CDNProxy_v2/backend/database"
+)
+
+// ownAccounts é a subconsulta com os usuários cujos dados o usuário em param
+// enxerga em /api/admin: ele mesmo e, se for revendedor, as suas subcontas.
+// Uso: "WHERE user_id IN " + ownAccounts("$1").
+func ownAccounts(param string) string {
+	return "(SELECT id FROM public.users WHERE id = " + param + " OR parent_id = " + param + ")"
+}
+
+// ownsAccount informa se ownerID é o próprio userID ou uma subconta dele.
+func ownsAccount(ctx context.Context, userID, ownerID int64) (bool, error) {
+	if ownerID == userID {
+		return true, nil
+	}
+	var ok bool
+	err := database.DB.QueryRow(ctx,
+		"SELECT EXISTS (SELECT 1 FROM public.users WHERE id = $1 AND parent_id = $2)", ownerID, userID).Scan(&ok)
+	return ok, err
+}
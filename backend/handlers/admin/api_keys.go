@@ -0,0 +1,151 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"CDNProxy_v2/backend/database"
+	"CDNProxy_v2/backend/middleware"
+
+	"github.com/gorilla/mux"
+)
+
+const apiKeyColumns = "id, user_id, name, prefix, scopes, allowed_ips, expires_at, last_used_at, last_used_ip, revoked_at, created_at"
+
+// CreatedAPIKey é a resposta da criação; Key só é exibida nesse momento.
+type CreatedAPIKey struct {
+	middleware.APIKey
+	Key string `json:"key"`
+}
+
+// ListAPIKeys lista as chaves de API do usuário logado, inclusive as revogadas.
+func ListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(middleware.UserIDKey).(int64)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := database.DB.Query(r.Context(),
+		"SELECT "+apiKeyColumns+" FROM public.api_keys WHERE user_id = $1 ORDER BY created_at DESC", userID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to query API keys: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	keys := []middleware.APIKey{}
+	for rows.Next() {
+		var k middleware.APIKey
+		if err := rows.Scan(&k.ID, &k.UserID, &k.Name, &k.Prefix, &k.Scopes, &k.AllowedIPs, &k.ExpiresAt, &k.LastUsedAt, &k.LastUsedIP, &k.RevokedAt, &k.CreatedAt); err != nil {
+			http.Error(w, "Failed to scan API key", http.StatusInternalServerError)
+			return
+		}
+		keys = append(keys, k)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Error iterating over API keys", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+// CreateAPIKey gera uma chave para o usuário logado. A chave em claro só é
+// devolvida nesta resposta; o banco guarda apenas o hash.
+func CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(middleware.UserIDKey).(int64)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	var payload struct {
+		Name       string     `json:"name"`
+		Scopes     []string   `json:"scopes"`
+		AllowedIPs []string   `json:"allowed_ips"`
+		ExpiresAt  *time.Time `json:"expires_at"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	payload.Name = strings.TrimSpace(payload.Name)
+	if payload.Name == "" || len(payload.Name) > 100 {
+		http.Error(w, "Name is required (max 100 characters)", http.StatusBadRequest)
+		return
+	}
+	scopes, err := middleware.NormalizeScopes(payload.Scopes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	allowedIPs, err := middleware.NormalizeAllowedIPs(payload.AllowedIPs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if payload.ExpiresAt != nil && !payload.ExpiresAt.After(time.Now()) {
+		http.Error(w, "expires_at must be in the future", http.StatusBadRequest)
+		return
+	}
+
+	key, prefix, hash, err := middleware.GenerateAPIKey()
+	if err != nil {
+		http.Error(w, "Failed to generate API key", http.StatusInternalServerError)
+		return
+	}
+
+	created := CreatedAPIKey{Key: key}
+	k := &created.APIKey
+	err = database.DB.QueryRow(r.Context(), `
+		INSERT INTO public.api_keys (user_id, name, prefix, key_hash, scopes, allowed_ips, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING `+apiKeyColumns,
+		userID, payload.Name, prefix, hash, scopes, allowedIPs, payload.ExpiresAt,
+	).Scan(&k.ID, &k.UserID, &k.Name, &k.Prefix, &k.Scopes, &k.AllowedIPs, &k.ExpiresAt, &k.LastUsedAt, &k.LastUsedIP, &k.RevokedAt, &k.CreatedAt)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create API key: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(created)
+}
+
+// RevokeAPIKey revoga uma chave do usuário logado. A linha é mantida para
+// auditoria (revoked_at, last_used_at).
+func RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid API key ID", http.StatusBadRequest)
+		return
+	}
+
+	userID, ok := r.Context().Value(middleware.UserIDKey).(int64)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	tag, err := database.DB.Exec(r.Context(),
+		"UPDATE public.api_keys SET revoked_at = NOW() WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL",
+		id, userID)
+	if err != nil {
+		http.Error(w, "Failed to revoke API key", http.StatusInternalServerError)
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
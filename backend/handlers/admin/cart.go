@@ -3,19 +3,27 @@ package admin
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
-	"strconv"
 
 	"CDNProxy_v2/backend/database"
 	"CDNProxy_v2/backend/middleware"
+	"CDNProxy_v2/backend/models"
 )
 
+// CartItem é um item do carrinho. Price é o total do item: o preço do plano
+// vezes Periods, a quantidade de períodos comprados (padrão 1). PlanID é o
+// plano do domínio, usado pelos cupons restritos a planos.
 type CartItem struct {
 	ID                int64   `json:"id"`
 	UserID            int64   `json:"user_id"`
 	ProductType       string  `json:"product_type"`
 	ProductIdentifier string  `json:"product_identifier"`
 	Price             float64 `json:"price"`
+	Periods           int     `json:"periods"`
+	PlanID            int64   `json:"plan_id,omitempty"`
+	BillingPeriod     string  `json:"billing_period,omitempty"`
+	PeriodDays        *int    `json:"period_days,omitempty"`
 }
 
 func CartHandler(w http.ResponseWriter, r *http.Request) {
@@ -26,6 +34,8 @@ func CartHandler(w http.ResponseWriter, r *http.Request) {
 		getCartItems(w, r)
 	case http.MethodPost:
 		addCartItem(w, r)
+	case http.MethodPut:
+		replaceCartItems(w, r)
 	case http.MethodDelete:
 		deleteCartItem(w, r)
 	default:
@@ -40,7 +50,7 @@ func getCartItems(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rows, err := database.DB.Query(context.Background(), "SELECT id, user_id, product_type, product_identifier, price FROM public.cart_items WHERE user_id = $1", userID)
+	rows, err := database.DB.Query(context.Background(), "SELECT id, user_id, product_type, product_identifier, price, periods FROM public.cart_items WHERE user_id = $1", userID)
 	if err != nil {
 		http.Error(w, "Failed to query cart items", http.StatusInternalServerError)
 		return
@@ -50,7 +60,7 @@ func getCartItems(w http.ResponseWriter, r *http.Request) {
 	var items []CartItem
 	for rows.Next() {
 		var item CartItem
-		if err := rows.Scan(&item.ID, &item.UserID, &item.ProductType, &item.ProductIdentifier, &item.Price); err != nil {
+		if err := rows.Scan(&item.ID, &item.UserID, &item.ProductType, &item.ProductIdentifier, &item.Price, &item.Periods); err != nil {
 			http.Error(w, "Failed to scan cart item", http.StatusInternalServerError)
 			return
 		}
@@ -61,6 +71,9 @@ func getCartItems(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(items)
 }
 
+// addCartItem adiciona um item ao carrinho. Com "coupon_code" no corpo, o
+// cupom é conferido contra o carrinho mais o novo item e aplicado a ele; um
+// cupom recusado não adiciona o item.
 func addCartItem(w http.ResponseWriter, r *http.Request) {
 	userID, ok := r.Context().Value(middleware.UserIDKey).(int64)
 	if !ok {
@@ -68,52 +81,90 @@ func addCartItem(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var item CartItem
-	if err := json.NewDecoder(r.Body).Decode(&item); err != nil {
+	var body struct {
+		CartItem
+		CouponCode string `json:"coupon_code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
+	item := body.CartItem
 
 	// Forçar o user_id do token para segurança
 	item.UserID = userID
 
-	// Sever-side price validation
-	if item.ProductType == "domain_renewal" {
-		// Converter ProductIdentifier (Domain ID) para int
-		domainID, err := strconv.Atoi(item.ProductIdentifier)
-		if err != nil {
-			http.Error(w, "Invalid domain ID", http.StatusBadRequest)
+	// O preço é sempre calculado no servidor
+	err := priceCartItem(r.Context(), database.DB, userID, models.BaseCurrency, &item)
+	if errors.Is(err, errUnsupportedItem) {
+		http.Error(w, "Unsupported product type", http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, models.ErrInvalidPeriods) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Domain or Plan not found", http.StatusNotFound)
+		return
+	}
+
+	// Com cupom, o item entra no carrinho junto com o cupom
+	var coupon *CartCoupon
+	if body.CouponCode != "" {
+		if coupon, err = checkouts.applyCoupon(r.Context(), userID, body.CouponCode, &item); err != nil {
+			writeCouponStoreError(w, err)
 			return
 		}
-
-		// Buscar o preço do plano associado ao domínio
-		var planPrice float64
-		query := `
-			SELECT COALESCE(p.price, 0)
-			FROM domains d
-			JOIN plans p ON d.plan_id = p.id
-			WHERE d.id = $1 AND d.user_id = $2
-		`
-		err = database.DB.QueryRow(context.Background(), query, domainID, userID).Scan(&planPrice)
+	} else {
+		_, err = database.DB.Exec(context.Background(),
+			"INSERT INTO public.cart_items (user_id, product_type, product_identifier, price, periods) VALUES ($1, $2, $3, $4, $5)",
+			item.UserID, item.ProductType, item.ProductIdentifier, item.Price, item.Periods)
 		if err != nil {
-			http.Error(w, "Domain or Plan not found", http.StatusNotFound)
+			http.Error(w, "Failed to add item to cart", http.StatusInternalServerError)
 			return
 		}
+	}
+
+	resp := map[string]interface{}{"message": "Item added to cart successfully"}
+	if coupon != nil {
+		resp["coupon"] = coupon
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resp)
+}
 
-		item.Price = planPrice
+// replaceCartItems troca o carrinho inteiro pelos itens enviados
+// ({"items": [{"product_type", "product_identifier", "periods"}]}), com os preços
+// calculados no servidor. Uma lista vazia esvazia o carrinho.
+func replaceCartItems(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(middleware.UserIDKey).(int64)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
+		return
 	}
-	// Se houver outros tipos de produto, adicionar lógica aqui ou manter o preço do payload (se confiável)
 
-	_, err := database.DB.Exec(context.Background(),
-		"INSERT INTO public.cart_items (user_id, product_type, product_identifier, price) VALUES ($1, $2, $3, $4)",
-		item.UserID, item.ProductType, item.ProductIdentifier, item.Price)
+	var body struct {
+		Items []CartItem `json:"items"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	items, err := checkouts.replaceCart(r.Context(), userID, body.Items)
+	var itemErr *cartItemError
+	if errors.As(err, &itemErr) {
+		writeCartItemError(w, itemErr)
+		return
+	}
 	if err != nil {
-		http.Error(w, "Failed to add item to cart", http.StatusInternalServerError)
+		http.Error(w, "Failed to update cart", http.StatusInternalServerError)
 		return
 	}
 
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(map[string]string{"message": "Item added to cart successfully"})
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(items)
 }
 
 func deleteCartItem(w http.ResponseWriter, r *http.Request) {
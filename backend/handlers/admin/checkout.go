@@ -1,103 +1,621 @@
 package admin
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"math"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"CDNProxy_v2/backend/database"
+	"CDNProxy_v2/backend/middleware"
 	"CDNProxy_v2/backend/models"
-	"CDNProxy_v2/backend/services/mercadopago"
+	"CDNProxy_v2/backend/services/payments"
+	"CDNProxy_v2/backend/services/wallet"
 
-	"github.com/jackc/pgtype"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
 )
 
-// CheckoutRequest is empty now as we pull from Cart
-type CheckoutRequest struct{}
+var (
+	errCartEmpty        = errors.New("cart is empty")
+	errPaymentNotFound  = errors.New("payment not found")
+	errUnsupportedItem  = errors.New("unsupported product type")
+	errItemNotAvailable = errors.New("domain or plan not found")
+	errNoCurrencyPrice  = errors.New("plan has no price in the checkout currency")
+)
 
-func CreateCheckoutSession(w http.ResponseWriter, r *http.Request) {
-	userID := r.Context().Value("user_id").(int64)
+// paymentMethodWallet é o método dos pagamentos quitados só com o saldo da
+// carteira.
+const paymentMethodWallet = payments.MethodWallet
 
-	// Fetch User
-	var user models.User
-	err := database.DB.QueryRow(r.Context(), "SELECT id, email, name FROM public.users WHERE id = $1", userID).Scan(&user.ID, &user.Email, &user.Name)
+// Checkout é o pagamento pendente criado a partir do carrinho, com o link de
+// pagamento do provedor. Amount já desconta o cupom do carrinho, se houver,
+// e a parte paga com o saldo da carteira (WalletAmount).
+type Checkout struct {
+	PaymentID    int64      `json:"payment_id"`
+	Provider     string     `json:"provider"`
+	Status       string     `json:"status"`
+	Amount       float64    `json:"amount"`
+	Currency     string     `json:"currency"`
+	Discount     float64    `json:"discount,omitempty"`
+	CouponCode   string     `json:"coupon_code,omitempty"`
+	WalletAmount float64    `json:"wallet_amount,omitempty"`
+	Items        []CartItem `json:"items"`
+	URL          string     `json:"url"`
+	SandboxURL   string     `json:"sandbox_url"`
+}
+
+// PaymentStatus é a situação de um pagamento, consultada pelo cliente depois
+// do checkout.
+type PaymentStatus struct {
+	ID            int64      `json:"id"`
+	UserID        int64      `json:"user_id"`
+	Amount        float64    `json:"amount"`
+	Currency      string     `json:"currency"`
+	Status        string     `json:"status"`
+	PaymentMethod string     `json:"payment_method"`
+	Discount      float64    `json:"discount"`
+	CouponCode    *string    `json:"coupon_code"`
+	WalletAmount  float64    `json:"wallet_amount"`
+	PaidAt        *time.Time `json:"paid_at"`
+	FulfilledAt   *time.Time `json:"fulfilled_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+// cartItemError identifica o item do carrinho que não pode mais ser cobrado.
+type cartItemError struct {
+	item CartItem
+	err  error
+}
+
+func (e *cartItemError) Error() string {
+	return fmt.Sprintf("cart item %d (%s %s): %v", e.item.ID, e.item.ProductType, e.item.ProductIdentifier, e.err)
+}
+
+func (e *cartItemError) Unwrap() error { return e.err }
+
+// checkoutStore isola o banco do carrinho e dos pagamentos para os testes.
+type checkoutStore interface {
+	// replaceCart troca todo o carrinho do usuário por items, com o preço atual.
+	replaceCart(ctx context.Context, userID int64, items []CartItem) ([]CartItem, error)
+	// applyCoupon confere o cupom code contra o carrinho do usuário, mais
+	// extra quando não for nil (o item sendo adicionado), e o aplica ao
+	// carrinho. extra é adicionado ao carrinho na mesma transação.
+	applyCoupon(ctx context.Context, userID int64, code string, extra *CartItem) (*CartCoupon, error)
+	// cartCoupon devolve o cupom aplicado ao carrinho com o desconto atual, ou
+	// errNoCartCoupon.
+	cartCoupon(ctx context.Context, userID int64) (*CartCoupon, error)
+	// removeCoupon tira o cupom do carrinho, ou devolve errNoCartCoupon.
+	removeCoupon(ctx context.Context, userID int64) error
+	// create trava e reprecifica o carrinho em currency, confere o cupom
+	// aplicado e grava, na mesma transação, o pagamento pendente no provider,
+	// com a cópia dos itens cobrados e o uso do cupom. Com useWallet, o saldo
+	// da carteira paga o que puder do total e é debitado na hora. O pagamento
+	// que o cupom zera fica com o método paymentMethodCoupon, e o que a
+	// carteira quita, com paymentMethodWallet.
+	create(ctx context.Context, userID int64, provider, currency string, useWallet bool) (*Checkout, error)
+	// createTopUp grava o pagamento pendente no provider de uma recarga de
+	// amount na carteira do usuário.
+	createTopUp(ctx context.Context, userID int64, provider string, amount float64) (*Checkout, error)
+	// attachCheckout guarda o id do checkout criado no provedor.
+	attachCheckout(ctx context.Context, paymentID int64, checkoutID string) error
+	// fail marca o pagamento cujo checkout não pôde ser criado e devolve o
+	// saldo da carteira usado nele.
+	fail(ctx context.Context, paymentID int64) error
+	// payment devolve o pagamento do usuário ou de uma subconta dele.
+	payment(ctx context.Context, userID, paymentID int64) (*PaymentStatus, error)
+	// apply registra o estado do pagamento no provedor (como o webhook).
+	apply(ctx context.Context, paymentID int64, p *payments.Payment) error
+	payer(ctx context.Context, userID int64) (models.User, error)
+	// attachPix grava a cobrança PIX criada no provedor para o pagamento.
+	attachPix(ctx context.Context, c *Checkout, provider string, charge *payments.PixCharge) (int64, error)
+	// pix devolve a cobrança PIX do pagamento do usuário ou de uma subconta.
+	pix(ctx context.Context, userID, paymentID int64) (*PixCheckout, error)
+	// expirePix marca como expirada a cobrança ainda pendente e cancela o
+	// pagamento, se ele não foi pago.
+	expirePix(ctx context.Context, paymentID int64) error
+}
+
+// Dependências do checkout, trocadas nos testes.
+var (
+	checkouts       checkoutStore = dbCheckoutStore{}
+	paymentProvider               = payments.Get
+)
+
+// querier é atendido pelo pool e por transações.
+type querier interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// priceCartItem calcula no servidor o preço atual de item para userID em
+// currency e copia para ele o período do plano. Na moeda base, subcontas
+// pagam o preço do revendedor, quando definido; o revendedor pode renovar os
+// domínios das subcontas pelo preço do plano. Nas outras moedas vale o preço
+// do plano em plan_prices, e errNoCurrencyPrice se não houver.
+func priceCartItem(ctx context.Context, q querier, userID int64, currency string, item *CartItem) error {
+	if item.ProductType != "domain_renewal" {
+		return errUnsupportedItem
+	}
+	if item.Periods == 0 {
+		item.Periods = 1
+	}
+	if item.Periods < 1 || item.Periods > models.MaxPeriods {
+		return models.ErrInvalidPeriods
+	}
+	domainID, err := strconv.ParseInt(item.ProductIdentifier, 10, 64)
 	if err != nil {
-		http.Error(w, "User not found", http.StatusInternalServerError)
-		return
+		return errItemNotAvailable
 	}
 
-	// Fetch Cart Items
-	rows, err := database.DB.Query(r.Context(), "SELECT id, product_type, product_identifier, price FROM public.cart_items WHERE user_id = $1", userID)
+	var price *float64
+	if currency == models.BaseCurrency {
+		query := `
+			SELECT p.id, COALESCE(rp.price, p.price, 0), p.billing_period, p.period_days
+			FROM domains d
+			JOIN plans p ON d.plan_id = p.id
+			LEFT JOIN reseller_prices rp ON rp.plan_id = p.id
+				AND rp.reseller_id = (SELECT parent_id FROM users WHERE id = $2)
+			WHERE d.id = $1 AND d.user_id IN ` + ownAccounts("$2")
+		err = q.QueryRow(ctx, query, domainID, userID).Scan(&item.PlanID, &price, &item.BillingPeriod, &item.PeriodDays)
+	} else {
+		query := `
+			SELECT p.id, pp.price, p.billing_period, p.period_days
+			FROM domains d
+			JOIN plans p ON d.plan_id = p.id
+			LEFT JOIN plan_prices pp ON pp.plan_id = p.id AND pp.currency = $3
+			WHERE d.id = $1 AND d.user_id IN ` + ownAccounts("$2")
+		err = q.QueryRow(ctx, query, domainID, userID, currency).Scan(&item.PlanID, &price, &item.BillingPeriod, &item.PeriodDays)
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		return errItemNotAvailable
+	}
 	if err != nil {
-		http.Error(w, "Failed to fetch cart items", http.StatusInternalServerError)
-		return
+		return err
 	}
-	defer rows.Close()
+	if price == nil {
+		return errNoCurrencyPrice
+	}
+	item.Price = math.Round(*price*float64(item.Periods)*100) / 100
+	return nil
+}
+
+type dbCheckoutStore struct{}
 
-	var cartItems []models.CartItem
-	var mpItems []mercadopago.Item
-	var totalAmount float64
+func (dbCheckoutStore) replaceCart(ctx context.Context, userID int64, items []CartItem) ([]CartItem, error) {
+	tx, err := database.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
 
+	if _, err := tx.Exec(ctx, "DELETE FROM public.cart_items WHERE user_id = $1", userID); err != nil {
+		return nil, err
+	}
+	out := []CartItem{}
+	for _, item := range items {
+		if err := priceCartItem(ctx, tx, userID, models.BaseCurrency, &item); err != nil {
+			return nil, &cartItemError{item: item, err: err}
+		}
+		item.UserID = userID
+		err = tx.QueryRow(ctx,
+			"INSERT INTO public.cart_items (user_id, product_type, product_identifier, price, periods) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+			userID, item.ProductType, item.ProductIdentifier, item.Price, item.Periods).Scan(&item.ID)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, item)
+	}
+	return out, tx.Commit(ctx)
+}
+
+func (dbCheckoutStore) create(ctx context.Context, userID int64, provider, currency string, useWallet bool) (*Checkout, error) {
+	tx, err := database.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	// FOR UPDATE impede que o carrinho mude enquanto o pagamento é criado
+	items, err := cartItems(ctx, tx, userID, true)
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, errCartEmpty
+	}
+
+	c := &Checkout{Provider: provider, Status: payments.StatusPending, Currency: currency, Items: items}
+	for i := range items {
+		stored := items[i].Price
+		if err := priceCartItem(ctx, tx, userID, currency, &items[i]); err != nil {
+			return nil, &cartItemError{item: items[i], err: err}
+		}
+		// O carrinho guarda o preço na moeda base
+		if currency == models.BaseCurrency && items[i].Price != stored {
+			if _, err := tx.Exec(ctx, "UPDATE public.cart_items SET price = $1 WHERE id = $2", items[i].Price, items[i].ID); err != nil {
+				return nil, err
+			}
+		}
+		c.Amount += items[i].Price
+	}
+	c.Amount = math.Round(c.Amount*100) / 100
+
+	coupon, err := cartDiscount(ctx, tx, userID, items, currency, true)
+	if err != nil {
+		return nil, err
+	}
+	method := provider
+	if coupon != nil {
+		c.Discount, c.CouponCode = coupon.Discount, coupon.Code
+		c.Amount = coupon.Total
+		if c.Amount == 0 {
+			method, c.Provider = paymentMethodCoupon, paymentMethodCoupon
+		}
+	}
+	if useWallet && c.Amount > 0 {
+		balance, err := wallet.Lock(ctx, tx, userID)
+		if err != nil {
+			return nil, err
+		}
+		c.WalletAmount = math.Round(math.Min(balance, c.Amount)*100) / 100
+		c.Amount = math.Round((c.Amount-c.WalletAmount)*100) / 100
+		if c.Amount == 0 {
+			method, c.Provider = paymentMethodWallet, paymentMethodWallet
+		}
+	}
+
+	// A cópia dos itens, com o período do plano, é o que o webhook renova
+	// quando o pagamento é aprovado
+	snapshot, err := json.Marshal(items)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.QueryRow(ctx, `
+		INSERT INTO public.payments (user_id, amount, currency, status, payment_method, metadata, discount, coupon_code, created_at, updated_at)
+		VALUES ($1, $2, $3, 'pending', $4, $5, $6, NULLIF($7, ''), NOW(), NOW()) RETURNING id`,
+		userID, c.Amount, currency, method, snapshot, c.Discount, c.CouponCode).Scan(&c.PaymentID)
+	if err != nil {
+		return nil, err
+	}
+	if c.WalletAmount > 0 {
+		if err := wallet.Hold(ctx, tx, userID, c.PaymentID, c.WalletAmount); err != nil {
+			return nil, err
+		}
+	}
+	// O uso conta para os limites do cupom enquanto o pagamento não falhar
+	if coupon != nil {
+		if _, err := tx.Exec(ctx,
+			"INSERT INTO public.coupon_redemptions (coupon_id, user_id, payment_id, discount, currency) VALUES ($1, $2, $3, $4, $5)",
+			coupon.id, userID, c.PaymentID, coupon.Discount, currency); err != nil {
+			return nil, err
+		}
+	}
+	return c, tx.Commit(ctx)
+}
+
+// cartItems lê o carrinho do usuário, com os preços gravados; forUpdate
+// trava os itens até o fim da transação.
+func cartItems(ctx context.Context, tx pgx.Tx, userID int64, forUpdate bool) ([]CartItem, error) {
+	query := "SELECT id, user_id, product_type, product_identifier, price, periods FROM public.cart_items WHERE user_id = $1 ORDER BY id"
+	if forUpdate {
+		query += " FOR UPDATE"
+	}
+	rows, err := tx.Query(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []CartItem
 	for rows.Next() {
-		var item models.CartItem
-		if err := rows.Scan(&item.ID, &item.ProductType, &item.ProductIdentifier, &item.Price); err != nil {
-			http.Error(w, "Failed to scan cart item", http.StatusInternalServerError)
-			return
+		var item CartItem
+		if err := rows.Scan(&item.ID, &item.UserID, &item.ProductType, &item.ProductIdentifier, &item.Price, &item.Periods); err != nil {
+			return nil, err
 		}
-		cartItems = append(cartItems, item)
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
 
-		mpItems = append(mpItems, mercadopago.Item{
-			ID:         fmt.Sprintf("ITEM-%d", item.ID),
-			Title:      fmt.Sprintf("%s - %s", item.ProductType, item.ProductIdentifier),
-			Quantity:   1,
-			CurrencyID: "BRL",
-			UnitPrice:  item.Price,
-		})
-		totalAmount += item.Price
+func (dbCheckoutStore) attachCheckout(ctx context.Context, paymentID int64, checkoutID string) error {
+	_, err := database.DB.Exec(ctx,
+		"UPDATE public.payments SET provider_checkout_id = $1, updated_at = NOW() WHERE id = $2", checkoutID, paymentID)
+	return err
+}
+
+func (dbCheckoutStore) fail(ctx context.Context, paymentID int64) error {
+	tx, err := database.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx,
+		"UPDATE public.payments SET status = 'failed', updated_at = NOW() WHERE id = $1 AND status = 'pending'", paymentID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() > 0 {
+		if err := wallet.Release(ctx, tx, paymentID); err != nil {
+			return err
+		}
 	}
+	return tx.Commit(ctx)
+}
+
+func (dbCheckoutStore) payment(ctx context.Context, userID, paymentID int64) (*PaymentStatus, error) {
+	var p PaymentStatus
+	err := database.DB.QueryRow(ctx, `
+		SELECT id, user_id, amount::float8, currency, COALESCE(status, ''), COALESCE(payment_method, ''), discount::float8, coupon_code,
+			wallet_amount::float8, paid_at, fulfilled_at, created_at, updated_at
+		FROM public.payments WHERE id = $1 AND user_id IN `+ownAccounts("$2"), paymentID, userID,
+	).Scan(&p.ID, &p.UserID, &p.Amount, &p.Currency, &p.Status, &p.PaymentMethod, &p.Discount, &p.CouponCode,
+		&p.WalletAmount, &p.PaidAt, &p.FulfilledAt, &p.CreatedAt, &p.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errPaymentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (dbCheckoutStore) apply(ctx context.Context, paymentID int64, p *payments.Payment) error {
+	_, err := payments.Apply(ctx, paymentID, p)
+	return err
+}
+
+func (dbCheckoutStore) payer(ctx context.Context, userID int64) (models.User, error) {
+	var user models.User
+	err := database.DB.QueryRow(ctx, "SELECT id, email, name FROM public.users WHERE id = $1", userID).Scan(&user.ID, &user.Email, &user.Name)
+	return user, err
+}
 
-	if len(cartItems) == 0 {
+// writeCartItemError responde 409 para itens que não podem mais ser cobrados
+// e 400 para tipos de produto desconhecidos e quantidades inválidas.
+func writeCartItemError(w http.ResponseWriter, err *cartItemError) {
+	status := http.StatusConflict
+	if errors.Is(err, errUnsupportedItem) || errors.Is(err, models.ErrInvalidPeriods) {
+		status = http.StatusBadRequest
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": err.err.Error(), "item": err.item})
+}
+
+// frontendURL é a raiz do painel, para onde os provedores devolvem o cliente.
+func frontendURL() string {
+	if u := os.Getenv("FRONTEND_URL"); u != "" {
+		return u
+	}
+	return "https://app.cdnproxy.top"
+}
+
+// writeCreateError responde à falha de checkouts.create.
+func writeCreateError(w http.ResponseWriter, userID int64, err error) {
+	var (
+		itemErr   *cartItemError
+		couponErr *couponError
+	)
+	switch {
+	case errors.Is(err, errCartEmpty):
 		http.Error(w, "Cart is empty", http.StatusBadRequest)
+	case errors.As(err, &itemErr):
+		writeCartItemError(w, itemErr)
+	case errors.As(err, &couponErr):
+		writeCouponError(w, couponErr)
+	default:
+		log.Printf("ERROR: Checkout of user %d failed: %v", userID, err)
+		http.Error(w, "Failed to create payment record", http.StatusInternalServerError)
+	}
+}
+
+// CreateCheckoutSession cria o pagamento do carrinho: reprecifica cada item
+// no servidor, grava o pagamento pendente junto com a cópia do carrinho e
+// devolve o link de pagamento do provedor. O corpo opcional
+// {"provider": "stripe", "currency": "USD", "use_wallet": true} escolhe o
+// provedor e a moeda; sem eles valem o provedor padrão e a moeda padrão dele.
+// use_wallet paga com o saldo da carteira o que ele cobrir, só em BRL.
+func CreateCheckoutSession(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(middleware.UserIDKey).(int64)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
 		return
 	}
 
-	// Get Frontend URL
-	frontendURL := os.Getenv("FRONTEND_URL")
-	if frontendURL == "" {
-		frontendURL = "https://app.cdnproxy.top"
+	var body struct {
+		Provider  string `json:"provider"`
+		Currency  string `json:"currency"`
+		UseWallet bool   `json:"use_wallet"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+	provider, err := paymentProvider(body.Provider)
+	if err != nil {
+		http.Error(w, "Unknown payment provider", http.StatusBadRequest)
+		return
+	}
+	currency := strings.ToUpper(provider.Currency())
+	if body.Currency != "" {
+		if currency, err = models.NormalizeCurrency(body.Currency); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !payments.SupportsCurrency(provider, currency) {
+			http.Error(w, fmt.Sprintf("Payment provider %s does not charge in %s", provider.Name(), currency), http.StatusBadRequest)
+			return
+		}
+	}
+	if body.UseWallet && currency != wallet.Currency {
+		http.Error(w, "The wallet balance can only pay checkouts in "+wallet.Currency, http.StatusBadRequest)
+		return
 	}
 
-	// Create Payment Record (Pending)
-	// We store the cart items snapshot in metadata to process later in webhook
-	cartJSON, _ := json.Marshal(cartItems)
-	metadata := pgtype.JSONB{}
-	metadata.Set(cartJSON)
+	user, err := checkouts.payer(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusInternalServerError)
+		return
+	}
 
-	var paymentID int64
-	err = database.DB.QueryRow(r.Context(),
-		"INSERT INTO public.payments (user_id, amount, status, payment_method, metadata, created_at, updated_at) VALUES ($1, $2, 'pending', 'mercadopago', $3, NOW(), NOW()) RETURNING id",
-		userID, totalAmount, metadata).Scan(&paymentID)
+	c, err := checkouts.create(r.Context(), userID, provider.Name(), currency, body.UseWallet)
+	if err != nil {
+		writeCreateError(w, userID, err)
+		return
+	}
+	if c.Amount == 0 {
+		writeFreeCheckout(w, r, c)
+		return
+	}
+	writeProviderCheckout(w, r, provider, user, c)
+}
 
+// writeProviderCheckout cria no provedor o checkout do pagamento pendente c e
+// responde 201 com o link. Se o provedor falhar, o pagamento é marcado como
+// falho e o saldo da carteira usado nele volta.
+func writeProviderCheckout(w http.ResponseWriter, r *http.Request, provider payments.Provider, user models.User, c *Checkout) {
+	baseURL := frontendURL()
+
+	// external_reference é o id do pagamento, usado pelo webhook
+	req := &payments.CheckoutRequest{
+		ExternalReference: strconv.FormatInt(c.PaymentID, 10),
+		Currency:          c.Currency,
+		Payer:             payments.Payer{Email: user.Email},
+		SuccessURL:        baseURL + "/admin/cart?status=success",
+		FailureURL:        baseURL + "/admin/cart?status=failure",
+		PendingURL:        baseURL + "/admin/cart?status=pending",
+	}
+	if user.Name != nil {
+		req.Payer.Name = *user.Name
+	}
+	req.Items = checkoutLineItems(c)
+
+	session, err := provider.CreateCheckout(r.Context(), req)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to create payment record: %v", err), http.StatusInternalServerError)
+		log.Printf("ERROR: Could not create %s checkout for payment %d: %v", provider.Name(), c.PaymentID, err)
+		if err := checkouts.fail(r.Context(), c.PaymentID); err != nil {
+			log.Printf("ERROR: Could not mark payment %d as failed: %v", c.PaymentID, err)
+		}
+		http.Error(w, "Failed to create checkout preference", http.StatusBadGateway)
 		return
 	}
+	if err := checkouts.attachCheckout(r.Context(), c.PaymentID, session.ID); err != nil {
+		log.Printf("ERROR: Could not store checkout of payment %d: %v", c.PaymentID, err)
+	}
+	c.URL, c.SandboxURL = session.URL, session.SandboxURL
 
-	// Call MP Service
-	mpService := mercadopago.NewService()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(c)
+}
 
-	// We need to modify CreatePreference to accept list of items and external reference = paymentID
-	pref, err := mpService.CreatePreferenceFromItems(mpItems, user, frontendURL, strconv.FormatInt(paymentID, 10))
+// checkoutLineItems monta os itens cobrados pelo provedor. Com desconto ou
+// saldo da carteira, o pedido vai como um item só, pelo total, para que a soma
+// confira com o valor do pagamento.
+func checkoutLineItems(c *Checkout) []payments.LineItem {
+	if c.Discount > 0 || c.WalletAmount > 0 {
+		title := fmt.Sprintf("CDNProxy - pedido #%d", c.PaymentID)
+		if c.Discount > 0 {
+			title += fmt.Sprintf(" (cupom %s)", c.CouponCode)
+		}
+		return []payments.LineItem{{
+			ID:        fmt.Sprintf("ORDER-%d", c.PaymentID),
+			Title:     title,
+			Quantity:  1,
+			UnitPrice: c.Amount,
+		}}
+	}
+	var items []payments.LineItem
+	for _, item := range c.Items {
+		id, title := fmt.Sprintf("ITEM-%d", item.ID), fmt.Sprintf("%s - %s (%dx %s)", item.ProductType, item.ProductIdentifier, item.Periods, item.BillingPeriod)
+		if item.ProductType == models.ProductWalletTopUp {
+			id, title = fmt.Sprintf("TOPUP-%d", c.PaymentID), "CDNProxy - recarga da carteira"
+		}
+		items = append(items, payments.LineItem{
+			ID:        id,
+			Title:     title,
+			Quantity:  1,
+			UnitPrice: item.Price,
+		})
+	}
+	return items
+}
+
+// writeFreeCheckout aprova na hora o pagamento que o cupom ou o saldo da
+// carteira zerou, sem passar pelo provedor, e responde como
+// CreateCheckoutSession, sem link.
+func writeFreeCheckout(w http.ResponseWriter, r *http.Request, c *Checkout) {
+	err := checkouts.apply(r.Context(), c.PaymentID, &payments.Payment{Status: payments.StatusApproved, Currency: c.Currency})
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to create checkout preference: %v", err), http.StatusInternalServerError)
+		log.Printf("ERROR: Could not settle free payment %d: %v", c.PaymentID, err)
+		http.Error(w, "Failed to settle payment", http.StatusInternalServerError)
 		return
 	}
+	c.Status = payments.StatusApproved
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"url":         pref.InitPoint,
-		"sandbox_url": pref.SandboxInitPoint,
-	})
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(c)
+}
+
+// pollableStatuses são os status que ainda podem mudar no provedor.
+var pollableStatuses = map[string]bool{payments.StatusPending: true, payments.StatusInProcess: true, payments.StatusAuthorized: true}
+
+// GetPaymentStatus devolve a situação do pagamento {id}. Enquanto estiver
+// pendente, consulta também o provedor do pagamento, para o caso de o webhook
+// ainda não ter chegado.
+func GetPaymentStatus(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(middleware.UserIDKey).(int64)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
+		return
+	}
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid payment ID", http.StatusBadRequest)
+		return
+	}
+
+	p, err := checkouts.payment(r.Context(), userID, id)
+	if errors.Is(err, errPaymentNotFound) {
+		http.Error(w, "Payment not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to query payment", http.StatusInternalServerError)
+		return
+	}
+
+	// Pagamentos manuais não têm provedor para consultar
+	if provider, err := paymentProvider(p.PaymentMethod); err == nil && p.PaymentMethod != "" && pollableStatuses[p.Status] {
+		if refreshed, err := syncPayment(r.Context(), provider, userID, p); err != nil {
+			log.Printf("WARN: Could not sync payment %d with %s: %v", p.ID, p.PaymentMethod, err)
+		} else {
+			p = refreshed
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+func syncPayment(ctx context.Context, provider payments.Provider, userID int64, p *PaymentStatus) (*PaymentStatus, error) {
+	remote, err := provider.FindPayment(ctx, strconv.FormatInt(p.ID, 10))
+	if err != nil || remote == nil || remote.Status == p.Status {
+		return p, err
+	}
+	if err := checkouts.apply(ctx, p.ID, remote); err != nil {
+		return nil, err
+	}
+	return checkouts.payment(ctx, userID, p.ID)
 }
@@ -0,0 +1,605 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"CDNProxy_v2/backend/middleware"
+	"CDNProxy_v2/backend/models"
+	"CDNProxy_v2/backend/services/mercadopago"
+	"CDNProxy_v2/backend/services/payments"
+	"CDNProxy_v2/backend/services/stripe"
+
+	"github.com/gorilla/mux"
+)
+
+// fakeCheckoutStore guarda carrinhos e pagamentos em memória. prices é o
+// preço atual de cada domínio que o usuário pode renovar, foreign o preço do
+// domínio em outras moedas e plans o plano do domínio (1 quando ausente).
+// balances é o saldo da carteira de cada usuário e released os pagamentos
+// cujo saldo já foi devolvido.
+type fakeCheckoutStore struct {
+	mu          sync.Mutex
+	prices      map[int64]map[string]float64
+	foreign     map[string]map[string]float64
+	plans       map[string]int64
+	carts       map[int64][]CartItem
+	payments    map[int64]*PaymentStatus
+	items       map[int64][]CartItem
+	pixes       map[int64]*PixCheckout
+	coupons     map[string]*models.Coupon
+	cartCoupons map[int64]string
+	redemptions []fakeRedemption
+	balances    map[int64]float64
+	released    map[int64]bool
+	nextID      int64
+}
+
+func newFakeCheckoutStore() *fakeCheckoutStore {
+	return &fakeCheckoutStore{
+		prices:      map[int64]map[string]float64{},
+		foreign:     map[string]map[string]float64{},
+		plans:       map[string]int64{},
+		carts:       map[int64][]CartItem{},
+		payments:    map[int64]*PaymentStatus{},
+		items:       map[int64][]CartItem{},
+		pixes:       map[int64]*PixCheckout{},
+		coupons:     map[string]*models.Coupon{},
+		cartCoupons: map[int64]string{},
+		balances:    map[int64]float64{},
+		released:    map[int64]bool{},
+	}
+}
+
+// price segue priceCartItem, com planos mensais.
+func (s *fakeCheckoutStore) price(userID int64, currency string, item *CartItem) error {
+	if item.ProductType != "domain_renewal" {
+		return errUnsupportedItem
+	}
+	if item.Periods == 0 {
+		item.Periods = 1
+	}
+	if item.Periods < 1 || item.Periods > models.MaxPeriods {
+		return models.ErrInvalidPeriods
+	}
+	price, ok := s.prices[userID][item.ProductIdentifier]
+	if !ok {
+		return errItemNotAvailable
+	}
+	if currency != models.BaseCurrency {
+		if price, ok = s.foreign[currency][item.ProductIdentifier]; !ok {
+			return errNoCurrencyPrice
+		}
+	}
+	item.Price, item.BillingPeriod = price*float64(item.Periods), models.PeriodMonthly
+	item.PlanID = 1
+	if planID, ok := s.plans[item.ProductIdentifier]; ok {
+		item.PlanID = planID
+	}
+	return nil
+}
+
+func (s *fakeCheckoutStore) replaceCart(_ context.Context, userID int64, items []CartItem) ([]CartItem, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := []CartItem{}
+	for _, item := range items {
+		if err := s.price(userID, models.BaseCurrency, &item); err != nil {
+			return nil, &cartItemError{item: item, err: err}
+		}
+		s.nextID++
+		item.ID, item.UserID = s.nextID, userID
+		out = append(out, item)
+	}
+	s.carts[userID] = append([]CartItem(nil), out...)
+	return out, nil
+}
+
+func (s *fakeCheckoutStore) create(_ context.Context, userID int64, provider, currency string, useWallet bool) (*Checkout, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cart := s.carts[userID]
+	if len(cart) == 0 {
+		return nil, errCartEmpty
+	}
+	c := &Checkout{Provider: provider, Status: "pending", Currency: currency}
+	for i := range cart {
+		if err := s.price(userID, currency, &cart[i]); err != nil {
+			return nil, &cartItemError{item: cart[i], err: err}
+		}
+		c.Amount += cart[i].Price
+	}
+	c.Items = append([]CartItem(nil), cart...)
+	var coupon *CartCoupon
+	if code, ok := s.cartCoupons[userID]; ok {
+		var err error
+		if coupon, err = s.evaluateCoupon(code, userID, c.Items, currency); err != nil {
+			return nil, err
+		}
+		c.Discount, c.CouponCode, c.Amount = coupon.Discount, coupon.Code, coupon.Total
+		if c.Amount == 0 {
+			c.Provider = paymentMethodCoupon
+		}
+	}
+	if useWallet && c.Amount > 0 {
+		c.WalletAmount = math.Min(s.balances[userID], c.Amount)
+		c.Amount = math.Round((c.Amount-c.WalletAmount)*100) / 100
+		s.balances[userID] -= c.WalletAmount
+		if c.Amount == 0 {
+			c.Provider = paymentMethodWallet
+		}
+	}
+	s.nextID++
+	c.PaymentID = s.nextID
+	now := time.Now()
+	s.payments[c.PaymentID] = &PaymentStatus{ID: c.PaymentID, UserID: userID, Amount: c.Amount, Currency: currency, Status: "pending",
+		PaymentMethod: c.Provider, Discount: c.Discount, WalletAmount: c.WalletAmount, CreatedAt: now, UpdatedAt: now}
+	s.items[c.PaymentID] = c.Items
+	if coupon != nil {
+		s.payments[c.PaymentID].CouponCode = &coupon.Code
+		s.redemptions = append(s.redemptions, fakeRedemption{code: coupon.Code, userID: userID, paymentID: c.PaymentID})
+	}
+	return c, nil
+}
+
+func (s *fakeCheckoutStore) createTopUp(_ context.Context, userID int64, provider string, amount float64) (*Checkout, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	item := CartItem{UserID: userID, ProductType: models.ProductWalletTopUp, ProductIdentifier: strconv.FormatInt(userID, 10), Price: amount, Periods: 1}
+	c := &Checkout{PaymentID: s.nextID, Provider: provider, Status: "pending", Amount: amount, Currency: models.BaseCurrency, Items: []CartItem{item}}
+	now := time.Now()
+	s.payments[c.PaymentID] = &PaymentStatus{ID: c.PaymentID, UserID: userID, Amount: amount, Currency: c.Currency, Status: "pending",
+		PaymentMethod: provider, CreatedAt: now, UpdatedAt: now}
+	s.items[c.PaymentID] = c.Items
+	return c, nil
+}
+
+// release segue wallet.Release: o saldo do pagamento não entregue volta uma
+// única vez.
+func (s *fakeCheckoutStore) release(p *PaymentStatus) {
+	if p.WalletAmount > 0 && p.FulfilledAt == nil && !s.released[p.ID] {
+		s.balances[p.UserID] += p.WalletAmount
+		s.released[p.ID] = true
+	}
+}
+
+func (s *fakeCheckoutStore) attachCheckout(context.Context, int64, string) error { return nil }
+
+func (s *fakeCheckoutStore) fail(_ context.Context, paymentID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.payments[paymentID].Status = "failed"
+	s.release(s.payments[paymentID])
+	return nil
+}
+
+func (s *fakeCheckoutStore) payment(_ context.Context, userID, paymentID int64) (*PaymentStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.payments[paymentID]
+	if !ok || p.UserID != userID {
+		return nil, errPaymentNotFound
+	}
+	copy := *p
+	return &copy, nil
+}
+
+// apply segue payments.Apply: a aprovação confere o valor, marca o
+// pagamento como entregue uma única vez, credita as recargas e tira do
+// carrinho os itens pagos; a recusa devolve o saldo da carteira.
+func (s *fakeCheckoutStore) apply(_ context.Context, paymentID int64, mp *payments.Payment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := s.payments[paymentID]
+	if p.FulfilledAt != nil {
+		return nil
+	}
+	p.Status = mp.Status
+	pix := s.pixes[paymentID]
+	if pix != nil {
+		pix.Status = mp.Status
+	}
+	if mp.Status == "approved" {
+		if math.Abs(mp.Amount-p.Amount) > 0.005 {
+			return nil
+		}
+		now := time.Now()
+		p.PaidAt, p.FulfilledAt = &now, &now
+		if pix != nil {
+			pix.PaidAt = &now
+		}
+		topUp := false
+		for _, item := range s.items[paymentID] {
+			if item.ProductType == models.ProductWalletTopUp {
+				s.balances[p.UserID] += item.Price
+				topUp = true
+			}
+		}
+		if !topUp {
+			s.clearPaidCart(p)
+		}
+	}
+	if mp.Status == "rejected" || mp.Status == "cancelled" {
+		s.release(p)
+	}
+	return nil
+}
+
+// clearPaidCart segue payments.Apply: tira do carrinho só os itens pagos e o
+// cupom usado no pagamento. Deve ser chamado com s.mu travado.
+func (s *fakeCheckoutStore) clearPaidCart(p *PaymentStatus) {
+	paid := map[int64]bool{}
+	for _, item := range s.items[p.ID] {
+		paid[item.ID] = true
+	}
+	var kept []CartItem
+	for _, item := range s.carts[p.UserID] {
+		if !paid[item.ID] {
+			kept = append(kept, item)
+		}
+	}
+	s.carts[p.UserID] = kept
+	if p.CouponCode != nil && s.cartCoupons[p.UserID] == *p.CouponCode {
+		delete(s.cartCoupons, p.UserID)
+	}
+}
+
+func (s *fakeCheckoutStore) attachPix(_ context.Context, c *Checkout, provider string, charge *payments.PixCharge) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	s.pixes[c.PaymentID] = &PixCheckout{PaymentID: c.PaymentID, TransactionID: s.nextID, Provider: provider, Status: charge.Status,
+		Amount: c.Amount, Currency: c.Currency, Code: charge.Code, ExpiresAt: charge.ExpiresAt, ProviderPaymentID: charge.PaymentID}
+	return s.nextID, nil
+}
+
+func (s *fakeCheckoutStore) pix(_ context.Context, userID, paymentID int64) (*PixCheckout, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pc, ok := s.pixes[paymentID]
+	if !ok || s.payments[paymentID].UserID != userID {
+		return nil, errPixNotFound
+	}
+	copy := *pc
+	return &copy, nil
+}
+
+// expirePix segue dbCheckoutStore.expirePix: só a cobrança pendente expira,
+// e o pagamento é cancelado se ainda não foi entregue.
+func (s *fakeCheckoutStore) expirePix(_ context.Context, paymentID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pc := s.pixes[paymentID]
+	if pc.Status != "pending" {
+		return nil
+	}
+	pc.Status = pixExpired
+	if p := s.payments[paymentID]; p.Status == "pending" && p.FulfilledAt == nil {
+		p.Status = "cancelled"
+		s.release(p)
+	}
+	return nil
+}
+
+func (s *fakeCheckoutStore) payer(_ context.Context, userID int64) (models.User, error) {
+	return models.User{ID: userID, Email: "cliente@example.com"}, nil
+}
+
+// fakeMercadoPago simula a API do MercadoPago: guarda as preferências, os
+// pagamentos PIX e as assinaturas criadas e responde a busca de pagamentos
+// por external_reference e a consulta por id.
+type fakeMercadoPago struct {
+	mu           sync.Mutex
+	preferences  []mercadopago.PreferenceRequest
+	payments     map[string]mercadopago.PaymentResponse
+	pix          []mercadopago.PixPaymentRequest
+	byID         map[string]mercadopago.PaymentResponse
+	preapprovals map[string]*mercadopago.PreapprovalResponse
+	subscribed   []mercadopago.PreapprovalRequest
+	failPrefs    bool
+}
+
+func (m *fakeMercadoPago) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if r.Header.Get("Authorization") != "Bearer TEST-TOKEN" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/checkout/preferences":
+		if m.failPrefs {
+			http.Error(w, `{"message":"invalid"}`, http.StatusBadRequest)
+			return
+		}
+		var pref mercadopago.PreferenceRequest
+		json.NewDecoder(r.Body).Decode(&pref)
+		m.preferences = append(m.preferences, pref)
+		id := "pref-" + pref.ExternalReference
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(mercadopago.PreferenceResponse{ID: id, InitPoint: "https://mp.test/" + id, SandboxInitPoint: "https://sandbox.mp.test/" + id})
+	case r.Method == "GET" && r.URL.Path == "/v1/payments/search":
+		results := []mercadopago.PaymentResponse{}
+		if p, ok := m.payments[r.URL.Query().Get("external_reference")]; ok {
+			results = append(results, p)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"results": results})
+	case r.Method == "POST" && r.URL.Path == "/v1/payments":
+		var req mercadopago.PixPaymentRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		m.pix = append(m.pix, req)
+		id := int64(700 + len(m.pix))
+		m.byID[strconv.FormatInt(id, 10)] = mercadopago.PaymentResponse{ID: id, Status: "pending", ExternalReference: req.ExternalReference,
+			TransactionAmount: req.TransactionAmount, CurrencyID: "BRL"}
+		var resp mercadopago.PixPaymentResponse
+		resp.ID, resp.Status, resp.DateOfExpiration = id, "pending", req.DateOfExpiration
+		resp.PointOfInteraction.TransactionData.QRCode = "00020126580014br.gov.bcb.pix0136" + req.ExternalReference + "6304ABCD"
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(resp)
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/v1/payments/"):
+		p, ok := m.byID[strings.TrimPrefix(r.URL.Path, "/v1/payments/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(p)
+	case r.Method == "POST" && r.URL.Path == "/preapproval":
+		if m.failPrefs {
+			http.Error(w, `{"message":"invalid"}`, http.StatusBadRequest)
+			return
+		}
+		var req mercadopago.PreapprovalRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		m.subscribed = append(m.subscribed, req)
+		id := "pre-" + req.ExternalReference
+		m.preapprovals[id] = &mercadopago.PreapprovalResponse{ID: id, Status: req.Status, ExternalReference: req.ExternalReference,
+			InitPoint: "https://mp.test/subscriptions/" + id}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(m.preapprovals[id])
+	case strings.HasPrefix(r.URL.Path, "/preapproval/"):
+		p, ok := m.preapprovals[strings.TrimPrefix(r.URL.Path, "/preapproval/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method == "PUT" {
+			var body struct {
+				Status string `json:"status"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			p.Status = body.Status
+		}
+		json.NewEncoder(w).Encode(p)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+type checkoutEnv struct {
+	store  *fakeCheckoutStore
+	mp     *fakeMercadoPago
+	router *mux.Router
+}
+
+func newCheckoutEnv(t *testing.T) *checkoutEnv {
+	t.Helper()
+	env := &checkoutEnv{store: newFakeCheckoutStore(), mp: &fakeMercadoPago{payments: map[string]mercadopago.PaymentResponse{},
+		byID: map[string]mercadopago.PaymentResponse{}, preapprovals: map[string]*mercadopago.PreapprovalResponse{}}}
+	srv := httptest.NewServer(env.mp)
+	t.Cleanup(srv.Close)
+
+	// O provedor real do MercadoPago, apontado para o servidor falso
+	mp := mercadopago.NewProvider(mercadopago.Config{Client: srv.Client(), BaseURL: srv.URL, AccessToken: "TEST-TOKEN"})
+	prevStore, prevProvider := checkouts, paymentProvider
+	checkouts = env.store
+	paymentProvider = func(name string) (payments.Provider, error) {
+		if name != "" && name != mp.Name() {
+			return nil, payments.ErrUnknownProvider
+		}
+		return mp, nil
+	}
+	t.Cleanup(func() { checkouts, paymentProvider = prevStore, prevProvider })
+
+	env.router = mux.NewRouter()
+	env.router.HandleFunc("/api/admin/cart", CartHandler).Methods("PUT")
+	env.router.HandleFunc("/api/admin/checkout", CreateCheckoutSession).Methods("POST")
+	env.router.HandleFunc("/api/admin/payments/{id}", GetPaymentStatus).Methods("GET")
+	env.router.HandleFunc("/api/admin/checkout/pix", CreatePixCharge).Methods("POST")
+	env.router.HandleFunc("/api/admin/payments/{id}/pix", GetPixCharge).Methods("GET")
+	env.router.HandleFunc("/api/admin/payments/{id}/pix/qrcode.png", GetPixQRCode).Methods("GET")
+	return env
+}
+
+func (env *checkoutEnv) call(t *testing.T, userID int64, method, path, body string, out interface{}) int {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req = req.WithContext(context.WithValue(req.Context(), middleware.UserIDKey, userID))
+	rec := httptest.NewRecorder()
+	env.router.ServeHTTP(rec, req)
+	if out != nil && rec.Code < 300 {
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s: resposta inválida %q: %v", method, path, rec.Body.String(), err)
+		}
+	}
+	return rec.Code
+}
+
+func TestCheckoutEndToEnd(t *testing.T) {
+	env := newCheckoutEnv(t)
+	env.store.prices[5] = map[string]float64{"10": 30, "11": 45}
+
+	// O preço enviado pelo cliente é ignorado
+	var cart []CartItem
+	code := env.call(t, 5, "PUT", "/api/admin/cart",
+		`{"items":[{"product_type":"domain_renewal","product_identifier":"10","price":1},{"product_type":"domain_renewal","product_identifier":"11","periods":3}]}`, &cart)
+	if code != http.StatusOK || len(cart) != 2 || cart[0].Price != 30 || cart[1].Price != 135 || cart[0].Periods != 1 {
+		t.Fatalf("PUT /cart: status %d, itens %+v", code, cart)
+	}
+
+	// O plano do domínio 10 ficou mais caro depois de ir para o carrinho
+	env.store.prices[5]["10"] = 35
+
+	if code := env.call(t, 5, "POST", "/api/admin/checkout", `{"provider":"paypal"}`, nil); code != http.StatusBadRequest {
+		t.Errorf("checkout com provedor desconhecido: status %d, esperado 400", code)
+	}
+
+	var c Checkout
+	if code := env.call(t, 5, "POST", "/api/admin/checkout", `{"provider":"mercadopago"}`, &c); code != http.StatusCreated {
+		t.Fatalf("POST /checkout: status %d", code)
+	}
+	if c.Amount != 170 || c.Status != "pending" || c.URL == "" || c.Provider != "mercadopago" || c.Currency != "BRL" {
+		t.Errorf("checkout inesperado: %+v", c)
+	}
+	if len(env.mp.preferences) != 1 {
+		t.Fatalf("esperada 1 preferência no MercadoPago, recebeu %d", len(env.mp.preferences))
+	}
+	pref := env.mp.preferences[0]
+	if pref.ExternalReference != strconv.FormatInt(c.PaymentID, 10) {
+		t.Errorf("external_reference = %q, esperado o id do pagamento %d", pref.ExternalReference, c.PaymentID)
+	}
+	var total float64
+	for _, item := range pref.Items {
+		total += item.UnitPrice * float64(item.Quantity)
+	}
+	if total != 170 || pref.Items[0].UnitPrice != 35 || pref.Items[0].CurrencyID != "BRL" {
+		t.Errorf("itens da preferência sem o preço atual: %+v", pref.Items)
+	}
+	if snap := env.store.items[c.PaymentID]; len(snap) != 2 || snap[0].Price != 35 || snap[1].Periods != 3 || snap[1].BillingPeriod != models.PeriodMonthly {
+		t.Errorf("cópia do carrinho no pagamento: %+v", snap)
+	}
+
+	path := "/api/admin/payments/" + strconv.FormatInt(c.PaymentID, 10)
+	var status PaymentStatus
+	if code := env.call(t, 5, "GET", path, "", &status); code != http.StatusOK || status.Status != "pending" || status.PaymentMethod != "mercadopago" {
+		t.Fatalf("antes do pagamento: status %d, %+v", code, status)
+	}
+
+	// Outro usuário não vê o pagamento
+	if code := env.call(t, 6, "GET", path, "", nil); code != http.StatusNotFound {
+		t.Errorf("pagamento de outro usuário: status %d, esperado 404", code)
+	}
+
+	// Sem o webhook, a consulta busca a aprovação no MercadoPago
+	env.mp.payments[pref.ExternalReference] = mercadopago.PaymentResponse{ID: 900, Status: "approved", ExternalReference: pref.ExternalReference, TransactionAmount: 170, CurrencyID: "BRL"}
+	if code := env.call(t, 5, "GET", path, "", &status); code != http.StatusOK || status.Status != "approved" || status.FulfilledAt == nil {
+		t.Fatalf("depois do pagamento: status %d, %+v", code, status)
+	}
+	if len(env.store.carts[5]) != 0 {
+		t.Errorf("carrinho não foi esvaziado: %+v", env.store.carts[5])
+	}
+
+	if code := env.call(t, 5, "POST", "/api/admin/checkout", "", nil); code != http.StatusBadRequest {
+		t.Errorf("checkout com carrinho vazio: status %d, esperado 400", code)
+	}
+}
+
+func TestCheckoutErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		cart      string
+		setup     func(env *checkoutEnv)
+		want      int
+		wantState string
+	}{
+		{"tipo de produto desconhecido", `{"items":[{"product_type":"gift","product_identifier":"1"}]}`, nil, http.StatusBadRequest, ""},
+		{"quantidade de períodos inválida", `{"items":[{"product_type":"domain_renewal","product_identifier":"10","periods":37}]}`, nil, http.StatusBadRequest, ""},
+		{"domínio de outro usuário", `{"items":[{"product_type":"domain_renewal","product_identifier":"99"}]}`, nil, http.StatusConflict, ""},
+		{"domínio removido antes do checkout", `{"items":[{"product_type":"domain_renewal","product_identifier":"10"}]}`,
+			func(env *checkoutEnv) { delete(env.store.prices[5], "10") }, http.StatusConflict, ""},
+		{"MercadoPago recusa a preferência", `{"items":[{"product_type":"domain_renewal","product_identifier":"10"}]}`,
+			func(env *checkoutEnv) { env.mp.failPrefs = true }, http.StatusBadGateway, "failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newCheckoutEnv(t)
+			env.store.prices[5] = map[string]float64{"10": 30}
+
+			code := env.call(t, 5, "PUT", "/api/admin/cart", tt.cart, nil)
+			if code != http.StatusOK {
+				if code != tt.want {
+					t.Fatalf("PUT /cart: status %d, esperado %d", code, tt.want)
+				}
+				return
+			}
+			if tt.setup != nil {
+				tt.setup(env)
+			}
+			if code := env.call(t, 5, "POST", "/api/admin/checkout", "", nil); code != tt.want {
+				t.Errorf("POST /checkout: status %d, esperado %d", code, tt.want)
+			}
+			for _, p := range env.store.payments {
+				if p.Status != tt.wantState {
+					t.Errorf("pagamento ficou %q, esperado %q", p.Status, tt.wantState)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckoutCurrency(t *testing.T) {
+	var stripeForm url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		stripeForm = r.Form
+		w.Write([]byte(`{"id":"cs_test_1","url":"https://checkout.stripe.test/c/cs_test_1"}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	tests := []struct {
+		name     string
+		body     string
+		want     int
+		currency string
+		amount   float64
+	}{
+		{"moeda padrão do Stripe", `{"provider":"stripe"}`, http.StatusCreated, "USD", 12},
+		{"moeda em minúsculas", `{"provider":"mercadopago","currency":"brl"}`, http.StatusCreated, "BRL", 60},
+		{"plano sem preço na moeda", `{"provider":"stripe","currency":"EUR"}`, http.StatusConflict, "", 0},
+		{"moeda que o Stripe não cobra", `{"provider":"stripe","currency":"JPY"}`, http.StatusBadRequest, "", 0},
+		{"moeda que o MercadoPago não cobra", `{"provider":"mercadopago","currency":"USD"}`, http.StatusBadRequest, "", 0},
+		{"código de moeda inválido", `{"provider":"stripe","currency":"US$"}`, http.StatusBadRequest, "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newCheckoutEnv(t)
+			mp, _ := paymentProvider("")
+			st := stripe.NewProvider(stripe.Config{Client: srv.Client(), BaseURL: srv.URL, SecretKey: "sk_test", Currencies: []string{"USD", "EUR"}})
+			paymentProvider = func(name string) (payments.Provider, error) {
+				if name == st.Name() {
+					return st, nil
+				}
+				return mp, nil
+			}
+			env.store.prices[5] = map[string]float64{"10": 30}
+			env.store.foreign["USD"] = map[string]float64{"10": 6}
+			env.call(t, 5, "PUT", "/api/admin/cart", `{"items":[{"product_type":"domain_renewal","product_identifier":"10","periods":2}]}`, nil)
+
+			var c Checkout
+			if code := env.call(t, 5, "POST", "/api/admin/checkout", tt.body, &c); code != tt.want {
+				t.Fatalf("POST /checkout: status %d, esperado %d", code, tt.want)
+			}
+			if tt.want != http.StatusCreated {
+				if len(env.store.payments) != 0 {
+					t.Errorf("pagamento criado: %+v", env.store.payments)
+				}
+				return
+			}
+			if c.Currency != tt.currency || c.Amount != tt.amount {
+				t.Errorf("checkout em %s de %.2f, esperado %s de %.2f", c.Currency, c.Amount, tt.currency, tt.amount)
+			}
+			if c.Provider == "stripe" && (stripeForm.Get("line_items[0][price_data][currency]") != "usd" || stripeForm.Get("line_items[0][price_data][unit_amount]") != "1200") {
+				t.Errorf("sessão do Stripe: %v", stripeForm)
+			}
+		})
+	}
+}
@@ -0,0 +1,320 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"CDNProxy_v2/backend/database"
+	"CDNProxy_v2/backend/middleware"
+	"CDNProxy_v2/backend/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// paymentMethodCoupon é o método do pagamento que o cupom zerou, aprovado sem
+// passar por um provedor.
+const paymentMethodCoupon = "coupon"
+
+var errNoCartCoupon = errors.New("no coupon applied to the cart")
+
+// couponUseCondition filtra os pagamentos (p) cujo uso do cupom conta para
+// os limites: entregues e não devolvidos, ou ainda não entregues e não
+// recusados.
+const couponUseCondition = `(CASE WHEN p.fulfilled_at IS NOT NULL THEN p.status NOT IN ('refunded', 'charged_back')
+	ELSE p.status NOT IN ('failed', 'rejected', 'cancelled', 'refunded', 'charged_back') END)`
+
+// CartCoupon é o cupom aplicado ao carrinho, com o desconto calculado sobre
+// os preços atuais. Subtotal, Discount e Total estão em Currency.
+type CartCoupon struct {
+	id           int64
+	Code         string     `json:"code"`
+	Description  *string    `json:"description"`
+	DiscountType string     `json:"discount_type"`
+	Value        float64    `json:"value"`
+	ExpiresAt    *time.Time `json:"expires_at"`
+	Currency     string     `json:"currency"`
+	Subtotal     float64    `json:"subtotal"`
+	Discount     float64    `json:"discount"`
+	Total        float64    `json:"total"`
+}
+
+// couponError identifica o cupom que não pode ser usado no carrinho.
+type couponError struct {
+	code string
+	err  error
+}
+
+func (e *couponError) Error() string { return fmt.Sprintf("coupon %s: %v", e.code, e.err) }
+
+func (e *couponError) Unwrap() error { return e.err }
+
+// couponDiscount confere o cupom para um usuário que já o usou userUses
+// vezes e calcula o desconto sobre items em currency.
+func couponDiscount(c *models.Coupon, userUses int, items []CartItem, currency string, now time.Time) (float64, error) {
+	if err := c.Check(now, userUses); err != nil {
+		return 0, err
+	}
+	list := make([]models.CouponItem, 0, len(items))
+	for _, item := range items {
+		list = append(list, models.CouponItem{PlanID: item.PlanID, Price: item.Price})
+	}
+	return c.Discount(list, currency)
+}
+
+func newCartCoupon(c *models.Coupon, items []CartItem, currency string, discount float64) *CartCoupon {
+	var subtotal float64
+	for _, item := range items {
+		subtotal += item.Price
+	}
+	subtotal = math.Round(subtotal*100) / 100
+	return &CartCoupon{
+		id:           c.ID,
+		Code:         c.Code,
+		Description:  c.Description,
+		DiscountType: c.DiscountType,
+		Value:        c.Value,
+		ExpiresAt:    c.ExpiresAt,
+		Currency:     currency,
+		Subtotal:     subtotal,
+		Discount:     discount,
+		Total:        math.Round((subtotal-discount)*100) / 100,
+	}
+}
+
+// loadCoupon busca o cupom code e quantas vezes ele foi usado, no total e
+// por userID. Contam os pagamentos aprovados e não devolvidos e também os
+// ainda em andamento, para que dois checkouts abertos ao mesmo tempo não
+// passem dos limites; um pagamento que falha ou é cancelado libera o uso.
+func loadCoupon(ctx context.Context, q querier, code string, userID int64) (*models.Coupon, int, error) {
+	var (
+		c        models.Coupon
+		userUses int
+	)
+	err := q.QueryRow(ctx, `
+		SELECT c.id, c.code, c.description, c.discount_type, c.value::float8, c.currency, c.expires_at, c.max_uses,
+			c.per_user_limit, c.plan_ids, c.active, COUNT(p.id), COUNT(p.id) FILTER (WHERE cr.user_id = $2)
+		FROM public.coupons c
+		LEFT JOIN public.coupon_redemptions cr ON cr.coupon_id = c.id
+		LEFT JOIN public.payments p ON p.id = cr.payment_id AND `+couponUseCondition+`
+		WHERE c.code = $1
+		GROUP BY c.id`, code, userID,
+	).Scan(&c.ID, &c.Code, &c.Description, &c.DiscountType, &c.Value, &c.Currency, &c.ExpiresAt, &c.MaxUses,
+		&c.PerUserLimit, &c.PlanIDs, &c.Active, &c.Uses, &userUses)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, 0, &couponError{code: code, err: models.ErrCouponNotFound}
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return &c, userUses, nil
+}
+
+// evaluateCoupon calcula o desconto do cupom code para userID sobre items em
+// currency. O cupom que não pode ser usado volta como couponError.
+func evaluateCoupon(ctx context.Context, q querier, code string, userID int64, items []CartItem, currency string) (*CartCoupon, error) {
+	c, userUses, err := loadCoupon(ctx, q, code, userID)
+	if err != nil {
+		return nil, err
+	}
+	discount, err := couponDiscount(c, userUses, items, currency, time.Now())
+	if err != nil {
+		return nil, &couponError{code: c.Code, err: err}
+	}
+	return newCartCoupon(c, items, currency, discount), nil
+}
+
+// cartDiscount confere o cupom aplicado ao carrinho de userID contra items em
+// currency. Devolve nil quando o carrinho não tem cupom. forUpdate trava o
+// cupom até o fim da transação, para que checkouts simultâneos contem os
+// usos um do outro.
+func cartDiscount(ctx context.Context, q querier, userID int64, items []CartItem, currency string, forUpdate bool) (*CartCoupon, error) {
+	query := "SELECT c.code FROM public.cart_coupons cc JOIN public.coupons c ON c.id = cc.coupon_id WHERE cc.user_id = $1"
+	if forUpdate {
+		query += " FOR UPDATE OF c"
+	}
+	var code string
+	err := q.QueryRow(ctx, query, userID).Scan(&code)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return evaluateCoupon(ctx, q, code, userID, items, currency)
+}
+
+// repricedCart lê o carrinho do usuário com os preços atuais na moeda base.
+func repricedCart(ctx context.Context, tx pgx.Tx, userID int64) ([]CartItem, error) {
+	items, err := cartItems(ctx, tx, userID, false)
+	if err != nil {
+		return nil, err
+	}
+	for i := range items {
+		if err := priceCartItem(ctx, tx, userID, models.BaseCurrency, &items[i]); err != nil {
+			return nil, &cartItemError{item: items[i], err: err}
+		}
+	}
+	return items, nil
+}
+
+func (dbCheckoutStore) applyCoupon(ctx context.Context, userID int64, code string, extra *CartItem) (*CartCoupon, error) {
+	tx, err := database.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	items, err := repricedCart(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if extra != nil {
+		items = append(items, *extra)
+	}
+	coupon, err := evaluateCoupon(ctx, tx, models.NormalizeCouponCode(code), userID, items, models.BaseCurrency)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(ctx, `
+		INSERT INTO public.cart_coupons (user_id, coupon_id, applied_at) VALUES ($1, $2, NOW())
+		ON CONFLICT (user_id) DO UPDATE SET coupon_id = EXCLUDED.coupon_id, applied_at = NOW()`,
+		userID, coupon.id); err != nil {
+		return nil, err
+	}
+	if extra != nil {
+		if _, err := tx.Exec(ctx,
+			"INSERT INTO public.cart_items (user_id, product_type, product_identifier, price, periods) VALUES ($1, $2, $3, $4, $5)",
+			userID, extra.ProductType, extra.ProductIdentifier, extra.Price, extra.Periods); err != nil {
+			return nil, err
+		}
+	}
+	return coupon, tx.Commit(ctx)
+}
+
+func (dbCheckoutStore) cartCoupon(ctx context.Context, userID int64) (*CartCoupon, error) {
+	tx, err := database.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	items, err := repricedCart(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	coupon, err := cartDiscount(ctx, tx, userID, items, models.BaseCurrency, false)
+	if err == nil && coupon == nil {
+		return nil, errNoCartCoupon
+	}
+	return coupon, err
+}
+
+func (dbCheckoutStore) removeCoupon(ctx context.Context, userID int64) error {
+	tag, err := database.DB.Exec(ctx, "DELETE FROM public.cart_coupons WHERE user_id = $1", userID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errNoCartCoupon
+	}
+	return nil
+}
+
+// writeCouponError responde 404 para cupons inexistentes e 409 para cupons
+// que não podem ser usados no carrinho (vencidos, esgotados, de outros
+// planos...).
+func writeCouponError(w http.ResponseWriter, err *couponError) {
+	status := http.StatusConflict
+	if errors.Is(err, models.ErrCouponNotFound) {
+		status = http.StatusNotFound
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.err.Error(), "coupon": err.code})
+}
+
+// writeCouponStoreError responde às falhas dos métodos de cupom de
+// checkouts.
+func writeCouponStoreError(w http.ResponseWriter, err error) {
+	var (
+		itemErr   *cartItemError
+		couponErr *couponError
+	)
+	switch {
+	case errors.As(err, &couponErr):
+		writeCouponError(w, couponErr)
+	case errors.As(err, &itemErr):
+		writeCartItemError(w, itemErr)
+	case errors.Is(err, errNoCartCoupon):
+		http.Error(w, "No coupon applied to the cart", http.StatusNotFound)
+	default:
+		log.Printf("ERROR: Cart coupon operation failed: %v", err)
+		http.Error(w, "Failed to update cart coupon", http.StatusInternalServerError)
+	}
+}
+
+// GetCartCoupon devolve o cupom aplicado ao carrinho, com o desconto sobre
+// os preços atuais. Um cupom que deixou de valer responde 409.
+func GetCartCoupon(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(middleware.UserIDKey).(int64)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
+		return
+	}
+
+	coupon, err := checkouts.cartCoupon(r.Context(), userID)
+	if err != nil {
+		writeCouponStoreError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(coupon)
+}
+
+// ApplyCartCoupon aplica ao carrinho o cupom {"code": "..."}, no lugar do que
+// já estiver aplicado. O cupom é conferido no servidor contra os itens e
+// preços atuais do carrinho.
+func ApplyCartCoupon(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(middleware.UserIDKey).(int64)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
+		return
+	}
+
+	var body struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Code == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	coupon, err := checkouts.applyCoupon(r.Context(), userID, body.Code, nil)
+	if err != nil {
+		writeCouponStoreError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(coupon)
+}
+
+// RemoveCartCoupon tira o cupom do carrinho.
+func RemoveCartCoupon(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(middleware.UserIDKey).(int64)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
+		return
+	}
+
+	if err := checkouts.removeCoupon(r.Context(), userID); err != nil {
+		writeCouponStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
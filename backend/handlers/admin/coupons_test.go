@@ -0,0 +1,330 @@
+package admin
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"CDNProxy_v2/backend/models"
+	"CDNProxy_v2/backend/services/mercadopago"
+)
+
+// fakeRedemption é o uso de um cupom em um pagamento, como em
+// coupon_redemptions.
+type fakeRedemption struct {
+	code      string
+	userID    int64
+	paymentID int64
+}
+
+// evaluateCoupon segue evaluateCoupon: contam os usos em pagamentos
+// entregues e não devolvidos ou ainda em andamento. Deve ser chamado com s.mu
+// travado.
+func (s *fakeCheckoutStore) evaluateCoupon(code string, userID int64, items []CartItem, currency string) (*CartCoupon, error) {
+	stored, ok := s.coupons[code]
+	if !ok {
+		return nil, &couponError{code: code, err: models.ErrCouponNotFound}
+	}
+	c := *stored
+	userUses := 0
+	for _, r := range s.redemptions {
+		if r.code == code && fakeCouponUse(s.payments[r.paymentID]) {
+			c.Uses++
+			if r.userID == userID {
+				userUses++
+			}
+		}
+	}
+	discount, err := couponDiscount(&c, userUses, items, currency, time.Now())
+	if err != nil {
+		return nil, &couponError{code: code, err: err}
+	}
+	return newCartCoupon(&c, items, currency, discount), nil
+}
+
+// fakeCouponUse segue couponUseCondition.
+func fakeCouponUse(p *PaymentStatus) bool {
+	switch p.Status {
+	case "refunded", "charged_back":
+		return false
+	case "failed", "rejected", "cancelled":
+		return p.FulfilledAt != nil
+	}
+	return true
+}
+
+// repriced devolve uma cópia do carrinho com os preços atuais.
+func (s *fakeCheckoutStore) repriced(userID int64) ([]CartItem, error) {
+	items := append([]CartItem(nil), s.carts[userID]...)
+	for i := range items {
+		if err := s.price(userID, models.BaseCurrency, &items[i]); err != nil {
+			return nil, &cartItemError{item: items[i], err: err}
+		}
+	}
+	return items, nil
+}
+
+func (s *fakeCheckoutStore) applyCoupon(_ context.Context, userID int64, code string, extra *CartItem) (*CartCoupon, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	items, err := s.repriced(userID)
+	if err != nil {
+		return nil, err
+	}
+	if extra != nil {
+		items = append(items, *extra)
+	}
+	code = models.NormalizeCouponCode(code)
+	coupon, err := s.evaluateCoupon(code, userID, items, models.BaseCurrency)
+	if err != nil {
+		return nil, err
+	}
+	s.cartCoupons[userID] = code
+	if extra != nil {
+		s.carts[userID] = append(s.carts[userID], *extra)
+	}
+	return coupon, nil
+}
+
+func (s *fakeCheckoutStore) cartCoupon(_ context.Context, userID int64) (*CartCoupon, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	code, ok := s.cartCoupons[userID]
+	if !ok {
+		return nil, errNoCartCoupon
+	}
+	items, err := s.repriced(userID)
+	if err != nil {
+		return nil, err
+	}
+	return s.evaluateCoupon(code, userID, items, models.BaseCurrency)
+}
+
+func (s *fakeCheckoutStore) removeCoupon(_ context.Context, userID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.cartCoupons[userID]; !ok {
+		return errNoCartCoupon
+	}
+	delete(s.cartCoupons, userID)
+	return nil
+}
+
+func intPtr(n int) *int { return &n }
+
+// newCouponEnv prepara o carrinho do usuário 5 com os domínios 10 (plano 1,
+// R$ 30) e 11 (plano 2, R$ 45) e os cupons dos testes.
+func newCouponEnv(t *testing.T) *checkoutEnv {
+	t.Helper()
+	env := newCheckoutEnv(t)
+	env.router.HandleFunc("/api/admin/cart/coupon", GetCartCoupon).Methods("GET")
+	env.router.HandleFunc("/api/admin/cart/coupon", ApplyCartCoupon).Methods("POST")
+	env.router.HandleFunc("/api/admin/cart/coupon", RemoveCartCoupon).Methods("DELETE")
+
+	env.store.prices[5] = map[string]float64{"10": 30, "11": 45}
+	env.store.prices[6] = map[string]float64{"20": 30}
+	env.store.plans["11"] = 2
+	past := time.Now().Add(-time.Hour)
+	for _, c := range []*models.Coupon{
+		{Code: "DEZ", DiscountType: models.DiscountPercentage, Value: 10, Currency: "BRL", Active: true},
+		{Code: "PLANO2", DiscountType: models.DiscountFixed, Value: 20, Currency: "BRL", PlanIDs: []int64{2}, Active: true},
+		{Code: "DOLAR", DiscountType: models.DiscountFixed, Value: 5, Currency: "USD", Active: true},
+		{Code: "VENCIDO", DiscountType: models.DiscountPercentage, Value: 10, Currency: "BRL", ExpiresAt: &past, Active: true},
+		{Code: "INATIVO", DiscountType: models.DiscountPercentage, Value: 10, Currency: "BRL"},
+		{Code: "GRATIS", DiscountType: models.DiscountPercentage, Value: 100, Currency: "BRL", PerUserLimit: intPtr(1), Active: true},
+		{Code: "ESGOTADO", DiscountType: models.DiscountPercentage, Value: 10, Currency: "BRL", MaxUses: intPtr(1), Active: true},
+	} {
+		env.store.coupons[c.Code] = c
+	}
+	// ESGOTADO já foi usado em um pagamento aprovado de outro usuário
+	now := time.Now()
+	env.store.payments[900] = &PaymentStatus{ID: 900, UserID: 7, Status: "approved", FulfilledAt: &now}
+	env.store.redemptions = append(env.store.redemptions, fakeRedemption{code: "ESGOTADO", userID: 7, paymentID: 900})
+	return env
+}
+
+func TestCartCoupon(t *testing.T) {
+	env := newCouponEnv(t)
+	env.call(t, 5, "PUT", "/api/admin/cart",
+		`{"items":[{"product_type":"domain_renewal","product_identifier":"10"},{"product_type":"domain_renewal","product_identifier":"11"}]}`, nil)
+
+	var coupon CartCoupon
+	if code := env.call(t, 5, "POST", "/api/admin/cart/coupon", `{"code":" dez "}`, &coupon); code != http.StatusOK {
+		t.Fatalf("POST /cart/coupon: status %d", code)
+	}
+	if coupon.Code != "DEZ" || coupon.Subtotal != 75 || coupon.Discount != 7.5 || coupon.Total != 67.5 {
+		t.Errorf("cupom aplicado: %+v", coupon)
+	}
+
+	// O cupom restrito ao plano 2 só desconta o domínio 11, até o preço dele
+	if code := env.call(t, 5, "POST", "/api/admin/cart/coupon", `{"code":"PLANO2"}`, &coupon); code != http.StatusOK || coupon.Discount != 20 || coupon.Total != 55 {
+		t.Fatalf("cupom de plano: status %d, %+v", code, coupon)
+	}
+	if code := env.call(t, 5, "GET", "/api/admin/cart/coupon", "", &coupon); code != http.StatusOK || coupon.Code != "PLANO2" {
+		t.Errorf("GET /cart/coupon: status %d, %+v", code, coupon)
+	}
+
+	var c Checkout
+	if code := env.call(t, 5, "POST", "/api/admin/checkout", "", &c); code != http.StatusCreated {
+		t.Fatalf("POST /checkout: status %d", code)
+	}
+	if c.Amount != 55 || c.Discount != 20 || c.CouponCode != "PLANO2" || c.Status != "pending" || c.URL == "" {
+		t.Errorf("checkout com cupom: %+v", c)
+	}
+	pref := env.mp.preferences[0]
+	if len(pref.Items) != 1 || pref.Items[0].UnitPrice != 55 {
+		t.Errorf("preferência com desconto deve ter um item pelo total: %+v", pref.Items)
+	}
+	if p := env.store.payments[c.PaymentID]; p.Discount != 20 || p.CouponCode == nil || *p.CouponCode != "PLANO2" {
+		t.Errorf("pagamento sem o desconto: %+v", p)
+	}
+	if r := env.store.redemptions[len(env.store.redemptions)-1]; r.code != "PLANO2" || r.paymentID != c.PaymentID || r.userID != 5 {
+		t.Errorf("uso do cupom não registrado: %+v", r)
+	}
+
+	if code := env.call(t, 5, "DELETE", "/api/admin/cart/coupon", "", nil); code != http.StatusNoContent {
+		t.Errorf("DELETE /cart/coupon: status %d", code)
+	}
+	if code := env.call(t, 5, "DELETE", "/api/admin/cart/coupon", "", nil); code != http.StatusNotFound {
+		t.Errorf("DELETE sem cupom: status %d, esperado 404", code)
+	}
+	if code := env.call(t, 5, "GET", "/api/admin/cart/coupon", "", nil); code != http.StatusNotFound {
+		t.Errorf("GET sem cupom: status %d, esperado 404", code)
+	}
+}
+
+func TestCartCouponErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"cupom inexistente", `{"code":"NADA"}`, http.StatusNotFound},
+		{"cupom vencido", `{"code":"VENCIDO"}`, http.StatusConflict},
+		{"cupom inativo", `{"code":"INATIVO"}`, http.StatusConflict},
+		{"cupom de outro plano", `{"code":"PLANO2"}`, http.StatusConflict},
+		{"desconto fixo em outra moeda", `{"code":"DOLAR"}`, http.StatusConflict},
+		{"cupom esgotado", `{"code":"ESGOTADO"}`, http.StatusConflict},
+		{"sem código", `{}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newCouponEnv(t)
+			env.call(t, 5, "PUT", "/api/admin/cart", `{"items":[{"product_type":"domain_renewal","product_identifier":"10"}]}`, nil)
+			if code := env.call(t, 5, "POST", "/api/admin/cart/coupon", tt.body, nil); code != tt.want {
+				t.Errorf("status %d, esperado %d", code, tt.want)
+			}
+			if _, ok := env.store.cartCoupons[5]; ok {
+				t.Error("cupom recusado ficou aplicado ao carrinho")
+			}
+		})
+	}
+}
+
+func TestCouponCheckout(t *testing.T) {
+	env := newCouponEnv(t)
+	cart := `{"items":[{"product_type":"domain_renewal","product_identifier":"10"}]}`
+
+	// O cupom que vence depois de aplicado é recusado no checkout
+	env.call(t, 5, "PUT", "/api/admin/cart", cart, nil)
+	env.call(t, 5, "POST", "/api/admin/cart/coupon", `{"code":"DEZ"}`, nil)
+	past := time.Now().Add(-time.Minute)
+	env.store.coupons["DEZ"].ExpiresAt = &past
+	if code := env.call(t, 5, "POST", "/api/admin/checkout", "", nil); code != http.StatusConflict {
+		t.Errorf("checkout com cupom vencido: status %d, esperado 409", code)
+	}
+	if len(env.store.payments) != 1 {
+		t.Errorf("pagamento criado com cupom vencido: %+v", env.store.payments)
+	}
+
+	// O pedido que o cupom zera é aprovado sem passar pelo provedor
+	env.call(t, 5, "POST", "/api/admin/cart/coupon", `{"code":"GRATIS"}`, nil)
+	var c Checkout
+	if code := env.call(t, 5, "POST", "/api/admin/checkout", "", &c); code != http.StatusCreated {
+		t.Fatalf("checkout gratuito: status %d", code)
+	}
+	if c.Amount != 0 || c.Discount != 30 || c.Status != "approved" || c.Provider != paymentMethodCoupon || c.URL != "" {
+		t.Errorf("checkout gratuito: %+v", c)
+	}
+	if len(env.mp.preferences) != 0 {
+		t.Errorf("checkout gratuito criou preferência: %+v", env.mp.preferences)
+	}
+	if p := env.store.payments[c.PaymentID]; p.FulfilledAt == nil || p.PaymentMethod != paymentMethodCoupon {
+		t.Errorf("pagamento gratuito não foi entregue: %+v", p)
+	}
+	if len(env.store.carts[5]) != 0 || env.store.cartCoupons[5] != "" {
+		t.Errorf("carrinho e cupom não foram limpos: %+v, %q", env.store.carts[5], env.store.cartCoupons[5])
+	}
+
+	// O limite por usuário conta o pagamento aprovado; outro usuário ainda pode usar
+	env.call(t, 5, "PUT", "/api/admin/cart", cart, nil)
+	if code := env.call(t, 5, "POST", "/api/admin/cart/coupon", `{"code":"GRATIS"}`, nil); code != http.StatusConflict {
+		t.Errorf("segundo uso do cupom: status %d, esperado 409", code)
+	}
+	env.call(t, 6, "PUT", "/api/admin/cart", `{"items":[{"product_type":"domain_renewal","product_identifier":"20"}]}`, nil)
+	if code := env.call(t, 6, "POST", "/api/admin/cart/coupon", `{"code":"GRATIS"}`, nil); code != http.StatusOK {
+		t.Errorf("cupom para outro usuário: status %d, esperado 200", code)
+	}
+}
+
+func TestCouponPendingCheckoutCountsTowardLimits(t *testing.T) {
+	env := newCouponEnv(t)
+	env.store.coupons["UNICO"] = &models.Coupon{Code: "UNICO", DiscountType: models.DiscountPercentage, Value: 10, Currency: "BRL",
+		MaxUses: intPtr(1), PerUserLimit: intPtr(1), Active: true}
+	cart := `{"items":[{"product_type":"domain_renewal","product_identifier":"10"}]}`
+
+	env.call(t, 5, "PUT", "/api/admin/cart", cart, nil)
+	env.call(t, 5, "POST", "/api/admin/cart/coupon", `{"code":"UNICO"}`, nil)
+	env.call(t, 6, "PUT", "/api/admin/cart", `{"items":[{"product_type":"domain_renewal","product_identifier":"20"}]}`, nil)
+	env.call(t, 6, "POST", "/api/admin/cart/coupon", `{"code":"UNICO"}`, nil)
+
+	var c Checkout
+	if code := env.call(t, 5, "POST", "/api/admin/checkout", "", &c); code != http.StatusCreated || c.Status != "pending" {
+		t.Fatalf("POST /checkout: status %d, %+v", code, c)
+	}
+
+	// O pagamento ainda pendente já ocupa o uso, no total e para o usuário
+	if code := env.call(t, 6, "POST", "/api/admin/checkout", "", nil); code != http.StatusConflict {
+		t.Errorf("checkout de outro usuário com o cupom esgotado: status %d, esperado 409", code)
+	}
+	if code := env.call(t, 5, "POST", "/api/admin/cart/coupon", `{"code":"UNICO"}`, nil); code != http.StatusConflict {
+		t.Errorf("cupom com pagamento pendente: status %d, esperado 409", code)
+	}
+
+	// O pagamento que falha libera o uso
+	if err := env.store.fail(context.Background(), c.PaymentID); err != nil {
+		t.Fatal(err)
+	}
+	if code := env.call(t, 6, "POST", "/api/admin/checkout", "", nil); code != http.StatusCreated {
+		t.Errorf("checkout depois da falha: status %d, esperado 201", code)
+	}
+}
+
+func TestLateApprovalKeepsNewCart(t *testing.T) {
+	env := newCouponEnv(t)
+	env.call(t, 5, "PUT", "/api/admin/cart", `{"items":[{"product_type":"domain_renewal","product_identifier":"10"}]}`, nil)
+	env.call(t, 5, "POST", "/api/admin/cart/coupon", `{"code":"DEZ"}`, nil)
+	var c Checkout
+	if code := env.call(t, 5, "POST", "/api/admin/checkout", "", &c); code != http.StatusCreated {
+		t.Fatalf("POST /checkout: status %d", code)
+	}
+
+	// Enquanto o pagamento está pendente, o usuário monta outro carrinho
+	env.call(t, 5, "PUT", "/api/admin/cart", `{"items":[{"product_type":"domain_renewal","product_identifier":"11"}]}`, nil)
+	env.call(t, 5, "POST", "/api/admin/cart/coupon", `{"code":"PLANO2"}`, nil)
+
+	ref := strconv.FormatInt(c.PaymentID, 10)
+	env.mp.payments[ref] = mercadopago.PaymentResponse{ID: 901, Status: "approved", ExternalReference: ref, TransactionAmount: c.Amount, CurrencyID: "BRL"}
+	var status PaymentStatus
+	if code := env.call(t, 5, "GET", "/api/admin/payments/"+ref, "", &status); code != http.StatusOK || status.FulfilledAt == nil {
+		t.Fatalf("aprovação: status %d, %+v", code, status)
+	}
+	if cart := env.store.carts[5]; len(cart) != 1 || cart[0].ProductIdentifier != "11" {
+		t.Errorf("a aprovação tirou itens do carrinho novo: %+v", cart)
+	}
+	if env.store.cartCoupons[5] != "PLANO2" {
+		t.Errorf("a aprovação tirou o cupom do carrinho novo: %q", env.store.cartCoupons[5])
+	}
+}
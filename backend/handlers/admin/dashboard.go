@@ -9,7 +9,8 @@ import (
 	"CDNProxy_v2/backend/middleware"
 )
 
-// DashboardHandler é o manipulador para a rota do dashboard do admin.
+// DashboardHandler é o manipulador para a rota do dashboard do admin. Para
+// revendedores, os totais incluem as subcontas.
 func DashboardHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
@@ -23,28 +24,28 @@ func DashboardHandler(w http.ResponseWriter, r *http.Request) {
 	var totalSpent float64
 
 	// Get total domains
-	err := database.DB.QueryRow(context.Background(), "SELECT COUNT(*) FROM public.domains WHERE user_id = $1", userID).Scan(&totalDomains)
+	err := database.DB.QueryRow(context.Background(), "SELECT COUNT(*) FROM public.domains WHERE user_id IN "+ownAccounts("$1"), userID).Scan(&totalDomains)
 	if err != nil {
 		http.Error(w, "Failed to query total domains", http.StatusInternalServerError)
 		return
 	}
 
 	// Get expiring domains (in the next 30 days)
-	err = database.DB.QueryRow(context.Background(), "SELECT COUNT(*) FROM public.domains WHERE user_id = $1 AND expired_at BETWEEN NOW() AND NOW() + INTERVAL '30 day'", userID).Scan(&expiringDomains)
+	err = database.DB.QueryRow(context.Background(), "SELECT COUNT(*) FROM public.domains WHERE user_id IN "+ownAccounts("$1")+" AND expired_at BETWEEN NOW() AND NOW() + INTERVAL '30 day'", userID).Scan(&expiringDomains)
 	if err != nil {
 		http.Error(w, "Failed to query expiring domains", http.StatusInternalServerError)
 		return
 	}
 
 	// Get total transactions
-	err = database.DB.QueryRow(context.Background(), "SELECT COUNT(*) FROM public.payments WHERE user_id = $1", userID).Scan(&totalTransactions)
+	err = database.DB.QueryRow(context.Background(), "SELECT COUNT(*) FROM public.payments WHERE user_id IN "+ownAccounts("$1"), userID).Scan(&totalTransactions)
 	if err != nil {
 		http.Error(w, "Failed to query total transactions", http.StatusInternalServerError)
 		return
 	}
 
 	// Get total spent
-	err = database.DB.QueryRow(context.Background(), "SELECT COALESCE(SUM(amount), 0) FROM public.payments WHERE user_id = $1", userID).Scan(&totalSpent)
+	err = database.DB.QueryRow(context.Background(), "SELECT COALESCE(SUM(amount), 0) FROM public.payments WHERE user_id IN "+ownAccounts("$1"), userID).Scan(&totalSpent)
 	if err != nil {
 		http.Error(w, "Failed to query total spent", http.StatusInternalServerError)
 		return
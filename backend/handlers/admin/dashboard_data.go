@@ -40,8 +40,7 @@ func DashboardDataHandler(w http.ResponseWriter, r *http.Request) {
 			COUNT(CASE WHEN active = false THEN 1 END),
 			COUNT(CASE WHEN expired_at BETWEEN NOW() AND NOW() + INTERVAL '30 day' THEN 1 END)
 		FROM domains
-		WHERE user_id = $1
-	`, userID).Scan(&data.TotalDomains, &data.ActiveDomains, &data.InactiveDomains, &data.ExpiringDomains)
+		WHERE user_id IN `+ownAccounts("$1"), userID).Scan(&data.TotalDomains, &data.ActiveDomains, &data.InactiveDomains, &data.ExpiringDomains)
 
 	if err != nil {
 		http.Error(w, "Error fetching domain counts: "+err.Error(), http.StatusInternalServerError)
@@ -55,7 +54,7 @@ func DashboardDataHandler(w http.ResponseWriter, r *http.Request) {
 			TO_CHAR(expired_at, 'DD/MM/YYYY'),
 			EXTRACT(DAY FROM expired_at - NOW())
 		FROM domains
-		WHERE user_id = $1 AND expired_at BETWEEN NOW() AND NOW() + INTERVAL '30 day'
+		WHERE user_id IN `+ownAccounts("$1")+` AND expired_at BETWEEN NOW() AND NOW() + INTERVAL '30 day'
 		ORDER BY expired_at ASC
 	`, userID)
 	if err != nil {
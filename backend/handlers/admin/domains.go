@@ -16,9 +16,15 @@ import (
 
 type DomainWithPrice struct {
 	models.Domain
-	PlanPrice float64 `json:"plan_price"`
+	PlanPrice         float64 `json:"plan_price"`
+	PlanBillingPeriod *string `json:"plan_billing_period"`
+	PlanPeriodDays    *int    `json:"plan_period_days"`
 }
 
+// GetUserDomains lista os domínios do usuário e das suas subcontas. O
+// plan_price é o preço que o próprio usuário paga na renovação: para
+// subcontas, o preço definido pelo revendedor, quando houver. Cada
+// renovação estende o domínio pelo período do plano.
 func GetUserDomains(w http.ResponseWriter, r *http.Request) {
 	userID, ok := r.Context().Value(middleware.UserIDKey).(int64)
 	if !ok {
@@ -27,11 +33,12 @@ func GetUserDomains(w http.ResponseWriter, r *http.Request) {
 	}
 
 	query := `
-		SELECT d.id, d.name, d.user_id, d.expired_at, d.target_url, d.plan_id, d.active, COALESCE(p.price, 0)
+		SELECT d.id, d.name, d.user_id, d.expired_at, d.target_url, d.plan_id, d.active, COALESCE(rp.price, p.price, 0), p.billing_period, p.period_days
 		FROM domains d
 		LEFT JOIN plans p ON d.plan_id = p.id
-		WHERE d.user_id = $1
-	`
+		LEFT JOIN reseller_prices rp ON rp.plan_id = p.id
+			AND rp.reseller_id = (SELECT parent_id FROM users WHERE id = $1)
+		WHERE d.user_id IN ` + ownAccounts("$1")
 
 	rows, err := database.DB.Query(r.Context(), query, userID)
 	if err != nil {
@@ -43,7 +50,7 @@ func GetUserDomains(w http.ResponseWriter, r *http.Request) {
 	var domains []DomainWithPrice
 	for rows.Next() {
 		var d DomainWithPrice
-		if err := rows.Scan(&d.ID, &d.Name, &d.UserID, &d.ExpiredAt, &d.TargetURL, &d.PlanID, &d.Active, &d.PlanPrice); err != nil {
+		if err := rows.Scan(&d.ID, &d.Name, &d.UserID, &d.ExpiredAt, &d.TargetURL, &d.PlanID, &d.Active, &d.PlanPrice, &d.PlanBillingPeriod, &d.PlanPeriodDays); err != nil {
 			http.Error(w, "Failed to scan domain", http.StatusInternalServerError)
 			return
 		}
@@ -68,7 +75,7 @@ func UpdateUserDomain(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Verifica se o domínio pertence ao usuário e se não está expirado
+	// Verifica se o domínio pertence ao usuário (ou a uma subconta) e se não está expirado
 	var d models.Domain
 	err = database.DB.QueryRow(r.Context(), "SELECT user_id, expired_at FROM domains WHERE id = $1", id).Scan(&d.UserID, &d.ExpiredAt)
 	if err != nil {
@@ -76,7 +83,7 @@ func UpdateUserDomain(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if d.UserID != userID {
+	if owns, err := ownsAccount(r.Context(), userID, d.UserID); err != nil || !owns {
 		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
@@ -126,7 +133,7 @@ func DeleteUserDomain(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if ownerID != userID {
+	if owns, err := ownsAccount(r.Context(), userID, ownerID); err != nil || !owns {
 		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
@@ -19,7 +19,7 @@ func DomainsRenewalHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rows, err := database.DB.Query(context.Background(), "SELECT id, user_id, name, expired_at FROM public.domains WHERE user_id = $1 AND expired_at BETWEEN NOW() AND NOW() + INTERVAL '30 day' ORDER BY expired_at ASC", userID)
+	rows, err := database.DB.Query(context.Background(), "SELECT id, user_id, name, expired_at FROM public.domains WHERE user_id IN "+ownAccounts("$1")+" AND expired_at BETWEEN NOW() AND NOW() + INTERVAL '30 day' ORDER BY expired_at ASC", userID)
 	if err != nil {
 		http.Error(w, "Failed to query domains for renewal", http.StatusInternalServerError)
 		return
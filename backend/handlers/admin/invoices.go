@@ -0,0 +1,81 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"CDNProxy_v2/backend/middleware"
+	"CDNProxy_v2/backend/services/invoices"
+
+	"github.com/gorilla/mux"
+)
+
+// invoiceForPayment devolve (emitindo, se preciso) o recibo do pagamento;
+// trocado nos testes.
+var invoiceForPayment = invoices.ForPayment
+
+// GetPaymentInvoice devolve o recibo do pagamento {id}, do usuário ou de uma
+// subconta dele. Pagamentos aprovados antes dos recibos existirem recebem o
+// número na primeira consulta.
+func GetPaymentInvoice(w http.ResponseWriter, r *http.Request) {
+	inv, ok := loadInvoice(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(inv)
+}
+
+// GetPaymentInvoicePDF devolve o recibo do pagamento {id} em PDF, para
+// download.
+func GetPaymentInvoicePDF(w http.ResponseWriter, r *http.Request) {
+	inv, ok := loadInvoice(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", `attachment; filename="recibo-`+invoices.FormatNumber(inv.Number)+`.pdf"`)
+	w.Write(invoices.Render(inv))
+}
+
+func loadInvoice(w http.ResponseWriter, r *http.Request) (*invoices.Invoice, bool) {
+	userID, ok := r.Context().Value(middleware.UserIDKey).(int64)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
+		return nil, false
+	}
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid payment ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	// Só o dono do pagamento (ou o revendedor dele) vê o recibo
+	_, err = checkouts.payment(r.Context(), userID, id)
+	if errors.Is(err, errPaymentNotFound) {
+		http.Error(w, "Payment not found", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, "Failed to query payment", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	inv, err := invoiceForPayment(r.Context(), id)
+	switch {
+	case errors.Is(err, invoices.ErrNotFound):
+		http.Error(w, "Payment not found", http.StatusNotFound)
+		return nil, false
+	case errors.Is(err, invoices.ErrNotPaid):
+		http.Error(w, "Payment has not been paid", http.StatusConflict)
+		return nil, false
+	case err != nil:
+		log.Printf("ERROR: Could not load invoice of payment %d: %v", id, err)
+		http.Error(w, "Failed to load invoice", http.StatusInternalServerError)
+		return nil, false
+	}
+	return inv, true
+}
@@ -0,0 +1,71 @@
+package admin
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"CDNProxy_v2/backend/middleware"
+	"CDNProxy_v2/backend/services/invoices"
+)
+
+func TestPaymentInvoice(t *testing.T) {
+	env := newCheckoutEnv(t)
+	env.router.HandleFunc("/api/admin/payments/{id}/invoice", GetPaymentInvoice).Methods("GET")
+	env.router.HandleFunc("/api/admin/payments/{id}/invoice.pdf", GetPaymentInvoicePDF).Methods("GET")
+
+	now := time.Now()
+	env.store.payments[1] = &PaymentStatus{ID: 1, UserID: 5, Amount: 30, Currency: "BRL", Status: "approved", PaidAt: &now, FulfilledAt: &now}
+	env.store.payments[2] = &PaymentStatus{ID: 2, UserID: 5, Amount: 30, Currency: "BRL", Status: "pending"}
+	prev := invoiceForPayment
+	invoiceForPayment = func(_ context.Context, paymentID int64) (*invoices.Invoice, error) {
+		if env.store.payments[paymentID].FulfilledAt == nil {
+			return nil, invoices.ErrNotPaid
+		}
+		return &invoices.Invoice{ID: 3, Number: 12, PaymentID: &paymentID, UserID: 5, CustomerEmail: "cliente@example.com",
+			Business: invoices.Business{Name: "CDNProxy"}, Items: []invoices.Line{{Description: "Renovação do domínio exemplo.com (mensal)", Quantity: 1, Amount: 30}},
+			Amount: 30, Currency: "BRL", PaidAt: &now, IssuedAt: now}, nil
+	}
+	t.Cleanup(func() { invoiceForPayment = prev })
+
+	var inv invoices.Invoice
+	if code := env.call(t, 5, "GET", "/api/admin/payments/1/invoice", "", &inv); code != http.StatusOK || inv.Number != 12 || len(inv.Items) != 1 {
+		t.Fatalf("GET /payments/1/invoice: status %d, %+v", code, inv)
+	}
+
+	tests := []struct {
+		name   string
+		userID int64
+		path   string
+		want   int
+	}{
+		{"pagamento de outro usuário", 6, "/api/admin/payments/1/invoice", http.StatusNotFound},
+		{"pagamento inexistente", 5, "/api/admin/payments/9/invoice.pdf", http.StatusNotFound},
+		{"pagamento não pago", 5, "/api/admin/payments/2/invoice.pdf", http.StatusConflict},
+		{"id inválido", 5, "/api/admin/payments/abc/invoice", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := env.call(t, tt.userID, "GET", tt.path, "", nil); code != tt.want {
+				t.Errorf("status %d, esperado %d", code, tt.want)
+			}
+		})
+	}
+
+	req := httptest.NewRequest("GET", "/api/admin/payments/1/invoice.pdf", nil)
+	req = req.WithContext(context.WithValue(req.Context(), middleware.UserIDKey, int64(5)))
+	rec := httptest.NewRecorder()
+	env.router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/pdf" {
+		t.Fatalf("GET invoice.pdf: status %d, content-type %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if got := rec.Header().Get("Content-Disposition"); got != `attachment; filename="recibo-000012.pdf"` {
+		t.Errorf("Content-Disposition = %q", got)
+	}
+	if !bytes.HasPrefix(rec.Body.Bytes(), []byte("%PDF-")) {
+		t.Errorf("resposta não é um PDF: %q", rec.Body.Bytes()[:10])
+	}
+}
@@ -0,0 +1,331 @@
+package admin
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"CDNProxy_v2/backend/database"
+	"CDNProxy_v2/backend/middleware"
+	"CDNProxy_v2/backend/models"
+	"CDNProxy_v2/backend/services/payments"
+	"CDNProxy_v2/backend/services/wallet"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// pixExpired é o status da cobrança PIX que venceu sem ser paga.
+const pixExpired = "expired"
+
+// Limites da validade de uma cobrança PIX, os mesmos do MercadoPago.
+const (
+	minPixExpiration = 30 * time.Minute
+	maxPixExpiration = 30 * 24 * time.Hour
+)
+
+// pixQRSize é o lado, em pixels, do QR code gerado.
+const pixQRSize = 320
+
+var errPixNotFound = errors.New("pix charge not found")
+
+// pixExpiration é a validade padrão das cobranças PIX.
+var pixExpiration = minPixExpiration
+
+// SetPixExpiration define a validade padrão das cobranças PIX
+// (PIX_EXPIRATION_MINUTES).
+func SetPixExpiration(d time.Duration) error {
+	if d < minPixExpiration || d > maxPixExpiration {
+		return fmt.Errorf("pix expiration must be between %v and %v", minPixExpiration, maxPixExpiration)
+	}
+	pixExpiration = d
+	return nil
+}
+
+// PixCheckout é a cobrança PIX de um pagamento: o código copia e cola
+// (qr_code) e o QR code em PNG codificado em base64.
+type PixCheckout struct {
+	PaymentID         int64      `json:"payment_id"`
+	TransactionID     int64      `json:"pix_transaction_id"`
+	Provider          string     `json:"provider"`
+	Status            string     `json:"status"`
+	Amount            float64    `json:"amount"`
+	Currency          string     `json:"currency"`
+	WalletAmount      float64    `json:"wallet_amount,omitempty"`
+	Items             []CartItem `json:"items,omitempty"`
+	Code              string     `json:"qr_code"`
+	QRCodePNG         string     `json:"qr_code_base64,omitempty"`
+	ExpiresAt         time.Time  `json:"expires_at"`
+	PaidAt            *time.Time `json:"paid_at,omitempty"`
+	ProviderPaymentID string     `json:"-"`
+}
+
+func (dbCheckoutStore) attachPix(ctx context.Context, c *Checkout, provider string, charge *payments.PixCharge) (int64, error) {
+	tx, err := database.DB.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	var id int64
+	err = tx.QueryRow(ctx, `
+		INSERT INTO public.pix_transactions
+			(user_id, payment_id, amount, status, provider, provider_payment_id, qr_code, expires_at, created_at, updated_at)
+		SELECT user_id, id, amount, $2, $3, $4, $5, $6, NOW(), NOW() FROM public.payments WHERE id = $1
+		RETURNING id`,
+		c.PaymentID, charge.Status, provider, charge.PaymentID, charge.Code, charge.ExpiresAt).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(ctx,
+		"UPDATE public.payments SET provider_payment_id = $1, updated_at = NOW() WHERE id = $2",
+		charge.PaymentID, c.PaymentID); err != nil {
+		return 0, err
+	}
+	return id, tx.Commit(ctx)
+}
+
+func (dbCheckoutStore) pix(ctx context.Context, userID, paymentID int64) (*PixCheckout, error) {
+	var pc PixCheckout
+	err := database.DB.QueryRow(ctx, `
+		SELECT pt.id, pt.payment_id, COALESCE(pt.provider, ''), COALESCE(pt.status, ''), pt.amount::float8, p.currency,
+			COALESCE(pt.qr_code, ''), pt.expires_at, pt.paid_at, COALESCE(pt.provider_payment_id, '')
+		FROM public.pix_transactions pt
+		JOIN public.payments p ON p.id = pt.payment_id
+		WHERE pt.payment_id = $1 AND p.user_id IN `+ownAccounts("$2"), paymentID, userID,
+	).Scan(&pc.TransactionID, &pc.PaymentID, &pc.Provider, &pc.Status, &pc.Amount, &pc.Currency,
+		&pc.Code, &pc.ExpiresAt, &pc.PaidAt, &pc.ProviderPaymentID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errPixNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &pc, nil
+}
+
+func (dbCheckoutStore) expirePix(ctx context.Context, paymentID int64) error {
+	tx, err := database.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx,
+		"UPDATE public.pix_transactions SET status = $1, updated_at = NOW() WHERE payment_id = $2 AND status = 'pending'",
+		pixExpired, paymentID)
+	if err != nil || tag.RowsAffected() == 0 {
+		return err
+	}
+	tag, err = tx.Exec(ctx,
+		"UPDATE public.payments SET status = 'cancelled', updated_at = NOW() WHERE id = $1 AND status = 'pending' AND fulfilled_at IS NULL",
+		paymentID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() > 0 {
+		if err := wallet.Release(ctx, tx, paymentID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// CreatePixCharge cria o pagamento do carrinho como uma cobrança PIX, sem
+// passar pela página de checkout do provedor. O carrinho é reprecificado
+// como em CreateCheckoutSession. Corpo opcional:
+// {"provider": "mercadopago", "expires_in_minutes": 60, "use_wallet": true};
+// com use_wallet, o PIX cobra só o que o saldo da carteira não cobrir.
+func CreatePixCharge(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(middleware.UserIDKey).(int64)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
+		return
+	}
+
+	var body struct {
+		Provider         string `json:"provider"`
+		ExpiresInMinutes int    `json:"expires_in_minutes"`
+		UseWallet        bool   `json:"use_wallet"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+	expiration := pixExpiration
+	if body.ExpiresInMinutes != 0 {
+		expiration = time.Duration(body.ExpiresInMinutes) * time.Minute
+		if expiration < minPixExpiration || expiration > maxPixExpiration {
+			http.Error(w, fmt.Sprintf("expires_in_minutes must be between %d and %d", int(minPixExpiration.Minutes()), int(maxPixExpiration.Minutes())), http.StatusBadRequest)
+			return
+		}
+	}
+	provider, err := paymentProvider(body.Provider)
+	if err != nil {
+		http.Error(w, "Unknown payment provider", http.StatusBadRequest)
+		return
+	}
+	pixProvider, ok := provider.(payments.PixProvider)
+	if !ok {
+		http.Error(w, "Payment provider does not support PIX", http.StatusBadRequest)
+		return
+	}
+
+	user, err := checkouts.payer(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusInternalServerError)
+		return
+	}
+
+	// PIX é sempre em reais
+	c, err := checkouts.create(r.Context(), userID, provider.Name(), models.BaseCurrency, body.UseWallet)
+	if err != nil {
+		writeCreateError(w, userID, err)
+		return
+	}
+	// Sem valor a cobrar não há PIX: o pagamento é aprovado na hora
+	if c.Amount == 0 {
+		writeFreeCheckout(w, r, c)
+		return
+	}
+
+	req := &payments.PixRequest{
+		ExternalReference: strconv.FormatInt(c.PaymentID, 10),
+		Amount:            c.Amount,
+		Description:       fmt.Sprintf("CDNProxy - pagamento #%d", c.PaymentID),
+		Payer:             payments.Payer{Email: user.Email},
+		ExpiresAt:         time.Now().Add(expiration),
+	}
+	if user.Name != nil {
+		req.Payer.Name = *user.Name
+	}
+	charge, err := pixProvider.CreatePix(r.Context(), req)
+	if err != nil {
+		log.Printf("ERROR: Could not create %s PIX charge for payment %d: %v", provider.Name(), c.PaymentID, err)
+		if err := checkouts.fail(r.Context(), c.PaymentID); err != nil {
+			log.Printf("ERROR: Could not mark payment %d as failed: %v", c.PaymentID, err)
+		}
+		http.Error(w, "Failed to create PIX charge", http.StatusBadGateway)
+		return
+	}
+
+	pc := &PixCheckout{
+		PaymentID:    c.PaymentID,
+		Provider:     provider.Name(),
+		Status:       charge.Status,
+		Amount:       c.Amount,
+		Currency:     c.Currency,
+		WalletAmount: c.WalletAmount,
+		Items:        c.Items,
+		Code:         charge.Code,
+		ExpiresAt:    charge.ExpiresAt,
+	}
+	// Sem o registro, o webhook ainda confirma o pagamento pelo external_reference
+	if pc.TransactionID, err = checkouts.attachPix(r.Context(), c, provider.Name(), charge); err != nil {
+		log.Printf("ERROR: Could not store PIX charge of payment %d: %v", c.PaymentID, err)
+	}
+	writePixCheckout(w, http.StatusCreated, pc)
+}
+
+// GetPixCharge devolve a cobrança PIX do pagamento {id}. Enquanto estiver
+// pendente, consulta o provedor (para o caso de o webhook ainda não ter
+// chegado) e, depois de vencida, marca a cobrança como expirada.
+func GetPixCharge(w http.ResponseWriter, r *http.Request) {
+	pc, ok := loadPixCharge(w, r)
+	if !ok {
+		return
+	}
+	writePixCheckout(w, http.StatusOK, pc)
+}
+
+// GetPixQRCode devolve o QR code da cobrança PIX do pagamento {id} em PNG.
+func GetPixQRCode(w http.ResponseWriter, r *http.Request) {
+	pc, ok := loadPixCharge(w, r)
+	if !ok {
+		return
+	}
+	png, err := qrcode.Encode(pc.Code, qrcode.Medium, pixQRSize)
+	if err != nil {
+		http.Error(w, "Failed to render QR code", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "private, max-age=300")
+	w.Write(png)
+}
+
+func loadPixCharge(w http.ResponseWriter, r *http.Request) (*PixCheckout, bool) {
+	userID, ok := r.Context().Value(middleware.UserIDKey).(int64)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
+		return nil, false
+	}
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid payment ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	pc, err := checkouts.pix(r.Context(), userID, id)
+	if errors.Is(err, errPixNotFound) {
+		http.Error(w, "PIX charge not found", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, "Failed to query PIX charge", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	if pollableStatuses[pc.Status] {
+		if refreshed, err := syncPix(r.Context(), userID, pc); err != nil {
+			log.Printf("WARN: Could not sync PIX charge of payment %d: %v", pc.PaymentID, err)
+		} else {
+			pc = refreshed
+		}
+	}
+	return pc, true
+}
+
+// syncPix aplica o status do pagamento no provedor e expira a cobrança
+// vencida que continua pendente.
+func syncPix(ctx context.Context, userID int64, pc *PixCheckout) (*PixCheckout, error) {
+	if provider, err := paymentProvider(pc.Provider); err == nil && pc.ProviderPaymentID != "" {
+		remote, err := provider.GetPayment(ctx, pc.ProviderPaymentID)
+		if err != nil {
+			return nil, err
+		}
+		if remote.Status != pc.Status {
+			if err := checkouts.apply(ctx, pc.PaymentID, remote); err != nil {
+				return nil, err
+			}
+			return checkouts.pix(ctx, userID, pc.PaymentID)
+		}
+	}
+	if time.Now().After(pc.ExpiresAt) {
+		if err := checkouts.expirePix(ctx, pc.PaymentID); err != nil {
+			return nil, err
+		}
+		return checkouts.pix(ctx, userID, pc.PaymentID)
+	}
+	return pc, nil
+}
+
+func writePixCheckout(w http.ResponseWriter, status int, pc *PixCheckout) {
+	if png, err := qrcode.Encode(pc.Code, qrcode.Medium, pixQRSize); err != nil {
+		log.Printf("ERROR: Could not render QR code of payment %d: %v", pc.PaymentID, err)
+	} else {
+		pc.QRCodePNG = base64.StdEncoding.EncodeToString(png)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(pc)
+}
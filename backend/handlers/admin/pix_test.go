@@ -0,0 +1,138 @@
+package admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"CDNProxy_v2/backend/middleware"
+	"CDNProxy_v2/backend/services/payments"
+)
+
+func TestPixCheckout(t *testing.T) {
+	env := newCheckoutEnv(t)
+	env.store.prices[5] = map[string]float64{"10": 30}
+	if code := env.call(t, 5, "PUT", "/api/admin/cart", `{"items":[{"product_type":"domain_renewal","product_identifier":"10"}]}`, nil); code != http.StatusOK {
+		t.Fatalf("PUT /cart: status %d", code)
+	}
+
+	var pc PixCheckout
+	if code := env.call(t, 5, "POST", "/api/admin/checkout/pix", "", &pc); code != http.StatusCreated {
+		t.Fatalf("POST /checkout/pix: status %d", code)
+	}
+	if pc.Status != "pending" || pc.Amount != 30 || pc.Currency != "BRL" || pc.Provider != "mercadopago" || pc.Code == "" || pc.TransactionID == 0 {
+		t.Errorf("cobrança PIX inesperada: %+v", pc)
+	}
+	if d := time.Until(pc.ExpiresAt); d < 29*time.Minute || d > 31*time.Minute {
+		t.Errorf("validade padrão de %v, esperados 30 minutos", d)
+	}
+	raw, err := base64.StdEncoding.DecodeString(pc.QRCodePNG)
+	if err != nil {
+		t.Fatalf("qr_code_base64 inválido: %v", err)
+	}
+	if _, err := png.Decode(bytes.NewReader(raw)); err != nil {
+		t.Errorf("qr_code_base64 não é um PNG: %v", err)
+	}
+	if len(env.mp.pix) != 1 || env.mp.pix[0].PaymentMethodID != "pix" || env.mp.pix[0].TransactionAmount != 30 ||
+		env.mp.pix[0].ExternalReference != strconv.FormatInt(pc.PaymentID, 10) {
+		t.Errorf("pagamento PIX enviado ao MercadoPago: %+v", env.mp.pix)
+	}
+
+	path := "/api/admin/payments/" + strconv.FormatInt(pc.PaymentID, 10) + "/pix"
+	if code := env.call(t, 6, "GET", path, "", nil); code != http.StatusNotFound {
+		t.Errorf("cobrança de outro usuário: status %d, esperado 404", code)
+	}
+
+	req := httptest.NewRequest("GET", path+"/qrcode.png", nil)
+	req = req.WithContext(context.WithValue(req.Context(), middleware.UserIDKey, int64(5)))
+	rec := httptest.NewRecorder()
+	env.router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("GET qrcode.png: status %d, content-type %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if _, err := png.Decode(rec.Body); err != nil {
+		t.Errorf("qrcode.png não é um PNG: %v", err)
+	}
+
+	// O cliente pagou; a consulta encontra a aprovação antes do webhook
+	mpID := strconv.Itoa(700 + len(env.mp.pix))
+	paid := env.mp.byID[mpID]
+	paid.Status = "approved"
+	env.mp.byID[mpID] = paid
+	if code := env.call(t, 5, "GET", path, "", &pc); code != http.StatusOK || pc.Status != "approved" || pc.PaidAt == nil {
+		t.Fatalf("depois do pagamento: status %d, %+v", code, pc)
+	}
+	if p := env.store.payments[pc.PaymentID]; p.Status != "approved" || p.FulfilledAt == nil {
+		t.Errorf("pagamento não foi entregue: %+v", p)
+	}
+	if len(env.store.carts[5]) != 0 {
+		t.Errorf("carrinho não foi esvaziado: %+v", env.store.carts[5])
+	}
+}
+
+func TestPixCheckoutExpiry(t *testing.T) {
+	env := newCheckoutEnv(t)
+	env.store.prices[5] = map[string]float64{"10": 30}
+	env.call(t, 5, "PUT", "/api/admin/cart", `{"items":[{"product_type":"domain_renewal","product_identifier":"10"}]}`, nil)
+
+	var pc PixCheckout
+	if code := env.call(t, 5, "POST", "/api/admin/checkout/pix", `{"expires_in_minutes":60}`, &pc); code != http.StatusCreated {
+		t.Fatalf("POST /checkout/pix: status %d", code)
+	}
+	if d := time.Until(pc.ExpiresAt); d < 59*time.Minute || d > 61*time.Minute {
+		t.Errorf("validade de %v, esperados 60 minutos", d)
+	}
+
+	// A cobrança venceu sem ser paga
+	env.store.pixes[pc.PaymentID].ExpiresAt = time.Now().Add(-time.Minute)
+	path := "/api/admin/payments/" + strconv.FormatInt(pc.PaymentID, 10) + "/pix"
+	if code := env.call(t, 5, "GET", path, "", &pc); code != http.StatusOK || pc.Status != pixExpired {
+		t.Fatalf("cobrança vencida: status %d, %+v", code, pc)
+	}
+	if p := env.store.payments[pc.PaymentID]; p.Status != "cancelled" || p.FulfilledAt != nil {
+		t.Errorf("pagamento da cobrança vencida: %+v", p)
+	}
+}
+
+// noPixProvider esconde o CreatePix do provedor embutido.
+type noPixProvider struct{ payments.Provider }
+
+func TestPixCheckoutErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		setup func(env *checkoutEnv)
+		want  int
+	}{
+		{"validade curta demais", `{"expires_in_minutes":5}`, nil, http.StatusBadRequest},
+		{"validade longa demais", `{"expires_in_minutes":50000}`, nil, http.StatusBadRequest},
+		{"provedor desconhecido", `{"provider":"paypal"}`, nil, http.StatusBadRequest},
+		{"provedor sem PIX", "", func(env *checkoutEnv) {
+			mp, _ := paymentProvider("")
+			paymentProvider = func(string) (payments.Provider, error) { return noPixProvider{mp}, nil }
+		}, http.StatusBadRequest},
+		{"carrinho vazio", "", func(env *checkoutEnv) { delete(env.store.carts, 5) }, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newCheckoutEnv(t)
+			env.store.prices[5] = map[string]float64{"10": 30}
+			env.call(t, 5, "PUT", "/api/admin/cart", `{"items":[{"product_type":"domain_renewal","product_identifier":"10"}]}`, nil)
+			if tt.setup != nil {
+				tt.setup(env)
+			}
+			if code := env.call(t, 5, "POST", "/api/admin/checkout/pix", tt.body, nil); code != tt.want {
+				t.Errorf("POST /checkout/pix: status %d, esperado %d", code, tt.want)
+			}
+			if len(env.mp.pix) != 0 {
+				t.Errorf("cobrança criada no MercadoPago: %+v", env.mp.pix)
+			}
+		})
+	}
+}
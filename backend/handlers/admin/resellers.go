@@ -0,0 +1,544 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"CDNProxy_v2/backend/database"
+	"CDNProxy_v2/backend/middleware"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+)
+
+// SubAccount é uma subconta de revendedor.
+type SubAccount struct {
+	ID        int64     `json:"id"`
+	Email     string    `json:"email"`
+	Name      string    `json:"name"`
+	Active    bool      `json:"active"`
+	Domains   int       `json:"domains"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ResellerSummary resume a cota de domínios do revendedor.
+type ResellerSummary struct {
+	DomainQuota int `json:"domain_quota"`
+	DomainsUsed int `json:"domains_used"`
+	SubAccounts int `json:"sub_accounts"`
+}
+
+// ResellerPrice é o preço de um plano para as subcontas. Price é nulo quando
+// o revendedor não definiu preço e vale o BasePrice.
+type ResellerPrice struct {
+	PlanID    int64    `json:"plan_id"`
+	PlanName  string   `json:"plan_name"`
+	BasePrice float64  `json:"base_price"`
+	Price     *float64 `json:"price"`
+}
+
+// SubAccountTraffic soma os acessos dos domínios de uma conta no período.
+type SubAccountTraffic struct {
+	UserID  int64  `json:"user_id"`
+	Email   string `json:"email"`
+	Domains int    `json:"domains"`
+	Hits    int64  `json:"hits"`
+}
+
+var (
+	errQuotaExceeded = errors.New("domain quota exceeded")
+	errPlanNotFound  = errors.New("plan not found")
+)
+
+// requireReseller devolve o id do usuário logado se ele for revendedor (tem
+// domain_quota definido); caso contrário responde 403.
+func requireReseller(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	userID, ok := r.Context().Value(middleware.UserIDKey).(int64)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusInternalServerError)
+		return 0, false
+	}
+
+	var quota *int
+	if err := database.DB.QueryRow(r.Context(), "SELECT domain_quota FROM public.users WHERE id = $1", userID).Scan(&quota); err != nil {
+		http.Error(w, "Failed to load reseller", http.StatusInternalServerError)
+		return 0, false
+	}
+	if quota == nil {
+		http.Error(w, "Forbidden: not a reseller", http.StatusForbidden)
+		return 0, false
+	}
+	return userID, true
+}
+
+// subAccountID lê {id} da rota e confirma que é uma subconta do revendedor.
+func subAccountID(w http.ResponseWriter, r *http.Request, resellerID int64) (int64, bool) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid sub-account ID", http.StatusBadRequest)
+		return 0, false
+	}
+	if id == resellerID {
+		http.Error(w, "Sub-account not found", http.StatusNotFound)
+		return 0, false
+	}
+	owns, err := ownsAccount(r.Context(), resellerID, id)
+	if err != nil {
+		http.Error(w, "Failed to load sub-account", http.StatusInternalServerError)
+		return 0, false
+	}
+	if !owns {
+		http.Error(w, "Sub-account not found", http.StatusNotFound)
+		return 0, false
+	}
+	return id, true
+}
+
+// GetResellerSummary devolve a cota e o uso atual do revendedor.
+func GetResellerSummary(w http.ResponseWriter, r *http.Request) {
+	resellerID, ok := requireReseller(w, r)
+	if !ok {
+		return
+	}
+
+	var s ResellerSummary
+	err := database.DB.QueryRow(r.Context(), `
+		SELECT u.domain_quota,
+			(SELECT COUNT(*) FROM public.domains WHERE user_id IN `+ownAccounts("$1")+`),
+			(SELECT COUNT(*) FROM public.users WHERE parent_id = $1)
+		FROM public.users u WHERE u.id = $1`, resellerID).Scan(&s.DomainQuota, &s.DomainsUsed, &s.SubAccounts)
+	if err != nil {
+		http.Error(w, "Failed to query reseller summary", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+// ListSubAccounts lista as subcontas do revendedor com a contagem de domínios.
+func ListSubAccounts(w http.ResponseWriter, r *http.Request) {
+	resellerID, ok := requireReseller(w, r)
+	if !ok {
+		return
+	}
+
+	rows, err := database.DB.Query(r.Context(), `
+		SELECT u.id, u.email, COALESCE(u.name, ''), COALESCE(u.active, false), u.created_at,
+			(SELECT COUNT(*) FROM public.domains d WHERE d.user_id = u.id)
+		FROM public.users u
+		WHERE u.parent_id = $1
+		ORDER BY u.id`, resellerID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to query sub-accounts: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	accounts := []SubAccount{}
+	for rows.Next() {
+		var a SubAccount
+		if err := rows.Scan(&a.ID, &a.Email, &a.Name, &a.Active, &a.CreatedAt, &a.Domains); err != nil {
+			http.Error(w, "Failed to scan sub-account", http.StatusInternalServerError)
+			return
+		}
+		accounts = append(accounts, a)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Error iterating over sub-accounts", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(accounts)
+}
+
+// CreateSubAccount cria um usuário Admin vinculado ao revendedor.
+func CreateSubAccount(w http.ResponseWriter, r *http.Request) {
+	resellerID, ok := requireReseller(w, r)
+	if !ok {
+		return
+	}
+
+	var p struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+		Name     string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	p.Email = strings.TrimSpace(p.Email)
+	if p.Email == "" || p.Password == "" {
+		http.Error(w, "Email and password are required", http.StatusBadRequest)
+		return
+	}
+	if len(p.Password) < middleware.MinPasswordLength {
+		http.Error(w, fmt.Sprintf("Password must be at least %d characters", middleware.MinPasswordLength), http.StatusBadRequest)
+		return
+	}
+
+	auth, err := middleware.CurrentAuthenticator()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	a := SubAccount{Email: p.Email, Name: p.Name, Active: true}
+	err = database.DB.QueryRow(r.Context(), `
+		INSERT INTO public.users (email, encrypted_password, role, name, active, parent_id, created_at, updated_at)
+		VALUES ($1, '', 2, $2, true, $3, NOW(), NOW())
+		RETURNING id, created_at`,
+		p.Email, p.Name, resellerID).Scan(&a.ID, &a.CreatedAt)
+	if err != nil {
+		log.Printf("ERROR: Reseller %d could not create sub-account %s: %v", resellerID, p.Email, err)
+		http.Error(w, "Failed to create sub-account", http.StatusInternalServerError)
+		return
+	}
+
+	// Mesmo fluxo de superadmin.CreateUser: se as credenciais falharem, desfaz o usuário
+	if err := auth.CreateCredentials(r.Context(), a.ID, p.Email, p.Password); err != nil {
+		database.DB.Exec(r.Context(), "DELETE FROM public.users WHERE id = $1", a.ID)
+		log.Printf("ERROR: Could not create credentials of sub-account %d: %v", a.ID, err)
+		http.Error(w, "Failed to create sub-account credentials", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(a)
+}
+
+// UpdateSubAccount altera nome, status ou senha de uma subconta.
+func UpdateSubAccount(w http.ResponseWriter, r *http.Request) {
+	resellerID, ok := requireReseller(w, r)
+	if !ok {
+		return
+	}
+	id, ok := subAccountID(w, r, resellerID)
+	if !ok {
+		return
+	}
+
+	var p struct {
+		Name     *string `json:"name"`
+		Active   *bool   `json:"active"`
+		Password string  `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if p.Password != "" {
+		if len(p.Password) < middleware.MinPasswordLength {
+			http.Error(w, fmt.Sprintf("Password must be at least %d characters", middleware.MinPasswordLength), http.StatusBadRequest)
+			return
+		}
+		auth, err := middleware.CurrentAuthenticator()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := auth.SetPassword(r.Context(), id, p.Password); err != nil {
+			log.Printf("ERROR: Could not update password of sub-account %d: %v", id, err)
+			http.Error(w, "Failed to update password", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	_, err := database.DB.Exec(r.Context(),
+		"UPDATE public.users SET name = COALESCE($1, name), active = COALESCE($2, active), updated_at = NOW() WHERE id = $3",
+		p.Name, p.Active, id)
+	if err != nil {
+		http.Error(w, "Failed to update sub-account", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// CreateSubAccountDomain cria um domínio para uma subconta, dentro da cota do
+// revendedor. O domínio nasce vencido e passa a valer depois da renovação.
+func CreateSubAccountDomain(w http.ResponseWriter, r *http.Request) {
+	resellerID, ok := requireReseller(w, r)
+	if !ok {
+		return
+	}
+	id, ok := subAccountID(w, r, resellerID)
+	if !ok {
+		return
+	}
+
+	var p struct {
+		Name      string `json:"name"`
+		Dominio   string `json:"dominio"`
+		TargetURL string `json:"target_url"`
+		PlanID    int64  `json:"plan_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	p.Dominio = strings.ToLower(strings.TrimSpace(p.Dominio))
+	if p.Dominio == "" || p.TargetURL == "" || p.PlanID == 0 {
+		http.Error(w, "dominio, target_url and plan_id are required", http.StatusBadRequest)
+		return
+	}
+	if p.Name == "" {
+		p.Name = p.Dominio
+	}
+
+	domainID, err := createDomainWithinQuota(r.Context(), resellerID, id, p.Name, p.Dominio, p.TargetURL, p.PlanID)
+	switch {
+	case errors.Is(err, errQuotaExceeded):
+		http.Error(w, "Domain quota exceeded", http.StatusConflict)
+		return
+	case errors.Is(err, errPlanNotFound):
+		http.Error(w, "Plan not found", http.StatusBadRequest)
+		return
+	case err != nil:
+		http.Error(w, fmt.Sprintf("Failed to create domain: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]int64{"id": domainID, "user_id": id})
+}
+
+// createDomainWithinQuota trava a linha do revendedor para que criações
+// simultâneas não ultrapassem a cota.
+func createDomainWithinQuota(ctx context.Context, resellerID, ownerID int64, name, dominio, targetURL string, planID int64) (int64, error) {
+	tx, err := database.DB.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	var quota, used int
+	if err := tx.QueryRow(ctx, "SELECT domain_quota FROM public.users WHERE id = $1 AND domain_quota IS NOT NULL FOR UPDATE", resellerID).Scan(&quota); err != nil {
+		return 0, err
+	}
+	if err := tx.QueryRow(ctx, "SELECT COUNT(*) FROM public.domains WHERE user_id IN "+ownAccounts("$1"), resellerID).Scan(&used); err != nil {
+		return 0, err
+	}
+	if used >= quota {
+		return 0, errQuotaExceeded
+	}
+
+	if err := tx.QueryRow(ctx, "SELECT 1 FROM public.plans WHERE id = $1", planID).Scan(new(int)); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, errPlanNotFound
+		}
+		return 0, err
+	}
+
+	var id int64
+	err = tx.QueryRow(ctx, `
+		INSERT INTO public.domains (name, dominio, user_id, expired_at, target_url, plan_id, created_at, updated_at)
+		VALUES ($1, $2, $3, NOW(), $4, $5, NOW(), NOW())
+		RETURNING id`,
+		name, dominio, ownerID, targetURL, planID).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	return id, tx.Commit(ctx)
+}
+
+// AssignDomainOwner transfere um domínio entre o revendedor e as suas
+// subcontas. Não altera o uso da cota.
+func AssignDomainOwner(w http.ResponseWriter, r *http.Request) {
+	resellerID, ok := requireReseller(w, r)
+	if !ok {
+		return
+	}
+	domainID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid domain ID", http.StatusBadRequest)
+		return
+	}
+
+	var p struct {
+		UserID int64 `json:"user_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil || p.UserID == 0 {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if owns, err := ownsAccount(r.Context(), resellerID, p.UserID); err != nil || !owns {
+		http.Error(w, "Sub-account not found", http.StatusNotFound)
+		return
+	}
+
+	tag, err := database.DB.Exec(r.Context(),
+		"UPDATE public.domains SET user_id = $1, updated_at = NOW() WHERE id = $2 AND user_id IN "+ownAccounts("$3"),
+		p.UserID, domainID, resellerID)
+	if err != nil {
+		http.Error(w, "Failed to assign domain", http.StatusInternalServerError)
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		http.Error(w, "Domain not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SubAccountsTrafficHandler soma os acessos dos últimos dias (days, padrão
+// 30) por conta: o próprio revendedor e cada subconta.
+func SubAccountsTrafficHandler(w http.ResponseWriter, r *http.Request) {
+	resellerID, ok := requireReseller(w, r)
+	if !ok {
+		return
+	}
+
+	days := 30
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 365 {
+			http.Error(w, "Invalid days: use 1 to 365", http.StatusBadRequest)
+			return
+		}
+		days = n
+	}
+	since := time.Now().AddDate(0, 0, -days)
+
+	rows, err := database.DB.Query(r.Context(), `
+		SELECT u.id, u.email,
+			(SELECT COUNT(*) FROM public.domains d WHERE d.user_id = u.id),
+			COALESCE((
+				SELECT SUM(r.hits) FROM public.access_log_rollups_daily r
+				JOIN public.domains d ON r.domain_id = d.id
+				WHERE d.user_id = u.id AND r.day >= $2::date
+			), 0)::bigint
+		FROM public.users u
+		WHERE u.id IN `+ownAccounts("$1")+`
+		ORDER BY u.id`, resellerID, since)
+	if err != nil {
+		http.Error(w, "Error fetching sub-account traffic: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	results := []SubAccountTraffic{}
+	for rows.Next() {
+		var t SubAccountTraffic
+		if err := rows.Scan(&t.UserID, &t.Email, &t.Domains, &t.Hits); err != nil {
+			http.Error(w, "Error scanning sub-account traffic: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		results = append(results, t)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// ListResellerPrices lista todos os planos com o preço do revendedor.
+func ListResellerPrices(w http.ResponseWriter, r *http.Request) {
+	resellerID, ok := requireReseller(w, r)
+	if !ok {
+		return
+	}
+
+	rows, err := database.DB.Query(r.Context(), `
+		SELECT p.id, p.name, p.price, rp.price
+		FROM public.plans p
+		LEFT JOIN public.reseller_prices rp ON rp.plan_id = p.id AND rp.reseller_id = $1
+		ORDER BY p.id`, resellerID)
+	if err != nil {
+		http.Error(w, "Failed to query prices", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	prices := []ResellerPrice{}
+	for rows.Next() {
+		var p ResellerPrice
+		if err := rows.Scan(&p.PlanID, &p.PlanName, &p.BasePrice, &p.Price); err != nil {
+			http.Error(w, "Failed to scan price", http.StatusInternalServerError)
+			return
+		}
+		prices = append(prices, p)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(prices)
+}
+
+// SetResellerPrice define o preço cobrado das subcontas em um plano.
+func SetResellerPrice(w http.ResponseWriter, r *http.Request) {
+	resellerID, ok := requireReseller(w, r)
+	if !ok {
+		return
+	}
+	planID, err := strconv.ParseInt(mux.Vars(r)["plan_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid plan ID", http.StatusBadRequest)
+		return
+	}
+
+	var p struct {
+		Price float64 `json:"price"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if p.Price <= 0 {
+		http.Error(w, "price must be greater than zero", http.StatusBadRequest)
+		return
+	}
+
+	tag, err := database.DB.Exec(r.Context(), `
+		INSERT INTO public.reseller_prices (reseller_id, plan_id, price)
+		SELECT $1, id, $3 FROM public.plans WHERE id = $2
+		ON CONFLICT (reseller_id, plan_id) DO UPDATE SET price = EXCLUDED.price, updated_at = NOW()`,
+		resellerID, planID, p.Price)
+	if err != nil {
+		http.Error(w, "Failed to save price", http.StatusInternalServerError)
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		http.Error(w, "Plan not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteResellerPrice volta a cobrar das subcontas o preço do plano.
+func DeleteResellerPrice(w http.ResponseWriter, r *http.Request) {
+	resellerID, ok := requireReseller(w, r)
+	if !ok {
+		return
+	}
+	planID, err := strconv.ParseInt(mux.Vars(r)["plan_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid plan ID", http.StatusBadRequest)
+		return
+	}
+
+	tag, err := database.DB.Exec(r.Context(),
+		"DELETE FROM public.reseller_prices WHERE reseller_id = $1 AND plan_id = $2", resellerID, planID)
+	if err != nil {
+		http.Error(w, "Failed to delete price", http.StatusInternalServerError)
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		http.Error(w, "Price not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
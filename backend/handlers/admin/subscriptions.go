@@ -0,0 +1,416 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"CDNProxy_v2/backend/database"
+	"CDNProxy_v2/backend/middleware"
+	"CDNProxy_v2/backend/models"
+	"CDNProxy_v2/backend/services/payments"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+)
+
+var (
+	errSubscriptionNotFound = errors.New("subscription not found")
+	errSubscriptionExists   = errors.New("domain already has an active subscription")
+)
+
+// Subscription é a renovação automática de um domínio: o provedor cobra o
+// preço do plano a cada período e cada cobrança aprovada renova o domínio.
+type Subscription struct {
+	ID                     int64      `json:"id"`
+	UserID                 int64      `json:"user_id"`
+	DomainID               *int64     `json:"domain_id"`
+	Domain                 *string    `json:"domain"`
+	PlanID                 *int64     `json:"plan_id"`
+	Provider               string     `json:"provider"`
+	Status                 string     `json:"status"`
+	Amount                 float64    `json:"amount"`
+	Currency               string     `json:"currency"`
+	BillingPeriod          string     `json:"billing_period"`
+	PeriodDays             *int       `json:"period_days"`
+	CheckoutURL            *string    `json:"checkout_url,omitempty"`
+	NextChargeAt           *time.Time `json:"next_charge_at"`
+	LastChargedAt          *time.Time `json:"last_charged_at"`
+	CancelledAt            *time.Time `json:"cancelled_at"`
+	CreatedAt              time.Time  `json:"created_at"`
+	UpdatedAt              time.Time  `json:"updated_at"`
+	ProviderSubscriptionID *string    `json:"-"`
+}
+
+// activeSubscription informa se a assinatura ainda está em vigor.
+func activeSubscription(status string) bool {
+	return status == payments.SubscriptionPending || status == payments.SubscriptionAuthorized || status == payments.SubscriptionPaused
+}
+
+// subscriptionStore isola o banco das assinaturas para os testes.
+type subscriptionStore interface {
+	// create grava a assinatura pendente do domínio domainID, do usuário ou
+	// de uma subconta dele, pelo preço atual do plano na moeda base.
+	create(ctx context.Context, userID, domainID int64, provider string) (*Subscription, error)
+	// attach guarda a assinatura criada no provedor.
+	attach(ctx context.Context, id int64, providerID, checkoutURL string) error
+	// discard apaga a assinatura que o provedor não aceitou.
+	discard(ctx context.Context, id int64) error
+	list(ctx context.Context, userID int64) ([]Subscription, error)
+	get(ctx context.Context, userID, id int64) (*Subscription, error)
+	// sync registra o estado da assinatura no provedor (como o webhook).
+	sync(ctx context.Context, provider string, sub *payments.Subscription) error
+	// cancel cancela só localmente a assinatura que nunca chegou ao provedor.
+	cancel(ctx context.Context, id int64) error
+}
+
+var subscriptions subscriptionStore = dbSubscriptionStore{}
+
+type dbSubscriptionStore struct{}
+
+const subscriptionColumns = `s.id, s.user_id, s.domain_id, d.name, s.plan_id, s.provider, s.status, s.amount::float8, s.currency,
+	s.billing_period, s.period_days, s.checkout_url, s.next_charge_at, s.last_charged_at, s.cancelled_at, s.created_at, s.updated_at,
+	s.provider_subscription_id`
+
+func scanSubscription(row pgx.Row) (*Subscription, error) {
+	var s Subscription
+	err := row.Scan(&s.ID, &s.UserID, &s.DomainID, &s.Domain, &s.PlanID, &s.Provider, &s.Status, &s.Amount, &s.Currency,
+		&s.BillingPeriod, &s.PeriodDays, &s.CheckoutURL, &s.NextChargeAt, &s.LastChargedAt, &s.CancelledAt, &s.CreatedAt, &s.UpdatedAt,
+		&s.ProviderSubscriptionID)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (dbSubscriptionStore) create(ctx context.Context, userID, domainID int64, provider string) (*Subscription, error) {
+	tx, err := database.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	// FOR UPDATE serializa as assinaturas do mesmo domínio
+	var (
+		name   string
+		planID *int64
+	)
+	err = tx.QueryRow(ctx,
+		"SELECT name, plan_id FROM public.domains WHERE id = $1 AND user_id IN "+ownAccounts("$2")+" FOR UPDATE",
+		domainID, userID).Scan(&name, &planID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errItemNotAvailable
+	}
+	if err != nil {
+		return nil, err
+	}
+	var exists bool
+	if err := tx.QueryRow(ctx,
+		"SELECT EXISTS (SELECT 1 FROM public.subscriptions WHERE domain_id = $1 AND status IN ('pending', 'authorized', 'paused'))",
+		domainID).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, errSubscriptionExists
+	}
+
+	item := CartItem{ProductType: "domain_renewal", ProductIdentifier: strconv.FormatInt(domainID, 10), Periods: 1}
+	if err := priceCartItem(ctx, tx, userID, models.BaseCurrency, &item); err != nil {
+		return nil, err
+	}
+
+	s := &Subscription{UserID: userID, DomainID: &domainID, Domain: &name, PlanID: planID, Provider: provider,
+		Status: payments.SubscriptionPending, Amount: item.Price, Currency: models.BaseCurrency,
+		BillingPeriod: item.BillingPeriod, PeriodDays: item.PeriodDays}
+	err = tx.QueryRow(ctx, `
+		INSERT INTO public.subscriptions (user_id, domain_id, plan_id, provider, status, amount, currency, billing_period, period_days, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, NOW(), NOW())
+		RETURNING id, created_at, updated_at`,
+		userID, domainID, planID, provider, s.Status, s.Amount, s.Currency, s.BillingPeriod, s.PeriodDays,
+	).Scan(&s.ID, &s.CreatedAt, &s.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return s, tx.Commit(ctx)
+}
+
+func (dbSubscriptionStore) attach(ctx context.Context, id int64, providerID, checkoutURL string) error {
+	_, err := database.DB.Exec(ctx,
+		"UPDATE public.subscriptions SET provider_subscription_id = $1, checkout_url = $2, updated_at = NOW() WHERE id = $3",
+		providerID, checkoutURL, id)
+	return err
+}
+
+func (dbSubscriptionStore) discard(ctx context.Context, id int64) error {
+	_, err := database.DB.Exec(ctx, "DELETE FROM public.subscriptions WHERE id = $1 AND provider_subscription_id IS NULL", id)
+	return err
+}
+
+func (dbSubscriptionStore) list(ctx context.Context, userID int64) ([]Subscription, error) {
+	rows, err := database.DB.Query(ctx, `
+		SELECT `+subscriptionColumns+`
+		FROM public.subscriptions s LEFT JOIN public.domains d ON d.id = s.domain_id
+		WHERE s.user_id IN `+ownAccounts("$1")+` ORDER BY s.id DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []Subscription{}
+	for rows.Next() {
+		s, err := scanSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *s)
+	}
+	return out, rows.Err()
+}
+
+func (dbSubscriptionStore) get(ctx context.Context, userID, id int64) (*Subscription, error) {
+	s, err := scanSubscription(database.DB.QueryRow(ctx, `
+		SELECT `+subscriptionColumns+`
+		FROM public.subscriptions s LEFT JOIN public.domains d ON d.id = s.domain_id
+		WHERE s.id = $1 AND s.user_id IN `+ownAccounts("$2"), id, userID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errSubscriptionNotFound
+	}
+	return s, err
+}
+
+func (dbSubscriptionStore) sync(ctx context.Context, provider string, sub *payments.Subscription) error {
+	return payments.SyncSubscription(ctx, provider, sub)
+}
+
+func (dbSubscriptionStore) cancel(ctx context.Context, id int64) error {
+	_, err := database.DB.Exec(ctx,
+		"UPDATE public.subscriptions SET status = 'cancelled', cancelled_at = NOW(), updated_at = NOW() WHERE id = $1",
+		id)
+	return err
+}
+
+// subscriptionFrequency devolve a cada quantos meses (ou dias, em planos
+// custom) o período do plano é cobrado.
+func subscriptionFrequency(period string, days *int) (int, bool) {
+	switch period {
+	case models.PeriodQuarterly:
+		return 3, false
+	case models.PeriodYearly:
+		return 12, false
+	case models.PeriodCustom:
+		if days != nil {
+			return *days, true
+		}
+	}
+	return 1, false
+}
+
+// subscriptionProvider devolve o provedor name (ou o padrão) se ele cobrar
+// assinaturas.
+func subscriptionProvider(name string) (payments.SubscriptionProvider, bool) {
+	p, err := paymentProvider(name)
+	if err != nil {
+		return nil, false
+	}
+	sp, ok := p.(payments.SubscriptionProvider)
+	return sp, ok
+}
+
+// CreateDomainSubscription ativa a renovação automática do domínio {id}: grava
+// a assinatura pendente e a cria no provedor, que devolve em checkout_url a
+// página onde o cliente autoriza as cobranças. Corpo opcional:
+// {"provider": "mercadopago"}.
+func CreateDomainSubscription(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(middleware.UserIDKey).(int64)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
+		return
+	}
+	domainID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid domain ID", http.StatusBadRequest)
+		return
+	}
+	var body struct {
+		Provider string `json:"provider"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+	provider, ok := subscriptionProvider(body.Provider)
+	if !ok {
+		http.Error(w, "Payment provider does not support subscriptions", http.StatusBadRequest)
+		return
+	}
+
+	user, err := checkouts.payer(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusInternalServerError)
+		return
+	}
+
+	s, err := subscriptions.create(r.Context(), userID, domainID, provider.Name())
+	switch {
+	case errors.Is(err, errItemNotAvailable):
+		http.Error(w, "Domain not found", http.StatusNotFound)
+		return
+	case errors.Is(err, errSubscriptionExists):
+		http.Error(w, "Domain already has an active subscription", http.StatusConflict)
+		return
+	case err != nil:
+		log.Printf("ERROR: Could not create subscription of domain %d for user %d: %v", domainID, userID, err)
+		http.Error(w, "Failed to create subscription", http.StatusInternalServerError)
+		return
+	}
+
+	frequency, days := subscriptionFrequency(s.BillingPeriod, s.PeriodDays)
+	req := &payments.SubscriptionRequest{
+		ExternalReference: payments.SubscriptionReference(s.ID),
+		Reason:            fmt.Sprintf("CDNProxy - renovação automática de %s", *s.Domain),
+		Payer:             payments.Payer{Email: user.Email},
+		Amount:            s.Amount,
+		Currency:          s.Currency,
+		Frequency:         frequency,
+		FrequencyDays:     days,
+		BackURL:           frontendURL() + "/admin/subscriptions",
+	}
+	remote, err := provider.CreateSubscription(r.Context(), req)
+	if err != nil {
+		log.Printf("ERROR: Could not create %s subscription %d: %v", provider.Name(), s.ID, err)
+		if err := subscriptions.discard(r.Context(), s.ID); err != nil {
+			log.Printf("ERROR: Could not discard subscription %d: %v", s.ID, err)
+		}
+		http.Error(w, "Failed to create subscription", http.StatusBadGateway)
+		return
+	}
+	if err := subscriptions.attach(r.Context(), s.ID, remote.ID, remote.URL); err != nil {
+		log.Printf("ERROR: Could not store subscription %d: %v", s.ID, err)
+	}
+	s.ProviderSubscriptionID, s.CheckoutURL = &remote.ID, &remote.URL
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(s)
+}
+
+// ListSubscriptions lista as assinaturas do usuário e das subcontas dele.
+func ListSubscriptions(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(middleware.UserIDKey).(int64)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
+		return
+	}
+	list, err := subscriptions.list(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "Failed to query subscriptions", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// GetSubscription devolve a assinatura {id}. Enquanto estiver pendente,
+// consulta o provedor, para o caso de a autorização do cliente ainda não ter
+// chegado pelo webhook.
+func GetSubscription(w http.ResponseWriter, r *http.Request) {
+	userID, s, ok := loadSubscription(w, r)
+	if !ok {
+		return
+	}
+	if s.Status == payments.SubscriptionPending && s.ProviderSubscriptionID != nil {
+		if provider, ok := subscriptionProvider(s.Provider); ok {
+			if err := syncSubscription(r.Context(), provider, s.ProviderSubscriptionID); err != nil {
+				log.Printf("WARN: Could not sync subscription %d: %v", s.ID, err)
+			} else if refreshed, err := subscriptions.get(r.Context(), userID, s.ID); err == nil {
+				s = refreshed
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+// CancelSubscription cancela a assinatura {id} no provedor; o domínio
+// continua ativo até o vencimento já pago.
+func CancelSubscription(w http.ResponseWriter, r *http.Request) {
+	userID, s, ok := loadSubscription(w, r)
+	if !ok {
+		return
+	}
+	if !activeSubscription(s.Status) {
+		http.Error(w, "Subscription is already cancelled", http.StatusConflict)
+		return
+	}
+
+	if s.ProviderSubscriptionID == nil {
+		// A assinatura nunca chegou ao provedor
+		if err := subscriptions.cancel(r.Context(), s.ID); err != nil {
+			http.Error(w, "Failed to cancel subscription", http.StatusInternalServerError)
+			return
+		}
+	} else {
+		provider, ok := subscriptionProvider(s.Provider)
+		if !ok {
+			http.Error(w, "Payment provider of the subscription is not available", http.StatusConflict)
+			return
+		}
+		remote, err := provider.CancelSubscription(r.Context(), *s.ProviderSubscriptionID)
+		if err != nil {
+			log.Printf("ERROR: Could not cancel %s subscription %d: %v", s.Provider, s.ID, err)
+			http.Error(w, "Failed to cancel subscription", http.StatusBadGateway)
+			return
+		}
+		if err := subscriptions.sync(r.Context(), s.Provider, remote); err != nil {
+			log.Printf("ERROR: Could not record cancellation of subscription %d: %v", s.ID, err)
+			http.Error(w, "Failed to cancel subscription", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	s, err := subscriptions.get(r.Context(), userID, s.ID)
+	if err != nil {
+		http.Error(w, "Failed to query subscription", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+func loadSubscription(w http.ResponseWriter, r *http.Request) (int64, *Subscription, bool) {
+	userID, ok := r.Context().Value(middleware.UserIDKey).(int64)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
+		return 0, nil, false
+	}
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid subscription ID", http.StatusBadRequest)
+		return 0, nil, false
+	}
+	s, err := subscriptions.get(r.Context(), userID, id)
+	if errors.Is(err, errSubscriptionNotFound) {
+		http.Error(w, "Subscription not found", http.StatusNotFound)
+		return 0, nil, false
+	}
+	if err != nil {
+		http.Error(w, "Failed to query subscription", http.StatusInternalServerError)
+		return 0, nil, false
+	}
+	return userID, s, true
+}
+
+func syncSubscription(ctx context.Context, provider payments.SubscriptionProvider, providerID *string) error {
+	remote, err := provider.GetSubscription(ctx, *providerID)
+	if err != nil {
+		return err
+	}
+	return subscriptions.sync(ctx, provider.Name(), remote)
+}
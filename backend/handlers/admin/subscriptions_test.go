@@ -0,0 +1,242 @@
+package admin
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"CDNProxy_v2/backend/models"
+	"CDNProxy_v2/backend/services/payments"
+)
+
+// fakeSubscriptionStore guarda as assinaturas em memória; os domínios que o
+// usuário pode assinar e os preços vêm de prices do fakeCheckoutStore.
+type fakeSubscriptionStore struct {
+	mu     sync.Mutex
+	prices *fakeCheckoutStore
+	subs   map[int64]*Subscription
+	nextID int64
+}
+
+func (s *fakeSubscriptionStore) create(_ context.Context, userID, domainID int64, provider string) (*Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item := CartItem{ProductType: "domain_renewal", ProductIdentifier: strconv.FormatInt(domainID, 10), Periods: 1}
+	if err := s.prices.price(userID, models.BaseCurrency, &item); err != nil {
+		return nil, err
+	}
+	for _, sub := range s.subs {
+		if *sub.DomainID == domainID && activeSubscription(sub.Status) {
+			return nil, errSubscriptionExists
+		}
+	}
+	s.nextID++
+	name := "dominio" + item.ProductIdentifier + ".com"
+	now := time.Now()
+	sub := &Subscription{ID: s.nextID, UserID: userID, DomainID: &domainID, Domain: &name, Provider: provider,
+		Status: payments.SubscriptionPending, Amount: item.Price, Currency: models.BaseCurrency, BillingPeriod: item.BillingPeriod,
+		CreatedAt: now, UpdatedAt: now}
+	s.subs[sub.ID] = sub
+	copied := *sub
+	return &copied, nil
+}
+
+func (s *fakeSubscriptionStore) attach(_ context.Context, id int64, providerID, checkoutURL string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subs[id].ProviderSubscriptionID, s.subs[id].CheckoutURL = &providerID, &checkoutURL
+	return nil
+}
+
+func (s *fakeSubscriptionStore) discard(_ context.Context, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.subs, id)
+	return nil
+}
+
+func (s *fakeSubscriptionStore) list(_ context.Context, userID int64) ([]Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := []Subscription{}
+	for id := s.nextID; id > 0; id-- {
+		if sub, ok := s.subs[id]; ok && sub.UserID == userID {
+			out = append(out, *sub)
+		}
+	}
+	return out, nil
+}
+
+func (s *fakeSubscriptionStore) get(_ context.Context, userID, id int64) (*Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, ok := s.subs[id]
+	if !ok || sub.UserID != userID {
+		return nil, errSubscriptionNotFound
+	}
+	copied := *sub
+	return &copied, nil
+}
+
+func (s *fakeSubscriptionStore) sync(_ context.Context, provider string, remote *payments.Subscription) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id, err := payments.ParseSubscriptionReference(remote.ExternalReference)
+	if err != nil {
+		return err
+	}
+	sub, ok := s.subs[id]
+	if !ok || sub.Provider != provider {
+		return payments.ErrSubscriptionNotFound
+	}
+	sub.Status, sub.ProviderSubscriptionID, sub.NextChargeAt = remote.Status, &remote.ID, remote.NextChargeAt
+	if remote.Status == payments.SubscriptionCancelled && sub.CancelledAt == nil {
+		now := time.Now()
+		sub.CancelledAt = &now
+	}
+	return nil
+}
+
+func (s *fakeSubscriptionStore) cancel(_ context.Context, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.subs[id].Status, s.subs[id].CancelledAt = payments.SubscriptionCancelled, &now
+	return nil
+}
+
+func newSubscriptionEnv(t *testing.T) (*checkoutEnv, *fakeSubscriptionStore) {
+	t.Helper()
+	env := newCheckoutEnv(t)
+	store := &fakeSubscriptionStore{prices: env.store, subs: map[int64]*Subscription{}}
+	prev := subscriptions
+	subscriptions = store
+	t.Cleanup(func() { subscriptions = prev })
+
+	env.router.HandleFunc("/api/admin/domains/{id}/subscription", CreateDomainSubscription).Methods("POST")
+	env.router.HandleFunc("/api/admin/subscriptions", ListSubscriptions).Methods("GET")
+	env.router.HandleFunc("/api/admin/subscriptions/{id}", GetSubscription).Methods("GET")
+	env.router.HandleFunc("/api/admin/subscriptions/{id}/cancel", CancelSubscription).Methods("POST")
+	return env, store
+}
+
+func TestDomainSubscription(t *testing.T) {
+	env, store := newSubscriptionEnv(t)
+	env.store.prices[5] = map[string]float64{"10": 30}
+
+	var sub Subscription
+	if code := env.call(t, 5, "POST", "/api/admin/domains/10/subscription", "", &sub); code != http.StatusCreated {
+		t.Fatalf("POST /domains/10/subscription: status %d", code)
+	}
+	if sub.Status != "pending" || sub.Amount != 30 || sub.Currency != "BRL" || sub.Provider != "mercadopago" ||
+		sub.CheckoutURL == nil || *sub.CheckoutURL != "https://mp.test/subscriptions/pre-sub-1" {
+		t.Errorf("assinatura inesperada: %+v", sub)
+	}
+	if len(env.mp.subscribed) != 1 {
+		t.Fatalf("assinaturas enviadas ao MercadoPago: %d, esperada 1", len(env.mp.subscribed))
+	}
+	req := env.mp.subscribed[0]
+	if req.ExternalReference != "sub-1" || req.PayerEmail != "cliente@example.com" || req.AutoRecurring.TransactionAmount != 30 ||
+		req.AutoRecurring.Frequency != 1 || req.AutoRecurring.FrequencyType != "months" || req.AutoRecurring.CurrencyID != "BRL" {
+		t.Errorf("preapproval enviado ao MercadoPago: %+v", req)
+	}
+
+	if code := env.call(t, 5, "POST", "/api/admin/domains/10/subscription", "", nil); code != http.StatusConflict {
+		t.Errorf("segunda assinatura do domínio: status %d, esperado 409", code)
+	}
+
+	var list []Subscription
+	if code := env.call(t, 5, "GET", "/api/admin/subscriptions", "", &list); code != http.StatusOK || len(list) != 1 || list[0].ID != sub.ID {
+		t.Errorf("GET /subscriptions: status %d, %+v", code, list)
+	}
+	if code := env.call(t, 6, "GET", "/api/admin/subscriptions/1", "", nil); code != http.StatusNotFound {
+		t.Errorf("assinatura de outro usuário: status %d, esperado 404", code)
+	}
+
+	// O cliente autorizou; a consulta encontra a autorização antes do webhook
+	env.mp.preapprovals["pre-sub-1"].Status = "authorized"
+	env.mp.preapprovals["pre-sub-1"].NextPaymentDate = "2026-11-19T10:00:00.000-03:00"
+	if code := env.call(t, 5, "GET", "/api/admin/subscriptions/1", "", &sub); code != http.StatusOK || sub.Status != "authorized" || sub.NextChargeAt == nil {
+		t.Fatalf("depois da autorização: status %d, %+v", code, sub)
+	}
+
+	if code := env.call(t, 5, "POST", "/api/admin/subscriptions/1/cancel", "", &sub); code != http.StatusOK || sub.Status != "cancelled" || sub.CancelledAt == nil {
+		t.Fatalf("POST /subscriptions/1/cancel: status %d, %+v", code, sub)
+	}
+	if env.mp.preapprovals["pre-sub-1"].Status != "cancelled" {
+		t.Errorf("assinatura não foi cancelada no MercadoPago: %+v", env.mp.preapprovals["pre-sub-1"])
+	}
+	if code := env.call(t, 5, "POST", "/api/admin/subscriptions/1/cancel", "", nil); code != http.StatusConflict {
+		t.Errorf("cancelar de novo: status %d, esperado 409", code)
+	}
+
+	// Cancelada, o domínio pode ser assinado outra vez
+	if code := env.call(t, 5, "POST", "/api/admin/domains/10/subscription", "", nil); code != http.StatusCreated {
+		t.Errorf("nova assinatura depois do cancelamento: status %d", code)
+	}
+	if len(store.subs) != 2 {
+		t.Errorf("assinaturas gravadas: %d, esperadas 2", len(store.subs))
+	}
+}
+
+func TestDomainSubscriptionErrors(t *testing.T) {
+	env, store := newSubscriptionEnv(t)
+	env.store.prices[5] = map[string]float64{"10": 30}
+
+	tests := []struct {
+		name string
+		path string
+		body string
+		want int
+	}{
+		{"domínio de outro usuário", "/api/admin/domains/11/subscription", "", http.StatusNotFound},
+		{"id inválido", "/api/admin/domains/abc/subscription", "", http.StatusBadRequest},
+		{"corpo inválido", "/api/admin/domains/10/subscription", "{", http.StatusBadRequest},
+		{"provedor desconhecido", "/api/admin/domains/10/subscription", `{"provider":"paypal"}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := env.call(t, 5, "POST", tt.path, tt.body, nil); code != tt.want {
+				t.Errorf("status %d, esperado %d", code, tt.want)
+			}
+		})
+	}
+
+	// O provedor recusou: a assinatura pendente é descartada
+	env.mp.failPrefs = true
+	if code := env.call(t, 5, "POST", "/api/admin/domains/10/subscription", "", nil); code != http.StatusBadGateway {
+		t.Errorf("falha no provedor: status %d, esperado 502", code)
+	}
+	if len(store.subs) != 0 {
+		t.Errorf("assinatura recusada continuou gravada: %+v", store.subs)
+	}
+
+	// Provedor sem assinaturas
+	paymentProvider = func(string) (payments.Provider, error) { return noPixProvider{}, nil }
+	if code := env.call(t, 5, "POST", "/api/admin/domains/10/subscription", "", nil); code != http.StatusBadRequest {
+		t.Errorf("provedor sem assinaturas: status %d, esperado 400", code)
+	}
+}
+
+func TestSubscriptionFrequency(t *testing.T) {
+	days := 45
+	tests := []struct {
+		period   string
+		days     *int
+		want     int
+		wantDays bool
+	}{
+		{models.PeriodMonthly, nil, 1, false},
+		{models.PeriodQuarterly, nil, 3, false},
+		{models.PeriodYearly, nil, 12, false},
+		{models.PeriodCustom, &days, 45, true},
+	}
+	for _, tt := range tests {
+		if got, gotDays := subscriptionFrequency(tt.period, tt.days); got != tt.want || gotDays != tt.wantDays {
+			t.Errorf("subscriptionFrequency(%q) = %d, %v; esperado %d, %v", tt.period, got, gotDays, tt.want, tt.wantDays)
+		}
+	}
+}
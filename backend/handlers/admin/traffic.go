@@ -17,6 +17,7 @@ type AdminDailyTraffic struct {
 }
 
 // TrafficChartHandler fetches aggregated daily hits for the logged-in user's domains
+// (and those of its sub-accounts, for resellers)
 func TrafficChartHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
@@ -29,18 +30,16 @@ func TrafficChartHandler(w http.ResponseWriter, r *http.Request) {
 
 	thirtyDaysAgo := time.Now().Add(-30 * 24 * time.Hour)
 
-	// Query: Join streaming_access_logs -> streaming_proxies -> domains
-	// Filter by domains.user_id
+	// Query: usa os rollups diários (access_log_rollups_daily) dos domínios do usuário
 	query := `
 		SELECT 
-			TO_CHAR(sal.created_at, 'YYYY-MM-DD') as day, 
-			COUNT(*) as hits
-		FROM streaming_access_logs sal
-		JOIN streaming_proxies sp ON sal.streaming_proxy_id = sp.id
-		JOIN domains d ON sp.domain_id = d.id
-		WHERE d.user_id = $1 AND sal.created_at >= $2
-		GROUP BY day
-		ORDER BY day ASC
+			TO_CHAR(r.day, 'YYYY-MM-DD') as day, 
+			SUM(r.hits)::bigint as hits
+		FROM access_log_rollups_daily r
+		JOIN domains d ON r.domain_id = d.id
+		WHERE d.user_id IN ` + ownAccounts("$1") + ` AND r.day >= $2::date
+		GROUP BY r.day
+		ORDER BY r.day ASC
 	`
 
 	rows, err := database.DB.Query(context.Background(), query, userID, thirtyDaysAgo)
@@ -17,6 +17,8 @@ type Payment struct {
 	Status    string    `json:"status"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
+	// InvoiceNumber é o número do recibo, depois da aprovação
+	InvoiceNumber *int64 `json:"invoice_number"`
 }
 
 func TransactionsHandler(w http.ResponseWriter, r *http.Request) {
@@ -28,7 +30,7 @@ func TransactionsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rows, err := database.DB.Query(context.Background(), "SELECT id, user_id, amount, status, created_at, updated_at FROM public.payments WHERE user_id = $1 ORDER BY created_at DESC", userID)
+	rows, err := database.DB.Query(context.Background(), "SELECT p.id, p.user_id, p.amount, p.status, p.created_at, p.updated_at, i.number FROM public.payments p LEFT JOIN public.invoices i ON i.payment_id = p.id WHERE p.user_id IN "+ownAccounts("$1")+" ORDER BY p.created_at DESC", userID)
 	if err != nil {
 		http.Error(w, "Failed to query transactions", http.StatusInternalServerError)
 		return
@@ -38,7 +40,7 @@ func TransactionsHandler(w http.ResponseWriter, r *http.Request) {
 	var transactions []Payment
 	for rows.Next() {
 		var p Payment
-		if err := rows.Scan(&p.ID, &p.UserID, &p.Amount, &p.Status, &p.CreatedAt, &p.UpdatedAt); err != nil {
+		if err := rows.Scan(&p.ID, &p.UserID, &p.Amount, &p.Status, &p.CreatedAt, &p.UpdatedAt, &p.InvoiceNumber); err != nil {
 			http.Error(w, "Failed to scan transaction", http.StatusInternalServerError)
 			return
 		}
@@ -0,0 +1,193 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"CDNProxy_v2/backend/database"
+	"CDNProxy_v2/backend/middleware"
+	"CDNProxy_v2/backend/models"
+	"CDNProxy_v2/backend/services/payments"
+	"CDNProxy_v2/backend/services/wallet"
+)
+
+// walletStore isola o banco da carteira para os testes.
+type walletStore interface {
+	get(ctx context.Context, userID int64) (*wallet.Wallet, error)
+	setAutoRenew(ctx context.Context, userID int64, enabled bool) (*wallet.Wallet, error)
+	// statement devolve até limit lançamentos mais antigos que beforeID
+	// (todos, quando zero), do mais recente para o mais antigo.
+	statement(ctx context.Context, userID, beforeID int64, limit int) (*wallet.Page, error)
+}
+
+var wallets walletStore = dbWalletStore{}
+
+type dbWalletStore struct{}
+
+func (dbWalletStore) get(ctx context.Context, userID int64) (*wallet.Wallet, error) {
+	return wallet.Get(ctx, userID)
+}
+
+func (dbWalletStore) setAutoRenew(ctx context.Context, userID int64, enabled bool) (*wallet.Wallet, error) {
+	return wallet.SetAutoRenew(ctx, userID, enabled)
+}
+
+func (dbWalletStore) statement(ctx context.Context, userID, beforeID int64, limit int) (*wallet.Page, error) {
+	return wallet.Statement(ctx, userID, beforeID, limit)
+}
+
+func (dbCheckoutStore) createTopUp(ctx context.Context, userID int64, provider string, amount float64) (*Checkout, error) {
+	item := CartItem{UserID: userID, ProductType: models.ProductWalletTopUp, ProductIdentifier: strconv.FormatInt(userID, 10), Price: amount, Periods: 1}
+	c := &Checkout{Provider: provider, Status: payments.StatusPending, Amount: amount, Currency: wallet.Currency, Items: []CartItem{item}}
+
+	// O webhook credita na carteira o preço do item quando o pagamento é aprovado
+	snapshot, err := json.Marshal(c.Items)
+	if err != nil {
+		return nil, err
+	}
+	err = database.DB.QueryRow(ctx, `
+		INSERT INTO public.payments (user_id, amount, currency, status, payment_method, metadata, created_at, updated_at)
+		VALUES ($1, $2, $3, 'pending', $4, $5, NOW(), NOW()) RETURNING id`,
+		userID, amount, c.Currency, provider, snapshot).Scan(&c.PaymentID)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// GetWallet devolve o saldo da carteira do usuário e se as renovações
+// automáticas com o saldo estão ligadas.
+func GetWallet(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(middleware.UserIDKey).(int64)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
+		return
+	}
+
+	wl, err := wallets.get(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "Failed to query wallet", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(wl)
+}
+
+// UpdateWallet liga ou desliga as renovações automáticas com o saldo da
+// carteira. Corpo: {"auto_renew": true}.
+func UpdateWallet(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(middleware.UserIDKey).(int64)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
+		return
+	}
+
+	var body struct {
+		AutoRenew *bool `json:"auto_renew"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.AutoRenew == nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	wl, err := wallets.setAutoRenew(r.Context(), userID, *body.AutoRenew)
+	if err != nil {
+		http.Error(w, "Failed to update wallet", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(wl)
+}
+
+// GetWalletEntries lista o extrato da carteira do usuário, do lançamento mais
+// recente para o mais antigo, paginado por limit e before_id.
+func GetWalletEntries(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(middleware.UserIDKey).(int64)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
+		return
+	}
+
+	q := r.URL.Query()
+	var beforeID int64
+	if v := q.Get("before_id"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 1 {
+			http.Error(w, "Parâmetro before_id inválido", http.StatusBadRequest)
+			return
+		}
+		beforeID = n
+	}
+	limit := wallet.DefaultLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "Parâmetro limit inválido", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, wallet.MaxLimit)
+	}
+
+	page, err := wallets.statement(r.Context(), userID, beforeID, limit)
+	if err != nil {
+		http.Error(w, "Failed to query wallet entries", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// CreateWalletTopUp cria o pagamento de uma recarga da carteira e devolve o
+// link de pagamento do provedor, como CreateCheckoutSession. O saldo é
+// creditado quando o pagamento é aprovado. Corpo:
+// {"amount": 100, "provider": "mercadopago"}; a recarga é sempre em reais.
+func CreateWalletTopUp(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(middleware.UserIDKey).(int64)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
+		return
+	}
+
+	var body struct {
+		Amount   float64 `json:"amount"`
+		Provider string  `json:"provider"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !wallet.ValidTopUp(body.Amount) {
+		http.Error(w, wallet.ErrInvalidTopUp.Error(), http.StatusBadRequest)
+		return
+	}
+	provider, err := paymentProvider(body.Provider)
+	if err != nil {
+		http.Error(w, "Unknown payment provider", http.StatusBadRequest)
+		return
+	}
+	if !payments.SupportsCurrency(provider, wallet.Currency) {
+		http.Error(w, fmt.Sprintf("Payment provider %s does not charge in %s", provider.Name(), wallet.Currency), http.StatusBadRequest)
+		return
+	}
+
+	user, err := checkouts.payer(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusInternalServerError)
+		return
+	}
+
+	c, err := checkouts.createTopUp(r.Context(), userID, provider.Name(), body.Amount)
+	if err != nil {
+		log.Printf("ERROR: Wallet top-up of user %d failed: %v", userID, err)
+		http.Error(w, "Failed to create payment record", http.StatusInternalServerError)
+		return
+	}
+	writeProviderCheckout(w, r, provider, user, c)
+}
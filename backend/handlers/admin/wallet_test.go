@@ -0,0 +1,265 @@
+package admin
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"CDNProxy_v2/backend/services/mercadopago"
+	"CDNProxy_v2/backend/services/payments"
+	"CDNProxy_v2/backend/services/stripe"
+	"CDNProxy_v2/backend/services/wallet"
+)
+
+// fakeWalletStore lê o saldo do fakeCheckoutStore e guarda em memória as
+// renovações automáticas e o extrato.
+type fakeWalletStore struct {
+	checkouts *fakeCheckoutStore
+	autoRenew map[int64]bool
+	entries   map[int64][]wallet.Entry
+}
+
+func (s *fakeWalletStore) get(_ context.Context, userID int64) (*wallet.Wallet, error) {
+	s.checkouts.mu.Lock()
+	defer s.checkouts.mu.Unlock()
+	return &wallet.Wallet{UserID: userID, Balance: s.checkouts.balances[userID], Currency: wallet.Currency, AutoRenew: s.autoRenew[userID]}, nil
+}
+
+func (s *fakeWalletStore) setAutoRenew(ctx context.Context, userID int64, enabled bool) (*wallet.Wallet, error) {
+	s.autoRenew[userID] = enabled
+	return s.get(ctx, userID)
+}
+
+// statement segue wallet.Statement: as entradas ficam da mais recente para a
+// mais antiga.
+func (s *fakeWalletStore) statement(_ context.Context, userID, beforeID int64, limit int) (*wallet.Page, error) {
+	page := &wallet.Page{Items: []wallet.Entry{}}
+	for _, e := range s.entries[userID] {
+		if beforeID != 0 && e.ID >= beforeID {
+			continue
+		}
+		if len(page.Items) == limit {
+			page.NextBeforeID = page.Items[limit-1].ID
+			break
+		}
+		page.Items = append(page.Items, e)
+	}
+	return page, nil
+}
+
+// newWalletEnv prepara o carrinho do usuário 5 com o domínio 10 (R$ 30) e as
+// rotas da carteira.
+func newWalletEnv(t *testing.T) (*checkoutEnv, *fakeWalletStore) {
+	t.Helper()
+	env := newCheckoutEnv(t)
+	ws := &fakeWalletStore{checkouts: env.store, autoRenew: map[int64]bool{}, entries: map[int64][]wallet.Entry{}}
+	prev := wallets
+	wallets = ws
+	t.Cleanup(func() { wallets = prev })
+
+	env.router.HandleFunc("/api/admin/wallet", GetWallet).Methods("GET")
+	env.router.HandleFunc("/api/admin/wallet", UpdateWallet).Methods("PUT")
+	env.router.HandleFunc("/api/admin/wallet/entries", GetWalletEntries).Methods("GET")
+	env.router.HandleFunc("/api/admin/wallet/top-up", CreateWalletTopUp).Methods("POST")
+
+	env.store.prices[5] = map[string]float64{"10": 30}
+	env.call(t, 5, "PUT", "/api/admin/cart", `{"items":[{"product_type":"domain_renewal","product_identifier":"10"}]}`, nil)
+	return env, ws
+}
+
+func TestWalletCheckout(t *testing.T) {
+	tests := []struct {
+		name       string
+		balance    float64
+		path       string
+		body       string
+		wantAmount float64
+		wantWallet float64
+		wantStatus string
+		wantMethod string
+	}{
+		{"saldo paga parte do pedido", 12.5, "/api/admin/checkout", `{"use_wallet":true}`, 17.5, 12.5, "pending", "mercadopago"},
+		{"saldo paga o pedido inteiro", 50, "/api/admin/checkout", `{"use_wallet":true}`, 0, 30, "approved", paymentMethodWallet},
+		{"saldo paga parte do PIX", 10, "/api/admin/checkout/pix", `{"use_wallet":true}`, 20, 10, "pending", "mercadopago"},
+		{"sem use_wallet o saldo fica", 50, "/api/admin/checkout", "", 30, 0, "pending", "mercadopago"},
+		{"carteira vazia", 0, "/api/admin/checkout", `{"use_wallet":true}`, 30, 0, "pending", "mercadopago"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env, _ := newWalletEnv(t)
+			env.store.balances[5] = tt.balance
+
+			var c Checkout
+			if code := env.call(t, 5, "POST", tt.path, tt.body, &c); code != http.StatusCreated {
+				t.Fatalf("POST %s: status %d", tt.path, code)
+			}
+			p := env.store.payments[c.PaymentID]
+			if p.Amount != tt.wantAmount || p.WalletAmount != tt.wantWallet || p.Status != tt.wantStatus || p.PaymentMethod != tt.wantMethod {
+				t.Errorf("pagamento: %+v", p)
+			}
+			if c.WalletAmount != tt.wantWallet || c.Status != tt.wantStatus {
+				t.Errorf("checkout: %+v", c)
+			}
+			if got := env.store.balances[5]; got != tt.balance-tt.wantWallet {
+				t.Errorf("saldo depois do checkout: %.2f, esperado %.2f", got, tt.balance-tt.wantWallet)
+			}
+			// O que a carteira quita não passa pelo provedor
+			if tt.wantAmount == 0 && (len(env.mp.preferences) != 0 || len(env.mp.pix) != 0) {
+				t.Errorf("pedido pago com saldo foi ao provedor: %+v %+v", env.mp.preferences, env.mp.pix)
+			}
+			if tt.wantAmount > 0 && tt.wantWallet > 0 && len(env.mp.preferences) == 1 {
+				if items := env.mp.preferences[0].Items; len(items) != 1 || items[0].UnitPrice != tt.wantAmount {
+					t.Errorf("preferência com saldo deve ter um item pelo restante: %+v", items)
+				}
+			}
+		})
+	}
+}
+
+func TestWalletCheckoutRelease(t *testing.T) {
+	env, _ := newWalletEnv(t)
+	env.store.balances[5] = 10
+	env.mp.failPrefs = true
+
+	// O provedor recusou o checkout: o saldo volta para a carteira
+	if code := env.call(t, 5, "POST", "/api/admin/checkout", `{"use_wallet":true}`, nil); code != http.StatusBadGateway {
+		t.Fatalf("POST /checkout: status %d, esperado 502", code)
+	}
+	if got := env.store.balances[5]; got != 10 {
+		t.Errorf("saldo depois da falha: %.2f, esperado 10", got)
+	}
+
+	// A cobrança PIX venceu sem ser paga
+	var pc PixCheckout
+	if code := env.call(t, 5, "POST", "/api/admin/checkout/pix", `{"use_wallet":true}`, &pc); code != http.StatusCreated || pc.WalletAmount != 10 {
+		t.Fatalf("POST /checkout/pix: status %d, %+v", code, pc)
+	}
+	if got := env.store.balances[5]; got != 0 {
+		t.Errorf("saldo durante o PIX: %.2f, esperado 0", got)
+	}
+	env.store.pixes[pc.PaymentID].ExpiresAt = time.Now().Add(-time.Minute)
+	env.call(t, 5, "GET", "/api/admin/payments/"+strconv.FormatInt(pc.PaymentID, 10)+"/pix", "", nil)
+	if got := env.store.balances[5]; got != 10 {
+		t.Errorf("saldo depois do PIX vencido: %.2f, esperado 10", got)
+	}
+}
+
+func TestWalletCheckoutCurrency(t *testing.T) {
+	env, _ := newWalletEnv(t)
+	env.store.balances[5] = 50
+	env.store.foreign["USD"] = map[string]float64{"10": 6}
+	mp, _ := paymentProvider("")
+	st := stripe.NewProvider(stripe.Config{SecretKey: "sk_test", Currencies: []string{"USD"}})
+	paymentProvider = func(name string) (payments.Provider, error) {
+		if name == st.Name() {
+			return st, nil
+		}
+		return mp, nil
+	}
+
+	if code := env.call(t, 5, "POST", "/api/admin/checkout", `{"provider":"stripe","use_wallet":true}`, nil); code != http.StatusBadRequest {
+		t.Errorf("saldo em checkout em USD: status %d, esperado 400", code)
+	}
+	if len(env.store.payments) != 0 || env.store.balances[5] != 50 {
+		t.Errorf("checkout recusado mexeu no pagamento ou no saldo: %+v, saldo %.2f", env.store.payments, env.store.balances[5])
+	}
+}
+
+func TestWalletTopUp(t *testing.T) {
+	env, _ := newWalletEnv(t)
+
+	var c Checkout
+	if code := env.call(t, 5, "POST", "/api/admin/wallet/top-up", `{"amount":100}`, &c); code != http.StatusCreated {
+		t.Fatalf("POST /wallet/top-up: status %d", code)
+	}
+	if c.Amount != 100 || c.Currency != "BRL" || c.URL == "" || len(env.mp.preferences) != 1 {
+		t.Fatalf("recarga inesperada: %+v", c)
+	}
+	if items := env.mp.preferences[0].Items; len(items) != 1 || items[0].UnitPrice != 100 || items[0].Title != "CDNProxy - recarga da carteira" {
+		t.Errorf("itens da preferência da recarga: %+v", items)
+	}
+
+	// O saldo só entra quando o pagamento é aprovado, e o carrinho fica
+	var wl wallet.Wallet
+	if env.call(t, 5, "GET", "/api/admin/wallet", "", &wl); wl.Balance != 0 {
+		t.Errorf("saldo antes da aprovação: %.2f", wl.Balance)
+	}
+	ref := strconv.FormatInt(c.PaymentID, 10)
+	env.mp.payments[ref] = mercadopago.PaymentResponse{ID: 901, Status: "approved", ExternalReference: ref, TransactionAmount: 100, CurrencyID: "BRL"}
+	env.call(t, 5, "GET", "/api/admin/payments/"+ref, "", nil)
+	if code := env.call(t, 5, "GET", "/api/admin/wallet", "", &wl); code != http.StatusOK || wl.Balance != 100 || wl.Currency != "BRL" {
+		t.Errorf("carteira depois da recarga: status %d, %+v", code, wl)
+	}
+	if len(env.store.carts[5]) != 1 {
+		t.Errorf("a recarga esvaziou o carrinho: %+v", env.store.carts[5])
+	}
+}
+
+func TestWalletTopUpErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"sem valor", `{}`},
+		{"valor negativo", `{"amount":-10}`},
+		{"abaixo do mínimo", `{"amount":0.5}`},
+		{"acima do máximo", `{"amount":50000.01}`},
+		{"frações de centavo", `{"amount":10.005}`},
+		{"provedor desconhecido", `{"amount":10,"provider":"paypal"}`},
+		{"corpo inválido", `{"amount":"dez"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env, _ := newWalletEnv(t)
+			if code := env.call(t, 5, "POST", "/api/admin/wallet/top-up", tt.body, nil); code != http.StatusBadRequest {
+				t.Errorf("status %d, esperado 400", code)
+			}
+			if len(env.store.payments) != 0 {
+				t.Errorf("pagamento criado: %+v", env.store.payments)
+			}
+		})
+	}
+}
+
+func TestWalletSettings(t *testing.T) {
+	env, ws := newWalletEnv(t)
+
+	var wl wallet.Wallet
+	if code := env.call(t, 5, "PUT", "/api/admin/wallet", `{"auto_renew":true}`, &wl); code != http.StatusOK || !wl.AutoRenew {
+		t.Fatalf("PUT /wallet: status %d, %+v", code, wl)
+	}
+	if !ws.autoRenew[5] || ws.autoRenew[6] {
+		t.Errorf("renovação automática gravada: %+v", ws.autoRenew)
+	}
+	if code := env.call(t, 5, "PUT", "/api/admin/wallet", `{}`, nil); code != http.StatusBadRequest {
+		t.Errorf("PUT sem auto_renew: status %d, esperado 400", code)
+	}
+}
+
+func TestWalletEntries(t *testing.T) {
+	env, ws := newWalletEnv(t)
+	for id := int64(5); id >= 1; id-- {
+		ws.entries[5] = append(ws.entries[5], wallet.Entry{ID: id, UserID: 5, Amount: 10, Balance: float64(id) * 10, Reason: wallet.ReasonTopUp})
+	}
+	ws.entries[6] = []wallet.Entry{{ID: 9, UserID: 6, Amount: 1, Balance: 1, Reason: wallet.ReasonAdjustment}}
+
+	var page wallet.Page
+	if code := env.call(t, 5, "GET", "/api/admin/wallet/entries?limit=2", "", &page); code != http.StatusOK {
+		t.Fatalf("GET /wallet/entries: status %d", code)
+	}
+	if len(page.Items) != 2 || page.Items[0].ID != 5 || page.NextBeforeID != 4 {
+		t.Fatalf("primeira página: %+v", page)
+	}
+	page = wallet.Page{}
+	if env.call(t, 5, "GET", "/api/admin/wallet/entries?limit=10&before_id=4", "", &page); len(page.Items) != 3 || page.Items[0].ID != 3 || page.NextBeforeID != 0 {
+		t.Errorf("última página: %+v", page)
+	}
+
+	for _, query := range []string{"limit=0", "limit=x", "before_id=-1"} {
+		if code := env.call(t, 5, "GET", "/api/admin/wallet/entries?"+query, "", nil); code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, esperado 400", query, code)
+		}
+	}
+}
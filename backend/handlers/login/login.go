@@ -1,25 +1,33 @@
 package login
 
 import (
-	"bytes"
-	"context"
 	"encoding/json"
-	"fmt"
-	"io/ioutil"
+	"errors"
+	"log"
 	"net/http"
 	"os"
 
-	"CDNProxy_v2/backend/database"
 	"CDNProxy_v2/backend/handlers/admin"
+	"CDNProxy_v2/backend/middleware"
 )
 
 type Credentials struct {
 	Email string `json:"email"`
 }
 
+// authenticatorOrError devolve o Authenticator configurado ou responde 500.
+func authenticatorOrError(w http.ResponseWriter) (middleware.Authenticator, bool) {
+	auth, err := middleware.CurrentAuthenticator()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	return auth, true
+}
+
 func UpdatePasswordHandler(w http.ResponseWriter, r *http.Request) {
-	userID := r.Context().Value("user_id").(string)
-	if userID == "" {
+	userID, ok := r.Context().Value(middleware.UserIDKey).(int64)
+	if !ok || userID == 0 {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
@@ -33,42 +41,21 @@ func UpdatePasswordHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if len(req.Password) < 6 {
+	if len(req.Password) < middleware.MinPasswordLength {
 		http.Error(w, "Password must be at least 6 characters", http.StatusBadRequest)
 		return
 	}
 
-	supabaseURL := os.Getenv("SUPABASE_URL")
-	serviceRoleKey := os.Getenv("SUPABASE_SECRET_KEY")
-	url := fmt.Sprintf("%s/auth/v1/admin/users/%s", supabaseURL, userID)
-
-	body, _ := json.Marshal(map[string]string{"password": req.Password})
-	httpReq, _ := http.NewRequest("PUT", url, bytes.NewBuffer(body)) // PUT or PATCH usually works for admin update
-	httpReq.Header.Set("Authorization", "Bearer "+serviceRoleKey)
-	httpReq.Header.Set("Content-Type", "application/json")
-	httpReq.Header.Set("apikey", serviceRoleKey)
-
-	client := &http.Client{}
-	resp, err := client.Do(httpReq)
-	if err != nil {
-		http.Error(w, "Failed to update password in Supabase Auth", http.StatusInternalServerError)
+	auth, ok := authenticatorOrError(w)
+	if !ok {
 		return
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		respBody, _ := ioutil.ReadAll(resp.Body)
-		http.Error(w, "Error from Auth provider: "+string(respBody), http.StatusInternalServerError)
+	if err := auth.SetPassword(r.Context(), userID, req.Password); err != nil {
+		http.Error(w, "Error from Auth provider: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Atualiza flag local (se existir essa lógica de encrypted_password)
-	_, err = database.DB.Exec(context.Background(), "UPDATE public.users SET encrypted_password = $1 WHERE supabase_auth_id = $2", "CHANGED", userID)
-	if err != nil {
-		// Não falha a reqquiição se o banco local der erro, pois o auth principal já foi
-		fmt.Printf("Warning: Failed to update local user schema: %v\n", err)
-	}
-
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(`{"message": "Senha atualizada com sucesso"}`))
 }
@@ -84,40 +71,103 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	supabaseURL := os.Getenv("SUPABASE_URL")
-	supabaseKey := os.Getenv("SUPABASE_API_KEY")
-	url := fmt.Sprintf("%s/auth/v1/token?grant_type=password", supabaseURL)
+	auth, ok := authenticatorOrError(w)
+	if !ok {
+		return
+	}
 
-	body, _ := json.Marshal(map[string]string{
-		"email":    creds.Email,
-		"password": creds.Password,
-	})
-	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(body))
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("apikey", supabaseKey)
+	subject := middleware.NewThrottleSubject(r, creds.Email, 0)
+	if wait := middleware.CheckThrottle(r.Context(), middleware.ThrottleLogin, subject); wait > 0 {
+		middleware.WriteThrottled(w, wait)
+		return
+	}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		http.Error(w, "Failed to connect to Supabase Auth", http.StatusInternalServerError)
+	session, err := auth.Login(r.Context(), creds.Email, creds.Password)
+	switch {
+	case errors.Is(err, middleware.ErrInvalidCredentials):
+		middleware.RecordAuthFailure(r.Context(), middleware.ThrottleLogin, subject, middleware.FailureInvalidCredentials)
+		http.Error(w, "Invalid login credentials", http.StatusUnauthorized)
+		return
+	case errors.Is(err, middleware.ErrUserDisabled):
+		http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+		return
+	case err != nil:
+		log.Printf("ERROR: Login failed: %v", err)
+		http.Error(w, "Failed to connect to Auth provider", http.StatusInternalServerError)
 		return
 	}
-	defer resp.Body.Close()
+	middleware.ResetThrottle(r.Context(), middleware.ThrottleLogin, subject)
+
+	writeSession(w, r, auth, session, false)
+}
 
-	respBody, _ := ioutil.ReadAll(resp.Body)
-	if resp.StatusCode != http.StatusOK {
-		http.Error(w, string(respBody), http.StatusUnauthorized)
+// writeSession responde com a sessão recém-aberta ou renovada, depois de
+// conferir o token emitido (usuário ativo, sessão não revogada) e registrar a
+// sessão. Se o token for recusado, a sessão também é encerrada no provedor.
+// No login, falhas do banco ao conferir não impedem a resposta; na
+// renovação (strict), impedem.
+func writeSession(w http.ResponseWriter, r *http.Request, auth middleware.Authenticator, session *middleware.Session, strict bool) {
+	identity, err := auth.Authenticate(r.Context(), session.AccessToken)
+	switch {
+	case errors.Is(err, middleware.ErrUserDisabled), errors.Is(err, middleware.ErrSessionRevoked):
+		if err := auth.Logout(r.Context(), session.AccessToken); err != nil {
+			log.Printf("ERROR: Could not end refused session at the Auth provider: %v", err)
+		}
+		status := http.StatusUnauthorized
+		if errors.Is(err, middleware.ErrUserDisabled) {
+			status = http.StatusForbidden
+		}
+		http.Error(w, err.Error(), status)
+		return
+	case err != nil && strict:
+		log.Printf("ERROR: Could not resolve user after refresh: %v", err)
+		http.Error(w, "Authentication temporarily unavailable", http.StatusServiceUnavailable)
 		return
 	}
 
+	// Com mfa.required, o token só acessa /api/auth/mfa até o segundo fator
+	resp := loginResponse{Session: session}
+	if err != nil {
+		log.Printf("ERROR: Could not resolve user after login: %v", err)
+	} else {
+		if err := middleware.TrackSession(r.Context(), r, identity.UserID, identity.SessionID); err != nil {
+			log.Printf("ERROR: Could not record session of user %d: %v", identity.UserID, err)
+		}
+		if resp.MFA, err = middleware.MFAStatusFor(r.Context(), identity.UserID, identity.Role, identity.SessionID); err != nil {
+			log.Printf("ERROR: Could not read MFA status after login: %v", err)
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	w.Write(respBody)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// loginResponse é a sessão do provedor acrescida do estado do segundo fator.
+type loginResponse struct {
+	*middleware.Session
+	MFA *middleware.MFAStatus `json:"mfa,omitempty"`
 }
 
 func MeHandler(w http.ResponseWriter, r *http.Request) {
 	admin.GetProfile(w, r)
 }
 
+// PermissionsHandler devolve a role e as permissões do usuário logado, para o
+// frontend montar os menus.
+func PermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	role, ok := r.Context().Value(middleware.RoleKey).(string)
+	if !ok {
+		http.Error(w, "Role not found in context", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"role":        role,
+		"permissions": middleware.RolePermissions(r.Context(), role),
+	})
+}
+
 func RequestPasswordResetHandler(w http.ResponseWriter, r *http.Request) {
 	type ResetRequest struct {
 		Email string `json:"email"`
@@ -128,39 +178,68 @@ func RequestPasswordResetHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	supabaseURL := os.Getenv("SUPABASE_URL")
-	// Para recover público, usa-se a API Key pública geralmente, mas como estamos no backend, podemos usar a URL de admin ou a pública.
-	// A rota padrão do supabase é POST /recover
+	auth, ok := authenticatorOrError(w)
+	if !ok {
+		return
+	}
 
-	url := fmt.Sprintf("%s/auth/v1/recover", supabaseURL)
+	// Todo pedido conta, com ou sem e-mail cadastrado, contra o envio em massa
+	subject := middleware.NewThrottleSubject(r, req.Email, 0)
+	if wait := middleware.CheckThrottle(r.Context(), middleware.ThrottleRecover, subject); wait > 0 {
+		middleware.WriteThrottled(w, wait)
+		return
+	}
+	middleware.RecordAuthFailure(r.Context(), middleware.ThrottleRecover, subject, middleware.FailureResetRequested)
 
 	// Configura redirect para o frontend
 	redirectURL := os.Getenv("FRONTEND_URL") + "/update-password" // Ajustar env no futuro
 
-	body, _ := json.Marshal(map[string]string{
-		"email":       req.Email,
-		"redirect_to": redirectURL,
-	})
+	if err := auth.RequestPasswordReset(r.Context(), req.Email, redirectURL); err != nil {
+		log.Printf("ERROR: Password reset request failed: %v", err)
+		http.Error(w, "Error requesting password reset", http.StatusBadRequest)
+		return
+	}
 
-	httpReq, _ := http.NewRequest("POST", url, bytes.NewBuffer(body))
-	// Usamos a API KEY pública para iniciar o fluxo de recuperação normal
-	httpReq.Header.Set("Content-Type", "application/json")
-	httpReq.Header.Set("apikey", os.Getenv("SUPABASE_API_KEY"))
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"message": "Password reset email sent"}`))
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(httpReq)
-	if err != nil {
-		http.Error(w, "Failed to connect to Supabase Auth", http.StatusInternalServerError)
+// ResetPasswordHandler conclui a recuperação de senha no modo auto-hospedado,
+// com o token recebido por e-mail.
+func ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Password) < middleware.MinPasswordLength {
+		http.Error(w, "Password must be at least 6 characters", http.StatusBadRequest)
 		return
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		respBody, _ := ioutil.ReadAll(resp.Body)
-		http.Error(w, "Error requesting password reset: "+string(respBody), http.StatusBadRequest)
+	auth, ok := authenticatorOrError(w)
+	if !ok {
+		return
+	}
+
+	err := auth.ResetPassword(r.Context(), req.Token, req.Password)
+	switch {
+	case errors.Is(err, middleware.ErrNotSupported):
+		http.Error(w, "Password reset is handled by the Auth provider link", http.StatusNotImplemented)
+		return
+	case errors.Is(err, middleware.ErrInvalidResetToken):
+		http.Error(w, "Invalid or expired reset token", http.StatusBadRequest)
+		return
+	case err != nil:
+		log.Printf("ERROR: Password reset failed: %v", err)
+		http.Error(w, "Error resetting password", http.StatusInternalServerError)
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(`{"message": "Password reset email sent"}`))
+	w.Write([]byte(`{"message": "Senha atualizada com sucesso"}`))
 }
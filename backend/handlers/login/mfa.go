@@ -0,0 +1,206 @@
+package login
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"CDNProxy_v2/backend/database"
+	"CDNProxy_v2/backend/middleware"
+)
+
+// mfaCode é o corpo das rotas que conferem o segundo fator: o código do
+// aplicativo ou, na falta dele, um código de recuperação.
+type mfaCode struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// mfaSession lê usuário, role e sessão do contexto. Só sessões interativas
+// (JWT) gerenciam o segundo fator; chaves de API e personificação não.
+func mfaSession(w http.ResponseWriter, r *http.Request) (userID int64, role, sessionID string, ok bool) {
+	userID, _ = r.Context().Value(middleware.UserIDKey).(int64)
+	role, _ = r.Context().Value(middleware.RoleKey).(string)
+	sessionID, _ = r.Context().Value(middleware.SessionIDKey).(string)
+	if userID == 0 || sessionID == "" {
+		http.Error(w, "Forbidden: this action requires an interactive session", http.StatusForbidden)
+		return 0, "", "", false
+	}
+	return userID, role, sessionID, true
+}
+
+func decodeMFACode(w http.ResponseWriter, r *http.Request) (mfaCode, bool) {
+	var req mfaCode
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.Code == "" && req.RecoveryCode == "") {
+		http.Error(w, "Invalid request: code or recovery_code required", http.StatusBadRequest)
+		return req, false
+	}
+	return req, true
+}
+
+// writeMFAError traduz os erros de middleware para status HTTP.
+func writeMFAError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, middleware.ErrInvalidMFACode):
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+	case errors.Is(err, middleware.ErrMFANotEnrolled), errors.Is(err, middleware.ErrMFAAlreadyEnabled):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, middleware.ErrMFARequired):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		log.Printf("ERROR: MFA operation failed: %v", err)
+		http.Error(w, "Failed to process two-factor authentication", http.StatusInternalServerError)
+	}
+}
+
+// checkingMFACode roda check, que confere um código, sob o limite de
+// tentativas do segundo fator. Devolve false se já respondeu com erro.
+func checkingMFACode(w http.ResponseWriter, r *http.Request, userID int64, check func() error) bool {
+	subject := middleware.NewThrottleSubject(r, "", userID)
+	if wait := middleware.CheckThrottle(r.Context(), middleware.ThrottleMFA, subject); wait > 0 {
+		middleware.WriteThrottled(w, wait)
+		return false
+	}
+	err := check()
+	if errors.Is(err, middleware.ErrInvalidMFACode) {
+		middleware.RecordAuthFailure(r.Context(), middleware.ThrottleMFA, subject, middleware.FailureInvalidMFACode)
+	}
+	if err != nil {
+		writeMFAError(w, err)
+		return false
+	}
+	middleware.ResetThrottle(r.Context(), middleware.ThrottleMFA, subject)
+	return true
+}
+
+func writeMFAStatus(ctx context.Context, w http.ResponseWriter, userID int64, role, sessionID string) {
+	status, err := middleware.MFAStatusFor(ctx, userID, role, sessionID)
+	if err != nil {
+		writeMFAError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// MFAStatusHandler devolve o estado do segundo fator na sessão atual.
+func MFAStatusHandler(w http.ResponseWriter, r *http.Request) {
+	userID, role, sessionID, ok := mfaSession(w, r)
+	if !ok {
+		return
+	}
+	writeMFAStatus(r.Context(), w, userID, role, sessionID)
+}
+
+// MFAEnrollHandler gera o segredo TOTP, ainda inativo, para o usuário
+// cadastrar no aplicativo. Chamar de novo antes da confirmação troca o segredo.
+func MFAEnrollHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _, _, ok := mfaSession(w, r)
+	if !ok {
+		return
+	}
+
+	var email string
+	if err := database.DB.QueryRow(r.Context(), "SELECT email FROM users WHERE id = $1", userID).Scan(&email); err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	secret, uri, err := middleware.BeginTOTPEnrollment(r.Context(), userID, email)
+	if err != nil {
+		writeMFAError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"secret": secret, "otpauth_url": uri})
+}
+
+// MFAConfirmHandler ativa o segundo fator com o primeiro código do
+// aplicativo e devolve os códigos de recuperação, exibidos uma única vez.
+func MFAConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _, sessionID, ok := mfaSession(w, r)
+	if !ok {
+		return
+	}
+	var req mfaCode
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		http.Error(w, "Invalid request: code required", http.StatusBadRequest)
+		return
+	}
+
+	var codes []string
+	if !checkingMFACode(w, r, userID, func() (err error) {
+		codes, err = middleware.ConfirmTOTPEnrollment(r.Context(), userID, sessionID, req.Code)
+		return err
+	}) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"recovery_codes": codes})
+}
+
+// MFAVerifyHandler conclui o login em duas etapas. Também renova a janela
+// exigida pelas ações sensíveis (step-up).
+func MFAVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	userID, role, sessionID, ok := mfaSession(w, r)
+	if !ok {
+		return
+	}
+	req, ok := decodeMFACode(w, r)
+	if !ok {
+		return
+	}
+
+	if !checkingMFACode(w, r, userID, func() error {
+		return middleware.VerifyMFA(r.Context(), userID, sessionID, req.Code, req.RecoveryCode)
+	}) {
+		return
+	}
+	writeMFAStatus(r.Context(), w, userID, role, sessionID)
+}
+
+// MFARecoveryCodesHandler substitui os códigos de recuperação.
+func MFARecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _, _, ok := mfaSession(w, r)
+	if !ok {
+		return
+	}
+	req, ok := decodeMFACode(w, r)
+	if !ok {
+		return
+	}
+
+	var codes []string
+	if !checkingMFACode(w, r, userID, func() (err error) {
+		codes, err = middleware.RegenerateRecoveryCodes(r.Context(), userID, req.Code, req.RecoveryCode)
+		return err
+	}) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"recovery_codes": codes})
+}
+
+// MFADisableHandler desativa o segundo fator (não permitido ao Superadmin).
+func MFADisableHandler(w http.ResponseWriter, r *http.Request) {
+	userID, role, _, ok := mfaSession(w, r)
+	if !ok {
+		return
+	}
+	req, ok := decodeMFACode(w, r)
+	if !ok {
+		return
+	}
+
+	if !checkingMFACode(w, r, userID, func() error {
+		return middleware.DisableMFA(r.Context(), userID, role, req.Code, req.RecoveryCode)
+	}) {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
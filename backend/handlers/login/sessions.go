@@ -0,0 +1,131 @@
+package login
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"CDNProxy_v2/backend/middleware"
+
+	"github.com/gorilla/mux"
+)
+
+// RefreshHandler troca o refresh token por uma sessão nova, no mesmo formato
+// do login. Sessões revogadas e usuários desativados são recusados mesmo com
+// o refresh token ainda válido no provedor.
+func RefreshHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		http.Error(w, "Invalid request: refresh_token required", http.StatusBadRequest)
+		return
+	}
+
+	auth, ok := authenticatorOrError(w)
+	if !ok {
+		return
+	}
+
+	session, err := auth.Refresh(r.Context(), req.RefreshToken)
+	switch {
+	case errors.Is(err, middleware.ErrInvalidRefreshToken):
+		http.Error(w, middleware.ErrInvalidRefreshToken.Error(), http.StatusUnauthorized)
+		return
+	case errors.Is(err, middleware.ErrUserDisabled):
+		http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+		return
+	case errors.Is(err, middleware.ErrSessionRevoked):
+		http.Error(w, middleware.ErrInvalidRefreshToken.Error(), http.StatusUnauthorized)
+		return
+	case err != nil:
+		log.Printf("ERROR: Refresh failed: %v", err)
+		http.Error(w, "Failed to connect to Auth provider", http.StatusInternalServerError)
+		return
+	}
+
+	writeSession(w, r, auth, session, true)
+}
+
+// LogoutHandler encerra a sessão do token. Com scope=global, encerra todas as
+// sessões do usuário.
+func LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _, sessionID, ok := mfaSession(w, r)
+	if !ok {
+		return
+	}
+
+	var err error
+	if r.URL.Query().Get("scope") == "global" {
+		err = middleware.RevokeAllSessions(r.Context(), userID, middleware.RevokedByLogout)
+	} else {
+		err = middleware.RevokeSession(r.Context(), userID, sessionID, middleware.RevokedByLogout)
+	}
+	if err != nil {
+		log.Printf("ERROR: Logout of user %d failed: %v", userID, err)
+		http.Error(w, "Failed to end session", http.StatusInternalServerError)
+		return
+	}
+
+	// O Supabase invalida os refresh tokens da sessão; no modo local não há o que fazer
+	if auth, err := middleware.CurrentAuthenticator(); err == nil {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if err := auth.Logout(r.Context(), token); err != nil {
+			log.Printf("ERROR: Could not end session at the Auth provider: %v", err)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListSessionsHandler lista as sessões do usuário logado; current marca a da
+// própria requisição.
+func ListSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(middleware.UserIDKey).(int64)
+	if !ok || userID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	sessionID, _ := r.Context().Value(middleware.SessionIDKey).(string)
+
+	list, err := middleware.ListSessions(r.Context(), userID, sessionID)
+	if err != nil {
+		log.Printf("ERROR: Could not list sessions of user %d: %v", userID, err)
+		http.Error(w, "Failed to list sessions", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// RevokeSessionHandler encerra uma das sessões do usuário logado (por
+// exemplo, a de um aparelho perdido).
+func RevokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _, _, ok := mfaSession(w, r)
+	if !ok {
+		return
+	}
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid session ID", http.StatusBadRequest)
+		return
+	}
+
+	s, err := middleware.SessionByID(r.Context(), userID, id)
+	if errors.Is(err, middleware.ErrSessionNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		err = middleware.RevokeSession(r.Context(), userID, s.SessionID, middleware.RevokedByUser)
+	}
+	if err != nil {
+		log.Printf("ERROR: Could not revoke session %d of user %d: %v", id, userID, err)
+		http.Error(w, "Failed to end session", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
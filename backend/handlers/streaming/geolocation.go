@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"CDNProxy_v2/backend/models"
+	"CDNProxy_v2/backend/services/metrics"
 
 	cache "github.com/patrickmn/go-cache"
 )
@@ -44,13 +45,19 @@ func GeolocationHandler(w http.ResponseWriter, r *http.Request) {
 // GetGeolocationFromProviders tenta obter a geolocalização de uma lista de provedores.
 // Esta função é exportada para que possa ser usada pelo ProxyHandler.
 func GetGeolocationFromProviders(ip string) (*models.Geolocation, error) {
-	providers := []func(string) (*models.Geolocation, error){
-		getFromIPAPI,
-		getFromFreeGeoIP,
+	providers := []struct {
+		name   string
+		lookup func(string) (*models.Geolocation, error)
+	}{
+		{"ip-api", getFromIPAPI},
+		{"freegeoip", getFromFreeGeoIP},
 	}
 
 	for _, provider := range providers {
-		if geo, err := provider(ip); err == nil {
+		start := time.Now()
+		geo, err := provider.lookup(ip)
+		metrics.ObserveGeolocation(provider.name, start, err)
+		if err == nil {
 			return geo, nil
 		}
 	}
@@ -4,7 +4,6 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
@@ -12,7 +11,10 @@ import (
 	"time"
 
 	"CDNProxy_v2/backend/database"
+	"CDNProxy_v2/backend/middleware"
 	"CDNProxy_v2/backend/models"
+	"CDNProxy_v2/backend/services/metrics"
+	"CDNProxy_v2/backend/services/requestlog"
 
 	"github.com/jackc/pgx/v5"
 )
@@ -25,15 +27,32 @@ type ProxyRequest struct {
 
 type countingResponseWriter struct {
 	http.ResponseWriter
-	bytes int64
+	bytes  int64
+	status int
+}
+
+func (w *countingResponseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
 }
 
 func (w *countingResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
 	n, err := w.ResponseWriter.Write(b)
 	w.bytes += int64(n)
 	return n, err
 }
 
+// Unwrap permite que o http.ResponseController (usado pelo ReverseProxy para
+// Flush) alcance o ResponseWriter original.
+func (w *countingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
 func ProxyHandler(w http.ResponseWriter, r *http.Request) {
 	var req ProxyRequest
 	if r.Method == http.MethodGet {
@@ -70,7 +89,35 @@ func DomainProxyHandler(w http.ResponseWriter, r *http.Request) {
 	handleProxy(w, r, req)
 }
 
-func handleProxy(w http.ResponseWriter, r *http.Request, req ProxyRequest) {
+func handleProxy(rw http.ResponseWriter, r *http.Request, req ProxyRequest) {
+	start := time.Now()
+	w := &countingResponseWriter{ResponseWriter: rw}
+	entry := requestlog.Entry{
+		Time:      start,
+		ClientIP:  getClientIP(r),
+		Method:    r.Method,
+		Domain:    req.Name,
+		URI:       req.Path,
+		Proto:     r.Proto,
+		Referer:   r.Referer(),
+		UserAgent: r.Header.Get("User-Agent"),
+	}
+	// Só domínios cadastrados ganham rótulo próprio nas métricas
+	domainLabel := "unknown"
+	defer func() {
+		entry.Status = w.status
+		entry.Bytes = w.bytes
+		entry.Duration = time.Since(start)
+		requestlog.Log(entry)
+
+		metrics.ProxyRequests.Inc(domainLabel, metrics.StatusLabel(w.status))
+		metrics.ProxyDuration.Observe(entry.Duration.Seconds(), domainLabel)
+		metrics.ProxyBytesOut.Add(float64(w.bytes), domainLabel)
+		if r.ContentLength > 0 {
+			metrics.ProxyBytesIn.Add(float64(r.ContentLength), domainLabel)
+		}
+	}()
+
 	if req.Name == "" {
 		if r.Method == http.MethodPost {
 			w.Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -82,8 +129,8 @@ func handleProxy(w http.ResponseWriter, r *http.Request, req ProxyRequest) {
 		return
 	}
 
-	clientIP := getClientIP(r)
-	userAgent := r.Header.Get("User-Agent")
+	clientIP := entry.ClientIP
+	userAgent := entry.UserAgent
 
 	var stream struct {
 		ID       int64
@@ -134,6 +181,7 @@ func handleProxy(w http.ResponseWriter, r *http.Request, req ProxyRequest) {
 		stream.UserID = userID
 		stream.ProxyURL = targetURL
 	}
+	domainLabel = metrics.DomainLabel(req.Name)
 
 	if isBrowser(userAgent) {
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -148,8 +196,6 @@ func handleProxy(w http.ResponseWriter, r *http.Request, req ProxyRequest) {
 		return
 	}
 
-	cw := &countingResponseWriter{ResponseWriter: w}
-
 	go createStreamingAccessLog(r.Context(), stream.ID, clientIP, userAgent)
 	go updateDailyTraffic(r.Context())
 
@@ -166,7 +212,19 @@ func handleProxy(w http.ResponseWriter, r *http.Request, req ProxyRequest) {
 	fallbackURL.Path = upstreamPath
 	fallbackURL.RawQuery = upstreamQuery
 
+	entry.Upstream = targetURL.Host
+	upstreamStart := time.Now()
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		entry.UpstreamLatency = time.Since(upstreamStart)
+		entry.CacheStatus = upstreamCacheStatus(resp.Header)
+		metrics.UpstreamDuration.Observe(entry.UpstreamLatency.Seconds(), domainLabel)
+		return nil
+	}
+
 	proxy.ErrorHandler = func(rw http.ResponseWriter, req *http.Request, proxyErr error) {
+		entry.UpstreamLatency = time.Since(upstreamStart)
+		entry.CacheStatus = "ERROR"
+		metrics.UpstreamErrors.Inc(domainLabel)
 		http.Redirect(rw, req, fallbackURL.String(), http.StatusMovedPermanently)
 	}
 
@@ -177,10 +235,10 @@ func handleProxy(w http.ResponseWriter, r *http.Request, req ProxyRequest) {
 	r.Header.Set("X-Forwarded-Host", r.Header.Get("Host"))
 	r.Host = targetURL.Host
 
-	proxy.ServeHTTP(cw, r)
+	proxy.ServeHTTP(w, r)
 
-	if stream.UserID != 0 && cw.bytes > 0 {
-		downloadBytes := cw.bytes
+	if stream.UserID != 0 && w.bytes > 0 {
+		downloadBytes := w.bytes
 		uploadBytes := int64(0)
 		bandwidthBytes := downloadBytes
 		go updateMonthlyTraffic(r.Context(), stream.UserID, downloadBytes, uploadBytes, bandwidthBytes)
@@ -191,22 +249,18 @@ func handleProxy(w http.ResponseWriter, r *http.Request, req ProxyRequest) {
 func createStreamingAccessLog(ctx context.Context, proxyID int64, clientIP, userAgent string) {
 	// 1. Bot Filtering: Se for robô, ignora
 	uaLower := strings.ToLower(userAgent)
-	fmt.Printf("[DEBUG] Access from IP: %s | UA: %s\n", clientIP, userAgent)
 
 	if strings.Contains(uaLower, "bot") || strings.Contains(uaLower, "crawler") ||
 		strings.Contains(uaLower, "spider") || strings.Contains(uaLower, "curl") ||
 		strings.Contains(uaLower, "wget") || strings.Contains(uaLower, "slurp") ||
 		strings.Contains(uaLower, "mediapartners") {
-		fmt.Println("[DEBUG] BLOCKED BOT")
 		return
 	}
 
 	// 2. Device Detection
 	deviceType := detectDeviceType(userAgent)
-	fmt.Printf("[DEBUG] Detected Device: '%s'\n", deviceType)
 
 	if deviceType == "Desconhecido" {
-		fmt.Println("[DEBUG] BLOCKED UNKNOWN DEVICE")
 		return // Não registrar dispositivos irreconhecíveis
 	}
 
@@ -301,28 +355,20 @@ func updateMonthlyTraffic(ctx context.Context, userID int64, download, upload, b
 	)
 }
 
-// getClientIP extrai o IP real do cliente, considerando proxies.
-func getClientIP(r *http.Request) string {
-	if ip := r.Header.Get("CF-Connecting-IP"); ip != "" {
-		return ip
-	}
-
-	if ip := r.Header.Get("True-Client-IP"); ip != "" {
-		return ip
-	}
-
-	if ip := r.Header.Get("X-Forwarded-For"); ip != "" {
-		parts := strings.Split(ip, ",")
-		if len(parts) > 0 {
-			return strings.TrimSpace(parts[0])
+// upstreamCacheStatus lê o status de cache informado pela origem (Cloudflare,
+// Nginx, Varnish...). Retorna vazio quando a origem não informa.
+func upstreamCacheStatus(h http.Header) string {
+	for _, key := range []string{"CF-Cache-Status", "X-Cache-Status", "X-Cache"} {
+		if v := h.Get(key); v != "" {
+			return strings.ToUpper(strings.TrimSpace(strings.SplitN(v, " ", 2)[0]))
 		}
 	}
+	return ""
+}
 
-	if ip := r.Header.Get("X-Real-IP"); ip != "" {
-		return ip
-	}
-
-	return strings.Split(r.RemoteAddr, ":")[0]
+// getClientIP extrai o IP real do cliente, considerando apenas proxies confiáveis.
+func getClientIP(r *http.Request) string {
+	return middleware.ClientIP(r)
 }
 
 // isBrowser verifica se o User-Agent pertence a um navegador comum.
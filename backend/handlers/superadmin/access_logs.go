@@ -2,10 +2,12 @@ package superadmin
 
 import (
 	"encoding/json"
+	"log"
 	"net/http"
 	"time"
 
 	"CDNProxy_v2/backend/database"
+	"CDNProxy_v2/backend/services/accesslogs"
 )
 
 // AccessLogSummary representa o resumo dos acessos agrupados por IP
@@ -65,3 +67,47 @@ func GetAccessLogsHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(logs)
 }
+
+// SearchAccessLogsHandler busca logs de acesso com filtros e paginação por cursor.
+func SearchAccessLogsHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := accesslogs.ParseFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	page, err := accesslogs.Search(r.Context(), filter)
+	if err != nil {
+		http.Error(w, "Error searching access logs: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// ExportAccessLogsHandler exporta os logs filtrados em CSV ou NDJSON (streaming).
+func ExportAccessLogsHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := accesslogs.ParseFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "ndjson" {
+		http.Error(w, "Invalid format: use csv or ndjson", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", accesslogs.ContentType(format))
+	w.Header().Set("Content-Disposition", "attachment; filename=access_logs."+format)
+
+	if err := accesslogs.Export(r.Context(), w, filter, format); err != nil {
+		// O cabeçalho já foi enviado; apenas registra o erro
+		log.Printf("Error exporting access logs: %v", err)
+	}
+}
@@ -0,0 +1,142 @@
+package superadmin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"CDNProxy_v2/backend/database"
+	"CDNProxy_v2/backend/middleware"
+)
+
+const (
+	auditDefaultLimit = 50
+	auditMaxLimit     = 500
+)
+
+// AuditLogPage é uma página do registro de auditoria, do mais recente para o
+// mais antigo. NextBeforeID é o before_id da próxima página.
+type AuditLogPage struct {
+	Items        []middleware.AuditEntry `json:"items"`
+	NextBeforeID int64                   `json:"next_before_id,omitempty"`
+}
+
+// AuditLogHandler consulta public.audit_log. Filtros: actor_id, role, method,
+// route, target_type, target_id, status, impersonation_id, impersonated_id,
+// from, to (RFC 3339 ou AAAA-MM-DD), limit e before_id (paginação).
+func AuditLogHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var where []string
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	for _, f := range []struct{ param, column string }{
+		{"actor_id", "actor_id"},
+		{"status", "status"},
+		{"impersonation_id", "impersonation_id"},
+		{"impersonated_id", "impersonated_id"},
+		{"before_id", "id"},
+	} {
+		v := q.Get(f.param)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid "+f.param, http.StatusBadRequest)
+			return
+		}
+		op := " = "
+		if f.param == "before_id" {
+			op = " < "
+		}
+		where = append(where, f.column+op+arg(n))
+	}
+	for _, f := range []struct{ param, column string }{
+		{"role", "actor_role"},
+		{"route", "route"},
+		{"target_type", "target_type"},
+		{"target_id", "target_id"},
+	} {
+		if v := q.Get(f.param); v != "" {
+			where = append(where, f.column+" = "+arg(v))
+		}
+	}
+	if v := q.Get("method"); v != "" {
+		where = append(where, "method = "+arg(strings.ToUpper(v)))
+	}
+	for _, f := range []struct{ param, op string }{{"from", " >= "}, {"to", " < "}} {
+		v := q.Get(f.param)
+		if v == "" {
+			continue
+		}
+		t, err := parseAuditTime(v)
+		if err != nil {
+			http.Error(w, "Invalid "+f.param+": use RFC 3339 or YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+		where = append(where, "created_at"+f.op+arg(t))
+	}
+
+	limit := auditDefaultLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, auditMaxLimit)
+	}
+
+	query := `SELECT id, actor_id, actor_role, api_key_id, ip, method, route, path, target_type, target_id, status, request, before, after, diff, created_at,
+		impersonation_id, impersonated_id
+		FROM public.audit_log`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY id DESC LIMIT " + arg(limit+1)
+
+	rows, err := database.DB.Query(r.Context(), query, args...)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to query audit log: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	page := AuditLogPage{Items: []middleware.AuditEntry{}}
+	for rows.Next() {
+		var e middleware.AuditEntry
+		if err := rows.Scan(&e.ID, &e.ActorID, &e.ActorRole, &e.APIKeyID, &e.IP, &e.Method, &e.Route, &e.Path,
+			&e.TargetType, &e.TargetID, &e.Status, &e.Request, &e.Before, &e.After, &e.Diff, &e.CreatedAt,
+			&e.ImpersonationID, &e.ImpersonatedID); err != nil {
+			http.Error(w, "Failed to scan audit entry", http.StatusInternalServerError)
+			return
+		}
+		page.Items = append(page.Items, e)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Error iterating over audit log", http.StatusInternalServerError)
+		return
+	}
+
+	if len(page.Items) > limit {
+		page.Items = page.Items[:limit]
+		page.NextBeforeID = page.Items[limit-1].ID
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+func parseAuditTime(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", v)
+}
@@ -0,0 +1,196 @@
+package superadmin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"CDNProxy_v2/backend/database"
+	"CDNProxy_v2/backend/middleware"
+
+	"github.com/gorilla/mux"
+)
+
+// AuthLockout é uma linha de public.auth_throttle: o contador de uma chave
+// (IP, e-mail ou usuário) em uma ação (login, recover ou mfa).
+type AuthLockout struct {
+	ID            int64      `json:"id"`
+	Action        string     `json:"action"`
+	Kind          string     `json:"kind"`
+	Key           string     `json:"key"`
+	Failures      int        `json:"failures"`
+	LastFailureAt time.Time  `json:"last_failure_at"`
+	LockedUntil   *time.Time `json:"locked_until"`
+}
+
+// AuthFailuresPage é uma página do histórico de tentativas, da mais recente
+// para a mais antiga.
+type AuthFailuresPage struct {
+	Items        []middleware.AuthFailure `json:"items"`
+	NextBeforeID int64                    `json:"next_before_id,omitempty"`
+}
+
+// ListAuthLockouts lista as chaves bloqueadas agora. Com all=true, inclui os
+// contadores com falhas ainda sem bloqueio. Filtros: action e kind.
+func ListAuthLockouts(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var where []string
+	var args []interface{}
+	if q.Get("all") != "true" {
+		where = append(where, "locked_until > NOW()")
+	}
+	for _, param := range []string{"action", "kind"} {
+		if v := q.Get(param); v != "" {
+			args = append(args, v)
+			where = append(where, param+" = $"+strconv.Itoa(len(args)))
+		}
+	}
+
+	query := "SELECT id, action, kind, key, failures, last_failure_at, locked_until FROM public.auth_throttle"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY last_failure_at DESC LIMIT 500"
+
+	rows, err := database.DB.Query(r.Context(), query, args...)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Erro ao buscar bloqueios: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	lockouts := []AuthLockout{}
+	for rows.Next() {
+		var l AuthLockout
+		if err := rows.Scan(&l.ID, &l.Action, &l.Kind, &l.Key, &l.Failures, &l.LastFailureAt, &l.LockedUntil); err != nil {
+			http.Error(w, "Erro ao ler bloqueio", http.StatusInternalServerError)
+			return
+		}
+		lockouts = append(lockouts, l)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Erro ao percorrer bloqueios", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lockouts)
+}
+
+// UnlockAuthLockout apaga o contador {id}, desbloqueando a chave na hora.
+func UnlockAuthLockout(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "ID de bloqueio inválido", http.StatusBadRequest)
+		return
+	}
+
+	tag, err := database.DB.Exec(r.Context(), "DELETE FROM public.auth_throttle WHERE id = $1", id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Erro ao desbloquear: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		http.Error(w, "Bloqueio não encontrado", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListAuthFailures consulta o histórico de tentativas que falharam ou foram
+// barradas. Filtros: action, email, ip, user_id, reason, from e to (RFC 3339
+// ou AAAA-MM-DD), limit e before_id (paginação).
+func ListAuthFailures(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var where []string
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	for _, param := range []string{"user_id", "before_id"} {
+		v := q.Get(param)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Parâmetro "+param+" inválido", http.StatusBadRequest)
+			return
+		}
+		if param == "before_id" {
+			where = append(where, "id < "+arg(n))
+		} else {
+			where = append(where, "user_id = "+arg(n))
+		}
+	}
+	for _, param := range []string{"action", "ip", "reason"} {
+		if v := q.Get(param); v != "" {
+			where = append(where, param+" = "+arg(v))
+		}
+	}
+	if v := q.Get("email"); v != "" {
+		where = append(where, "email = "+arg(strings.ToLower(strings.TrimSpace(v))))
+	}
+	for _, f := range []struct{ param, op string }{{"from", " >= "}, {"to", " < "}} {
+		v := q.Get(f.param)
+		if v == "" {
+			continue
+		}
+		t, err := parseAuditTime(v)
+		if err != nil {
+			http.Error(w, "Parâmetro "+f.param+" inválido: use RFC 3339 ou AAAA-MM-DD", http.StatusBadRequest)
+			return
+		}
+		where = append(where, "created_at"+f.op+arg(t))
+	}
+
+	limit := auditDefaultLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "Parâmetro limit inválido", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, auditMaxLimit)
+	}
+
+	query := "SELECT id, action, ip, email, user_id, reason, user_agent, locked_until, created_at FROM public.auth_failures"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY id DESC LIMIT " + arg(limit+1)
+
+	rows, err := database.DB.Query(r.Context(), query, args...)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Erro ao buscar tentativas: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	page := AuthFailuresPage{Items: []middleware.AuthFailure{}}
+	for rows.Next() {
+		var f middleware.AuthFailure
+		if err := rows.Scan(&f.ID, &f.Action, &f.IP, &f.Email, &f.UserID, &f.Reason, &f.UserAgent, &f.LockedUntil, &f.CreatedAt); err != nil {
+			http.Error(w, "Erro ao ler tentativa", http.StatusInternalServerError)
+			return
+		}
+		page.Items = append(page.Items, f)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Erro ao percorrer tentativas", http.StatusInternalServerError)
+		return
+	}
+
+	if len(page.Items) > limit {
+		page.Items = page.Items[:limit]
+		page.NextBeforeID = page.Items[limit-1].ID
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
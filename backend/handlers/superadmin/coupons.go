@@ -0,0 +1,183 @@
+package superadmin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"CDNProxy_v2/backend/database"
+	"CDNProxy_v2/backend/models"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// couponColumns lê um cupom com Uses, a quantidade de pagamentos que o usaram
+// e contam para max_uses: aprovados e não devolvidos ou ainda em andamento.
+const couponColumns = `
+	c.id, c.code, c.description, c.discount_type, c.value::float8, c.currency, c.expires_at, c.max_uses, c.per_user_limit,
+	c.plan_ids, c.active, c.created_at, c.updated_at,
+	(SELECT COUNT(*) FROM public.coupon_redemptions cr JOIN public.payments p ON p.id = cr.payment_id
+		WHERE cr.coupon_id = c.id AND (CASE WHEN p.fulfilled_at IS NOT NULL THEN p.status NOT IN ('refunded', 'charged_back')
+			ELSE p.status NOT IN ('failed', 'rejected', 'cancelled', 'refunded', 'charged_back') END))`
+
+func scanCoupon(row pgx.Row) (models.Coupon, error) {
+	var c models.Coupon
+	err := row.Scan(&c.ID, &c.Code, &c.Description, &c.DiscountType, &c.Value, &c.Currency, &c.ExpiresAt, &c.MaxUses,
+		&c.PerUserLimit, &c.PlanIDs, &c.Active, &c.CreatedAt, &c.UpdatedAt, &c.Uses)
+	return c, err
+}
+
+// isPgError informa se err é o erro code do PostgreSQL.
+func isPgError(err error, code string) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == code
+}
+
+func GetAllCoupons(w http.ResponseWriter, r *http.Request) {
+	rows, err := database.DB.Query(r.Context(), "SELECT "+couponColumns+" FROM public.coupons c ORDER BY c.id")
+	if err != nil {
+		http.Error(w, "Failed to query coupons", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	coupons := []models.Coupon{}
+	for rows.Next() {
+		c, err := scanCoupon(rows)
+		if err != nil {
+			http.Error(w, "Failed to scan coupon", http.StatusInternalServerError)
+			return
+		}
+		coupons = append(coupons, c)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(coupons)
+}
+
+func GetCoupon(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid coupon ID", http.StatusBadRequest)
+		return
+	}
+
+	c, err := scanCoupon(database.DB.QueryRow(r.Context(), "SELECT "+couponColumns+" FROM public.coupons c WHERE c.id = $1", id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "Coupon not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to query coupon", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c)
+}
+
+// decodeCoupon lê e confere o cupom do corpo. Sem "active", o cupom é criado
+// ativo.
+func decodeCoupon(w http.ResponseWriter, r *http.Request) (*models.Coupon, bool) {
+	c := models.Coupon{Active: true}
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return nil, false
+	}
+	if err := models.NormalizeCoupon(&c); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return &c, true
+}
+
+func CreateCoupon(w http.ResponseWriter, r *http.Request) {
+	c, ok := decodeCoupon(w, r)
+	if !ok {
+		return
+	}
+
+	err := database.DB.QueryRow(r.Context(), `
+		INSERT INTO public.coupons
+			(code, description, discount_type, value, currency, expires_at, max_uses, per_user_limit, plan_ids, active, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, NOW(), NOW())
+		RETURNING id, created_at, updated_at`,
+		c.Code, c.Description, c.DiscountType, c.Value, c.Currency, c.ExpiresAt, c.MaxUses, c.PerUserLimit, c.PlanIDs, c.Active,
+	).Scan(&c.ID, &c.CreatedAt, &c.UpdatedAt)
+	if isPgError(err, "23505") {
+		http.Error(w, "A coupon with this code already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to create coupon", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(c)
+}
+
+// UpdateCoupon troca todos os campos do cupom {id}. Os usos já registrados
+// continuam contando para os novos limites.
+func UpdateCoupon(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid coupon ID", http.StatusBadRequest)
+		return
+	}
+	c, ok := decodeCoupon(w, r)
+	if !ok {
+		return
+	}
+
+	tag, err := database.DB.Exec(r.Context(), `
+		UPDATE public.coupons
+		SET code = $1, description = $2, discount_type = $3, value = $4, currency = $5, expires_at = $6, max_uses = $7,
+			per_user_limit = $8, plan_ids = $9, active = $10, updated_at = NOW()
+		WHERE id = $11`,
+		c.Code, c.Description, c.DiscountType, c.Value, c.Currency, c.ExpiresAt, c.MaxUses, c.PerUserLimit, c.PlanIDs, c.Active, id)
+	if isPgError(err, "23505") {
+		http.Error(w, "A coupon with this code already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to update coupon", http.StatusInternalServerError)
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		http.Error(w, "Coupon not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteCoupon apaga o cupom {id} e o tira dos carrinhos. Cupons já usados
+// em pagamentos respondem 409 e devem ser desativados.
+func DeleteCoupon(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid coupon ID", http.StatusBadRequest)
+		return
+	}
+
+	tag, err := database.DB.Exec(r.Context(), "DELETE FROM public.coupons WHERE id = $1", id)
+	if isPgError(err, "23503") {
+		http.Error(w, "Coupon has been used in payments; deactivate it instead", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to delete coupon", http.StatusInternalServerError)
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		http.Error(w, "Coupon not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
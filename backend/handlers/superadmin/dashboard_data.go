@@ -50,9 +50,8 @@ func DashboardDataHandler(w http.ResponseWriter, r *http.Request) {
 		data.TotalUsers = 0
 	}
 
-	// Get total requests (logs)
-	// Counting all might be slow on large tables, but valid for now. Ideal is caching.
-	err = database.DB.QueryRow(context.Background(), "SELECT COUNT(*) FROM streaming_access_logs").Scan(&data.MonthlyRequests)
+	// Get total requests for current month from the daily rollups
+	err = database.DB.QueryRow(context.Background(), "SELECT COALESCE(SUM(hits), 0)::bigint FROM access_log_rollups_daily WHERE day >= date_trunc('month', CURRENT_DATE)").Scan(&data.MonthlyRequests)
 	if err != nil {
 		data.MonthlyRequests = 0
 	}
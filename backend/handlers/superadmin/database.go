@@ -6,6 +6,7 @@ import (
 	"net/http"
 
 	"CDNProxy_v2/backend/database"
+	"CDNProxy_v2/backend/services/accesslogs"
 )
 
 type TableStatus struct {
@@ -15,9 +16,10 @@ type TableStatus struct {
 }
 
 type DatabaseStatusResponse struct {
-	DatabaseSize      string        `json:"database_size"`
-	ActiveConnections int           `json:"active_connections"`
-	Tables            []TableStatus `json:"tables"`
+	DatabaseSize      string                 `json:"database_size"`
+	ActiveConnections int                    `json:"active_connections"`
+	Tables            []TableStatus          `json:"tables"`
+	AccessLogParts    []accesslogs.Partition `json:"access_log_partitions"`
 }
 
 type DatabaseCleanRequest struct {
@@ -68,10 +70,17 @@ func DatabaseStatusHandler(w http.ResponseWriter, r *http.Request) {
 		tables = append(tables, t)
 	}
 
+	// 4. Partições mensais de streaming_access_logs
+	partitions, err := accesslogs.ListPartitions(r.Context())
+	if err != nil {
+		partitions = []accesslogs.Partition{}
+	}
+
 	resp := DatabaseStatusResponse{
 		DatabaseSize:      finalSize,
 		ActiveConnections: activeConnections,
 		Tables:            tables,
+		AccessLogParts:    partitions,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
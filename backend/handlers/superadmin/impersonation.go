@@ -0,0 +1,183 @@
+package superadmin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"CDNProxy_v2/backend/database"
+	"CDNProxy_v2/backend/middleware"
+
+	"github.com/gorilla/mux"
+)
+
+// ImpersonationSession é a resposta de StartImpersonation. O token só é
+// devolvido aqui e deve ser usado como Bearer em /api/admin.
+type ImpersonationSession struct {
+	middleware.Impersonation
+	Token     string `json:"token"`
+	TokenType string `json:"token_type"`
+	Target    struct {
+		ID    int64  `json:"id"`
+		Email string `json:"email"`
+		Name  string `json:"name"`
+		Role  int    `json:"role"`
+	} `json:"target"`
+}
+
+// StartImpersonation abre uma sessão curta em que o Superadmin autenticado vê
+// /api/admin como o usuário {id}. Corpo: reason (obrigatório), ttl_minutes
+// (padrão 15, máximo 60) e allow_writes (padrão false, somente leitura).
+func StartImpersonation(w http.ResponseWriter, r *http.Request) {
+	actorID, ok := r.Context().Value(middleware.UserIDKey).(int64)
+	if !ok {
+		http.Error(w, "ID do usuário não encontrado no contexto", http.StatusInternalServerError)
+		return
+	}
+	actorRole, _ := r.Context().Value(middleware.RoleKey).(string)
+	targetID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "ID de usuário inválido", http.StatusBadRequest)
+		return
+	}
+
+	var p struct {
+		Reason      string `json:"reason"`
+		TTLMinutes  int    `json:"ttl_minutes"`
+		AllowWrites bool   `json:"allow_writes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, "Corpo da requisição inválido", http.StatusBadRequest)
+		return
+	}
+	p.Reason = strings.TrimSpace(p.Reason)
+	if p.Reason == "" {
+		http.Error(w, "Informe o motivo da personificação", http.StatusBadRequest)
+		return
+	}
+	ttl := middleware.DefaultImpersonationTTL
+	if p.TTLMinutes != 0 {
+		ttl = time.Duration(p.TTLMinutes) * time.Minute
+		if ttl < time.Minute || ttl > middleware.MaxImpersonationTTL {
+			http.Error(w, fmt.Sprintf("ttl_minutes deve estar entre 1 e %d", int(middleware.MaxImpersonationTTL.Minutes())), http.StatusBadRequest)
+			return
+		}
+	}
+	if targetID == actorID {
+		http.Error(w, "Não é possível personificar a si mesmo", http.StatusConflict)
+		return
+	}
+
+	var s ImpersonationSession
+	err = database.DB.QueryRow(r.Context(), "SELECT id, email, COALESCE(name, ''), role FROM users WHERE id = $1", targetID).
+		Scan(&s.Target.ID, &s.Target.Email, &s.Target.Name, &s.Target.Role)
+	if err != nil {
+		http.Error(w, "Usuário não encontrado", http.StatusNotFound)
+		return
+	}
+	if strconv.Itoa(s.Target.Role) == middleware.RoleSuperadmin {
+		http.Error(w, "Não é possível personificar um Superadmin", http.StatusConflict)
+		return
+	}
+
+	token, hash, err := middleware.GenerateImpersonationToken()
+	if err != nil {
+		http.Error(w, "Erro ao gerar o token", http.StatusInternalServerError)
+		return
+	}
+	s.Token, s.TokenType = token, "Bearer"
+	err = database.DB.QueryRow(r.Context(), `
+		INSERT INTO public.impersonation_sessions (actor_id, actor_role, target_id, token_hash, allow_writes, reason, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, NOW() + $7 * INTERVAL '1 second')
+		RETURNING id, actor_id, actor_role, target_id, allow_writes, reason, expires_at, ended_at, created_at`,
+		actorID, actorRole, targetID, hash, p.AllowWrites, p.Reason, int(ttl.Seconds()),
+	).Scan(&s.ID, &s.ActorID, &s.ActorRole, &s.TargetID, &s.AllowWrites, &s.Reason, &s.ExpiresAt, &s.EndedAt, &s.CreatedAt)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Erro ao criar sessão de personificação: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(s)
+}
+
+// ListImpersonations lista as sessões de personificação, das mais recentes
+// para as mais antigas. Filtros: actor_id, target_id e active=true.
+func ListImpersonations(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var where []string
+	var args []interface{}
+	for _, param := range []string{"actor_id", "target_id"} {
+		v := q.Get(param)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Parâmetro "+param+" inválido", http.StatusBadRequest)
+			return
+		}
+		args = append(args, n)
+		where = append(where, param+" = $"+strconv.Itoa(len(args)))
+	}
+	if q.Get("active") == "true" {
+		where = append(where, "ended_at IS NULL AND expires_at > NOW()")
+	}
+
+	query := `SELECT id, actor_id, actor_role, target_id, allow_writes, reason, expires_at, ended_at, created_at
+		FROM public.impersonation_sessions`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY id DESC LIMIT 200"
+
+	rows, err := database.DB.Query(r.Context(), query, args...)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Erro ao buscar sessões de personificação: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	sessions := []middleware.Impersonation{}
+	for rows.Next() {
+		var s middleware.Impersonation
+		if err := rows.Scan(&s.ID, &s.ActorID, &s.ActorRole, &s.TargetID, &s.AllowWrites, &s.Reason, &s.ExpiresAt, &s.EndedAt, &s.CreatedAt); err != nil {
+			http.Error(w, "Erro ao ler sessão de personificação", http.StatusInternalServerError)
+			return
+		}
+		sessions = append(sessions, s)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Erro ao percorrer sessões de personificação", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions)
+}
+
+// EndImpersonation encerra a sessão {id} antes da expiração; o token deixa
+// de ser aceito imediatamente.
+func EndImpersonation(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "ID de sessão inválido", http.StatusBadRequest)
+		return
+	}
+
+	tag, err := database.DB.Exec(r.Context(),
+		"UPDATE public.impersonation_sessions SET ended_at = NOW() WHERE id = $1 AND ended_at IS NULL", id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Erro ao encerrar sessão: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		http.Error(w, "Sessão não encontrada ou já encerrada", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
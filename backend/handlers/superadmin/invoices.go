@@ -0,0 +1,57 @@
+package superadmin
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"CDNProxy_v2/backend/services/invoices"
+
+	"github.com/gorilla/mux"
+)
+
+// GetPaymentInvoice devolve o recibo do pagamento {id}, emitindo-o se o
+// pagamento foi aprovado antes dos recibos existirem.
+func GetPaymentInvoice(w http.ResponseWriter, r *http.Request) {
+	inv, ok := loadInvoice(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(inv)
+}
+
+// GetPaymentInvoicePDF devolve o recibo do pagamento {id} em PDF.
+func GetPaymentInvoicePDF(w http.ResponseWriter, r *http.Request) {
+	inv, ok := loadInvoice(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", `attachment; filename="recibo-`+invoices.FormatNumber(inv.Number)+`.pdf"`)
+	w.Write(invoices.Render(inv))
+}
+
+func loadInvoice(w http.ResponseWriter, r *http.Request) (*invoices.Invoice, bool) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "ID de pagamento inválido", http.StatusBadRequest)
+		return nil, false
+	}
+	inv, err := invoices.ForPayment(r.Context(), id)
+	switch {
+	case errors.Is(err, invoices.ErrNotFound):
+		http.Error(w, "Pagamento não encontrado", http.StatusNotFound)
+		return nil, false
+	case errors.Is(err, invoices.ErrNotPaid):
+		http.Error(w, "O pagamento não foi pago", http.StatusConflict)
+		return nil, false
+	case err != nil:
+		log.Printf("ERROR: Could not load invoice of payment %d: %v", id, err)
+		http.Error(w, "Erro ao carregar o recibo", http.StatusInternalServerError)
+		return nil, false
+	}
+	return inv, true
+}
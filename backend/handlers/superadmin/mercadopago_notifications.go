@@ -0,0 +1,128 @@
+package superadmin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"CDNProxy_v2/backend/database"
+	"CDNProxy_v2/backend/services/payments"
+
+	"github.com/gorilla/mux"
+)
+
+// MercadoPagoNotificationsPage é uma página de notificações recebidas dos
+// provedores de pagamento, da mais recente para a mais antiga.
+type MercadoPagoNotificationsPage struct {
+	Items        []payments.Notification `json:"items"`
+	NextBeforeID int64                   `json:"next_before_id,omitempty"`
+}
+
+// ListMercadoPagoNotifications lista as notificações gravadas pelos webhooks
+// de pagamento. Filtros: provider, status, topic, resource_id (id do
+// pagamento no provedor), payment_id (pagamento local), limit e before_id
+// (paginação).
+func ListMercadoPagoNotifications(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var where []string
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	for _, param := range []string{"payment_id", "before_id"} {
+		v := q.Get(param)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Parâmetro "+param+" inválido", http.StatusBadRequest)
+			return
+		}
+		if param == "before_id" {
+			where = append(where, "id < "+arg(n))
+		} else {
+			where = append(where, "payment_id = "+arg(n))
+		}
+	}
+	for _, param := range []string{"provider", "status", "topic", "resource_id"} {
+		if v := q.Get(param); v != "" {
+			where = append(where, param+" = "+arg(v))
+		}
+	}
+
+	limit := auditDefaultLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "Parâmetro limit inválido", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, auditMaxLimit)
+	}
+
+	query := "SELECT " + payments.NotificationColumns + " FROM public.mercadopago_notifications"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY id DESC LIMIT " + arg(limit+1)
+
+	rows, err := database.DB.Query(r.Context(), query, args...)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Erro ao buscar notificações: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	page := MercadoPagoNotificationsPage{Items: []payments.Notification{}}
+	for rows.Next() {
+		n, err := payments.ScanNotification(rows)
+		if err != nil {
+			http.Error(w, "Erro ao ler notificação", http.StatusInternalServerError)
+			return
+		}
+		page.Items = append(page.Items, *n)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Erro ao percorrer notificações", http.StatusInternalServerError)
+		return
+	}
+
+	if len(page.Items) > limit {
+		page.Items = page.Items[:limit]
+		page.NextBeforeID = page.Items[limit-1].ID
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// ReplayMercadoPagoNotification reprocessa a notificação {id}, consultando de
+// novo o pagamento no provedor que a enviou. A assinatura não é verificada outra vez,
+// inclusive em notificações rejeitadas; renovações já aplicadas ao pagamento
+// não se repetem. Devolve a notificação com o novo resultado.
+func ReplayMercadoPagoNotification(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "ID de notificação inválido", http.StatusBadRequest)
+		return
+	}
+
+	n, err := payments.ProcessNotification(r.Context(), id)
+	if errors.Is(err, payments.ErrNotificationNotFound) {
+		http.Error(w, "Notificação não encontrada", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Erro ao reprocessar notificação: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(n)
+}
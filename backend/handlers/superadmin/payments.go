@@ -25,6 +25,8 @@ type Payment struct {
 	PaidAt        time.Time `json:"paid_at"`
 	CreatedAt     time.Time `json:"created_at"`
 	UpdatedAt     time.Time `json:"updated_at"`
+	// InvoiceNumber só é preenchido na listagem
+	InvoiceNumber *int64 `json:"invoice_number,omitempty"`
 }
 
 // PaymentsHandler handles the request to get all payments.
@@ -33,7 +35,7 @@ func PaymentsHandler(w http.ResponseWriter, r *http.Request) {
 
 	switch r.Method {
 	case http.MethodGet:
-		rows, err := database.DB.Query(context.Background(), "SELECT id, user_id, plan_id, amount, status, payment_method, paid_at, created_at, updated_at FROM payments")
+		rows, err := database.DB.Query(context.Background(), "SELECT p.id, p.user_id, p.plan_id, p.amount, p.status, p.payment_method, p.paid_at, p.created_at, p.updated_at, i.number FROM payments p LEFT JOIN invoices i ON i.payment_id = p.id")
 		if err != nil {
 			http.Error(w, "Failed to query payments", http.StatusInternalServerError)
 			return
@@ -43,7 +45,7 @@ func PaymentsHandler(w http.ResponseWriter, r *http.Request) {
 		payments := []Payment{}
 		for rows.Next() {
 			var p Payment
-			if err := rows.Scan(&p.ID, &p.UserID, &p.PlanID, &p.Amount, &p.Status, &p.PaymentMethod, &p.PaidAt, &p.CreatedAt, &p.UpdatedAt); err != nil {
+			if err := rows.Scan(&p.ID, &p.UserID, &p.PlanID, &p.Amount, &p.Status, &p.PaymentMethod, &p.PaidAt, &p.CreatedAt, &p.UpdatedAt, &p.InvoiceNumber); err != nil {
 				http.Error(w, "Failed to scan payment", http.StatusInternalServerError)
 				return
 			}
@@ -1,6 +1,7 @@
 package superadmin
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -10,10 +11,57 @@ import (
 	"CDNProxy_v2/backend/models"
 
 	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
 )
 
+// loadPlanPrices preenche os preços em outras moedas dos planos.
+func loadPlanPrices(ctx context.Context, plans []models.Plan) error {
+	index := make(map[int64]*models.Plan, len(plans))
+	ids := make([]int64, 0, len(plans))
+	for i := range plans {
+		index[plans[i].ID] = &plans[i]
+		ids = append(ids, plans[i].ID)
+	}
+	rows, err := database.DB.Query(ctx, "SELECT plan_id, currency, price::float8 FROM public.plan_prices WHERE plan_id = ANY($1)", ids)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			planID   int64
+			currency string
+			price    float64
+		)
+		if err := rows.Scan(&planID, &currency, &price); err != nil {
+			return err
+		}
+		p := index[planID]
+		if p.Prices == nil {
+			p.Prices = map[string]float64{}
+		}
+		p.Prices[currency] = price
+	}
+	return rows.Err()
+}
+
+// savePlanPrices troca os preços em outras moedas do plano planID.
+func savePlanPrices(ctx context.Context, tx pgx.Tx, planID int64, prices map[string]float64) error {
+	if _, err := tx.Exec(ctx, "DELETE FROM public.plan_prices WHERE plan_id = $1", planID); err != nil {
+		return err
+	}
+	for currency, price := range prices {
+		if _, err := tx.Exec(ctx,
+			"INSERT INTO public.plan_prices (plan_id, currency, price, updated_at) VALUES ($1, $2, $3, NOW())",
+			planID, currency, price); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func GetAllPlans(w http.ResponseWriter, r *http.Request) {
-	rows, err := database.DB.Query(r.Context(), "SELECT id, name, price, description FROM public.plans")
+	rows, err := database.DB.Query(r.Context(), "SELECT id, name, price, description, billing_period, period_days FROM public.plans ORDER BY id")
 	if err != nil {
 		http.Error(w, "Failed to query plans", http.StatusInternalServerError)
 		return
@@ -23,12 +71,17 @@ func GetAllPlans(w http.ResponseWriter, r *http.Request) {
 	var plans []models.Plan
 	for rows.Next() {
 		var p models.Plan
-		if err := rows.Scan(&p.ID, &p.Name, &p.Price, &p.Description); err != nil {
+		if err := rows.Scan(&p.ID, &p.Name, &p.Price, &p.Description, &p.BillingPeriod, &p.PeriodDays); err != nil {
 			http.Error(w, "Failed to scan plan", http.StatusInternalServerError)
 			return
 		}
 		plans = append(plans, p)
 	}
+	rows.Close()
+	if err := loadPlanPrices(r.Context(), plans); err != nil {
+		http.Error(w, "Failed to query plan prices", http.StatusInternalServerError)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(plans)
@@ -43,34 +96,81 @@ func GetPlan(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var p models.Plan
-	err = database.DB.QueryRow(r.Context(), "SELECT id, name, price, description FROM public.plans WHERE id = $1", id).Scan(&p.ID, &p.Name, &p.Price, &p.Description)
+	err = database.DB.QueryRow(r.Context(), "SELECT id, name, price, description, billing_period, period_days FROM public.plans WHERE id = $1", id).Scan(&p.ID, &p.Name, &p.Price, &p.Description, &p.BillingPeriod, &p.PeriodDays)
 	if err != nil {
 		http.Error(w, "Plan not found", http.StatusNotFound)
 		return
 	}
+	plans := []models.Plan{p}
+	if err := loadPlanPrices(r.Context(), plans); err != nil {
+		http.Error(w, "Failed to query plan prices", http.StatusInternalServerError)
+		return
+	}
+	p = plans[0]
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(p)
 }
 
+// validatePlan confere o período de cobrança do plano (vazio vale monthly)
+// e os preços em outras moedas.
+func validatePlan(w http.ResponseWriter, p *models.Plan) bool {
+	if err := models.ValidateBillingPeriod(p.BillingPeriod, p.PeriodDays); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	if p.BillingPeriod == "" {
+		p.BillingPeriod = models.PeriodMonthly
+	}
+	if p.Prices != nil {
+		prices, err := models.NormalizePlanPrices(p.Prices)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return false
+		}
+		p.Prices = prices
+	}
+	return true
+}
+
 func CreatePlan(w http.ResponseWriter, r *http.Request) {
 	var p models.Plan
 	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
+	if !validatePlan(w, &p) {
+		return
+	}
+
+	tx, err := database.DB.Begin(r.Context())
+	if err != nil {
+		http.Error(w, "Failed to start transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(r.Context())
 
-	err := database.DB.QueryRow(
+	err = tx.QueryRow(
 		r.Context(),
-		"INSERT INTO public.plans (name, price, description, created_at, updated_at) VALUES ($1, $2, $3, NOW(), NOW()) RETURNING id",
+		"INSERT INTO public.plans (name, price, description, billing_period, period_days, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, NOW(), NOW()) RETURNING id",
 		p.Name,
 		p.Price,
 		p.Description,
+		p.BillingPeriod,
+		p.PeriodDays,
 	).Scan(&p.ID)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to create plan: %v", err), http.StatusInternalServerError)
 		return
 	}
+	if err := savePlanPrices(r.Context(), tx, p.ID, p.Prices); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create plan prices: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(r.Context()); err != nil {
+		http.Error(w, "Failed to commit transaction", http.StatusInternalServerError)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
@@ -90,19 +190,42 @@ func UpdatePlan(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
+	if !validatePlan(w, &p) {
+		return
+	}
+
+	tx, err := database.DB.Begin(r.Context())
+	if err != nil {
+		http.Error(w, "Failed to start transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(r.Context())
 
-	_, err = database.DB.Exec(
+	_, err = tx.Exec(
 		r.Context(),
-		"UPDATE public.plans SET name = $1, price = $2, description = $3, updated_at = NOW() WHERE id = $4",
+		"UPDATE public.plans SET name = $1, price = $2, description = $3, billing_period = $4, period_days = $5, updated_at = NOW() WHERE id = $6",
 		p.Name,
 		p.Price,
 		p.Description,
+		p.BillingPeriod,
+		p.PeriodDays,
 		id,
 	)
 	if err != nil {
 		http.Error(w, "Failed to update plan", http.StatusInternalServerError)
 		return
 	}
+	// Sem "prices" no corpo, os preços em outras moedas não mudam
+	if p.Prices != nil {
+		if err := savePlanPrices(r.Context(), tx, int64(id), p.Prices); err != nil {
+			http.Error(w, "Failed to update plan prices", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(r.Context()); err != nil {
+		http.Error(w, "Failed to commit transaction", http.StatusInternalServerError)
+		return
+	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -0,0 +1,99 @@
+package superadmin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"CDNProxy_v2/backend/database"
+	"CDNProxy_v2/backend/services/payments"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+)
+
+// RefundResult é o reembolso aceito pelo provedor e a situação do pagamento
+// depois dele.
+type RefundResult struct {
+	RefundID  string  `json:"refund_id"`
+	PaymentID int64   `json:"payment_id"`
+	Amount    float64 `json:"amount"`
+	Status    string  `json:"status"`
+}
+
+// RefundPayment reembolsa, no provedor que o recebeu, o pagamento aprovado
+// {id}. O corpo opcional {"amount": 10.5} pede um reembolso parcial; sem ele
+// o pagamento é reembolsado inteiro. O status do pagamento é atualizado com o
+// que o provedor informa (o webhook do reembolso também o atualiza); as
+// renovações já aplicadas não são desfeitas. No reembolso total,
+// payments.Apply devolve à carteira o saldo usado no pagamento e estorna as
+// recargas dele.
+func RefundPayment(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "ID de pagamento inválido", http.StatusBadRequest)
+		return
+	}
+
+	var body struct {
+		Amount float64 `json:"amount"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Amount < 0 {
+			http.Error(w, "Corpo da requisição inválido", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var (
+		method, status    string
+		providerPaymentID *string
+		amount            float64
+	)
+	err = database.DB.QueryRow(r.Context(),
+		"SELECT COALESCE(payment_method, ''), COALESCE(status, ''), provider_payment_id, amount::float8 FROM public.payments WHERE id = $1",
+		id).Scan(&method, &status, &providerPaymentID, &amount)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "Pagamento não encontrado", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Erro ao buscar pagamento", http.StatusInternalServerError)
+		return
+	}
+	if status != payments.StatusApproved || providerPaymentID == nil {
+		http.Error(w, "Só pagamentos aprovados por um provedor podem ser reembolsados", http.StatusConflict)
+		return
+	}
+	if body.Amount > amount+0.005 {
+		http.Error(w, "Valor do reembolso maior que o do pagamento", http.StatusBadRequest)
+		return
+	}
+	provider, err := payments.Get(method)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Provedor de pagamento %q não configurado", method), http.StatusConflict)
+		return
+	}
+
+	refund, err := provider.Refund(r.Context(), *providerPaymentID, body.Amount)
+	if err != nil {
+		log.Printf("ERROR: Could not refund payment %d on %s: %v", id, method, err)
+		http.Error(w, fmt.Sprintf("Erro ao reembolsar no provedor: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	result := RefundResult{RefundID: refund.ID, PaymentID: id, Amount: refund.Amount, Status: status}
+	if remote, err := provider.GetPayment(r.Context(), *providerPaymentID); err != nil {
+		log.Printf("WARN: Could not fetch payment %d after refund: %v", id, err)
+	} else if _, err := payments.Apply(r.Context(), id, remote); err != nil {
+		log.Printf("WARN: Could not record refund of payment %d: %v", id, err)
+	} else {
+		result.Status = remote.Status
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
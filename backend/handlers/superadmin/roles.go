@@ -0,0 +1,147 @@
+package superadmin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"CDNProxy_v2/backend/database"
+	"CDNProxy_v2/backend/middleware"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+)
+
+// ListRoles lista as roles com as permissões de cada uma.
+func ListRoles(w http.ResponseWriter, r *http.Request) {
+	rows, err := database.DB.Query(r.Context(), `
+		SELECT r.id, r.name, r.description, COALESCE(array_agg(rp.permission ORDER BY rp.permission) FILTER (WHERE rp.permission IS NOT NULL), '{}')
+		FROM public.roles r
+		LEFT JOIN public.role_permissions rp ON rp.role_id = r.id
+		GROUP BY r.id
+		ORDER BY r.id`)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to query roles: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	roles := []middleware.Role{}
+	for rows.Next() {
+		var role middleware.Role
+		if err := rows.Scan(&role.ID, &role.Name, &role.Description, &role.Permissions); err != nil {
+			http.Error(w, "Failed to scan role", http.StatusInternalServerError)
+			return
+		}
+		roles = append(roles, role)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Error iterating over roles", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(roles)
+}
+
+// AssignUserRole troca a role de um usuário. O último Superadmin ativo não
+// pode ser rebaixado.
+func AssignUserRole(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "ID de usuário inválido", http.StatusBadRequest)
+		return
+	}
+
+	var p struct {
+		Role int `json:"role_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, "Corpo da requisição inválido", http.StatusBadRequest)
+		return
+	}
+
+	if err := assignRole(r.Context(), id, p.Role); err != nil {
+		writeRoleError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int64{"id": id, "role_id": int64(p.Role)})
+}
+
+var (
+	errUnknownRole      = errors.New("unknown role")
+	errLastSuperadmin   = errors.New("cannot demote the last active superadmin")
+	errRoleChangeDenied = errors.New("changing roles requires the roles.manage permission")
+	errRoleUserNotFound = errors.New("user not found")
+)
+
+const superadminRoleID = 1
+
+func writeRoleError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errUnknownRole):
+		http.Error(w, "Role inexistente", http.StatusBadRequest)
+	case errors.Is(err, errRoleUserNotFound):
+		http.Error(w, "Usuário não encontrado", http.StatusNotFound)
+	case errors.Is(err, errLastSuperadmin):
+		http.Error(w, "Não é possível rebaixar o último Superadmin ativo", http.StatusConflict)
+	case errors.Is(err, errRoleChangeDenied):
+		http.Error(w, "Forbidden: missing permission "+middleware.PermRolesManage, http.StatusForbidden)
+	default:
+		http.Error(w, fmt.Sprintf("Erro ao atualizar role: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// assignRole grava a nova role em uma transação, travando os Superadmins para
+// que duas trocas simultâneas não deixem o sistema sem nenhum.
+func assignRole(ctx context.Context, userID int64, role int) error {
+	tx, err := database.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := tx.QueryRow(ctx, "SELECT 1 FROM public.roles WHERE id = $1", role).Scan(new(int)); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return errUnknownRole
+		}
+		return err
+	}
+
+	var current int
+	if err := tx.QueryRow(ctx, "SELECT role FROM public.users WHERE id = $1 FOR UPDATE", userID).Scan(&current); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return errRoleUserNotFound
+		}
+		return err
+	}
+
+	if current == superadminRoleID && role != superadminRoleID {
+		var others int
+		if err := tx.QueryRow(ctx, `
+			SELECT COUNT(*) FROM (
+				SELECT id FROM public.users WHERE role = $1 AND active AND id <> $2 FOR UPDATE
+			) s`, superadminRoleID, userID).Scan(&others); err != nil {
+			return err
+		}
+		if others == 0 {
+			return errLastSuperadmin
+		}
+	}
+
+	if _, err := tx.Exec(ctx, "UPDATE public.users SET role = $1, updated_at = NOW() WHERE id = $2", role, userID); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// canChangeRoles informa se o usuário da requisição pode atribuir roles.
+func canChangeRoles(r *http.Request) bool {
+	role, _ := r.Context().Value(middleware.RoleKey).(string)
+	return middleware.HasPermission(r.Context(), role, middleware.PermRolesManage)
+}
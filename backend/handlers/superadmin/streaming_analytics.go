@@ -15,14 +15,13 @@ type StreamingHit struct {
 
 // StreamingHitsHandler retorna a contagem de hits por hora nas últimas 24 horas.
 func StreamingHitsHandler(w http.ResponseWriter, r *http.Request) {
-	// Query para agrupar hits por hora nas últimas 24h
-	// Ajustado para Postgres: to_char(created_at, 'HH24:00')
+	// Usa os rollups horários (access_log_rollups_hourly) das últimas 24h
 	query := `
-		SELECT to_char(created_at, 'HH24:00') as hour_bucket, COUNT(*) as total_hits
-		FROM streaming_access_logs
-		WHERE created_at >= NOW() - INTERVAL '24 hours'
-		GROUP BY hour_bucket
-		ORDER BY hour_bucket ASC
+		SELECT to_char(bucket, 'HH24:00') as hour_bucket, SUM(hits)::bigint as total_hits
+		FROM access_log_rollups_hourly
+		WHERE bucket >= date_trunc('hour', NOW() - INTERVAL '23 hours')
+		GROUP BY bucket
+		ORDER BY bucket ASC
 	`
 
 	rows, err := database.DB.Query(context.Background(), query)
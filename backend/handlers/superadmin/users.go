@@ -1,15 +1,15 @@
 package superadmin
 
 import (
-	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
+	"log"
 	"net/http"
 	"strconv"
 
 	"CDNProxy_v2/backend/database"
-	"CDNProxy_v2/backend/imports/config"
+	"CDNProxy_v2/backend/middleware"
 	"CDNProxy_v2/backend/models"
 
 	"github.com/gorilla/mux"
@@ -24,95 +24,6 @@ type UserPayload struct {
 	Active   bool   `json:"active"`
 }
 
-type SupabaseUserResponse struct {
-	ID    string `json:"id"`
-	Email string `json:"email"`
-	// Outros campos omitidos
-}
-
-// createSupabaseUser cria o usuário no Supabase Auth via Admin API
-func createSupabaseUser(email, password string) (*SupabaseUserResponse, error) {
-	cfg, err := config.LoadConfig()
-	if err != nil {
-		return nil, err
-	}
-
-	url := fmt.Sprintf("%s/auth/v1/admin/users", cfg.SupabaseURL)
-	payload := map[string]interface{}{
-		"email":         email,
-		"password":      password,
-		"email_confirm": true,
-		"user_metadata": map[string]interface{}{},
-		"app_metadata":  map[string]interface{}{"provider": "email", "providers": []string{"email"}},
-	}
-
-	body, _ := json.Marshal(payload)
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
-	if err != nil {
-		return nil, err
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+cfg.SupabaseServiceRoleKey)
-	req.Header.Set("apikey", cfg.SupabaseServiceRoleKey)
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode >= 400 {
-		respBody, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("supabase error: %s", string(respBody))
-	}
-
-	var sbUser SupabaseUserResponse
-	if err := json.NewDecoder(resp.Body).Decode(&sbUser); err != nil {
-		return nil, err
-	}
-
-	return &sbUser, nil
-}
-
-// updateSupabaseUserPassword atualiza a senha no Supabase Auth
-func updateSupabaseUserPassword(uid, password string) error {
-	cfg, err := config.LoadConfig()
-	if err != nil {
-		return err
-	}
-
-	url := fmt.Sprintf("%s/auth/v1/admin/users/%s", cfg.SupabaseURL, uid)
-	payload := map[string]interface{}{
-		"password": password,
-	}
-
-	body, _ := json.Marshal(payload)
-	req, err := http.NewRequest("PUT", url, bytes.NewBuffer(body))
-	if err != nil {
-		return err
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+cfg.SupabaseServiceRoleKey)
-	req.Header.Set("apikey", cfg.SupabaseServiceRoleKey)
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode >= 400 {
-		respBody, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("supabase error: %s", string(respBody))
-	}
-
-	return nil
-}
-
 func CreateUser(w http.ResponseWriter, r *http.Request) {
 	var p UserPayload
 	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
@@ -125,31 +36,44 @@ func CreateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 1. Criar no Supabase
-	sbUser, err := createSupabaseUser(p.Email, p.Password)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Erro ao criar usuário no Supabase: %v", err), http.StatusInternalServerError)
+	// Sem role_id o usuário é criado como Admin; outras roles exigem roles.manage
+	if p.Role == 0 {
+		p.Role = 2
+	}
+	if p.Role != 2 && !canChangeRoles(r) {
+		writeRoleError(w, errRoleChangeDenied)
+		return
+	}
+	var exists bool
+	if err := database.DB.QueryRow(r.Context(), "SELECT EXISTS (SELECT 1 FROM public.roles WHERE id = $1)", p.Role).Scan(&exists); err != nil || !exists {
+		writeRoleError(w, errUnknownRole)
 		return
 	}
 
-	// 2. Inserir no banco local vinculando o supabase_auth_id
-	// Nota: A tabela users tem um ID SERIAL/BIGINT. O supabase_auth_id é um UUID salvo em outra coluna.
-	// Precisamos saber se a coluna 'supabase_auth_id' existe. O modelo User tem 'SupabaseAuthID *string'.
-	// Supondo coluna 'supabase_auth_id'.
-
-	// Como a tabela user usa ID bigint e supabase usa UUID, armazenamos o UUID em supabase_auth_id.
-	// E a senha encriptada? Deixamos vazia ou placeholder, pois quem autentica é o Supabase.
-
-	_, err = database.DB.Exec(r.Context(),
-		"INSERT INTO users (email, encrypted_password, role, name, active, supabase_auth_id, created_at, updated_at) VALUES ($1, '', $2, $3, true, $4, NOW(), NOW())",
-		p.Email, p.Role, p.Name, sbUser.ID)
+	auth, err := middleware.CurrentAuthenticator()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
+	// 1. Inserir no banco local; as credenciais ficam a cargo do Authenticator
+	// (Supabase Auth grava supabase_auth_id, modo local grava o hash bcrypt)
+	var userID int64
+	err = database.DB.QueryRow(r.Context(),
+		"INSERT INTO users (email, encrypted_password, role, name, active, created_at, updated_at) VALUES ($1, '', $2, $3, true, NOW(), NOW()) RETURNING id",
+		p.Email, p.Role, p.Name).Scan(&userID)
 	if err != nil {
-		// Rollback parcial: Deveríamos deletar do Supabase se falhar aqui, mas por simplificação vamos apenas logar erro.
 		http.Error(w, fmt.Sprintf("Erro ao criar usuário localmente: %v", err), http.StatusInternalServerError)
 		return
 	}
 
+	// 2. Criar as credenciais; se falhar, desfaz o usuário local
+	if err := auth.CreateCredentials(r.Context(), userID, p.Email, p.Password); err != nil {
+		database.DB.Exec(r.Context(), "DELETE FROM users WHERE id = $1", userID)
+		http.Error(w, fmt.Sprintf("Erro ao criar credenciais do usuário: %v", err), http.StatusInternalServerError)
+		return
+	}
+
 	w.WriteHeader(http.StatusCreated)
 }
 
@@ -167,33 +91,45 @@ func UpdateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Se senha fornecida, atualizar no Supabase
+	// Troca de role passa pelas mesmas regras de PUT /users/{id}/role
+	var currentRole int
+	if err := database.DB.QueryRow(r.Context(), "SELECT role FROM users WHERE id = $1", id).Scan(&currentRole); err != nil {
+		http.Error(w, "Usuário não encontrado", http.StatusNotFound)
+		return
+	}
+	if p.Role != 0 && p.Role != currentRole {
+		if !canChangeRoles(r) {
+			writeRoleError(w, errRoleChangeDenied)
+			return
+		}
+		if err := assignRole(r.Context(), int64(id), p.Role); err != nil {
+			writeRoleError(w, err)
+			return
+		}
+	}
+
+	// Se senha fornecida, atualizar no provedor de autenticação
 	if p.Password != "" {
-		// Precisamos do supabase_auth_id deste usuário para atualizar no Supabase
-		var sbID *string
-		err := database.DB.QueryRow(r.Context(), "SELECT supabase_auth_id FROM users WHERE id = $1", id).Scan(&sbID)
+		auth, err := middleware.CurrentAuthenticator()
 		if err != nil {
-			http.Error(w, "Usuário não encontrado", http.StatusNotFound)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		if sbID != nil && *sbID != "" {
-			if err := updateSupabaseUserPassword(*sbID, p.Password); err != nil {
-				http.Error(w, fmt.Sprintf("Erro ao atualizar senha no Supabase: %v", err), http.StatusInternalServerError)
+		if err := auth.SetPassword(r.Context(), int64(id), p.Password); err != nil {
+			if errors.Is(err, middleware.ErrUserNotFound) {
+				http.Error(w, "Usuário não encontrado", http.StatusNotFound)
 				return
 			}
-		} else {
-			// Se não tem ID do Supabase (usuário legado?), talvez devêssemos impedir ou apenas atualizar local (se houver hash local).
-			// Vamos assumir erro por enquanto para forçar integridade.
-			http.Error(w, "Usuário não vinculado ao Supabase Auth", http.StatusBadRequest)
+			http.Error(w, fmt.Sprintf("Erro ao atualizar senha: %v", err), http.StatusInternalServerError)
 			return
 		}
 	}
 
 	// Atualizar dados locais
 	_, err = database.DB.Exec(r.Context(),
-		"UPDATE users SET email=$1, role=$2, name=$3, updated_at=NOW() WHERE id=$4",
-		p.Email, p.Role, p.Name, id)
+		"UPDATE users SET email=$1, name=$2, updated_at=NOW() WHERE id=$3",
+		p.Email, p.Name, id)
 
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Erro ao atualizar usuário: %v", err), http.StatusInternalServerError)
@@ -256,5 +192,123 @@ func DeactivateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// O middleware já recusa usuários inativos; revogar evita que os tokens
+	// voltem a valer numa reativação
+	if err := middleware.RevokeAllSessions(r.Context(), int64(id), middleware.RevokedByDeactivate); err != nil {
+		log.Printf("ERROR: Could not revoke sessions of deactivated user %d: %v", id, err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SetUserQuota define a cota de domínios de um usuário Admin, tornando-o
+// revendedor. domain_quota nulo remove a revenda, desde que não haja subcontas.
+func SetUserQuota(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "ID de usuário inválido", http.StatusBadRequest)
+		return
+	}
+
+	var p struct {
+		DomainQuota *int `json:"domain_quota"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, "Corpo da requisição inválido", http.StatusBadRequest)
+		return
+	}
+	if p.DomainQuota != nil && *p.DomainQuota < 0 {
+		http.Error(w, "A cota não pode ser negativa", http.StatusBadRequest)
+		return
+	}
+
+	var role int
+	var parentID *int64
+	var subAccounts int
+	err = database.DB.QueryRow(r.Context(),
+		"SELECT role, parent_id, (SELECT COUNT(*) FROM users WHERE parent_id = $1) FROM users WHERE id = $1", id).
+		Scan(&role, &parentID, &subAccounts)
+	if err != nil {
+		http.Error(w, "Usuário não encontrado", http.StatusNotFound)
+		return
+	}
+	switch {
+	case role != 2:
+		http.Error(w, "Apenas usuários Admin podem ser revendedores", http.StatusConflict)
+		return
+	case parentID != nil:
+		http.Error(w, "Subcontas não podem ser revendedoras", http.StatusConflict)
+		return
+	case p.DomainQuota == nil && subAccounts > 0:
+		http.Error(w, "O revendedor ainda possui subcontas", http.StatusConflict)
+		return
+	}
+
+	if _, err := database.DB.Exec(r.Context(), "UPDATE users SET domain_quota = $1, updated_at = NOW() WHERE id = $2", p.DomainQuota, id); err != nil {
+		http.Error(w, fmt.Sprintf("Erro ao atualizar cota: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": id, "domain_quota": p.DomainQuota})
+}
+
+// ResetUserMFA remove o segundo fator de um usuário que perdeu o aparelho e
+// os códigos de recuperação. No próximo login ele cadastra um novo (o
+// Superadmin é obrigado a isso).
+func ResetUserMFA(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "ID de usuário inválido", http.StatusBadRequest)
+		return
+	}
+
+	var exists bool
+	if err := database.DB.QueryRow(r.Context(), "SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)", id).Scan(&exists); err != nil || !exists {
+		http.Error(w, "Usuário não encontrado", http.StatusNotFound)
+		return
+	}
+	if err := middleware.ResetMFA(r.Context(), id); err != nil {
+		http.Error(w, fmt.Sprintf("Erro ao remover o segundo fator: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListUserSessions lista as sessões de login do usuário {id}.
+func ListUserSessions(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "ID de usuário inválido", http.StatusBadRequest)
+		return
+	}
+
+	list, err := middleware.ListSessions(r.Context(), id, "")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Erro ao buscar sessões: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// RevokeUserSessions encerra todas as sessões do usuário {id}, inclusive as
+// personificações abertas por ele. Chaves de API continuam valendo.
+func RevokeUserSessions(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "ID de usuário inválido", http.StatusBadRequest)
+		return
+	}
+
+	var exists bool
+	if err := database.DB.QueryRow(r.Context(), "SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)", id).Scan(&exists); err != nil || !exists {
+		http.Error(w, "Usuário não encontrado", http.StatusNotFound)
+		return
+	}
+	if err := middleware.RevokeAllSessions(r.Context(), id, middleware.RevokedBySuperadmin); err != nil {
+		http.Error(w, fmt.Sprintf("Erro ao encerrar as sessões: %v", err), http.StatusInternalServerError)
+		return
+	}
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -0,0 +1,123 @@
+package superadmin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"CDNProxy_v2/backend/database"
+	"CDNProxy_v2/backend/middleware"
+	"CDNProxy_v2/backend/services/wallet"
+
+	"github.com/gorilla/mux"
+)
+
+// UserWallet é a carteira de um usuário com uma página do extrato.
+type UserWallet struct {
+	*wallet.Wallet
+	Entries *wallet.Page `json:"entries"`
+}
+
+// GetUserWallet devolve o saldo da carteira do usuário {id} e o extrato,
+// paginado por limit e before_id.
+func GetUserWallet(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "ID de usuário inválido", http.StatusBadRequest)
+		return
+	}
+	q := r.URL.Query()
+	var beforeID int64
+	if v := q.Get("before_id"); v != "" {
+		if beforeID, err = strconv.ParseInt(v, 10, 64); err != nil || beforeID < 1 {
+			http.Error(w, "Parâmetro before_id inválido", http.StatusBadRequest)
+			return
+		}
+	}
+	limit := wallet.DefaultLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "Parâmetro limit inválido", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, wallet.MaxLimit)
+	}
+
+	var exists bool
+	if err := database.DB.QueryRow(r.Context(), "SELECT EXISTS (SELECT 1 FROM public.users WHERE id = $1)", userID).Scan(&exists); err != nil {
+		http.Error(w, "Erro ao consultar o usuário", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Usuário não encontrado", http.StatusNotFound)
+		return
+	}
+
+	uw := UserWallet{}
+	if uw.Wallet, err = wallet.Get(r.Context(), userID); err != nil {
+		http.Error(w, "Erro ao consultar a carteira", http.StatusInternalServerError)
+		return
+	}
+	if uw.Entries, err = wallet.Statement(r.Context(), userID, beforeID, limit); err != nil {
+		http.Error(w, "Erro ao consultar o extrato", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(uw)
+}
+
+// CreateWalletAdjustment lança na carteira do usuário {id} um crédito
+// (amount > 0) ou débito (amount < 0) manual, com o motivo em description.
+// Corpo: {"amount": -10.5, "description": "Estorno do pedido #12"}. Um débito
+// maior que o saldo responde 409.
+func CreateWalletAdjustment(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "ID de usuário inválido", http.StatusBadRequest)
+		return
+	}
+	actorID, ok := r.Context().Value(middleware.UserIDKey).(int64)
+	if !ok {
+		http.Error(w, "User ID not found in context", http.StatusUnauthorized)
+		return
+	}
+
+	var body struct {
+		Amount      float64 `json:"amount"`
+		Description string  `json:"description"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Corpo da requisição inválido", http.StatusBadRequest)
+		return
+	}
+	body.Description = strings.TrimSpace(body.Description)
+	if !wallet.ValidAmount(body.Amount) {
+		http.Error(w, "amount deve ser diferente de zero e ter no máximo 2 casas decimais", http.StatusBadRequest)
+		return
+	}
+	if body.Description == "" {
+		http.Error(w, "description é obrigatório", http.StatusBadRequest)
+		return
+	}
+
+	entry, err := wallet.Adjust(r.Context(), userID, body.Amount, body.Description, actorID)
+	switch {
+	case errors.Is(err, wallet.ErrInsufficientFunds):
+		http.Error(w, "Saldo insuficiente para o débito", http.StatusConflict)
+		return
+	case isPgError(err, "23503"):
+		http.Error(w, "Usuário não encontrado", http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, "Erro ao lançar o ajuste", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(entry)
+}
@@ -0,0 +1,81 @@
+package webhook
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+
+	"CDNProxy_v2/backend/services/metrics"
+	"CDNProxy_v2/backend/services/payments"
+)
+
+// maxNotificationBody limita o corpo gravado de cada notificação.
+const maxNotificationBody = 64 << 10
+
+// NewPaymentHandler recebe as notificações do provedor de pagamento p. Toda
+// notificação é gravada em mercadopago_notifications com o nome do provedor;
+// as que p.ParseWebhook não consegue verificar ficam como "rejected" e
+// recebem 401. As válidas são processadas na hora; falhas de consulta ao
+// provedor ou ao banco respondem 500 para que o provedor reenvie.
+func NewPaymentHandler(p payments.Provider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(io.LimitReader(r.Body, maxNotificationBody))
+		ev, sigErr := p.ParseWebhook(r, body)
+		if ev == nil {
+			ev = &payments.WebhookEvent{}
+		}
+		n := &payments.Notification{
+			Provider:   p.Name(),
+			Payload:    body,
+			Query:      r.URL.RawQuery,
+			RequestID:  ev.RequestID,
+			Topic:      ev.Topic,
+			ResourceID: ev.ResourceID,
+			Status:     payments.NotificationReceived,
+		}
+		if sigErr != nil {
+			msg := sigErr.Error()
+			n.Status, n.Error = payments.NotificationRejected, &msg
+		}
+		n.SignatureValid = sigErr == nil
+
+		if err := payments.SaveNotification(r.Context(), n); err != nil {
+			log.Printf("ERROR: Could not store %s notification: %v", p.Name(), err)
+			metrics.ObserveWebhook(p.Name(), "db_error")
+			http.Error(w, "Failed to store notification", http.StatusInternalServerError)
+			return
+		}
+
+		if sigErr != nil {
+			if errors.Is(sigErr, payments.ErrSecretNotConfigured) {
+				log.Printf("ERROR: %s notification %d rejected: %v", p.Name(), n.ID, sigErr)
+			}
+			metrics.ObserveWebhook(p.Name(), "rejected")
+			http.Error(w, sigErr.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		processed, err := payments.ProcessNotification(r.Context(), n.ID)
+		if err != nil {
+			log.Printf("ERROR: Could not process %s notification %d: %v", p.Name(), n.ID, err)
+			metrics.ObserveWebhook(p.Name(), "db_error")
+			http.Error(w, "Failed to process notification", http.StatusInternalServerError)
+			return
+		}
+		metrics.ObserveWebhook(p.Name(), processed.Status)
+		if processed.Status == payments.NotificationFailed {
+			log.Printf("ERROR: %s notification %d failed: %s", p.Name(), n.ID, derefString(processed.Error))
+			http.Error(w, "Failed to process notification", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func derefString(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
@@ -17,6 +18,13 @@ import (
 	"CDNProxy_v2/backend/handlers/superadmin"
 	"CDNProxy_v2/backend/handlers/webhook"
 	"CDNProxy_v2/backend/middleware"
+	"CDNProxy_v2/backend/services/accesslogs"
+	"CDNProxy_v2/backend/services/invoices"
+	"CDNProxy_v2/backend/services/mercadopago"
+	"CDNProxy_v2/backend/services/metrics"
+	"CDNProxy_v2/backend/services/payments"
+	"CDNProxy_v2/backend/services/requestlog"
+	"CDNProxy_v2/backend/services/stripe"
 
 	"github.com/gorilla/mux"
 )
@@ -29,11 +37,44 @@ func main() {
 	}
 	time.Local = loc
 	// Carrega a configuração no início
-	_, err = config.LoadConfig()
+	cfg, err := config.LoadConfig()
 	if err != nil {
 		log.Fatalf("Error loading config: %v", err)
 	}
 
+	// Define quais proxies podem informar o IP real do cliente
+	if err := middleware.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+
+	// Limites de tentativas de login, recuperação de senha e segundo fator
+	middleware.SetLoginThrottle(middleware.LoginThrottleConfig{
+		EmailFailures: cfg.LockoutEmailFailures,
+		IPFailures:    cfg.LockoutIPFailures,
+		BaseLockout:   time.Duration(cfg.LockoutBaseSeconds) * time.Second,
+		MaxLockout:    time.Duration(cfg.LockoutMaxMinutes) * time.Minute,
+		Window:        time.Duration(cfg.LockoutWindowMinutes) * time.Minute,
+	})
+
+	// Backend de autenticação (Supabase ou local)
+	if err := setupAuthenticator(cfg); err != nil {
+		log.Fatalf("Error configuring authentication: %v", err)
+	}
+
+	// Log de requisições do proxy (Common/Combined, W3C ou JSON)
+	if err := requestlog.Setup(requestlog.Config{
+		Format:     cfg.RequestLogFormat,
+		Outputs:    cfg.RequestLogOutput,
+		MaxSizeMB:  cfg.RequestLogMaxSizeMB,
+		MaxBackups: cfg.RequestLogMaxBackups,
+	}); err != nil {
+		log.Fatalf("Error configuring request log: %v", err)
+	}
+	defer requestlog.Close()
+
+	// Limita quantos domínios ganham séries próprias em /metrics
+	metrics.SetMaxDomainLabels(cfg.MetricsMaxDomainLabels)
+
 	// Conecta ao banco de dados
 	database.ConnectDB()
 	defer database.CloseDB()
@@ -41,20 +82,59 @@ func main() {
 	// Roda as migrações
 	database.RunMigrations()
 
-	// Cria um novo roteador com gorilla/mux
+	// Catálogo de permissões e roles padrão
+	if err := middleware.SeedPermissions(context.Background()); err != nil {
+		log.Fatalf("Error seeding permissions: %v", err)
+	}
+
+	// Partições, rollups e retenção dos logs de acesso
+	accesslogs.StartMaintenance(context.Background(), accesslogs.MaintenanceConfig{
+		RetentionDays:             cfg.AccessLogRetentionDays,
+		HourlyRollupRetentionDays: cfg.HourlyRollupRetentionDays,
+	})
+
+	r := newRouter(cfg)
+	if err := payments.SetDefault(cfg.PaymentProvider); err != nil {
+		log.Fatalf("PAYMENT_PROVIDER %q: %v (disponíveis: %v)", cfg.PaymentProvider, err, payments.Names())
+	}
+	if err := admin.SetPixExpiration(time.Duration(cfg.PixExpirationMinutes) * time.Minute); err != nil {
+		log.Fatalf("PIX_EXPIRATION_MINUTES: %v", err)
+	}
+	invoices.SetEmailReceipts(cfg.InvoiceEmailEnabled)
+
+	// Renovação automática dos domínios com o saldo das carteiras
+	payments.StartAutoRenew(context.Background(), payments.AutoRenewConfig{
+		DaysBefore: cfg.WalletAutoRenewDays,
+		Interval:   time.Hour,
+	})
+
+	server := &http.Server{
+		Addr:      ":8080",
+		Handler:   middleware.CORSMiddleware(r),
+		ConnState: metrics.TrackConnState,
+	}
+
+	log.Println("Servidor Go iniciado na porta :8080")
+	if err := server.ListenAndServe(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// newRouter monta todas as rotas da API e do proxy.
+func newRouter(cfg *config.Config) *mux.Router {
 	r := mux.NewRouter()
+	r.Use(middleware.Metrics)
 
 	// Rota de Status
 	r.HandleFunc("/api/status", status.StatusHandler).Methods("GET")
 
-	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		host := r.Host
-		if strings.Contains(host, ":") {
-			host = strings.Split(host, ":")[0]
-		}
+	// Métricas Prometheus (apenas nos hosts da API, para não encobrir caminhos
+	// dos domínios de streaming)
+	r.Handle("/metrics", metrics.Handler(cfg.MetricsToken)).Methods("GET").
+		MatcherFunc(func(r *http.Request, _ *mux.RouteMatch) bool { return isAPIHost(r.Host) })
 
-		if host == "localhost" || host == "127.0.0.1" ||
-			strings.HasPrefix(host, "app.") || strings.HasPrefix(host, "api.") {
+	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if isAPIHost(r.Host) {
 			fmt.Fprintf(w, "API CDN Proxy Online! - Status:200")
 			return
 		}
@@ -63,8 +143,20 @@ func main() {
 	})
 	r.HandleFunc("/auth", login.LoginHandler).Methods("POST")
 	r.HandleFunc("/auth/recover", login.RequestPasswordResetHandler).Methods("POST")
-	r.Handle("/api/auth/me", middleware.SupabaseAuth(http.HandlerFunc(login.MeHandler))).Methods("GET")
-	r.Handle("/api/auth/update_password", middleware.SupabaseAuth(http.HandlerFunc(login.UpdatePasswordHandler))).Methods("PUT", "POST")
+	r.HandleFunc("/auth/reset-password", login.ResetPasswordHandler).Methods("POST")
+	r.HandleFunc("/auth/refresh", login.RefreshHandler).Methods("POST")
+	r.Handle("/api/auth/logout", middleware.Authenticate(http.HandlerFunc(login.LogoutHandler))).Methods("POST")
+	r.Handle("/api/auth/sessions", middleware.Authenticate(http.HandlerFunc(login.ListSessionsHandler))).Methods("GET")
+	r.Handle("/api/auth/sessions/{id}", middleware.Authenticate(http.HandlerFunc(login.RevokeSessionHandler))).Methods("DELETE")
+	r.Handle("/api/auth/me", middleware.Authenticate(http.HandlerFunc(login.MeHandler))).Methods("GET")
+	r.Handle("/api/auth/update_password", middleware.Authenticate(http.HandlerFunc(login.UpdatePasswordHandler))).Methods("PUT", "POST")
+	r.Handle("/api/auth/permissions", middleware.Authenticate(http.HandlerFunc(login.PermissionsHandler))).Methods("GET")
+	r.Handle("/api/auth/mfa", middleware.Authenticate(http.HandlerFunc(login.MFAStatusHandler))).Methods("GET")
+	r.Handle("/api/auth/mfa/enroll", middleware.Authenticate(http.HandlerFunc(login.MFAEnrollHandler))).Methods("POST")
+	r.Handle("/api/auth/mfa/confirm", middleware.Authenticate(http.HandlerFunc(login.MFAConfirmHandler))).Methods("POST")
+	r.Handle("/api/auth/mfa/verify", middleware.Authenticate(http.HandlerFunc(login.MFAVerifyHandler))).Methods("POST")
+	r.Handle("/api/auth/mfa/recovery-codes", middleware.Authenticate(http.HandlerFunc(login.MFARecoveryCodesHandler))).Methods("POST")
+	r.Handle("/api/auth/mfa/disable", middleware.Authenticate(http.HandlerFunc(login.MFADisableHandler))).Methods("POST")
 
 	streamingRouter := r.PathPrefix("/api/streaming").Subrouter()
 	streamingRouter.HandleFunc("/proxy", streaming.ProxyHandler).Methods("GET", "POST")
@@ -76,91 +168,192 @@ func main() {
 	// Rota Pública de Configuração (Logo, Favicon, Nome)
 	r.HandleFunc("/api/public/config", public.GetPublicConfig).Methods("GET")
 
+	// Provedores de pagamento usados pelo checkout, webhooks e reembolsos
+	mpProvider := mercadopago.NewProvider(mercadopago.Config{
+		BaseURL:       cfg.MercadoPagoBaseURL,
+		AccessToken:   cfg.MercadoPagoAccessToken,
+		WebhookSecret: cfg.MercadoPagoWebhookSecret,
+		Currency:      cfg.MercadoPagoCurrency,
+	})
+	payments.Register(mpProvider)
+
 	// Rotas de Checkout e Webhook
-	r.HandleFunc("/api/webhook/mercadopago", webhook.HandleWebhook).Methods("POST")
+	r.HandleFunc("/api/webhook/mercadopago", webhook.NewPaymentHandler(mpProvider)).Methods("POST")
+
+	// O Stripe só é habilitado com STRIPE_SECRET_KEY
+	if cfg.StripeSecretKey != "" {
+		stripeProvider := stripe.NewProvider(stripe.Config{
+			BaseURL:       cfg.StripeBaseURL,
+			SecretKey:     cfg.StripeSecretKey,
+			WebhookSecret: cfg.StripeWebhookSecret,
+			Currency:      cfg.StripeCurrency,
+			Currencies:    strings.Split(cfg.StripeCurrencies, ","),
+		})
+		payments.Register(stripeProvider)
+		r.HandleFunc("/api/webhook/stripe", webhook.NewPaymentHandler(stripeProvider)).Methods("POST")
+	}
 
 	// --- ROTAS DE ADMIN ---
+	// Cada rota exige uma permissão da role do usuário (tabela role_permissions);
+	// as que aceitam chaves de API declaram também o escopo exigido da chave.
+	// As rotas com stepUp exigem segundo fator ativo de qualquer role que as
+	// acesse, mesmo das que não o têm como obrigatório.
+	require := middleware.RequirePermission
+	scope := middleware.RequireScope
+	stepUp := middleware.RequireStepUp
+
 	adminRouter := r.PathPrefix("/api/admin").Subrouter()
-	adminRouter.Use(middleware.SupabaseAuth, middleware.RoleAuthorization("2"))
-	adminRouter.HandleFunc("/dashboard", admin.DashboardHandler).Methods("GET", "OPTIONS")
-	adminRouter.HandleFunc("/dashboard/data", admin.DashboardDataHandler).Methods("GET", "OPTIONS")
-	adminRouter.HandleFunc("/dashboard/traffic", admin.TrafficChartHandler).Methods("GET", "OPTIONS") // New route
-	adminRouter.HandleFunc("/domains", admin.GetUserDomains).Methods("GET", "OPTIONS")
-	adminRouter.HandleFunc("/domains/{id}", admin.UpdateUserDomain).Methods("PUT", "OPTIONS")
-	adminRouter.HandleFunc("/domains/{id}", admin.DeleteUserDomain).Methods("DELETE", "OPTIONS")
-	adminRouter.HandleFunc("/cart", admin.CartHandler).Methods("GET", "POST", "PUT", "DELETE")
-	adminRouter.HandleFunc("/transactions", admin.TransactionsHandler).Methods("GET")
-	// Novas rotas de domínio para Admin
-	adminRouter.HandleFunc("/domains", admin.GetUserDomains).Methods("GET")
-	adminRouter.HandleFunc("/domains/{id}", admin.UpdateUserDomain).Methods("PUT")
+	adminRouter.Use(middleware.AuthenticateWithAPIKey, middleware.Audit)
+	adminRouter.Handle("/dashboard", require(middleware.PermAccountRead, admin.DashboardHandler)).Methods("GET", "OPTIONS")
+	adminRouter.Handle("/dashboard/data", require(middleware.PermAccountRead, admin.DashboardDataHandler)).Methods("GET", "OPTIONS")
+	adminRouter.Handle("/dashboard/traffic", scope(middleware.ScopeTrafficRead, require(middleware.PermAccountRead, admin.TrafficChartHandler))).Methods("GET", "OPTIONS")
+	adminRouter.Handle("/domains", scope(middleware.ScopeDomainsRead, require(middleware.PermAccountRead, admin.GetUserDomains))).Methods("GET", "OPTIONS")
+	adminRouter.Handle("/domains/{id}", scope(middleware.ScopeDomainsWrite, require(middleware.PermAccountWrite, admin.UpdateUserDomain))).Methods("PUT", "OPTIONS")
+	adminRouter.Handle("/domains/{id}", scope(middleware.ScopeDomainsWrite, require(middleware.PermAccountWrite, admin.DeleteUserDomain))).Methods("DELETE", "OPTIONS")
+	adminRouter.Handle("/cart", require(middleware.PermAccountRead, admin.CartHandler)).Methods("GET")
+	adminRouter.Handle("/cart", require(middleware.PermAccountWrite, admin.CartHandler)).Methods("POST", "PUT", "DELETE")
+	adminRouter.Handle("/cart/coupon", require(middleware.PermAccountRead, admin.GetCartCoupon)).Methods("GET")
+	adminRouter.Handle("/cart/coupon", require(middleware.PermAccountWrite, admin.ApplyCartCoupon)).Methods("POST")
+	adminRouter.Handle("/cart/coupon", require(middleware.PermAccountWrite, admin.RemoveCartCoupon)).Methods("DELETE")
+	adminRouter.Handle("/checkout", require(middleware.PermAccountWrite, admin.CreateCheckoutSession)).Methods("POST")
+	adminRouter.Handle("/payments/{id}", scope(middleware.ScopeBillingRead, require(middleware.PermAccountRead, admin.GetPaymentStatus))).Methods("GET")
+	adminRouter.Handle("/checkout/pix", require(middleware.PermAccountWrite, admin.CreatePixCharge)).Methods("POST")
+	adminRouter.Handle("/payments/{id}/pix", scope(middleware.ScopeBillingRead, require(middleware.PermAccountRead, admin.GetPixCharge))).Methods("GET")
+	adminRouter.Handle("/payments/{id}/pix/qrcode.png", scope(middleware.ScopeBillingRead, require(middleware.PermAccountRead, admin.GetPixQRCode))).Methods("GET")
+	adminRouter.Handle("/payments/{id}/invoice", scope(middleware.ScopeBillingRead, require(middleware.PermAccountRead, admin.GetPaymentInvoice))).Methods("GET")
+	adminRouter.Handle("/payments/{id}/invoice.pdf", scope(middleware.ScopeBillingRead, require(middleware.PermAccountRead, admin.GetPaymentInvoicePDF))).Methods("GET")
+	adminRouter.Handle("/domains/{id}/subscription", require(middleware.PermAccountWrite, admin.CreateDomainSubscription)).Methods("POST")
+	adminRouter.Handle("/subscriptions", scope(middleware.ScopeBillingRead, require(middleware.PermAccountRead, admin.ListSubscriptions))).Methods("GET")
+	adminRouter.Handle("/subscriptions/{id}", scope(middleware.ScopeBillingRead, require(middleware.PermAccountRead, admin.GetSubscription))).Methods("GET")
+	adminRouter.Handle("/subscriptions/{id}/cancel", require(middleware.PermAccountWrite, admin.CancelSubscription)).Methods("POST")
+	adminRouter.Handle("/wallet", scope(middleware.ScopeBillingRead, require(middleware.PermAccountRead, admin.GetWallet))).Methods("GET")
+	adminRouter.Handle("/wallet", require(middleware.PermAccountWrite, admin.UpdateWallet)).Methods("PUT")
+	adminRouter.Handle("/wallet/entries", scope(middleware.ScopeBillingRead, require(middleware.PermAccountRead, admin.GetWalletEntries))).Methods("GET")
+	adminRouter.Handle("/wallet/top-up", require(middleware.PermAccountWrite, admin.CreateWalletTopUp)).Methods("POST")
+	adminRouter.Handle("/transactions", scope(middleware.ScopeBillingRead, require(middleware.PermAccountRead, admin.TransactionsHandler))).Methods("GET")
+	adminRouter.Handle("/access-logs", scope(middleware.ScopeTrafficRead, require(middleware.PermAccountRead, admin.AccessLogsHandler))).Methods("GET")
+	adminRouter.Handle("/access-logs/export", scope(middleware.ScopeTrafficRead, require(middleware.PermAccountRead, admin.ExportAccessLogsHandler))).Methods("GET")
 
 	// Profile routes
-	adminRouter.HandleFunc("/profile", admin.GetProfile).Methods("GET")
-	adminRouter.HandleFunc("/profile", admin.UpdateProfile).Methods("PUT")
+	adminRouter.Handle("/profile", require(middleware.PermAccountRead, admin.GetProfile)).Methods("GET")
+	adminRouter.Handle("/profile", require(middleware.PermAccountWrite, admin.UpdateProfile)).Methods("PUT")
+
+	// Revenda: subcontas, cota de domínios e preços próprios
+	adminRouter.Handle("/reseller", require(middleware.PermAccountRead, admin.GetResellerSummary)).Methods("GET")
+	adminRouter.Handle("/reseller/prices", require(middleware.PermAccountRead, admin.ListResellerPrices)).Methods("GET")
+	adminRouter.Handle("/reseller/prices/{plan_id}", require(middleware.PermAccountWrite, admin.SetResellerPrice)).Methods("PUT")
+	adminRouter.Handle("/reseller/prices/{plan_id}", require(middleware.PermAccountWrite, admin.DeleteResellerPrice)).Methods("DELETE")
+	adminRouter.Handle("/sub-accounts", require(middleware.PermAccountRead, admin.ListSubAccounts)).Methods("GET")
+	adminRouter.Handle("/sub-accounts", require(middleware.PermAccountWrite, admin.CreateSubAccount)).Methods("POST")
+	adminRouter.Handle("/sub-accounts/traffic", scope(middleware.ScopeTrafficRead, require(middleware.PermAccountRead, admin.SubAccountsTrafficHandler))).Methods("GET")
+	adminRouter.Handle("/sub-accounts/{id}", require(middleware.PermAccountWrite, admin.UpdateSubAccount)).Methods("PUT")
+	adminRouter.Handle("/sub-accounts/{id}/domains", scope(middleware.ScopeDomainsWrite, require(middleware.PermAccountWrite, admin.CreateSubAccountDomain))).Methods("POST")
+	adminRouter.Handle("/domains/{id}/owner", scope(middleware.ScopeDomainsWrite, require(middleware.PermAccountWrite, admin.AssignDomainOwner))).Methods("PUT")
+
+	// Chaves de API (apenas com JWT; chaves não gerenciam outras chaves)
+	adminRouter.Handle("/api-keys", require(middleware.PermAccountRead, admin.ListAPIKeys)).Methods("GET")
+	adminRouter.Handle("/api-keys", require(middleware.PermAccountWrite, admin.CreateAPIKey)).Methods("POST")
+	adminRouter.Handle("/api-keys/{id}", require(middleware.PermAccountWrite, admin.RevokeAPIKey)).Methods("DELETE")
 
 	// --- ROTAS DE SUPER ADMIN ---
+	// Acessíveis também às roles intermediárias (suporte, financeiro) conforme
+	// as permissões de cada rota.
 	superAdminRouter := r.PathPrefix("/api/superadmin").Subrouter()
-	superAdminRouter.Use(middleware.SupabaseAuth, middleware.RoleAuthorization("1"))
-	superAdminRouter.HandleFunc("/dashboard", superadmin.DashboardHandler).Methods("GET")
-	superAdminRouter.HandleFunc("/dashboard/data", superadmin.DashboardDataHandler).Methods("GET")
-	superAdminRouter.HandleFunc("/database/status", superadmin.DatabaseStatusHandler).Methods("GET")
-	superAdminRouter.HandleFunc("/database/clean", superadmin.DatabaseCleanHandler).Methods("POST")
-	superAdminRouter.HandleFunc("/payments", superadmin.PaymentsHandler).Methods("GET", "POST")
-	superAdminRouter.HandleFunc("/payments/{id}", superadmin.PaymentHandler).Methods("GET", "PUT", "DELETE")
-	superAdminRouter.HandleFunc("/mail", superadmin.MailHandler).Methods("POST")
-	superAdminRouter.HandleFunc("/cloudflare/config", superadmin.CloudflareConfigHandler).Methods("GET", "PUT")
-	superAdminRouter.HandleFunc("/cloudflare/zones", superadmin.ListZonesHandler).Methods("GET")
-	superAdminRouter.HandleFunc("/cloudflare/zones", superadmin.CreateZoneHandler).Methods("POST")
-	superAdminRouter.HandleFunc("/cloudflare/zones/{id}", superadmin.GetZoneDetailsHandler).Methods("GET")
-	superAdminRouter.HandleFunc("/cloudflare/zones/{id}/dns_records", superadmin.ListDNSRecordsHandler).Methods("GET")
-	superAdminRouter.HandleFunc("/cloudflare/zones/{id}/dns_records", superadmin.CreateDNSRecordHandler).Methods("POST")
-	superAdminRouter.HandleFunc("/cloudflare/zones/{id}/dns_records/{record_id}", superadmin.UpdateDNSRecordHandler).Methods("PUT")
-	superAdminRouter.HandleFunc("/cloudflare/zones/{id}/dns_records/{record_id}", superadmin.DeleteDNSRecordHandler).Methods("DELETE")
-	superAdminRouter.HandleFunc("/configuration", superadmin.ConfigurationHandler).Methods("GET", "PUT")
-	superAdminRouter.HandleFunc("/general_config", superadmin.GeneralConfigHandler).Methods("GET", "POST", "PUT", "DELETE")
-	superAdminRouter.HandleFunc("/analytics", superadmin.AnalyticsHandler).Methods("GET")
-	superAdminRouter.HandleFunc("/analytics/devices", superadmin.DeviceStatsHandler).Methods("GET")
-	superAdminRouter.HandleFunc("/analytics/streaming-hits", superadmin.StreamingHitsHandler).Methods("GET")
+	superAdminRouter.Use(middleware.Authenticate, middleware.Audit)
+	superAdminRouter.Handle("/dashboard", require(middleware.PermDashboardView, superadmin.DashboardHandler)).Methods("GET")
+	superAdminRouter.Handle("/dashboard/data", require(middleware.PermDashboardView, superadmin.DashboardDataHandler)).Methods("GET")
+	superAdminRouter.Handle("/dashboard/traffic-chart", require(middleware.PermDashboardView, superadmin.TrafficChartHandler)).Methods("GET")
+	superAdminRouter.Handle("/analytics", require(middleware.PermDashboardView, superadmin.AnalyticsHandler)).Methods("GET")
+	superAdminRouter.Handle("/analytics/devices", require(middleware.PermDashboardView, superadmin.DeviceStatsHandler)).Methods("GET")
+	superAdminRouter.Handle("/analytics/streaming-hits", require(middleware.PermDashboardView, superadmin.StreamingHitsHandler)).Methods("GET")
+	superAdminRouter.Handle("/database/status", require(middleware.PermDatabaseManage, superadmin.DatabaseStatusHandler)).Methods("GET")
+	superAdminRouter.Handle("/database/clean", require(middleware.PermDatabaseManage, superadmin.DatabaseCleanHandler)).Methods("POST")
+	superAdminRouter.Handle("/mail", require(middleware.PermMailSend, superadmin.MailHandler)).Methods("POST")
+
+	// Payments
+	superAdminRouter.Handle("/payments", require(middleware.PermPaymentsRead, superadmin.PaymentsHandler)).Methods("GET")
+	superAdminRouter.Handle("/payments", require(middleware.PermPaymentsWrite, superadmin.PaymentsHandler)).Methods("POST")
+	superAdminRouter.Handle("/payments/{id}", require(middleware.PermPaymentsRead, superadmin.PaymentHandler)).Methods("GET")
+	superAdminRouter.Handle("/payments/{id}", require(middleware.PermPaymentsWrite, superadmin.PaymentHandler)).Methods("PUT", "DELETE")
+	superAdminRouter.Handle("/payments/{id}/refund", require(middleware.PermPaymentsWrite, stepUp(superadmin.RefundPayment))).Methods("POST")
+	superAdminRouter.Handle("/payments/{id}/invoice", require(middleware.PermPaymentsRead, superadmin.GetPaymentInvoice)).Methods("GET")
+	superAdminRouter.Handle("/payments/{id}/invoice.pdf", require(middleware.PermPaymentsRead, superadmin.GetPaymentInvoicePDF)).Methods("GET")
+	superAdminRouter.Handle("/users/{id}/wallet", require(middleware.PermPaymentsRead, superadmin.GetUserWallet)).Methods("GET")
+	superAdminRouter.Handle("/users/{id}/wallet/adjustments", require(middleware.PermPaymentsWrite, stepUp(superadmin.CreateWalletAdjustment))).Methods("POST")
 
 	// Plans
-	superAdminRouter.HandleFunc("/plans", superadmin.GetAllPlans).Methods("GET")
-	superAdminRouter.HandleFunc("/plans", superadmin.CreatePlan).Methods("POST")
-	superAdminRouter.HandleFunc("/plans/{id}", superadmin.GetPlan).Methods("GET")
-	superAdminRouter.HandleFunc("/plans/{id}", superadmin.UpdatePlan).Methods("PUT")
-	superAdminRouter.HandleFunc("/plans/{id}", superadmin.DeletePlan).Methods("DELETE")
-	superAdminRouter.HandleFunc("/mercadopago", superadmin.MercadoPagoHandler).Methods("GET", "POST")
-	superAdminRouter.HandleFunc("/dashboard/traffic-chart", superadmin.TrafficChartHandler).Methods("GET")
-	superAdminRouter.HandleFunc("/access-logs", superadmin.GetAccessLogsHandler).Methods("GET") // Nova rota de Monitoring
-	// Novas rotas de domínio para Super Admin
-	superAdminRouter.HandleFunc("/domains", superadmin.GetAllDomains).Methods("GET")
-	superAdminRouter.HandleFunc("/domains", superadmin.CreateDomain).Methods("POST")
-	superAdminRouter.HandleFunc("/domains/{id}", superadmin.GetDomain).Methods("GET")
-	superAdminRouter.HandleFunc("/domains/{id}", superadmin.UpdateDomain).Methods("PUT")
-	superAdminRouter.HandleFunc("/domains/{id}", superadmin.DeleteDomain).Methods("DELETE")
-	superAdminRouter.HandleFunc("/domains/{id}/renew", superadmin.RenewDomain).Methods("POST")
-	superAdminRouter.HandleFunc("/domains/{id}/activate", superadmin.ActivateDomain).Methods("POST")
-	superAdminRouter.HandleFunc("/domains/{id}/deactivate", superadmin.DeactivateDomain).Methods("POST")
+	superAdminRouter.Handle("/plans", require(middleware.PermPlansRead, superadmin.GetAllPlans)).Methods("GET")
+	superAdminRouter.Handle("/plans", require(middleware.PermPlansWrite, superadmin.CreatePlan)).Methods("POST")
+	superAdminRouter.Handle("/plans/{id}", require(middleware.PermPlansRead, superadmin.GetPlan)).Methods("GET")
+	superAdminRouter.Handle("/plans/{id}", require(middleware.PermPlansWrite, superadmin.UpdatePlan)).Methods("PUT")
+	superAdminRouter.Handle("/plans/{id}", require(middleware.PermPlansWrite, superadmin.DeletePlan)).Methods("DELETE")
+	superAdminRouter.Handle("/coupons", require(middleware.PermPlansRead, superadmin.GetAllCoupons)).Methods("GET")
+	superAdminRouter.Handle("/coupons", require(middleware.PermPlansWrite, superadmin.CreateCoupon)).Methods("POST")
+	superAdminRouter.Handle("/coupons/{id}", require(middleware.PermPlansRead, superadmin.GetCoupon)).Methods("GET")
+	superAdminRouter.Handle("/coupons/{id}", require(middleware.PermPlansWrite, superadmin.UpdateCoupon)).Methods("PUT")
+	superAdminRouter.Handle("/coupons/{id}", require(middleware.PermPlansWrite, superadmin.DeleteCoupon)).Methods("DELETE")
+
+	// Configurações e integrações
+	superAdminRouter.Handle("/configuration", require(middleware.PermSettingsRead, superadmin.ConfigurationHandler)).Methods("GET")
+	superAdminRouter.Handle("/configuration", require(middleware.PermSettingsWrite, superadmin.ConfigurationHandler)).Methods("PUT")
+	superAdminRouter.Handle("/general_config", require(middleware.PermSettingsRead, superadmin.GeneralConfigHandler)).Methods("GET")
+	superAdminRouter.Handle("/general_config", require(middleware.PermSettingsWrite, stepUp(superadmin.GeneralConfigHandler))).Methods("POST", "PUT", "DELETE")
+	superAdminRouter.Handle("/mercadopago", require(middleware.PermSettingsRead, superadmin.MercadoPagoHandler)).Methods("GET")
+	superAdminRouter.Handle("/mercadopago", require(middleware.PermSettingsWrite, stepUp(superadmin.MercadoPagoHandler))).Methods("POST")
+	superAdminRouter.Handle("/mercadopago/notifications", require(middleware.PermPaymentsRead, superadmin.ListMercadoPagoNotifications)).Methods("GET")
+	superAdminRouter.Handle("/mercadopago/notifications/{id}/replay", require(middleware.PermPaymentsWrite, superadmin.ReplayMercadoPagoNotification)).Methods("POST")
+	superAdminRouter.Handle("/cloudflare/config", require(middleware.PermSettingsRead, superadmin.CloudflareConfigHandler)).Methods("GET")
+	superAdminRouter.Handle("/cloudflare/config", require(middleware.PermSettingsWrite, stepUp(superadmin.CloudflareConfigHandler))).Methods("PUT")
+	superAdminRouter.Handle("/cloudflare/zones", require(middleware.PermCloudflare, superadmin.ListZonesHandler)).Methods("GET")
+	superAdminRouter.Handle("/cloudflare/zones", require(middleware.PermCloudflare, superadmin.CreateZoneHandler)).Methods("POST")
+	superAdminRouter.Handle("/cloudflare/zones/{id}", require(middleware.PermCloudflare, superadmin.GetZoneDetailsHandler)).Methods("GET")
+	superAdminRouter.Handle("/cloudflare/zones/{id}/dns_records", require(middleware.PermCloudflare, superadmin.ListDNSRecordsHandler)).Methods("GET")
+	superAdminRouter.Handle("/cloudflare/zones/{id}/dns_records", require(middleware.PermCloudflare, superadmin.CreateDNSRecordHandler)).Methods("POST")
+	superAdminRouter.Handle("/cloudflare/zones/{id}/dns_records/{record_id}", require(middleware.PermCloudflare, superadmin.UpdateDNSRecordHandler)).Methods("PUT")
+	superAdminRouter.Handle("/cloudflare/zones/{id}/dns_records/{record_id}", require(middleware.PermCloudflare, superadmin.DeleteDNSRecordHandler)).Methods("DELETE")
+
+	// Access logs
+	superAdminRouter.Handle("/access-logs", require(middleware.PermLogsRead, superadmin.GetAccessLogsHandler)).Methods("GET")
+	superAdminRouter.Handle("/access-logs/search", require(middleware.PermLogsRead, superadmin.SearchAccessLogsHandler)).Methods("GET")
+	superAdminRouter.Handle("/access-logs/export", require(middleware.PermLogsRead, superadmin.ExportAccessLogsHandler)).Methods("GET")
+
+	// Domains
+	superAdminRouter.Handle("/domains", require(middleware.PermDomainsRead, superadmin.GetAllDomains)).Methods("GET")
+	superAdminRouter.Handle("/domains", require(middleware.PermDomainsWrite, superadmin.CreateDomain)).Methods("POST")
+	superAdminRouter.Handle("/domains/{id}", require(middleware.PermDomainsRead, superadmin.GetDomain)).Methods("GET")
+	superAdminRouter.Handle("/domains/{id}", require(middleware.PermDomainsWrite, superadmin.UpdateDomain)).Methods("PUT")
+	superAdminRouter.Handle("/domains/{id}", require(middleware.PermDomainsWrite, superadmin.DeleteDomain)).Methods("DELETE")
+	superAdminRouter.Handle("/domains/{id}/renew", require(middleware.PermDomainsWrite, superadmin.RenewDomain)).Methods("POST")
+	superAdminRouter.Handle("/domains/{id}/activate", require(middleware.PermDomainsWrite, superadmin.ActivateDomain)).Methods("POST")
+	superAdminRouter.Handle("/domains/{id}/deactivate", require(middleware.PermDomainsWrite, superadmin.DeactivateDomain)).Methods("POST")
 
 	// User management routes
-	superAdminRouter.HandleFunc("/users", superadmin.GetAllUsers).Methods("GET")
-	superAdminRouter.HandleFunc("/users", superadmin.CreateUser).Methods("POST")
-	superAdminRouter.HandleFunc("/users/{id}", superadmin.UpdateUser).Methods("PUT")
-	superAdminRouter.HandleFunc("/users/{id}/activate", superadmin.ActivateUser).Methods("POST")
-	superAdminRouter.HandleFunc("/users/{id}/deactivate", superadmin.DeactivateUser).Methods("POST")
+	superAdminRouter.Handle("/users", require(middleware.PermUsersRead, superadmin.GetAllUsers)).Methods("GET")
+	superAdminRouter.Handle("/users", require(middleware.PermUsersWrite, superadmin.CreateUser)).Methods("POST")
+	superAdminRouter.Handle("/users/{id}", require(middleware.PermUsersWrite, superadmin.UpdateUser)).Methods("PUT")
+	superAdminRouter.Handle("/users/{id}/activate", require(middleware.PermUsersWrite, superadmin.ActivateUser)).Methods("POST")
+	superAdminRouter.Handle("/users/{id}/deactivate", require(middleware.PermUsersWrite, superadmin.DeactivateUser)).Methods("POST")
+	superAdminRouter.Handle("/users/{id}/mfa", require(middleware.PermUsersWrite, stepUp(superadmin.ResetUserMFA))).Methods("DELETE")
+	superAdminRouter.Handle("/users/{id}/quota", require(middleware.PermUsersWrite, superadmin.SetUserQuota)).Methods("PUT")
+	superAdminRouter.Handle("/users/{id}/role", require(middleware.PermRolesManage, superadmin.AssignUserRole)).Methods("PUT")
+	superAdminRouter.Handle("/roles", require(middleware.PermUsersRead, superadmin.ListRoles)).Methods("GET")
+	superAdminRouter.Handle("/audit-log", require(middleware.PermAuditRead, superadmin.AuditLogHandler)).Methods("GET")
+	superAdminRouter.Handle("/users/{id}/sessions", require(middleware.PermUsersRead, superadmin.ListUserSessions)).Methods("GET")
+	superAdminRouter.Handle("/users/{id}/sessions", require(middleware.PermUsersWrite, superadmin.RevokeUserSessions)).Methods("DELETE")
+	superAdminRouter.Handle("/auth/lockouts", require(middleware.PermUsersRead, superadmin.ListAuthLockouts)).Methods("GET")
+	superAdminRouter.Handle("/auth/lockouts/{id}", require(middleware.PermUsersWrite, superadmin.UnlockAuthLockout)).Methods("DELETE")
+	superAdminRouter.Handle("/auth/failures", require(middleware.PermUsersRead, superadmin.ListAuthFailures)).Methods("GET")
+	superAdminRouter.Handle("/users/{id}/impersonate", require(middleware.PermImpersonate, superadmin.StartImpersonation)).Methods("POST")
+	superAdminRouter.Handle("/impersonations", require(middleware.PermImpersonate, superadmin.ListImpersonations)).Methods("GET")
+	superAdminRouter.Handle("/impersonations/{id}", require(middleware.PermImpersonate, superadmin.EndImpersonation)).Methods("DELETE")
 
 	// Traffic routes
-	superAdminRouter.HandleFunc("/traffic", superadmin.GetAllTraffic).Methods("GET")
-	superAdminRouter.HandleFunc("/traffic/{id}", superadmin.GetTraffic).Methods("GET")
-	superAdminRouter.HandleFunc("/traffic/reset", superadmin.ResetTrafficHandler).Methods("POST")
+	superAdminRouter.Handle("/traffic", require(middleware.PermTrafficRead, superadmin.GetAllTraffic)).Methods("GET")
+	superAdminRouter.Handle("/traffic/{id}", require(middleware.PermTrafficRead, superadmin.GetTraffic)).Methods("GET")
+	superAdminRouter.Handle("/traffic/reset", require(middleware.PermTrafficWrite, superadmin.ResetTrafficHandler)).Methods("POST")
 
 	r.PathPrefix("/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		host := r.Host
-		if strings.Contains(host, ":") {
-			host = strings.Split(host, ":")[0]
-		}
-
-		if host == "localhost" || host == "127.0.0.1" ||
-			strings.HasPrefix(host, "app.") || strings.HasPrefix(host, "api.") {
+		if isAPIHost(r.Host) {
 			http.NotFound(w, r)
 			return
 		}
@@ -168,8 +361,54 @@ func main() {
 		streaming.DomainProxyHandler(w, r)
 	})
 
-	log.Println("Servidor Go iniciado na porta :8080")
-	if err := http.ListenAndServe(":8080", middleware.CORSMiddleware(r)); err != nil {
-		log.Fatal(err)
+	return r
+}
+
+// setupAuthenticator escolhe o backend de autenticação conforme AUTH_PROVIDER.
+func setupAuthenticator(cfg *config.Config) error {
+	switch strings.ToLower(cfg.AuthProvider) {
+	case "local":
+		auth, err := middleware.NewLocalAuthenticator(middleware.LocalAuthConfig{
+			Secret:          cfg.AuthJWTSecret,
+			Issuer:          cfg.AuthJWTIssuer,
+			TokenTTL:        time.Duration(cfg.AuthTokenTTLMinutes) * time.Minute,
+			RefreshTokenTTL: time.Duration(cfg.AuthRefreshTTLDays) * 24 * time.Hour,
+		})
+		if err != nil {
+			return err
+		}
+		middleware.SetAuthenticator(auth)
+		log.Println("Autenticação: modo local (bcrypt + JWT próprio)")
+	case "supabase", "":
+		if cfg.SupabaseJWTSigningKey == "" {
+			log.Println("WARNING: SUPABASE_JWT_SIGNING_KEY not configured, protected routes will fail")
+			return nil
+		}
+		auth := middleware.NewSupabaseAuthenticator(middleware.SupabaseAuthConfig{
+			URL:            cfg.SupabaseURL,
+			APIKey:         cfg.SupabaseAPIKey,
+			ServiceRoleKey: cfg.SupabaseServiceRoleKey,
+			JWKSURL:        cfg.SupabaseJWTSigningKey,
+			Issuer:         cfg.SupabaseJWTIssuer,
+			Audience:       cfg.SupabaseJWTAudience,
+			JWKS: middleware.JWKSOptions{
+				RefreshInterval: time.Duration(cfg.JWKSRefreshMinutes) * time.Minute,
+			},
+		})
+		auth.Start(context.Background())
+		middleware.SetAuthenticator(auth)
+	default:
+		return fmt.Errorf("unknown AUTH_PROVIDER %q (use supabase or local)", cfg.AuthProvider)
+	}
+	return nil
+}
+
+// isAPIHost indica se o host é o da própria API/painel (e não um domínio de streaming).
+func isAPIHost(host string) bool {
+	if strings.Contains(host, ":") {
+		host = strings.Split(host, ":")[0]
 	}
+
+	return host == "localhost" || host == "127.0.0.1" ||
+		strings.HasPrefix(host, "app.") || strings.HasPrefix(host, "api.")
 }
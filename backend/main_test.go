@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"CDNProxy_v2/backend/config"
+	"CDNProxy_v2/backend/middleware"
+
+	"github.com/gorilla/mux"
+)
+
+// routeMatrix lista todas as rotas protegidas: a permissão exigida, o escopo
+// aceito de chaves de API e as roles padrão (DefaultRoles) que têm acesso.
+var routeMatrix = []struct {
+	method string
+	path   string
+	perm   string
+	scope  string
+	roles  string
+}{
+	// Admin
+	{"GET", "/api/admin/dashboard", middleware.PermAccountRead, "", "1,2"},
+	{"GET", "/api/admin/dashboard/data", middleware.PermAccountRead, "", "1,2"},
+	{"GET", "/api/admin/dashboard/traffic", middleware.PermAccountRead, middleware.ScopeTrafficRead, "1,2"},
+	{"GET", "/api/admin/domains", middleware.PermAccountRead, middleware.ScopeDomainsRead, "1,2"},
+	{"PUT", "/api/admin/domains/{id}", middleware.PermAccountWrite, middleware.ScopeDomainsWrite, "1,2"},
+	{"DELETE", "/api/admin/domains/{id}", middleware.PermAccountWrite, middleware.ScopeDomainsWrite, "1,2"},
+	{"GET", "/api/admin/cart", middleware.PermAccountRead, "", "1,2"},
+	{"POST", "/api/admin/cart", middleware.PermAccountWrite, "", "1,2"},
+	{"PUT", "/api/admin/cart", middleware.PermAccountWrite, "", "1,2"},
+	{"DELETE", "/api/admin/cart", middleware.PermAccountWrite, "", "1,2"},
+	{"GET", "/api/admin/cart/coupon", middleware.PermAccountRead, "", "1,2"},
+	{"POST", "/api/admin/cart/coupon", middleware.PermAccountWrite, "", "1,2"},
+	{"DELETE", "/api/admin/cart/coupon", middleware.PermAccountWrite, "", "1,2"},
+	{"POST", "/api/admin/checkout", middleware.PermAccountWrite, "", "1,2"},
+	{"GET", "/api/admin/payments/{id}", middleware.PermAccountRead, middleware.ScopeBillingRead, "1,2"},
+	{"POST", "/api/admin/checkout/pix", middleware.PermAccountWrite, "", "1,2"},
+	{"GET", "/api/admin/payments/{id}/pix", middleware.PermAccountRead, middleware.ScopeBillingRead, "1,2"},
+	{"GET", "/api/admin/payments/{id}/pix/qrcode.png", middleware.PermAccountRead, middleware.ScopeBillingRead, "1,2"},
+	{"GET", "/api/admin/payments/{id}/invoice", middleware.PermAccountRead, middleware.ScopeBillingRead, "1,2"},
+	{"GET", "/api/admin/payments/{id}/invoice.pdf", middleware.PermAccountRead, middleware.ScopeBillingRead, "1,2"},
+	{"POST", "/api/admin/domains/{id}/subscription", middleware.PermAccountWrite, "", "1,2"},
+	{"GET", "/api/admin/subscriptions", middleware.PermAccountRead, middleware.ScopeBillingRead, "1,2"},
+	{"GET", "/api/admin/subscriptions/{id}", middleware.PermAccountRead, middleware.ScopeBillingRead, "1,2"},
+	{"POST", "/api/admin/subscriptions/{id}/cancel", middleware.PermAccountWrite, "", "1,2"},
+	{"GET", "/api/admin/wallet", middleware.PermAccountRead, middleware.ScopeBillingRead, "1,2"},
+	{"PUT", "/api/admin/wallet", middleware.PermAccountWrite, "", "1,2"},
+	{"GET", "/api/admin/wallet/entries", middleware.PermAccountRead, middleware.ScopeBillingRead, "1,2"},
+	{"POST", "/api/admin/wallet/top-up", middleware.PermAccountWrite, "", "1,2"},
+	{"GET", "/api/admin/transactions", middleware.PermAccountRead, middleware.ScopeBillingRead, "1,2"},
+	{"GET", "/api/admin/access-logs", middleware.PermAccountRead, middleware.ScopeTrafficRead, "1,2"},
+	{"GET", "/api/admin/access-logs/export", middleware.PermAccountRead, middleware.ScopeTrafficRead, "1,2"},
+	{"GET", "/api/admin/profile", middleware.PermAccountRead, "", "1,2"},
+	{"PUT", "/api/admin/profile", middleware.PermAccountWrite, "", "1,2"},
+	{"GET", "/api/admin/reseller", middleware.PermAccountRead, "", "1,2"},
+	{"GET", "/api/admin/reseller/prices", middleware.PermAccountRead, "", "1,2"},
+	{"PUT", "/api/admin/reseller/prices/{plan_id}", middleware.PermAccountWrite, "", "1,2"},
+	{"DELETE", "/api/admin/reseller/prices/{plan_id}", middleware.PermAccountWrite, "", "1,2"},
+	{"GET", "/api/admin/sub-accounts", middleware.PermAccountRead, "", "1,2"},
+	{"POST", "/api/admin/sub-accounts", middleware.PermAccountWrite, "", "1,2"},
+	{"GET", "/api/admin/sub-accounts/traffic", middleware.PermAccountRead, middleware.ScopeTrafficRead, "1,2"},
+	{"PUT", "/api/admin/sub-accounts/{id}", middleware.PermAccountWrite, "", "1,2"},
+	{"POST", "/api/admin/sub-accounts/{id}/domains", middleware.PermAccountWrite, middleware.ScopeDomainsWrite, "1,2"},
+	{"PUT", "/api/admin/domains/{id}/owner", middleware.PermAccountWrite, middleware.ScopeDomainsWrite, "1,2"},
+	{"GET", "/api/admin/api-keys", middleware.PermAccountRead, "", "1,2"},
+	{"POST", "/api/admin/api-keys", middleware.PermAccountWrite, "", "1,2"},
+	{"DELETE", "/api/admin/api-keys/{id}", middleware.PermAccountWrite, "", "1,2"},
+
+	// Superadmin: dashboard e manutenção
+	{"GET", "/api/superadmin/dashboard", middleware.PermDashboardView, "", "1,3"},
+	{"GET", "/api/superadmin/dashboard/data", middleware.PermDashboardView, "", "1,3"},
+	{"GET", "/api/superadmin/dashboard/traffic-chart", middleware.PermDashboardView, "", "1,3"},
+	{"GET", "/api/superadmin/analytics", middleware.PermDashboardView, "", "1,3"},
+	{"GET", "/api/superadmin/analytics/devices", middleware.PermDashboardView, "", "1,3"},
+	{"GET", "/api/superadmin/analytics/streaming-hits", middleware.PermDashboardView, "", "1,3"},
+	{"GET", "/api/superadmin/database/status", middleware.PermDatabaseManage, "", "1"},
+	{"POST", "/api/superadmin/database/clean", middleware.PermDatabaseManage, "", "1"},
+	{"POST", "/api/superadmin/mail", middleware.PermMailSend, "", "1"},
+
+	// Superadmin: financeiro
+	{"GET", "/api/superadmin/payments", middleware.PermPaymentsRead, "", "1,4"},
+	{"POST", "/api/superadmin/payments", middleware.PermPaymentsWrite, "", "1,4"},
+	{"GET", "/api/superadmin/payments/{id}", middleware.PermPaymentsRead, "", "1,4"},
+	{"PUT", "/api/superadmin/payments/{id}", middleware.PermPaymentsWrite, "", "1,4"},
+	{"DELETE", "/api/superadmin/payments/{id}", middleware.PermPaymentsWrite, "", "1,4"},
+	{"POST", "/api/superadmin/payments/{id}/refund", middleware.PermPaymentsWrite, "", "1,4"},
+	{"GET", "/api/superadmin/payments/{id}/invoice", middleware.PermPaymentsRead, "", "1,4"},
+	{"GET", "/api/superadmin/payments/{id}/invoice.pdf", middleware.PermPaymentsRead, "", "1,4"},
+	{"GET", "/api/superadmin/users/{id}/wallet", middleware.PermPaymentsRead, "", "1,4"},
+	{"POST", "/api/superadmin/users/{id}/wallet/adjustments", middleware.PermPaymentsWrite, "", "1,4"},
+	{"GET", "/api/superadmin/plans", middleware.PermPlansRead, "", "1,4"},
+	{"POST", "/api/superadmin/plans", middleware.PermPlansWrite, "", "1,4"},
+	{"GET", "/api/superadmin/plans/{id}", middleware.PermPlansRead, "", "1,4"},
+	{"PUT", "/api/superadmin/plans/{id}", middleware.PermPlansWrite, "", "1,4"},
+	{"DELETE", "/api/superadmin/plans/{id}", middleware.PermPlansWrite, "", "1,4"},
+	{"GET", "/api/superadmin/coupons", middleware.PermPlansRead, "", "1,4"},
+	{"POST", "/api/superadmin/coupons", middleware.PermPlansWrite, "", "1,4"},
+	{"GET", "/api/superadmin/coupons/{id}", middleware.PermPlansRead, "", "1,4"},
+	{"PUT", "/api/superadmin/coupons/{id}", middleware.PermPlansWrite, "", "1,4"},
+	{"DELETE", "/api/superadmin/coupons/{id}", middleware.PermPlansWrite, "", "1,4"},
+
+	// Superadmin: configurações e integrações
+	{"GET", "/api/superadmin/configuration", middleware.PermSettingsRead, "", "1"},
+	{"PUT", "/api/superadmin/configuration", middleware.PermSettingsWrite, "", "1"},
+	{"GET", "/api/superadmin/general_config", middleware.PermSettingsRead, "", "1"},
+	{"POST", "/api/superadmin/general_config", middleware.PermSettingsWrite, "", "1"},
+	{"PUT", "/api/superadmin/general_config", middleware.PermSettingsWrite, "", "1"},
+	{"DELETE", "/api/superadmin/general_config", middleware.PermSettingsWrite, "", "1"},
+	{"GET", "/api/superadmin/mercadopago", middleware.PermSettingsRead, "", "1"},
+	{"POST", "/api/superadmin/mercadopago", middleware.PermSettingsWrite, "", "1"},
+	{"GET", "/api/superadmin/mercadopago/notifications", middleware.PermPaymentsRead, "", "1,4"},
+	{"POST", "/api/superadmin/mercadopago/notifications/{id}/replay", middleware.PermPaymentsWrite, "", "1,4"},
+	{"GET", "/api/superadmin/cloudflare/config", middleware.PermSettingsRead, "", "1"},
+	{"PUT", "/api/superadmin/cloudflare/config", middleware.PermSettingsWrite, "", "1"},
+	{"GET", "/api/superadmin/cloudflare/zones", middleware.PermCloudflare, "", "1"},
+	{"POST", "/api/superadmin/cloudflare/zones", middleware.PermCloudflare, "", "1"},
+	{"GET", "/api/superadmin/cloudflare/zones/{id}", middleware.PermCloudflare, "", "1"},
+	{"GET", "/api/superadmin/cloudflare/zones/{id}/dns_records", middleware.PermCloudflare, "", "1"},
+	{"POST", "/api/superadmin/cloudflare/zones/{id}/dns_records", middleware.PermCloudflare, "", "1"},
+	{"PUT", "/api/superadmin/cloudflare/zones/{id}/dns_records/{record_id}", middleware.PermCloudflare, "", "1"},
+	{"DELETE", "/api/superadmin/cloudflare/zones/{id}/dns_records/{record_id}", middleware.PermCloudflare, "", "1"},
+
+	// Superadmin: logs, domínios, usuários e tráfego
+	{"GET", "/api/superadmin/access-logs", middleware.PermLogsRead, "", "1,3"},
+	{"GET", "/api/superadmin/access-logs/search", middleware.PermLogsRead, "", "1,3"},
+	{"GET", "/api/superadmin/access-logs/export", middleware.PermLogsRead, "", "1,3"},
+	{"GET", "/api/superadmin/domains", middleware.PermDomainsRead, "", "1,3"},
+	{"POST", "/api/superadmin/domains", middleware.PermDomainsWrite, "", "1"},
+	{"GET", "/api/superadmin/domains/{id}", middleware.PermDomainsRead, "", "1,3"},
+	{"PUT", "/api/superadmin/domains/{id}", middleware.PermDomainsWrite, "", "1"},
+	{"DELETE", "/api/superadmin/domains/{id}", middleware.PermDomainsWrite, "", "1"},
+	{"POST", "/api/superadmin/domains/{id}/renew", middleware.PermDomainsWrite, "", "1"},
+	{"POST", "/api/superadmin/domains/{id}/activate", middleware.PermDomainsWrite, "", "1"},
+	{"POST", "/api/superadmin/domains/{id}/deactivate", middleware.PermDomainsWrite, "", "1"},
+	{"GET", "/api/superadmin/users", middleware.PermUsersRead, "", "1,3"},
+	{"POST", "/api/superadmin/users", middleware.PermUsersWrite, "", "1"},
+	{"PUT", "/api/superadmin/users/{id}", middleware.PermUsersWrite, "", "1"},
+	{"POST", "/api/superadmin/users/{id}/activate", middleware.PermUsersWrite, "", "1"},
+	{"POST", "/api/superadmin/users/{id}/deactivate", middleware.PermUsersWrite, "", "1"},
+	{"DELETE", "/api/superadmin/users/{id}/mfa", middleware.PermUsersWrite, "", "1"},
+	{"PUT", "/api/superadmin/users/{id}/quota", middleware.PermUsersWrite, "", "1"},
+	{"PUT", "/api/superadmin/users/{id}/role", middleware.PermRolesManage, "", "1"},
+	{"GET", "/api/superadmin/roles", middleware.PermUsersRead, "", "1,3"},
+	{"GET", "/api/superadmin/audit-log", middleware.PermAuditRead, "", "1"},
+	{"GET", "/api/superadmin/users/{id}/sessions", middleware.PermUsersRead, "", "1,3"},
+	{"DELETE", "/api/superadmin/users/{id}/sessions", middleware.PermUsersWrite, "", "1"},
+	{"GET", "/api/superadmin/auth/lockouts", middleware.PermUsersRead, "", "1,3"},
+	{"DELETE", "/api/superadmin/auth/lockouts/{id}", middleware.PermUsersWrite, "", "1"},
+	{"GET", "/api/superadmin/auth/failures", middleware.PermUsersRead, "", "1,3"},
+	{"POST", "/api/superadmin/users/{id}/impersonate", middleware.PermImpersonate, "", "1"},
+	{"GET", "/api/superadmin/impersonations", middleware.PermImpersonate, "", "1"},
+	{"DELETE", "/api/superadmin/impersonations/{id}", middleware.PermImpersonate, "", "1"},
+	{"GET", "/api/superadmin/traffic", middleware.PermTrafficRead, "", "1,3"},
+	{"GET", "/api/superadmin/traffic/{id}", middleware.PermTrafficRead, "", "1,3"},
+	{"POST", "/api/superadmin/traffic/reset", middleware.PermTrafficWrite, "", "1"},
+}
+
+var defaultRoleIDs = []string{middleware.RoleSuperadmin, middleware.RoleAdmin, middleware.RoleSupport, middleware.RoleFinance}
+
+type registeredRoute struct {
+	perm, scope string
+	hasPerm     bool
+}
+
+// protectedRoutes percorre o roteador e indexa por "MÉTODO caminho" as rotas
+// sob /api/admin e /api/superadmin.
+func protectedRoutes(t *testing.T) map[string]registeredRoute {
+	t.Helper()
+	routes := map[string]registeredRoute{}
+	err := newRouter(&config.Config{}).Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil || route.GetHandler() == nil {
+			return nil
+		}
+		if !strings.HasPrefix(path, "/api/admin/") && !strings.HasPrefix(path, "/api/superadmin/") {
+			return nil
+		}
+		methods, _ := route.GetMethods()
+		perm, hasPerm := middleware.RoutePermission(route.GetHandler())
+		scope, _ := middleware.RouteScope(route.GetHandler())
+		for _, m := range methods {
+			if m == "OPTIONS" {
+				continue
+			}
+			key := m + " " + path
+			if _, dup := routes[key]; dup {
+				t.Errorf("rota registrada duas vezes: %s", key)
+			}
+			routes[key] = registeredRoute{perm: perm, scope: scope, hasPerm: hasPerm}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return routes
+}
+
+func TestEveryProtectedRouteIsInTheMatrix(t *testing.T) {
+	routes := protectedRoutes(t)
+
+	inMatrix := map[string]bool{}
+	for _, row := range routeMatrix {
+		key := row.method + " " + row.path
+		inMatrix[key] = true
+
+		got, ok := routes[key]
+		switch {
+		case !ok:
+			t.Errorf("%s está na matriz mas não foi registrada", key)
+		case !got.hasPerm:
+			t.Errorf("%s não usa RequirePermission", key)
+		case got.perm != row.perm:
+			t.Errorf("%s exige %q, a matriz diz %q", key, got.perm, row.perm)
+		case got.scope != row.scope:
+			t.Errorf("%s aceita chaves com escopo %q, a matriz diz %q", key, got.scope, row.scope)
+		}
+	}
+
+	for key := range routes {
+		if !inMatrix[key] {
+			t.Errorf("%s foi registrada sem entrada na matriz de permissões", key)
+		}
+	}
+}
+
+func TestDefaultRolesMatchTheMatrix(t *testing.T) {
+	defaults := middleware.DefaultRolePermissions()
+	for _, row := range routeMatrix {
+		allowed := map[string]bool{}
+		for _, role := range strings.Split(row.roles, ",") {
+			allowed[role] = true
+		}
+		for _, role := range defaultRoleIDs {
+			has := false
+			for _, p := range defaults[role] {
+				has = has || p == row.perm
+			}
+			if has != allowed[role] {
+				t.Errorf("%s %s: role %s acesso=%v, a matriz diz %v", row.method, row.path, role, has, allowed[role])
+			}
+		}
+	}
+}
+
+// roleAuthenticator aceita como token o próprio número da role.
+type roleAuthenticator struct{}
+
+func (roleAuthenticator) Authenticate(ctx context.Context, token string) (*middleware.Identity, error) {
+	return &middleware.Identity{UserID: 99, Role: token, Subject: "99"}, nil
+}
+
+func (roleAuthenticator) Login(ctx context.Context, email, password string) (*middleware.Session, error) {
+	return nil, middleware.ErrNotSupported
+}
+
+func (roleAuthenticator) RequestPasswordReset(ctx context.Context, email, redirectTo string) error {
+	return middleware.ErrNotSupported
+}
+
+func (roleAuthenticator) ResetPassword(ctx context.Context, resetToken, password string) error {
+	return middleware.ErrNotSupported
+}
+
+func (roleAuthenticator) SetPassword(ctx context.Context, userID int64, password string) error {
+	return middleware.ErrNotSupported
+}
+
+func (roleAuthenticator) CreateCredentials(ctx context.Context, userID int64, email, password string) error {
+	return middleware.ErrNotSupported
+}
+
+func (roleAuthenticator) Refresh(ctx context.Context, refreshToken string) (*middleware.Session, error) {
+	return nil, middleware.ErrNotSupported
+}
+
+func (roleAuthenticator) Logout(ctx context.Context, accessToken string) error {
+	return middleware.ErrNotSupported
+}
+
+// Sem banco, as permissões vêm de DefaultRolePermissions. As requisições
+// negadas param no middleware com 403; as permitidas não são executadas aqui
+// porque os handlers dependem do banco.
+func TestRolesWithoutPermissionAreForbidden(t *testing.T) {
+	middleware.SetAuthenticator(roleAuthenticator{})
+	t.Cleanup(func() { middleware.SetAuthenticator(nil) })
+
+	router := newRouter(&config.Config{})
+	for _, row := range routeMatrix {
+		for _, role := range defaultRoleIDs {
+			if strings.Contains(","+row.roles+",", ","+role+",") {
+				continue
+			}
+			path := strings.NewReplacer("{id}", "1", "{record_id}", "1").Replace(row.path)
+			req := httptest.NewRequest(row.method, path, nil)
+			req.Host = "api.cdnproxy.top"
+			req.Header.Set("Authorization", "Bearer "+role)
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusForbidden {
+				t.Errorf("%s %s com role %s: esperado 403, recebeu %d", row.method, row.path, role, rr.Code)
+			}
+		}
+	}
+}
+
+func TestUnauthenticatedRequestsAreRejected(t *testing.T) {
+	router := newRouter(&config.Config{})
+	for _, row := range routeMatrix {
+		path := strings.NewReplacer("{id}", "1", "{record_id}", "1").Replace(row.path)
+		req := httptest.NewRequest(row.method, path, nil)
+		req.Host = "api.cdnproxy.top"
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("%s %s sem token: esperado 401, recebeu %d", row.method, row.path, rr.Code)
+		}
+	}
+}
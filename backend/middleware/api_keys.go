@@ -0,0 +1,306 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"CDNProxy_v2/backend/database"
+
+	"github.com/gorilla/mux"
+)
+
+// Escopos aceitos pelas chaves de API.
+const (
+	ScopeDomainsRead  = "domains:read"
+	ScopeDomainsWrite = "domains:write"
+	ScopeTrafficRead  = "traffic:read"
+	ScopeBillingRead  = "billing:read"
+)
+
+// Scopes lista os escopos válidos, na ordem exibida na documentação.
+var Scopes = []string{ScopeDomainsRead, ScopeDomainsWrite, ScopeTrafficRead, ScopeBillingRead}
+
+// APIKeyPrefix inicia toda chave gerada; é o que diferencia uma chave de um
+// JWT no cabeçalho Authorization.
+const APIKeyPrefix = "cdnp_"
+
+// apiKeyDisplayLength é o tamanho do prefixo guardado em claro para a listagem.
+const apiKeyDisplayLength = len(APIKeyPrefix) + 8
+
+// apiKeyTouchInterval limita a gravação de last_used_at a uma por minuto por chave.
+const apiKeyTouchInterval = time.Minute
+
+// APIKey é uma linha de public.api_keys.
+type APIKey struct {
+	ID         int64      `json:"id"`
+	UserID     int64      `json:"user_id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	AllowedIPs []string   `json:"allowed_ips"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	LastUsedIP *string    `json:"last_used_ip"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// HasScope informa se a chave concede scope.
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsIP informa se ip está em allowed_ips. Lista vazia aceita qualquer IP.
+func (k *APIKey) allowsIP(ip string) bool {
+	if len(k.AllowedIPs) == 0 {
+		return true
+	}
+	parsed := parseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	nets, err := parseNetworks(k.AllowedIPs, "allowed IP")
+	if err != nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	errAPIKeyInvalid   = errors.New("invalid API key")
+	errAPIKeyRevoked   = errors.New("API key revoked")
+	errAPIKeyExpired   = errors.New("API key expired")
+	errAPIKeyIPDenied  = errors.New("API key not allowed from this IP")
+	errAPIKeyNoScope   = errors.New("API key lacks the required scope")
+	errAPIKeyNotScoped = errors.New("API keys are not accepted on this route")
+)
+
+// GenerateAPIKey cria uma chave nova. A chave em claro só deve ser mostrada
+// uma vez; no banco ficam o prefixo e o hash.
+func GenerateAPIKey() (key, prefix, hash string, err error) {
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", "", err
+	}
+	key = APIKeyPrefix + hex.EncodeToString(raw)
+	return key, key[:apiKeyDisplayLength], HashAPIKey(key), nil
+}
+
+// HashAPIKey calcula o hash gravado em api_keys.key_hash. As chaves têm 192
+// bits aleatórios, então um SHA-256 sem sal é suficiente.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// NormalizeScopes valida e remove duplicatas de uma lista de escopos.
+func NormalizeScopes(scopes []string) ([]string, error) {
+	seen := make(map[string]bool, len(scopes))
+	out := make([]string, 0, len(scopes))
+	for _, s := range scopes {
+		s = strings.TrimSpace(s)
+		valid := false
+		for _, known := range Scopes {
+			if s == known {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return nil, fmt.Errorf("invalid scope %q", s)
+		}
+		if !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+	if len(out) == 0 {
+		return nil, errors.New("at least one scope is required")
+	}
+	return out, nil
+}
+
+// NormalizeAllowedIPs valida IPs e CIDRs e devolve todos no formato CIDR.
+func NormalizeAllowedIPs(entries []string) ([]string, error) {
+	nets, err := parseNetworks(entries, "allowed IP")
+	if err != nil {
+		return nil, err
+	}
+	out := make([]string, 0, len(nets))
+	for _, n := range nets {
+		out = append(out, n.String())
+	}
+	return out, nil
+}
+
+// apiKeyStore isola o acesso a public.api_keys para os testes.
+type apiKeyStore interface {
+	byHash(ctx context.Context, hash string) (*APIKey, error)
+	touch(ctx context.Context, id int64, ip string, at time.Time) error
+}
+
+type dbAPIKeyStore struct{}
+
+func (dbAPIKeyStore) byHash(ctx context.Context, hash string) (*APIKey, error) {
+	var k APIKey
+	err := database.DB.QueryRow(ctx, `
+		SELECT id, user_id, name, prefix, scopes, allowed_ips, expires_at, last_used_at, last_used_ip, revoked_at, created_at
+		FROM public.api_keys WHERE key_hash = $1`, hash,
+	).Scan(&k.ID, &k.UserID, &k.Name, &k.Prefix, &k.Scopes, &k.AllowedIPs, &k.ExpiresAt, &k.LastUsedAt, &k.LastUsedIP, &k.RevokedAt, &k.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+func (dbAPIKeyStore) touch(ctx context.Context, id int64, ip string, at time.Time) error {
+	_, err := database.DB.Exec(ctx,
+		"UPDATE public.api_keys SET last_used_at = $1, last_used_ip = $2 WHERE id = $3",
+		at, ip, id)
+	return err
+}
+
+// Dependências da autenticação por chave, trocadas nos testes.
+var (
+	apiKeys  apiKeyStore = dbAPIKeyStore{}
+	keyUsers userStore   = dbUserStore{}
+	keyNow               = time.Now
+)
+
+// extractAPIKey lê a chave de X-API-Key ou de "Authorization: Bearer cdnp_...".
+func extractAPIKey(r *http.Request) (string, bool) {
+	if key := strings.TrimSpace(r.Header.Get("X-API-Key")); key != "" {
+		return key, true
+	}
+	if token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); strings.HasPrefix(token, APIKeyPrefix) {
+		return token, true
+	}
+	return "", false
+}
+
+// authenticateAPIKey valida a chave (existência, revogação, validade e IP de
+// origem) e registra o uso.
+func authenticateAPIKey(ctx context.Context, key, ip string) (*APIKey, *authUser, error) {
+	if !strings.HasPrefix(key, APIKeyPrefix) {
+		return nil, nil, errAPIKeyInvalid
+	}
+	k, err := apiKeys.byHash(ctx, HashAPIKey(key))
+	if err != nil {
+		return nil, nil, errAPIKeyInvalid
+	}
+
+	now := keyNow()
+	switch {
+	case k.RevokedAt != nil:
+		return nil, nil, errAPIKeyRevoked
+	case k.ExpiresAt != nil && !now.Before(*k.ExpiresAt):
+		return nil, nil, errAPIKeyExpired
+	case !k.allowsIP(ip):
+		return nil, nil, errAPIKeyIPDenied
+	}
+
+	user, err := keyUsers.byID(ctx, k.UserID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: id %d: %v", ErrUserNotFound, k.UserID, err)
+	}
+	if user.Disabled {
+		return nil, nil, ErrUserDisabled
+	}
+
+	if k.LastUsedAt == nil || now.Sub(*k.LastUsedAt) >= apiKeyTouchInterval {
+		if err := apiKeys.touch(ctx, k.ID, ip, now); err != nil {
+			log.Printf("WARN: Failed to record API key %d usage: %v", k.ID, err)
+		}
+	}
+	return k, user, nil
+}
+
+// AuthenticateWithAPIKey aceita uma chave de API (X-API-Key ou Bearer cdnp_...)
+// e, sem ela, delega para Authenticate. Requisições com chave só chegam a
+// rotas registradas com RequireScope e precisam do escopo da rota; as demais
+// respondem 403.
+func AuthenticateWithAPIKey(next http.Handler) http.Handler {
+	jwtAuth := Authenticate(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, ok := extractAPIKey(r)
+		if !ok {
+			jwtAuth.ServeHTTP(w, r)
+			return
+		}
+
+		k, user, err := authenticateAPIKey(r.Context(), key, ClientIP(r))
+		switch {
+		case errors.Is(err, ErrUserNotFound):
+			log.Printf("ERROR: API key owner lookup failed: %v", err)
+			http.Error(w, "User not found or database error", http.StatusForbidden)
+			return
+		case errors.Is(err, errAPIKeyIPDenied), errors.Is(err, ErrUserDisabled):
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		scope, scoped := routeScope(r)
+		if !scoped {
+			http.Error(w, errAPIKeyNotScoped.Error(), http.StatusForbidden)
+			return
+		}
+		if !k.HasScope(scope) {
+			http.Error(w, fmt.Sprintf("%s: %s", errAPIKeyNoScope, scope), http.StatusForbidden)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), UserIDKey, user.ID)
+		ctx = context.WithValue(ctx, RoleKey, user.identity("").Role)
+		ctx = context.WithValue(ctx, APIKeyKey, k)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// scopedHandler marca uma rota que aceita chaves de API com o escopo indicado.
+type scopedHandler struct {
+	scope string
+	http.Handler
+}
+
+// RequireScope registra o escopo exigido de chaves de API em uma rota; deve
+// ser o handler mais externo da rota. Requisições autenticadas por JWT não são
+// afetadas.
+func RequireScope(scope string, h http.Handler) http.Handler {
+	return scopedHandler{scope: scope, Handler: h}
+}
+
+// routeScope retorna o escopo da rota casada pelo mux, se houver.
+func routeScope(r *http.Request) (string, bool) {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return "", false
+	}
+	return RouteScope(route.GetHandler())
+}
+
+// RouteScope devolve o escopo de um handler registrado com RequireScope.
+func RouteScope(h http.Handler) (string, bool) {
+	s, ok := h.(scopedHandler)
+	return s.scope, ok
+}
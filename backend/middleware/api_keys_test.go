@@ -0,0 +1,238 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// fakeAPIKeyStore é um public.api_keys em memória.
+type fakeAPIKeyStore struct {
+	mu      sync.Mutex
+	keys    map[string]*APIKey
+	touches int
+}
+
+func (s *fakeAPIKeyStore) byHash(ctx context.Context, hash string) (*APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.keys[hash]
+	if !ok {
+		return nil, errNoRows
+	}
+	copy := *k
+	return &copy, nil
+}
+
+func (s *fakeAPIKeyStore) touch(ctx context.Context, id int64, ip string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, k := range s.keys {
+		if k.ID == id {
+			k.LastUsedAt = &at
+			k.LastUsedIP = &ip
+			s.touches++
+		}
+	}
+	return nil
+}
+
+// useAPIKeys instala o cadastro em memória e devolve uma função que cria
+// chaves para o usuário admin (id 2).
+func useAPIKeys(t *testing.T, now time.Time) (*fakeAPIKeyStore, func(k APIKey) string) {
+	t.Helper()
+	store := &fakeAPIKeyStore{keys: map[string]*APIKey{}}
+	prevKeys, prevUsers, prevNow := apiKeys, keyUsers, keyNow
+	apiKeys = store
+	keyUsers = newFakeUserStore(&authUser{ID: 2, Email: "admin@example.com", Role: 2})
+	keyNow = func() time.Time { return now }
+	t.Cleanup(func() { apiKeys, keyUsers, keyNow = prevKeys, prevUsers, prevNow })
+
+	var nextID int64
+	create := func(k APIKey) string {
+		key, prefix, hash, err := GenerateAPIKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		nextID++
+		k.ID, k.UserID, k.Prefix = nextID, 2, prefix
+		store.keys[hash] = &k
+		return key
+	}
+	return store, create
+}
+
+// adminRoutes monta um roteador com uma rota de cada tipo.
+func adminRoutes(seen *APIKey) http.Handler {
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		if k, found := r.Context().Value(APIKeyKey).(*APIKey); found {
+			*seen = *k
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	r := mux.NewRouter()
+	admin := r.PathPrefix("/api/admin").Subrouter()
+	admin.Use(AuthenticateWithAPIKey, RoleAuthorization("2"))
+	admin.Handle("/domains", RequireScope(ScopeDomainsRead, http.HandlerFunc(ok))).Methods("GET")
+	admin.Handle("/domains/{id}", RequireScope(ScopeDomainsWrite, http.HandlerFunc(ok))).Methods("PUT")
+	admin.HandleFunc("/profile", ok).Methods("GET")
+	return r
+}
+
+func TestAPIKeyAuthentication(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	past, future := now.Add(-time.Hour), now.Add(time.Hour)
+	_, create := useAPIKeys(t, now)
+
+	readOnly := create(APIKey{Scopes: []string{ScopeDomainsRead}})
+	revoked := create(APIKey{Scopes: []string{ScopeDomainsRead}, RevokedAt: &past})
+	expired := create(APIKey{Scopes: []string{ScopeDomainsRead}, ExpiresAt: &past})
+	notExpired := create(APIKey{Scopes: []string{ScopeDomainsRead}, ExpiresAt: &future})
+	restricted := create(APIKey{Scopes: []string{ScopeDomainsRead}, AllowedIPs: []string{"203.0.113.0/24"}})
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		header string
+		key    string
+		remote string
+		want   int
+	}{
+		{"escopo correto via X-API-Key", "GET", "/api/admin/domains", "X-API-Key", readOnly, "", http.StatusOK},
+		{"escopo correto via Bearer", "GET", "/api/admin/domains", "Authorization", readOnly, "", http.StatusOK},
+		{"sem o escopo da rota", "PUT", "/api/admin/domains/1", "X-API-Key", readOnly, "", http.StatusForbidden},
+		{"rota sem escopo", "GET", "/api/admin/profile", "X-API-Key", readOnly, "", http.StatusForbidden},
+		{"chave desconhecida", "GET", "/api/admin/domains", "X-API-Key", APIKeyPrefix + "inexistente", "", http.StatusUnauthorized},
+		{"revogada", "GET", "/api/admin/domains", "X-API-Key", revoked, "", http.StatusUnauthorized},
+		{"expirada", "GET", "/api/admin/domains", "X-API-Key", expired, "", http.StatusUnauthorized},
+		{"dentro da validade", "GET", "/api/admin/domains", "X-API-Key", notExpired, "", http.StatusOK},
+		{"IP permitido", "GET", "/api/admin/domains", "X-API-Key", restricted, "203.0.113.7:5000", http.StatusOK},
+		{"IP fora da lista", "GET", "/api/admin/domains", "X-API-Key", restricted, "198.51.100.7:5000", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var seen APIKey
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.remote != "" {
+				req.RemoteAddr = tt.remote
+			}
+			if tt.header == "Authorization" {
+				req.Header.Set("Authorization", "Bearer "+tt.key)
+			} else {
+				req.Header.Set(tt.header, tt.key)
+			}
+			rr := httptest.NewRecorder()
+			adminRoutes(&seen).ServeHTTP(rr, req)
+
+			if rr.Code != tt.want {
+				t.Fatalf("Esperado status %d, recebeu %d (%s)", tt.want, rr.Code, rr.Body.String())
+			}
+			if tt.want == http.StatusOK && seen.ID == 0 {
+				t.Error("a chave deveria estar no contexto")
+			}
+		})
+	}
+}
+
+func TestAPIKeyRecordsUsageOncePerInterval(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	store, create := useAPIKeys(t, now)
+	key := create(APIKey{Scopes: []string{ScopeDomainsRead}})
+
+	call := func() {
+		var seen APIKey
+		req := httptest.NewRequest("GET", "/api/admin/domains", nil)
+		req.RemoteAddr = "198.51.100.9:4000"
+		req.Header.Set("X-API-Key", key)
+		rr := httptest.NewRecorder()
+		adminRoutes(&seen).ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("status %d", rr.Code)
+		}
+	}
+
+	call()
+	call()
+	if store.touches != 1 {
+		t.Fatalf("last_used_at deveria ser gravado uma vez por intervalo, foi gravado %d vezes", store.touches)
+	}
+
+	keyNow = func() time.Time { return now.Add(2 * apiKeyTouchInterval) }
+	call()
+	if store.touches != 2 {
+		t.Errorf("esperado novo registro de uso após o intervalo, houve %d", store.touches)
+	}
+
+	k, _ := store.byHash(context.Background(), HashAPIKey(key))
+	if k.LastUsedIP == nil || *k.LastUsedIP != "198.51.100.9" {
+		t.Errorf("last_used_ip inesperado: %v", k.LastUsedIP)
+	}
+}
+
+func TestAPIKeyRoutesStillAcceptJWT(t *testing.T) {
+	a, _, _ := newTestLocalAuth(t)
+	useAuthenticator(t, a)
+	useAPIKeys(t, time.Now())
+
+	session, err := a.Login(context.Background(), "admin@example.com", "senha-correta")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/api/admin/domains", "/api/admin/profile"} {
+		var seen APIKey
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "Bearer "+session.AccessToken)
+		rr := httptest.NewRecorder()
+		adminRoutes(&seen).ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Errorf("%s: JWT deveria ser aceito, status %d", path, rr.Code)
+		}
+	}
+}
+
+func TestNormalizeScopesAndAllowedIPs(t *testing.T) {
+	scopes, err := NormalizeScopes([]string{"domains:read", " traffic:read", "domains:read"})
+	if err != nil || len(scopes) != 2 {
+		t.Errorf("NormalizeScopes = %v, %v", scopes, err)
+	}
+	for _, invalid := range [][]string{nil, {"domains:delete"}, {""}} {
+		if _, err := NormalizeScopes(invalid); err == nil {
+			t.Errorf("esperado erro para %q", invalid)
+		}
+	}
+
+	ips, err := NormalizeAllowedIPs([]string{"203.0.113.7", "10.0.0.0/8", "2001:db8::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"203.0.113.7/32", "10.0.0.0/8", "2001:db8::1/128"}
+	for i := range want {
+		if ips[i] != want[i] {
+			t.Errorf("ips[%d] = %q, esperado %q", i, ips[i], want[i])
+		}
+	}
+	if _, err := NormalizeAllowedIPs([]string{"não-é-ip"}); err == nil {
+		t.Error("esperado erro para IP inválido")
+	}
+}
+
+func TestGenerateAPIKey(t *testing.T) {
+	key, prefix, hash, err := GenerateAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) != len(APIKeyPrefix)+48 || key[:len(prefix)] != prefix || len(prefix) != apiKeyDisplayLength {
+		t.Errorf("formato inesperado: key=%q prefix=%q", key, prefix)
+	}
+	if hash != HashAPIKey(key) || hash == key {
+		t.Error("hash deve ser o SHA-256 da chave")
+	}
+}
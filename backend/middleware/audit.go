@@ -0,0 +1,385 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"CDNProxy_v2/backend/database"
+
+	"github.com/gorilla/mux"
+)
+
+// AuditEntry é uma linha de public.audit_log.
+type AuditEntry struct {
+	ID         int64           `json:"id"`
+	ActorID    int64           `json:"actor_id"`
+	ActorRole  string          `json:"actor_role"`
+	APIKeyID   *int64          `json:"api_key_id,omitempty"`
+	IP         string          `json:"ip"`
+	Method     string          `json:"method"`
+	Route      string          `json:"route"`
+	Path       string          `json:"path"`
+	TargetType string          `json:"target_type"`
+	TargetID   string          `json:"target_id"`
+	Status     int             `json:"status"`
+	Request    json.RawMessage `json:"request"`
+	Before     json.RawMessage `json:"before"`
+	After      json.RawMessage `json:"after"`
+	Diff       json.RawMessage `json:"diff"`
+	CreatedAt  time.Time       `json:"created_at"`
+
+	// Preenchidos em requisições personificadas: ActorID é o Superadmin e
+	// ImpersonatedID o usuário em nome de quem ele agiu.
+	ImpersonationID *int64 `json:"impersonation_id,omitempty"`
+	ImpersonatedID  *int64 `json:"impersonated_id,omitempty"`
+}
+
+const (
+	// auditBodyLimit limita o corpo da requisição e da resposta guardados.
+	auditBodyLimit = 64 << 10
+	auditRedacted  = "[redacted]"
+)
+
+// auditStore isola public.audit_log e as leituras de estado para os testes.
+type auditStore interface {
+	insert(ctx context.Context, e *AuditEntry) error
+	snapshot(ctx context.Context, query string, args ...any) (json.RawMessage, error)
+}
+
+type dbAuditStore struct{}
+
+func (dbAuditStore) insert(ctx context.Context, e *AuditEntry) error {
+	if database.DB == nil {
+		return errors.New("database not connected")
+	}
+	return database.DB.QueryRow(ctx, `
+		INSERT INTO public.audit_log
+			(actor_id, actor_role, api_key_id, ip, method, route, path, target_type, target_id, status, request, before, after, diff,
+			 impersonation_id, impersonated_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
+		RETURNING id, created_at`,
+		e.ActorID, e.ActorRole, e.APIKeyID, e.IP, e.Method, e.Route, e.Path, e.TargetType, e.TargetID, e.Status,
+		e.Request, e.Before, e.After, e.Diff, e.ImpersonationID, e.ImpersonatedID).Scan(&e.ID, &e.CreatedAt)
+}
+
+func (dbAuditStore) snapshot(ctx context.Context, query string, args ...any) (json.RawMessage, error) {
+	if database.DB == nil {
+		return nil, errors.New("database not connected")
+	}
+	// A subconsulta escalar devolve NULL, em vez de nenhuma linha, se o alvo não existe
+	var out json.RawMessage
+	err := database.DB.QueryRow(ctx, "SELECT ("+query+")", args...).Scan(&out)
+	return out, err
+}
+
+var audits auditStore = dbAuditStore{}
+
+// auditSnapshot lê o estado de um tipo de alvo antes e depois da alteração.
+// A consulta recebe o id do alvo em $1 (a menos que noID) seguido do usuário
+// logado, se byActor.
+type auditSnapshot struct {
+	query   string
+	noID    bool
+	byActor bool
+	// hashSecrets troca valores sensíveis por um hash curto, para que a troca
+	// de uma credencial apareça no diff sem expor o valor.
+	hashSecrets bool
+}
+
+var auditSnapshots = map[string]auditSnapshot{
+	"domains":                   {query: "SELECT to_jsonb(t) FROM public.domains t WHERE t.id = $1"},
+	"users":                     {query: "SELECT to_jsonb(t) - ARRAY['encrypted_password', 'password_digest', 'reset_password_token', 'totp_secret', 'totp_last_step'] FROM public.users t WHERE t.id = $1"},
+	"payments":                  {query: "SELECT to_jsonb(t) FROM public.payments t WHERE t.id = $1"},
+	"plans":                     {query: "SELECT to_jsonb(t) FROM public.plans t WHERE t.id = $1"},
+	"api_keys":                  {query: "SELECT to_jsonb(t) - 'key_hash' FROM public.api_keys t WHERE t.id = $1"},
+	"reseller_prices":           {query: "SELECT to_jsonb(t) FROM public.reseller_prices t WHERE t.plan_id = $1 AND t.reseller_id = $2", byActor: true},
+	"cart":                      {query: "SELECT COALESCE(jsonb_agg(to_jsonb(t) ORDER BY t.id), '[]'::jsonb) FROM public.cart_items t WHERE t.user_id = $1", noID: true, byActor: true},
+	"settings":                  {query: "SELECT COALESCE(jsonb_object_agg(key, value), '{}'::jsonb) FROM public.general_configs", noID: true, hashSecrets: true},
+	"lockouts":                  {query: "SELECT to_jsonb(t) FROM public.auth_throttle t WHERE t.id = $1"},
+	"impersonations":            {query: "SELECT to_jsonb(t) - 'token_hash' FROM public.impersonation_sessions t WHERE t.id = $1"},
+	"mercadopago_notifications": {query: "SELECT to_jsonb(t) - 'payload' FROM public.mercadopago_notifications t WHERE t.id = $1"},
+}
+
+// auditEntityAliases normaliza o tipo do alvo deduzido do caminho da rota.
+var auditEntityAliases = map[string]string{
+	"sub-accounts":      "users",
+	"profile":           "users",
+	"api-keys":          "api_keys",
+	"prices":            "reseller_prices",
+	"configuration":     "settings",
+	"general_config":    "settings",
+	"mercadopago":       "settings",
+	"cloudflare/config": "settings",
+	"cloudflare/zones":  "zones",
+	"notifications":     "mercadopago_notifications",
+}
+
+// auditTarget deduz o alvo do template da rota: o último parâmetro e o
+// segmento que o precede (/domains/{id}/renew → domains, id). Sem parâmetro,
+// o alvo é o primeiro segmento depois do prefixo, sem id.
+func auditTarget(route string, vars map[string]string, actorID int64) (string, string) {
+	rest := route
+	for _, prefix := range []string{"/api/admin/", "/api/superadmin/"} {
+		rest = strings.TrimPrefix(rest, prefix)
+	}
+	if rest == "profile" {
+		return "users", strconv.FormatInt(actorID, 10)
+	}
+
+	segs := strings.Split(rest, "/")
+	for i := len(segs) - 1; i > 0; i-- {
+		if strings.HasPrefix(segs[i], "{") && strings.HasSuffix(segs[i], "}") {
+			return auditEntity(segs[i-1]), vars[strings.Trim(segs[i], "{}")]
+		}
+	}
+	if alias, ok := auditEntityAliases[rest]; ok {
+		return alias, ""
+	}
+	return auditEntity(segs[0]), ""
+}
+
+func auditEntity(name string) string {
+	if alias, ok := auditEntityAliases[name]; ok {
+		return alias
+	}
+	return name
+}
+
+func (s auditSnapshot) take(ctx context.Context, id string, actorID int64) json.RawMessage {
+	var args []any
+	if !s.noID {
+		n, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			return nil
+		}
+		args = append(args, n)
+	}
+	if s.byActor {
+		args = append(args, actorID)
+	}
+	out, err := audits.snapshot(ctx, s.query, args...)
+	if err != nil {
+		log.Printf("WARN: audit snapshot failed: %v", err)
+		return nil
+	}
+	return redactJSON(out, s.hashSecrets)
+}
+
+// auditRecorder guarda o status e o início do corpo da resposta, de onde sai
+// o id de recursos criados por POST.
+type auditRecorder struct {
+	statusRecorder
+	body bytes.Buffer
+}
+
+func (w *auditRecorder) Write(b []byte) (int, error) {
+	if room := auditBodyLimit - w.body.Len(); room > 0 {
+		w.body.Write(b[:min(len(b), room)])
+	}
+	return w.statusRecorder.Write(b)
+}
+
+// Audit grava em public.audit_log toda requisição que não seja GET, HEAD ou
+// OPTIONS: quem fez, de onde, em qual rota e alvo, e o estado do alvo antes e
+// depois. Em sessões de personificação também as leituras são gravadas, e o
+// autor é o Superadmin, não o usuário personificado. Deve ser registrado com
+// router.Use depois da autenticação. Falhas ao gravar são apenas registradas
+// no log, sem afetar a resposta.
+func Audit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		imp, impersonated := ImpersonationFromContext(r.Context())
+		readOnly := false
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			if !impersonated {
+				next.ServeHTTP(w, r)
+				return
+			}
+			readOnly = true
+		}
+
+		e := &AuditEntry{Method: r.Method, Path: r.URL.Path, IP: ClientIP(r)}
+		// userID é quem a requisição representa; nos snapshots "do próprio
+		// usuário" (perfil, carrinho) é ele, mesmo quando personificado.
+		userID, _ := r.Context().Value(UserIDKey).(int64)
+		e.ActorID = userID
+		e.ActorRole, _ = r.Context().Value(RoleKey).(string)
+		if impersonated {
+			e.ActorID, e.ActorRole = imp.ActorID, imp.ActorRole
+			e.ImpersonationID, e.ImpersonatedID = &imp.ID, &imp.TargetID
+		}
+		if k, ok := r.Context().Value(APIKeyKey).(*APIKey); ok {
+			e.APIKeyID = &k.ID
+		}
+		if route := mux.CurrentRoute(r); route != nil {
+			e.Route, _ = route.GetPathTemplate()
+		}
+		e.TargetType, e.TargetID = auditTarget(e.Route, mux.Vars(r), userID)
+		e.Request = readAuditBody(r)
+
+		snap, hasSnap := auditSnapshots[e.TargetType]
+		hasSnap = hasSnap && !readOnly
+		if hasSnap {
+			e.Before = snap.take(r.Context(), e.TargetID, userID)
+		}
+
+		rec := &auditRecorder{statusRecorder: statusRecorder{ResponseWriter: w}}
+		next.ServeHTTP(rec, r)
+		e.Status = rec.status
+		if e.Status == 0 {
+			e.Status = http.StatusOK
+		}
+
+		if e.Status < 400 {
+			if e.TargetID == "" && !snap.noID && r.Method == http.MethodPost {
+				e.TargetID = createdID(rec.body.Bytes())
+			}
+			if hasSnap {
+				e.After = snap.take(r.Context(), e.TargetID, userID)
+			}
+			e.Diff = auditDiff(e.Before, e.After)
+		}
+
+		if err := audits.insert(r.Context(), e); err != nil {
+			log.Printf("ERROR: Could not write audit entry for %s %s by user %d: %v", e.Method, e.Path, e.ActorID, err)
+		}
+	})
+}
+
+// readAuditBody lê o corpo JSON da requisição (até auditBodyLimit), devolve-o
+// com os campos sensíveis mascarados e recoloca o corpo original para o handler.
+func readAuditBody(r *http.Request) json.RawMessage {
+	if r.Body == nil {
+		return nil
+	}
+	head, err := io.ReadAll(io.LimitReader(r.Body, auditBodyLimit))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(head), r.Body), r.Body}
+	if err != nil || len(head) == 0 || !json.Valid(head) {
+		return nil
+	}
+	return redactJSON(head, false)
+}
+
+// createdID extrai o campo "id" de uma resposta JSON de criação.
+func createdID(body []byte) string {
+	var created struct {
+		ID json.Number `json:"id"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&created); err != nil {
+		return ""
+	}
+	return created.ID.String()
+}
+
+// auditSensitiveKey informa se o campo guarda uma credencial.
+func auditSensitiveKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range []string{"password", "secret", "token", "api_key", "apikey", "access_key"} {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactJSON mascara os valores de campos sensíveis em qualquer nível.
+func redactJSON(raw json.RawMessage, hashSecrets bool) json.RawMessage {
+	if len(raw) == 0 {
+		return nil
+	}
+	var v any
+	if err := json.Unmarshal(raw, &v); err != nil || v == nil {
+		return nil
+	}
+	out, err := json.Marshal(redactValue(v, hashSecrets))
+	if err != nil {
+		return nil
+	}
+	return out
+}
+
+func redactValue(v any, hashSecrets bool) any {
+	switch t := v.(type) {
+	case map[string]any:
+		for k, val := range t {
+			if s, ok := val.(string); ok && s != "" && auditSensitiveKey(k) {
+				if hashSecrets {
+					sum := sha256.Sum256([]byte(s))
+					t[k] = "[redacted sha256:" + hex.EncodeToString(sum[:4]) + "]"
+				} else {
+					t[k] = auditRedacted
+				}
+				continue
+			}
+			t[k] = redactValue(val, hashSecrets)
+		}
+	case []any:
+		for i := range t {
+			t[i] = redactValue(t[i], hashSecrets)
+		}
+	}
+	return v
+}
+
+// auditDiff compara os estados antes e depois. Para objetos, devolve apenas os
+// campos alterados ({"campo": {"before": ..., "after": ...}}); para outros
+// valores, o par inteiro. Sem mudança, devolve nil.
+func auditDiff(before, after json.RawMessage) json.RawMessage {
+	if before == nil && after == nil {
+		return nil
+	}
+	var b, a any
+	if before != nil {
+		if err := json.Unmarshal(before, &b); err != nil {
+			return nil
+		}
+	}
+	if after != nil {
+		if err := json.Unmarshal(after, &a); err != nil {
+			return nil
+		}
+	}
+	if reflect.DeepEqual(a, b) {
+		return nil
+	}
+
+	type change struct {
+		Before any `json:"before"`
+		After  any `json:"after"`
+	}
+	bm, bok := b.(map[string]any)
+	am, aok := a.(map[string]any)
+	if (bok || b == nil) && (aok || a == nil) {
+		diff := map[string]change{}
+		for k, av := range am {
+			if bv, found := bm[k]; !found || !reflect.DeepEqual(av, bv) {
+				diff[k] = change{Before: bm[k], After: av}
+			}
+		}
+		for k, bv := range bm {
+			if _, found := am[k]; !found {
+				diff[k] = change{Before: bv}
+			}
+		}
+		out, _ := json.Marshal(diff)
+		return out
+	}
+	out, _ := json.Marshal(change{Before: b, After: a})
+	return out
+}
@@ -0,0 +1,239 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// fakeAuditStore guarda as entradas gravadas e devolve o estado de state,
+// indexado pelos argumentos da consulta de snapshot.
+type fakeAuditStore struct {
+	mu      sync.Mutex
+	entries []AuditEntry
+	state   map[string]string
+	queries []string
+}
+
+func (s *fakeAuditStore) insert(ctx context.Context, e *AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e.ID = int64(len(s.entries) + 1)
+	s.entries = append(s.entries, *e)
+	return nil
+}
+
+func (s *fakeAuditStore) snapshot(ctx context.Context, query string, args ...any) (json.RawMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queries = append(s.queries, query)
+	v, ok := s.state[fmt.Sprint(args...)]
+	if !ok {
+		return nil, nil
+	}
+	return json.RawMessage(v), nil
+}
+
+func useAuditStore(t *testing.T, state map[string]string) *fakeAuditStore {
+	t.Helper()
+	store := &fakeAuditStore{state: state}
+	prev := audits
+	audits = store
+	t.Cleanup(func() { audits = prev })
+	return store
+}
+
+// withActor simula a autenticação, que roda antes de Audit.
+func withActor(id int64, role string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), UserIDKey, id)
+			ctx = context.WithValue(ctx, RoleKey, role)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func auditedRouter(handlers map[string]http.HandlerFunc) *mux.Router {
+	r := mux.NewRouter()
+	sa := r.PathPrefix("/api/superadmin").Subrouter()
+	sa.Use(withActor(1, RoleSuperadmin), Audit)
+	for route, h := range handlers {
+		method, path, _ := strings.Cut(route, " ")
+		sa.HandleFunc(path, h).Methods(method)
+	}
+	return r
+}
+
+func TestAuditRecordsDiffOfUpdatedTarget(t *testing.T) {
+	store := useAuditStore(t, map[string]string{
+		"7": `{"id": 7, "target_url": "http://antiga", "active": true}`,
+	})
+
+	var seenBody string
+	router := auditedRouter(map[string]http.HandlerFunc{
+		"PUT /domains/{id}": func(w http.ResponseWriter, r *http.Request) {
+			b, _ := io.ReadAll(r.Body)
+			seenBody = string(b)
+			store.state["7"] = `{"id": 7, "target_url": "http://nova", "active": true}`
+			w.WriteHeader(http.StatusOK)
+		},
+		"GET /domains/{id}": func(w http.ResponseWriter, r *http.Request) {},
+	})
+
+	body := `{"target_url": "http://nova", "password": "segredo"}`
+	req := httptest.NewRequest("PUT", "/api/superadmin/domains/7", strings.NewReader(body))
+	req.RemoteAddr = "203.0.113.5:1234"
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/superadmin/domains/7", nil))
+
+	if seenBody != body {
+		t.Errorf("o handler deveria receber o corpo original, recebeu %q", seenBody)
+	}
+	if len(store.entries) != 1 {
+		t.Fatalf("esperada uma entrada (GET não é auditado), houve %d", len(store.entries))
+	}
+	e := store.entries[0]
+	if e.ActorID != 1 || e.ActorRole != RoleSuperadmin || e.IP != "203.0.113.5" {
+		t.Errorf("autor inesperado: %+v", e)
+	}
+	if e.Route != "/api/superadmin/domains/{id}" || e.TargetType != "domains" || e.TargetID != "7" || e.Status != http.StatusOK {
+		t.Errorf("rota ou alvo inesperados: %+v", e)
+	}
+	if want := `{"target_url":{"before":"http://antiga","after":"http://nova"}}`; string(e.Diff) != want {
+		t.Errorf("diff = %s, esperado %s", e.Diff, want)
+	}
+	if strings.Contains(string(e.Request), "segredo") || !strings.Contains(string(e.Request), auditRedacted) {
+		t.Errorf("senha deveria ser mascarada: %s", e.Request)
+	}
+}
+
+func TestAuditUsesCreatedIDFromResponse(t *testing.T) {
+	store := useAuditStore(t, map[string]string{})
+	router := auditedRouter(map[string]http.HandlerFunc{
+		"POST /users": func(w http.ResponseWriter, r *http.Request) {
+			store.state["42"] = `{"id": 42, "email": "novo@example.com"}`
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(map[string]any{"id": 42})
+		},
+	})
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/api/superadmin/users", strings.NewReader(`{"email": "novo@example.com"}`)))
+
+	e := store.entries[0]
+	if e.TargetType != "users" || e.TargetID != "42" {
+		t.Fatalf("alvo inesperado: %s/%s", e.TargetType, e.TargetID)
+	}
+	if e.Before != nil || string(e.After) != `{"email":"novo@example.com","id":42}` {
+		t.Errorf("before=%s after=%s", e.Before, e.After)
+	}
+	if !strings.Contains(string(e.Diff), `"email":{"before":null,"after":"novo@example.com"}`) {
+		t.Errorf("diff de criação inesperado: %s", e.Diff)
+	}
+}
+
+func TestAuditRecordsFailedRequestsWithoutAfter(t *testing.T) {
+	store := useAuditStore(t, map[string]string{"3": `{"id": 3}`})
+	router := auditedRouter(map[string]http.HandlerFunc{
+		"DELETE /payments/{id}": func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+		},
+	})
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("DELETE", "/api/superadmin/payments/3", nil))
+
+	e := store.entries[0]
+	if e.Status != http.StatusForbidden || e.Before == nil || e.After != nil || e.Diff != nil {
+		t.Errorf("entrada inesperada para requisição negada: %+v", e)
+	}
+}
+
+func TestAuditHashesSecretsInSettings(t *testing.T) {
+	store := useAuditStore(t, map[string]string{
+		"": `{"MERCADOPAGO_ACCESS_TOKEN": "APP_USR-1", "site_name": "CDN"}`,
+	})
+	router := auditedRouter(map[string]http.HandlerFunc{
+		"POST /mercadopago": func(w http.ResponseWriter, r *http.Request) {
+			store.state[""] = `{"MERCADOPAGO_ACCESS_TOKEN": "APP_USR-2", "site_name": "CDN"}`
+		},
+	})
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/api/superadmin/mercadopago", strings.NewReader(`{"MERCADOPAGO_ACCESS_TOKEN": "APP_USR-2"}`)))
+
+	e := store.entries[0]
+	if e.TargetType != "settings" {
+		t.Fatalf("alvo = %q", e.TargetType)
+	}
+	for _, raw := range []json.RawMessage{e.Request, e.Before, e.After, e.Diff} {
+		if strings.Contains(string(raw), "APP_USR") {
+			t.Errorf("credencial exposta: %s", raw)
+		}
+	}
+	if !strings.Contains(string(e.Diff), "MERCADOPAGO_ACCESS_TOKEN") || strings.Contains(string(e.Diff), "site_name") {
+		t.Errorf("a troca da credencial deveria aparecer no diff, sem os campos inalterados: %s", e.Diff)
+	}
+}
+
+func TestAuditTarget(t *testing.T) {
+	tests := []struct {
+		route      string
+		vars       map[string]string
+		wantType   string
+		wantTarget string
+	}{
+		{"/api/superadmin/domains/{id}/renew", map[string]string{"id": "5"}, "domains", "5"},
+		{"/api/superadmin/cloudflare/zones/{id}/dns_records/{record_id}", map[string]string{"id": "z", "record_id": "r"}, "dns_records", "r"},
+		{"/api/superadmin/cloudflare/zones", nil, "zones", ""},
+		{"/api/superadmin/mercadopago/notifications/{id}/replay", map[string]string{"id": "9"}, "mercadopago_notifications", "9"},
+		{"/api/superadmin/cloudflare/config", nil, "settings", ""},
+		{"/api/superadmin/general_config", nil, "settings", ""},
+		{"/api/superadmin/traffic/reset", nil, "traffic", ""},
+		{"/api/superadmin/database/clean", nil, "database", ""},
+		{"/api/admin/sub-accounts/{id}/domains", map[string]string{"id": "9"}, "users", "9"},
+		{"/api/admin/reseller/prices/{plan_id}", map[string]string{"plan_id": "3"}, "reseller_prices", "3"},
+		{"/api/admin/api-keys/{id}", map[string]string{"id": "4"}, "api_keys", "4"},
+		{"/api/admin/profile", nil, "users", "12"},
+		{"/api/admin/cart", nil, "cart", ""},
+	}
+	for _, tt := range tests {
+		gotType, gotTarget := auditTarget(tt.route, tt.vars, 12)
+		if gotType != tt.wantType || gotTarget != tt.wantTarget {
+			t.Errorf("auditTarget(%s) = %s/%s, esperado %s/%s", tt.route, gotType, gotTarget, tt.wantType, tt.wantTarget)
+		}
+	}
+}
+
+func TestAuditDiff(t *testing.T) {
+	tests := []struct {
+		name          string
+		before, after string
+		want          string
+	}{
+		{"sem mudança", `{"a": 1}`, `{"a": 1}`, ""},
+		{"campo removido", `{"a": 1, "b": 2}`, `{"a": 1}`, `{"b":{"before":2,"after":null}}`},
+		{"exclusão", `{"a": 1}`, "", `{"a":{"before":1,"after":null}}`},
+		{"listas", `[1]`, `[1, 2]`, `{"before":[1],"after":[1,2]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var before, after json.RawMessage
+			if tt.before != "" {
+				before = json.RawMessage(tt.before)
+			}
+			if tt.after != "" {
+				after = json.RawMessage(tt.after)
+			}
+			if got := string(auditDiff(before, after)); got != tt.want {
+				t.Errorf("auditDiff = %s, esperado %s", got, tt.want)
+			}
+		})
+	}
+}
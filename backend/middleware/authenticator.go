@@ -0,0 +1,290 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"CDNProxy_v2/backend/database"
+)
+
+// Authenticator é o backend de autenticação usado pelo login, pela
+// recuperação de senha e pela validação de tokens nas rotas protegidas.
+type Authenticator interface {
+	// Login troca e-mail e senha por uma sessão.
+	Login(ctx context.Context, email, password string) (*Session, error)
+	// Authenticate valida o access token e resolve o usuário local.
+	Authenticate(ctx context.Context, token string) (*Identity, error)
+	// RequestPasswordReset envia o e-mail de recuperação; redirectTo é a
+	// página do frontend que recebe o link.
+	RequestPasswordReset(ctx context.Context, email, redirectTo string) error
+	// ResetPassword conclui a recuperação com o token recebido por e-mail.
+	ResetPassword(ctx context.Context, resetToken, password string) error
+	// SetPassword troca a senha de um usuário de public.users.
+	SetPassword(ctx context.Context, userID int64, password string) error
+	// CreateCredentials cria as credenciais de um usuário recém-inserido em
+	// public.users.
+	CreateCredentials(ctx context.Context, userID int64, email, password string) error
+	// Refresh troca um refresh token por uma sessão nova, com o mesmo
+	// session_id.
+	Refresh(ctx context.Context, refreshToken string) (*Session, error)
+	// Logout encerra no provedor a sessão do access token. A revogação local
+	// fica com RevokeSession.
+	Logout(ctx context.Context, accessToken string) error
+}
+
+// Identity é o usuário autenticado de uma requisição.
+type Identity struct {
+	UserID  int64
+	Role    string
+	Subject string
+	// SessionID vem da claim session_id do token (ver SessionIDFor).
+	SessionID string
+	// MFAEnabled indica segundo fator (TOTP) ativo.
+	MFAEnabled bool
+}
+
+// SessionIDFor devolve o id da sessão do token; sem a claim session_id,
+// usa o hash do próprio token.
+func (i *Identity) SessionIDFor(token string) string {
+	if i.SessionID != "" {
+		return i.SessionID
+	}
+	return HashAPIKey(token)
+}
+
+// Session é a resposta do login, no mesmo formato do Supabase Auth.
+type Session struct {
+	AccessToken  string      `json:"access_token"`
+	TokenType    string      `json:"token_type"`
+	ExpiresIn    int64       `json:"expires_in"`
+	ExpiresAt    int64       `json:"expires_at,omitempty"`
+	RefreshToken string      `json:"refresh_token,omitempty"`
+	User         SessionUser `json:"user"`
+}
+
+// SessionUser identifica o dono da sessão.
+type SessionUser struct {
+	ID    string `json:"id"`
+	Email string `json:"email"`
+}
+
+var (
+	// ErrInvalidCredentials indica e-mail ou senha incorretos.
+	ErrInvalidCredentials = errors.New("invalid email or password")
+	// ErrInvalidResetToken indica token de recuperação inválido ou expirado.
+	ErrInvalidResetToken = errors.New("invalid or expired reset token")
+	// ErrUserNotFound indica token válido sem usuário correspondente em public.users.
+	ErrUserNotFound = errors.New("user not found")
+	// ErrAuthUnavailable indica que o provedor não pôde validar o token agora
+	// (ex: JWKS indisponível).
+	ErrAuthUnavailable = errors.New("authentication temporarily unavailable")
+	// ErrNotSupported indica operação que o provedor não implementa.
+	ErrNotSupported = errors.New("operation not supported by the authentication provider")
+)
+
+// MinPasswordLength é o tamanho mínimo aceito para novas senhas.
+const MinPasswordLength = 6
+
+var (
+	authMu        sync.RWMutex
+	authenticator Authenticator
+)
+
+// SetAuthenticator define o backend usado por Authenticate e pelos handlers de login.
+func SetAuthenticator(a Authenticator) {
+	authMu.Lock()
+	authenticator = a
+	authMu.Unlock()
+}
+
+// CurrentAuthenticator retorna o backend configurado. Sem SetAuthenticator,
+// usa o Supabase a partir das variáveis de ambiente.
+func CurrentAuthenticator() (Authenticator, error) {
+	authMu.RLock()
+	a := authenticator
+	authMu.RUnlock()
+	if a != nil {
+		return a, nil
+	}
+
+	jwksURL := os.Getenv("SUPABASE_JWT_SIGNING_KEY")
+	if jwksURL == "" {
+		return nil, errors.New("Supabase JWKS URL not configured")
+	}
+
+	authMu.Lock()
+	defer authMu.Unlock()
+	if authenticator == nil {
+		authenticator = NewSupabaseAuthenticator(SupabaseAuthConfig{
+			URL:            os.Getenv("SUPABASE_URL"),
+			APIKey:         os.Getenv("SUPABASE_API_KEY"),
+			ServiceRoleKey: os.Getenv("SUPABASE_SERVICE_ROLE_KEY"),
+			JWKSURL:        jwksURL,
+			Issuer:         os.Getenv("SUPABASE_JWT_ISSUER"),
+			Audience:       os.Getenv("SUPABASE_JWT_AUDIENCE"),
+		})
+	}
+	return authenticator, nil
+}
+
+// Authenticate valida o Bearer token com o Authenticator configurado e injeta
+// UserIDKey, RoleKey e SessionIDKey no contexto. Usuários desativados e
+// sessões revogadas são recusados; sessões que ainda devem o segundo fator só
+// acessam /api/auth/mfa. Tokens de personificação (imp_...)
+// são validados em public.impersonation_sessions.
+func Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authHeader := r.Header.Get("Authorization")
+		if authHeader == "" {
+			http.Error(w, "Authorization header required", http.StatusUnauthorized)
+			return
+		}
+
+		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
+		if tokenString == authHeader {
+			http.Error(w, "Could not find Bearer token in Authorization header", http.StatusUnauthorized)
+			return
+		}
+
+		if strings.HasPrefix(tokenString, ImpersonationTokenPrefix) {
+			authenticateImpersonation(w, r, tokenString, next)
+			return
+		}
+
+		auth, err := CurrentAuthenticator()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		identity, err := auth.Authenticate(r.Context(), tokenString)
+		switch {
+		case errors.Is(err, ErrAuthUnavailable):
+			log.Printf("ERROR: %v", err)
+			http.Error(w, "Authentication temporarily unavailable", http.StatusServiceUnavailable)
+			return
+		case errors.Is(err, ErrUserDisabled):
+			http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+			return
+		case errors.Is(err, ErrSessionRevoked):
+			http.Error(w, "Invalid token: "+err.Error(), http.StatusUnauthorized)
+			return
+		case errors.Is(err, ErrUserNotFound):
+			log.Printf("ERROR: User lookup failed: %v", err)
+			http.Error(w, "User not found or database error", http.StatusForbidden)
+			return
+		case err != nil:
+			log.Printf("ERROR: Token validation failed: %v", err)
+			http.Error(w, "Invalid token: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		identity.SessionID = identity.SessionIDFor(tokenString)
+		if !enforceMFA(w, r, identity) {
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), UserIDKey, identity.UserID)
+		ctx = context.WithValue(ctx, RoleKey, identity.Role)
+		ctx = context.WithValue(ctx, SessionIDKey, identity.SessionID)
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// SupabaseAuth é o nome histórico de Authenticate; a validação segue o
+// Authenticator configurado (Supabase ou local).
+func SupabaseAuth(next http.Handler) http.Handler {
+	return Authenticate(next)
+}
+
+// authUser é a parte de public.users usada na autenticação.
+type authUser struct {
+	ID             int64
+	Email          string
+	Role           int
+	PasswordHash   string
+	SupabaseAuthID string
+	ResetSentAt    *time.Time
+	TOTPEnabled    bool
+	// Disabled é public.users.active = false.
+	Disabled bool
+	// SessionsRevokedAt é o último "encerrar todas as sessões".
+	SessionsRevokedAt *time.Time
+}
+
+func (u *authUser) identity(subject string) *Identity {
+	return &Identity{UserID: u.ID, Role: strconv.Itoa(u.Role), Subject: subject, MFAEnabled: u.TOTPEnabled}
+}
+
+// userStore isola o acesso a public.users para que os autenticadores possam
+// ser testados sem banco.
+type userStore interface {
+	bySupabaseID(ctx context.Context, subject string) (*authUser, error)
+	byID(ctx context.Context, id int64) (*authUser, error)
+	byEmail(ctx context.Context, email string) (*authUser, error)
+	byResetToken(ctx context.Context, tokenHash string) (*authUser, error)
+	setPasswordHash(ctx context.Context, id int64, hash string) error
+	setResetToken(ctx context.Context, id int64, tokenHash string, sentAt time.Time) error
+	setSupabaseID(ctx context.Context, id int64, subject string) error
+}
+
+// dbUserStore implementa userStore sobre database.DB.
+type dbUserStore struct{}
+
+const authUserColumns = "id, email, role, COALESCE(encrypted_password, ''), COALESCE(supabase_auth_id::text, ''), reset_password_sent_at, totp_enabled_at IS NOT NULL, NOT COALESCE(active, true), sessions_revoked_at"
+
+func (dbUserStore) scan(ctx context.Context, where string, arg interface{}) (*authUser, error) {
+	var u authUser
+	err := database.DB.QueryRow(ctx,
+		"SELECT "+authUserColumns+" FROM public.users WHERE "+where, arg,
+	).Scan(&u.ID, &u.Email, &u.Role, &u.PasswordHash, &u.SupabaseAuthID, &u.ResetSentAt, &u.TOTPEnabled, &u.Disabled, &u.SessionsRevokedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (s dbUserStore) bySupabaseID(ctx context.Context, subject string) (*authUser, error) {
+	return s.scan(ctx, "supabase_auth_id = $1", subject)
+}
+
+func (s dbUserStore) byID(ctx context.Context, id int64) (*authUser, error) {
+	return s.scan(ctx, "id = $1", id)
+}
+
+func (s dbUserStore) byEmail(ctx context.Context, email string) (*authUser, error) {
+	return s.scan(ctx, "LOWER(email) = LOWER($1)", email)
+}
+
+func (s dbUserStore) byResetToken(ctx context.Context, tokenHash string) (*authUser, error) {
+	return s.scan(ctx, "reset_password_token = $1", tokenHash)
+}
+
+func (dbUserStore) setPasswordHash(ctx context.Context, id int64, hash string) error {
+	_, err := database.DB.Exec(ctx,
+		"UPDATE public.users SET encrypted_password = $1, reset_password_token = NULL, reset_password_sent_at = NULL, updated_at = NOW() WHERE id = $2",
+		hash, id)
+	return err
+}
+
+func (dbUserStore) setResetToken(ctx context.Context, id int64, tokenHash string, sentAt time.Time) error {
+	_, err := database.DB.Exec(ctx,
+		"UPDATE public.users SET reset_password_token = $1, reset_password_sent_at = $2, updated_at = NOW() WHERE id = $3",
+		tokenHash, sentAt, id)
+	return err
+}
+
+func (dbUserStore) setSupabaseID(ctx context.Context, id int64, subject string) error {
+	_, err := database.DB.Exec(ctx,
+		"UPDATE public.users SET supabase_auth_id = $1, updated_at = NOW() WHERE id = $2",
+		subject, id)
+	return err
+}
@@ -0,0 +1,142 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeUserStore é um public.users em memória.
+type fakeUserStore struct {
+	mu    sync.Mutex
+	users map[int64]*authUser
+	reset map[string]int64
+}
+
+func newFakeUserStore(users ...*authUser) *fakeUserStore {
+	s := &fakeUserStore{users: map[int64]*authUser{}, reset: map[string]int64{}}
+	for _, u := range users {
+		s.users[u.ID] = u
+	}
+	return s
+}
+
+var errNoRows = errors.New("no rows in result set")
+
+func (s *fakeUserStore) find(match func(*authUser) bool) (*authUser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range s.users {
+		if match(u) {
+			copy := *u
+			return &copy, nil
+		}
+	}
+	return nil, errNoRows
+}
+
+func (s *fakeUserStore) bySupabaseID(ctx context.Context, subject string) (*authUser, error) {
+	return s.find(func(u *authUser) bool { return u.SupabaseAuthID == subject })
+}
+
+func (s *fakeUserStore) byID(ctx context.Context, id int64) (*authUser, error) {
+	return s.find(func(u *authUser) bool { return u.ID == id })
+}
+
+func (s *fakeUserStore) byEmail(ctx context.Context, email string) (*authUser, error) {
+	return s.find(func(u *authUser) bool { return strings.EqualFold(u.Email, email) })
+}
+
+func (s *fakeUserStore) byResetToken(ctx context.Context, tokenHash string) (*authUser, error) {
+	s.mu.Lock()
+	id, ok := s.reset[tokenHash]
+	s.mu.Unlock()
+	if !ok {
+		return nil, errNoRows
+	}
+	return s.byID(ctx, id)
+}
+
+func (s *fakeUserStore) setPasswordHash(ctx context.Context, id int64, hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[id]
+	if !ok {
+		return errNoRows
+	}
+	u.PasswordHash = hash
+	u.ResetSentAt = nil
+	for k, v := range s.reset {
+		if v == id {
+			delete(s.reset, k)
+		}
+	}
+	return nil
+}
+
+func (s *fakeUserStore) setResetToken(ctx context.Context, id int64, tokenHash string, sentAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[id]
+	if !ok {
+		return errNoRows
+	}
+	u.ResetSentAt = &sentAt
+	s.reset[tokenHash] = id
+	return nil
+}
+
+func (s *fakeUserStore) setSupabaseID(ctx context.Context, id int64, subject string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[id]
+	if !ok {
+		return errNoRows
+	}
+	u.SupabaseAuthID = subject
+	return nil
+}
+
+// useAuthenticator troca o Authenticator global durante o teste.
+func useAuthenticator(t *testing.T, a Authenticator) {
+	t.Helper()
+	authMu.Lock()
+	prev := authenticator
+	authenticator = a
+	authMu.Unlock()
+
+	t.Cleanup(func() {
+		authMu.Lock()
+		authenticator = prev
+		authMu.Unlock()
+	})
+}
+
+type authResult struct {
+	code   int
+	userID int64
+	role   string
+}
+
+func callProtected(token string) authResult {
+	var res authResult
+	handler := Authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res.userID, _ = r.Context().Value(UserIDKey).(int64)
+		res.role, _ = r.Context().Value(RoleKey).(string)
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req := httptest.NewRequest("GET", "/api/protected", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	res.code = rr.Code
+	return res
+}
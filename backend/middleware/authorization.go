@@ -6,6 +6,9 @@ import (
 
 // RoleAuthorization é um middleware que verifica se a role do usuário, presente no token JWT,
 // corresponde à role necessária para acessar a rota.
+//
+// As rotas de main.go usam RequirePermission; RoleAuthorization fica para
+// verificações simples por role.
 func RoleAuthorization(requiredRole string) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,208 @@
+package middleware
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// cloudflareRanges são as faixas publicadas pela Cloudflare (as mesmas do
+// set_real_ip_from do Nginx).
+var cloudflareRanges = []string{
+	// Cloudflare IPv4
+	"173.245.48.0/20",
+	"103.21.244.0/22",
+	"103.22.200.0/22",
+	"103.31.4.0/22",
+	"141.101.64.0/18",
+	"108.162.192.0/18",
+	"190.93.240.0/20",
+	"188.114.96.0/20",
+	"197.234.240.0/22",
+	"198.41.128.0/17",
+	"162.158.0.0/15",
+	"104.16.0.0/13",
+	"104.24.0.0/14",
+	"172.64.0.0/13",
+	"131.0.72.0/22",
+	// Cloudflare IPv6
+	"2400:cb00::/32",
+	"2606:4700::/32",
+	"2803:f800::/32",
+	"2405:b500::/32",
+	"2405:8100::/32",
+	"2a06:98c0::/29",
+	"2c0f:f248::/32",
+}
+
+// defaultTrustedProxies são as faixas da Cloudflare mais o loopback, já que o
+// Nginx local repassa as requisições para o backend em 127.0.0.1:8080.
+var defaultTrustedProxies = append(append([]string{}, cloudflareRanges...), "127.0.0.0/8", "::1/128")
+
+var (
+	trustedProxiesMu sync.RWMutex
+	trustedProxies   = mustParseCIDRs(defaultTrustedProxies)
+
+	// cloudflareNetworks são os únicos peers cujos CF-Connecting-IP e
+	// True-Client-IP valem: o Nginx repassa o CF-Connecting-IP que o cliente
+	// mandar, então vindo do loopback ele pode ter sido forjado.
+	cloudflareNetworks = mustParseCIDRs(cloudflareRanges)
+)
+
+// ParseTrustedProxies converte uma lista separada por vírgulas de CIDRs (ou IPs
+// isolados) em redes. Entradas vazias são ignoradas.
+func ParseTrustedProxies(list string) ([]*net.IPNet, error) {
+	return parseNetworks(strings.Split(list, ","), "trusted proxy")
+}
+
+// parseNetworks converte CIDRs ou IPs isolados (tratados como /32 ou /128) em
+// redes; what identifica a lista nas mensagens de erro.
+func parseNetworks(entries []string, what string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid %s %q", what, entry)
+			}
+			if ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %w", what, entry, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// SetTrustedProxies substitui a lista de proxies confiáveis. Uma lista vazia
+// mantém o padrão (Cloudflare + loopback).
+func SetTrustedProxies(list string) error {
+	nets, err := ParseTrustedProxies(list)
+	if err != nil {
+		return err
+	}
+	if len(nets) == 0 {
+		nets = mustParseCIDRs(defaultTrustedProxies)
+	}
+
+	trustedProxiesMu.Lock()
+	trustedProxies = nets
+	trustedProxiesMu.Unlock()
+	return nil
+}
+
+// ClientIP extrai o IP real do cliente. Os cabeçalhos de proxy só são
+// considerados quando o peer imediato é um proxy confiável; caso contrário vale
+// o endereço da conexão. CF-Connecting-IP e True-Client-IP valem apenas quando
+// o peer é da Cloudflare; dos demais proxies (como o Nginx local) valem só o
+// X-Forwarded-For e o X-Real-IP.
+func ClientIP(r *http.Request) string {
+	peer := remoteIP(r.RemoteAddr)
+	if peer == nil {
+		return r.RemoteAddr
+	}
+
+	if !isTrustedProxy(peer) {
+		return peer.String()
+	}
+
+	if inNetworks(cloudflareNetworks, peer) {
+		for _, header := range []string{"CF-Connecting-IP", "True-Client-IP"} {
+			if ip := parseIP(r.Header.Get(header)); ip != nil {
+				return ip.String()
+			}
+		}
+	}
+
+	// O X-Forwarded-For é percorrido da direita para a esquerda: cada proxy
+	// confiável adiciona o endereço de quem falou com ele, então o primeiro
+	// endereço não confiável é o cliente. Entradas à esquerda dele podem ter
+	// sido forjadas pelo próprio cliente.
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		var leftmost net.IP
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := parseIP(hops[i])
+			if ip == nil {
+				break
+			}
+			if !isTrustedProxy(ip) {
+				return ip.String()
+			}
+			leftmost = ip
+		}
+		if leftmost != nil {
+			return leftmost.String()
+		}
+	}
+
+	if ip := parseIP(r.Header.Get("X-Real-IP")); ip != nil {
+		return ip.String()
+	}
+
+	return peer.String()
+}
+
+// remoteIP interpreta o RemoteAddr ("ip:porta", "[ipv6]:porta" ou apenas o IP).
+func remoteIP(remoteAddr string) net.IP {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	return parseIP(host)
+}
+
+// parseIP aceita IPv4, IPv6 (com ou sem colchetes) e IPv4 mapeado em IPv6.
+func parseIP(value string) net.IP {
+	value = strings.TrimSpace(value)
+	value = strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+	if i := strings.IndexByte(value, '%'); i >= 0 {
+		value = value[:i]
+	}
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	trustedProxiesMu.RLock()
+	defer trustedProxiesMu.RUnlock()
+
+	return inNetworks(trustedProxies, ip)
+}
+
+func inNetworks(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func mustParseCIDRs(cidrs []string) []*net.IPNet {
+	nets, err := ParseTrustedProxies(strings.Join(cidrs, ","))
+	if err != nil {
+		panic(err)
+	}
+	return nets
+}
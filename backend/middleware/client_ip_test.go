@@ -0,0 +1,137 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	cases := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{
+			name:       "peer não confiável ignora cabeçalhos",
+			remoteAddr: "203.0.113.10:5555",
+			headers: map[string]string{
+				"CF-Connecting-IP": "1.1.1.1",
+				"X-Forwarded-For":  "2.2.2.2",
+				"X-Real-IP":        "3.3.3.3",
+			},
+			want: "203.0.113.10",
+		},
+		{
+			name:       "peer IPv6 não confiável",
+			remoteAddr: "[2001:db8::1]:443",
+			headers:    map[string]string{"X-Forwarded-For": "2.2.2.2"},
+			want:       "2001:db8::1",
+		},
+		{
+			name:       "Cloudflare envia CF-Connecting-IP",
+			remoteAddr: "172.64.1.2:443",
+			headers:    map[string]string{"CF-Connecting-IP": "198.51.100.7"},
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "Cloudflare IPv6 envia CF-Connecting-IP IPv6",
+			remoteAddr: "[2606:4700::6810:1]:443",
+			headers:    map[string]string{"CF-Connecting-IP": "2001:db8::beef"},
+			want:       "2001:db8::beef",
+		},
+		{
+			name:       "CF-Connecting-IP inválido cai para o X-Forwarded-For",
+			remoteAddr: "127.0.0.1:40000",
+			headers: map[string]string{
+				"CF-Connecting-IP": "not-an-ip",
+				"X-Forwarded-For":  "198.51.100.7",
+			},
+			want: "198.51.100.7",
+		},
+		{
+			name:       "CF-Connecting-IP vindo do Nginx local é ignorado",
+			remoteAddr: "127.0.0.1:40000",
+			headers: map[string]string{
+				"CF-Connecting-IP": "6.6.6.6",
+				"True-Client-IP":   "6.6.6.7",
+				"X-Forwarded-For":  "203.0.113.10",
+				"X-Real-IP":        "203.0.113.10",
+			},
+			want: "203.0.113.10",
+		},
+		{
+			name:       "CF-Connecting-IP forjado sem outros cabeçalhos usa o peer",
+			remoteAddr: "127.0.0.1:40000",
+			headers:    map[string]string{"CF-Connecting-IP": "6.6.6.6"},
+			want:       "127.0.0.1",
+		},
+		{
+			name:       "X-Forwarded-For é lido da direita para a esquerda",
+			remoteAddr: "127.0.0.1:40000",
+			headers:    map[string]string{"X-Forwarded-For": "6.6.6.6, 198.51.100.7, 162.158.1.1"},
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "X-Forwarded-For só com proxies confiáveis usa o mais à esquerda",
+			remoteAddr: "127.0.0.1:40000",
+			headers:    map[string]string{"X-Forwarded-For": "162.158.1.1, 172.64.0.9"},
+			want:       "162.158.1.1",
+		},
+		{
+			name:       "X-Real-IP do Nginx local",
+			remoteAddr: "127.0.0.1:40000",
+			headers:    map[string]string{"X-Real-IP": "198.51.100.7"},
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "sem cabeçalhos usa o peer",
+			remoteAddr: "[::1]:40000",
+			want:       "::1",
+		},
+		{
+			name:       "IPv4 mapeado em IPv6",
+			remoteAddr: "[::ffff:203.0.113.10]:5555",
+			want:       "203.0.113.10",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tc.remoteAddr
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+
+			if got := ClientIP(req); got != tc.want {
+				t.Errorf("ClientIP() = %q, esperado %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSetTrustedProxies(t *testing.T) {
+	t.Cleanup(func() { _ = SetTrustedProxies("") })
+
+	if err := SetTrustedProxies("10.0.0.0/8, 192.0.2.1"); err != nil {
+		t.Fatalf("SetTrustedProxies retornou erro: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.7, 10.1.2.3")
+	if got := ClientIP(req); got != "198.51.100.7" {
+		t.Errorf("ClientIP() = %q, esperado 198.51.100.7", got)
+	}
+
+	// Com a lista customizada o loopback deixa de ser confiável.
+	req.RemoteAddr = "127.0.0.1:1234"
+	if got := ClientIP(req); got != "127.0.0.1" {
+		t.Errorf("ClientIP() = %q, esperado 127.0.0.1", got)
+	}
+
+	if err := SetTrustedProxies("not-a-cidr"); err == nil {
+		t.Error("esperado erro para CIDR inválido")
+	}
+}
@@ -5,3 +5,14 @@ type ContextKey string
 
 const UserIDKey ContextKey = "userID"
 const RoleKey ContextKey = "role"
+
+// APIKeyKey guarda a *APIKey quando a requisição foi autenticada por chave de API.
+const APIKeyKey ContextKey = "apiKey"
+
+// SessionIDKey guarda o id da sessão do access token (Identity.SessionID),
+// usado pelo segundo fator.
+const SessionIDKey ContextKey = "sessionID"
+
+// ImpersonationKey guarda a *Impersonation quando um Superadmin age como outro
+// usuário; UserIDKey e RoleKey passam a ser os do usuário personificado.
+const ImpersonationKey ContextKey = "impersonation"
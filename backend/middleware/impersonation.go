@@ -0,0 +1,176 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"CDNProxy_v2/backend/database"
+)
+
+// ImpersonationTokenPrefix inicia todo token de personificação, separando-o
+// de JWTs e de chaves de API no cabeçalho Authorization.
+const ImpersonationTokenPrefix = "imp_"
+
+// Limites da validade de uma sessão de personificação.
+const (
+	DefaultImpersonationTTL = 15 * time.Minute
+	MaxImpersonationTTL     = time.Hour
+)
+
+// ImpersonatedByHeader é devolvido em toda resposta a uma requisição
+// personificada, com o id do Superadmin, para o frontend exibir o aviso.
+const ImpersonatedByHeader = "X-Impersonated-By"
+
+// Impersonation é uma linha de public.impersonation_sessions.
+type Impersonation struct {
+	ID          int64      `json:"id"`
+	ActorID     int64      `json:"actor_id"`
+	ActorRole   string     `json:"actor_role"`
+	TargetID    int64      `json:"target_id"`
+	AllowWrites bool       `json:"allow_writes"`
+	Reason      string     `json:"reason"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	EndedAt     *time.Time `json:"ended_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+var (
+	errImpersonationInvalid  = errors.New("invalid impersonation token")
+	errImpersonationEnded    = errors.New("impersonation session ended")
+	errImpersonationExpired  = errors.New("impersonation session expired")
+	errImpersonationReadOnly = errors.New("read-only impersonation session")
+	errImpersonationRoute    = errors.New("impersonation sessions are limited to /api/admin")
+	errImpersonationCreds    = errors.New("credentials cannot be changed while impersonating")
+	errImpersonationRevoked  = errors.New("impersonating user can no longer impersonate")
+)
+
+// impersonationCredentialPaths são rotas de credenciais do usuário que nem
+// uma sessão com allow_writes pode alterar: uma chave de API ou uma
+// subconta criada durante a personificação sobreviveria ao fim da sessão, e
+// o perfil e as subcontas recebem senhas.
+var impersonationCredentialPaths = []string{
+	"/api/admin/api-keys",
+	"/api/admin/sub-accounts",
+	"/api/admin/profile",
+}
+
+// GenerateImpersonationToken cria o token de uma sessão nova; no banco fica
+// só o hash (HashAPIKey).
+func GenerateImpersonationToken() (token, hash string, err error) {
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", err
+	}
+	token = ImpersonationTokenPrefix + hex.EncodeToString(raw)
+	return token, HashAPIKey(token), nil
+}
+
+// impersonationStore isola public.impersonation_sessions para os testes.
+type impersonationStore interface {
+	byHash(ctx context.Context, hash string) (*Impersonation, error)
+}
+
+type dbImpersonationStore struct{}
+
+func (dbImpersonationStore) byHash(ctx context.Context, hash string) (*Impersonation, error) {
+	var s Impersonation
+	err := database.DB.QueryRow(ctx, `
+		SELECT id, actor_id, actor_role, target_id, allow_writes, reason, expires_at, ended_at, created_at
+		FROM public.impersonation_sessions WHERE token_hash = $1`, hash,
+	).Scan(&s.ID, &s.ActorID, &s.ActorRole, &s.TargetID, &s.AllowWrites, &s.Reason, &s.ExpiresAt, &s.EndedAt, &s.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Dependências da personificação, trocadas nos testes.
+var (
+	impersonations     impersonationStore = dbImpersonationStore{}
+	impersonationUsers userStore          = dbUserStore{}
+	impersonationNow                      = time.Now
+)
+
+// ImpersonationFromContext devolve a sessão de personificação da requisição.
+func ImpersonationFromContext(ctx context.Context) (*Impersonation, bool) {
+	s, ok := ctx.Value(ImpersonationKey).(*Impersonation)
+	return s, ok
+}
+
+// impersonationAllows aplica os limites da sessão: só rotas /api/admin e as
+// consultas de /api/auth, apenas leitura sem allow_writes e nunca escrita em
+// credenciais.
+func impersonationAllows(s *Impersonation, r *http.Request) error {
+	readOnly := r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions
+	switch {
+	case !strings.HasPrefix(r.URL.Path, "/api/admin/") && !(readOnly && strings.HasPrefix(r.URL.Path, "/api/auth/")):
+		return errImpersonationRoute
+	case readOnly:
+		return nil
+	case !s.AllowWrites:
+		return errImpersonationReadOnly
+	}
+	for _, p := range impersonationCredentialPaths {
+		if r.URL.Path == p || strings.HasPrefix(r.URL.Path, p+"/") {
+			return errImpersonationCreds
+		}
+	}
+	return nil
+}
+
+// authenticateImpersonation valida o token e injeta o usuário personificado
+// em UserIDKey/RoleKey, mantendo a sessão (e o Superadmin) em ImpersonationKey.
+// A cada requisição o alvo precisa continuar ativo e o Superadmin precisa
+// continuar ativo e com PermImpersonate, como em authenticateAPIKey.
+func authenticateImpersonation(w http.ResponseWriter, r *http.Request, token string, next http.Handler) {
+	s, err := impersonations.byHash(r.Context(), HashAPIKey(token))
+	if err != nil {
+		http.Error(w, errImpersonationInvalid.Error(), http.StatusUnauthorized)
+		return
+	}
+	switch {
+	case s.EndedAt != nil:
+		http.Error(w, errImpersonationEnded.Error(), http.StatusUnauthorized)
+		return
+	case !impersonationNow().Before(s.ExpiresAt):
+		http.Error(w, errImpersonationExpired.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err := impersonationAllows(s, r); err != nil {
+		http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+		return
+	}
+
+	user, err := impersonationUsers.byID(r.Context(), s.TargetID)
+	if err != nil {
+		log.Printf("ERROR: Impersonation target lookup failed: %v", fmt.Errorf("%w: id %d: %v", ErrUserNotFound, s.TargetID, err))
+		http.Error(w, "User not found or database error", http.StatusForbidden)
+		return
+	}
+	if user.Disabled {
+		http.Error(w, "Forbidden: "+ErrUserDisabled.Error(), http.StatusForbidden)
+		return
+	}
+	actor, err := impersonationUsers.byID(r.Context(), s.ActorID)
+	if err != nil || actor.Disabled || !HasPermission(r.Context(), actor.identity("").Role, PermImpersonate) {
+		if err != nil {
+			log.Printf("ERROR: Impersonation actor lookup failed: %v", fmt.Errorf("%w: id %d: %v", ErrUserNotFound, s.ActorID, err))
+		}
+		http.Error(w, "Forbidden: "+errImpersonationRevoked.Error(), http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set(ImpersonatedByHeader, strconv.FormatInt(s.ActorID, 10))
+	ctx := context.WithValue(r.Context(), UserIDKey, user.ID)
+	ctx = context.WithValue(ctx, RoleKey, user.identity("").Role)
+	ctx = context.WithValue(ctx, ImpersonationKey, s)
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
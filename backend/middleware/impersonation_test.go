@@ -0,0 +1,191 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type fakeImpersonationStore map[string]*Impersonation
+
+func (s fakeImpersonationStore) byHash(ctx context.Context, hash string) (*Impersonation, error) {
+	if imp, ok := s[hash]; ok {
+		copy := *imp
+		return &copy, nil
+	}
+	return nil, errNoRows
+}
+
+// useImpersonations troca as dependências da personificação e devolve uma
+// função que registra uma sessão e devolve o seu token.
+func useImpersonations(t *testing.T, now time.Time, users ...*authUser) func(s Impersonation) string {
+	t.Helper()
+	store := fakeImpersonationStore{}
+	prevStore, prevUsers, prevNow := impersonations, impersonationUsers, impersonationNow
+	impersonations, impersonationUsers = store, newFakeUserStore(users...)
+	impersonationNow = func() time.Time { return now }
+	t.Cleanup(func() { impersonations, impersonationUsers, impersonationNow = prevStore, prevUsers, prevNow })
+
+	return func(s Impersonation) string {
+		token, hash, err := GenerateImpersonationToken()
+		if err != nil {
+			t.Fatal(err)
+		}
+		store[hash] = &s
+		return token
+	}
+}
+
+func TestImpersonationTokenIsNotAnAPIKey(t *testing.T) {
+	token, hash, err := GenerateImpersonationToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(token, ImpersonationTokenPrefix) || strings.HasPrefix(token, APIKeyPrefix) {
+		t.Errorf("prefixo inesperado: %s", token)
+	}
+	if hash != HashAPIKey(token) {
+		t.Error("o hash deveria ser o mesmo de HashAPIKey")
+	}
+}
+
+func TestAuthenticateImpersonation(t *testing.T) {
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	ended := now.Add(-time.Minute)
+	usePermissionStore(t, &fakePermissionStore{perms: map[string][]string{RoleSuperadmin: {PermImpersonate}}}, time.Minute)
+	issue := useImpersonations(t, now,
+		&authUser{ID: 1, Role: 1}, &authUser{ID: 20, Role: 2}, &authUser{ID: 21, Role: 2, Disabled: true},
+		&authUser{ID: 2, Role: 1, Disabled: true}, &authUser{ID: 3, Role: 3})
+
+	active := Impersonation{ID: 1, ActorID: 1, ActorRole: RoleSuperadmin, TargetID: 20, ExpiresAt: now.Add(10 * time.Minute)}
+	writable := active
+	writable.AllowWrites = true
+	expired := active
+	expired.ExpiresAt = now
+	closed := active
+	closed.EndedAt = &ended
+	missingTarget := active
+	missingTarget.TargetID = 99
+	disabledTarget := active
+	disabledTarget.TargetID = 21
+	disabledActor := active
+	disabledActor.ActorID = 2
+	revokedActor := active
+	revokedActor.ActorID = 3
+	missingActor := active
+	missingActor.ActorID = 98
+
+	tests := []struct {
+		name       string
+		session    *Impersonation
+		method     string
+		path       string
+		wantStatus int
+	}{
+		{"leitura em /api/admin", &active, "GET", "/api/admin/domains", http.StatusOK},
+		{"consulta em /api/auth", &active, "GET", "/api/auth/me", http.StatusOK},
+		{"escrita sem allow_writes", &active, "PUT", "/api/admin/profile", http.StatusForbidden},
+		{"escrita com allow_writes", &writable, "PUT", "/api/admin/domains/7", http.StatusOK},
+		{"perfil mesmo com allow_writes", &writable, "PUT", "/api/admin/profile", http.StatusForbidden},
+		{"criar subconta mesmo com allow_writes", &writable, "POST", "/api/admin/sub-accounts", http.StatusForbidden},
+		{"alterar subconta mesmo com allow_writes", &writable, "PUT", "/api/admin/sub-accounts/30", http.StatusForbidden},
+		{"chave de API mesmo com allow_writes", &writable, "POST", "/api/admin/api-keys", http.StatusForbidden},
+		{"revogar chave mesmo com allow_writes", &writable, "DELETE", "/api/admin/api-keys/3", http.StatusForbidden},
+		{"troca de senha", &writable, "PUT", "/api/auth/update_password", http.StatusForbidden},
+		{"painel superadmin", &active, "GET", "/api/superadmin/users", http.StatusForbidden},
+		{"sessão expirada", &expired, "GET", "/api/admin/domains", http.StatusUnauthorized},
+		{"sessão encerrada", &closed, "GET", "/api/admin/domains", http.StatusUnauthorized},
+		{"usuário removido", &missingTarget, "GET", "/api/admin/domains", http.StatusForbidden},
+		{"usuário desativado", &disabledTarget, "GET", "/api/admin/domains", http.StatusForbidden},
+		{"superadmin desativado", &disabledActor, "GET", "/api/admin/domains", http.StatusForbidden},
+		{"superadmin sem a permissão", &revokedActor, "GET", "/api/admin/domains", http.StatusForbidden},
+		{"superadmin removido", &missingActor, "GET", "/api/admin/domains", http.StatusForbidden},
+		{"token desconhecido", nil, "GET", "/api/admin/domains", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := ImpersonationTokenPrefix + "desconhecido"
+			if tt.session != nil {
+				token = issue(*tt.session)
+			}
+
+			var gotUser int64
+			var gotRole string
+			var gotSession *Impersonation
+			h := Authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotUser, _ = r.Context().Value(UserIDKey).(int64)
+				gotRole, _ = r.Context().Value(RoleKey).(string)
+				gotSession, _ = ImpersonationFromContext(r.Context())
+			}))
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, esperado %d (%s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			if gotUser != 20 || gotRole != "2" {
+				t.Errorf("contexto deveria ter o usuário personificado, tem %d/%s", gotUser, gotRole)
+			}
+			if gotSession == nil || gotSession.ActorID != 1 {
+				t.Errorf("sessão não injetada no contexto: %+v", gotSession)
+			}
+			if rec.Header().Get(ImpersonatedByHeader) != "1" {
+				t.Errorf("%s = %q", ImpersonatedByHeader, rec.Header().Get(ImpersonatedByHeader))
+			}
+		})
+	}
+}
+
+func TestAuditRecordsRealActorWhenImpersonating(t *testing.T) {
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	usePermissionStore(t, &fakePermissionStore{perms: map[string][]string{RoleSuperadmin: {PermImpersonate}}}, time.Minute)
+	issue := useImpersonations(t, now, &authUser{ID: 1, Role: 1}, &authUser{ID: 20, Role: 2})
+	store := useAuditStore(t, map[string]string{"7": `{"id": 7, "name": "antigo.example.com"}`})
+	token := issue(Impersonation{ID: 5, ActorID: 1, ActorRole: RoleSuperadmin, TargetID: 20, AllowWrites: true, ExpiresAt: now.Add(time.Minute)})
+
+	r := mux.NewRouter()
+	admin := r.PathPrefix("/api/admin").Subrouter()
+	admin.Use(Authenticate, Audit)
+	admin.HandleFunc("/domains/{id}", func(w http.ResponseWriter, r *http.Request) {
+		store.state["7"] = `{"id": 7, "name": "novo.example.com"}`
+	}).Methods("PUT")
+	admin.HandleFunc("/domains", func(w http.ResponseWriter, r *http.Request) {}).Methods("GET")
+
+	for _, method := range []string{"PUT", "GET"} {
+		path := "/api/admin/domains/7"
+		if method == "GET" {
+			path = "/api/admin/domains"
+		}
+		req := httptest.NewRequest(method, path, strings.NewReader(`{"name": "novo.example.com"}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	if len(store.entries) != 2 {
+		t.Fatalf("esperadas 2 entradas (leituras personificadas também são auditadas), houve %d", len(store.entries))
+	}
+	for _, e := range store.entries {
+		if e.ActorID != 1 || e.ActorRole != RoleSuperadmin {
+			t.Errorf("o autor deveria ser o Superadmin: %+v", e)
+		}
+		if e.ImpersonationID == nil || *e.ImpersonationID != 5 || e.ImpersonatedID == nil || *e.ImpersonatedID != 20 {
+			t.Errorf("personificação não registrada: %+v", e)
+		}
+	}
+	if put := store.entries[0]; put.TargetID != "7" || !strings.Contains(string(put.Diff), `"after":"novo.example.com"`) {
+		t.Errorf("a alteração do domínio não foi registrada: %s/%s %s", put.TargetType, put.TargetID, put.Diff)
+	}
+	if get := store.entries[1]; get.Before != nil || get.Diff != nil {
+		t.Errorf("leituras não deveriam gerar snapshots: %+v", get)
+	}
+}
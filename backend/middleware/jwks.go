@@ -0,0 +1,192 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v3/jwk"
+)
+
+// JWKSOptions controla o cache de chaves públicas.
+type JWKSOptions struct {
+	// RefreshInterval é o intervalo da atualização em segundo plano (padrão 15 min).
+	RefreshInterval time.Duration
+	// MinRefreshInterval limita as atualizações disparadas por um "kid"
+	// desconhecido, para que tokens forjados não gerem uma requisição cada (padrão 30 s).
+	MinRefreshInterval time.Duration
+	// FetchTimeout limita cada download do JWKS (padrão 10 s).
+	FetchTimeout time.Duration
+	// HTTPClient usado no download (padrão http.DefaultClient).
+	HTTPClient *http.Client
+}
+
+// ErrJWKSUnavailable indica que nenhum conjunto de chaves foi obtido ainda.
+var ErrJWKSUnavailable = errors.New("jwks: no key set available")
+
+// JWKSCache mantém o JWKS em memória. Uma falha de download nunca descarta o
+// último conjunto válido (stale-while-error).
+type JWKSCache struct {
+	url  string
+	opts JWKSOptions
+
+	mu          sync.RWMutex
+	set         jwk.Set
+	fetchedAt   time.Time
+	lastAttempt time.Time
+	lastErr     error
+
+	// refreshMu serializa os downloads; requisições concorrentes com o mesmo
+	// kid desconhecido aguardam a mesma atualização.
+	refreshMu sync.Mutex
+}
+
+// NewJWKSCache cria o cache sem fazer nenhum download.
+func NewJWKSCache(url string, opts JWKSOptions) *JWKSCache {
+	if opts.RefreshInterval <= 0 {
+		opts.RefreshInterval = 15 * time.Minute
+	}
+	if opts.MinRefreshInterval <= 0 {
+		opts.MinRefreshInterval = 30 * time.Second
+	}
+	if opts.FetchTimeout <= 0 {
+		opts.FetchTimeout = 10 * time.Second
+	}
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = http.DefaultClient
+	}
+	return &JWKSCache{url: url, opts: opts}
+}
+
+// Start atualiza o JWKS a cada RefreshInterval até ctx ser cancelado.
+func (c *JWKSCache) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(c.opts.RefreshInterval)
+		defer ticker.Stop()
+
+		for {
+			if err := c.Refresh(ctx); err != nil {
+				log.Printf("JWKS: background refresh failed: %v", err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Refresh baixa o JWKS. Em caso de erro o conjunto anterior é mantido.
+func (c *JWKSCache) Refresh(ctx context.Context) error {
+	c.refreshMu.Lock()
+	defer c.refreshMu.Unlock()
+	return c.refresh(ctx)
+}
+
+func (c *JWKSCache) refresh(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, c.opts.FetchTimeout)
+	defer cancel()
+
+	set, err := jwk.Fetch(ctx, c.url, jwk.WithHTTPClient(c.opts.HTTPClient))
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lastAttempt = now
+	c.lastErr = err
+	if err != nil {
+		return fmt.Errorf("jwks: fetch %s: %w", c.url, err)
+	}
+	c.set = set
+	c.fetchedAt = now
+	return nil
+}
+
+// KeySet retorna o conjunto em cache, baixando-o se ainda não existir.
+func (c *JWKSCache) KeySet(ctx context.Context) (jwk.Set, error) {
+	if set := c.cached(); set != nil {
+		return set, nil
+	}
+
+	c.refreshMu.Lock()
+	defer c.refreshMu.Unlock()
+
+	// Outra goroutine pode ter baixado enquanto esperávamos
+	if set := c.cached(); set != nil {
+		return set, nil
+	}
+	if !c.canRetry() {
+		return nil, c.unavailable()
+	}
+	if err := c.refresh(ctx); err != nil {
+		return nil, err
+	}
+	return c.cached(), nil
+}
+
+// KeySetFor retorna um conjunto que contém kid. Se o kid não estiver no cache
+// (rotação de chaves), força uma atualização respeitando MinRefreshInterval.
+// Se a atualização falhar, devolve o conjunto antigo; a validação do token é
+// que vai rejeitar a assinatura.
+func (c *JWKSCache) KeySetFor(ctx context.Context, kid string) (jwk.Set, error) {
+	set, err := c.KeySet(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if kid == "" {
+		return set, nil
+	}
+	if _, ok := set.LookupKeyID(kid); ok {
+		return set, nil
+	}
+
+	c.refreshMu.Lock()
+	defer c.refreshMu.Unlock()
+
+	if current := c.cached(); current != set {
+		return current, nil // Já atualizado por outra requisição
+	}
+	if !c.canRetry() {
+		return set, nil
+	}
+	if err := c.refresh(ctx); err != nil {
+		log.Printf("JWKS: refresh for unknown kid %q failed, using cached keys: %v", kid, err)
+		return set, nil
+	}
+	return c.cached(), nil
+}
+
+// FetchedAt retorna quando o conjunto atual foi baixado.
+func (c *JWKSCache) FetchedAt() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.fetchedAt
+}
+
+func (c *JWKSCache) cached() jwk.Set {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.set
+}
+
+func (c *JWKSCache) canRetry() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.lastAttempt.IsZero() || time.Since(c.lastAttempt) >= c.opts.MinRefreshInterval
+}
+
+func (c *JWKSCache) unavailable() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.lastErr != nil {
+		return fmt.Errorf("%w: %v", ErrJWKSUnavailable, c.lastErr)
+	}
+	return ErrJWKSUnavailable
+}
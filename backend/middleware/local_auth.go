@@ -0,0 +1,354 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"CDNProxy_v2/backend/services/mailer"
+
+	"github.com/lestrrat-go/jwx/v3/jwa"
+	jwxjwt "github.com/lestrrat-go/jwx/v3/jwt"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// LocalAuthConfig configura o modo auto-hospedado.
+type LocalAuthConfig struct {
+	// Secret assina os tokens (HS256). Obrigatório, mínimo de 32 bytes.
+	Secret string
+	// Issuer gravado e exigido na claim "iss" (padrão "cdnproxy").
+	Issuer string
+	// Audience gravada e exigida na claim "aud" (padrão "authenticated").
+	Audience string
+	// TokenTTL é a validade do access token (padrão 1 hora).
+	TokenTTL time.Duration
+	// ResetTokenTTL é a validade do link de recuperação (padrão 1 hora).
+	ResetTokenTTL time.Duration
+	// RefreshTokenTTL é a validade do refresh token (padrão 30 dias).
+	RefreshTokenTTL time.Duration
+}
+
+// LocalAuthenticator autentica com os hashes bcrypt de
+// public.users.encrypted_password e emite JWTs próprios.
+type LocalAuthenticator struct {
+	cfg      LocalAuthConfig
+	users    userStore
+	sendMail func(mailer.Message) error
+	now      func() time.Time
+}
+
+// NewLocalAuthenticator valida cfg e aplica os padrões.
+func NewLocalAuthenticator(cfg LocalAuthConfig) (*LocalAuthenticator, error) {
+	if len(cfg.Secret) < 32 {
+		return nil, errors.New("AUTH_JWT_SECRET must have at least 32 characters")
+	}
+	if cfg.Issuer == "" {
+		cfg.Issuer = "cdnproxy"
+	}
+	if cfg.Audience == "" {
+		cfg.Audience = "authenticated"
+	}
+	if cfg.TokenTTL <= 0 {
+		cfg.TokenTTL = time.Hour
+	}
+	if cfg.ResetTokenTTL <= 0 {
+		cfg.ResetTokenTTL = time.Hour
+	}
+	if cfg.RefreshTokenTTL <= 0 {
+		cfg.RefreshTokenTTL = DefaultRefreshTokenTTL
+	}
+	return &LocalAuthenticator{
+		cfg:      cfg,
+		users:    dbUserStore{},
+		sendMail: mailer.Send,
+		now:      time.Now,
+	}, nil
+}
+
+// Login confere a senha com bcrypt e abre uma sessão com access e refresh token.
+func (a *LocalAuthenticator) Login(ctx context.Context, email, password string) (*Session, error) {
+	user, err := a.users.byEmail(ctx, email)
+	if err != nil || !isBcryptHash(user.PasswordHash) {
+		// Compara mesmo assim para não revelar, pelo tempo de resposta, se o e-mail existe
+		bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return nil, ErrInvalidCredentials
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	if user.Disabled {
+		return nil, ErrUserDisabled
+	}
+
+	sessionID, err := newSessionID()
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, refreshExpires, err := a.newRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	session, err := a.issue(user, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if err := sessions.start(ctx, &AuthSession{
+		SessionID:        sessionID,
+		UserID:           user.ID,
+		CreatedAt:        a.now(),
+		RefreshExpiresAt: &refreshExpires,
+	}, hashResetToken(refreshToken)); err != nil {
+		return nil, err
+	}
+	session.RefreshToken = refreshToken
+	return session, nil
+}
+
+// Refresh troca o refresh token por outro (o anterior deixa de valer) e emite
+// um access token da mesma sessão.
+func (a *LocalAuthenticator) Refresh(ctx context.Context, refreshToken string) (*Session, error) {
+	if refreshToken == "" {
+		return nil, ErrInvalidRefreshToken
+	}
+	hash := hashResetToken(refreshToken)
+	s, err := sessions.byRefreshHash(ctx, hash)
+	if err != nil {
+		return nil, ErrInvalidRefreshToken
+	}
+	if s.RevokedAt != nil || s.RefreshExpiresAt == nil || !a.now().Before(*s.RefreshExpiresAt) {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	user, err := a.users.byID(ctx, s.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("%w: id %d: %v", ErrUserNotFound, s.UserID, err)
+	}
+	if err := checkSession(ctx, user, s.SessionID, s.CreatedAt); err != nil {
+		return nil, err
+	}
+
+	next, expires, err := a.newRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	session, err := a.issue(user, s.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	if err := sessions.rotate(ctx, s.SessionID, hash, hashResetToken(next), expires, a.now()); err != nil {
+		// Outro refresh trocou o mesmo token antes: a sessão é encerrada
+		if errors.Is(err, ErrInvalidRefreshToken) {
+			if err := sessions.revoke(ctx, s.UserID, s.SessionID, RevokedByRefreshReuse, a.now()); err != nil {
+				log.Printf("ERROR: Could not revoke session %s after refresh token reuse: %v", s.SessionID, err)
+			}
+		}
+		return nil, err
+	}
+	session.RefreshToken = next
+	return session, nil
+}
+
+// Logout não tem o que fazer no modo local: a sessão é revogada em
+// public.auth_sessions por RevokeSession.
+func (a *LocalAuthenticator) Logout(ctx context.Context, accessToken string) error {
+	return nil
+}
+
+// newRefreshToken gera um refresh token opaco e a sua validade.
+func (a *LocalAuthenticator) newRefreshToken() (string, time.Time, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", time.Time{}, err
+	}
+	return hex.EncodeToString(raw), a.now().Add(a.cfg.RefreshTokenTTL), nil
+}
+
+func (a *LocalAuthenticator) issue(user *authUser, sessionID string) (*Session, error) {
+	now := a.now()
+	expires := now.Add(a.cfg.TokenTTL)
+
+	tok, err := jwxjwt.NewBuilder().
+		Subject(strconv.FormatInt(user.ID, 10)).
+		Issuer(a.cfg.Issuer).
+		Audience([]string{a.cfg.Audience}).
+		IssuedAt(now).
+		NotBefore(now).
+		Expiration(expires).
+		Claim("email", user.Email).
+		Claim("session_id", sessionID).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+
+	signed, err := jwxjwt.Sign(tok, jwxjwt.WithKey(jwa.HS256(), []byte(a.cfg.Secret)))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Session{
+		AccessToken: string(signed),
+		TokenType:   "bearer",
+		ExpiresIn:   int64(a.cfg.TokenTTL / time.Second),
+		ExpiresAt:   expires.Unix(),
+		User: SessionUser{
+			ID:    strconv.FormatInt(user.ID, 10),
+			Email: user.Email,
+		},
+	}, nil
+}
+
+// Authenticate valida um token emitido por Login.
+func (a *LocalAuthenticator) Authenticate(ctx context.Context, tokenString string) (*Identity, error) {
+	token, err := jwxjwt.ParseString(tokenString,
+		jwxjwt.WithKey(jwa.HS256(), []byte(a.cfg.Secret)),
+		jwxjwt.WithValidate(true),
+		jwxjwt.WithIssuer(a.cfg.Issuer),
+		jwxjwt.WithAudience(a.cfg.Audience),
+		jwxjwt.WithClock(jwxjwt.ClockFunc(a.now)),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	subject, _ := token.Subject()
+	userID, err := strconv.ParseInt(subject, 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid subject claim")
+	}
+
+	user, err := a.users.byID(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("%w: id %d: %v", ErrUserNotFound, userID, err)
+	}
+	identity := user.identity(subject)
+	token.Get("session_id", &identity.SessionID)
+	identity.SessionID = identity.SessionIDFor(tokenString)
+	issuedAt, _ := token.IssuedAt()
+	if err := checkSession(ctx, user, identity.SessionID, issuedAt); err != nil {
+		return nil, err
+	}
+	return identity, nil
+}
+
+// RequestPasswordReset grava o hash de um token aleatório e envia o link
+// redirectTo?token=... por e-mail. E-mails desconhecidos não geram erro, para
+// não revelar quais contas existem.
+func (a *LocalAuthenticator) RequestPasswordReset(ctx context.Context, email, redirectTo string) error {
+	user, err := a.users.byEmail(ctx, email)
+	if err != nil {
+		return nil
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return err
+	}
+	token := hex.EncodeToString(raw)
+
+	if err := a.users.setResetToken(ctx, user.ID, hashResetToken(token), a.now()); err != nil {
+		return err
+	}
+
+	link, err := url.Parse(redirectTo)
+	if err != nil {
+		return fmt.Errorf("invalid redirect URL: %w", err)
+	}
+	q := link.Query()
+	q.Set("token", token)
+	link.RawQuery = q.Encode()
+
+	if err := a.sendMail(mailer.Message{
+		To:      user.Email,
+		Subject: "Recuperação de senha",
+		HTML: fmt.Sprintf(`<p>Recebemos um pedido para redefinir sua senha.</p>
+<p><a href="%s">Clique aqui para criar uma nova senha</a>. O link expira em %d minutos.</p>
+<p>Se você não fez este pedido, ignore este e-mail.</p>`, link.String(), int(a.cfg.ResetTokenTTL/time.Minute)),
+	}); err != nil {
+		log.Printf("ERROR: Failed to send password reset e-mail to user %d: %v", user.ID, err)
+		return err
+	}
+	return nil
+}
+
+// ResetPassword troca a senha se o token existir e não tiver expirado. O
+// token só pode ser usado uma vez.
+func (a *LocalAuthenticator) ResetPassword(ctx context.Context, resetToken, password string) error {
+	if resetToken == "" {
+		return ErrInvalidResetToken
+	}
+	user, err := a.users.byResetToken(ctx, hashResetToken(resetToken))
+	if err != nil {
+		return ErrInvalidResetToken
+	}
+	if user.ResetSentAt == nil || a.now().Sub(*user.ResetSentAt) > a.cfg.ResetTokenTTL {
+		return ErrInvalidResetToken
+	}
+	return a.SetPassword(ctx, user.ID, password)
+}
+
+// SetPassword grava o hash bcrypt da nova senha e invalida links de recuperação pendentes.
+func (a *LocalAuthenticator) SetPassword(ctx context.Context, userID int64, password string) error {
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	return a.users.setPasswordHash(ctx, userID, hash)
+}
+
+// CreateCredentials grava o hash da senha inicial.
+func (a *LocalAuthenticator) CreateCredentials(ctx context.Context, userID int64, email, password string) error {
+	return a.SetPassword(ctx, userID, password)
+}
+
+// HashPassword gera o hash bcrypt usado em public.users.encrypted_password.
+func HashPassword(password string) (string, error) {
+	if len(password) < MinPasswordLength {
+		return "", fmt.Errorf("password must be at least %d characters", MinPasswordLength)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+var (
+	dummyHashOnce  sync.Once
+	dummyHashValue []byte
+)
+
+// dummyHash é comparado quando o usuário não existe, igualando o tempo de resposta.
+func dummyHash() []byte {
+	dummyHashOnce.Do(func() {
+		dummyHashValue, _ = bcrypt.GenerateFromPassword([]byte("cdnproxy-dummy-password"), bcrypt.DefaultCost)
+	})
+	return dummyHashValue
+}
+
+func isBcryptHash(h string) bool {
+	_, err := bcrypt.Cost([]byte(h))
+	return err == nil
+}
+
+func hashResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newSessionID identifica a sessão na claim session_id, como no Supabase.
+func newSessionID() (string, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
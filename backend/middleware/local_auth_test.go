@@ -0,0 +1,180 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+
+	"CDNProxy_v2/backend/services/mailer"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const testSecret = "segredo-de-teste-com-pelo-menos-32-bytes"
+
+func newTestLocalAuth(t *testing.T) (*LocalAuthenticator, *fakeUserStore, *[]mailer.Message) {
+	t.Helper()
+	a, err := NewLocalAuthenticator(LocalAuthConfig{Secret: testSecret})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("senha-correta"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newFakeUserStore(
+		&authUser{ID: 7, Email: "admin@example.com", Role: 2, PasswordHash: string(hash)},
+		&authUser{ID: 8, Email: "semsenha@example.com", Role: 2},
+	)
+	a.users = store
+	now := time.Now()
+	useSessionStore(t, &now)
+
+	var sent []mailer.Message
+	a.sendMail = func(m mailer.Message) error {
+		sent = append(sent, m)
+		return nil
+	}
+	return a, store, &sent
+}
+
+func TestNewLocalAuthenticatorRequiresSecret(t *testing.T) {
+	if _, err := NewLocalAuthenticator(LocalAuthConfig{Secret: "curto"}); err == nil {
+		t.Error("esperado erro com segredo curto")
+	}
+}
+
+func TestLocalLoginAndAuthenticate(t *testing.T) {
+	a, _, _ := newTestLocalAuth(t)
+	useAuthenticator(t, a)
+
+	session, err := a.Login(context.Background(), "Admin@Example.com", "senha-correta")
+	if err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	if session.User.ID != "7" || session.ExpiresIn != 3600 || session.TokenType != "bearer" {
+		t.Errorf("sessão inesperada: %+v", session)
+	}
+
+	res := callProtected(session.AccessToken)
+	if res.code != http.StatusOK || res.userID != 7 || res.role != "2" {
+		t.Errorf("token local rejeitado: %+v", res)
+	}
+
+	identity, err := a.Authenticate(context.Background(), session.AccessToken)
+	if err != nil || len(identity.SessionID) != 32 {
+		t.Errorf("o token deveria trazer a claim session_id: %+v %v", identity, err)
+	}
+	other, _ := a.Login(context.Background(), "admin@example.com", "senha-correta")
+	if second, _ := a.Authenticate(context.Background(), other.AccessToken); second.SessionID == identity.SessionID {
+		t.Error("cada login deveria abrir uma sessão nova")
+	}
+}
+
+func TestLocalLoginRejectsInvalidCredentials(t *testing.T) {
+	a, _, _ := newTestLocalAuth(t)
+
+	for _, tt := range []struct{ email, password string }{
+		{"admin@example.com", "senha-errada"},
+		{"naoexiste@example.com", "senha-correta"},
+		{"semsenha@example.com", ""}, // sem hash bcrypt (usuário do Supabase)
+	} {
+		if _, err := a.Login(context.Background(), tt.email, tt.password); !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("%s: esperado ErrInvalidCredentials, recebeu %v", tt.email, err)
+		}
+	}
+}
+
+func TestLocalAuthenticateRejectsTokens(t *testing.T) {
+	a, _, _ := newTestLocalAuth(t)
+	useAuthenticator(t, a)
+
+	// Token emitido com outro segredo
+	other, _ := NewLocalAuthenticator(LocalAuthConfig{Secret: "outro-segredo-com-pelo-menos-32-bytes!!"})
+	other.users = a.users
+	forged, err := other.Login(context.Background(), "admin@example.com", "senha-correta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := callProtected(forged.AccessToken); res.code != http.StatusUnauthorized {
+		t.Errorf("token de outro segredo: esperado 401, recebeu %d", res.code)
+	}
+
+	// Token expirado
+	a.now = func() time.Time { return time.Now().Add(-2 * time.Hour) }
+	expired, err := a.Login(context.Background(), "admin@example.com", "senha-correta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.now = time.Now
+	if res := callProtected(expired.AccessToken); res.code != http.StatusUnauthorized {
+		t.Errorf("token expirado: esperado 401, recebeu %d", res.code)
+	}
+}
+
+func TestLocalPasswordResetFlow(t *testing.T) {
+	a, _, sent := newTestLocalAuth(t)
+	ctx := context.Background()
+
+	if err := a.RequestPasswordReset(ctx, "naoexiste@example.com", "https://app.example.com/update-password"); err != nil || len(*sent) != 0 {
+		t.Fatalf("e-mail desconhecido não deve falhar nem enviar e-mail: %v, %d", err, len(*sent))
+	}
+
+	if err := a.RequestPasswordReset(ctx, "admin@example.com", "https://app.example.com/update-password"); err != nil {
+		t.Fatalf("RequestPasswordReset: %v", err)
+	}
+	if len(*sent) != 1 || (*sent)[0].To != "admin@example.com" {
+		t.Fatalf("esperado um e-mail para admin@example.com, recebeu %+v", *sent)
+	}
+
+	token := extractResetToken(t, (*sent)[0].HTML)
+
+	if err := a.ResetPassword(ctx, "token-errado", "nova-senha"); !errors.Is(err, ErrInvalidResetToken) {
+		t.Errorf("token errado: esperado ErrInvalidResetToken, recebeu %v", err)
+	}
+	if err := a.ResetPassword(ctx, token, "nova-senha"); err != nil {
+		t.Fatalf("ResetPassword: %v", err)
+	}
+	if _, err := a.Login(ctx, "admin@example.com", "nova-senha"); err != nil {
+		t.Errorf("login com a nova senha falhou: %v", err)
+	}
+	if err := a.ResetPassword(ctx, token, "outra-senha"); !errors.Is(err, ErrInvalidResetToken) {
+		t.Errorf("o token deve valer uma única vez, recebeu %v", err)
+	}
+}
+
+func TestLocalPasswordResetExpires(t *testing.T) {
+	a, _, sent := newTestLocalAuth(t)
+	ctx := context.Background()
+
+	if err := a.RequestPasswordReset(ctx, "admin@example.com", "https://app.example.com/update-password"); err != nil {
+		t.Fatal(err)
+	}
+	token := extractResetToken(t, (*sent)[0].HTML)
+
+	a.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	if err := a.ResetPassword(ctx, token, "nova-senha"); !errors.Is(err, ErrInvalidResetToken) {
+		t.Errorf("token expirado: esperado ErrInvalidResetToken, recebeu %v", err)
+	}
+}
+
+func TestHashPasswordMinLength(t *testing.T) {
+	if _, err := HashPassword("12345"); err == nil {
+		t.Error("esperado erro para senha curta")
+	}
+}
+
+var resetLinkToken = regexp.MustCompile(`[?&]token=([0-9a-f]+)`)
+
+func extractResetToken(t *testing.T, html string) string {
+	t.Helper()
+	m := resetLinkToken.FindStringSubmatch(html)
+	if m == nil {
+		t.Fatalf("e-mail sem link de recuperação: %s", html)
+	}
+	return m[1]
+}
@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	"net/http"
+	"time"
+
+	"CDNProxy_v2/backend/services/metrics"
+
+	"github.com/gorilla/mux"
+)
+
+// statusRecorder guarda o status enviado ao cliente.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap permite que o http.ResponseController alcance o writer original.
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Metrics conta as requisições e mede a latência por rota. Deve ser registrado
+// com router.Use para que o template da rota (ex: /api/admin/domains/{id}) já
+// esteja resolvido, mantendo a cardinalidade do rótulo "route" limitada.
+func Metrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unmatched"
+		if current := mux.CurrentRoute(r); current != nil {
+			if tpl, err := current.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		method := metrics.MethodLabel(r.Method)
+		metrics.HTTPRequests.Inc(route, method, metrics.StatusLabel(rec.status))
+		metrics.HTTPDuration.Observe(time.Since(start).Seconds(), route, method)
+	})
+}
@@ -0,0 +1,546 @@
+package middleware
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"CDNProxy_v2/backend/database"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Parâmetros do TOTP (RFC 6238), os padrões dos aplicativos autenticadores.
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	// totpSkew aceita o código do intervalo anterior e do seguinte, para
+	// relógios levemente dessincronizados.
+	totpSkew = 1
+	// TOTPIssuer aparece no aplicativo autenticador.
+	TOTPIssuer = "CDNProxy"
+)
+
+// RecoveryCodeCount é quantos códigos de recuperação são gerados por vez.
+const RecoveryCodeCount = 10
+
+// StepUpWindow é por quanto tempo uma verificação vale para RequireStepUp.
+const StepUpWindow = 5 * time.Minute
+
+// mfaSessionRetention é por quanto tempo uma sessão verificada é lembrada;
+// acima do tempo de vida de qualquer access token.
+const mfaSessionRetention = 30 * 24 * time.Hour
+
+// MFARequiredHeader indica ao frontend o que falta: "enroll", "verify" ou
+// "step-up".
+const MFARequiredHeader = "X-MFA-Required"
+
+var (
+	// ErrInvalidMFACode indica código TOTP ou de recuperação incorreto ou já usado.
+	ErrInvalidMFACode = errors.New("invalid or already used two-factor code")
+	// ErrMFANotEnrolled indica que o usuário não tem o segundo fator ativo.
+	ErrMFANotEnrolled = errors.New("two-factor authentication is not enabled")
+	// ErrMFAAlreadyEnabled indica cadastro de um fator já ativo.
+	ErrMFAAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+	// ErrMFARequired indica tentativa de desativar o fator em uma role que o exige.
+	ErrMFARequired = errors.New("two-factor authentication is required for this role")
+)
+
+// MFARequiredFor informa se a role exige o segundo fator mesmo sem cadastro.
+func MFARequiredFor(role string) bool {
+	return role == RoleSuperadmin
+}
+
+// mfaState é a parte de public.users usada pelo segundo fator.
+type mfaState struct {
+	Secret        string
+	Enabled       bool
+	LastStep      int64
+	RecoveryCodes int
+}
+
+// mfaSession é uma linha de public.mfa_sessions.
+type mfaSession struct {
+	VerifiedAt time.Time
+	StepUpAt   time.Time
+}
+
+// mfaStore isola as tabelas do segundo fator para os testes.
+type mfaStore interface {
+	state(ctx context.Context, userID int64) (*mfaState, error)
+	setPendingSecret(ctx context.Context, userID int64, secret string) error
+	enable(ctx context.Context, userID, step int64, codeHashes []string) error
+	disable(ctx context.Context, userID int64) error
+	// useStep grava o intervalo aceito; devolve false se ele não for
+	// posterior ao último usado.
+	useStep(ctx context.Context, userID, step int64) (bool, error)
+	useRecoveryCode(ctx context.Context, userID int64, codeHash string) (bool, error)
+	replaceRecoveryCodes(ctx context.Context, userID int64, codeHashes []string) error
+	// session devolve nil, sem erro, para sessões não verificadas.
+	session(ctx context.Context, userID int64, sessionID string) (*mfaSession, error)
+	markSession(ctx context.Context, userID int64, sessionID string, at time.Time) error
+}
+
+type dbMFAStore struct{}
+
+func (dbMFAStore) state(ctx context.Context, userID int64) (*mfaState, error) {
+	var s mfaState
+	err := database.DB.QueryRow(ctx, `
+		SELECT COALESCE(totp_secret, ''), totp_enabled_at IS NOT NULL, totp_last_step,
+			(SELECT COUNT(*) FROM public.user_recovery_codes WHERE user_id = $1 AND used_at IS NULL)
+		FROM public.users WHERE id = $1`, userID,
+	).Scan(&s.Secret, &s.Enabled, &s.LastStep, &s.RecoveryCodes)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (dbMFAStore) setPendingSecret(ctx context.Context, userID int64, secret string) error {
+	tag, err := database.DB.Exec(ctx,
+		"UPDATE public.users SET totp_secret = $1, updated_at = NOW() WHERE id = $2 AND totp_enabled_at IS NULL",
+		secret, userID)
+	if err == nil && tag.RowsAffected() == 0 {
+		return ErrMFAAlreadyEnabled
+	}
+	return err
+}
+
+func (s dbMFAStore) enable(ctx context.Context, userID, step int64, codeHashes []string) error {
+	tx, err := database.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, `
+		UPDATE public.users SET totp_enabled_at = NOW(), totp_last_step = $1, updated_at = NOW()
+		WHERE id = $2 AND totp_enabled_at IS NULL AND totp_secret IS NOT NULL`, step, userID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrMFAAlreadyEnabled
+	}
+	if err := insertRecoveryCodes(ctx, tx, userID, codeHashes); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func (dbMFAStore) disable(ctx context.Context, userID int64) error {
+	tx, err := database.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	for _, q := range []string{
+		"UPDATE public.users SET totp_secret = NULL, totp_enabled_at = NULL, totp_last_step = 0, updated_at = NOW() WHERE id = $1",
+		"DELETE FROM public.user_recovery_codes WHERE user_id = $1",
+		"DELETE FROM public.mfa_sessions WHERE user_id = $1",
+	} {
+		if _, err := tx.Exec(ctx, q, userID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+func (dbMFAStore) useStep(ctx context.Context, userID, step int64) (bool, error) {
+	tag, err := database.DB.Exec(ctx,
+		"UPDATE public.users SET totp_last_step = $1 WHERE id = $2 AND totp_last_step < $1", step, userID)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+func (dbMFAStore) useRecoveryCode(ctx context.Context, userID int64, codeHash string) (bool, error) {
+	tag, err := database.DB.Exec(ctx,
+		"UPDATE public.user_recovery_codes SET used_at = NOW() WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL",
+		userID, codeHash)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+func (dbMFAStore) replaceRecoveryCodes(ctx context.Context, userID int64, codeHashes []string) error {
+	tx, err := database.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "DELETE FROM public.user_recovery_codes WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+	if err := insertRecoveryCodes(ctx, tx, userID, codeHashes); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func insertRecoveryCodes(ctx context.Context, tx pgx.Tx, userID int64, codeHashes []string) error {
+	_, err := tx.Exec(ctx, `
+		INSERT INTO public.user_recovery_codes (user_id, code_hash)
+		SELECT $1, h FROM unnest($2::text[]) AS h`, userID, codeHashes)
+	return err
+}
+
+func (dbMFAStore) session(ctx context.Context, userID int64, sessionID string) (*mfaSession, error) {
+	if database.DB == nil {
+		return nil, errors.New("database not connected")
+	}
+	var s mfaSession
+	err := database.DB.QueryRow(ctx,
+		"SELECT verified_at, step_up_at FROM public.mfa_sessions WHERE user_id = $1 AND session_id = $2",
+		userID, sessionID,
+	).Scan(&s.VerifiedAt, &s.StepUpAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (dbMFAStore) markSession(ctx context.Context, userID int64, sessionID string, at time.Time) error {
+	if _, err := database.DB.Exec(ctx, `
+		INSERT INTO public.mfa_sessions (session_id, user_id, verified_at, step_up_at) VALUES ($1, $2, $3, $3)
+		ON CONFLICT (user_id, session_id) DO UPDATE SET step_up_at = EXCLUDED.step_up_at`,
+		sessionID, userID, at); err != nil {
+		return err
+	}
+	// Sessões antigas já expiraram no provedor; a limpeza aproveita a escrita
+	_, err := database.DB.Exec(ctx,
+		"DELETE FROM public.mfa_sessions WHERE user_id = $1 AND verified_at < $2", userID, at.Add(-mfaSessionRetention))
+	return err
+}
+
+// Dependências do segundo fator, trocadas nos testes.
+var (
+	mfa    mfaStore = dbMFAStore{}
+	mfaNow          = time.Now
+)
+
+// GenerateTOTPSecret cria um segredo de 160 bits em base32 sem padding.
+func GenerateTOTPSecret() (string, error) {
+	raw := make([]byte, 20)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(raw), nil
+}
+
+// TOTPURI monta o otpauth:// lido pelos aplicativos (normalmente via QR code).
+func TOTPURI(secret, account string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", TOTPIssuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+	label := url.PathEscape(TOTPIssuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+// totpCode calcula o código do intervalo step (HOTP, RFC 4226).
+func totpCode(key []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	n := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, n%1000000)
+}
+
+// ValidateTOTP confere code contra secret no instante now, com tolerância de
+// um intervalo para cada lado. Devolve o intervalo que casou, usado contra
+// reutilização do mesmo código.
+func ValidateTOTP(secret, code string, now time.Time) (int64, bool) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secret))
+	if err != nil || len(key) == 0 {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// generateRecoveryCodes devolve os códigos em claro (xxxxx-xxxxx) e os hashes
+// gravados no banco.
+func generateRecoveryCodes() (codes, hashes []string, err error) {
+	for range RecoveryCodeCount {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		h := hex.EncodeToString(raw)
+		code := h[:5] + "-" + h[5:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode ignora maiúsculas, espaços e o hífen digitados.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	return HashAPIKey(code)
+}
+
+// MFAStatus é o estado do segundo fator de um usuário na sessão atual.
+type MFAStatus struct {
+	Enabled bool `json:"enabled"`
+	// Required indica que a sessão não acessa as rotas protegidas até
+	// cadastrar (Enabled false) ou verificar o segundo fator.
+	Required      bool       `json:"required"`
+	Verified      bool       `json:"verified"`
+	StepUpUntil   *time.Time `json:"step_up_until,omitempty"`
+	RecoveryCodes int        `json:"recovery_codes_remaining"`
+}
+
+// MFAStatusFor consulta o estado do segundo fator do usuário na sessão.
+func MFAStatusFor(ctx context.Context, userID int64, role, sessionID string) (*MFAStatus, error) {
+	st, err := mfa.state(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	out := &MFAStatus{Enabled: st.Enabled, RecoveryCodes: st.RecoveryCodes}
+	sess, err := mfa.session(ctx, userID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if sess != nil {
+		out.Verified = true
+		until := sess.StepUpAt.Add(StepUpWindow)
+		if until.After(mfaNow()) {
+			out.StepUpUntil = &until
+		}
+	}
+	out.Required = (st.Enabled || MFARequiredFor(role)) && !out.Verified
+	return out, nil
+}
+
+// BeginTOTPEnrollment grava um segredo novo, ainda inativo, e devolve o
+// segredo e o otpauth:// para o aplicativo.
+func BeginTOTPEnrollment(ctx context.Context, userID int64, account string) (secret, uri string, err error) {
+	st, err := mfa.state(ctx, userID)
+	if err != nil {
+		return "", "", err
+	}
+	if st.Enabled {
+		return "", "", ErrMFAAlreadyEnabled
+	}
+	secret, err = GenerateTOTPSecret()
+	if err != nil {
+		return "", "", err
+	}
+	if err := mfa.setPendingSecret(ctx, userID, secret); err != nil {
+		return "", "", err
+	}
+	return secret, TOTPURI(secret, account), nil
+}
+
+// ConfirmTOTPEnrollment ativa o segredo pendente com o primeiro código do
+// aplicativo, marca a sessão atual como verificada e devolve os códigos de
+// recuperação, exibidos uma única vez.
+func ConfirmTOTPEnrollment(ctx context.Context, userID int64, sessionID, code string) ([]string, error) {
+	st, err := mfa.state(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if st.Enabled {
+		return nil, ErrMFAAlreadyEnabled
+	}
+	if st.Secret == "" {
+		return nil, ErrMFANotEnrolled
+	}
+	now := mfaNow()
+	step, ok := ValidateTOTP(st.Secret, code, now)
+	if !ok {
+		return nil, ErrInvalidMFACode
+	}
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	if err := mfa.enable(ctx, userID, step, hashes); err != nil {
+		return nil, err
+	}
+	return codes, mfa.markSession(ctx, userID, sessionID, now)
+}
+
+// checkMFACode aceita um código TOTP ou, se code estiver vazio, um código de
+// recuperação, que é consumido.
+func checkMFACode(ctx context.Context, userID int64, code, recoveryCode string) error {
+	st, err := mfa.state(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if !st.Enabled {
+		return ErrMFANotEnrolled
+	}
+	if code == "" {
+		used, err := mfa.useRecoveryCode(ctx, userID, hashRecoveryCode(recoveryCode))
+		if err != nil {
+			return err
+		}
+		if !used {
+			return ErrInvalidMFACode
+		}
+		return nil
+	}
+	step, ok := ValidateTOTP(st.Secret, code, mfaNow())
+	if !ok || step <= st.LastStep {
+		return ErrInvalidMFACode
+	}
+	used, err := mfa.useStep(ctx, userID, step)
+	if err != nil {
+		return err
+	}
+	if !used {
+		return ErrInvalidMFACode
+	}
+	return nil
+}
+
+// VerifyMFA confere o código e marca a sessão como verificada. Chamado de
+// novo, renova a janela de StepUpWindow usada por RequireStepUp.
+func VerifyMFA(ctx context.Context, userID int64, sessionID, code, recoveryCode string) error {
+	if err := checkMFACode(ctx, userID, code, recoveryCode); err != nil {
+		return err
+	}
+	return mfa.markSession(ctx, userID, sessionID, mfaNow())
+}
+
+// RegenerateRecoveryCodes troca todos os códigos de recuperação, após
+// conferir um código válido.
+func RegenerateRecoveryCodes(ctx context.Context, userID int64, code, recoveryCode string) ([]string, error) {
+	if err := checkMFACode(ctx, userID, code, recoveryCode); err != nil {
+		return nil, err
+	}
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	return codes, mfa.replaceRecoveryCodes(ctx, userID, hashes)
+}
+
+// DisableMFA remove o segundo fator do usuário após conferir um código. Roles
+// que exigem o fator não podem desativá-lo.
+func DisableMFA(ctx context.Context, userID int64, role, code, recoveryCode string) error {
+	if MFARequiredFor(role) {
+		return ErrMFARequired
+	}
+	if err := checkMFACode(ctx, userID, code, recoveryCode); err != nil {
+		return err
+	}
+	return mfa.disable(ctx, userID)
+}
+
+// ResetMFA remove o segundo fator de um usuário sem código, para o
+// Superadmin atender quem perdeu o aparelho e os códigos de recuperação.
+func ResetMFA(ctx context.Context, userID int64) error {
+	return mfa.disable(ctx, userID)
+}
+
+// isMFAPath são as rotas liberadas antes da verificação: cadastro e
+// verificação do próprio segundo fator.
+func isMFAPath(path string) bool {
+	return path == "/api/auth/mfa" || strings.HasPrefix(path, "/api/auth/mfa/")
+}
+
+// enforceMFA bloqueia sessões ainda não verificadas de usuários com segundo
+// fator ativo ou de roles que o exigem. Devolve false se já respondeu.
+func enforceMFA(w http.ResponseWriter, r *http.Request, identity *Identity) bool {
+	if !identity.MFAEnabled && !MFARequiredFor(identity.Role) || isMFAPath(r.URL.Path) {
+		return true
+	}
+	sess, err := mfa.session(r.Context(), identity.UserID, identity.SessionID)
+	if err != nil {
+		log.Printf("ERROR: MFA session lookup failed for user %d: %v", identity.UserID, err)
+		http.Error(w, "Authentication temporarily unavailable", http.StatusServiceUnavailable)
+		return false
+	}
+	if sess != nil {
+		return true
+	}
+	if !identity.MFAEnabled {
+		w.Header().Set(MFARequiredHeader, "enroll")
+		http.Error(w, "Forbidden: two-factor enrollment required", http.StatusForbidden)
+		return false
+	}
+	w.Header().Set(MFARequiredHeader, "verify")
+	http.Error(w, "Forbidden: two-factor verification required", http.StatusForbidden)
+	return false
+}
+
+// MFAEnrollmentRequired abre a resposta de RequireStepUp para quem ainda não
+// cadastrou o segundo fator, junto com o cabeçalho MFARequiredHeader "enroll".
+const MFAEnrollmentRequired = "mfa_enrollment_required"
+
+// RequireStepUp protege ações sensíveis (credenciais da Cloudflare e do
+// MercadoPago, reembolsos, ajustes de carteira, reset de segundo fator): a
+// sessão precisa ter verificado um código TOTP nos últimos StepUpWindow, para
+// qualquer role. Quem não tem o segundo fator ativo recebe 403
+// mfa_enrollment_required (cabeçalho "enroll") e precisa cadastrá-lo antes;
+// com o fator ativo, 403 com o cabeçalho "step-up". Chaves de API e sessões
+// de personificação não passam.
+func RequireStepUp(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := r.Context().Value(UserIDKey).(int64)
+		sessionID, _ := r.Context().Value(SessionIDKey).(string)
+		if sessionID == "" {
+			http.Error(w, "Forbidden: this action requires an interactive session", http.StatusForbidden)
+			return
+		}
+		sess, err := mfa.session(r.Context(), userID, sessionID)
+		if err != nil {
+			log.Printf("ERROR: MFA session lookup failed for user %d: %v", userID, err)
+			http.Error(w, "Authentication temporarily unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if sess == nil || mfaNow().Sub(sess.StepUpAt) > StepUpWindow {
+			st, err := mfa.state(r.Context(), userID)
+			if err != nil {
+				log.Printf("ERROR: MFA state lookup failed for user %d: %v", userID, err)
+				http.Error(w, "Authentication temporarily unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			if !st.Enabled {
+				w.Header().Set(MFARequiredHeader, "enroll")
+				http.Error(w, MFAEnrollmentRequired+": enroll a second factor to perform this action", http.StatusForbidden)
+				return
+			}
+			w.Header().Set(MFARequiredHeader, "step-up")
+			http.Error(w, "Forbidden: recent two-factor verification required", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
@@ -0,0 +1,349 @@
+package middleware
+
+import (
+	"context"
+	"encoding/base32"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMFAStore guarda o segundo fator de um único usuário em memória.
+type fakeMFAStore struct {
+	mu       sync.Mutex
+	st       mfaState
+	codes    map[string]bool // hash → já usado
+	sessions map[string]*mfaSession
+}
+
+func (s *fakeMFAStore) state(ctx context.Context, userID int64) (*mfaState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.st
+	st.RecoveryCodes = 0
+	for _, used := range s.codes {
+		if !used {
+			st.RecoveryCodes++
+		}
+	}
+	return &st, nil
+}
+
+func (s *fakeMFAStore) setPendingSecret(ctx context.Context, userID int64, secret string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.st.Secret = secret
+	return nil
+}
+
+func (s *fakeMFAStore) enable(ctx context.Context, userID, step int64, codeHashes []string) error {
+	s.mu.Lock()
+	s.st.Enabled, s.st.LastStep = true, step
+	s.mu.Unlock()
+	return s.replaceRecoveryCodes(ctx, userID, codeHashes)
+}
+
+func (s *fakeMFAStore) disable(ctx context.Context, userID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.st, s.codes, s.sessions = mfaState{}, map[string]bool{}, map[string]*mfaSession{}
+	return nil
+}
+
+func (s *fakeMFAStore) useStep(ctx context.Context, userID, step int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if step <= s.st.LastStep {
+		return false, nil
+	}
+	s.st.LastStep = step
+	return true, nil
+}
+
+func (s *fakeMFAStore) useRecoveryCode(ctx context.Context, userID int64, codeHash string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	used, ok := s.codes[codeHash]
+	if !ok || used {
+		return false, nil
+	}
+	s.codes[codeHash] = true
+	return true, nil
+}
+
+func (s *fakeMFAStore) replaceRecoveryCodes(ctx context.Context, userID int64, codeHashes []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.codes = map[string]bool{}
+	for _, h := range codeHashes {
+		s.codes[h] = false
+	}
+	return nil
+}
+
+func (s *fakeMFAStore) session(ctx context.Context, userID int64, sessionID string) (*mfaSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sessions[fmt.Sprint(userID, "/", sessionID)], nil
+}
+
+func (s *fakeMFAStore) markSession(ctx context.Context, userID int64, sessionID string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := fmt.Sprint(userID, "/", sessionID)
+	if sess, ok := s.sessions[key]; ok {
+		sess.StepUpAt = at
+		return nil
+	}
+	s.sessions[key] = &mfaSession{VerifiedAt: at, StepUpAt: at}
+	return nil
+}
+
+// useMFAStore troca o banco e o relógio do segundo fator; *now pode ser
+// avançado durante o teste.
+func useMFAStore(t *testing.T, now *time.Time) *fakeMFAStore {
+	t.Helper()
+	store := &fakeMFAStore{codes: map[string]bool{}, sessions: map[string]*mfaSession{}}
+	prevStore, prevNow := mfa, mfaNow
+	mfa, mfaNow = store, func() time.Time { return *now }
+	t.Cleanup(func() { mfa, mfaNow = prevStore, prevNow })
+	return store
+}
+
+func TestValidateTOTPWithRFC6238Vectors(t *testing.T) {
+	// Vetores SHA-1 do apêndice B da RFC 6238 (8 dígitos), truncados para 6
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, tt := range tests {
+		now := time.Unix(tt.unix, 0)
+		step, ok := ValidateTOTP(secret, tt.code, now)
+		if !ok || step != tt.unix/totpPeriod {
+			t.Errorf("código %s em %d: ok=%v step=%d", tt.code, tt.unix, ok, step)
+		}
+		if _, ok := ValidateTOTP(secret, tt.code, now.Add(3*totpPeriod*time.Second)); ok {
+			t.Errorf("código %s não deveria valer 90 s depois", tt.code)
+		}
+	}
+	if _, ok := ValidateTOTP(secret, "12345", time.Unix(59, 0)); ok {
+		t.Error("código com tamanho errado aceito")
+	}
+}
+
+// codeAt calcula o código do aplicativo para o segredo no instante now.
+func codeAt(t *testing.T, secret string, now time.Time) string {
+	t.Helper()
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return totpCode(key, now.Unix()/totpPeriod)
+}
+
+func TestMFAEnrollmentVerificationAndRecovery(t *testing.T) {
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	store := useMFAStore(t, &now)
+	ctx := context.Background()
+
+	secret, uri, err := BeginTOTPEnrollment(ctx, 7, "admin@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(uri, "otpauth://totp/CDNProxy:admin@example.com?") || !strings.Contains(uri, "secret="+secret) {
+		t.Errorf("otpauth inesperado: %s", uri)
+	}
+
+	if _, err := ConfirmTOTPEnrollment(ctx, 7, "sessao-1", "000000"); err != ErrInvalidMFACode {
+		t.Fatalf("código errado na confirmação: %v", err)
+	}
+	codes, err := ConfirmTOTPEnrollment(ctx, 7, "sessao-1", codeAt(t, secret, now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != RecoveryCodeCount {
+		t.Fatalf("esperados %d códigos de recuperação, vieram %d", RecoveryCodeCount, len(codes))
+	}
+	if _, _, err := BeginTOTPEnrollment(ctx, 7, "admin@example.com"); err != ErrMFAAlreadyEnabled {
+		t.Errorf("novo cadastro com fator ativo: %v", err)
+	}
+
+	status, err := MFAStatusFor(ctx, 7, "2", "sessao-1")
+	if err != nil || !status.Enabled || !status.Verified || status.Required {
+		t.Errorf("a sessão da confirmação deveria estar verificada: %+v %v", status, err)
+	}
+
+	// O código da confirmação não pode ser reutilizado em outra sessão
+	if err := VerifyMFA(ctx, 7, "sessao-2", codeAt(t, secret, now), ""); err != ErrInvalidMFACode {
+		t.Errorf("reutilização do código: %v", err)
+	}
+	now = now.Add(totpPeriod * time.Second)
+	if err := VerifyMFA(ctx, 7, "sessao-2", codeAt(t, secret, now), ""); err != nil {
+		t.Errorf("código do intervalo seguinte: %v", err)
+	}
+
+	// Códigos de recuperação valem uma vez, com ou sem hífen
+	if err := VerifyMFA(ctx, 7, "sessao-3", strings.ToUpper(strings.ReplaceAll(codes[0], "-", "")), codes[0]); err != ErrInvalidMFACode {
+		t.Errorf("com code preenchido, o código de recuperação não deveria ser usado: %v", err)
+	}
+	if err := VerifyMFA(ctx, 7, "sessao-3", "", strings.ToUpper(strings.ReplaceAll(codes[0], "-", ""))); err != nil {
+		t.Errorf("código de recuperação: %v", err)
+	}
+	if err := VerifyMFA(ctx, 7, "sessao-4", "", codes[0]); err != ErrInvalidMFACode {
+		t.Errorf("código de recuperação reutilizado: %v", err)
+	}
+	if st, _ := store.state(ctx, 7); st.RecoveryCodes != RecoveryCodeCount-1 {
+		t.Errorf("restam %d códigos", st.RecoveryCodes)
+	}
+
+	if err := DisableMFA(ctx, 7, RoleSuperadmin, "", codes[1]); err != ErrMFARequired {
+		t.Errorf("Superadmin não pode desativar o fator: %v", err)
+	}
+	if err := DisableMFA(ctx, 7, "2", "", codes[1]); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := MFAStatusFor(ctx, 7, "2", "sessao-1"); status.Enabled || status.Verified {
+		t.Errorf("o fator e as sessões verificadas deveriam ser removidos: %+v", status)
+	}
+}
+
+func TestAuthenticateEnforcesMFA(t *testing.T) {
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	store := useMFAStore(t, &now)
+	useAuthenticator(t, fixedAuthenticator{
+		"super-novo":       {UserID: 1, Role: RoleSuperadmin, SessionID: "s1"},
+		"super-verificado": {UserID: 1, Role: RoleSuperadmin, SessionID: "s2", MFAEnabled: true},
+		"super-pendente":   {UserID: 1, Role: RoleSuperadmin, SessionID: "s3", MFAEnabled: true},
+		"admin-sem-fator":  {UserID: 2, Role: "2", SessionID: "s4"},
+		"admin-com-fator":  {UserID: 2, Role: "2", SessionID: "s5", MFAEnabled: true},
+	})
+	store.markSession(context.Background(), 1, "s2", now)
+
+	tests := []struct {
+		token, path string
+		wantStatus  int
+		wantHeader  string
+	}{
+		{"super-novo", "/api/superadmin/users", http.StatusForbidden, "enroll"},
+		{"super-novo", "/api/auth/mfa/enroll", http.StatusOK, ""},
+		{"super-verificado", "/api/superadmin/users", http.StatusOK, ""},
+		{"super-pendente", "/api/superadmin/users", http.StatusForbidden, "verify"},
+		{"super-pendente", "/api/auth/mfa/verify", http.StatusOK, ""},
+		{"super-pendente", "/api/auth/mfa-falso", http.StatusForbidden, "verify"},
+		{"admin-sem-fator", "/api/admin/domains", http.StatusOK, ""},
+		{"admin-com-fator", "/api/admin/domains", http.StatusForbidden, "verify"},
+	}
+	for _, tt := range tests {
+		var gotSession string
+		h := Authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotSession, _ = r.Context().Value(SessionIDKey).(string)
+		}))
+		req := httptest.NewRequest("GET", tt.path, nil)
+		req.Header.Set("Authorization", "Bearer "+tt.token)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if rec.Code != tt.wantStatus || rec.Header().Get(MFARequiredHeader) != tt.wantHeader {
+			t.Errorf("%s em %s: status %d %s=%q, esperado %d %q", tt.token, tt.path, rec.Code,
+				MFARequiredHeader, rec.Header().Get(MFARequiredHeader), tt.wantStatus, tt.wantHeader)
+		}
+		if tt.wantStatus == http.StatusOK && gotSession == "" {
+			t.Errorf("%s: SessionIDKey ausente no contexto", tt.token)
+		}
+	}
+}
+
+func TestRequireStepUp(t *testing.T) {
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	store := useMFAStore(t, &now)
+	store.st.Enabled = true
+	store.markSession(context.Background(), 1, "s1", now)
+
+	h := RequireStepUp(func(w http.ResponseWriter, r *http.Request) {})
+	call := func(sessionID string) *httptest.ResponseRecorder {
+		ctx := context.WithValue(context.Background(), UserIDKey, int64(1))
+		if sessionID != "" {
+			ctx = context.WithValue(ctx, SessionIDKey, sessionID)
+		}
+		rec := httptest.NewRecorder()
+		h(rec, httptest.NewRequest("POST", "/api/superadmin/mercadopago", nil).WithContext(ctx))
+		return rec
+	}
+
+	if rec := call("s1"); rec.Code != http.StatusOK {
+		t.Errorf("verificação recente: status %d", rec.Code)
+	}
+	if rec := call(""); rec.Code != http.StatusForbidden {
+		t.Errorf("sem sessão interativa (chave de API): status %d", rec.Code)
+	}
+	if rec := call("s2"); rec.Code != http.StatusForbidden || rec.Header().Get(MFARequiredHeader) != "step-up" {
+		t.Errorf("sessão não verificada: status %d", rec.Code)
+	}
+
+	now = now.Add(StepUpWindow + time.Second)
+	if rec := call("s1"); rec.Code != http.StatusForbidden || rec.Header().Get(MFARequiredHeader) != "step-up" {
+		t.Errorf("verificação vencida: status %d", rec.Code)
+	}
+	store.markSession(context.Background(), 1, "s1", now)
+	if rec := call("s1"); rec.Code != http.StatusOK {
+		t.Errorf("após nova verificação: status %d", rec.Code)
+	}
+
+	// Sem segundo fator ativo não há como verificar: a resposta pede o cadastro
+	store.st.Enabled = false
+	rec := call("s2")
+	if rec.Code != http.StatusForbidden || rec.Header().Get(MFARequiredHeader) != "enroll" ||
+		!strings.HasPrefix(rec.Body.String(), MFAEnrollmentRequired) {
+		t.Errorf("usuário sem segundo fator: status %d %s=%q %q", rec.Code,
+			MFARequiredHeader, rec.Header().Get(MFARequiredHeader), rec.Body.String())
+	}
+}
+
+// fixedAuthenticator resolve tokens fixos para identidades.
+type fixedAuthenticator map[string]Identity
+
+func (a fixedAuthenticator) Authenticate(ctx context.Context, token string) (*Identity, error) {
+	id, ok := a[token]
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+	return &id, nil
+}
+
+func (fixedAuthenticator) Login(ctx context.Context, email, password string) (*Session, error) {
+	return nil, ErrNotSupported
+}
+
+func (fixedAuthenticator) RequestPasswordReset(ctx context.Context, email, redirectTo string) error {
+	return ErrNotSupported
+}
+
+func (fixedAuthenticator) ResetPassword(ctx context.Context, resetToken, password string) error {
+	return ErrNotSupported
+}
+
+func (fixedAuthenticator) SetPassword(ctx context.Context, userID int64, password string) error {
+	return ErrNotSupported
+}
+
+func (fixedAuthenticator) CreateCredentials(ctx context.Context, userID int64, email, password string) error {
+	return ErrNotSupported
+}
+
+func (fixedAuthenticator) Refresh(ctx context.Context, refreshToken string) (*Session, error) {
+	return nil, ErrNotSupported
+}
+
+func (fixedAuthenticator) Logout(ctx context.Context, accessToken string) error {
+	return ErrNotSupported
+}
@@ -0,0 +1,315 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"CDNProxy_v2/backend/database"
+)
+
+// Roles de public.users.role, como aparecem em RoleKey.
+const (
+	RoleSuperadmin = "1"
+	RoleAdmin      = "2"
+	RoleSupport    = "3"
+	RoleFinance    = "4"
+)
+
+// Permissões checadas por RequirePermission.
+const (
+	// Painel do próprio usuário (/api/admin)
+	PermAccountRead  = "account.read"
+	PermAccountWrite = "account.write"
+
+	// Painel Superadmin (/api/superadmin)
+	PermDashboardView  = "dashboard.view"
+	PermUsersRead      = "users.read"
+	PermUsersWrite     = "users.write"
+	PermRolesManage    = "roles.manage"
+	PermDomainsRead    = "domains.read"
+	PermDomainsWrite   = "domains.write"
+	PermLogsRead       = "logs.read"
+	PermTrafficRead    = "traffic.read"
+	PermTrafficWrite   = "traffic.write"
+	PermPaymentsRead   = "payments.read"
+	PermPaymentsWrite  = "payments.write"
+	PermPlansRead      = "plans.read"
+	PermPlansWrite     = "plans.write"
+	PermSettingsRead   = "settings.read"
+	PermSettingsWrite  = "settings.write"
+	PermCloudflare     = "cloudflare.manage"
+	PermMailSend       = "mail.send"
+	PermDatabaseManage = "database.manage"
+	PermAuditRead      = "audit.read"
+	PermImpersonate    = "users.impersonate"
+)
+
+// Permission descreve uma permissão do catálogo public.permissions.
+type Permission struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// Permissions é o catálogo gravado em public.permissions por SeedPermissions.
+var Permissions = []Permission{
+	{PermAccountRead, "Consultar o próprio painel: domínios, tráfego, transações e perfil"},
+	{PermAccountWrite, "Alterar os próprios domínios, carrinho, perfil e chaves de API"},
+	{PermDashboardView, "Ver o dashboard e os analytics globais"},
+	{PermUsersRead, "Listar usuários e roles"},
+	{PermUsersWrite, "Criar, editar, ativar e desativar usuários"},
+	{PermRolesManage, "Atribuir roles a usuários"},
+	{PermDomainsRead, "Listar e consultar todos os domínios"},
+	{PermDomainsWrite, "Criar, editar, renovar, ativar, desativar e excluir domínios"},
+	{PermLogsRead, "Consultar e exportar os logs de acesso"},
+	{PermTrafficRead, "Consultar o tráfego dos domínios"},
+	{PermTrafficWrite, "Zerar contadores de tráfego"},
+	{PermPaymentsRead, "Listar e consultar pagamentos"},
+	{PermPaymentsWrite, "Criar, editar e excluir pagamentos"},
+	{PermPlansRead, "Listar e consultar planos"},
+	{PermPlansWrite, "Criar, editar e excluir planos"},
+	{PermSettingsRead, "Ver configurações gerais, Cloudflare e MercadoPago"},
+	{PermSettingsWrite, "Alterar configurações gerais, Cloudflare e MercadoPago"},
+	{PermCloudflare, "Gerenciar zonas e registros DNS da Cloudflare"},
+	{PermMailSend, "Enviar e-mails pelo painel"},
+	{PermDatabaseManage, "Ver o status e executar a limpeza do banco"},
+	{PermAuditRead, "Consultar o registro de auditoria"},
+	{PermImpersonate, "Abrir sessões de personificação para ver o painel como outro usuário"},
+}
+
+// Role descreve uma linha de public.roles.
+type Role struct {
+	ID          int      `json:"id"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+// DefaultRoles são as roles criadas por SeedPermissions. As permissões de cada
+// role só são gravadas quando ela ainda não tem nenhuma no banco, para não
+// desfazer ajustes feitos depois; o Superadmin sempre recebe o catálogo inteiro.
+var DefaultRoles = []Role{
+	{ID: 1, Name: "superadmin", Description: "Acesso total"},
+	{ID: 2, Name: "admin", Description: "Revendedor: gerencia os próprios domínios e pagamentos", Permissions: []string{
+		PermAccountRead, PermAccountWrite,
+	}},
+	{ID: 3, Name: "support", Description: "Suporte: consulta usuários, domínios, tráfego e logs", Permissions: []string{
+		PermDashboardView, PermUsersRead, PermDomainsRead, PermLogsRead, PermTrafficRead,
+	}},
+	{ID: 4, Name: "finance", Description: "Financeiro: gerencia pagamentos e planos", Permissions: []string{
+		PermPaymentsRead, PermPaymentsWrite, PermPlansRead, PermPlansWrite,
+	}},
+}
+
+// DefaultRolePermissions devolve o mapa role → permissões de DefaultRoles.
+func DefaultRolePermissions() map[string][]string {
+	out := make(map[string][]string, len(DefaultRoles))
+	for _, role := range DefaultRoles {
+		perms := role.Permissions
+		if role.ID == 1 {
+			perms = make([]string, 0, len(Permissions))
+			for _, p := range Permissions {
+				perms = append(perms, p.Name)
+			}
+		}
+		out[strconv.Itoa(role.ID)] = perms
+	}
+	return out
+}
+
+// SeedPermissions grava o catálogo de permissões e as roles padrão. É
+// idempotente e roda a cada inicialização, depois das migrações.
+func SeedPermissions(ctx context.Context) error {
+	tx, err := database.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	for _, p := range Permissions {
+		if _, err := tx.Exec(ctx, `
+			INSERT INTO public.permissions (name, description) VALUES ($1, $2)
+			ON CONFLICT (name) DO UPDATE SET description = EXCLUDED.description`,
+			p.Name, p.Description); err != nil {
+			return fmt.Errorf("seed permission %s: %w", p.Name, err)
+		}
+	}
+
+	defaults := DefaultRolePermissions()
+	for _, role := range DefaultRoles {
+		if _, err := tx.Exec(ctx, `
+			INSERT INTO public.roles (id, name, description) VALUES ($1, $2, $3)
+			ON CONFLICT (id) DO NOTHING`,
+			role.ID, role.Name, role.Description); err != nil {
+			return fmt.Errorf("seed role %s: %w", role.Name, err)
+		}
+
+		query := `
+			INSERT INTO public.role_permissions (role_id, permission)
+			SELECT $1, p FROM unnest($2::text[]) AS p
+			WHERE NOT EXISTS (SELECT 1 FROM public.role_permissions WHERE role_id = $1)`
+		if role.ID == 1 {
+			query = `
+				INSERT INTO public.role_permissions (role_id, permission)
+				SELECT $1, p FROM unnest($2::text[]) AS p
+				ON CONFLICT DO NOTHING`
+		}
+		if _, err := tx.Exec(ctx, query, role.ID, defaults[strconv.Itoa(role.ID)]); err != nil {
+			return fmt.Errorf("seed permissions of role %s: %w", role.Name, err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	permissionCache.invalidate()
+	return nil
+}
+
+// permissionStore isola a leitura de public.role_permissions para os testes.
+type permissionStore interface {
+	load(ctx context.Context) (map[string][]string, error)
+}
+
+type dbPermissionStore struct{}
+
+func (dbPermissionStore) load(ctx context.Context) (map[string][]string, error) {
+	if database.DB == nil {
+		return nil, errors.New("database not connected")
+	}
+	rows, err := database.DB.Query(ctx, "SELECT role_id::text, permission FROM public.role_permissions")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := map[string][]string{}
+	for rows.Next() {
+		var role, perm string
+		if err := rows.Scan(&role, &perm); err != nil {
+			return nil, err
+		}
+		out[role] = append(out[role], perm)
+	}
+	return out, rows.Err()
+}
+
+// rolePermissionCache mantém public.role_permissions em memória por ttl. Se o
+// banco falhar, continua usando a última leitura; sem nenhuma leitura, usa
+// DefaultRolePermissions.
+type rolePermissionCache struct {
+	store permissionStore
+	ttl   time.Duration
+
+	mu       sync.RWMutex
+	perms    map[string]map[string]bool
+	loadedAt time.Time
+}
+
+var permissionCache = &rolePermissionCache{store: dbPermissionStore{}, ttl: time.Minute}
+
+func (c *rolePermissionCache) get(ctx context.Context) map[string]map[string]bool {
+	c.mu.RLock()
+	perms, fresh := c.perms, time.Since(c.loadedAt) < c.ttl
+	c.mu.RUnlock()
+	if perms != nil && fresh {
+		return perms
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.perms != nil && time.Since(c.loadedAt) < c.ttl {
+		return c.perms
+	}
+
+	loaded, err := c.store.load(ctx)
+	if err != nil {
+		if c.perms == nil {
+			log.Printf("WARN: Could not load role permissions, using defaults: %v", err)
+			c.perms = toPermissionSet(DefaultRolePermissions())
+		} else {
+			log.Printf("WARN: Could not refresh role permissions, using cached values: %v", err)
+		}
+		// Evita uma consulta por requisição enquanto o banco estiver fora
+		c.loadedAt = time.Now()
+		return c.perms
+	}
+	c.perms = toPermissionSet(loaded)
+	c.loadedAt = time.Now()
+	return c.perms
+}
+
+func (c *rolePermissionCache) invalidate() {
+	c.mu.Lock()
+	c.loadedAt = time.Time{}
+	c.mu.Unlock()
+}
+
+func toPermissionSet(m map[string][]string) map[string]map[string]bool {
+	out := make(map[string]map[string]bool, len(m))
+	for role, perms := range m {
+		set := make(map[string]bool, len(perms))
+		for _, p := range perms {
+			set[p] = true
+		}
+		out[role] = set
+	}
+	return out
+}
+
+// HasPermission informa se role concede perm.
+func HasPermission(ctx context.Context, role, perm string) bool {
+	return permissionCache.get(ctx)[role][perm]
+}
+
+// RolePermissions lista, em ordem alfabética, as permissões de role.
+func RolePermissions(ctx context.Context, role string) []string {
+	set := permissionCache.get(ctx)[role]
+	out := make([]string, 0, len(set))
+	for p := range set {
+		out = append(out, p)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// permissionHandler exige uma permissão da role do usuário autenticado.
+type permissionHandler struct {
+	permission string
+	next       http.Handler
+}
+
+// RequirePermission protege uma rota com perm. Deve rodar depois de
+// Authenticate (ou AuthenticateWithAPIKey), que injeta RoleKey.
+func RequirePermission(perm string, h http.HandlerFunc) http.Handler {
+	return permissionHandler{permission: perm, next: h}
+}
+
+func (h permissionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	role, ok := r.Context().Value(RoleKey).(string)
+	if !ok {
+		http.Error(w, "Role not found in context", http.StatusInternalServerError)
+		return
+	}
+	if !HasPermission(r.Context(), role, h.permission) {
+		http.Error(w, "Forbidden: missing permission "+h.permission, http.StatusForbidden)
+		return
+	}
+	h.next.ServeHTTP(w, r)
+}
+
+// RoutePermission devolve a permissão exigida por um handler registrado com
+// RequirePermission (atravessando RequireScope).
+func RoutePermission(h http.Handler) (string, bool) {
+	if s, ok := h.(scopedHandler); ok {
+		h = s.Handler
+	}
+	p, ok := h.(permissionHandler)
+	return p.permission, ok
+}
@@ -0,0 +1,150 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakePermissionStore devolve perms ou err e conta as leituras.
+type fakePermissionStore struct {
+	perms map[string][]string
+	err   error
+	loads atomic.Int32
+}
+
+func (s *fakePermissionStore) load(ctx context.Context) (map[string][]string, error) {
+	s.loads.Add(1)
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.perms, nil
+}
+
+// usePermissionStore troca o cache global por um apoiado em store.
+func usePermissionStore(t *testing.T, store permissionStore, ttl time.Duration) *rolePermissionCache {
+	t.Helper()
+	prev := permissionCache
+	permissionCache = &rolePermissionCache{store: store, ttl: ttl}
+	t.Cleanup(func() { permissionCache = prev })
+	return permissionCache
+}
+
+func callWithRole(h http.Handler, role string) int {
+	req := httptest.NewRequest("GET", "/api/superadmin/users", nil)
+	if role != "" {
+		req = req.WithContext(context.WithValue(req.Context(), RoleKey, role))
+	}
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	return rr.Code
+}
+
+func TestRequirePermission(t *testing.T) {
+	usePermissionStore(t, &fakePermissionStore{perms: map[string][]string{
+		"3": {PermUsersRead},
+		"9": {PermUsersRead, PermUsersWrite},
+	}}, time.Minute)
+
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+
+	tests := []struct {
+		name string
+		perm string
+		role string
+		want int
+	}{
+		{"role com a permissão", PermUsersRead, "3", http.StatusOK},
+		{"role sem a permissão", PermUsersWrite, "3", http.StatusForbidden},
+		{"role criada no banco", PermUsersWrite, "9", http.StatusOK},
+		{"role desconhecida", PermUsersRead, "42", http.StatusForbidden},
+		{"superadmin sem linhas no banco", PermUsersRead, RoleSuperadmin, http.StatusForbidden},
+		{"sem role no contexto", PermUsersRead, "", http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := callWithRole(RequirePermission(tt.perm, ok), tt.role); got != tt.want {
+				t.Errorf("Esperado status %d, recebeu %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestPermissionCacheUsesDefaultsWithoutDatabase(t *testing.T) {
+	usePermissionStore(t, &fakePermissionStore{err: errors.New("sem conexão")}, time.Minute)
+
+	if !HasPermission(context.Background(), RoleSupport, PermLogsRead) {
+		t.Error("suporte deveria ler logs com as permissões padrão")
+	}
+	if HasPermission(context.Background(), RoleSupport, PermPaymentsWrite) {
+		t.Error("suporte não deveria alterar pagamentos")
+	}
+	if !HasPermission(context.Background(), RoleFinance, PermPlansWrite) {
+		t.Error("financeiro deveria gerenciar planos")
+	}
+}
+
+func TestPermissionCacheKeepsLastLoadOnError(t *testing.T) {
+	store := &fakePermissionStore{perms: map[string][]string{"5": {PermMailSend}}}
+	cache := usePermissionStore(t, store, time.Minute)
+
+	if !HasPermission(context.Background(), "5", PermMailSend) {
+		t.Fatal("permissão carregada do banco não encontrada")
+	}
+	HasPermission(context.Background(), "5", PermMailSend)
+	if n := store.loads.Load(); n != 1 {
+		t.Errorf("esperada uma leitura dentro do ttl, houve %d", n)
+	}
+
+	store.err = errors.New("banco fora do ar")
+	cache.invalidate()
+	if !HasPermission(context.Background(), "5", PermMailSend) {
+		t.Error("a última leitura deveria continuar valendo quando o banco falha")
+	}
+	if HasPermission(context.Background(), RoleSupport, PermLogsRead) {
+		t.Error("com uma leitura válida em cache, os padrões não devem ser usados")
+	}
+}
+
+func TestDefaultRolePermissions(t *testing.T) {
+	catalog := map[string]bool{}
+	for _, p := range Permissions {
+		if catalog[p.Name] {
+			t.Errorf("permissão duplicada no catálogo: %s", p.Name)
+		}
+		catalog[p.Name] = true
+	}
+
+	defaults := DefaultRolePermissions()
+	if len(defaults[RoleSuperadmin]) != len(Permissions) {
+		t.Errorf("superadmin deveria ter todas as %d permissões, tem %d", len(Permissions), len(defaults[RoleSuperadmin]))
+	}
+	for role, perms := range defaults {
+		for _, p := range perms {
+			if !catalog[p] {
+				t.Errorf("role %s usa permissão fora do catálogo: %s", role, p)
+			}
+		}
+	}
+}
+
+func TestRolePermissionsIsSorted(t *testing.T) {
+	usePermissionStore(t, &fakePermissionStore{perms: map[string][]string{
+		"4": {PermPlansWrite, PermPaymentsRead, PermPlansRead},
+	}}, time.Minute)
+
+	got := RolePermissions(context.Background(), "4")
+	want := []string{PermPaymentsRead, PermPlansRead, PermPlansWrite}
+	if len(got) != len(want) {
+		t.Fatalf("RolePermissions = %v", got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("RolePermissions[%d] = %q, esperado %q", i, got[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"CDNProxy_v2/backend/database"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var (
+	// ErrSessionRevoked indica sessão encerrada (logout ou revogação) com o
+	// token ainda dentro da validade.
+	ErrSessionRevoked = errors.New("session revoked")
+	// ErrUserDisabled indica usuário desativado (public.users.active = false).
+	ErrUserDisabled = errors.New("user account is disabled")
+	// ErrInvalidRefreshToken indica refresh token desconhecido, expirado ou
+	// de sessão revogada.
+	ErrInvalidRefreshToken = errors.New("invalid or expired refresh token")
+	// ErrSessionNotFound indica sessão inexistente ou de outro usuário.
+	ErrSessionNotFound = errors.New("session not found")
+)
+
+// Motivos gravados em public.auth_sessions.revoked_reason.
+const (
+	RevokedByLogout     = "logout"
+	RevokedByUser       = "user"
+	RevokedBySuperadmin = "superadmin"
+	RevokedByDeactivate = "deactivated"
+	// RevokedByRefreshReuse encerra a sessão cujo refresh token foi usado
+	// duas vezes: uma das cópias pode ter vazado.
+	RevokedByRefreshReuse = "refresh_reused"
+)
+
+// DefaultRefreshTokenTTL é a validade do refresh token no modo local.
+const DefaultRefreshTokenTTL = 30 * 24 * time.Hour
+
+// AuthSession é uma linha de public.auth_sessions.
+type AuthSession struct {
+	ID               int64      `json:"id"`
+	SessionID        string     `json:"-"`
+	UserID           int64      `json:"user_id"`
+	IP               string     `json:"ip"`
+	UserAgent        string     `json:"user_agent"`
+	CreatedAt        time.Time  `json:"created_at"`
+	LastRefreshedAt  *time.Time `json:"last_refreshed_at"`
+	RefreshExpiresAt *time.Time `json:"refresh_expires_at,omitempty"`
+	RevokedAt        *time.Time `json:"revoked_at,omitempty"`
+	RevokedReason    *string    `json:"revoked_reason,omitempty"`
+	// Current marca a sessão da própria requisição na listagem.
+	Current bool `json:"current"`
+}
+
+// sessionStore isola public.auth_sessions para os testes.
+type sessionStore interface {
+	// byID devolve a sessão ou nil se o backend nunca a viu.
+	byID(ctx context.Context, sessionID string) (*AuthSession, error)
+	byRefreshHash(ctx context.Context, hash string) (*AuthSession, error)
+	// byRowID devolve a sessão public.auth_sessions.id do usuário, ou nil.
+	byRowID(ctx context.Context, userID, id int64) (*AuthSession, error)
+	// start grava uma sessão nova com o hash do refresh token (modo local).
+	start(ctx context.Context, s *AuthSession, refreshHash string) error
+	// track cria a sessão, se preciso, e atualiza IP, user agent e a última
+	// renovação.
+	track(ctx context.Context, s *AuthSession, at time.Time) error
+	// rotate troca o refresh token oldHash da sessão por refreshHash, ou
+	// devolve ErrInvalidRefreshToken se oldHash já não for o da sessão.
+	rotate(ctx context.Context, sessionID, oldHash, refreshHash string, expiresAt, at time.Time) error
+	// revoke encerra uma sessão do usuário, registrando-a se preciso.
+	revoke(ctx context.Context, userID int64, sessionID, reason string, at time.Time) error
+	// revokeAll encerra todas as sessões do usuário, inclusive as
+	// desconhecidas (users.sessions_revoked_at) e as de personificação que
+	// ele abriu.
+	revokeAll(ctx context.Context, userID int64, reason string, at time.Time) error
+	list(ctx context.Context, userID int64) ([]AuthSession, error)
+}
+
+type dbSessionStore struct{}
+
+const authSessionColumns = "id, session_id, user_id, ip, user_agent, created_at, last_refreshed_at, refresh_expires_at, revoked_at, revoked_reason"
+
+func scanAuthSession(row pgx.Row) (*AuthSession, error) {
+	var s AuthSession
+	err := row.Scan(&s.ID, &s.SessionID, &s.UserID, &s.IP, &s.UserAgent, &s.CreatedAt,
+		&s.LastRefreshedAt, &s.RefreshExpiresAt, &s.RevokedAt, &s.RevokedReason)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (dbSessionStore) byID(ctx context.Context, sessionID string) (*AuthSession, error) {
+	if database.DB == nil {
+		return nil, errors.New("database not connected")
+	}
+	s, err := scanAuthSession(database.DB.QueryRow(ctx,
+		"SELECT "+authSessionColumns+" FROM public.auth_sessions WHERE session_id = $1", sessionID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	return s, err
+}
+
+func (dbSessionStore) byRefreshHash(ctx context.Context, hash string) (*AuthSession, error) {
+	return scanAuthSession(database.DB.QueryRow(ctx,
+		"SELECT "+authSessionColumns+" FROM public.auth_sessions WHERE refresh_token_hash = $1", hash))
+}
+
+func (dbSessionStore) byRowID(ctx context.Context, userID, id int64) (*AuthSession, error) {
+	s, err := scanAuthSession(database.DB.QueryRow(ctx,
+		"SELECT "+authSessionColumns+" FROM public.auth_sessions WHERE id = $1 AND user_id = $2", id, userID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	return s, err
+}
+
+func (dbSessionStore) start(ctx context.Context, s *AuthSession, refreshHash string) error {
+	return database.DB.QueryRow(ctx, `
+		INSERT INTO public.auth_sessions (session_id, user_id, refresh_token_hash, refresh_expires_at, created_at)
+		VALUES ($1, $2, $3, $4, $5) RETURNING id`,
+		s.SessionID, s.UserID, refreshHash, s.RefreshExpiresAt, s.CreatedAt).Scan(&s.ID)
+}
+
+func (dbSessionStore) track(ctx context.Context, s *AuthSession, at time.Time) error {
+	_, err := database.DB.Exec(ctx, `
+		INSERT INTO public.auth_sessions (session_id, user_id, ip, user_agent, created_at, last_refreshed_at)
+		VALUES ($1, $2, $3, $4, $5, $5)
+		ON CONFLICT (session_id) DO UPDATE SET ip = EXCLUDED.ip, user_agent = EXCLUDED.user_agent, last_refreshed_at = EXCLUDED.last_refreshed_at
+		WHERE auth_sessions.user_id = EXCLUDED.user_id`,
+		s.SessionID, s.UserID, s.IP, s.UserAgent, at)
+	return err
+}
+
+func (dbSessionStore) rotate(ctx context.Context, sessionID, oldHash, refreshHash string, expiresAt, at time.Time) error {
+	tag, err := database.DB.Exec(ctx, `
+		UPDATE public.auth_sessions SET refresh_token_hash = $3, refresh_expires_at = $4, last_refreshed_at = $5
+		WHERE session_id = $1 AND refresh_token_hash = $2 AND revoked_at IS NULL`,
+		sessionID, oldHash, refreshHash, expiresAt, at)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrInvalidRefreshToken
+	}
+	return nil
+}
+
+func (dbSessionStore) revoke(ctx context.Context, userID int64, sessionID, reason string, at time.Time) error {
+	_, err := database.DB.Exec(ctx, `
+		INSERT INTO public.auth_sessions (session_id, user_id, created_at, revoked_at, revoked_reason)
+		VALUES ($1, $2, $3, $3, $4)
+		ON CONFLICT (session_id) DO UPDATE SET
+			revoked_at = COALESCE(auth_sessions.revoked_at, EXCLUDED.revoked_at),
+			revoked_reason = COALESCE(auth_sessions.revoked_reason, EXCLUDED.revoked_reason),
+			refresh_token_hash = NULL
+		WHERE auth_sessions.user_id = EXCLUDED.user_id`,
+		sessionID, userID, at, reason)
+	return err
+}
+
+func (dbSessionStore) revokeAll(ctx context.Context, userID int64, reason string, at time.Time) error {
+	tx, err := database.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "UPDATE public.users SET sessions_revoked_at = $2 WHERE id = $1", userID, at); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `
+		UPDATE public.auth_sessions SET revoked_at = $2, revoked_reason = $3, refresh_token_hash = NULL
+		WHERE user_id = $1 AND revoked_at IS NULL`, userID, at, reason); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx,
+		"UPDATE public.impersonation_sessions SET ended_at = $2 WHERE actor_id = $1 AND ended_at IS NULL",
+		userID, at); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func (dbSessionStore) list(ctx context.Context, userID int64) ([]AuthSession, error) {
+	rows, err := database.DB.Query(ctx,
+		"SELECT "+authSessionColumns+" FROM public.auth_sessions WHERE user_id = $1 ORDER BY created_at DESC LIMIT 100", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []AuthSession{}
+	for rows.Next() {
+		s, err := scanAuthSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *s)
+	}
+	return out, rows.Err()
+}
+
+// Dependências das sessões, trocadas nos testes.
+var (
+	sessions   sessionStore = dbSessionStore{}
+	sessionNow              = time.Now
+)
+
+// checkSession recusa usuário desativado, sessão revogada e sessões
+// iniciadas antes de um "encerrar todas" (users.sessions_revoked_at). Sem
+// registro da sessão, vale o horário de emissão do token (issuedAt).
+func checkSession(ctx context.Context, user *authUser, sessionID string, issuedAt time.Time) error {
+	if user.Disabled {
+		return ErrUserDisabled
+	}
+	s, err := sessions.byID(ctx, sessionID)
+	if err != nil {
+		return fmt.Errorf("%w: session lookup: %v", ErrAuthUnavailable, err)
+	}
+	started := issuedAt
+	if s != nil && s.UserID == user.ID {
+		if s.RevokedAt != nil {
+			return ErrSessionRevoked
+		}
+		started = s.CreatedAt
+	}
+	// A claim iat tem resolução de segundos
+	if user.SessionsRevokedAt != nil && started.Before(user.SessionsRevokedAt.Truncate(time.Second)) {
+		return ErrSessionRevoked
+	}
+	return nil
+}
+
+// TrackSession registra a sessão recém-aberta ou renovada com o IP e o user
+// agent da requisição, para a listagem de sessões.
+func TrackSession(ctx context.Context, r *http.Request, userID int64, sessionID string) error {
+	return sessions.track(ctx, &AuthSession{
+		SessionID: sessionID,
+		UserID:    userID,
+		IP:        ClientIP(r),
+		UserAgent: r.UserAgent(),
+		CreatedAt: sessionNow(),
+	}, sessionNow())
+}
+
+// RevokeSession encerra a sessão sessionID do usuário. O token dela passa a
+// ser recusado na hora, mesmo sem o backend tê-la registrado antes.
+func RevokeSession(ctx context.Context, userID int64, sessionID, reason string) error {
+	return sessions.revoke(ctx, userID, sessionID, reason, sessionNow())
+}
+
+// RevokeAllSessions encerra todas as sessões do usuário e as personificações
+// abertas por ele. Chaves de API não são afetadas.
+func RevokeAllSessions(ctx context.Context, userID int64, reason string) error {
+	return sessions.revokeAll(ctx, userID, reason, sessionNow())
+}
+
+// ListSessions devolve as sessões do usuário (até 100, mais recentes
+// primeiro), marcando currentID como a atual.
+func ListSessions(ctx context.Context, userID int64, currentID string) ([]AuthSession, error) {
+	list, err := sessions.list(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range list {
+		list[i].Current = currentID != "" && list[i].SessionID == currentID
+	}
+	return list, nil
+}
+
+// SessionByID devolve a sessão de public.auth_sessions.id do usuário, ou
+// ErrSessionNotFound.
+func SessionByID(ctx context.Context, userID, id int64) (*AuthSession, error) {
+	s, err := sessions.byRowID(ctx, userID, id)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return nil, ErrSessionNotFound
+	}
+	return s, nil
+}
@@ -0,0 +1,368 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeSessionStore guarda as sessões em memória. revokedAll simula
+// users.sessions_revoked_at, que no banco fica na própria linha do usuário.
+type fakeSessionStore struct {
+	byHash     map[string]string
+	rows       map[string]*AuthSession
+	revokedAll map[int64]time.Time
+	nextID     int64
+}
+
+func (s *fakeSessionStore) byID(_ context.Context, sessionID string) (*AuthSession, error) {
+	if row, ok := s.rows[sessionID]; ok {
+		copy := *row
+		return &copy, nil
+	}
+	return nil, nil
+}
+
+func (s *fakeSessionStore) byRefreshHash(_ context.Context, hash string) (*AuthSession, error) {
+	id, ok := s.byHash[hash]
+	if !ok {
+		return nil, errNoRows
+	}
+	copy := *s.rows[id]
+	return &copy, nil
+}
+
+func (s *fakeSessionStore) byRowID(_ context.Context, userID, id int64) (*AuthSession, error) {
+	for _, row := range s.rows {
+		if row.ID == id && row.UserID == userID {
+			copy := *row
+			return &copy, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *fakeSessionStore) insert(row *AuthSession) {
+	s.nextID++
+	row.ID = s.nextID
+	s.rows[row.SessionID] = row
+}
+
+func (s *fakeSessionStore) start(_ context.Context, row *AuthSession, refreshHash string) error {
+	copy := *row
+	s.insert(&copy)
+	row.ID = copy.ID
+	s.byHash[refreshHash] = row.SessionID
+	return nil
+}
+
+func (s *fakeSessionStore) track(_ context.Context, row *AuthSession, at time.Time) error {
+	existing, ok := s.rows[row.SessionID]
+	if !ok {
+		copy := *row
+		copy.LastRefreshedAt = &at
+		s.insert(&copy)
+		return nil
+	}
+	if existing.UserID == row.UserID {
+		existing.IP, existing.UserAgent, existing.LastRefreshedAt = row.IP, row.UserAgent, &at
+	}
+	return nil
+}
+
+func (s *fakeSessionStore) dropHash(sessionID string) {
+	for h, id := range s.byHash {
+		if id == sessionID {
+			delete(s.byHash, h)
+		}
+	}
+}
+
+func (s *fakeSessionStore) rotate(_ context.Context, sessionID, oldHash, refreshHash string, expiresAt, at time.Time) error {
+	if s.byHash[oldHash] != sessionID || s.rows[sessionID].RevokedAt != nil {
+		return ErrInvalidRefreshToken
+	}
+	s.dropHash(sessionID)
+	s.byHash[refreshHash] = sessionID
+	row := s.rows[sessionID]
+	row.RefreshExpiresAt, row.LastRefreshedAt = &expiresAt, &at
+	return nil
+}
+
+func (s *fakeSessionStore) revoke(_ context.Context, userID int64, sessionID, reason string, at time.Time) error {
+	row, ok := s.rows[sessionID]
+	if !ok {
+		row = &AuthSession{SessionID: sessionID, UserID: userID, CreatedAt: at}
+		s.insert(row)
+	}
+	if row.UserID != userID || row.RevokedAt != nil {
+		return nil
+	}
+	row.RevokedAt, row.RevokedReason = &at, &reason
+	s.dropHash(sessionID)
+	return nil
+}
+
+func (s *fakeSessionStore) revokeAll(ctx context.Context, userID int64, reason string, at time.Time) error {
+	s.revokedAll[userID] = at
+	for id, row := range s.rows {
+		if row.UserID == userID {
+			s.revoke(ctx, userID, id, reason, at)
+		}
+	}
+	return nil
+}
+
+func (s *fakeSessionStore) list(_ context.Context, userID int64) ([]AuthSession, error) {
+	out := []AuthSession{}
+	for _, row := range s.rows {
+		if row.UserID == userID {
+			out = append(out, *row)
+		}
+	}
+	return out, nil
+}
+
+func useSessionStore(t *testing.T, now *time.Time) *fakeSessionStore {
+	t.Helper()
+	store := &fakeSessionStore{byHash: map[string]string{}, rows: map[string]*AuthSession{}, revokedAll: map[int64]time.Time{}}
+	prevStore, prevNow := sessions, sessionNow
+	sessions, sessionNow = store, func() time.Time { return *now }
+	t.Cleanup(func() { sessions, sessionNow = prevStore, prevNow })
+	return store
+}
+
+func TestCheckSession(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	store := useSessionStore(t, &now)
+	ctx := context.Background()
+	store.revoke(ctx, 7, "revogada", RevokedByLogout, now.Add(-time.Hour))
+	store.insert(&AuthSession{SessionID: "antiga", UserID: 7, CreatedAt: now.Add(-2 * time.Hour)})
+	store.insert(&AuthSession{SessionID: "de-outro", UserID: 8, CreatedAt: now.Add(-2 * time.Hour)})
+	cutoff := now.Add(-30 * time.Minute)
+
+	tests := []struct {
+		name      string
+		user      authUser
+		sessionID string
+		issuedAt  time.Time
+		want      error
+	}{
+		{"sessão desconhecida", authUser{ID: 7}, "nova", now, nil},
+		{"usuário desativado", authUser{ID: 7, Disabled: true}, "nova", now, ErrUserDisabled},
+		{"sessão revogada", authUser{ID: 7}, "revogada", now, ErrSessionRevoked},
+		{"iniciada antes de encerrar todas", authUser{ID: 7, SessionsRevokedAt: &cutoff}, "antiga", now, ErrSessionRevoked},
+		{"token renovado de sessão antiga", authUser{ID: 7, SessionsRevokedAt: &cutoff}, "antiga", now.Add(-time.Minute), ErrSessionRevoked},
+		{"desconhecida emitida antes", authUser{ID: 7, SessionsRevokedAt: &cutoff}, "nova", cutoff.Add(-time.Second), ErrSessionRevoked},
+		{"desconhecida emitida depois", authUser{ID: 7, SessionsRevokedAt: &cutoff}, "nova", cutoff.Add(time.Second), nil},
+		{"id de sessão de outro usuário", authUser{ID: 7}, "de-outro", now, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkSession(ctx, &tt.user, tt.sessionID, tt.issuedAt); !errors.Is(err, tt.want) {
+				t.Errorf("checkSession = %v, esperado %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLocalRefreshRotatesToken(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	auth, _, _ := newTestLocalAuth(t)
+	auth.now = func() time.Time { return now }
+	useSessionStore(t, &now)
+	ctx := context.Background()
+
+	login, err := auth.Login(ctx, "admin@example.com", "senha-correta")
+	if err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	if login.RefreshToken == "" {
+		t.Fatal("login sem refresh_token")
+	}
+	first, err := auth.Authenticate(ctx, login.AccessToken)
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+
+	now = now.Add(10 * time.Minute)
+	refreshed, err := auth.Refresh(ctx, login.RefreshToken)
+	if err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	second, err := auth.Authenticate(ctx, refreshed.AccessToken)
+	if err != nil {
+		t.Fatalf("Authenticate após refresh: %v", err)
+	}
+	if second.SessionID != first.SessionID {
+		t.Errorf("refresh trocou a sessão: %q → %q", first.SessionID, second.SessionID)
+	}
+	if _, err := auth.Refresh(ctx, login.RefreshToken); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("refresh token antigo aceito: %v", err)
+	}
+
+	if err := RevokeSession(ctx, 7, second.SessionID, RevokedByLogout); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := auth.Authenticate(ctx, refreshed.AccessToken); !errors.Is(err, ErrSessionRevoked) {
+		t.Errorf("token de sessão revogada aceito: %v", err)
+	}
+	if _, err := auth.Refresh(ctx, refreshed.RefreshToken); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("refresh de sessão revogada aceito: %v", err)
+	}
+}
+
+// racingSessionStore simula outro refresh com o mesmo token que termina
+// entre a leitura da sessão e a troca do token.
+type racingSessionStore struct {
+	*fakeSessionStore
+	sessionID, winner string
+}
+
+func (s *racingSessionStore) byRefreshHash(ctx context.Context, hash string) (*AuthSession, error) {
+	row, err := s.fakeSessionStore.byRefreshHash(ctx, hash)
+	if err == nil && s.winner == "" {
+		s.sessionID, s.winner = row.SessionID, "token-do-outro-refresh"
+		if err := s.fakeSessionStore.rotate(ctx, row.SessionID, hash, hashResetToken(s.winner), *row.RefreshExpiresAt, row.CreatedAt); err != nil {
+			return nil, err
+		}
+	}
+	return row, err
+}
+
+func TestLocalRefreshReuseRevokesSession(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	auth, _, _ := newTestLocalAuth(t)
+	auth.now = func() time.Time { return now }
+	store := &racingSessionStore{fakeSessionStore: useSessionStore(t, &now)}
+	sessions = store
+	ctx := context.Background()
+
+	login, err := auth.Login(ctx, "admin@example.com", "senha-correta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := auth.Refresh(ctx, login.RefreshToken); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Fatalf("refresh perdeu a corrida e foi aceito: %v", err)
+	}
+	row := store.rows[store.sessionID]
+	if row.RevokedAt == nil || row.RevokedReason == nil || *row.RevokedReason != RevokedByRefreshReuse {
+		t.Errorf("sessão não foi revogada: %+v", row)
+	}
+	if _, err := auth.Refresh(ctx, store.winner); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("o token do outro refresh deveria deixar de valer: %v", err)
+	}
+}
+
+func TestLocalRefreshExpires(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	auth, _, _ := newTestLocalAuth(t)
+	auth.now = func() time.Time { return now }
+	useSessionStore(t, &now)
+
+	login, err := auth.Login(context.Background(), "admin@example.com", "senha-correta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(DefaultRefreshTokenTTL)
+	if _, err := auth.Refresh(context.Background(), login.RefreshToken); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("refresh token expirado aceito: %v", err)
+	}
+}
+
+func TestRevokeAllSessionsAndDisabledUser(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	auth, users, _ := newTestLocalAuth(t)
+	auth.now = func() time.Time { return now }
+	store := useSessionStore(t, &now)
+	user := users.users[7]
+	useAuthenticator(t, auth)
+	ctx := context.Background()
+
+	a, _ := auth.Login(ctx, "admin@example.com", "senha-correta")
+	b, _ := auth.Login(ctx, "admin@example.com", "senha-correta")
+
+	call := func(token string) int {
+		req := httptest.NewRequest("GET", "/api/auth/me", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		Authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := call(a.AccessToken); code != http.StatusOK {
+		t.Fatalf("antes da revogação: status %d", code)
+	}
+
+	now = now.Add(time.Minute)
+	if err := RevokeAllSessions(ctx, 7, RevokedBySuperadmin); err != nil {
+		t.Fatal(err)
+	}
+	revokedAt := store.revokedAll[7]
+	user.SessionsRevokedAt = &revokedAt
+	for _, s := range []*Session{a, b} {
+		if code := call(s.AccessToken); code != http.StatusUnauthorized {
+			t.Errorf("após encerrar todas: status %d, esperado 401", code)
+		}
+	}
+
+	// Login novo depois da revogação funciona
+	now = now.Add(time.Second)
+	c, err := auth.Login(ctx, "admin@example.com", "senha-correta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := call(c.AccessToken); code != http.StatusOK {
+		t.Errorf("login após a revogação: status %d", code)
+	}
+
+	// Usuário desativado perde o acesso na hora e não entra de novo
+	user.Disabled = true
+	if code := call(c.AccessToken); code != http.StatusForbidden {
+		t.Errorf("usuário desativado: status %d, esperado 403", code)
+	}
+	if _, err := auth.Login(ctx, "admin@example.com", "senha-correta"); !errors.Is(err, ErrUserDisabled) {
+		t.Errorf("login de usuário desativado: %v", err)
+	}
+}
+
+func TestListSessionsMarksCurrent(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	store := useSessionStore(t, &now)
+	ctx := context.Background()
+	req := httptest.NewRequest("POST", "/auth", nil)
+	req.RemoteAddr = "203.0.113.7:5000"
+	req.Header.Set("User-Agent", "navegador")
+
+	TrackSession(ctx, req, 5, "s1")
+	TrackSession(ctx, req, 5, "s2")
+	TrackSession(ctx, req, 6, "s3")
+
+	list, err := ListSessions(ctx, 5, "s2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("esperadas 2 sessões, recebeu %d", len(list))
+	}
+	for _, s := range list {
+		if s.Current != (s.SessionID == "s2") {
+			t.Errorf("sessão %s: current=%v", s.SessionID, s.Current)
+		}
+		if s.IP != "203.0.113.7" || s.UserAgent != "navegador" {
+			t.Errorf("sessão %s sem IP/user agent: %+v", s.SessionID, s)
+		}
+	}
+
+	id := store.rows["s3"].ID
+	if _, err := SessionByID(ctx, 5, id); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("sessão de outro usuário encontrada: %v", err)
+	}
+	// Busca direto pelo id, sem passar pela listagem (limitada às 100 mais
+	// recentes)
+	if s, err := SessionByID(ctx, 5, store.rows["s1"].ID); err != nil || s.SessionID != "s1" {
+		t.Errorf("sessão do usuário não encontrada: %+v, %v", s, err)
+	}
+}
@@ -1,95 +1,283 @@
 package middleware
 
 import (
+	"bytes"
 	"context"
-	"log"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"os"
-	"strconv"
 	"strings"
+	"time"
 
-	"CDNProxy_v2/backend/database"
-
-	"github.com/lestrrat-go/jwx/v3/jwk"
+	"github.com/lestrrat-go/jwx/v3/jws"
 	jwxjwt "github.com/lestrrat-go/jwx/v3/jwt"
 )
 
-func SupabaseAuth(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
-			http.Error(w, "Authorization header required", http.StatusUnauthorized)
-			return
-		}
+// SupabaseAuthConfig define o projeto Supabase e como os tokens são validados.
+type SupabaseAuthConfig struct {
+	// URL do projeto (SUPABASE_URL).
+	URL string
+	// APIKey pública, usada no login e na recuperação de senha.
+	APIKey string
+	// ServiceRoleKey, usada na Admin API (criar usuário, trocar senha).
+	ServiceRoleKey string
+	// JWKSURL é o endpoint .well-known/jwks.json do projeto.
+	JWKSURL string
+	// Issuer esperado na claim "iss". Vazio não valida.
+	Issuer string
+	// Audience esperada na claim "aud". Vazio não valida.
+	Audience string
+	JWKS     JWKSOptions
+	// HTTPClient usado nas chamadas REST (padrão com timeout de 15 s).
+	HTTPClient *http.Client
+}
 
-		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-		if tokenString == authHeader {
-			http.Error(w, "Could not find Bearer token in Authorization header", http.StatusUnauthorized)
-			return
-		}
+// SupabaseAuthenticator delega login e senhas ao Supabase Auth e valida os
+// tokens com o JWKS em cache.
+type SupabaseAuthenticator struct {
+	cfg      SupabaseAuthConfig
+	jwks     *JWKSCache
+	client   *http.Client
+	users    userStore
+	issuer   string
+	audience string
+}
 
-		log.Printf("DEBUG: Received token string: %s", tokenString)
+// NewSupabaseAuthenticator cria o autenticador. O JWKS é baixado sob demanda;
+// chame Start para a atualização periódica.
+func NewSupabaseAuthenticator(cfg SupabaseAuthConfig) *SupabaseAuthenticator {
+	client := cfg.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 15 * time.Second}
+	}
+	return &SupabaseAuthenticator{
+		cfg:      cfg,
+		jwks:     NewJWKSCache(cfg.JWKSURL, cfg.JWKS),
+		client:   client,
+		users:    dbUserStore{},
+		issuer:   cfg.Issuer,
+		audience: cfg.Audience,
+	}
+}
 
-		jwksURL := os.Getenv("SUPABASE_JWT_SIGNING_KEY")
-		if jwksURL == "" {
-			http.Error(w, "Supabase JWKS URL not configured", http.StatusInternalServerError)
-			return
-		}
+// Start atualiza o JWKS em segundo plano até ctx ser cancelado.
+func (a *SupabaseAuthenticator) Start(ctx context.Context) {
+	a.jwks.Start(ctx)
+}
 
-		keySet, err := jwk.Fetch(r.Context(), jwksURL)
-		if err != nil {
-			log.Printf("ERROR: Failed to fetch JWKS: %v", err)
-			http.Error(w, "Failed to fetch JWKS", http.StatusInternalServerError)
-			return
-		}
+// Authenticate valida assinatura, expiração, issuer e audience e resolve o
+// subject em public.users.supabase_auth_id.
+func (a *SupabaseAuthenticator) Authenticate(ctx context.Context, tokenString string) (*Identity, error) {
+	msg, err := jws.ParseString(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	var kid string
+	if sigs := msg.Signatures(); len(sigs) > 0 {
+		kid, _ = sigs[0].ProtectedHeaders().KeyID()
+	}
 
-		token, err := jwxjwt.ParseString(
-			tokenString,
-			jwxjwt.WithKeySet(keySet),
-			jwxjwt.WithValidate(true),
-			jwxjwt.WithContext(r.Context()),
-		)
-		if err != nil {
-			log.Printf("ERROR: Token validation failed: %v", err)
-			http.Error(w, "Invalid token: "+err.Error(), http.StatusUnauthorized)
-			return
-		}
+	keySet, err := a.jwks.KeySetFor(ctx, kid)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrAuthUnavailable, err)
+	}
 
-		subject, ok := token.Subject()
-		if !ok || subject == "" {
-			http.Error(w, "Subject claim not found", http.StatusUnauthorized)
-			return
-		}
+	options := []jwxjwt.ParseOption{
+		jwxjwt.WithKeySet(keySet, jws.WithInferAlgorithmFromKey(true)),
+		jwxjwt.WithValidate(true),
+		jwxjwt.WithContext(ctx),
+	}
+	if a.issuer != "" {
+		options = append(options, jwxjwt.WithIssuer(a.issuer))
+	}
+	if a.audience != "" {
+		options = append(options, jwxjwt.WithAudience(a.audience))
+	}
 
-		log.Printf("DEBUG: Extracted subject: %s", subject)
+	token, err := jwxjwt.ParseString(tokenString, options...)
+	if err != nil {
+		return nil, err
+	}
 
-		var (
-			userID      int64
-			userRoleInt int
-		)
+	subject, ok := token.Subject()
+	if !ok || subject == "" {
+		return nil, errors.New("subject claim not found")
+	}
 
-		query := "SELECT id, role FROM public.users WHERE supabase_auth_id = $1"
-		err = database.DB.QueryRow(
-			r.Context(),
-			query,
-			subject,
-		).Scan(&userID, &userRoleInt)
+	user, err := a.users.bySupabaseID(ctx, subject)
+	if err != nil {
+		return nil, fmt.Errorf("%w: subject %s: %v", ErrUserNotFound, subject, err)
+	}
+	identity := user.identity(subject)
+	token.Get("session_id", &identity.SessionID)
+	identity.SessionID = identity.SessionIDFor(tokenString)
+	issuedAt, _ := token.IssuedAt()
+	if err := checkSession(ctx, user, identity.SessionID, issuedAt); err != nil {
+		return nil, err
+	}
+	return identity, nil
+}
 
-		if err != nil {
-			log.Printf("ERROR: Database query failed. Query: '%s', Subject: '%s', Error: %v", query, subject, err)
-			http.Error(w, "User not found or database error", http.StatusForbidden)
-			return
-		}
+// Login usa o grant "password" do Supabase Auth.
+func (a *SupabaseAuthenticator) Login(ctx context.Context, email, password string) (*Session, error) {
+	var session Session
+	status, body, err := a.call(ctx, http.MethodPost, "/auth/v1/token?grant_type=password", false,
+		map[string]string{"email": email, "password": password}, &session)
+	if err != nil {
+		return nil, err
+	}
+	if status == http.StatusBadRequest || status == http.StatusUnauthorized {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidCredentials, body)
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("supabase error: %s", body)
+	}
+	return &session, nil
+}
 
-		userRole := strconv.Itoa(userRoleInt)
+// Refresh usa o grant "refresh_token" do Supabase Auth; o session_id do novo
+// access token é o mesmo da sessão original.
+func (a *SupabaseAuthenticator) Refresh(ctx context.Context, refreshToken string) (*Session, error) {
+	if refreshToken == "" {
+		return nil, ErrInvalidRefreshToken
+	}
+	var session Session
+	status, body, err := a.call(ctx, http.MethodPost, "/auth/v1/token?grant_type=refresh_token", false,
+		map[string]string{"refresh_token": refreshToken}, &session)
+	if err != nil {
+		return nil, err
+	}
+	if status == http.StatusBadRequest || status == http.StatusUnauthorized {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidRefreshToken, body)
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("supabase error: %s", body)
+	}
+	return &session, nil
+}
 
-		log.Printf("DEBUG: Found user role '%s' for subject '%s'", userRole, subject)
+// Logout encerra no Supabase a sessão do access token, invalidando os
+// refresh tokens dela. Sessão já encerrada não é erro.
+func (a *SupabaseAuthenticator) Logout(ctx context.Context, accessToken string) error {
+	status, body, err := a.do(ctx, http.MethodPost, "/auth/v1/logout?scope=local", a.cfg.APIKey, accessToken, struct{}{}, nil)
+	if err != nil {
+		return err
+	}
+	switch status {
+	case http.StatusOK, http.StatusNoContent, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+		return nil
+	}
+	return fmt.Errorf("supabase error: %s", body)
+}
 
-		ctx := context.WithValue(r.Context(), UserIDKey, userID)
-		ctx = context.WithValue(ctx, RoleKey, userRole)
+// RequestPasswordReset pede ao Supabase o envio do e-mail de recuperação.
+func (a *SupabaseAuthenticator) RequestPasswordReset(ctx context.Context, email, redirectTo string) error {
+	status, body, err := a.call(ctx, http.MethodPost, "/auth/v1/recover", false,
+		map[string]string{"email": email, "redirect_to": redirectTo}, nil)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("supabase error: %s", body)
+	}
+	return nil
+}
 
-		next.ServeHTTP(w, r.WithContext(ctx))
-	})
+// ResetPassword não se aplica: o link do Supabase abre uma sessão e a nova
+// senha é enviada em /api/auth/update_password.
+func (a *SupabaseAuthenticator) ResetPassword(ctx context.Context, resetToken, password string) error {
+	return ErrNotSupported
+}
+
+// SetPassword troca a senha pela Admin API do Supabase.
+func (a *SupabaseAuthenticator) SetPassword(ctx context.Context, userID int64, password string) error {
+	user, err := a.users.byID(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUserNotFound, err)
+	}
+	if user.SupabaseAuthID == "" {
+		return errors.New("user is not linked to Supabase Auth")
+	}
+
+	status, body, err := a.call(ctx, http.MethodPut, "/auth/v1/admin/users/"+user.SupabaseAuthID, true,
+		map[string]string{"password": password}, nil)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("supabase error: %s", body)
+	}
+	return nil
+}
+
+// CreateCredentials cria o usuário no Supabase Auth e grava o UUID em
+// public.users.supabase_auth_id.
+func (a *SupabaseAuthenticator) CreateCredentials(ctx context.Context, userID int64, email, password string) error {
+	payload := map[string]interface{}{
+		"email":         email,
+		"password":      password,
+		"email_confirm": true,
+		"user_metadata": map[string]interface{}{},
+		"app_metadata":  map[string]interface{}{"provider": "email", "providers": []string{"email"}},
+	}
+
+	var created struct {
+		ID string `json:"id"`
+	}
+	status, body, err := a.call(ctx, http.MethodPost, "/auth/v1/admin/users", true, payload, &created)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK && status != http.StatusCreated {
+		return fmt.Errorf("supabase error: %s", body)
+	}
+
+	return a.users.setSupabaseID(ctx, userID, created.ID)
+}
+
+// call faz uma requisição JSON ao Supabase; admin usa a service role key. Em
+// status 2xx, decodifica a resposta em out (se não for nil); o corpo bruto é
+// devolvido para mensagens de erro.
+func (a *SupabaseAuthenticator) call(ctx context.Context, method, path string, admin bool, payload, out interface{}) (int, string, error) {
+	if admin {
+		return a.do(ctx, method, path, a.cfg.ServiceRoleKey, a.cfg.ServiceRoleKey, payload, out)
+	}
+	return a.do(ctx, method, path, a.cfg.APIKey, "", payload, out)
+}
+
+// do é call com apikey e Bearer explícitos (bearer vazio omite Authorization).
+func (a *SupabaseAuthenticator) do(ctx context.Context, method, path, apiKey, bearer string, payload, out interface{}) (int, string, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return 0, "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(a.cfg.URL, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("apikey", apiKey)
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to connect to Supabase Auth: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := io.ReadAll(resp.Body)
+	if out != nil && resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		if err := json.Unmarshal(respBody, out); err != nil {
+			return resp.StatusCode, string(respBody), err
+		}
+	}
+	return resp.StatusCode, string(respBody), nil
 }
 
 func CORSMiddleware(next http.Handler) http.Handler {
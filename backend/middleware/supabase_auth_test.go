@@ -1,77 +1,341 @@
 package middleware
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
-	"os"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v3/jwa"
+	"github.com/lestrrat-go/jwx/v3/jwk"
+	jwxjwt "github.com/lestrrat-go/jwx/v3/jwt"
 )
 
-// Mock JWT válido (gere um token real do Supabase para teste)
-const validJWT = "Bearer <SUPERADMIN_JWT_AQUI>"
-const adminJWT = "Bearer <ADMIN_JWT_AQUI>"
+const (
+	testIssuer   = "https://projeto-teste.supabase.co/auth/v1"
+	testAudience = "authenticated"
+)
 
-// Mock JWKS URL (endpoint público do seu projeto Supabase)
-const jwksURL = "https://<YOUR_PROJECT_ID>.supabase.co/auth/v1/keys"
+// jwksServer simula o endpoint .well-known/jwks.json do Supabase.
+type jwksServer struct {
+	*httptest.Server
+	hits atomic.Int32
 
-func TestSupabaseAuthMiddlewareSuperadmin(t *testing.T) {
-	os.Setenv("SUPABASE_JWT_SIGNING_KEY", jwksURL)
+	mu   sync.Mutex
+	keys jwk.Set
+	fail bool
+}
 
-	protectedHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("Acesso autorizado SUPERADMIN"))
-	})
+func newJWKSServer(t *testing.T, keys ...jwk.Key) *jwksServer {
+	t.Helper()
+	s := &jwksServer{}
+	s.setKeys(t, keys...)
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.hits.Add(1)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.fail {
+			http.Error(w, "indisponível", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.keys)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
 
-	handlerToTest := SupabaseAuth(protectedHandler)
+func (s *jwksServer) setKeys(t *testing.T, keys ...jwk.Key) {
+	t.Helper()
+	set := jwk.NewSet()
+	for _, k := range keys {
+		pub, err := jwk.PublicKeyOf(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := set.AddKey(pub); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.mu.Lock()
+	s.keys = set
+	s.mu.Unlock()
+}
 
-	req := httptest.NewRequest("GET", "/api/protected", nil)
-	req.Header.Set("Authorization", validJWT)
+func (s *jwksServer) setFail(fail bool) {
+	s.mu.Lock()
+	s.fail = fail
+	s.mu.Unlock()
+}
 
-	rr := httptest.NewRecorder()
-	handlerToTest.ServeHTTP(rr, req)
+func newSigningKey(t *testing.T, kid string) jwk.Key {
+	t.Helper()
+	raw, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := jwk.Import(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key.Set(jwk.KeyIDKey, kid)
+	key.Set(jwk.AlgorithmKey, jwa.RS256())
+	return key
+}
+
+type tokenOptions struct {
+	subject  string
+	issuer   string
+	audience string
+	expires  time.Time
+}
 
-	if rr.Code != http.StatusOK {
-		t.Errorf("Esperado status 200 para SUPERADMIN, recebeu %d, body: %s", rr.Code, rr.Body.String())
+func signToken(t *testing.T, key jwk.Key, o tokenOptions) string {
+	t.Helper()
+	if o.issuer == "" {
+		o.issuer = testIssuer
+	}
+	if o.audience == "" {
+		o.audience = testAudience
+	}
+	if o.expires.IsZero() {
+		o.expires = time.Now().Add(time.Hour)
+	}
+
+	tok, err := jwxjwt.NewBuilder().
+		Subject(o.subject).
+		Issuer(o.issuer).
+		Audience([]string{o.audience}).
+		IssuedAt(time.Now().Add(-time.Minute)).
+		Expiration(o.expires).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := jwxjwt.Sign(tok, jwxjwt.WithKey(jwa.RS256(), key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(signed)
+}
+
+// useSupabaseAuth instala um autenticador apontando para o servidor local e
+// um cadastro de usuários em memória no lugar do banco.
+func useSupabaseAuth(t *testing.T, jwksURL string, opts JWKSOptions) *SupabaseAuthenticator {
+	t.Helper()
+	a := NewSupabaseAuthenticator(SupabaseAuthConfig{
+		JWKSURL:  jwksURL,
+		Issuer:   testIssuer,
+		Audience: testAudience,
+		JWKS:     opts,
+	})
+	a.users = newFakeUserStore(
+		&authUser{ID: 1, Email: "super@example.com", Role: 1, SupabaseAuthID: "superadmin-uuid"},
+		&authUser{ID: 2, Email: "admin@example.com", Role: 2, SupabaseAuthID: "admin-uuid"},
+	)
+	now := time.Now()
+	useSessionStore(t, &now)
+	useAuthenticator(t, a)
+	return a
+}
+
+func TestSupabaseAuthMiddlewareSuperadmin(t *testing.T) {
+	key := newSigningKey(t, "kid-1")
+	srv := newJWKSServer(t, key)
+	useSupabaseAuth(t, srv.URL, JWKSOptions{})
+	now := time.Now()
+	store := useMFAStore(t, &now)
+
+	// O Superadmin precisa do segundo fator; sem a claim session_id, a
+	// sessão é o hash do token
+	token := signToken(t, key, tokenOptions{subject: "superadmin-uuid"})
+	if res := callProtected(token); res.code != http.StatusForbidden {
+		t.Fatalf("Esperado status 403 para SUPERADMIN sem segundo fator, recebeu %d", res.code)
+	}
+	store.markSession(context.Background(), 1, HashAPIKey(token), now)
+
+	res := callProtected(token)
+	if res.code != http.StatusOK {
+		t.Fatalf("Esperado status 200 para SUPERADMIN, recebeu %d", res.code)
+	}
+	if res.userID != 1 || res.role != "1" {
+		t.Errorf("Contexto inesperado: userID=%d role=%q", res.userID, res.role)
 	}
 }
 
 func TestSupabaseAuthMiddlewareAdmin(t *testing.T) {
-	os.Setenv("SUPABASE_JWT_SIGNING_KEY", jwksURL)
+	key := newSigningKey(t, "kid-1")
+	srv := newJWKSServer(t, key)
+	useSupabaseAuth(t, srv.URL, JWKSOptions{})
 
-	protectedHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("Acesso autorizado ADMIN"))
-	})
+	res := callProtected(signToken(t, key, tokenOptions{subject: "admin-uuid"}))
+	if res.code != http.StatusOK || res.role != "2" {
+		t.Errorf("Esperado status 200 e role 2 para ADMIN, recebeu %d e %q", res.code, res.role)
+	}
+}
 
-	handlerToTest := SupabaseAuth(protectedHandler)
+func TestSupabaseAuthMiddlewareRejectsTokens(t *testing.T) {
+	key := newSigningKey(t, "kid-1")
+	other := newSigningKey(t, "kid-1") // mesmo kid, chave diferente
+	srv := newJWKSServer(t, key)
+	useSupabaseAuth(t, srv.URL, JWKSOptions{})
 
-	req := httptest.NewRequest("GET", "/api/protected", nil)
-	req.Header.Set("Authorization", adminJWT)
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"sem token", "", http.StatusUnauthorized},
+		{"token malformado", "token_invalido", http.StatusUnauthorized},
+		{"assinatura de outra chave", signToken(t, other, tokenOptions{subject: "admin-uuid"}), http.StatusUnauthorized},
+		{"expirado", signToken(t, key, tokenOptions{subject: "admin-uuid", expires: time.Now().Add(-time.Hour)}), http.StatusUnauthorized},
+		{"issuer errado", signToken(t, key, tokenOptions{subject: "admin-uuid", issuer: "https://outro.supabase.co/auth/v1"}), http.StatusUnauthorized},
+		{"audience errada", signToken(t, key, tokenOptions{subject: "admin-uuid", audience: "anon"}), http.StatusUnauthorized},
+		{"sem subject", signToken(t, key, tokenOptions{}), http.StatusUnauthorized},
+		{"usuário inexistente", signToken(t, key, tokenOptions{subject: "desconhecido"}), http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if res := callProtected(tt.token); res.code != tt.want {
+				t.Errorf("Esperado status %d, recebeu %d", tt.want, res.code)
+			}
+		})
+	}
+}
 
-	rr := httptest.NewRecorder()
-	handlerToTest.ServeHTTP(rr, req)
+func TestSupabaseAuthCachesJWKS(t *testing.T) {
+	key := newSigningKey(t, "kid-1")
+	srv := newJWKSServer(t, key)
+	useSupabaseAuth(t, srv.URL, JWKSOptions{})
 
-	if rr.Code != http.StatusOK {
-		t.Errorf("Esperado status 200 para ADMIN, recebeu %d, body: %s", rr.Code, rr.Body.String())
+	token := signToken(t, key, tokenOptions{subject: "admin-uuid"})
+	for i := 0; i < 5; i++ {
+		if res := callProtected(token); res.code != http.StatusOK {
+			t.Fatalf("requisição %d: status %d", i, res.code)
+		}
+	}
+	if hits := srv.hits.Load(); hits != 1 {
+		t.Errorf("JWKS deveria ser baixado uma vez, foi baixado %d vezes", hits)
 	}
 }
 
-func TestSupabaseAuthMiddlewareInvalidToken(t *testing.T) {
-	os.Setenv("SUPABASE_JWT_SIGNING_KEY", jwksURL)
+func TestSupabaseAuthRefreshesOnUnknownKid(t *testing.T) {
+	oldKey := newSigningKey(t, "kid-old")
+	newKey := newSigningKey(t, "kid-new")
+	srv := newJWKSServer(t, oldKey)
+	useSupabaseAuth(t, srv.URL, JWKSOptions{MinRefreshInterval: time.Nanosecond})
 
-	protectedHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-	})
+	if res := callProtected(signToken(t, oldKey, tokenOptions{subject: "admin-uuid"})); res.code != http.StatusOK {
+		t.Fatalf("chave antiga: status %d", res.code)
+	}
+
+	// Rotação de chaves no Supabase
+	srv.setKeys(t, oldKey, newKey)
+
+	if res := callProtected(signToken(t, newKey, tokenOptions{subject: "admin-uuid"})); res.code != http.StatusOK {
+		t.Fatalf("chave nova: status %d", res.code)
+	}
+	if hits := srv.hits.Load(); hits != 2 {
+		t.Errorf("esperado 2 downloads do JWKS, houve %d", hits)
+	}
+}
+
+func TestSupabaseAuthUnknownKidIsRateLimited(t *testing.T) {
+	key := newSigningKey(t, "kid-1")
+	srv := newJWKSServer(t, key)
+	useSupabaseAuth(t, srv.URL, JWKSOptions{MinRefreshInterval: time.Hour})
+
+	// Primeiro acesso baixa o JWKS; kids forjados não disparam novos downloads
+	for i := 0; i < 3; i++ {
+		forged := signToken(t, newSigningKey(t, "kid-forjado"), tokenOptions{subject: "admin-uuid"})
+		if res := callProtected(forged); res.code != http.StatusUnauthorized {
+			t.Fatalf("token forjado: status %d", res.code)
+		}
+	}
+	if hits := srv.hits.Load(); hits != 1 {
+		t.Errorf("kids desconhecidos não devem gerar downloads dentro do intervalo mínimo, houve %d", hits)
+	}
+}
+
+func TestSupabaseAuthServesStaleKeysOnError(t *testing.T) {
+	key := newSigningKey(t, "kid-1")
+	srv := newJWKSServer(t, key)
+	v := useSupabaseAuth(t, srv.URL, JWKSOptions{})
+
+	token := signToken(t, key, tokenOptions{subject: "admin-uuid"})
+	if res := callProtected(token); res.code != http.StatusOK {
+		t.Fatalf("status %d", res.code)
+	}
+
+	srv.setFail(true)
+	if err := v.jwks.Refresh(context.Background()); err == nil {
+		t.Fatal("esperado erro na atualização com o servidor fora do ar")
+	}
+
+	if res := callProtected(token); res.code != http.StatusOK {
+		t.Errorf("chaves antigas devem continuar válidas quando o JWKS falha, status %d", res.code)
+	}
+}
+
+func TestSupabaseAuthJWKSUnavailable(t *testing.T) {
+	key := newSigningKey(t, "kid-1")
+	srv := newJWKSServer(t, key)
+	srv.setFail(true)
+	useSupabaseAuth(t, srv.URL, JWKSOptions{})
 
-	handlerToTest := SupabaseAuth(protectedHandler)
+	if res := callProtected(signToken(t, key, tokenOptions{subject: "admin-uuid"})); res.code != http.StatusServiceUnavailable {
+		t.Errorf("Esperado 503 sem JWKS disponível, recebeu %d", res.code)
+	}
+}
 
-	req := httptest.NewRequest("GET", "/api/protected", nil)
-	req.Header.Set("Authorization", "Bearer token_invalido")
+func TestSupabaseRefreshAndLogout(t *testing.T) {
+	var logoutAuth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/auth/v1/token" && r.URL.Query().Get("grant_type") == "refresh_token":
+			var body struct {
+				RefreshToken string `json:"refresh_token"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			if body.RefreshToken != "rt-valido" {
+				http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte(`{"access_token":"novo","token_type":"bearer","expires_in":3600,"refresh_token":"rt-novo"}`))
+		case r.URL.Path == "/auth/v1/logout":
+			logoutAuth = r.Header.Get("Authorization")
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	a := NewSupabaseAuthenticator(SupabaseAuthConfig{URL: srv.URL, APIKey: "anon"})
+	ctx := context.Background()
 
-	rr := httptest.NewRecorder()
-	handlerToTest.ServeHTTP(rr, req)
+	session, err := a.Refresh(ctx, "rt-valido")
+	if err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	if session.AccessToken != "novo" || session.RefreshToken != "rt-novo" {
+		t.Errorf("sessão inesperada: %+v", session)
+	}
+	if _, err := a.Refresh(ctx, "rt-invalido"); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("refresh token inválido: %v", err)
+	}
 
-	if rr.Code == http.StatusOK {
-		t.Errorf("Esperado erro de autenticação, recebeu status 200")
+	if err := a.Logout(ctx, "token-do-usuario"); err != nil {
+		t.Fatalf("Logout: %v", err)
+	}
+	if logoutAuth != "Bearer token-do-usuario" {
+		t.Errorf("logout deveria usar o token do usuário, usou %q", logoutAuth)
 	}
 }
@@ -0,0 +1,342 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"CDNProxy_v2/backend/database"
+)
+
+// Ações limitadas por LoginThrottle.
+const (
+	ThrottleLogin   = "login"
+	ThrottleRecover = "recover"
+	ThrottleMFA     = "mfa"
+)
+
+// Tipos de chave dos contadores.
+const (
+	throttleByIP    = "ip"
+	throttleByEmail = "email"
+	throttleByUser  = "user"
+)
+
+// LoginThrottleConfig define os limites de tentativas. Ao atingir o limite de
+// uma chave, ela fica bloqueada por BaseLockout; cada falha seguinte dobra o
+// bloqueio, até MaxLockout. Contadores sem falhas há mais de Window zeram.
+type LoginThrottleConfig struct {
+	// Falhas de login por e-mail e por IP.
+	EmailFailures int
+	IPFailures    int
+	// Pedidos de recuperação de senha por e-mail e por IP (contam todos,
+	// contra o envio de e-mails em massa).
+	RecoverPerEmail int
+	RecoverPerIP    int
+	// Códigos do segundo fator incorretos por usuário.
+	MFAFailures int
+	BaseLockout time.Duration
+	MaxLockout  time.Duration
+	Window      time.Duration
+}
+
+// DefaultLoginThrottle são os limites sem configuração.
+var DefaultLoginThrottle = LoginThrottleConfig{
+	EmailFailures:   5,
+	IPFailures:      20,
+	RecoverPerEmail: 3,
+	RecoverPerIP:    10,
+	MFAFailures:     5,
+	BaseLockout:     time.Minute,
+	MaxLockout:      time.Hour,
+	Window:          time.Hour,
+}
+
+var (
+	throttleMu  sync.RWMutex
+	throttleCfg = DefaultLoginThrottle
+)
+
+// SetLoginThrottle troca os limites; campos zerados mantêm o padrão.
+func SetLoginThrottle(cfg LoginThrottleConfig) {
+	def := DefaultLoginThrottle
+	for _, f := range []struct {
+		v   *int
+		def int
+	}{
+		{&cfg.EmailFailures, def.EmailFailures},
+		{&cfg.IPFailures, def.IPFailures},
+		{&cfg.RecoverPerEmail, def.RecoverPerEmail},
+		{&cfg.RecoverPerIP, def.RecoverPerIP},
+		{&cfg.MFAFailures, def.MFAFailures},
+	} {
+		if *f.v <= 0 {
+			*f.v = f.def
+		}
+	}
+	for _, f := range []struct {
+		v   *time.Duration
+		def time.Duration
+	}{
+		{&cfg.BaseLockout, def.BaseLockout},
+		{&cfg.MaxLockout, def.MaxLockout},
+		{&cfg.Window, def.Window},
+	} {
+		if *f.v <= 0 {
+			*f.v = f.def
+		}
+	}
+	throttleMu.Lock()
+	throttleCfg = cfg
+	throttleMu.Unlock()
+}
+
+func currentThrottle() LoginThrottleConfig {
+	throttleMu.RLock()
+	defer throttleMu.RUnlock()
+	return throttleCfg
+}
+
+// ThrottleSubject identifica quem tenta: IP sempre, e-mail no login e na
+// recuperação, usuário no segundo fator.
+type ThrottleSubject struct {
+	IP        string
+	Email     string
+	UserID    int64
+	UserAgent string
+}
+
+// NewThrottleSubject monta o ThrottleSubject de uma requisição.
+func NewThrottleSubject(r *http.Request, email string, userID int64) ThrottleSubject {
+	return ThrottleSubject{
+		IP:        ClientIP(r),
+		Email:     strings.ToLower(strings.TrimSpace(email)),
+		UserID:    userID,
+		UserAgent: r.UserAgent(),
+	}
+}
+
+type throttleKey struct {
+	action, kind, key string
+	limit             int
+}
+
+// keys devolve as chaves contadas para a ação.
+func (s ThrottleSubject) keys(action string, cfg LoginThrottleConfig) []throttleKey {
+	var out []throttleKey
+	add := func(kind, key string, limit int) {
+		if key != "" && key != "0" {
+			out = append(out, throttleKey{action, kind, key, limit})
+		}
+	}
+	switch action {
+	case ThrottleLogin:
+		add(throttleByEmail, s.Email, cfg.EmailFailures)
+		add(throttleByIP, s.IP, cfg.IPFailures)
+	case ThrottleRecover:
+		add(throttleByEmail, s.Email, cfg.RecoverPerEmail)
+		add(throttleByIP, s.IP, cfg.RecoverPerIP)
+	case ThrottleMFA:
+		add(throttleByUser, strconv.FormatInt(s.UserID, 10), cfg.MFAFailures)
+	}
+	return out
+}
+
+// AuthFailure é uma linha de public.auth_failures.
+type AuthFailure struct {
+	ID          int64      `json:"id"`
+	Action      string     `json:"action"`
+	IP          string     `json:"ip"`
+	Email       string     `json:"email"`
+	UserID      *int64     `json:"user_id,omitempty"`
+	Reason      string     `json:"reason"`
+	UserAgent   string     `json:"user_agent"`
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// Motivos gravados em public.auth_failures.
+const (
+	FailureInvalidCredentials = "invalid_credentials"
+	FailureResetRequested     = "reset_requested"
+	FailureInvalidMFACode     = "invalid_mfa_code"
+	FailureBlocked            = "blocked"
+)
+
+// throttleStore isola public.auth_throttle e public.auth_failures para os testes.
+type throttleStore interface {
+	// lockedUntil devolve o maior bloqueio vigente entre as chaves.
+	lockedUntil(ctx context.Context, keys []throttleKey, now time.Time) (time.Time, error)
+	// fail soma uma falha (zerando contadores parados desde resetBefore) e
+	// devolve o total.
+	fail(ctx context.Context, k throttleKey, now, resetBefore time.Time) (int, error)
+	lock(ctx context.Context, k throttleKey, until time.Time) error
+	clear(ctx context.Context, k throttleKey) error
+	logFailure(ctx context.Context, f *AuthFailure) error
+}
+
+type dbThrottleStore struct{}
+
+func (dbThrottleStore) lockedUntil(ctx context.Context, keys []throttleKey, now time.Time) (time.Time, error) {
+	var until *time.Time
+	for _, k := range keys {
+		var t *time.Time
+		err := database.DB.QueryRow(ctx, `
+			SELECT MAX(locked_until) FROM public.auth_throttle
+			WHERE action = $1 AND kind = $2 AND key = $3 AND locked_until > $4`,
+			k.action, k.kind, k.key, now).Scan(&t)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if t != nil && (until == nil || t.After(*until)) {
+			until = t
+		}
+	}
+	if until == nil {
+		return time.Time{}, nil
+	}
+	return *until, nil
+}
+
+func (dbThrottleStore) fail(ctx context.Context, k throttleKey, now, resetBefore time.Time) (int, error) {
+	var failures int
+	err := database.DB.QueryRow(ctx, `
+		INSERT INTO public.auth_throttle (action, kind, key, failures, last_failure_at) VALUES ($1, $2, $3, 1, $4)
+		ON CONFLICT (action, kind, key) DO UPDATE SET
+			failures = CASE WHEN auth_throttle.last_failure_at < $5 THEN 1 ELSE auth_throttle.failures + 1 END,
+			locked_until = CASE WHEN auth_throttle.last_failure_at < $5 THEN NULL ELSE auth_throttle.locked_until END,
+			last_failure_at = $4
+		RETURNING failures`, k.action, k.kind, k.key, now, resetBefore).Scan(&failures)
+	return failures, err
+}
+
+func (dbThrottleStore) lock(ctx context.Context, k throttleKey, until time.Time) error {
+	_, err := database.DB.Exec(ctx,
+		"UPDATE public.auth_throttle SET locked_until = $4 WHERE action = $1 AND kind = $2 AND key = $3",
+		k.action, k.kind, k.key, until)
+	return err
+}
+
+func (dbThrottleStore) clear(ctx context.Context, k throttleKey) error {
+	_, err := database.DB.Exec(ctx,
+		"DELETE FROM public.auth_throttle WHERE action = $1 AND kind = $2 AND key = $3", k.action, k.kind, k.key)
+	return err
+}
+
+func (dbThrottleStore) logFailure(ctx context.Context, f *AuthFailure) error {
+	return database.DB.QueryRow(ctx, `
+		INSERT INTO public.auth_failures (action, ip, email, user_id, reason, user_agent, locked_until)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id, created_at`,
+		f.Action, f.IP, f.Email, f.UserID, f.Reason, f.UserAgent, f.LockedUntil).Scan(&f.ID, &f.CreatedAt)
+}
+
+// Dependências do bloqueio de tentativas, trocadas nos testes.
+var (
+	throttles   throttleStore = dbThrottleStore{}
+	throttleNow               = time.Now
+)
+
+// lockoutFor devolve o bloqueio após failures falhas numa chave de limite
+// limit: zero antes do limite, depois BaseLockout dobrando a cada falha.
+func lockoutFor(failures, limit int, cfg LoginThrottleConfig) time.Duration {
+	if failures < limit {
+		return 0
+	}
+	d := cfg.BaseLockout
+	for i := limit; i < failures && d < cfg.MaxLockout; i++ {
+		d *= 2
+	}
+	return min(d, cfg.MaxLockout)
+}
+
+func (s ThrottleSubject) failure(action, reason string, lockedUntil time.Time) *AuthFailure {
+	f := &AuthFailure{Action: action, IP: s.IP, Email: s.Email, Reason: reason, UserAgent: s.UserAgent}
+	if s.UserID != 0 {
+		f.UserID = &s.UserID
+	}
+	if !lockedUntil.IsZero() {
+		f.LockedUntil = &lockedUntil
+	}
+	return f
+}
+
+// CheckThrottle devolve quanto falta para alguma chave do sujeito ser
+// desbloqueada (zero se liberado). Tentativas barradas são registradas em
+// public.auth_failures. Erros do banco liberam a tentativa, para uma queda
+// do banco não bloquear todos os logins.
+func CheckThrottle(ctx context.Context, action string, s ThrottleSubject) time.Duration {
+	now := throttleNow()
+	until, err := throttles.lockedUntil(ctx, s.keys(action, currentThrottle()), now)
+	if err != nil {
+		log.Printf("ERROR: Could not read %s throttle: %v", action, err)
+		return 0
+	}
+	if until.IsZero() {
+		return 0
+	}
+	if err := throttles.logFailure(ctx, s.failure(action, FailureBlocked, until)); err != nil {
+		log.Printf("ERROR: Could not record blocked %s attempt: %v", action, err)
+	}
+	return until.Sub(now)
+}
+
+// RecordAuthFailure conta uma falha (ou, na recuperação de senha, um pedido)
+// em todas as chaves do sujeito, bloqueia as que passaram do limite e grava o
+// histórico. Devolve o bloqueio resultante (zero se nenhum).
+func RecordAuthFailure(ctx context.Context, action string, s ThrottleSubject, reason string) time.Duration {
+	cfg := currentThrottle()
+	now := throttleNow()
+	var lockout time.Duration
+	for _, k := range s.keys(action, cfg) {
+		failures, err := throttles.fail(ctx, k, now, now.Add(-cfg.Window))
+		if err != nil {
+			log.Printf("ERROR: Could not count %s failure for %s: %v", action, k.kind, err)
+			continue
+		}
+		d := lockoutFor(failures, k.limit, cfg)
+		if d == 0 {
+			continue
+		}
+		if err := throttles.lock(ctx, k, now.Add(d)); err != nil {
+			log.Printf("ERROR: Could not lock %s %s: %v", k.kind, k.key, err)
+		}
+		lockout = max(lockout, d)
+	}
+
+	var until time.Time
+	if lockout > 0 {
+		until = now.Add(lockout)
+	}
+	if err := throttles.logFailure(ctx, s.failure(action, reason, until)); err != nil {
+		log.Printf("ERROR: Could not record %s failure: %v", action, err)
+	}
+	return lockout
+}
+
+// ResetThrottle zera, após um sucesso, os contadores de e-mail e de usuário.
+// O do IP continua, para que uma conta válida do atacante não o zere.
+func ResetThrottle(ctx context.Context, action string, s ThrottleSubject) {
+	for _, k := range s.keys(action, currentThrottle()) {
+		if k.kind == throttleByIP {
+			continue
+		}
+		if err := throttles.clear(ctx, k); err != nil {
+			log.Printf("ERROR: Could not reset %s throttle: %v", action, err)
+		}
+	}
+}
+
+// ErrThrottled é a resposta às tentativas bloqueadas.
+var ErrThrottled = errors.New("too many attempts, try again later")
+
+// WriteThrottled responde 429 com Retry-After em segundos.
+func WriteThrottled(w http.ResponseWriter, wait time.Duration) {
+	secs := int64((wait + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.FormatInt(max(secs, 1), 10))
+	http.Error(w, ErrThrottled.Error(), http.StatusTooManyRequests)
+}
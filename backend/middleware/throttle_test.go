@@ -0,0 +1,238 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type fakeThrottleRow struct {
+	failures    int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// fakeThrottleStore guarda os contadores em memória, com a mesma regra de
+// janela do dbThrottleStore.
+type fakeThrottleStore struct {
+	rows     map[throttleKey]*fakeThrottleRow
+	failures []AuthFailure
+}
+
+func rowKey(k throttleKey) throttleKey {
+	return throttleKey{action: k.action, kind: k.kind, key: k.key}
+}
+
+func (s *fakeThrottleStore) lockedUntil(_ context.Context, keys []throttleKey, now time.Time) (time.Time, error) {
+	var until time.Time
+	for _, k := range keys {
+		if row, ok := s.rows[rowKey(k)]; ok && row.lockedUntil.After(now) && row.lockedUntil.After(until) {
+			until = row.lockedUntil
+		}
+	}
+	return until, nil
+}
+
+func (s *fakeThrottleStore) fail(_ context.Context, k throttleKey, now, resetBefore time.Time) (int, error) {
+	row, ok := s.rows[rowKey(k)]
+	if !ok || row.last.Before(resetBefore) {
+		row = &fakeThrottleRow{}
+		s.rows[rowKey(k)] = row
+	}
+	row.failures++
+	row.last = now
+	return row.failures, nil
+}
+
+func (s *fakeThrottleStore) lock(_ context.Context, k throttleKey, until time.Time) error {
+	s.rows[rowKey(k)].lockedUntil = until
+	return nil
+}
+
+func (s *fakeThrottleStore) clear(_ context.Context, k throttleKey) error {
+	delete(s.rows, rowKey(k))
+	return nil
+}
+
+func (s *fakeThrottleStore) logFailure(_ context.Context, f *AuthFailure) error {
+	s.failures = append(s.failures, *f)
+	return nil
+}
+
+func (s *fakeThrottleStore) failuresOf(kind, key string) int {
+	for k, row := range s.rows {
+		if k.kind == kind && k.key == key {
+			return row.failures
+		}
+	}
+	return 0
+}
+
+func useThrottleStore(t *testing.T, now *time.Time) *fakeThrottleStore {
+	t.Helper()
+	store := &fakeThrottleStore{rows: map[throttleKey]*fakeThrottleRow{}}
+	prevStore, prevNow, prevCfg := throttles, throttleNow, currentThrottle()
+	throttles, throttleNow = store, func() time.Time { return *now }
+	SetLoginThrottle(LoginThrottleConfig{})
+	t.Cleanup(func() {
+		throttles, throttleNow = prevStore, prevNow
+		SetLoginThrottle(prevCfg)
+	})
+	return store
+}
+
+func TestLockoutFor(t *testing.T) {
+	cfg := LoginThrottleConfig{BaseLockout: time.Minute, MaxLockout: 10 * time.Minute}
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, 0},
+		{4, 0},
+		{5, time.Minute},
+		{6, 2 * time.Minute},
+		{8, 8 * time.Minute},
+		{9, 10 * time.Minute},
+		{50, 10 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got := lockoutFor(tt.failures, 5, cfg); got != tt.want {
+			t.Errorf("lockoutFor(%d) = %v, esperado %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestLoginThrottleLocksEmailAfterLimit(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	store := useThrottleStore(t, &now)
+	ctx := context.Background()
+	s := ThrottleSubject{IP: "203.0.113.7", Email: "alvo@example.com"}
+
+	for i := 1; i < DefaultLoginThrottle.EmailFailures; i++ {
+		if d := RecordAuthFailure(ctx, ThrottleLogin, s, FailureInvalidCredentials); d != 0 {
+			t.Fatalf("falha %d já bloqueou por %v", i, d)
+		}
+	}
+	if d := CheckThrottle(ctx, ThrottleLogin, s); d != 0 {
+		t.Fatalf("bloqueado antes do limite: %v", d)
+	}
+
+	if d := RecordAuthFailure(ctx, ThrottleLogin, s, FailureInvalidCredentials); d != time.Minute {
+		t.Fatalf("bloqueio no limite = %v, esperado 1m", d)
+	}
+	if d := CheckThrottle(ctx, ThrottleLogin, s); d != time.Minute {
+		t.Fatalf("CheckThrottle = %v, esperado 1m", d)
+	}
+
+	// Mesmo e-mail vindo de outro IP continua bloqueado
+	other := ThrottleSubject{IP: "198.51.100.1", Email: "alvo@example.com"}
+	if d := CheckThrottle(ctx, ThrottleLogin, other); d == 0 {
+		t.Fatal("bloqueio por e-mail deveria valer para qualquer IP")
+	}
+
+	last := store.failures[len(store.failures)-1]
+	if last.Reason != FailureBlocked || last.LockedUntil == nil {
+		t.Fatalf("tentativa barrada não registrada: %+v", last)
+	}
+
+	// Falha seguinte, depois de liberado, dobra o bloqueio
+	now = now.Add(time.Minute)
+	if d := CheckThrottle(ctx, ThrottleLogin, s); d != 0 {
+		t.Fatalf("ainda bloqueado após o prazo: %v", d)
+	}
+	if d := RecordAuthFailure(ctx, ThrottleLogin, s, FailureInvalidCredentials); d != 2*time.Minute {
+		t.Fatalf("segundo bloqueio = %v, esperado 2m", d)
+	}
+}
+
+func TestLoginThrottleWindowResetsCounter(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	store := useThrottleStore(t, &now)
+	ctx := context.Background()
+	s := ThrottleSubject{IP: "203.0.113.7", Email: "alvo@example.com"}
+
+	for i := 0; i < 3; i++ {
+		RecordAuthFailure(ctx, ThrottleLogin, s, FailureInvalidCredentials)
+	}
+	now = now.Add(DefaultLoginThrottle.Window + time.Second)
+	RecordAuthFailure(ctx, ThrottleLogin, s, FailureInvalidCredentials)
+	if got := store.failuresOf(throttleByEmail, s.Email); got != 1 {
+		t.Fatalf("contador após a janela = %d, esperado 1", got)
+	}
+}
+
+func TestResetThrottleKeepsIPCounter(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	store := useThrottleStore(t, &now)
+	ctx := context.Background()
+	s := ThrottleSubject{IP: "203.0.113.7", Email: "alvo@example.com"}
+
+	RecordAuthFailure(ctx, ThrottleLogin, s, FailureInvalidCredentials)
+	RecordAuthFailure(ctx, ThrottleLogin, s, FailureInvalidCredentials)
+	ResetThrottle(ctx, ThrottleLogin, s)
+
+	if got := store.failuresOf(throttleByEmail, s.Email); got != 0 {
+		t.Errorf("contador do e-mail = %d, esperado 0 após sucesso", got)
+	}
+	if got := store.failuresOf(throttleByIP, s.IP); got != 2 {
+		t.Errorf("contador do IP = %d, esperado 2", got)
+	}
+}
+
+func TestRecoverThrottleCountsEveryRequest(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	useThrottleStore(t, &now)
+	ctx := context.Background()
+
+	// IPs diferentes: só o limite por e-mail deve atuar
+	for i := 0; i < DefaultLoginThrottle.RecoverPerEmail; i++ {
+		r := httptest.NewRequest("POST", "/api/auth/recover", nil)
+		r.RemoteAddr = fmt.Sprintf("203.0.113.%d:4000", i+1)
+		s := NewThrottleSubject(r, " Alvo@Example.com", 0)
+		if d := CheckThrottle(ctx, ThrottleRecover, s); d != 0 {
+			t.Fatalf("pedido %d bloqueado cedo demais", i+1)
+		}
+		RecordAuthFailure(ctx, ThrottleRecover, s, FailureResetRequested)
+	}
+	s := ThrottleSubject{IP: "198.51.100.9", Email: "alvo@example.com"}
+	if d := CheckThrottle(ctx, ThrottleRecover, s); d == 0 {
+		t.Fatal("esperado bloqueio da recuperação por e-mail")
+	}
+	// O login do mesmo e-mail não é afetado
+	if d := CheckThrottle(ctx, ThrottleLogin, s); d != 0 {
+		t.Fatalf("login bloqueado pela recuperação: %v", d)
+	}
+}
+
+func TestMFAThrottleByUser(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	store := useThrottleStore(t, &now)
+	ctx := context.Background()
+	s := ThrottleSubject{IP: "203.0.113.7", UserID: 42}
+
+	for i := 0; i < DefaultLoginThrottle.MFAFailures; i++ {
+		RecordAuthFailure(ctx, ThrottleMFA, s, FailureInvalidMFACode)
+	}
+	if d := CheckThrottle(ctx, ThrottleMFA, s); d == 0 {
+		t.Fatal("esperado bloqueio do segundo fator")
+	}
+	if got := store.failuresOf(throttleByIP, s.IP); got != 0 {
+		t.Errorf("segundo fator não deveria contar por IP, contou %d", got)
+	}
+	if f := store.failures[0]; f.UserID == nil || *f.UserID != 42 {
+		t.Errorf("user_id não registrado: %+v", f)
+	}
+}
+
+func TestWriteThrottled(t *testing.T) {
+	rec := httptest.NewRecorder()
+	WriteThrottled(rec, 1500*time.Millisecond)
+	if rec.Code != 429 {
+		t.Fatalf("status = %d, esperado 429", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("Retry-After = %q, esperado 2", got)
+	}
+}
@@ -0,0 +1,67 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Períodos de cobrança dos planos (plans.billing_period).
+const (
+	PeriodMonthly   = "monthly"
+	PeriodQuarterly = "quarterly"
+	PeriodYearly    = "yearly"
+	PeriodCustom    = "custom"
+)
+
+// Limites dos períodos: dias de um plano custom e quantidade de períodos
+// comprados de uma vez em um item do carrinho.
+const (
+	MaxPeriodDays = 3650
+	MaxPeriods    = 36
+)
+
+var (
+	ErrInvalidBillingPeriod = errors.New("billing_period must be monthly, quarterly, yearly or custom")
+	ErrInvalidPeriodDays    = fmt.Errorf("period_days must be between 1 and %d for custom plans and empty otherwise", MaxPeriodDays)
+	ErrInvalidPeriods       = fmt.Errorf("periods must be between 1 and %d", MaxPeriods)
+)
+
+// ValidateBillingPeriod confere o período de um plano. Vazio vale monthly.
+func ValidateBillingPeriod(period string, days *int) error {
+	switch period {
+	case "", PeriodMonthly, PeriodQuarterly, PeriodYearly:
+		if days != nil {
+			return ErrInvalidPeriodDays
+		}
+	case PeriodCustom:
+		if days == nil || *days < 1 || *days > MaxPeriodDays {
+			return ErrInvalidPeriodDays
+		}
+	default:
+		return ErrInvalidBillingPeriod
+	}
+	return nil
+}
+
+// RenewalInterval devolve, no formato de intervalo do Postgres, quanto
+// periods períodos do plano estendem um domínio: meses de calendário para
+// monthly, quarterly e yearly e dias para custom. Sem período (itens
+// anteriores aos planos terem período), cada período vale 30 dias.
+func RenewalInterval(period string, days *int, periods int) string {
+	if periods < 1 {
+		periods = 1
+	}
+	switch period {
+	case PeriodMonthly:
+		return fmt.Sprintf("%d months", periods)
+	case PeriodQuarterly:
+		return fmt.Sprintf("%d months", 3*periods)
+	case PeriodYearly:
+		return fmt.Sprintf("%d years", periods)
+	case PeriodCustom:
+		if days != nil && *days > 0 {
+			return fmt.Sprintf("%d days", *days*periods)
+		}
+	}
+	return fmt.Sprintf("%d days", 30*periods)
+}
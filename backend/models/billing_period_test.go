@@ -0,0 +1,52 @@
+package models
+
+import "testing"
+
+func intPtr(n int) *int { return &n }
+
+func TestValidateBillingPeriod(t *testing.T) {
+	tests := []struct {
+		period string
+		days   *int
+		want   error
+	}{
+		{"", nil, nil},
+		{PeriodMonthly, nil, nil},
+		{PeriodQuarterly, nil, nil},
+		{PeriodYearly, nil, nil},
+		{PeriodCustom, intPtr(45), nil},
+		{PeriodMonthly, intPtr(30), ErrInvalidPeriodDays},
+		{PeriodCustom, nil, ErrInvalidPeriodDays},
+		{PeriodCustom, intPtr(0), ErrInvalidPeriodDays},
+		{PeriodCustom, intPtr(MaxPeriodDays + 1), ErrInvalidPeriodDays},
+		{"weekly", nil, ErrInvalidBillingPeriod},
+	}
+	for _, tt := range tests {
+		if err := ValidateBillingPeriod(tt.period, tt.days); err != tt.want {
+			t.Errorf("ValidateBillingPeriod(%q, %v) = %v, esperado %v", tt.period, tt.days, err, tt.want)
+		}
+	}
+}
+
+func TestRenewalInterval(t *testing.T) {
+	tests := []struct {
+		period  string
+		days    *int
+		periods int
+		want    string
+	}{
+		{PeriodMonthly, nil, 1, "1 months"},
+		{PeriodMonthly, nil, 3, "3 months"},
+		{PeriodQuarterly, nil, 2, "6 months"},
+		{PeriodYearly, nil, 1, "1 years"},
+		{PeriodCustom, intPtr(45), 2, "90 days"},
+		{PeriodMonthly, nil, 0, "1 months"},
+		{"", nil, 1, "30 days"},
+		{"", nil, 2, "60 days"},
+	}
+	for _, tt := range tests {
+		if got := RenewalInterval(tt.period, tt.days, tt.periods); got != tt.want {
+			t.Errorf("RenewalInterval(%q, %v, %d) = %q, esperado %q", tt.period, tt.days, tt.periods, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package models
+
+import (
+	"errors"
+	"math"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Tipos de desconto dos cupons (coupons.discount_type).
+const (
+	DiscountPercentage = "percentage"
+	DiscountFixed      = "fixed"
+)
+
+// Coupon é um código de desconto do carrinho. PlanIDs vazio vale para todos
+// os planos; MaxUses e PerUserLimit nulos não limitam. Uses é quantas vezes
+// ele foi usado em pagamentos aprovados.
+type Coupon struct {
+	ID           int64      `json:"id"`
+	Code         string     `json:"code"`
+	Description  *string    `json:"description"`
+	DiscountType string     `json:"discount_type"`
+	Value        float64    `json:"value"`
+	Currency     string     `json:"currency"`
+	ExpiresAt    *time.Time `json:"expires_at"`
+	MaxUses      *int       `json:"max_uses"`
+	PerUserLimit *int       `json:"per_user_limit"`
+	PlanIDs      []int64    `json:"plan_ids"`
+	Active       bool       `json:"active"`
+	Uses         int        `json:"uses"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+}
+
+var (
+	ErrInvalidCouponCode  = errors.New("code must have 3 to 32 letters, digits, '-' or '_'")
+	ErrInvalidDiscount    = errors.New("discount_type must be percentage (value up to 100) or fixed, with a value greater than zero")
+	ErrInvalidCouponLimit = errors.New("max_uses and per_user_limit must be greater than zero when set")
+
+	ErrCouponNotFound      = errors.New("coupon not found")
+	ErrCouponInactive      = errors.New("coupon is not active")
+	ErrCouponExpired       = errors.New("coupon has expired")
+	ErrCouponExhausted     = errors.New("coupon has reached its maximum number of uses")
+	ErrCouponUserLimit     = errors.New("coupon has reached its limit of uses for this account")
+	ErrCouponNotEligible   = errors.New("coupon does not apply to any item in the cart")
+	ErrCouponWrongCurrency = errors.New("coupon does not apply to the checkout currency")
+)
+
+var couponCode = regexp.MustCompile(`^[A-Z0-9_-]{3,32}$`)
+
+// NormalizeCouponCode devolve o código em maiúsculas, como é gravado e
+// comparado.
+func NormalizeCouponCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// NormalizeCoupon confere um cupom criado ou alterado pelo superadmin. O
+// código vai para maiúsculas e a moeda vazia vale a moeda base; ela só
+// importa para descontos fixos.
+func NormalizeCoupon(c *Coupon) error {
+	c.Code = NormalizeCouponCode(c.Code)
+	if !couponCode.MatchString(c.Code) {
+		return ErrInvalidCouponCode
+	}
+	switch c.DiscountType {
+	case DiscountPercentage:
+		if c.Value <= 0 || c.Value > 100 {
+			return ErrInvalidDiscount
+		}
+	case DiscountFixed:
+		if c.Value <= 0 {
+			return ErrInvalidDiscount
+		}
+	default:
+		return ErrInvalidDiscount
+	}
+	if c.Currency == "" {
+		c.Currency = BaseCurrency
+	}
+	currency, err := NormalizeCurrency(c.Currency)
+	if err != nil {
+		return err
+	}
+	c.Currency = currency
+	if (c.MaxUses != nil && *c.MaxUses < 1) || (c.PerUserLimit != nil && *c.PerUserLimit < 1) {
+		return ErrInvalidCouponLimit
+	}
+	if c.PlanIDs == nil {
+		c.PlanIDs = []int64{}
+	}
+	return nil
+}
+
+// Check confere se o cupom ainda pode ser usado em now por um usuário que já
+// o usou userUses vezes.
+func (c *Coupon) Check(now time.Time, userUses int) error {
+	switch {
+	case !c.Active:
+		return ErrCouponInactive
+	case c.ExpiresAt != nil && !now.Before(*c.ExpiresAt):
+		return ErrCouponExpired
+	case c.MaxUses != nil && c.Uses >= *c.MaxUses:
+		return ErrCouponExhausted
+	case c.PerUserLimit != nil && userUses >= *c.PerUserLimit:
+		return ErrCouponUserLimit
+	}
+	return nil
+}
+
+// AppliesTo informa se o cupom vale para o plano planID.
+func (c *Coupon) AppliesTo(planID int64) bool {
+	if len(c.PlanIDs) == 0 {
+		return true
+	}
+	for _, id := range c.PlanIDs {
+		if id == planID {
+			return true
+		}
+	}
+	return false
+}
+
+// CouponItem é um item cobrado, para o cálculo do desconto: o plano e o
+// preço total do item.
+type CouponItem struct {
+	PlanID int64
+	Price  float64
+}
+
+// Discount calcula o desconto do cupom sobre os itens em currency: a
+// porcentagem dos itens dos planos do cupom ou o valor fixo, limitado ao
+// total desses itens. Devolve ErrCouponNotEligible se nenhum item for de um
+// plano do cupom e ErrCouponWrongCurrency para desconto fixo em outra moeda.
+func (c *Coupon) Discount(items []CouponItem, currency string) (float64, error) {
+	eligible, found := 0.0, false
+	for _, item := range items {
+		if item.PlanID != 0 && c.AppliesTo(item.PlanID) {
+			eligible += item.Price
+			found = true
+		}
+	}
+	if !found {
+		return 0, ErrCouponNotEligible
+	}
+	var discount float64
+	switch c.DiscountType {
+	case DiscountPercentage:
+		discount = eligible * c.Value / 100
+	case DiscountFixed:
+		if c.Currency != currency {
+			return 0, ErrCouponWrongCurrency
+		}
+		discount = math.Min(c.Value, eligible)
+	}
+	return math.Round(discount*100) / 100, nil
+}
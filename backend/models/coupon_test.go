@@ -0,0 +1,88 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNormalizeCoupon(t *testing.T) {
+	zero := 0
+	tests := []struct {
+		name   string
+		coupon Coupon
+		err    error
+	}{
+		{"porcentagem", Coupon{Code: " natal-10 ", DiscountType: DiscountPercentage, Value: 10}, nil},
+		{"valor fixo em dólar", Coupon{Code: "OFF5", DiscountType: DiscountFixed, Value: 5, Currency: "usd"}, nil},
+		{"código curto", Coupon{Code: "AB", DiscountType: DiscountFixed, Value: 5}, ErrInvalidCouponCode},
+		{"código com espaço", Coupon{Code: "NATAL 10", DiscountType: DiscountFixed, Value: 5}, ErrInvalidCouponCode},
+		{"porcentagem acima de 100", Coupon{Code: "TUDO", DiscountType: DiscountPercentage, Value: 101}, ErrInvalidDiscount},
+		{"valor zero", Coupon{Code: "NADA", DiscountType: DiscountFixed}, ErrInvalidDiscount},
+		{"tipo desconhecido", Coupon{Code: "NADA", DiscountType: "bonus", Value: 5}, ErrInvalidDiscount},
+		{"moeda inválida", Coupon{Code: "OFF5", DiscountType: DiscountFixed, Value: 5, Currency: "US$"}, ErrInvalidCurrency},
+		{"limite zero", Coupon{Code: "OFF5", DiscountType: DiscountFixed, Value: 5, MaxUses: &zero}, ErrInvalidCouponLimit},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := tt.coupon
+			if err := NormalizeCoupon(&c); err != tt.err {
+				t.Fatalf("erro %v, esperado %v", err, tt.err)
+			}
+			if tt.err == nil && (c.Code != NormalizeCouponCode(tt.coupon.Code) || c.Currency == "" || c.PlanIDs == nil) {
+				t.Errorf("cupom não normalizado: %+v", c)
+			}
+		})
+	}
+}
+
+func TestCouponCheck(t *testing.T) {
+	now := time.Now()
+	past, future := now.Add(-time.Minute), now.Add(time.Hour)
+	one, two := 1, 2
+	tests := []struct {
+		name     string
+		coupon   Coupon
+		userUses int
+		err      error
+	}{
+		{"válido", Coupon{Active: true, ExpiresAt: &future, MaxUses: &two, Uses: 1, PerUserLimit: &one}, 0, nil},
+		{"inativo", Coupon{}, 0, ErrCouponInactive},
+		{"vencido", Coupon{Active: true, ExpiresAt: &past}, 0, ErrCouponExpired},
+		{"esgotado", Coupon{Active: true, MaxUses: &two, Uses: 2}, 0, ErrCouponExhausted},
+		{"limite do usuário", Coupon{Active: true, PerUserLimit: &one}, 1, ErrCouponUserLimit},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.coupon.Check(now, tt.userUses); err != tt.err {
+				t.Errorf("erro %v, esperado %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestCouponDiscount(t *testing.T) {
+	items := []CouponItem{{PlanID: 1, Price: 30}, {PlanID: 2, Price: 45.5}}
+	tests := []struct {
+		name     string
+		coupon   Coupon
+		currency string
+		want     float64
+		err      error
+	}{
+		{"porcentagem de todos os planos", Coupon{DiscountType: DiscountPercentage, Value: 15}, "BRL", 11.33, nil},
+		{"porcentagem de um plano", Coupon{DiscountType: DiscountPercentage, Value: 10, PlanIDs: []int64{2}}, "BRL", 4.55, nil},
+		{"valor fixo", Coupon{DiscountType: DiscountFixed, Value: 20, Currency: "BRL"}, "BRL", 20, nil},
+		{"valor fixo limitado aos itens do plano", Coupon{DiscountType: DiscountFixed, Value: 50, Currency: "BRL", PlanIDs: []int64{1}}, "BRL", 30, nil},
+		{"valor fixo em outra moeda", Coupon{DiscountType: DiscountFixed, Value: 5, Currency: "USD"}, "BRL", 0, ErrCouponWrongCurrency},
+		{"porcentagem em outra moeda", Coupon{DiscountType: DiscountPercentage, Value: 10, Currency: "BRL"}, "USD", 7.55, nil},
+		{"plano fora do carrinho", Coupon{DiscountType: DiscountPercentage, Value: 10, PlanIDs: []int64{3}}, "BRL", 0, ErrCouponNotEligible},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.coupon.Discount(items, tt.currency)
+			if err != tt.err || got != tt.want {
+				t.Errorf("desconto %.2f (%v), esperado %.2f (%v)", got, err, tt.want, tt.err)
+			}
+		})
+	}
+}
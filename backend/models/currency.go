@@ -0,0 +1,47 @@
+package models
+
+import (
+	"errors"
+	"strings"
+)
+
+// BaseCurrency é a moeda de plans.price, dos preços de revenda e do PIX.
+const BaseCurrency = "BRL"
+
+var (
+	ErrInvalidCurrency  = errors.New("currency must be an ISO 4217 code such as USD")
+	ErrInvalidPlanPrice = errors.New("prices must be greater than zero and not repeat the base currency " + BaseCurrency)
+)
+
+// NormalizeCurrency devolve o código ISO 4217 em maiúsculas, ou
+// ErrInvalidCurrency se não tiver três letras.
+func NormalizeCurrency(code string) (string, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if len(code) != 3 {
+		return "", ErrInvalidCurrency
+	}
+	for _, c := range code {
+		if c < 'A' || c > 'Z' {
+			return "", ErrInvalidCurrency
+		}
+	}
+	return code, nil
+}
+
+// NormalizePlanPrices confere os preços de um plano em outras moedas
+// (plan_prices) e devolve as moedas em maiúsculas. O preço na moeda base é
+// plans.price.
+func NormalizePlanPrices(prices map[string]float64) (map[string]float64, error) {
+	out := make(map[string]float64, len(prices))
+	for code, price := range prices {
+		currency, err := NormalizeCurrency(code)
+		if err != nil {
+			return nil, err
+		}
+		if _, dup := out[currency]; dup || currency == BaseCurrency || price <= 0 {
+			return nil, ErrInvalidPlanPrice
+		}
+		out[currency] = price
+	}
+	return out, nil
+}
@@ -0,0 +1,34 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNormalizePlanPrices(t *testing.T) {
+	tests := []struct {
+		name   string
+		prices map[string]float64
+		want   map[string]float64
+		err    error
+	}{
+		{"sem preços", nil, map[string]float64{}, nil},
+		{"moedas em minúsculas", map[string]float64{"usd": 9.9, " eur ": 8.5}, map[string]float64{"USD": 9.9, "EUR": 8.5}, nil},
+		{"moeda base", map[string]float64{"BRL": 50}, nil, ErrInvalidPlanPrice},
+		{"moeda repetida", map[string]float64{"usd": 9.9, "USD": 10}, nil, ErrInvalidPlanPrice},
+		{"preço zero", map[string]float64{"USD": 0}, nil, ErrInvalidPlanPrice},
+		{"código inválido", map[string]float64{"US$": 9.9}, nil, ErrInvalidCurrency},
+		{"código longo", map[string]float64{"EURO": 9.9}, nil, ErrInvalidCurrency},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NormalizePlanPrices(tt.prices)
+			if err != tt.err {
+				t.Fatalf("erro %v, esperado %v", err, tt.err)
+			}
+			if tt.err == nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("preços %v, esperado %v", got, tt.want)
+			}
+		})
+	}
+}
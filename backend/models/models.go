@@ -23,12 +23,19 @@ type User struct {
 	IsActive            bool       `json:"is_active"`
 }
 
+// ProductWalletTopUp é o tipo do item de uma recarga da carteira; o preço do
+// item é creditado na carteira quando o pagamento é aprovado.
+const ProductWalletTopUp = "wallet_top_up"
+
 type CartItem struct {
 	ID                int64     `json:"id"`
 	UserID            int64     `json:"user_id"`
 	ProductType       string    `json:"product_type"`
 	ProductIdentifier string    `json:"product_identifier"`
 	Price             float64   `json:"price"`
+	Periods           int       `json:"periods,omitempty"`
+	BillingPeriod     string    `json:"billing_period,omitempty"`
+	PeriodDays        *int      `json:"period_days,omitempty"`
 	CreatedAt         time.Time `json:"created_at"`
 	UpdatedAt         time.Time `json:"updated_at"`
 }
@@ -134,22 +141,31 @@ type Payment struct {
 }
 
 type PixTransaction struct {
-	ID        int64     `json:"id"`
-	UserID    int64     `json:"user_id"`
-	Amount    float64   `json:"amount"`
-	Status    *string   `json:"status"`
-	PixKey    *string   `json:"pix_key"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID                int64      `json:"id"`
+	UserID            int64      `json:"user_id"`
+	PaymentID         *int64     `json:"payment_id"`
+	Amount            float64    `json:"amount"`
+	Status            *string    `json:"status"`
+	PixKey            *string    `json:"pix_key"`
+	Provider          *string    `json:"provider"`
+	ProviderPaymentID *string    `json:"provider_payment_id"`
+	QRCode            *string    `json:"qr_code"`
+	ExpiresAt         *time.Time `json:"expires_at"`
+	PaidAt            *time.Time `json:"paid_at"`
+	CreatedAt         time.Time  `json:"created_at"`
+	UpdatedAt         time.Time  `json:"updated_at"`
 }
 
 type Plan struct {
-	ID          int64     `json:"id"`
-	Name        string    `json:"name"`
-	Price       float64   `json:"price"`
-	Description *string   `json:"description"`
-	CreatedAt   time.Time `json:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at"`
+	ID            int64              `json:"id"`
+	Name          string             `json:"name"`
+	Price         float64            `json:"price"`
+	Description   *string            `json:"description"`
+	BillingPeriod string             `json:"billing_period"`
+	PeriodDays    *int               `json:"period_days"`
+	Prices        map[string]float64 `json:"prices,omitempty"`
+	CreatedAt     time.Time          `json:"created_at"`
+	UpdatedAt     time.Time          `json:"updated_at"`
 }
 
 type Profile struct {
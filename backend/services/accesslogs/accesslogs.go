@@ -0,0 +1,407 @@
+package accesslogs
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"CDNProxy_v2/backend/database"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	DefaultLimit = 100
+	MaxLimit     = 1000
+)
+
+// Entry is a single row of streaming_access_logs joined with its domain.
+type Entry struct {
+	ID          int64     `json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	DomainID    int64     `json:"domain_id"`
+	Domain      string    `json:"domain"`
+	UserID      int64     `json:"user_id"`
+	ClientIP    string    `json:"client_ip"`
+	UserAgent   string    `json:"user_agent"`
+	DeviceType  string    `json:"device_type"`
+	CountryCode string    `json:"country_code"`
+	CountryName string    `json:"country_name"`
+	City        string    `json:"city"`
+}
+
+// Page is one page of search results. NextCursor is empty on the last page.
+type Page struct {
+	Items      []Entry `json:"items"`
+	NextCursor string  `json:"next_cursor,omitempty"`
+}
+
+// Filter holds every supported search criterion. ScopeUserID, when set,
+// restricts results to domains owned by that user regardless of UserID;
+// IncludeSubAccounts widens that scope to the user's sub-accounts.
+type Filter struct {
+	From        *time.Time
+	To          *time.Time
+	DomainID    int64
+	Domain      string
+	UserID      int64
+	ScopeUserID int64
+	CountryCode string
+	DeviceType  string
+	IP          string
+	UserAgent   string
+	Ascending   bool
+	Limit       int
+	Cursor      *Cursor
+
+	// IncludeSubAccounts is set by handlers, never parsed from the query string.
+	IncludeSubAccounts bool
+}
+
+// Cursor marks the last row returned so the next page starts right after it.
+type Cursor struct {
+	CreatedAt time.Time
+	ID        int64
+}
+
+// Encode returns the opaque string form of the cursor.
+func (c Cursor) Encode() string {
+	raw := fmt.Sprintf("%d:%d", c.CreatedAt.UnixNano(), c.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// DecodeCursor parses a cursor produced by Cursor.Encode.
+func DecodeCursor(s string) (*Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	parts := strings.SplitN(string(raw), ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	id, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return &Cursor{CreatedAt: time.Unix(0, nanos), ID: id}, nil
+}
+
+// ParseFilter reads the filter from the query string:
+// from, to (RFC3339 or YYYY-MM-DD), domain (name or id), user_id, country,
+// device, ip (address or CIDR), ua, order (asc|desc), limit and cursor.
+func ParseFilter(r *http.Request) (Filter, error) {
+	q := r.URL.Query()
+	f := Filter{Limit: DefaultLimit}
+
+	if v := q.Get("from"); v != "" {
+		t, err := parseTime(v)
+		if err != nil {
+			return f, fmt.Errorf("invalid from: %v", err)
+		}
+		f.From = &t
+	}
+	if v := q.Get("to"); v != "" {
+		t, err := parseTime(v)
+		if err != nil {
+			return f, fmt.Errorf("invalid to: %v", err)
+		}
+		f.To = &t
+	}
+
+	if v := strings.TrimSpace(q.Get("domain")); v != "" {
+		if id, err := strconv.ParseInt(v, 10, 64); err == nil {
+			f.DomainID = id
+		} else {
+			f.Domain = strings.ToLower(v)
+		}
+	}
+	if v := q.Get("domain_id"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return f, fmt.Errorf("invalid domain_id")
+		}
+		f.DomainID = id
+	}
+
+	if v := q.Get("user_id"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return f, fmt.Errorf("invalid user_id")
+		}
+		f.UserID = id
+	}
+
+	f.CountryCode = strings.ToUpper(strings.TrimSpace(q.Get("country")))
+	f.DeviceType = strings.TrimSpace(q.Get("device"))
+	f.UserAgent = q.Get("ua")
+
+	if v := strings.TrimSpace(q.Get("ip")); v != "" {
+		if _, _, err := net.ParseCIDR(v); err != nil && net.ParseIP(v) == nil {
+			return f, fmt.Errorf("invalid ip: must be an address or CIDR")
+		}
+		f.IP = v
+	}
+
+	switch strings.ToLower(q.Get("order")) {
+	case "", "desc":
+	case "asc":
+		f.Ascending = true
+	default:
+		return f, fmt.Errorf("invalid order: use asc or desc")
+	}
+
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return f, fmt.Errorf("invalid limit")
+		}
+		if limit > MaxLimit {
+			limit = MaxLimit
+		}
+		f.Limit = limit
+	}
+
+	if v := q.Get("cursor"); v != "" {
+		c, err := DecodeCursor(v)
+		if err != nil {
+			return f, err
+		}
+		f.Cursor = c
+	}
+
+	return f, nil
+}
+
+func parseTime(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", v, time.Local)
+}
+
+// buildQuery assembles the SELECT for the filter. The cursor and limit are
+// only applied when paginate is true; exports stream the whole range.
+func buildQuery(f Filter, paginate bool) (string, []interface{}) {
+	where := []string{"1=1"}
+	args := []interface{}{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if f.From != nil {
+		where = append(where, "sal.created_at >= "+arg(*f.From))
+	}
+	if f.To != nil {
+		where = append(where, "sal.created_at < "+arg(*f.To))
+	}
+	if f.DomainID != 0 {
+		where = append(where, "d.id = "+arg(f.DomainID))
+	}
+	if f.Domain != "" {
+		where = append(where, "d.dominio = "+arg(f.Domain))
+	}
+	if f.UserID != 0 {
+		where = append(where, "d.user_id = "+arg(f.UserID))
+	}
+	if f.ScopeUserID != 0 {
+		scope := arg(f.ScopeUserID)
+		if f.IncludeSubAccounts {
+			where = append(where, "(d.user_id = "+scope+" OR d.user_id IN (SELECT id FROM public.users WHERE parent_id = "+scope+"))")
+		} else {
+			where = append(where, "d.user_id = "+scope)
+		}
+	}
+	if f.CountryCode != "" {
+		where = append(where, "sal.country_code = "+arg(f.CountryCode))
+	}
+	if f.DeviceType != "" {
+		where = append(where, "sal.device_type = "+arg(f.DeviceType))
+	}
+	if f.IP != "" {
+		if strings.Contains(f.IP, "/") {
+			// client_ip é VARCHAR: try_inet (migração 034) dá NULL para o que
+			// não é IP, e essas linhas ficam fora do filtro
+			where = append(where, fmt.Sprintf("public.try_inet(sal.client_ip) <<= %s::cidr", arg(f.IP)))
+		} else {
+			where = append(where, "sal.client_ip = "+arg(f.IP))
+		}
+	}
+	if f.UserAgent != "" {
+		where = append(where, "sal.user_agent ILIKE "+arg("%"+escapeLike(f.UserAgent)+"%"))
+	}
+
+	order := "DESC"
+	cmp := "<"
+	if f.Ascending {
+		order = "ASC"
+		cmp = ">"
+	}
+
+	if paginate && f.Cursor != nil {
+		where = append(where, fmt.Sprintf("(sal.created_at, sal.id) %s (%s, %s)",
+			cmp, arg(f.Cursor.CreatedAt), arg(f.Cursor.ID)))
+	}
+
+	query := fmt.Sprintf(`
+		SELECT
+			sal.id, sal.created_at, d.id, COALESCE(d.dominio, ''), d.user_id,
+			COALESCE(sal.client_ip, ''), COALESCE(sal.user_agent, ''), COALESCE(sal.device_type, ''),
+			COALESCE(sal.country_code, ''), COALESCE(sal.country_name, ''), COALESCE(sal.city, '')
+		FROM streaming_access_logs sal
+		JOIN streaming_proxies sp ON sal.streaming_proxy_id = sp.id
+		JOIN domains d ON sp.domain_id = d.id
+		WHERE %s
+		ORDER BY sal.created_at %s, sal.id %s`,
+		strings.Join(where, " AND "), order, order)
+
+	if paginate {
+		// Busca um registro a mais para saber se existe próxima página
+		query += " LIMIT " + arg(f.Limit+1)
+	}
+
+	return query, args
+}
+
+func escapeLike(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "%", `\%`)
+	return strings.ReplaceAll(s, "_", `\_`)
+}
+
+func scanEntry(rows pgx.Rows) (Entry, error) {
+	var e Entry
+	err := rows.Scan(&e.ID, &e.CreatedAt, &e.DomainID, &e.Domain, &e.UserID,
+		&e.ClientIP, &e.UserAgent, &e.DeviceType, &e.CountryCode, &e.CountryName, &e.City)
+	return e, err
+}
+
+// Search returns one page of access logs matching the filter.
+func Search(ctx context.Context, f Filter) (*Page, error) {
+	if f.Limit <= 0 {
+		f.Limit = DefaultLimit
+	}
+
+	query, args := buildQuery(f, true)
+	rows, err := database.DB.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	page := &Page{Items: []Entry{}}
+	for rows.Next() {
+		e, err := scanEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		page.Items = append(page.Items, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(page.Items) > f.Limit {
+		page.Items = page.Items[:f.Limit]
+		last := page.Items[len(page.Items)-1]
+		page.NextCursor = Cursor{CreatedAt: last.CreatedAt, ID: last.ID}.Encode()
+	}
+
+	return page, nil
+}
+
+// Export streams every row matching the filter to w as "csv" or "ndjson".
+// Rows are written as they arrive from Postgres, so large ranges are never
+// held in memory.
+func Export(ctx context.Context, w io.Writer, f Filter, format string) error {
+	query, args := buildQuery(f, false)
+	rows, err := database.DB.Query(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	buf := bufio.NewWriter(w)
+	flusher, _ := w.(http.Flusher)
+
+	var writeRow func(Entry) error
+	switch format {
+	case "csv":
+		cw := csv.NewWriter(buf)
+		if err := cw.Write([]string{"id", "created_at", "domain_id", "domain", "user_id", "client_ip", "user_agent", "device_type", "country_code", "country_name", "city"}); err != nil {
+			return err
+		}
+		writeRow = func(e Entry) error {
+			err := cw.Write([]string{
+				strconv.FormatInt(e.ID, 10),
+				e.CreatedAt.Format(time.RFC3339),
+				strconv.FormatInt(e.DomainID, 10),
+				e.Domain,
+				strconv.FormatInt(e.UserID, 10),
+				e.ClientIP,
+				e.UserAgent,
+				e.DeviceType,
+				e.CountryCode,
+				e.CountryName,
+				e.City,
+			})
+			cw.Flush()
+			return err
+		}
+	case "ndjson":
+		enc := json.NewEncoder(buf)
+		writeRow = func(e Entry) error {
+			return enc.Encode(e)
+		}
+	default:
+		return fmt.Errorf("unsupported export format %q", format)
+	}
+
+	n := 0
+	for rows.Next() {
+		e, err := scanEntry(rows)
+		if err != nil {
+			return err
+		}
+		if err := writeRow(e); err != nil {
+			return err
+		}
+
+		n++
+		if n%1000 == 0 {
+			if err := buf.Flush(); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	return buf.Flush()
+}
+
+// ContentType returns the response content type for an export format.
+func ContentType(format string) string {
+	if format == "csv" {
+		return "text/csv; charset=utf-8"
+	}
+	return "application/x-ndjson"
+}
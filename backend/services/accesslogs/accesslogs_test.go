@@ -0,0 +1,133 @@
+package accesslogs
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	c := Cursor{CreatedAt: time.Date(2025, 12, 1, 10, 30, 0, 123, time.UTC), ID: 42}
+
+	decoded, err := DecodeCursor(c.Encode())
+	if err != nil {
+		t.Fatalf("DecodeCursor: %v", err)
+	}
+	if !decoded.CreatedAt.Equal(c.CreatedAt) || decoded.ID != c.ID {
+		t.Errorf("cursor = %+v, want %+v", decoded, c)
+	}
+
+	if _, err := DecodeCursor("not-a-cursor"); err == nil {
+		t.Error("expected error for invalid cursor")
+	}
+}
+
+func TestParseFilter(t *testing.T) {
+	req := httptest.NewRequest("GET", "/?from=2025-12-01&to=2025-12-02T00:00:00Z&domain=Power.cdnproxy.top&country=br&device=SmartTV&ip=10.0.0.0/8&ua=VLC&order=asc&limit=5000", nil)
+
+	f, err := ParseFilter(req)
+	if err != nil {
+		t.Fatalf("ParseFilter: %v", err)
+	}
+	if f.From == nil || f.To == nil {
+		t.Fatal("expected time range to be parsed")
+	}
+	if f.Domain != "power.cdnproxy.top" || f.CountryCode != "BR" || f.DeviceType != "SmartTV" {
+		t.Errorf("unexpected filter: %+v", f)
+	}
+	if !f.Ascending || f.Limit != MaxLimit {
+		t.Errorf("order/limit not applied: %+v", f)
+	}
+
+	for _, bad := range []string{"?ip=abc", "?ip=cafe", "?ip=1.2.3", "?ip=::::", "?order=up", "?limit=0", "?from=yesterday", "?user_id=x"} {
+		if _, err := ParseFilter(httptest.NewRequest("GET", "/"+bad, nil)); err == nil {
+			t.Errorf("expected error for %s", bad)
+		}
+	}
+}
+
+func TestBuildQueryScopesAndPaginates(t *testing.T) {
+	f := Filter{
+		ScopeUserID: 7,
+		IP:          "10.0.0.0/8",
+		UserAgent:   "50%_off",
+		Limit:       10,
+		Cursor:      &Cursor{CreatedAt: time.Unix(0, 0), ID: 3},
+	}
+
+	query, args := buildQuery(f, true)
+	for _, want := range []string{"d.user_id = $1", "<<= $2::cidr", "ILIKE $3", "(sal.created_at, sal.id) < ($4, $5)", "LIMIT $6"} {
+		if !strings.Contains(query, want) {
+			t.Errorf("query missing %q:\n%s", want, query)
+		}
+	}
+	if args[2] != `%50\%\_off%` {
+		t.Errorf("user agent not escaped: %v", args[2])
+	}
+	if args[len(args)-1] != 11 {
+		t.Errorf("expected limit+1 as last arg, got %v", args[len(args)-1])
+	}
+
+	exportQuery, _ := buildQuery(f, false)
+	if strings.Contains(exportQuery, "LIMIT") || strings.Contains(exportQuery, "sal.id) <") {
+		t.Errorf("export query must not paginate:\n%s", exportQuery)
+	}
+}
+
+func TestBuildQueryCIDRCastsClientIPSafely(t *testing.T) {
+	// client_ip values such as "cafe", "1.2.3" or "::::" look like hex or
+	// dotted addresses but fail a plain ::inet cast, which used to abort the
+	// whole search. The CIDR filter must go through try_inet, which yields
+	// NULL for them instead.
+	query, args := buildQuery(Filter{IP: "10.0.0.0/8"}, false)
+	if !strings.Contains(query, "public.try_inet(sal.client_ip) <<= $1::cidr") {
+		t.Errorf("CIDR filter must use try_inet:\n%s", query)
+	}
+	if strings.Contains(query, "sal.client_ip::inet") || strings.Contains(query, "~") {
+		t.Errorf("CIDR filter must not cast client_ip directly:\n%s", query)
+	}
+	if args[0] != "10.0.0.0/8" {
+		t.Errorf("unexpected args: %v", args)
+	}
+
+	query, _ = buildQuery(Filter{IP: "cafe::1"}, false)
+	if !strings.Contains(query, "sal.client_ip = $1") || strings.Contains(query, "try_inet") {
+		t.Errorf("single address must be compared as text:\n%s", query)
+	}
+}
+
+func TestBuildQueryIncludesSubAccounts(t *testing.T) {
+	query, args := buildQuery(Filter{ScopeUserID: 7, IncludeSubAccounts: true, UserID: 9}, false)
+	for _, want := range []string{"d.user_id = $1", "(d.user_id = $2 OR d.user_id IN (SELECT id FROM public.users WHERE parent_id = $2))"} {
+		if !strings.Contains(query, want) {
+			t.Errorf("query missing %q:\n%s", want, query)
+		}
+	}
+	if len(args) != 2 || args[1] != int64(7) {
+		t.Errorf("scope must be bound once, got %v", args)
+	}
+}
+
+func TestExpiredPartitions(t *testing.T) {
+	month := func(y int, m time.Month) Partition {
+		from := time.Date(y, m, 1, 0, 0, 0, 0, time.UTC)
+		return Partition{Name: partitionName(from), From: from, To: from.AddDate(0, 1, 0)}
+	}
+	partitions := []Partition{
+		month(2025, 9),
+		month(2025, 10),
+		month(2025, 11),
+		{Name: "streaming_access_logs_manual"},
+	}
+
+	// Outubro termina em 01/11: só é removida quando o corte passa dessa data
+	expired := expiredPartitions(partitions, time.Date(2025, 11, 1, 0, 0, 0, 0, time.UTC))
+	if len(expired) != 2 || expired[0].Name != "streaming_access_logs_p202509" || expired[1].Name != "streaming_access_logs_p202510" {
+		t.Errorf("unexpected expired partitions: %+v", expired)
+	}
+
+	if got := expiredPartitions(partitions, time.Date(2025, 10, 15, 0, 0, 0, 0, time.UTC)); len(got) != 1 {
+		t.Errorf("partition still holding data inside the window was expired: %+v", got)
+	}
+}
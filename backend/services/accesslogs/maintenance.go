@@ -0,0 +1,80 @@
+package accesslogs
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// MaintenanceConfig controls the background partition, rollup and retention job.
+type MaintenanceConfig struct {
+	// RetentionDays is how long raw access logs are kept. Whole monthly
+	// partitions are dropped once they fall entirely outside this window.
+	RetentionDays int
+	// HourlyRollupRetentionDays is how long hourly rollups are kept.
+	HourlyRollupRetentionDays int
+	// PartitionsAhead is how many future monthly partitions are kept ready.
+	PartitionsAhead int
+	// Interval between rollup refreshes.
+	Interval time.Duration
+}
+
+// StartMaintenance runs the maintenance job once and then every cfg.Interval
+// until ctx is cancelled. Partition and retention work runs at most once per
+// hour; rollups are refreshed on every tick.
+func StartMaintenance(ctx context.Context, cfg MaintenanceConfig) {
+	if cfg.PartitionsAhead <= 0 {
+		cfg.PartitionsAhead = 2
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 5 * time.Minute
+	}
+
+	go func() {
+		var lastHousekeeping time.Time
+		ticker := time.NewTicker(cfg.Interval)
+		defer ticker.Stop()
+
+		for {
+			now := time.Now()
+			if now.Sub(lastHousekeeping) >= time.Hour {
+				runHousekeeping(ctx, cfg, now)
+				lastHousekeeping = now
+			}
+
+			if err := RefreshRollups(ctx); err != nil {
+				log.Printf("Access logs: failed to refresh rollups: %v", err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func runHousekeeping(ctx context.Context, cfg MaintenanceConfig, now time.Time) {
+	if err := EnsurePartitions(ctx, now, cfg.PartitionsAhead); err != nil {
+		log.Printf("Access logs: failed to ensure partitions: %v", err)
+	}
+
+	if cfg.RetentionDays > 0 {
+		cutoff := now.AddDate(0, 0, -cfg.RetentionDays)
+		dropped, err := DropPartitionsBefore(ctx, cutoff)
+		if err != nil {
+			log.Printf("Access logs: failed to drop old partitions: %v", err)
+		}
+		for _, name := range dropped {
+			log.Printf("Access logs: dropped partition %s (retention %d days)", name, cfg.RetentionDays)
+		}
+	}
+
+	if cfg.HourlyRollupRetentionDays > 0 {
+		cutoff := now.AddDate(0, 0, -cfg.HourlyRollupRetentionDays)
+		if _, err := PruneHourlyRollups(ctx, cutoff); err != nil {
+			log.Printf("Access logs: failed to prune hourly rollups: %v", err)
+		}
+	}
+}
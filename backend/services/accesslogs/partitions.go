@@ -0,0 +1,145 @@
+package accesslogs
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"time"
+
+	"CDNProxy_v2/backend/database"
+)
+
+const partitionPrefix = "streaming_access_logs_p"
+
+var partitionNamePattern = regexp.MustCompile(`^streaming_access_logs_p(\d{6})$`)
+
+// Partition describes one monthly partition of streaming_access_logs.
+type Partition struct {
+	Name  string    `json:"name"`
+	From  time.Time `json:"from"`
+	To    time.Time `json:"to"`
+	Rows  int64     `json:"rows"`
+	Bytes int64     `json:"bytes"`
+	Size  string    `json:"size"`
+}
+
+// partitionName returns the partition holding the UTC month of t.
+func partitionName(t time.Time) string {
+	return partitionPrefix + t.UTC().Format("200601")
+}
+
+// monthStart returns the first instant of the UTC month containing t.
+func monthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// isPartitioned reports whether migration 014 converted the table.
+func isPartitioned(ctx context.Context) (bool, error) {
+	var kind string
+	err := database.DB.QueryRow(ctx, `
+		SELECT c.relkind::text
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE n.nspname = 'public' AND c.relname = 'streaming_access_logs'`).Scan(&kind)
+	if err != nil {
+		return false, err
+	}
+	return kind == "p", nil
+}
+
+// EnsurePartitions creates the monthly partitions from the current month up to
+// `ahead` months in the future. Existing partitions are left untouched.
+func EnsurePartitions(ctx context.Context, now time.Time, ahead int) error {
+	partitioned, err := isPartitioned(ctx)
+	if err != nil {
+		return err
+	}
+	if !partitioned {
+		return fmt.Errorf("streaming_access_logs is not partitioned")
+	}
+
+	start := monthStart(now)
+	for i := 0; i <= ahead; i++ {
+		from := start.AddDate(0, i, 0)
+		to := from.AddDate(0, 1, 0)
+
+		// O nome vem de partitionName (apenas dígitos), por isso é seguro interpolar
+		query := fmt.Sprintf(
+			"CREATE TABLE IF NOT EXISTS public.%s PARTITION OF public.streaming_access_logs FOR VALUES FROM ('%s') TO ('%s')",
+			partitionName(from), from.Format(time.RFC3339), to.Format(time.RFC3339))
+		if _, err := database.DB.Exec(ctx, query); err != nil {
+			return fmt.Errorf("create partition %s: %w", partitionName(from), err)
+		}
+	}
+	return nil
+}
+
+// ListPartitions returns the monthly partitions with their size, oldest first.
+func ListPartitions(ctx context.Context) ([]Partition, error) {
+	rows, err := database.DB.Query(ctx, `
+		SELECT
+			c.relname,
+			COALESCE(s.n_live_tup, 0),
+			pg_total_relation_size(c.oid),
+			pg_size_pretty(pg_total_relation_size(c.oid))
+		FROM pg_inherits i
+		JOIN pg_class c ON c.oid = i.inhrelid
+		JOIN pg_class p ON p.oid = i.inhparent
+		JOIN pg_namespace n ON n.oid = p.relnamespace
+		LEFT JOIN pg_stat_user_tables s ON s.relid = c.oid
+		WHERE n.nspname = 'public' AND p.relname = 'streaming_access_logs'
+		ORDER BY c.relname ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	partitions := []Partition{}
+	for rows.Next() {
+		var p Partition
+		if err := rows.Scan(&p.Name, &p.Rows, &p.Bytes, &p.Size); err != nil {
+			return nil, err
+		}
+		if m := partitionNamePattern.FindStringSubmatch(p.Name); m != nil {
+			if from, err := time.Parse("200601", m[1]); err == nil {
+				p.From = from
+				p.To = from.AddDate(0, 1, 0)
+			}
+		}
+		partitions = append(partitions, p)
+	}
+	return partitions, rows.Err()
+}
+
+// DropPartitionsBefore drops every monthly partition whose whole range ends on
+// or before cutoff and returns the names of the dropped partitions.
+func DropPartitionsBefore(ctx context.Context, cutoff time.Time) ([]string, error) {
+	partitions, err := ListPartitions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	dropped := []string{}
+	for _, p := range expiredPartitions(partitions, cutoff) {
+		if _, err := database.DB.Exec(ctx, fmt.Sprintf("DROP TABLE IF EXISTS public.%s", p.Name)); err != nil {
+			return dropped, fmt.Errorf("drop partition %s: %w", p.Name, err)
+		}
+		dropped = append(dropped, p.Name)
+	}
+	return dropped, nil
+}
+
+// expiredPartitions filters the app-managed partitions entirely older than cutoff.
+func expiredPartitions(partitions []Partition, cutoff time.Time) []Partition {
+	var expired []Partition
+	for _, p := range partitions {
+		if !partitionNamePattern.MatchString(p.Name) || p.To.IsZero() {
+			continue
+		}
+		if !p.To.After(cutoff) {
+			expired = append(expired, p)
+		}
+	}
+	return expired
+}
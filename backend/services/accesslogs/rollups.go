@@ -0,0 +1,106 @@
+package accesslogs
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"CDNProxy_v2/backend/database"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// rollupLookback re-aggregates the last hour already rolled up, so hits written
+// late (the access log insert waits for geolocation) are still counted.
+const rollupLookback = time.Hour
+
+// RefreshRollups recomputes the hourly rollups from the last aggregated hour up
+// to now, then the daily rollups for every day touched. Days are cut in the
+// application time zone so charts match what the panel shows.
+func RefreshRollups(ctx context.Context) error {
+	start, err := rollupStart(ctx)
+	if err != nil {
+		return err
+	}
+	if start.IsZero() {
+		return nil // Nenhum log ainda
+	}
+
+	tx, err := database.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO public.access_log_rollups_hourly (bucket, domain_id, device_type, country_code, hits)
+		SELECT
+			date_trunc('hour', sal.created_at),
+			sp.domain_id,
+			COALESCE(sal.device_type, ''),
+			COALESCE(sal.country_code, ''),
+			COUNT(*)
+		FROM streaming_access_logs sal
+		JOIN streaming_proxies sp ON sal.streaming_proxy_id = sp.id
+		WHERE sal.created_at >= $1
+		GROUP BY 1, 2, 3, 4
+		ON CONFLICT (bucket, domain_id, device_type, country_code) DO UPDATE SET hits = EXCLUDED.hits`,
+		start)
+	if err != nil {
+		return err
+	}
+
+	tz := timeZoneName()
+	_, err = tx.Exec(ctx, `
+		INSERT INTO public.access_log_rollups_daily (day, domain_id, device_type, country_code, hits)
+		SELECT (bucket AT TIME ZONE $2)::date, domain_id, device_type, country_code, SUM(hits)
+		FROM public.access_log_rollups_hourly
+		WHERE bucket >= (date_trunc('day', $1::timestamptz AT TIME ZONE $2) AT TIME ZONE $2)
+		GROUP BY 1, 2, 3, 4
+		ON CONFLICT (day, domain_id, device_type, country_code) DO UPDATE SET hits = EXCLUDED.hits`,
+		start, tz)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// rollupStart returns where the next refresh begins: one hour before the last
+// hourly bucket, or the oldest log when nothing was aggregated yet.
+func rollupStart(ctx context.Context) (time.Time, error) {
+	var last *time.Time
+	if err := database.DB.QueryRow(ctx, "SELECT MAX(bucket) FROM public.access_log_rollups_hourly").Scan(&last); err != nil {
+		return time.Time{}, err
+	}
+	if last != nil {
+		return last.Add(-rollupLookback), nil
+	}
+
+	var oldest time.Time
+	err := database.DB.QueryRow(ctx, "SELECT date_trunc('hour', created_at) FROM streaming_access_logs ORDER BY created_at ASC LIMIT 1").Scan(&oldest)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return time.Time{}, nil
+	}
+	return oldest, err
+}
+
+// PruneHourlyRollups removes hourly rollups older than cutoff. Daily rollups
+// are kept indefinitely.
+func PruneHourlyRollups(ctx context.Context, cutoff time.Time) (int64, error) {
+	tag, err := database.DB.Exec(ctx, "DELETE FROM public.access_log_rollups_hourly WHERE bucket < $1", cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// timeZoneName returns the IANA name of the application time zone, which
+// main.go sets through time.Local.
+func timeZoneName() string {
+	name := time.Local.String()
+	if name == "" || name == "Local" {
+		return "UTC"
+	}
+	return name
+}
@@ -0,0 +1,56 @@
+package invoices
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"CDNProxy_v2/backend/database"
+	"CDNProxy_v2/backend/services/mailer"
+)
+
+var emailReceipts atomic.Bool
+
+// SetEmailReceipts turns on or off emailing each invoice to the customer
+// when it is issued. It is off by default.
+func SetEmailReceipts(enabled bool) {
+	emailReceipts.Store(enabled)
+}
+
+// Deliver emails invoice id with its PDF to the customer, once, when
+// SetEmailReceipts is on. It is meant to run after the transaction that
+// issued the invoice has committed.
+func Deliver(ctx context.Context, id int64) error {
+	if !emailReceipts.Load() {
+		return nil
+	}
+	inv, err := scanInvoice(database.DB.QueryRow(ctx,
+		"SELECT "+invoiceColumns+" FROM public.invoices WHERE id = $1 AND emailed_at IS NULL", id))
+	if err != nil {
+		return err
+	}
+	if inv.CustomerEmail == "" {
+		return nil
+	}
+	if err := mailer.Send(Message(inv)); err != nil {
+		return err
+	}
+	_, err = database.DB.Exec(ctx, "UPDATE public.invoices SET emailed_at = NOW() WHERE id = $1", id)
+	return err
+}
+
+// Message is the email carrying inv and its PDF.
+func Message(inv *Invoice) mailer.Message {
+	number := FormatNumber(inv.Number)
+	return mailer.Message{
+		To:      inv.CustomerEmail,
+		Subject: fmt.Sprintf("%s - Recibo nº %s", inv.Business.Name, number),
+		Text: fmt.Sprintf("Olá,\n\nRecebemos o seu pagamento de %s. O recibo nº %s segue em anexo.\n\n%s\n",
+			FormatMoney(inv.Amount, inv.Currency), number, inv.Business.Name),
+		Attachments: []mailer.Attachment{{
+			Name:        "recibo-" + number + ".pdf",
+			ContentType: "application/pdf",
+			Data:        Render(inv),
+		}},
+	}
+}
@@ -0,0 +1,360 @@
+// Package invoices issues the receipts of paid payments: a sequentially
+// numbered snapshot of the items, the customer and the business data taken
+// when the payment is approved, which can be rendered as PDF and emailed to
+// the customer.
+package invoices
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"CDNProxy_v2/backend/database"
+	"CDNProxy_v2/backend/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var (
+	// ErrNotPaid is returned for payments that were never approved.
+	ErrNotPaid = errors.New("payment has not been paid")
+	// ErrNotFound is returned for payments that do not exist.
+	ErrNotFound = errors.New("payment not found")
+)
+
+// Keys of the business data in general_configs. The name falls back to
+// site_name.
+const (
+	KeyBusinessName     = "invoice_business_name"
+	KeyBusinessDocument = "invoice_business_document"
+	KeyBusinessAddress  = "invoice_business_address"
+	KeyBusinessEmail    = "invoice_business_email"
+)
+
+// defaultBusinessName is used when neither the business name nor site_name
+// are configured.
+const defaultBusinessName = "CDNProxy"
+
+// Business is the issuer of the invoice.
+type Business struct {
+	Name     string `json:"name"`
+	Document string `json:"document,omitempty"`
+	Address  string `json:"address,omitempty"`
+	Email    string `json:"email,omitempty"`
+}
+
+// Line is one item of an invoice; Amount is the total of the line.
+type Line struct {
+	Description string  `json:"description"`
+	Quantity    int     `json:"quantity"`
+	Amount      float64 `json:"amount"`
+}
+
+// Invoice is an issued receipt.
+type Invoice struct {
+	ID            int64      `json:"id"`
+	Number        int64      `json:"number"`
+	PaymentID     *int64     `json:"payment_id"`
+	UserID        int64      `json:"user_id"`
+	CustomerName  string     `json:"customer_name"`
+	CustomerEmail string     `json:"customer_email"`
+	Business      Business   `json:"business"`
+	Items         []Line     `json:"items"`
+	Amount        float64    `json:"amount"`
+	Currency      string     `json:"currency"`
+	PaymentMethod string     `json:"payment_method"`
+	PaidAt        *time.Time `json:"paid_at"`
+	IssuedAt      time.Time  `json:"issued_at"`
+	EmailedAt     *time.Time `json:"emailed_at"`
+}
+
+// FormatNumber returns the printed invoice number.
+func FormatNumber(n int64) string {
+	return fmt.Sprintf("%06d", n)
+}
+
+// querier is satisfied by the pool and by transactions.
+type querier interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
+const invoiceColumns = `id, number, payment_id, user_id, customer_name, customer_email, business, items, amount::float8, currency,
+	payment_method, paid_at, issued_at, emailed_at`
+
+func scanInvoice(row pgx.Row) (*Invoice, error) {
+	var (
+		inv             Invoice
+		business, items []byte
+	)
+	err := row.Scan(&inv.ID, &inv.Number, &inv.PaymentID, &inv.UserID, &inv.CustomerName, &inv.CustomerEmail, &business, &items,
+		&inv.Amount, &inv.Currency, &inv.PaymentMethod, &inv.PaidAt, &inv.IssuedAt, &inv.EmailedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(business, &inv.Business); err != nil {
+		return nil, fmt.Errorf("invalid business of invoice %d: %w", inv.ID, err)
+	}
+	if err := json.Unmarshal(items, &inv.Items); err != nil {
+		return nil, fmt.Errorf("invalid items of invoice %d: %w", inv.ID, err)
+	}
+	return &inv, nil
+}
+
+func byPayment(ctx context.Context, q querier, paymentID int64) (*Invoice, error) {
+	return scanInvoice(q.QueryRow(ctx, "SELECT "+invoiceColumns+" FROM public.invoices WHERE payment_id = $1", paymentID))
+}
+
+// Issue returns the invoice of the fulfilled payment paymentID, issuing it
+// with the next number when the payment has none yet; issued reports
+// whether it was issued now. The caller must hold the lock of the payment
+// row, as Apply does, so a payment never gets two invoices.
+func Issue(ctx context.Context, tx pgx.Tx, paymentID int64) (inv *Invoice, issued bool, err error) {
+	inv, err = byPayment(ctx, tx, paymentID)
+	if err == nil {
+		return inv, false, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return nil, false, err
+	}
+
+	var (
+		metadata    []byte
+		fulfilledAt *time.Time
+		name        *string
+		discount    float64
+		couponCode  *string
+		walletPart  float64
+	)
+	inv = &Invoice{PaymentID: &paymentID}
+	err = tx.QueryRow(ctx, `
+		SELECT p.user_id, p.amount::float8, p.currency, COALESCE(p.payment_method, ''), p.paid_at, p.fulfilled_at, p.metadata,
+			p.discount::float8, p.coupon_code, p.wallet_amount::float8, COALESCE(u.email, ''), u.name
+		FROM public.payments p LEFT JOIN public.users u ON u.id = p.user_id
+		WHERE p.id = $1`, paymentID,
+	).Scan(&inv.UserID, &inv.Amount, &inv.Currency, &inv.PaymentMethod, &inv.PaidAt, &fulfilledAt, &metadata, &discount, &couponCode, &walletPart, &inv.CustomerEmail, &name)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, false, ErrNotFound
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if fulfilledAt == nil {
+		return nil, false, ErrNotPaid
+	}
+	if name != nil {
+		inv.CustomerName = *name
+	}
+	if inv.Business, err = loadBusiness(ctx, tx); err != nil {
+		return nil, false, err
+	}
+	var cart []models.CartItem
+	if len(metadata) > 0 {
+		if err := json.Unmarshal(metadata, &cart); err != nil {
+			return nil, false, fmt.Errorf("invalid metadata of payment %d: %w", paymentID, err)
+		}
+	}
+	names, err := domainNames(ctx, tx, cart)
+	if err != nil {
+		return nil, false, err
+	}
+	inv.Items = Lines(cart, names)
+	if discount > 0 {
+		inv.Items = append(inv.Items, DiscountLine(couponCode, discount))
+	}
+	if walletPart > 0 {
+		inv.Items = append(inv.Items, WalletLine(walletPart))
+	}
+
+	business, err := json.Marshal(inv.Business)
+	if err != nil {
+		return nil, false, err
+	}
+	items, err := json.Marshal(inv.Items)
+	if err != nil {
+		return nil, false, err
+	}
+	// The counter row stays locked until the transaction ends, so numbers
+	// have no gaps
+	if err := tx.QueryRow(ctx,
+		"UPDATE public.invoice_counter SET last_number = last_number + 1 WHERE id = 1 RETURNING last_number",
+	).Scan(&inv.Number); err != nil {
+		return nil, false, err
+	}
+	err = tx.QueryRow(ctx, `
+		INSERT INTO public.invoices
+			(number, payment_id, user_id, customer_name, customer_email, business, items, amount, currency, payment_method, paid_at, issued_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, NOW())
+		RETURNING id, issued_at`,
+		inv.Number, paymentID, inv.UserID, inv.CustomerName, inv.CustomerEmail, business, items, inv.Amount, inv.Currency,
+		inv.PaymentMethod, inv.PaidAt,
+	).Scan(&inv.ID, &inv.IssuedAt)
+	if err != nil {
+		return nil, false, err
+	}
+	return inv, true, nil
+}
+
+// ForPayment returns the invoice of payment paymentID, issuing it for
+// payments fulfilled before invoices existed. It returns ErrNotFound and
+// ErrNotPaid for missing and unpaid payments.
+func ForPayment(ctx context.Context, paymentID int64) (*Invoice, error) {
+	inv, err := byPayment(ctx, database.DB, paymentID)
+	if err == nil || !errors.Is(err, pgx.ErrNoRows) {
+		return inv, err
+	}
+
+	tx, err := database.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var locked int64
+	err = tx.QueryRow(ctx, "SELECT id FROM public.payments WHERE id = $1 FOR UPDATE", paymentID).Scan(&locked)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	inv, _, err = Issue(ctx, tx, paymentID)
+	if err != nil {
+		return nil, err
+	}
+	return inv, tx.Commit(ctx)
+}
+
+// loadBusiness reads the business data from general_configs.
+func loadBusiness(ctx context.Context, q querier) (Business, error) {
+	rows, err := q.Query(ctx,
+		"SELECT key, COALESCE(value, '') FROM public.general_configs WHERE key = ANY($1)",
+		[]string{KeyBusinessName, KeyBusinessDocument, KeyBusinessAddress, KeyBusinessEmail, "site_name"})
+	if err != nil {
+		return Business{}, err
+	}
+	defer rows.Close()
+
+	values := map[string]string{}
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return Business{}, err
+		}
+		values[key] = value
+	}
+	if err := rows.Err(); err != nil {
+		return Business{}, err
+	}
+	return businessFrom(values), nil
+}
+
+func businessFrom(values map[string]string) Business {
+	b := Business{
+		Name:     values[KeyBusinessName],
+		Document: values[KeyBusinessDocument],
+		Address:  values[KeyBusinessAddress],
+		Email:    values[KeyBusinessEmail],
+	}
+	if b.Name == "" {
+		b.Name = values["site_name"]
+	}
+	if b.Name == "" {
+		b.Name = defaultBusinessName
+	}
+	return b
+}
+
+// domainNames returns the names of the domains renewed by cart.
+func domainNames(ctx context.Context, q querier, cart []models.CartItem) (map[int64]string, error) {
+	var ids []int64
+	for _, item := range cart {
+		if id, err := strconv.ParseInt(item.ProductIdentifier, 10, 64); err == nil && item.ProductType == "domain_renewal" {
+			ids = append(ids, id)
+		}
+	}
+	names := map[int64]string{}
+	if len(ids) == 0 {
+		return names, nil
+	}
+	rows, err := q.Query(ctx, "SELECT id, name FROM public.domains WHERE id = ANY($1)", ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			id   int64
+			name string
+		)
+		if err := rows.Scan(&id, &name); err != nil {
+			return nil, err
+		}
+		names[id] = name
+	}
+	return names, rows.Err()
+}
+
+// Lines turns the cart snapshot of a payment into invoice lines. names maps
+// domain ids to names; domains missing from it are printed by id.
+func Lines(cart []models.CartItem, names map[int64]string) []Line {
+	lines := make([]Line, 0, len(cart))
+	for _, item := range cart {
+		quantity := item.Periods
+		if quantity < 1 {
+			quantity = 1
+		}
+		description := item.ProductType + " " + item.ProductIdentifier
+		switch item.ProductType {
+		case models.ProductWalletTopUp:
+			description = "Recarga da carteira"
+		case "domain_renewal":
+			domain := "#" + item.ProductIdentifier
+			if id, err := strconv.ParseInt(item.ProductIdentifier, 10, 64); err == nil && names[id] != "" {
+				domain = names[id]
+			}
+			description = "Renovação do domínio " + domain
+			if period := periodLabel(item.BillingPeriod, item.PeriodDays); period != "" {
+				description += " (" + period + ")"
+			}
+		}
+		lines = append(lines, Line{Description: description, Quantity: quantity, Amount: item.Price})
+	}
+	return lines
+}
+
+// DiscountLine is the invoice line of a coupon discount, with a negative
+// amount so the lines add up to the amount paid.
+func DiscountLine(couponCode *string, discount float64) Line {
+	description := "Desconto"
+	if couponCode != nil && *couponCode != "" {
+		description += " (cupom " + *couponCode + ")"
+	}
+	return Line{Description: description, Quantity: 1, Amount: -discount}
+}
+
+// WalletLine is the invoice line of the part of a payment paid from the
+// wallet balance, with a negative amount like DiscountLine.
+func WalletLine(amount float64) Line {
+	return Line{Description: "Pago com o saldo da carteira", Quantity: 1, Amount: -amount}
+}
+
+// periodLabel names the plan period bought by one unit of a line.
+func periodLabel(period string, days *int) string {
+	switch period {
+	case models.PeriodMonthly:
+		return "mensal"
+	case models.PeriodQuarterly:
+		return "trimestral"
+	case models.PeriodYearly:
+		return "anual"
+	case models.PeriodCustom:
+		if days != nil {
+			return fmt.Sprintf("%d dias", *days)
+		}
+	}
+	return ""
+}
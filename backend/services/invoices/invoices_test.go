@@ -0,0 +1,96 @@
+package invoices
+
+import (
+	"reflect"
+	"testing"
+
+	"CDNProxy_v2/backend/models"
+)
+
+func TestLines(t *testing.T) {
+	days := 45
+	cart := []models.CartItem{
+		{ProductType: "domain_renewal", ProductIdentifier: "10", Price: 60, Periods: 2, BillingPeriod: models.PeriodMonthly},
+		{ProductType: "domain_renewal", ProductIdentifier: "11", Price: 90, Periods: 1, BillingPeriod: models.PeriodCustom, PeriodDays: &days},
+		// Deleted domain, snapshot from before plans had periods
+		{ProductType: "domain_renewal", ProductIdentifier: "12", Price: 25},
+		{ProductType: models.ProductWalletTopUp, ProductIdentifier: "5", Price: 100, Periods: 1},
+	}
+	got := Lines(cart, map[int64]string{10: "exemplo.com", 11: "tv.exemplo.com"})
+	want := []Line{
+		{Description: "Renovação do domínio exemplo.com (mensal)", Quantity: 2, Amount: 60},
+		{Description: "Renovação do domínio tv.exemplo.com (45 dias)", Quantity: 1, Amount: 90},
+		{Description: "Renovação do domínio #12", Quantity: 1, Amount: 25},
+		{Description: "Recarga da carteira", Quantity: 1, Amount: 100},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Lines = %+v, want %+v", got, want)
+	}
+	if got := Lines(nil, nil); got == nil || len(got) != 0 {
+		t.Errorf("Lines(nil) = %#v, want an empty slice", got)
+	}
+}
+
+func TestDiscountLine(t *testing.T) {
+	code := "DEZ"
+	if got := DiscountLine(&code, 7.5); got != (Line{Description: "Desconto (cupom DEZ)", Quantity: 1, Amount: -7.5}) {
+		t.Errorf("DiscountLine = %+v", got)
+	}
+	if got := DiscountLine(nil, 5); got.Description != "Desconto" || got.Amount != -5 {
+		t.Errorf("DiscountLine without coupon = %+v", got)
+	}
+}
+
+func TestWalletLine(t *testing.T) {
+	if got := WalletLine(12.5); got != (Line{Description: "Pago com o saldo da carteira", Quantity: 1, Amount: -12.5}) {
+		t.Errorf("WalletLine = %+v", got)
+	}
+}
+
+func TestBusinessFrom(t *testing.T) {
+	tests := []struct {
+		name   string
+		values map[string]string
+		want   Business
+	}{
+		{"nothing configured", map[string]string{}, Business{Name: "CDNProxy"}},
+		{"site name", map[string]string{"site_name": "Minha CDN"}, Business{Name: "Minha CDN"}},
+		{"business data", map[string]string{
+			"site_name":         "Minha CDN",
+			KeyBusinessName:     "Minha CDN Ltda",
+			KeyBusinessDocument: "12.345.678/0001-90",
+			KeyBusinessAddress:  "Rua A, 1 - São Paulo/SP",
+			KeyBusinessEmail:    "financeiro@example.com",
+		}, Business{Name: "Minha CDN Ltda", Document: "12.345.678/0001-90", Address: "Rua A, 1 - São Paulo/SP", Email: "financeiro@example.com"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := businessFrom(tt.values); got != tt.want {
+				t.Errorf("businessFrom = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormat(t *testing.T) {
+	money := []struct {
+		amount   float64
+		currency string
+		want     string
+	}{
+		{0, "BRL", "R$ 0,00"},
+		{30, "BRL", "R$ 30,00"},
+		{1234.5, "BRL", "R$ 1.234,50"},
+		{1234567.891, "USD", "US$ 1.234.567,89"},
+		{9.99, "EUR", "€ 9,99"},
+		{-5.1, "GBP", "-GBP 5,10"},
+	}
+	for _, tt := range money {
+		if got := FormatMoney(tt.amount, tt.currency); got != tt.want {
+			t.Errorf("FormatMoney(%v, %s) = %q, want %q", tt.amount, tt.currency, got, tt.want)
+		}
+	}
+	if got := FormatNumber(42); got != "000042" {
+		t.Errorf("FormatNumber(42) = %q, want 000042", got)
+	}
+}
@@ -0,0 +1,215 @@
+package invoices
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// A4 in points and the layout of the receipt.
+const (
+	pageWidth    = 595.0
+	pageHeight   = 842.0
+	marginLeft   = 50.0
+	marginTop    = 50.0
+	marginBottom = 60.0
+	columnQty    = 390.0
+	columnAmount = 450.0
+	// maxDescription is how many characters of a line description fit
+	// before the quantity column.
+	maxDescription = 62
+)
+
+// Render returns inv as an A4 PDF with the standard Helvetica fonts, so no
+// font has to be embedded. Lines that do not fit continue on new pages.
+func Render(inv *Invoice) []byte {
+	d := &document{}
+	d.newPage()
+
+	d.advance(28)
+	d.put(marginLeft, 20, true, "RECIBO DE PAGAMENTO")
+	d.put(columnAmount, 12, true, "Nº "+FormatNumber(inv.Number))
+	d.skip(10)
+	d.text(marginLeft, 11, true, inv.Business.Name)
+	for _, s := range []string{inv.Business.Document, inv.Business.Address, inv.Business.Email} {
+		if s != "" {
+			d.text(marginLeft, 10, false, s)
+		}
+	}
+	d.skip(12)
+
+	d.text(marginLeft, 10, true, "Cliente")
+	if inv.CustomerName != "" {
+		d.text(marginLeft, 10, false, inv.CustomerName)
+	}
+	d.text(marginLeft, 10, false, inv.CustomerEmail)
+	d.skip(12)
+
+	d.text(marginLeft, 10, false, "Emitido em: "+inv.IssuedAt.Format("02/01/2006"))
+	if inv.PaidAt != nil {
+		d.text(marginLeft, 10, false, "Pago em: "+inv.PaidAt.Format("02/01/2006"))
+	}
+	if inv.PaymentID != nil {
+		payment := fmt.Sprintf("Pagamento: #%d", *inv.PaymentID)
+		if inv.PaymentMethod != "" {
+			payment += " (" + inv.PaymentMethod + ")"
+		}
+		d.text(marginLeft, 10, false, payment)
+	}
+	d.skip(16)
+
+	d.row(true, "Descrição", "Qtd.", "Valor")
+	d.rule()
+	for _, line := range inv.Items {
+		d.row(false, truncate(line.Description, maxDescription), fmt.Sprint(line.Quantity), FormatMoney(line.Amount, inv.Currency))
+	}
+	d.rule()
+	d.row(true, "Total", "", FormatMoney(inv.Amount, inv.Currency))
+	return d.bytes()
+}
+
+// FormatMoney formats amount with Brazilian separators and the currency
+// symbol, as in "R$ 1.234,56".
+func FormatMoney(amount float64, currency string) string {
+	symbol := map[string]string{"BRL": "R$", "USD": "US$", "EUR": "€"}[currency]
+	if symbol == "" {
+		symbol = currency
+	}
+	sign := ""
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	cents := int64(math.Round(amount * 100))
+	whole := fmt.Sprint(cents / 100)
+	var grouped strings.Builder
+	for i, c := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			grouped.WriteByte('.')
+		}
+		grouped.WriteRune(c)
+	}
+	return fmt.Sprintf("%s%s %s,%02d", sign, symbol, grouped.String(), cents%100)
+}
+
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n-3]) + "..."
+}
+
+// document lays out text top to bottom on as many pages as needed.
+type document struct {
+	pages []*bytes.Buffer
+	y     float64
+}
+
+func (d *document) newPage() {
+	d.pages = append(d.pages, &bytes.Buffer{})
+	d.y = pageHeight - marginTop
+}
+
+// advance moves down by height, starting a new page when it does not fit.
+func (d *document) advance(height float64) {
+	if d.y-height < marginBottom {
+		d.newPage()
+	}
+	d.y -= height
+}
+
+func (d *document) skip(height float64) {
+	d.y -= height
+}
+
+func (d *document) text(x, size float64, bold bool, s string) {
+	d.advance(size * 1.4)
+	d.put(x, size, bold, s)
+}
+
+// row writes one line of the items table.
+func (d *document) row(bold bool, description, quantity, amount string) {
+	d.advance(14)
+	d.put(marginLeft, 10, bold, description)
+	d.put(columnQty, 10, bold, quantity)
+	d.put(columnAmount, 10, bold, amount)
+}
+
+func (d *document) rule() {
+	d.advance(6)
+	fmt.Fprintf(d.pages[len(d.pages)-1], "0.5 w %.2f %.2f m %.2f %.2f l S\n", marginLeft, d.y+3, pageWidth-marginLeft, d.y+3)
+}
+
+func (d *document) put(x, size float64, bold bool, s string) {
+	if s == "" {
+		return
+	}
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	fmt.Fprintf(d.pages[len(d.pages)-1], "BT /%s %.1f Tf %.2f %.2f Td (%s) Tj ET\n", font, size, x, d.y, pdfString(s))
+}
+
+// bytes assembles the PDF: catalog, page tree, fonts, then each page and
+// its content stream, followed by the cross-reference table.
+func (d *document) bytes() []byte {
+	var (
+		out     bytes.Buffer
+		offsets []int
+	)
+	object := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		// Objects 1-4 are fixed; page i is 5+2i and its content 6+2i
+		kids[i] = fmt.Sprintf("%d 0 R", 5+2*i)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	for i, content := range d.pages {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+			pageWidth, pageHeight, 6+2*i))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.String()))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return out.Bytes()
+}
+
+// winAnsi maps the characters outside Latin-1 that WinAnsiEncoding has.
+var winAnsi = map[rune]byte{'€': 0x80, '…': 0x85, '•': 0x95, '–': 0x96, '—': 0x97, '‘': 0x91, '’': 0x92, '“': 0x93, '”': 0x94}
+
+// pdfString encodes s as the body of a PDF literal string in
+// WinAnsiEncoding; characters it lacks become '?'.
+func pdfString(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		var c byte
+		switch {
+		case winAnsi[r] != 0:
+			c = winAnsi[r]
+		case r >= 0xa0 && r <= 0xff, r >= 0x20 && r < 0x7f:
+			c = byte(r)
+		default:
+			c = '?'
+		}
+		if c == '(' || c == ')' || c == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
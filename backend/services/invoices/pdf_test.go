@@ -0,0 +1,119 @@
+package invoices
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func testInvoice(items int) *Invoice {
+	paymentID := int64(42)
+	paid := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	inv := &Invoice{
+		ID: 1, Number: 7, PaymentID: &paymentID, UserID: 5,
+		CustomerName: "Cliente (Teste)", CustomerEmail: "cliente@example.com",
+		Business: Business{Name: "Minha CDN Ltda", Document: "12.345.678/0001-90"},
+		Currency: "BRL", PaymentMethod: "mercadopago", PaidAt: &paid, IssuedAt: paid,
+	}
+	for i := 0; i < items; i++ {
+		inv.Items = append(inv.Items, Line{Description: fmt.Sprintf("Renovação do domínio d%d.com (mensal)", i), Quantity: 1, Amount: 30})
+		inv.Amount += 30
+	}
+	return inv
+}
+
+// checkPDF verifies the structure of a PDF made by Render and returns its
+// page count.
+func checkPDF(t *testing.T, pdf []byte) int {
+	t.Helper()
+	if !bytes.HasPrefix(pdf, []byte("%PDF-1.4\n")) || !bytes.HasSuffix(pdf, []byte("%%EOF\n")) {
+		t.Fatalf("not a PDF: %q...", pdf[:20])
+	}
+	m := regexp.MustCompile(`startxref\n(\d+)\n`).FindSubmatch(pdf)
+	if m == nil {
+		t.Fatal("startxref missing")
+	}
+	xref, _ := strconv.Atoi(string(m[1]))
+	if !bytes.HasPrefix(pdf[xref:], []byte("xref\n")) {
+		t.Fatalf("startxref %d does not point at the xref table", xref)
+	}
+	// Every entry of the table must point at its object
+	entries := regexp.MustCompile(`(\d{10}) 00000 n `).FindAllSubmatch(pdf[xref:], -1)
+	for i, e := range entries {
+		off, _ := strconv.Atoi(string(e[1]))
+		if want := fmt.Sprintf("%d 0 obj\n", i+1); !bytes.HasPrefix(pdf[off:], []byte(want)) {
+			t.Errorf("xref entry %d points at %q, want %q", i+1, pdf[off:off+10], want)
+		}
+	}
+	for _, s := range regexp.MustCompile(`/Length (\d+) >>\nstream\n`).FindAllSubmatchIndex(pdf, -1) {
+		n, _ := strconv.Atoi(string(pdf[s[2]:s[3]]))
+		if !bytes.HasPrefix(pdf[s[1]+n:], []byte("endstream")) {
+			t.Errorf("stream at %d is not %d bytes long", s[1], n)
+		}
+	}
+	m = regexp.MustCompile(`/Count (\d+)`).FindSubmatch(pdf)
+	pages, _ := strconv.Atoi(string(m[1]))
+	return pages
+}
+
+func TestRender(t *testing.T) {
+	pdf := Render(testInvoice(2))
+	if pages := checkPDF(t, pdf); pages != 1 {
+		t.Errorf("%d pages, want 1", pages)
+	}
+	for _, want := range []string{
+		"(N\xba 000007)",
+		"(Minha CDN Ltda)",
+		`(Cliente \(Teste\))`,
+		"(Renova\xe7\xe3o do dom\xednio d1.com \\(mensal\\))",
+		"(R$ 60,00)",
+		"(Pagamento: #42 \\(mercadopago\\))",
+		"(Pago em: 19/10/2026)",
+	} {
+		if !bytes.Contains(pdf, []byte(want)) {
+			t.Errorf("PDF does not contain %q", want)
+		}
+	}
+}
+
+func TestRenderPages(t *testing.T) {
+	pdf := Render(testInvoice(120))
+	if pages := checkPDF(t, pdf); pages < 3 {
+		t.Errorf("%d pages for 120 items, want at least 3", pages)
+	}
+	if !bytes.Contains(pdf, []byte("d119.com \\(mensal\\))")) {
+		t.Error("last item is missing")
+	}
+	if !bytes.Contains(pdf, []byte("(R$ 3.600,00)")) {
+		t.Error("total is missing")
+	}
+}
+
+func TestPDFString(t *testing.T) {
+	tests := map[string]string{
+		"plain":         "plain",
+		"a (b) \\ c":    `a \(b\) \\ c`,
+		"ação":          "a\xe7\xe3o",
+		"€ – “x”":       "\x80 \x96 \x93x\x94",
+		"emoji 🙂 tab\t": "emoji ? tab?",
+	}
+	for in, want := range tests {
+		if got := pdfString(in); got != want {
+			t.Errorf("pdfString(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestMessage(t *testing.T) {
+	msg := Message(testInvoice(1))
+	if msg.To != "cliente@example.com" || msg.Subject != "Minha CDN Ltda - Recibo nº 000007" {
+		t.Errorf("message = %q to %q", msg.Subject, msg.To)
+	}
+	if len(msg.Attachments) != 1 || msg.Attachments[0].Name != "recibo-000007.pdf" || msg.Attachments[0].ContentType != "application/pdf" {
+		t.Fatalf("attachments = %+v", msg.Attachments)
+	}
+	checkPDF(t, msg.Attachments[0].Data)
+}
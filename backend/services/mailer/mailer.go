@@ -0,0 +1,137 @@
+// Package mailer envia e-mails pelo SMTP configurado (SMTP_ADDRESS, SMTP_PORT,
+// SMTP_USERNAME, SMTP_PASSWORD) usando TLS implícito.
+package mailer
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/smtp"
+	"net/textproto"
+
+	"CDNProxy_v2/backend/config"
+)
+
+// Message é um e-mail simples. Se HTML estiver preenchido, Text é ignorado.
+type Message struct {
+	To          string
+	Subject     string
+	Text        string
+	HTML        string
+	Attachments []Attachment
+}
+
+// Attachment é um arquivo anexado à mensagem.
+type Attachment struct {
+	Name        string
+	ContentType string
+	Data        []byte
+}
+
+// Send entrega msg pelo servidor SMTP configurado.
+func Send(msg Message) error {
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	auth := smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, cfg.SMTPAddress)
+
+	var body []byte
+	switch {
+	case len(msg.Attachments) > 0:
+		if body, err = multipartBody(msg); err != nil {
+			return fmt.Errorf("failed to build message: %w", err)
+		}
+	case msg.HTML != "":
+		body = []byte(fmt.Sprintf("To: %s\r\nSubject: %s\r\nMIME-version: 1.0;\r\nContent-Type: text/html; charset=\"UTF-8\";\r\n\r\n%s", msg.To, msg.Subject, msg.HTML))
+	default:
+		body = []byte(fmt.Sprintf("To: %s\r\nSubject: %s\r\n\r\n%s", msg.To, msg.Subject, msg.Text))
+	}
+
+	// Establish a TLS connection
+	tlsconfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: cfg.SMTPAddress,
+	}
+
+	conn, err := tls.Dial("tcp", cfg.SMTPAddress+":"+cfg.SMTPPort, tlsconfig)
+	if err != nil {
+		return fmt.Errorf("failed to dial TLS: %w", err)
+	}
+
+	client, err := smtp.NewClient(conn, cfg.SMTPAddress)
+	if err != nil {
+		return fmt.Errorf("failed to create SMTP client: %w", err)
+	}
+	defer client.Close()
+
+	if err = client.Auth(auth); err != nil {
+		return fmt.Errorf("failed to authenticate: %w", err)
+	}
+	if err = client.Mail(cfg.SMTPUsername); err != nil {
+		return fmt.Errorf("failed to set sender: %w", err)
+	}
+	if err = client.Rcpt(msg.To); err != nil {
+		return fmt.Errorf("failed to set recipient: %w", err)
+	}
+
+	wc, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("failed to get data writer: %w", err)
+	}
+	if _, err = wc.Write(body); err != nil {
+		return fmt.Errorf("failed to write message: %w", err)
+	}
+	if err = wc.Close(); err != nil {
+		return fmt.Errorf("failed to close writer: %w", err)
+	}
+
+	return client.Quit()
+}
+
+// multipartBody monta a mensagem com anexos (multipart/mixed): o texto ou
+// HTML e, em seguida, cada anexo em base64.
+func multipartBody(msg Message) ([]byte, error) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	fmt.Fprintf(&buf, "To: %s\r\nSubject: %s\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=%q\r\n\r\n",
+		msg.To, mime.QEncoding.Encode("utf-8", msg.Subject), w.Boundary())
+
+	contentType, content := "text/plain; charset=\"UTF-8\"", msg.Text
+	if msg.HTML != "" {
+		contentType, content = "text/html; charset=\"UTF-8\"", msg.HTML
+	}
+	part, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {contentType}})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := part.Write([]byte(content)); err != nil {
+		return nil, err
+	}
+
+	for _, a := range msg.Attachments {
+		part, err := w.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {a.ContentType},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": a.Name})},
+		})
+		if err != nil {
+			return nil, err
+		}
+		// Linhas de no máximo 76 caracteres, como pede a RFC 2045
+		encoded := base64.StdEncoding.EncodeToString(a.Data)
+		for len(encoded) > 76 {
+			fmt.Fprintf(part, "%s\r\n", encoded[:76])
+			encoded = encoded[76:]
+		}
+		fmt.Fprintf(part, "%s\r\n", encoded)
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,67 @@
+package mailer
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func TestMultipartBody(t *testing.T) {
+	data := bytes.Repeat([]byte("%PDF-1.4 receipt "), 20)
+	body, err := multipartBody(Message{
+		To:          "cliente@example.com",
+		Subject:     "Recibo nº 000001",
+		Text:        "Segue o recibo.",
+		Attachments: []Attachment{{Name: "recibo-000001.pdf", ContentType: "application/pdf", Data: data}},
+	})
+	if err != nil {
+		t.Fatalf("multipartBody: %v", err)
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("invalid message: %v", err)
+	}
+	if subject, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject")); subject != "Recibo nº 000001" {
+		t.Errorf("Subject = %q", subject)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("Content-Type = %q, %v", msg.Header.Get("Content-Type"), err)
+	}
+
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	text, err := r.NextPart()
+	if err != nil {
+		t.Fatalf("text part: %v", err)
+	}
+	if b, _ := io.ReadAll(text); string(b) != "Segue o recibo." || !strings.HasPrefix(text.Header.Get("Content-Type"), "text/plain") {
+		t.Errorf("text part = %q (%s)", b, text.Header.Get("Content-Type"))
+	}
+
+	attachment, err := r.NextPart()
+	if err != nil {
+		t.Fatalf("attachment part: %v", err)
+	}
+	if attachment.FileName() != "recibo-000001.pdf" || attachment.Header.Get("Content-Type") != "application/pdf" {
+		t.Errorf("attachment %q (%s)", attachment.FileName(), attachment.Header.Get("Content-Type"))
+	}
+	encoded, _ := io.ReadAll(attachment)
+	for _, line := range strings.Split(strings.TrimSpace(string(encoded)), "\r\n") {
+		if len(line) > 76 {
+			t.Errorf("base64 line of %d characters", len(line))
+		}
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(string(encoded), "\r\n", ""))
+	if err != nil || !bytes.Equal(decoded, data) {
+		t.Errorf("attachment data does not round-trip: %v", err)
+	}
+	if _, err := r.NextPart(); err != io.EOF {
+		t.Errorf("extra part: %v", err)
+	}
+}
@@ -0,0 +1,217 @@
+package mercadopago
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"CDNProxy_v2/backend/services/payments"
+)
+
+// PreapprovalRequest is the body of a subscription without a plan in
+// /preapproval. The payer authorizes it at the returned init_point.
+type PreapprovalRequest struct {
+	Reason            string        `json:"reason"`
+	ExternalReference string        `json:"external_reference"`
+	PayerEmail        string        `json:"payer_email"`
+	BackURL           string        `json:"back_url"`
+	AutoRecurring     AutoRecurring `json:"auto_recurring"`
+	Status            string        `json:"status,omitempty"`
+}
+
+// AutoRecurring is the charge of a preapproval: TransactionAmount every
+// Frequency FrequencyType ("months" or "days").
+type AutoRecurring struct {
+	Frequency         int     `json:"frequency"`
+	FrequencyType     string  `json:"frequency_type"`
+	TransactionAmount float64 `json:"transaction_amount"`
+	CurrencyID        string  `json:"currency_id"`
+}
+
+// PreapprovalResponse is a subscription; Status is pending, authorized,
+// paused or cancelled.
+type PreapprovalResponse struct {
+	ID                string `json:"id"`
+	Status            string `json:"status"`
+	ExternalReference string `json:"external_reference"`
+	InitPoint         string `json:"init_point"`
+	NextPaymentDate   string `json:"next_payment_date"`
+}
+
+// AuthorizedPaymentResponse is one charge of a subscription. Payment is
+// empty until the charge has been attempted.
+type AuthorizedPaymentResponse struct {
+	ID                int64   `json:"id"`
+	PreapprovalID     string  `json:"preapproval_id"`
+	Status            string  `json:"status"`
+	TransactionAmount float64 `json:"transaction_amount"`
+	CurrencyID        string  `json:"currency_id"`
+	ExternalReference string  `json:"external_reference"`
+	Payment           struct {
+		ID           int64  `json:"id"`
+		Status       string `json:"status"`
+		StatusDetail string `json:"status_detail"`
+	} `json:"payment"`
+}
+
+// CreatePreapproval creates a subscription waiting for the payer's
+// authorization.
+func (s *Service) CreatePreapproval(req *PreapprovalRequest) (*PreapprovalResponse, error) {
+	var result PreapprovalResponse
+	if err := s.send("POST", "/preapproval", req, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (s *Service) GetPreapproval(id string) (*PreapprovalResponse, error) {
+	var result PreapprovalResponse
+	if err := s.send("GET", "/preapproval/"+url.PathEscape(id), nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// UpdatePreapprovalStatus pauses, resumes (authorized) or cancels a
+// subscription. Cancelled subscriptions cannot be resumed.
+func (s *Service) UpdatePreapprovalStatus(id, status string) (*PreapprovalResponse, error) {
+	var result PreapprovalResponse
+	if err := s.send("PUT", "/preapproval/"+url.PathEscape(id), map[string]string{"status": status}, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (s *Service) GetAuthorizedPayment(id string) (*AuthorizedPaymentResponse, error) {
+	var result AuthorizedPaymentResponse
+	if err := s.send("GET", "/authorized_payments/"+url.PathEscape(id), nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// send makes an authenticated JSON request and decodes the response into
+// out.
+func (s *Service) send(method, path string, body, out interface{}) error {
+	token, err := s.getAccessToken()
+	if err != nil {
+		return err
+	}
+
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, s.BaseURL+path, &reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		var errResp map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&errResp)
+		return fmt.Errorf("mercadopago api error: %d - %v", resp.StatusCode, errResp)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+var _ payments.SubscriptionProvider = (*Provider)(nil)
+
+// CreateSubscription creates a preapproval without a plan, which the payer
+// authorizes at Subscription.URL.
+func (p *Provider) CreateSubscription(_ context.Context, req *payments.SubscriptionRequest) (*payments.Subscription, error) {
+	currency := req.Currency
+	if currency == "" {
+		currency = p.Currency()
+	}
+	recurring := AutoRecurring{
+		Frequency:         req.Frequency,
+		FrequencyType:     "months",
+		TransactionAmount: req.Amount,
+		CurrencyID:        currency,
+	}
+	if req.FrequencyDays {
+		recurring.FrequencyType = "days"
+	}
+	resp, err := p.svc.CreatePreapproval(&PreapprovalRequest{
+		Reason:            req.Reason,
+		ExternalReference: req.ExternalReference,
+		PayerEmail:        req.Payer.Email,
+		BackURL:           req.BackURL,
+		AutoRecurring:     recurring,
+		Status:            payments.SubscriptionPending,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return toSubscription(resp), nil
+}
+
+func (p *Provider) GetSubscription(_ context.Context, id string) (*payments.Subscription, error) {
+	resp, err := p.svc.GetPreapproval(id)
+	if err != nil {
+		return nil, err
+	}
+	return toSubscription(resp), nil
+}
+
+func (p *Provider) CancelSubscription(_ context.Context, id string) (*payments.Subscription, error) {
+	resp, err := p.svc.UpdatePreapprovalStatus(id, payments.SubscriptionCancelled)
+	if err != nil {
+		return nil, err
+	}
+	return toSubscription(resp), nil
+}
+
+func (p *Provider) GetSubscriptionCharge(_ context.Context, id string) (*payments.SubscriptionCharge, error) {
+	resp, err := p.svc.GetAuthorizedPayment(id)
+	if err != nil {
+		return nil, err
+	}
+	charge := &payments.SubscriptionCharge{
+		ID:             strconv.FormatInt(resp.ID, 10),
+		SubscriptionID: resp.PreapprovalID,
+		Status:         resp.Status,
+	}
+	if resp.Payment.ID != 0 {
+		charge.Payment = &payments.Payment{
+			ID:                strconv.FormatInt(resp.Payment.ID, 10),
+			Status:            resp.Payment.Status,
+			StatusDetail:      resp.Payment.StatusDetail,
+			ExternalReference: resp.ExternalReference,
+			Amount:            resp.TransactionAmount,
+			Currency:          resp.CurrencyID,
+		}
+	}
+	return charge, nil
+}
+
+func toSubscription(resp *PreapprovalResponse) *payments.Subscription {
+	sub := &payments.Subscription{
+		ID:                resp.ID,
+		Status:            resp.Status,
+		ExternalReference: resp.ExternalReference,
+		URL:               resp.InitPoint,
+	}
+	if t, err := time.Parse(dateLayout, resp.NextPaymentDate); err == nil {
+		sub.NextChargeAt = &t
+	}
+	return sub
+}
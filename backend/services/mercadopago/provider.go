@@ -0,0 +1,210 @@
+package mercadopago
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"CDNProxy_v2/backend/services/payments"
+)
+
+// Name is the provider name, stored in payments.payment_method.
+const Name = "mercadopago"
+
+// Config configures a Provider. Empty fields fall back to the production API,
+// to MERCADOPAGO_ACCESS_TOKEN and MERCADOPAGO_WEBHOOK_SECRET from
+// general_configs and to DefaultCurrency.
+type Config struct {
+	Client        *http.Client
+	BaseURL       string
+	AccessToken   string
+	WebhookSecret string
+	Currency      string
+}
+
+// Provider is the Mercado Pago implementation of payments.Provider, using
+// Checkout Pro preferences as the hosted checkout, /v1/payments for PIX
+// charges and preapprovals for subscriptions.
+type Provider struct {
+	svc           *Service
+	webhookSecret string
+}
+
+var _ payments.PixProvider = (*Provider)(nil)
+
+// NewProvider returns a Mercado Pago provider for cfg.
+func NewProvider(cfg Config) *Provider {
+	svc := NewService()
+	if cfg.Client != nil {
+		svc.Client = cfg.Client
+	}
+	if cfg.BaseURL != "" {
+		svc.BaseURL = cfg.BaseURL
+	}
+	if cfg.Currency != "" {
+		svc.Currency = cfg.Currency
+	}
+	svc.AccessToken = cfg.AccessToken
+	return &Provider{svc: svc, webhookSecret: cfg.WebhookSecret}
+}
+
+func (p *Provider) Name() string { return Name }
+
+func (p *Provider) Currency() string { return p.svc.currency() }
+
+func (p *Provider) CreateCheckout(_ context.Context, req *payments.CheckoutRequest) (*payments.CheckoutSession, error) {
+	currency := req.Currency
+	if currency == "" {
+		currency = p.Currency()
+	}
+	pref := PreferenceRequest{
+		Payer:             &Payer{Name: req.Payer.Name, Email: req.Payer.Email},
+		BackUrls:          &BackUrls{Success: req.SuccessURL, Failure: req.FailureURL, Pending: req.PendingURL},
+		AutoReturn:        "approved",
+		ExternalReference: req.ExternalReference,
+	}
+	for _, item := range req.Items {
+		pref.Items = append(pref.Items, Item{
+			ID:         item.ID,
+			Title:      item.Title,
+			Quantity:   item.Quantity,
+			CurrencyID: currency,
+			UnitPrice:  item.UnitPrice,
+		})
+	}
+	resp, err := p.svc.SendPreference(&pref)
+	if err != nil {
+		return nil, err
+	}
+	return &payments.CheckoutSession{ID: resp.ID, URL: resp.InitPoint, SandboxURL: resp.SandboxInitPoint}, nil
+}
+
+func (p *Provider) GetPayment(_ context.Context, id string) (*payments.Payment, error) {
+	resp, err := p.svc.GetPayment(id)
+	if err != nil {
+		return nil, err
+	}
+	return toPayment(resp), nil
+}
+
+func (p *Provider) FindPayment(_ context.Context, externalRef string) (*payments.Payment, error) {
+	resp, err := p.svc.SearchPayment(externalRef)
+	if err != nil || resp == nil {
+		return nil, err
+	}
+	return toPayment(resp), nil
+}
+
+func (p *Provider) Refund(_ context.Context, paymentID string, amount float64) (*payments.Refund, error) {
+	resp, err := p.svc.Refund(paymentID, amount)
+	if err != nil {
+		return nil, err
+	}
+	return &payments.Refund{
+		ID:        strconv.FormatInt(resp.ID, 10),
+		PaymentID: paymentID,
+		Amount:    resp.Amount,
+		Status:    resp.Status,
+	}, nil
+}
+
+// CreatePix creates a PIX payment. Its confirmation arrives through the same
+// payment webhook as Checkout Pro payments.
+func (p *Provider) CreatePix(_ context.Context, req *payments.PixRequest) (*payments.PixCharge, error) {
+	resp, err := p.svc.CreatePixPayment(&PixPaymentRequest{
+		TransactionAmount: req.Amount,
+		Description:       req.Description,
+		ExternalReference: req.ExternalReference,
+		DateOfExpiration:  req.ExpiresAt.Format(dateLayout),
+		Payer:             PixPayer{Email: req.Payer.Email, FirstName: req.Payer.Name},
+	})
+	if err != nil {
+		return nil, err
+	}
+	charge := &payments.PixCharge{
+		PaymentID: strconv.FormatInt(resp.ID, 10),
+		Status:    resp.Status,
+		Code:      resp.PointOfInteraction.TransactionData.QRCode,
+		ExpiresAt: req.ExpiresAt,
+	}
+	if t, err := time.Parse(dateLayout, resp.DateOfExpiration); err == nil {
+		charge.ExpiresAt = t
+	}
+	return charge, nil
+}
+
+// ParseWebhook reads the topic and resource id from the query (the legacy
+// topic/id format or type/data.id) or from the JSON body (type and data.id),
+// and verifies the x-signature header against the data.id of the query.
+func (p *Provider) ParseWebhook(r *http.Request, body []byte) (*payments.WebhookEvent, error) {
+	ev := &payments.WebhookEvent{RequestID: r.Header.Get("x-request-id")}
+	ev.Topic, ev.ResourceID = notificationResource(r, body)
+	if topic, ok := subscriptionTopics[ev.Topic]; ok {
+		ev.Topic = topic
+	}
+
+	secret := p.webhookSecret
+	if secret == "" {
+		secret = p.svc.WebhookSecret(r.Context())
+	}
+	// The signed manifest uses the data.id of the query
+	dataID := r.URL.Query().Get("data.id")
+	if dataID == "" {
+		dataID = r.URL.Query().Get("id")
+	}
+	if err := VerifySignature(secret, r.Header.Get("x-signature"), ev.RequestID, dataID); err != nil {
+		return ev, fmt.Errorf("mercadopago: %w", err)
+	}
+	return ev, nil
+}
+
+// subscriptionTopics maps the preapproval topics, current and legacy, onto
+// the subscription topics.
+var subscriptionTopics = map[string]string{
+	"subscription_preapproval":        payments.TopicSubscription,
+	"preapproval":                     payments.TopicSubscription,
+	"subscription_authorized_payment": payments.TopicSubscriptionCharge,
+	"authorized_payment":              payments.TopicSubscriptionCharge,
+}
+
+func notificationResource(r *http.Request, body []byte) (string, string) {
+	q := r.URL.Query()
+	if topic := q.Get("topic"); topic != "" {
+		return topic, q.Get("id")
+	}
+	topic, id := q.Get("type"), q.Get("data.id")
+
+	var payload struct {
+		Type string `json:"type"`
+		Data struct {
+			ID json.RawMessage `json:"id"`
+		} `json:"data"`
+	}
+	if json.Unmarshal(body, &payload) == nil {
+		if topic == "" {
+			topic = payload.Type
+		}
+		if id == "" && len(payload.Data.ID) > 0 {
+			var s string
+			if json.Unmarshal(payload.Data.ID, &s) != nil {
+				s = string(payload.Data.ID)
+			}
+			id = s
+		}
+	}
+	return topic, id
+}
+
+func toPayment(resp *PaymentResponse) *payments.Payment {
+	return &payments.Payment{
+		ID:                strconv.FormatInt(resp.ID, 10),
+		Status:            resp.Status,
+		StatusDetail:      resp.StatusDetail,
+		ExternalReference: resp.ExternalReference,
+		Amount:            resp.TransactionAmount,
+		Currency:          resp.CurrencyID,
+	}
+}
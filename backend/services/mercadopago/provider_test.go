@@ -0,0 +1,230 @@
+package mercadopago
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"CDNProxy_v2/backend/services/payments"
+)
+
+// fakeAPI answers the Mercado Pago endpoints used by Provider and records
+// the last request body.
+type fakeAPI struct {
+	lastPath string
+	lastBody map[string]interface{}
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer TEST-TOKEN" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	f.lastPath, f.lastBody = r.URL.Path, nil
+	json.NewDecoder(r.Body).Decode(&f.lastBody)
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/checkout/preferences":
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(PreferenceResponse{ID: "pref-1", InitPoint: "https://mp.test/pref-1"})
+	case r.Method == "GET" && r.URL.Path == "/v1/payments/77":
+		json.NewEncoder(w).Encode(PaymentResponse{ID: 77, Status: "approved", ExternalReference: "12", TransactionAmount: 50, CurrencyID: "ARS"})
+	case r.Method == "GET" && r.URL.Path == "/v1/payments/search":
+		json.NewEncoder(w).Encode(map[string]interface{}{"results": []PaymentResponse{}})
+	case r.Method == "POST" && r.URL.Path == "/v1/payments/77/refunds":
+		if r.Header.Get("X-Idempotency-Key") == "" {
+			http.Error(w, "missing idempotency key", http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(RefundResponse{ID: 5, PaymentID: 77, Amount: 20, Status: "approved"})
+	case r.Method == "POST" && r.URL.Path == "/preapproval":
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id":"pre-1","status":"pending","external_reference":"sub-3","init_point":"https://mp.test/sub/pre-1"}`))
+	case r.Method == "GET" && r.URL.Path == "/preapproval/pre-1":
+		w.Write([]byte(`{"id":"pre-1","status":"authorized","external_reference":"sub-3","next_payment_date":"2026-11-19T10:00:00.000-03:00"}`))
+	case r.Method == "PUT" && r.URL.Path == "/preapproval/pre-1":
+		w.Write([]byte(`{"id":"pre-1","status":"` + f.lastBody["status"].(string) + `","external_reference":"sub-3"}`))
+	case r.Method == "GET" && r.URL.Path == "/authorized_payments/900":
+		w.Write([]byte(`{"id":900,"preapproval_id":"pre-1","status":"processed","transaction_amount":30,"currency_id":"BRL","external_reference":"sub-3","payment":{"id":901,"status":"approved"}}`))
+	case r.Method == "GET" && r.URL.Path == "/authorized_payments/902":
+		w.Write([]byte(`{"id":902,"preapproval_id":"pre-1","status":"scheduled","transaction_amount":30,"currency_id":"BRL"}`))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newTestProvider(t *testing.T, cfg Config) (*Provider, *fakeAPI) {
+	t.Helper()
+	api := &fakeAPI{}
+	srv := httptest.NewServer(api)
+	t.Cleanup(srv.Close)
+	cfg.Client, cfg.BaseURL, cfg.AccessToken = srv.Client(), srv.URL, "TEST-TOKEN"
+	return NewProvider(cfg), api
+}
+
+func TestProviderCreateCheckoutCurrency(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		request  string
+		wantCode string
+	}{
+		{"default currency", "", "", "BRL"},
+		{"configured currency", "ARS", "", "ARS"},
+		{"request currency wins", "ARS", "USD", "USD"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, api := newTestProvider(t, Config{Currency: tt.config})
+			session, err := p.CreateCheckout(context.Background(), &payments.CheckoutRequest{
+				ExternalReference: "12",
+				Currency:          tt.request,
+				Items:             []payments.LineItem{{ID: "ITEM-1", Title: "renewal", Quantity: 1, UnitPrice: 30}},
+			})
+			if err != nil {
+				t.Fatalf("CreateCheckout: %v", err)
+			}
+			if session.ID != "pref-1" || session.URL != "https://mp.test/pref-1" {
+				t.Errorf("session = %+v", session)
+			}
+			items, _ := api.lastBody["items"].([]interface{})
+			if len(items) != 1 || items[0].(map[string]interface{})["currency_id"] != tt.wantCode {
+				t.Errorf("items = %v, want currency_id %s", api.lastBody["items"], tt.wantCode)
+			}
+			if api.lastBody["external_reference"] != "12" {
+				t.Errorf("external_reference = %v", api.lastBody["external_reference"])
+			}
+		})
+	}
+}
+
+func TestProviderPayments(t *testing.T) {
+	p, api := newTestProvider(t, Config{})
+	ctx := context.Background()
+
+	got, err := p.GetPayment(ctx, "77")
+	if err != nil {
+		t.Fatalf("GetPayment: %v", err)
+	}
+	want := payments.Payment{ID: "77", Status: payments.StatusApproved, ExternalReference: "12", Amount: 50, Currency: "ARS"}
+	if *got != want {
+		t.Errorf("GetPayment = %+v, want %+v", *got, want)
+	}
+
+	if found, err := p.FindPayment(ctx, "99"); err != nil || found != nil {
+		t.Errorf("FindPayment without results = %+v, %v; want nil, nil", found, err)
+	}
+
+	refund, err := p.Refund(ctx, "77", 20)
+	if err != nil {
+		t.Fatalf("Refund: %v", err)
+	}
+	if refund.ID != "5" || refund.PaymentID != "77" || refund.Amount != 20 {
+		t.Errorf("Refund = %+v", refund)
+	}
+	if api.lastBody["amount"] != 20.0 {
+		t.Errorf("refund body = %v, want amount 20", api.lastBody)
+	}
+
+	if _, err := p.Refund(ctx, "77", 0); err != nil {
+		t.Fatalf("full Refund: %v", err)
+	}
+	if _, ok := api.lastBody["amount"]; ok {
+		t.Errorf("full refund sent an amount: %v", api.lastBody)
+	}
+}
+
+func TestProviderParseWebhook(t *testing.T) {
+	const secret = "s3cret"
+	signed := "ts=1,v1=" + sign(secret, "id:123;request-id:req-1;ts:1;")
+
+	tests := []struct {
+		name      string
+		query     string
+		body      string
+		signature string
+		wantTopic string
+		wantID    string
+		wantErr   error
+	}{
+		{"query type and data.id", "type=payment&data.id=123", "", signed, "payment", "123", nil},
+		{"body type and numeric data.id", "data.id=123", `{"type":"payment","data":{"id":123}}`, signed, "payment", "123", nil},
+		{"legacy topic and id", "topic=merchant_order&id=123", "", signed, "merchant_order", "123", nil},
+		{"subscription", "type=subscription_preapproval&data.id=123", "", signed, payments.TopicSubscription, "123", nil},
+		{"subscription charge", "type=subscription_authorized_payment&data.id=123", "", signed, payments.TopicSubscriptionCharge, "123", nil},
+		{"bad signature still parsed", "type=payment&data.id=123", "", "ts=1,v1=00", "payment", "123", payments.ErrInvalidSignature},
+		{"no signature", "type=payment&data.id=123", "", "", "payment", "123", payments.ErrSignatureMissing},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, _ := newTestProvider(t, Config{WebhookSecret: secret})
+			r := httptest.NewRequest("POST", "/api/webhook/mercadopago?"+tt.query, strings.NewReader(tt.body))
+			r.Header.Set("x-request-id", "req-1")
+			if tt.signature != "" {
+				r.Header.Set("x-signature", tt.signature)
+			}
+			ev, err := p.ParseWebhook(r, []byte(tt.body))
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Errorf("ParseWebhook error = %v, want %v", err, tt.wantErr)
+			}
+			if ev == nil || ev.Topic != tt.wantTopic || ev.ResourceID != tt.wantID || ev.RequestID != "req-1" {
+				t.Errorf("ParseWebhook event = %+v, want topic %s id %s", ev, tt.wantTopic, tt.wantID)
+			}
+		})
+	}
+}
+
+func TestProviderSubscriptions(t *testing.T) {
+	p, api := newTestProvider(t, Config{})
+	ctx := context.Background()
+
+	tests := []struct {
+		name          string
+		days          bool
+		wantFrequency string
+	}{
+		{"monthly", false, "months"},
+		{"custom plan in days", true, "days"},
+	}
+	for _, tt := range tests {
+		sub, err := p.CreateSubscription(ctx, &payments.SubscriptionRequest{
+			ExternalReference: "sub-3", Reason: "renewal", Payer: payments.Payer{Email: "client@example.com"},
+			Amount: 30, Frequency: 3, FrequencyDays: tt.days, BackURL: "https://app.test/back",
+		})
+		if err != nil {
+			t.Fatalf("%s: CreateSubscription: %v", tt.name, err)
+		}
+		if sub.ID != "pre-1" || sub.URL != "https://mp.test/sub/pre-1" || sub.Status != payments.SubscriptionPending {
+			t.Errorf("%s: subscription = %+v", tt.name, sub)
+		}
+		recurring, _ := api.lastBody["auto_recurring"].(map[string]interface{})
+		if recurring["frequency_type"] != tt.wantFrequency || recurring["frequency"] != 3.0 || recurring["currency_id"] != "BRL" ||
+			api.lastBody["payer_email"] != "client@example.com" || api.lastBody["external_reference"] != "sub-3" {
+			t.Errorf("%s: preapproval body = %v", tt.name, api.lastBody)
+		}
+	}
+
+	sub, err := p.GetSubscription(ctx, "pre-1")
+	if err != nil || sub.Status != payments.SubscriptionAuthorized || sub.NextChargeAt == nil || sub.NextChargeAt.UTC().Hour() != 13 {
+		t.Errorf("GetSubscription = %+v, %v", sub, err)
+	}
+	if sub, err := p.CancelSubscription(ctx, "pre-1"); err != nil || sub.Status != payments.SubscriptionCancelled {
+		t.Errorf("CancelSubscription = %+v, %v", sub, err)
+	}
+
+	charge, err := p.GetSubscriptionCharge(ctx, "900")
+	if err != nil {
+		t.Fatalf("GetSubscriptionCharge: %v", err)
+	}
+	want := payments.Payment{ID: "901", Status: payments.StatusApproved, ExternalReference: "sub-3", Amount: 30, Currency: "BRL"}
+	if charge.SubscriptionID != "pre-1" || charge.Payment == nil || *charge.Payment != want {
+		t.Errorf("GetSubscriptionCharge = %+v (payment %+v)", charge, charge.Payment)
+	}
+	if charge, err := p.GetSubscriptionCharge(ctx, "902"); err != nil || charge.Payment != nil || charge.Status != "scheduled" {
+		t.Errorf("scheduled charge = %+v, %v; want no payment", charge, err)
+	}
+}
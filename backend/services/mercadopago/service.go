@@ -3,9 +3,12 @@ package mercadopago
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 
 	"CDNProxy_v2/backend/database"
 	"CDNProxy_v2/backend/models"
@@ -13,14 +16,32 @@ import (
 
 const BaseURL = "https://api.mercadopago.com"
 
+// DefaultCurrency is charged when Service.Currency is empty.
+const DefaultCurrency = "BRL"
+
 type Service struct {
 	Client *http.Client
+	// BaseURL is the Mercado Pago API root; tests point it at a local server.
+	BaseURL string
+	// AccessToken overrides MERCADOPAGO_ACCESS_TOKEN from general_configs.
+	AccessToken string
+	// Currency is the currency_id of preference items.
+	Currency string
 }
 
 func NewService() *Service {
 	return &Service{
-		Client: &http.Client{},
+		Client:   &http.Client{},
+		BaseURL:  BaseURL,
+		Currency: DefaultCurrency,
+	}
+}
+
+func (s *Service) currency() string {
+	if s.Currency == "" {
+		return DefaultCurrency
 	}
+	return s.Currency
 }
 
 // Structs for Preference
@@ -59,6 +80,9 @@ type PreferenceResponse struct {
 }
 
 func (s *Service) getAccessToken() (string, error) {
+	if s.AccessToken != "" {
+		return s.AccessToken, nil
+	}
 	var token string
 	err := database.DB.QueryRow(context.Background(), "SELECT value FROM general_configs WHERE key = 'MERCADOPAGO_ACCESS_TOKEN'").Scan(&token)
 	if err != nil {
@@ -68,11 +92,6 @@ func (s *Service) getAccessToken() (string, error) {
 }
 
 func (s *Service) CreatePreference(plan models.Plan, user models.User, frontendURL string) (*PreferenceResponse, error) {
-	token, err := s.getAccessToken()
-	if err != nil {
-		return nil, err
-	}
-
 	reqBody := PreferenceRequest{
 		Items: []Item{
 			{
@@ -80,7 +99,7 @@ func (s *Service) CreatePreference(plan models.Plan, user models.User, frontendU
 				Title:       plan.Name,
 				Description: *plan.Description,
 				Quantity:    1,
-				CurrencyID:  "BRL",
+				CurrencyID:  s.currency(),
 				UnitPrice:   plan.Price,
 			},
 		},
@@ -97,16 +116,26 @@ func (s *Service) CreatePreference(plan models.Plan, user models.User, frontendU
 		ExternalReference: fmt.Sprintf("USER-%d|PLAN-%d", user.ID, plan.ID),
 	}
 
-	bodyBytes, _ := json.Marshal(reqBody)
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/checkout/preferences", BaseURL), bytes.NewBuffer(bodyBytes))
+	return s.SendPreference(&reqBody)
+}
+
+// SendPreference creates the checkout preference req.
+func (s *Service) SendPreference(req *PreferenceRequest) (*PreferenceResponse, error) {
+	token, err := s.getAccessToken()
 	if err != nil {
 		return nil, err
 	}
 
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
-	req.Header.Set("Content-Type", "application/json")
+	bodyBytes, _ := json.Marshal(req)
+	httpReq, err := http.NewRequest("POST", fmt.Sprintf("%s/checkout/preferences", s.BaseURL), bytes.NewBuffer(bodyBytes))
+	if err != nil {
+		return nil, err
+	}
 
-	resp, err := s.Client.Do(req)
+	httpReq.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.Client.Do(httpReq)
 	if err != nil {
 		return nil, err
 	}
@@ -132,6 +161,7 @@ type PaymentResponse struct {
 	StatusDetail      string  `json:"status_detail"`
 	ExternalReference string  `json:"external_reference"`
 	TransactionAmount float64 `json:"transaction_amount"`
+	CurrencyID        string  `json:"currency_id"`
 }
 
 func (s *Service) GetPayment(paymentID string) (*PaymentResponse, error) {
@@ -140,7 +170,7 @@ func (s *Service) GetPayment(paymentID string) (*PaymentResponse, error) {
 		return nil, err
 	}
 
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/v1/payments/%s", BaseURL, paymentID), nil)
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/v1/payments/%s", s.BaseURL, paymentID), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -164,12 +194,44 @@ func (s *Service) GetPayment(paymentID string) (*PaymentResponse, error) {
 	return &result, nil
 }
 
-func (s *Service) CreatePreferenceFromItems(items []Item, user models.User, frontendURL string, externalRef string) (*PreferenceResponse, error) {
+// SearchPayment returns the most recent Mercado Pago payment whose
+// external_reference is externalRef, or nil when there is none yet.
+func (s *Service) SearchPayment(externalRef string) (*PaymentResponse, error) {
 	token, err := s.getAccessToken()
 	if err != nil {
 		return nil, err
 	}
 
+	q := url.Values{"external_reference": {externalRef}, "sort": {"date_created"}, "criteria": {"desc"}, "limit": {"1"}}
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/v1/payments/search?%s", s.BaseURL, q.Encode()), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to search payments: %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Results []PaymentResponse `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	if len(result.Results) == 0 {
+		return nil, nil
+	}
+	return &result.Results[0], nil
+}
+
+func (s *Service) CreatePreferenceFromItems(items []Item, user models.User, frontendURL string, externalRef string) (*PreferenceResponse, error) {
 	payerName := ""
 	if user.Name != nil {
 		payerName = *user.Name
@@ -189,15 +251,36 @@ func (s *Service) CreatePreferenceFromItems(items []Item, user models.User, fron
 		AutoReturn:        "approved",
 		ExternalReference: externalRef,
 	}
+	return s.SendPreference(&reqBody)
+}
+
+// RefundResponse is a refund created by Refund.
+type RefundResponse struct {
+	ID        int64   `json:"id"`
+	PaymentID int64   `json:"payment_id"`
+	Amount    float64 `json:"amount"`
+	Status    string  `json:"status"`
+}
 
-	bodyBytes, _ := json.Marshal(reqBody)
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/checkout/preferences", BaseURL), bytes.NewBuffer(bodyBytes))
+// Refund refunds amount of the Mercado Pago payment paymentID, or all of it
+// when amount is zero.
+func (s *Service) Refund(paymentID string, amount float64) (*RefundResponse, error) {
+	token, err := s.getAccessToken()
 	if err != nil {
 		return nil, err
 	}
 
+	body := []byte("{}")
+	if amount > 0 {
+		body, _ = json.Marshal(map[string]float64{"amount": amount})
+	}
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/v1/payments/%s/refunds", s.BaseURL, url.PathEscape(paymentID)), bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
 	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Idempotency-Key", idempotencyKey())
 
 	resp, err := s.Client.Do(req)
 	if err != nil {
@@ -211,10 +294,97 @@ func (s *Service) CreatePreferenceFromItems(items []Item, user models.User, fron
 		return nil, fmt.Errorf("mercadopago api error: %d - %v", resp.StatusCode, errResp)
 	}
 
-	var result PreferenceResponse
+	var result RefundResponse
 	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
 		return nil, err
 	}
+	return &result, nil
+}
 
+// PixPaymentRequest is the body of a PIX payment in /v1/payments.
+type PixPaymentRequest struct {
+	TransactionAmount float64  `json:"transaction_amount"`
+	Description       string   `json:"description,omitempty"`
+	PaymentMethodID   string   `json:"payment_method_id"`
+	ExternalReference string   `json:"external_reference,omitempty"`
+	DateOfExpiration  string   `json:"date_of_expiration,omitempty"`
+	Payer             PixPayer `json:"payer"`
+}
+
+// PixPayer is the payer of a PIX payment.
+type PixPayer struct {
+	Email     string `json:"email"`
+	FirstName string `json:"first_name,omitempty"`
+}
+
+// PixPaymentResponse is a PIX payment; QRCode is the copy-and-paste code.
+type PixPaymentResponse struct {
+	ID                 int64  `json:"id"`
+	Status             string `json:"status"`
+	DateOfExpiration   string `json:"date_of_expiration"`
+	PointOfInteraction struct {
+		TransactionData struct {
+			QRCode string `json:"qr_code"`
+		} `json:"transaction_data"`
+	} `json:"point_of_interaction"`
+}
+
+// dateLayout is the date format of the Mercado Pago API.
+const dateLayout = "2006-01-02T15:04:05.000-07:00"
+
+// CreatePixPayment creates a PIX payment, which the customer pays by
+// scanning the returned code until its date_of_expiration.
+func (s *Service) CreatePixPayment(req *PixPaymentRequest) (*PixPaymentResponse, error) {
+	token, err := s.getAccessToken()
+	if err != nil {
+		return nil, err
+	}
+
+	req.PaymentMethodID = "pix"
+	bodyBytes, _ := json.Marshal(req)
+	httpReq, err := http.NewRequest("POST", fmt.Sprintf("%s/v1/payments", s.BaseURL), bytes.NewBuffer(bodyBytes))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("X-Idempotency-Key", idempotencyKey())
+
+	resp, err := s.Client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		var errResp map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&errResp)
+		return nil, fmt.Errorf("mercadopago api error: %d - %v", resp.StatusCode, errResp)
+	}
+
+	var result PixPaymentResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	if result.PointOfInteraction.TransactionData.QRCode == "" {
+		return nil, fmt.Errorf("mercadopago returned PIX payment %d without a qr_code", result.ID)
+	}
 	return &result, nil
 }
+
+// idempotencyKey returns a random key for requests that require one.
+func idempotencyKey() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// WebhookSecret returns the webhook signing secret stored in
+// general_configs, used when MERCADOPAGO_WEBHOOK_SECRET is not set.
+func (s *Service) WebhookSecret(ctx context.Context) string {
+	var secret string
+	if err := database.DB.QueryRow(ctx, "SELECT value FROM general_configs WHERE key = 'MERCADOPAGO_WEBHOOK_SECRET'").Scan(&secret); err != nil {
+		return ""
+	}
+	return secret
+}
@@ -0,0 +1,57 @@
+package mercadopago
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"CDNProxy_v2/backend/services/payments"
+)
+
+// VerifySignature checks the x-signature header ("ts=...,v1=...") sent by
+// Mercado Pago: v1 must be the hex HMAC-SHA256, keyed with the webhook secret,
+// of the manifest "id:<data.id>;request-id:<x-request-id>;ts:<ts>;". Parts
+// whose value is missing are left out of the manifest.
+func VerifySignature(secret, signature, requestID, dataID string) error {
+	if secret == "" {
+		return payments.ErrSecretNotConfigured
+	}
+	var ts, v1 string
+	for _, part := range strings.Split(signature, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(k) {
+		case "ts":
+			ts = strings.TrimSpace(v)
+		case "v1":
+			v1 = strings.TrimSpace(v)
+		}
+	}
+	if ts == "" || v1 == "" {
+		return payments.ErrSignatureMissing
+	}
+
+	expected := hmac.New(sha256.New, []byte(secret))
+	expected.Write([]byte(signatureManifest(dataID, requestID, ts)))
+	got, err := hex.DecodeString(v1)
+	if err != nil || !hmac.Equal(got, expected.Sum(nil)) {
+		return payments.ErrInvalidSignature
+	}
+	return nil
+}
+
+func signatureManifest(dataID, requestID, ts string) string {
+	var b strings.Builder
+	if dataID != "" {
+		// Alphanumeric ids are signed in lower case
+		b.WriteString("id:" + strings.ToLower(dataID) + ";")
+	}
+	if requestID != "" {
+		b.WriteString("request-id:" + requestID + ";")
+	}
+	b.WriteString("ts:" + ts + ";")
+	return b.String()
+}
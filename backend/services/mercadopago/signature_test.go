@@ -0,0 +1,50 @@
+package mercadopago
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"CDNProxy_v2/backend/services/payments"
+)
+
+func sign(secret, manifest string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(manifest))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifySignature(t *testing.T) {
+	const secret = "s3cret"
+	valid := "ts=1704908010,v1=" + sign(secret, "id:123456;request-id:req-1;ts:1704908010;")
+
+	tests := []struct {
+		name      string
+		secret    string
+		signature string
+		requestID string
+		dataID    string
+		want      error
+	}{
+		{"valid", secret, valid, "req-1", "123456", nil},
+		{"spaces around parts", secret, " ts=1704908010 , v1=" + sign(secret, "id:123456;request-id:req-1;ts:1704908010;"), "req-1", "123456", nil},
+		{"alphanumeric id signed in lower case", secret, "ts=1,v1=" + sign(secret, "id:abc9;request-id:req-1;ts:1;"), "req-1", "ABC9", nil},
+		{"no request id", secret, "ts=1,v1=" + sign(secret, "id:123456;ts:1;"), "", "123456", nil},
+		{"other data id", secret, valid, "req-1", "999", payments.ErrInvalidSignature},
+		{"other request id", secret, valid, "req-2", "123456", payments.ErrInvalidSignature},
+		{"wrong secret", "other", valid, "req-1", "123456", payments.ErrInvalidSignature},
+		{"not hex", secret, "ts=1,v1=zz", "req-1", "123456", payments.ErrInvalidSignature},
+		{"missing header", secret, "", "req-1", "123456", payments.ErrSignatureMissing},
+		{"missing v1", secret, "ts=1704908010", "req-1", "123456", payments.ErrSignatureMissing},
+		{"no secret", "", valid, "req-1", "123456", payments.ErrSecretNotConfigured},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := VerifySignature(tt.secret, tt.signature, tt.requestID, tt.dataID); !errors.Is(err, tt.want) {
+				t.Errorf("VerifySignature = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package metrics
+
+import (
+	"strings"
+	"sync"
+)
+
+// OtherDomain is the label used once the domain limit is reached.
+const OtherDomain = "other"
+
+// domainLabels caps how many distinct domains become label values, so a burst
+// of random Host headers cannot blow up the number of series.
+var domainLabels = &domainLimiter{max: 100, seen: map[string]struct{}{}}
+
+type domainLimiter struct {
+	mu   sync.Mutex
+	max  int
+	seen map[string]struct{}
+}
+
+// SetMaxDomainLabels sets how many distinct domains are tracked individually.
+// Zero or less disables per-domain labels entirely.
+func SetMaxDomainLabels(n int) {
+	domainLabels.mu.Lock()
+	domainLabels.max = n
+	domainLabels.mu.Unlock()
+}
+
+// DomainLabel returns the label value for a proxied domain. Only domains that
+// exist in the database should be passed here; the first domains seen (up to
+// the limit) keep their own series and the rest are grouped under "other".
+func DomainLabel(domain string) string {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	if domain == "" {
+		return "unknown"
+	}
+
+	l := domainLabels
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.seen[domain]; ok {
+		return domain
+	}
+	if len(l.seen) >= l.max {
+		return OtherDomain
+	}
+	l.seen[domain] = struct{}{}
+	return domain
+}
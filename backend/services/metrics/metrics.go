@@ -0,0 +1,158 @@
+package metrics
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"CDNProxy_v2/backend/database"
+)
+
+// proxyBuckets cover both playlist requests and long segment/stream transfers.
+var proxyBuckets = []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// API e roteador
+var (
+	HTTPRequests = NewCounterVec("cdnproxy_http_requests_total",
+		"HTTP requests handled, by route template, method and status code.",
+		"route", "method", "status")
+	HTTPDuration = NewHistogramVec("cdnproxy_http_request_duration_seconds",
+		"HTTP request latency by route template and method.",
+		DefaultBuckets, "route", "method")
+	OpenConnections = NewGauge("cdnproxy_http_open_connections",
+		"Client connections currently open.")
+	ActiveConnections = NewGauge("cdnproxy_http_active_connections",
+		"Client connections currently serving a request.")
+)
+
+// Proxy de streaming, rotulado por domínio (ver DomainLabel)
+var (
+	ProxyRequests = NewCounterVec("cdnproxy_proxy_requests_total",
+		"Proxied requests by domain and status code.",
+		"domain", "status")
+	ProxyDuration = NewHistogramVec("cdnproxy_proxy_request_duration_seconds",
+		"Total time to serve a proxied request, including the body transfer.",
+		proxyBuckets, "domain")
+	UpstreamDuration = NewHistogramVec("cdnproxy_proxy_upstream_duration_seconds",
+		"Time until the upstream returned response headers.",
+		proxyBuckets, "domain")
+	UpstreamErrors = NewCounterVec("cdnproxy_proxy_upstream_errors_total",
+		"Requests where the upstream could not be reached or returned no response.",
+		"domain")
+	ProxyBytesIn = NewCounterVec("cdnproxy_proxy_received_bytes_total",
+		"Request body bytes received from clients.",
+		"domain")
+	ProxyBytesOut = NewCounterVec("cdnproxy_proxy_sent_bytes_total",
+		"Response bytes sent to clients.",
+		"domain")
+)
+
+// Integrações externas
+var (
+	GeolocationRequests = NewCounterVec("cdnproxy_geolocation_requests_total",
+		"Geolocation provider lookups by provider and result (success or failure).",
+		"provider", "result")
+	GeolocationDuration = NewHistogramVec("cdnproxy_geolocation_request_duration_seconds",
+		"Geolocation provider latency.",
+		DefaultBuckets, "provider")
+	WebhookEvents = NewCounterVec("cdnproxy_webhook_events_total",
+		"Webhook notifications processed, by provider and outcome.",
+		"provider", "outcome")
+)
+
+func init() {
+	registerPoolStats()
+}
+
+// ObserveGeolocation records one provider lookup.
+func ObserveGeolocation(provider string, start time.Time, err error) {
+	GeolocationDuration.Observe(time.Since(start).Seconds(), provider)
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	GeolocationRequests.Inc(provider, result)
+}
+
+// ObserveWebhook records the outcome of one webhook notification.
+func ObserveWebhook(provider, outcome string) {
+	WebhookEvents.Inc(provider, outcome)
+}
+
+// StatusLabel converts a status code to a label value.
+func StatusLabel(code int) string {
+	if code == 0 {
+		code = http.StatusOK
+	}
+	return strconv.Itoa(code)
+}
+
+// MethodLabel keeps the method label bounded: anything that is not a standard
+// HTTP method becomes "OTHER".
+func MethodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodOptions, http.MethodConnect, http.MethodTrace:
+		return method
+	}
+	return "OTHER"
+}
+
+// registerPoolStats exposes pgxpool.Stat() for database.DB.
+func registerPoolStats() {
+	pool := func(read func() float64) func() (float64, bool) {
+		return func() (float64, bool) {
+			if database.DB == nil {
+				return 0, false
+			}
+			return read(), true
+		}
+	}
+
+	NewGaugeFunc("cdnproxy_db_pool_acquired_connections", "Connections currently checked out of the pool.",
+		pool(func() float64 { return float64(database.DB.Stat().AcquiredConns()) }))
+	NewGaugeFunc("cdnproxy_db_pool_idle_connections", "Idle connections in the pool.",
+		pool(func() float64 { return float64(database.DB.Stat().IdleConns()) }))
+	NewGaugeFunc("cdnproxy_db_pool_total_connections", "Total connections in the pool, including ones being constructed.",
+		pool(func() float64 { return float64(database.DB.Stat().TotalConns()) }))
+	NewGaugeFunc("cdnproxy_db_pool_max_connections", "Maximum size of the pool.",
+		pool(func() float64 { return float64(database.DB.Stat().MaxConns()) }))
+	NewCounterFunc("cdnproxy_db_pool_acquires_total", "Successful connection acquires.",
+		pool(func() float64 { return float64(database.DB.Stat().AcquireCount()) }))
+	NewCounterFunc("cdnproxy_db_pool_empty_acquires_total", "Acquires that had to wait because the pool was empty.",
+		pool(func() float64 { return float64(database.DB.Stat().EmptyAcquireCount()) }))
+	NewCounterFunc("cdnproxy_db_pool_canceled_acquires_total", "Acquires cancelled by their context.",
+		pool(func() float64 { return float64(database.DB.Stat().CanceledAcquireCount()) }))
+	NewCounterFunc("cdnproxy_db_pool_acquire_duration_seconds_total", "Total time spent waiting for connections.",
+		pool(func() float64 { return database.DB.Stat().AcquireDuration().Seconds() }))
+}
+
+// connStates remembers the last state of each connection so ConnState can
+// keep the active gauge consistent when a connection closes mid-request.
+var connStates sync.Map // net.Conn -> http.ConnState
+
+// TrackConnState is meant for http.Server.ConnState.
+func TrackConnState(conn net.Conn, state http.ConnState) {
+	prev, _ := connStates.Load(conn)
+	if prev == http.StateActive && state != http.StateActive {
+		ActiveConnections.Add(-1)
+	}
+
+	switch state {
+	case http.StateNew:
+		OpenConnections.Add(1)
+		connStates.Store(conn, state)
+	case http.StateActive:
+		if prev != http.StateActive {
+			ActiveConnections.Add(1)
+		}
+		connStates.Store(conn, state)
+	case http.StateIdle:
+		connStates.Store(conn, state)
+	case http.StateHijacked, http.StateClosed:
+		OpenConnections.Add(-1)
+		connStates.Delete(conn)
+	}
+}
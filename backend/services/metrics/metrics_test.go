@@ -0,0 +1,167 @@
+package metrics
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func scrape(t *testing.T) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if _, err := DefaultRegistry.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	return buf.String()
+}
+
+func TestCounterExposition(t *testing.T) {
+	c := NewCounterVec("test_events_total", "Test events.", "kind")
+	c.Inc("a")
+	c.Add(2, "a")
+	c.Inc(`with "quotes"`)
+
+	out := scrape(t)
+	for _, want := range []string{
+		"# HELP test_events_total Test events.\n",
+		"# TYPE test_events_total counter\n",
+		`test_events_total{kind="a"} 3` + "\n",
+		`test_events_total{kind="with \"quotes\""} 1` + "\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in output:\n%s", want, out)
+		}
+	}
+}
+
+func TestHistogramExposition(t *testing.T) {
+	h := NewHistogramVec("test_latency_seconds", "Test latency.", []float64{0.1, 1}, "route")
+	h.Observe(0.05, "/x")
+	h.Observe(0.5, "/x")
+	h.Observe(5, "/x")
+
+	out := scrape(t)
+	for _, want := range []string{
+		`test_latency_seconds_bucket{route="/x",le="0.1"} 1`,
+		`test_latency_seconds_bucket{route="/x",le="1"} 2`,
+		`test_latency_seconds_bucket{route="/x",le="+Inf"} 3`,
+		`test_latency_seconds_sum{route="/x"} 5.55`,
+		`test_latency_seconds_count{route="/x"} 3`,
+	} {
+		if !strings.Contains(out, want+"\n") {
+			t.Errorf("missing %q in output:\n%s", want, out)
+		}
+	}
+}
+
+func TestPoolStatsSkippedWithoutDatabase(t *testing.T) {
+	if out := scrape(t); strings.Contains(out, "cdnproxy_db_pool_") {
+		t.Errorf("pool metrics must be omitted while database.DB is nil")
+	}
+}
+
+func TestDomainLabelLimit(t *testing.T) {
+	SetMaxDomainLabels(2)
+	defer SetMaxDomainLabels(100)
+	domainLabels.seen = map[string]struct{}{}
+
+	if got := DomainLabel("A.example.com"); got != "a.example.com" {
+		t.Errorf("DomainLabel normaliza para minúsculas, got %q", got)
+	}
+	DomainLabel("b.example.com")
+
+	if got := DomainLabel("c.example.com"); got != OtherDomain {
+		t.Errorf("third domain should be grouped as %q, got %q", OtherDomain, got)
+	}
+	if got := DomainLabel("a.example.com"); got != "a.example.com" {
+		t.Errorf("known domain must keep its label, got %q", got)
+	}
+	if got := DomainLabel(""); got != "unknown" {
+		t.Errorf("empty domain, got %q", got)
+	}
+}
+
+func TestMethodLabel(t *testing.T) {
+	if MethodLabel("GET") != "GET" || MethodLabel("FOO") != "OTHER" {
+		t.Error("unexpected method labels")
+	}
+}
+
+func TestTrackConnState(t *testing.T) {
+	open, active := OpenConnections.Value(), ActiveConnections.Value()
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	TrackConnState(c1, http.StateNew)
+	TrackConnState(c1, http.StateActive)
+	if OpenConnections.Value() != open+1 || ActiveConnections.Value() != active+1 {
+		t.Fatalf("expected one open and active connection")
+	}
+
+	TrackConnState(c1, http.StateIdle)
+	TrackConnState(c1, http.StateActive)
+	TrackConnState(c1, http.StateClosed) // fechada no meio de uma requisição
+	if OpenConnections.Value() != open || ActiveConnections.Value() != active {
+		t.Errorf("gauges must return to their initial values, got open=%v active=%v",
+			OpenConnections.Value(), ActiveConnections.Value())
+	}
+}
+
+func TestHandlerToken(t *testing.T) {
+	h := Handler("s3cret")
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without token, got %d", rec.Code)
+	}
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer s3cre")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 with a wrong token, got %d", rec.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("unexpected response: %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+}
+
+func TestHandlerWithoutToken(t *testing.T) {
+	h := Handler("")
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     string
+		want       int
+	}{
+		{"direct loopback request", "127.0.0.1:40000", "", http.StatusOK},
+		{"direct IPv6 loopback request", "[::1]:40000", "", http.StatusOK},
+		{"remote peer", "203.0.113.10:40000", "", http.StatusForbidden},
+		{"forwarded by the local proxy", "127.0.0.1:40000", "203.0.113.10", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/metrics", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.header != "" {
+				req.Header.Set("X-Real-IP", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package payments
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"CDNProxy_v2/backend/database"
+	"CDNProxy_v2/backend/models"
+	"CDNProxy_v2/backend/services/invoices"
+	"CDNProxy_v2/backend/services/wallet"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// MethodWallet is the payment method of payments made entirely from the
+// wallet balance.
+const MethodWallet = "wallet"
+
+// AutoRenewConfig controls the job that renews domains from wallet balances.
+type AutoRenewConfig struct {
+	// DaysBefore is how many days before expiry a domain is renewed.
+	DaysBefore int
+	// Interval between runs.
+	Interval time.Duration
+}
+
+// StartAutoRenew runs RenewFromWallets once and then every cfg.Interval
+// until ctx is cancelled.
+func StartAutoRenew(ctx context.Context, cfg AutoRenewConfig) {
+	if cfg.DaysBefore < 0 {
+		cfg.DaysBefore = 0
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Hour
+	}
+
+	go func() {
+		ticker := time.NewTicker(cfg.Interval)
+		defer ticker.Stop()
+
+		for {
+			renewed, err := RenewFromWallets(ctx, time.Now().AddDate(0, 0, cfg.DaysBefore))
+			if err != nil {
+				log.Printf("Wallet auto-renewal: %v", err)
+			} else if renewed > 0 {
+				log.Printf("Wallet auto-renewal: renewed %d domains", renewed)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// RenewFromWallets renews by one plan period every active domain expiring
+// before deadline whose owner, or the owner's reseller, turned on automatic
+// renewals of the wallet, paying from that wallet. Domains with an
+// authorized subscription are left to the subscription. Each renewal is an
+// approved payment with method MethodWallet and its own invoice; wallets
+// without enough balance are skipped until the next run. It returns how many
+// domains were renewed.
+func RenewFromWallets(ctx context.Context, deadline time.Time) (int, error) {
+	// The owner's own wallet is tried before the reseller's
+	rows, err := database.DB.Query(ctx, `
+		SELECT w.user_id, d.id
+		FROM public.wallets w
+		JOIN public.users u ON u.id = w.user_id OR u.parent_id = w.user_id
+		JOIN public.domains d ON d.user_id = u.id
+		WHERE w.auto_renew AND d.active AND d.plan_id IS NOT NULL AND d.expired_at IS NOT NULL AND d.expired_at <= $1
+			AND NOT EXISTS (SELECT 1 FROM public.subscriptions s WHERE s.domain_id = d.id AND s.status = $2)
+		ORDER BY d.expired_at, d.id, (u.id = w.user_id) DESC`, deadline, SubscriptionAuthorized)
+	if err != nil {
+		return 0, err
+	}
+	type candidate struct{ walletUserID, domainID int64 }
+	var candidates []candidate
+	for rows.Next() {
+		var c candidate
+		if err := rows.Scan(&c.walletUserID, &c.domainID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		candidates = append(candidates, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	renewed := 0
+	for _, c := range candidates {
+		ok, err := renewFromWallet(ctx, c.walletUserID, c.domainID, deadline)
+		switch {
+		case errors.Is(err, wallet.ErrInsufficientFunds):
+			log.Printf("Wallet auto-renewal: wallet of user %d cannot pay domain %d", c.walletUserID, c.domainID)
+		case err != nil:
+			log.Printf("Wallet auto-renewal: domain %d from wallet of user %d: %v", c.domainID, c.walletUserID, err)
+		case ok:
+			renewed++
+		}
+	}
+	return renewed, nil
+}
+
+// renewalQuote is the domain and plan prices read by renewFromWallet.
+type renewalQuote struct {
+	ownerID int64
+	// resellerID is the parent of the domain owner, when it is a sub-account.
+	resellerID *int64
+	planPrice  float64
+	// resellerPrice is the price resellerID set for the plan, if any.
+	resellerPrice *float64
+}
+
+// price returns what renewing the domain costs when paid from the wallet of
+// walletUserID. Sub-accounts pay their reseller's price, as at checkout,
+// whether the sub-account's own wallet or the reseller's pays. ok is false
+// when the wallet belongs to neither of them.
+func (q renewalQuote) price(walletUserID int64) (price float64, ok bool) {
+	if walletUserID != q.ownerID && (q.resellerID == nil || walletUserID != *q.resellerID) {
+		return 0, false
+	}
+	if q.resellerID != nil && q.resellerPrice != nil {
+		return *q.resellerPrice, true
+	}
+	return q.planPrice, true
+}
+
+// renewFromWallet renews domainID from the wallet of walletUserID, unless it
+// was already renewed past deadline. The domain row stays locked while the
+// payment is recorded, so concurrent runs renew it once.
+func renewFromWallet(ctx context.Context, walletUserID, domainID int64, deadline time.Time) (bool, error) {
+	tx, err := database.DB.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	var (
+		name      string
+		expiredAt time.Time
+		quote     renewalQuote
+		item      = models.CartItem{ProductType: "domain_renewal", ProductIdentifier: strconv.FormatInt(domainID, 10), Periods: 1}
+	)
+	// The reseller price is the one set by the parent of the domain owner
+	err = tx.QueryRow(ctx, `
+		SELECT d.name, d.expired_at, d.user_id, u.parent_id, COALESCE(p.price, 0)::float8, rp.price::float8,
+			p.billing_period, p.period_days
+		FROM public.domains d
+		JOIN public.users u ON u.id = d.user_id
+		JOIN public.plans p ON p.id = d.plan_id
+		LEFT JOIN public.reseller_prices rp ON rp.plan_id = p.id AND rp.reseller_id = u.parent_id
+		WHERE d.id = $1 AND d.active
+		FOR UPDATE OF d`, domainID,
+	).Scan(&name, &expiredAt, &quote.ownerID, &quote.resellerID, &quote.planPrice, &quote.resellerPrice,
+		&item.BillingPeriod, &item.PeriodDays)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	price, ok := quote.price(walletUserID)
+	if !ok || expiredAt.After(deadline) || price <= 0 {
+		return false, nil
+	}
+	item.Price = price
+
+	snapshot, err := json.Marshal([]models.CartItem{item})
+	if err != nil {
+		return false, err
+	}
+	var paymentID int64
+	err = tx.QueryRow(ctx, `
+		INSERT INTO public.payments
+			(user_id, amount, currency, status, payment_method, metadata, wallet_amount, paid_at, fulfilled_at, created_at, updated_at)
+		VALUES ($1, 0, $2, $3, $4, $5, $6, NOW(), NOW(), NOW(), NOW())
+		RETURNING id`,
+		walletUserID, wallet.Currency, StatusApproved, MethodWallet, snapshot, price).Scan(&paymentID)
+	if err != nil {
+		return false, err
+	}
+	ref := wallet.PaymentReference(paymentID)
+	description := fmt.Sprintf("Renovação automática do domínio %s", name)
+	if err := wallet.Post(ctx, tx, &wallet.Entry{UserID: walletUserID, Amount: -price, Reason: wallet.ReasonRenewal,
+		Reference: &ref, Description: &description}); err != nil {
+		return false, err
+	}
+	if err := renewPaidItems(ctx, tx, walletUserID, snapshot); err != nil {
+		return false, err
+	}
+	inv, _, err := invoices.Issue(ctx, tx, paymentID)
+	if err != nil {
+		return false, fmt.Errorf("issue invoice: %w", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return false, err
+	}
+	go func() {
+		if err := invoices.Deliver(context.Background(), inv.ID); err != nil {
+			log.Printf("ERROR: Could not email invoice %d of payment %d: %v", inv.Number, paymentID, err)
+		}
+	}()
+	return true, nil
+}
@@ -0,0 +1,33 @@
+package payments
+
+import "testing"
+
+func TestRenewalQuotePrice(t *testing.T) {
+	reseller, resellerPrice := int64(10), 25.0
+	subAccount := renewalQuote{ownerID: 20, resellerID: &reseller, planPrice: 40, resellerPrice: &resellerPrice}
+	noResellerPrice := renewalQuote{ownerID: 20, resellerID: &reseller, planPrice: 40}
+	direct := renewalQuote{ownerID: 30, planPrice: 40}
+
+	tests := []struct {
+		name      string
+		quote     renewalQuote
+		wallet    int64
+		wantPrice float64
+		wantOK    bool
+	}{
+		{"sub-account wallet pays the reseller price", subAccount, 20, 25, true},
+		{"reseller wallet pays the reseller price", subAccount, 10, 25, true},
+		{"plan price without a reseller price", noResellerPrice, 10, 40, true},
+		{"own wallet of a direct customer", direct, 30, 40, true},
+		{"unrelated wallet", subAccount, 99, 0, false},
+		{"reseller of another account", direct, 10, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			price, ok := tt.quote.price(tt.wallet)
+			if price != tt.wantPrice || ok != tt.wantOK {
+				t.Errorf("price(%d) = %v, %v; want %v, %v", tt.wallet, price, ok, tt.wantPrice, tt.wantOK)
+			}
+		})
+	}
+}
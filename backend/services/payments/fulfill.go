@@ -0,0 +1,293 @@
+package payments
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"CDNProxy_v2/backend/database"
+	"CDNProxy_v2/backend/models"
+	"CDNProxy_v2/backend/services/invoices"
+	"CDNProxy_v2/backend/services/wallet"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// finalStatuses may still change a payment after it was fulfilled.
+var finalStatuses = map[string]bool{StatusRefunded: true, StatusChargedBack: true, StatusCancelled: true}
+
+// reversedStatuses give back the wallet part of a fulfilled payment and take
+// back its wallet top-ups.
+var reversedStatuses = map[string]bool{StatusRefunded: true, StatusChargedBack: true}
+
+// unpaidStatuses end a payment that was not fulfilled; the wallet balance it
+// used goes back to the wallet.
+var unpaidStatuses = map[string]bool{StatusRejected: true, StatusCancelled: true, StatusRefunded: true, StatusChargedBack: true}
+
+// Apply records the provider payment state on the local payment paymentID
+// and returns the resulting notification status. The first time the payment
+// is approved it renews the paid domains, credits wallet top-ups, issues the
+// invoice (emailed afterwards when enabled) and, unless the payment is a
+// subscription charge or a top-up, removes the paid items and their coupon
+// from the cart; the PIX charge of the payment, if any, follows the payment
+// status. A payment that ends without being approved gives back the wallet
+// balance its checkout used, and a refund or chargeback of a fulfilled
+// payment gives that balance back too and takes back its top-ups. The
+// payment row is locked while this runs and fulfilled_at records the
+// renewal, so it is safe to call any number of times for the same payment:
+// it is used by the webhooks, by notification replays, by checkout status
+// polling and to settle payments a coupon or the wallet made free.
+func Apply(ctx context.Context, paymentID int64, payment *Payment) (string, error) {
+	tx, err := database.DB.Begin(ctx)
+	if err != nil {
+		return NotificationFailed, err
+	}
+	defer tx.Rollback(ctx)
+
+	var (
+		userID      int64
+		status      string
+		amount      float64
+		currency    string
+		fulfilledAt *time.Time
+		metadata    []byte
+		subID       *int64
+	)
+	err = tx.QueryRow(ctx,
+		"SELECT user_id, COALESCE(status, ''), amount::float8, currency, fulfilled_at, metadata, subscription_id FROM public.payments WHERE id = $1 FOR UPDATE",
+		paymentID).Scan(&userID, &status, &amount, &currency, &fulfilledAt, &metadata, &subID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return NotificationFailed, fmt.Errorf("payment %d not found", paymentID)
+	}
+	if err != nil {
+		return NotificationFailed, err
+	}
+
+	if fulfilledAt != nil {
+		// Already renewed; only refunds and chargebacks still change the status
+		if finalStatuses[payment.Status] {
+			if _, err := tx.Exec(ctx,
+				"UPDATE public.payments SET status = $1, updated_at = NOW() WHERE id = $2",
+				payment.Status, paymentID); err != nil {
+				return NotificationFailed, err
+			}
+			if err := syncPixTransaction(ctx, tx, paymentID, payment.Status); err != nil {
+				return NotificationFailed, err
+			}
+			if reversedStatuses[payment.Status] && !reversedStatuses[status] {
+				if err := wallet.Refund(ctx, tx, paymentID); err != nil {
+					return NotificationFailed, fmt.Errorf("refund wallet balance: %w", err)
+				}
+				if err := reverseTopUps(ctx, tx, paymentID, userID, metadata); err != nil {
+					return NotificationFailed, err
+				}
+			}
+			return NotificationProcessed, tx.Commit(ctx)
+		}
+		return NotificationDuplicate, nil
+	}
+
+	if _, err := tx.Exec(ctx,
+		"UPDATE public.payments SET status = $1, provider_payment_id = NULLIF($2, ''), updated_at = NOW() WHERE id = $3",
+		payment.Status, payment.ID, paymentID); err != nil {
+		return NotificationFailed, err
+	}
+	if err := syncPixTransaction(ctx, tx, paymentID, payment.Status); err != nil {
+		return NotificationFailed, err
+	}
+	if unpaidStatuses[payment.Status] {
+		if err := wallet.Release(ctx, tx, paymentID); err != nil {
+			return NotificationFailed, fmt.Errorf("release wallet balance: %w", err)
+		}
+	}
+
+	if payment.Status == StatusApproved {
+		if payment.Currency != "" && !strings.EqualFold(payment.Currency, currency) {
+			return NotificationFailed, fmt.Errorf("paid currency %s differs from payment %d currency %s", payment.Currency, paymentID, currency)
+		}
+		if payment.Amount+0.005 < amount {
+			return NotificationFailed, fmt.Errorf("paid amount %.2f is lower than payment %d amount %.2f", payment.Amount, paymentID, amount)
+		}
+		// A payment approved after its wallet part was given back takes it again
+		if err := wallet.Retake(ctx, tx, paymentID); err != nil {
+			return NotificationFailed, fmt.Errorf("take wallet balance of payment %d again: %w", paymentID, err)
+		}
+		if err := renewPaidItems(ctx, tx, userID, metadata); err != nil {
+			return NotificationFailed, err
+		}
+		topUp, err := creditTopUps(ctx, tx, paymentID, userID, metadata)
+		if err != nil {
+			return NotificationFailed, err
+		}
+		if _, err := tx.Exec(ctx,
+			"UPDATE public.payments SET fulfilled_at = NOW(), paid_at = COALESCE(paid_at, NOW()) WHERE id = $1",
+			paymentID); err != nil {
+			return NotificationFailed, err
+		}
+		if subID == nil && !topUp {
+			if err := clearPaidCart(ctx, tx, paymentID, userID, metadata); err != nil {
+				return NotificationFailed, err
+			}
+		}
+		inv, _, err := invoices.Issue(ctx, tx, paymentID)
+		if err != nil {
+			return NotificationFailed, fmt.Errorf("issue invoice: %w", err)
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return NotificationFailed, err
+		}
+		go func() {
+			if err := invoices.Deliver(context.Background(), inv.ID); err != nil {
+				log.Printf("ERROR: Could not email invoice %d of payment %d: %v", inv.Number, paymentID, err)
+			}
+		}()
+		return NotificationProcessed, nil
+	}
+	return NotificationProcessed, tx.Commit(ctx)
+}
+
+// syncPixTransaction copies the payment status to the PIX charge of the
+// payment, when it has one.
+func syncPixTransaction(ctx context.Context, tx pgx.Tx, paymentID int64, status string) error {
+	_, err := tx.Exec(ctx, `
+		UPDATE public.pix_transactions
+		SET status = $1, paid_at = CASE WHEN $1 = 'approved' THEN COALESCE(paid_at, NOW()) ELSE paid_at END, updated_at = NOW()
+		WHERE payment_id = $2`, status, paymentID)
+	return err
+}
+
+// clearPaidCart removes from the cart of userID the items of the payment's
+// cart snapshot, and the coupon when it is the one this payment redeemed.
+// Items added and coupons applied after the checkout stay in the cart.
+func clearPaidCart(ctx context.Context, tx pgx.Tx, paymentID, userID int64, metadata []byte) error {
+	if len(metadata) > 0 {
+		var items []models.CartItem
+		if err := json.Unmarshal(metadata, &items); err != nil {
+			return fmt.Errorf("invalid payment metadata: %w", err)
+		}
+		ids := make([]int64, 0, len(items))
+		for _, item := range items {
+			if item.ID > 0 {
+				ids = append(ids, item.ID)
+			}
+		}
+		if len(ids) > 0 {
+			if _, err := tx.Exec(ctx, "DELETE FROM public.cart_items WHERE user_id = $1 AND id = ANY($2)", userID, ids); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := tx.Exec(ctx, `
+		DELETE FROM public.cart_coupons cc USING public.coupon_redemptions cr
+		WHERE cc.user_id = $1 AND cr.payment_id = $2 AND cc.coupon_id = cr.coupon_id`, userID, paymentID)
+	return err
+}
+
+// creditTopUps credits the wallet of the payer with the wallet top-ups of the
+// payment's cart snapshot and reports whether there was any.
+func creditTopUps(ctx context.Context, tx pgx.Tx, paymentID, userID int64, metadata []byte) (bool, error) {
+	if len(metadata) == 0 {
+		return false, nil
+	}
+	var items []models.CartItem
+	if err := json.Unmarshal(metadata, &items); err != nil {
+		return false, fmt.Errorf("invalid payment metadata: %w", err)
+	}
+	credited := false
+	for _, item := range items {
+		if item.ProductType != models.ProductWalletTopUp {
+			continue
+		}
+		ref := wallet.PaymentReference(paymentID)
+		description := fmt.Sprintf("Recarga pelo pagamento #%d", paymentID)
+		if err := wallet.Post(ctx, tx, &wallet.Entry{UserID: userID, Amount: item.Price, Reason: wallet.ReasonTopUp,
+			Reference: &ref, Description: &description}); err != nil {
+			return false, fmt.Errorf("credit wallet top-up: %w", err)
+		}
+		credited = true
+	}
+	return credited, nil
+}
+
+// reverseTopUps debits from the wallet of the payer the top-ups of a
+// fulfilled payment that was refunded or charged back. When the balance no
+// longer covers them it debits what is left and records the difference in
+// payments.wallet_shortfall for a superadmin to settle by hand.
+func reverseTopUps(ctx context.Context, tx pgx.Tx, paymentID, userID int64, metadata []byte) error {
+	if len(metadata) == 0 {
+		return nil
+	}
+	var items []models.CartItem
+	if err := json.Unmarshal(metadata, &items); err != nil {
+		return fmt.Errorf("invalid payment metadata: %w", err)
+	}
+	var total float64
+	for _, item := range items {
+		if item.ProductType == models.ProductWalletTopUp {
+			total += item.Price
+		}
+	}
+	if total = math.Round(total*100) / 100; total <= 0 {
+		return nil
+	}
+
+	balance, err := wallet.Lock(ctx, tx, userID)
+	if err != nil {
+		return err
+	}
+	debit := math.Min(balance, total)
+	if debit > 0 {
+		ref := wallet.PaymentReference(paymentID)
+		description := fmt.Sprintf("Estorno da recarga do pagamento #%d", paymentID)
+		if err := wallet.Post(ctx, tx, &wallet.Entry{UserID: userID, Amount: -debit, Reason: wallet.ReasonTopUpReversal,
+			Reference: &ref, Description: &description}); err != nil {
+			return fmt.Errorf("reverse wallet top-up: %w", err)
+		}
+	}
+	if shortfall := math.Round((total-debit)*100) / 100; shortfall > 0 {
+		if _, err := tx.Exec(ctx, "UPDATE public.payments SET wallet_shortfall = $2 WHERE id = $1", paymentID, shortfall); err != nil {
+			return err
+		}
+		log.Printf("WARN: Wallet of user %d is %.2f short of reversing the top-up of payment %d", userID, shortfall, paymentID)
+	}
+	return nil
+}
+
+// renewPaidItems extends each domain of the payment's cart snapshot that
+// belongs to the payer or to one of the payer's sub-accounts, by the plan
+// period recorded at checkout times the periods bought. The extension counts
+// from now when the domain has already expired, and the domain is
+// reactivated.
+func renewPaidItems(ctx context.Context, tx pgx.Tx, userID int64, metadata []byte) error {
+	if len(metadata) == 0 {
+		return nil
+	}
+	var items []models.CartItem
+	if err := json.Unmarshal(metadata, &items); err != nil {
+		return fmt.Errorf("invalid payment metadata: %w", err)
+	}
+	for _, item := range items {
+		if item.ProductType != "domain_renewal" {
+			continue
+		}
+		domainID, _ := strconv.ParseInt(item.ProductIdentifier, 10, 64)
+		if domainID <= 0 {
+			continue
+		}
+		interval := models.RenewalInterval(item.BillingPeriod, item.PeriodDays, item.Periods)
+		if _, err := tx.Exec(ctx, `
+			UPDATE public.domains
+			SET expired_at = GREATEST(COALESCE(expired_at, NOW()), NOW()) + $3::interval, active = true
+			WHERE id = $1 AND user_id IN (SELECT id FROM public.users WHERE id = $2 OR parent_id = $2)`,
+			domainID, userID, interval); err != nil {
+			return fmt.Errorf("renew domain %d: %w", domainID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package payments
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"CDNProxy_v2/backend/database"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Notification statuses stored in mercadopago_notifications.status.
+const (
+	NotificationReceived  = "received"
+	NotificationProcessed = "processed"
+	NotificationDuplicate = "duplicate"
+	NotificationIgnored   = "ignored"
+	NotificationFailed    = "failed"
+	NotificationRejected  = "rejected"
+)
+
+// ErrNotificationNotFound is returned by ProcessNotification for unknown ids.
+var ErrNotificationNotFound = errors.New("notification not found")
+
+// Notification is one webhook request received from a provider. They are
+// stored in mercadopago_notifications, which keeps its original name and
+// records the provider of each row.
+type Notification struct {
+	ID             int64           `json:"id"`
+	Provider       string          `json:"provider"`
+	Payload        json.RawMessage `json:"payload"`
+	Query          string          `json:"query"`
+	RequestID      string          `json:"request_id"`
+	Topic          string          `json:"topic"`
+	ResourceID     string          `json:"resource_id"`
+	SignatureValid bool            `json:"signature_valid"`
+	Status         string          `json:"status"`
+	Error          *string         `json:"error,omitempty"`
+	PaymentID      *int64          `json:"payment_id,omitempty"`
+	ProviderStatus *string         `json:"mp_status,omitempty"`
+	Attempts       int             `json:"attempts"`
+	ProcessedAt    *time.Time      `json:"processed_at,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	UpdatedAt      time.Time       `json:"updated_at"`
+}
+
+// NotificationColumns is the column list scanned by ScanNotification.
+const NotificationColumns = "id, provider, COALESCE(payload, 'null'::jsonb), query, request_id, topic, resource_id, signature_valid, status, error, payment_id, mp_status, attempts, processed_at, created_at, updated_at"
+
+// ScanNotification reads a row selected with NotificationColumns.
+func ScanNotification(row pgx.Row) (*Notification, error) {
+	var n Notification
+	err := row.Scan(&n.ID, &n.Provider, &n.Payload, &n.Query, &n.RequestID, &n.Topic, &n.ResourceID, &n.SignatureValid,
+		&n.Status, &n.Error, &n.PaymentID, &n.ProviderStatus, &n.Attempts, &n.ProcessedAt, &n.CreatedAt, &n.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+// SaveNotification inserts n and fills its id and timestamps.
+func SaveNotification(ctx context.Context, n *Notification) error {
+	payload := n.Payload
+	if len(payload) == 0 || !json.Valid(payload) {
+		raw, _ := json.Marshal(map[string]string{"raw": string(payload)})
+		payload = raw
+	}
+	return database.DB.QueryRow(ctx, `
+		INSERT INTO public.mercadopago_notifications
+			(provider, payload, query, request_id, topic, resource_id, signature_valid, status, error)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING id, created_at, updated_at`,
+		n.Provider, payload, n.Query, n.RequestID, n.Topic, n.ResourceID, n.SignatureValid, n.Status, n.Error,
+	).Scan(&n.ID, &n.CreatedAt, &n.UpdatedAt)
+}
+
+// GetNotification loads one stored notification.
+func GetNotification(ctx context.Context, id int64) (*Notification, error) {
+	n, err := ScanNotification(database.DB.QueryRow(ctx,
+		"SELECT "+NotificationColumns+" FROM public.mercadopago_notifications WHERE id = $1", id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotificationNotFound
+	}
+	return n, err
+}
+
+// ProcessNotification applies the stored notification id: it fetches the
+// payment from the notification's provider and hands it to Apply. Duplicated,
+// retried or replayed notifications for the same payment never renew twice.
+// The outcome is written back to the notification, which is returned.
+func ProcessNotification(ctx context.Context, id int64) (*Notification, error) {
+	n, err := GetNotification(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	status, providerStatus, paymentID, procErr := process(ctx, n)
+	var errText *string
+	if procErr != nil {
+		msg := procErr.Error()
+		errText = &msg
+	}
+	n, err = ScanNotification(database.DB.QueryRow(ctx, `
+		UPDATE public.mercadopago_notifications
+		SET status = $2, error = $3, mp_status = COALESCE($4, mp_status), payment_id = COALESCE($5, payment_id),
+			attempts = attempts + 1, processed_at = NOW(), updated_at = NOW()
+		WHERE id = $1
+		RETURNING `+NotificationColumns, id, status, errText, providerStatus, paymentID))
+	if err != nil {
+		return nil, fmt.Errorf("record notification %d outcome: %w", id, err)
+	}
+	return n, nil
+}
+
+// process returns the notification status, the provider payment status and
+// the local payment id (when known).
+func process(ctx context.Context, n *Notification) (string, *string, *int64, error) {
+	if n.ResourceID == "" {
+		return NotificationIgnored, nil, nil, nil
+	}
+	switch n.Topic {
+	case TopicPayment:
+	case TopicSubscription, TopicSubscriptionCharge:
+		return processSubscription(ctx, n)
+	default:
+		return NotificationIgnored, nil, nil, nil
+	}
+	provider, err := Get(n.Provider)
+	if err != nil {
+		return NotificationFailed, nil, nil, fmt.Errorf("provider %q: %w", n.Provider, err)
+	}
+
+	payment, err := provider.GetPayment(ctx, n.ResourceID)
+	if err != nil {
+		return NotificationFailed, nil, nil, fmt.Errorf("fetch payment %s: %w", n.ResourceID, err)
+	}
+	providerStatus := payment.Status
+
+	// external_reference is the local payment id
+	paymentID, err := strconv.ParseInt(payment.ExternalReference, 10, 64)
+	if err != nil {
+		return NotificationIgnored, &providerStatus, nil, fmt.Errorf("external_reference %q is not a payment id", payment.ExternalReference)
+	}
+
+	status, err := Apply(ctx, paymentID, payment)
+	return status, &providerStatus, &paymentID, err
+}
+
+// processSubscription handles the subscription topics: subscription changes
+// are copied to the local subscription and charges go through
+// ApplySubscriptionCharge.
+func processSubscription(ctx context.Context, n *Notification) (string, *string, *int64, error) {
+	p, err := Get(n.Provider)
+	if err != nil {
+		return NotificationFailed, nil, nil, fmt.Errorf("provider %q: %w", n.Provider, err)
+	}
+	provider, ok := p.(SubscriptionProvider)
+	if !ok {
+		return NotificationIgnored, nil, nil, fmt.Errorf("provider %q does not bill subscriptions", n.Provider)
+	}
+
+	if n.Topic == TopicSubscription {
+		sub, err := provider.GetSubscription(ctx, n.ResourceID)
+		if err != nil {
+			return NotificationFailed, nil, nil, fmt.Errorf("fetch subscription %s: %w", n.ResourceID, err)
+		}
+		if err := SyncSubscription(ctx, n.Provider, sub); err != nil {
+			if errors.Is(err, ErrSubscriptionNotFound) {
+				return NotificationIgnored, &sub.Status, nil, err
+			}
+			return NotificationFailed, &sub.Status, nil, err
+		}
+		return NotificationProcessed, &sub.Status, nil, nil
+	}
+
+	charge, err := provider.GetSubscriptionCharge(ctx, n.ResourceID)
+	if err != nil {
+		return NotificationFailed, nil, nil, fmt.Errorf("fetch subscription charge %s: %w", n.ResourceID, err)
+	}
+	providerStatus := charge.Status
+	if charge.Payment != nil {
+		providerStatus = charge.Payment.Status
+	}
+	status, paymentID, err := ApplySubscriptionCharge(ctx, n.Provider, charge)
+	return status, &providerStatus, paymentID, err
+}
@@ -0,0 +1,238 @@
+// Package payments defines the interface implemented by payment providers
+// and the provider-neutral parts of billing: the provider registry, the
+// webhook notification log and the fulfilment of approved payments.
+package payments
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Payment statuses stored in public.payments.status. They follow Mercado
+// Pago's names, which the table already used before other providers existed;
+// providers map their own states onto these.
+const (
+	StatusPending     = "pending"
+	StatusInProcess   = "in_process"
+	StatusAuthorized  = "authorized"
+	StatusApproved    = "approved"
+	StatusRejected    = "rejected"
+	StatusCancelled   = "cancelled"
+	StatusRefunded    = "refunded"
+	StatusChargedBack = "charged_back"
+)
+
+// TopicPayment is the webhook topic of events about a payment. Providers
+// report their payment events under this topic so they are processed the
+// same way; anything else is only recorded.
+const TopicPayment = "payment"
+
+var (
+	// ErrUnknownProvider is returned by Get for names that were not registered.
+	ErrUnknownProvider = errors.New("unknown payment provider")
+	// ErrSignatureMissing means the webhook request carries no usable signature.
+	ErrSignatureMissing = errors.New("missing webhook signature")
+	// ErrInvalidSignature means the webhook signature does not match.
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+	// ErrSecretNotConfigured means no webhook secret is set, so nothing can
+	// be verified.
+	ErrSecretNotConfigured = errors.New("webhook secret not configured")
+)
+
+// LineItem is one charged line of a checkout.
+type LineItem struct {
+	ID        string
+	Title     string
+	Quantity  int
+	UnitPrice float64
+}
+
+// Payer identifies who pays a checkout.
+type Payer struct {
+	Name  string
+	Email string
+}
+
+// CheckoutRequest describes a hosted checkout to be created. Currency may be
+// empty to use the provider's default currency.
+type CheckoutRequest struct {
+	// ExternalReference is the local payment id; providers echo it back on
+	// the payment so webhooks and polling can find the local row.
+	ExternalReference string
+	Currency          string
+	Items             []LineItem
+	Payer             Payer
+	SuccessURL        string
+	FailureURL        string
+	PendingURL        string
+}
+
+// CheckoutSession is the provider side of a checkout: its id and the page
+// where the customer pays.
+type CheckoutSession struct {
+	ID         string
+	URL        string
+	SandboxURL string
+}
+
+// Payment is a payment as reported by a provider.
+type Payment struct {
+	ID                string
+	Status            string
+	StatusDetail      string
+	ExternalReference string
+	Amount            float64
+	Currency          string
+}
+
+// Refund is a refund accepted by a provider.
+type Refund struct {
+	ID        string
+	PaymentID string
+	Amount    float64
+	Status    string
+}
+
+// WebhookEvent is what a provider extracted from a webhook request.
+type WebhookEvent struct {
+	Topic      string
+	ResourceID string
+	RequestID  string
+}
+
+// Provider is a payment provider. Implementations must be safe for
+// concurrent use.
+type Provider interface {
+	// Name identifies the provider; it is stored in payments.payment_method.
+	Name() string
+	// Currency is the currency charged when a checkout does not set one.
+	Currency() string
+	// CreateCheckout creates a hosted checkout for req.
+	CreateCheckout(ctx context.Context, req *CheckoutRequest) (*CheckoutSession, error)
+	// GetPayment fetches the provider payment id.
+	GetPayment(ctx context.Context, id string) (*Payment, error)
+	// FindPayment returns the most recent payment for externalRef, or nil
+	// when the customer has not paid yet.
+	FindPayment(ctx context.Context, externalRef string) (*Payment, error)
+	// Refund refunds amount of the provider payment paymentID; an amount of
+	// zero refunds it in full.
+	Refund(ctx context.Context, paymentID string, amount float64) (*Refund, error)
+	// ParseWebhook extracts the event from a webhook request whose body was
+	// already read, and verifies its signature. The event is returned even
+	// when verification fails, wrapped with one of the signature errors, so
+	// the request can still be recorded.
+	ParseWebhook(r *http.Request, body []byte) (*WebhookEvent, error)
+}
+
+// PixRequest describes a PIX charge, always in BRL.
+type PixRequest struct {
+	// ExternalReference is the local payment id, as in CheckoutRequest.
+	ExternalReference string
+	Amount            float64
+	Description       string
+	Payer             Payer
+	ExpiresAt         time.Time
+}
+
+// PixCharge is a PIX charge created by a provider.
+type PixCharge struct {
+	// PaymentID is the provider payment that the PIX transfer settles.
+	PaymentID string
+	Status    string
+	// Code is the PIX copy-and-paste code (EMV BR Code) shown as the QR code.
+	Code      string
+	ExpiresAt time.Time
+}
+
+// PixProvider is implemented by providers that create PIX charges directly,
+// without sending the customer to a hosted checkout. Payments of PIX charges
+// are confirmed like any other payment of the provider.
+type PixProvider interface {
+	Provider
+	CreatePix(ctx context.Context, req *PixRequest) (*PixCharge, error)
+}
+
+// MultiCurrencyProvider is implemented by providers that charge in more
+// currencies than their default one.
+type MultiCurrencyProvider interface {
+	Provider
+	// Currencies lists the ISO 4217 codes checkouts may use.
+	Currencies() []string
+}
+
+// SupportsCurrency reports whether p can charge in currency: its default
+// currency or, for a MultiCurrencyProvider, one of its Currencies.
+func SupportsCurrency(p Provider, currency string) bool {
+	if strings.EqualFold(p.Currency(), currency) {
+		return true
+	}
+	if mc, ok := p.(MultiCurrencyProvider); ok {
+		for _, c := range mc.Currencies() {
+			if strings.EqualFold(c, currency) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var (
+	mu          sync.RWMutex
+	providers   = map[string]Provider{}
+	defaultName string
+)
+
+// Register makes p available under p.Name(), replacing any provider already
+// registered with that name. The first provider registered is the default
+// until SetDefault is called.
+func Register(p Provider) {
+	mu.Lock()
+	defer mu.Unlock()
+	providers[p.Name()] = p
+	if defaultName == "" {
+		defaultName = p.Name()
+	}
+}
+
+// SetDefault chooses the provider returned by Get("").
+func SetDefault(name string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := providers[name]; !ok {
+		return ErrUnknownProvider
+	}
+	defaultName = name
+	return nil
+}
+
+// Get returns the provider registered as name, or the default one when name
+// is empty.
+func Get(name string) (Provider, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	if name == "" {
+		name = defaultName
+	}
+	p, ok := providers[name]
+	if !ok {
+		return nil, ErrUnknownProvider
+	}
+	return p, nil
+}
+
+// Names lists the registered providers, sorted.
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
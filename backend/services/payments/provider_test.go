@@ -0,0 +1,100 @@
+package payments
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+type stubProvider struct{ name string }
+
+func (s stubProvider) Name() string     { return s.name }
+func (s stubProvider) Currency() string { return "BRL" }
+func (s stubProvider) CreateCheckout(context.Context, *CheckoutRequest) (*CheckoutSession, error) {
+	return nil, nil
+}
+func (s stubProvider) GetPayment(context.Context, string) (*Payment, error)  { return nil, nil }
+func (s stubProvider) FindPayment(context.Context, string) (*Payment, error) { return nil, nil }
+func (s stubProvider) Refund(context.Context, string, float64) (*Refund, error) {
+	return nil, nil
+}
+func (s stubProvider) ParseWebhook(*http.Request, []byte) (*WebhookEvent, error) { return nil, nil }
+
+func TestRegistry(t *testing.T) {
+	prevProviders, prevDefault := providers, defaultName
+	providers, defaultName = map[string]Provider{}, ""
+	t.Cleanup(func() { providers, defaultName = prevProviders, prevDefault })
+
+	if _, err := Get(""); !errors.Is(err, ErrUnknownProvider) {
+		t.Errorf("Get with no providers = %v, want ErrUnknownProvider", err)
+	}
+
+	Register(stubProvider{"first"})
+	Register(stubProvider{"second"})
+	if p, err := Get(""); err != nil || p.Name() != "first" {
+		t.Errorf("default provider = %v, %v; want first registered", p, err)
+	}
+	if err := SetDefault("second"); err != nil {
+		t.Fatalf("SetDefault: %v", err)
+	}
+	if p, _ := Get(""); p.Name() != "second" {
+		t.Errorf("default provider = %s, want second", p.Name())
+	}
+	if err := SetDefault("missing"); !errors.Is(err, ErrUnknownProvider) {
+		t.Errorf("SetDefault(missing) = %v, want ErrUnknownProvider", err)
+	}
+	if _, err := Get("missing"); !errors.Is(err, ErrUnknownProvider) {
+		t.Errorf("Get(missing) = %v, want ErrUnknownProvider", err)
+	}
+	if got := Names(); !reflect.DeepEqual(got, []string{"first", "second"}) {
+		t.Errorf("Names = %v", got)
+	}
+}
+
+type multiCurrencyStub struct{ stubProvider }
+
+func (multiCurrencyStub) Currencies() []string { return []string{"USD", "EUR"} }
+
+func TestSupportsCurrency(t *testing.T) {
+	tests := []struct {
+		provider Provider
+		currency string
+		want     bool
+	}{
+		{stubProvider{"single"}, "BRL", true},
+		{stubProvider{"single"}, "brl", true},
+		{stubProvider{"single"}, "USD", false},
+		{multiCurrencyStub{stubProvider{"multi"}}, "BRL", true},
+		{multiCurrencyStub{stubProvider{"multi"}}, "eur", true},
+		{multiCurrencyStub{stubProvider{"multi"}}, "JPY", false},
+	}
+	for _, tt := range tests {
+		if got := SupportsCurrency(tt.provider, tt.currency); got != tt.want {
+			t.Errorf("SupportsCurrency(%s, %s) = %v, want %v", tt.provider.Name(), tt.currency, got, tt.want)
+		}
+	}
+}
+
+func TestSubscriptionReference(t *testing.T) {
+	if ref := SubscriptionReference(42); ref != "sub-42" {
+		t.Errorf("SubscriptionReference(42) = %q", ref)
+	}
+	tests := []struct {
+		ref     string
+		want    int64
+		wantErr bool
+	}{
+		{"sub-42", 42, false},
+		{"42", 0, true},
+		{"sub-", 0, true},
+		{"sub-x", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseSubscriptionReference(tt.ref)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("ParseSubscriptionReference(%q) = %d, %v", tt.ref, got, err)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package payments
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"CDNProxy_v2/backend/database"
+	"CDNProxy_v2/backend/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Subscription statuses stored in public.subscriptions.status, following
+// Mercado Pago's preapproval states.
+const (
+	SubscriptionPending    = "pending"
+	SubscriptionAuthorized = "authorized"
+	SubscriptionPaused     = "paused"
+	SubscriptionCancelled  = "cancelled"
+)
+
+// Webhook topics of subscription events: changes of the subscription itself
+// and charges made by it.
+const (
+	TopicSubscription       = "subscription"
+	TopicSubscriptionCharge = "subscription_charge"
+)
+
+// subscriptionRefPrefix marks external references of subscriptions, so the
+// payments they generate are never mistaken for a checkout payment id.
+const subscriptionRefPrefix = "sub-"
+
+// ErrSubscriptionNotFound is returned for subscriptions with no local row.
+var ErrSubscriptionNotFound = errors.New("subscription not found")
+
+// SubscriptionReference returns the external reference of the local
+// subscription id.
+func SubscriptionReference(id int64) string {
+	return subscriptionRefPrefix + strconv.FormatInt(id, 10)
+}
+
+// ParseSubscriptionReference returns the local subscription id of an
+// external reference made by SubscriptionReference.
+func ParseSubscriptionReference(ref string) (int64, error) {
+	id, err := strconv.ParseInt(strings.TrimPrefix(ref, subscriptionRefPrefix), 10, 64)
+	if err != nil || !strings.HasPrefix(ref, subscriptionRefPrefix) {
+		return 0, fmt.Errorf("external_reference %q is not a subscription", ref)
+	}
+	return id, nil
+}
+
+// SubscriptionRequest describes a recurring charge to be created. The payer
+// authorizes it on the page returned in Subscription.URL.
+type SubscriptionRequest struct {
+	// ExternalReference is SubscriptionReference of the local subscription.
+	ExternalReference string
+	Reason            string
+	Payer             Payer
+	Amount            float64
+	Currency          string
+	// The charge repeats every Frequency months or, for custom plans, days.
+	Frequency     int
+	FrequencyDays bool
+	BackURL       string
+}
+
+// Subscription is a subscription as reported by a provider.
+type Subscription struct {
+	ID                string
+	Status            string
+	ExternalReference string
+	URL               string
+	NextChargeAt      *time.Time
+}
+
+// SubscriptionCharge is one charge made by a subscription. Payment is nil
+// until the provider has actually attempted the charge.
+type SubscriptionCharge struct {
+	ID             string
+	SubscriptionID string
+	Status         string
+	Payment        *Payment
+}
+
+// SubscriptionProvider is implemented by providers that bill subscriptions.
+// Their webhooks report subscription changes under TopicSubscription and
+// charges under TopicSubscriptionCharge.
+type SubscriptionProvider interface {
+	Provider
+	CreateSubscription(ctx context.Context, req *SubscriptionRequest) (*Subscription, error)
+	GetSubscription(ctx context.Context, id string) (*Subscription, error)
+	CancelSubscription(ctx context.Context, id string) (*Subscription, error)
+	GetSubscriptionCharge(ctx context.Context, id string) (*SubscriptionCharge, error)
+}
+
+// SyncSubscription records the provider state of sub on the local
+// subscription named by its external reference.
+func SyncSubscription(ctx context.Context, provider string, sub *Subscription) error {
+	id, err := ParseSubscriptionReference(sub.ExternalReference)
+	if err != nil {
+		return err
+	}
+	tag, err := database.DB.Exec(ctx, `
+		UPDATE public.subscriptions
+		SET status = $3, provider_subscription_id = $4, next_charge_at = $5,
+			cancelled_at = CASE WHEN $3 = 'cancelled' THEN COALESCE(cancelled_at, NOW()) ELSE cancelled_at END,
+			updated_at = NOW()
+		WHERE id = $1 AND provider = $2`,
+		id, provider, sub.Status, sub.ID, sub.NextChargeAt)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrSubscriptionNotFound
+	}
+	return nil
+}
+
+// ApplySubscriptionCharge records a charge of a subscription as a payment of
+// the subscription's domain and hands it to Apply, which renews the domain
+// once the charge is approved. The payment is keyed by the provider payment
+// id, so repeated notifications of a charge reuse it. It returns the
+// notification status and the local payment id.
+func ApplySubscriptionCharge(ctx context.Context, provider string, charge *SubscriptionCharge) (string, *int64, error) {
+	if charge.Payment == nil || charge.Payment.ID == "" {
+		// Scheduled, not attempted yet
+		return NotificationIgnored, nil, nil
+	}
+
+	var (
+		subID, userID int64
+		domainID      *int64
+		amount        float64
+		currency      string
+		period        string
+		periodDays    *int
+	)
+	err := database.DB.QueryRow(ctx, `
+		SELECT id, user_id, domain_id, amount::float8, currency, billing_period, period_days
+		FROM public.subscriptions WHERE provider = $1 AND provider_subscription_id = $2`,
+		provider, charge.SubscriptionID).Scan(&subID, &userID, &domainID, &amount, &currency, &period, &periodDays)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return NotificationIgnored, nil, fmt.Errorf("subscription %s: %w", charge.SubscriptionID, ErrSubscriptionNotFound)
+	}
+	if err != nil {
+		return NotificationFailed, nil, err
+	}
+	if domainID == nil {
+		return NotificationIgnored, nil, fmt.Errorf("domain of subscription %d was deleted", subID)
+	}
+
+	// The same snapshot a cart checkout records, renewing one period
+	snapshot, err := json.Marshal([]models.CartItem{{
+		UserID:            userID,
+		ProductType:       "domain_renewal",
+		ProductIdentifier: strconv.FormatInt(*domainID, 10),
+		Price:             amount,
+		Periods:           1,
+		BillingPeriod:     period,
+		PeriodDays:        periodDays,
+	}})
+	if err != nil {
+		return NotificationFailed, nil, err
+	}
+	var paymentID int64
+	err = database.DB.QueryRow(ctx, `
+		WITH inserted AS (
+			INSERT INTO public.payments
+				(user_id, amount, currency, status, payment_method, provider_payment_id, subscription_id, metadata, created_at, updated_at)
+			VALUES ($1, $2, $3, 'pending', $4, $5, $6, $7, NOW(), NOW())
+			ON CONFLICT (payment_method, provider_payment_id) WHERE provider_payment_id IS NOT NULL DO NOTHING
+			RETURNING id
+		)
+		SELECT id FROM inserted
+		UNION ALL
+		SELECT id FROM public.payments WHERE payment_method = $4 AND provider_payment_id = $5
+		LIMIT 1`,
+		userID, amount, currency, provider, charge.Payment.ID, subID, snapshot).Scan(&paymentID)
+	if err != nil {
+		return NotificationFailed, nil, err
+	}
+
+	status, err := Apply(ctx, paymentID, charge.Payment)
+	if err != nil {
+		return status, &paymentID, err
+	}
+	if charge.Payment.Status == StatusApproved {
+		if _, err := database.DB.Exec(ctx,
+			"UPDATE public.subscriptions SET last_charged_at = NOW(), updated_at = NOW() WHERE id = $1", subID); err != nil {
+			return NotificationFailed, &paymentID, err
+		}
+	}
+	return status, &paymentID, nil
+}
@@ -0,0 +1,176 @@
+package requestlog
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formatter turns an entry into one log line (including the trailing newline).
+type Formatter interface {
+	Format(e Entry) []byte
+	// Header is written at the start of every new file (W3C directives).
+	Header() []byte
+}
+
+// NewFormatter returns the formatter for "common", "combined", "w3c" or "json".
+func NewFormatter(name string) (Formatter, error) {
+	switch strings.ToLower(name) {
+	case "common", "clf":
+		return commonFormatter{}, nil
+	case "combined":
+		return commonFormatter{combined: true}, nil
+	case "w3c":
+		return w3cFormatter{}, nil
+	case "json":
+		return jsonFormatter{}, nil
+	default:
+		return nil, fmt.Errorf("unknown format %q (use common, combined, w3c or json)", name)
+	}
+}
+
+// commonFormatter writes the Common/Combined Log Format followed by the proxy
+// fields: "host" "upstream" upstream_time_seconds "cache_status".
+type commonFormatter struct {
+	combined bool
+}
+
+func (f commonFormatter) Format(e Entry) []byte {
+	var b strings.Builder
+
+	bytes := "-"
+	if e.Bytes > 0 {
+		bytes = strconv.FormatInt(e.Bytes, 10)
+	}
+
+	fmt.Fprintf(&b, "%s - - [%s] \"%s %s %s\" %d %s",
+		dash(e.ClientIP),
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method, escapeQuoted(e.URI), e.Proto,
+		e.Status, bytes)
+
+	if f.combined {
+		fmt.Fprintf(&b, " \"%s\" \"%s\"", escapeQuoted(dash(e.Referer)), escapeQuoted(dash(e.UserAgent)))
+	}
+
+	fmt.Fprintf(&b, " \"%s\" \"%s\" %s \"%s\"\n",
+		escapeQuoted(dash(e.Domain)),
+		escapeQuoted(dash(e.Upstream)),
+		seconds(e.UpstreamLatency),
+		escapeQuoted(dash(e.CacheStatus)))
+
+	return []byte(b.String())
+}
+
+func (commonFormatter) Header() []byte { return nil }
+
+// w3cFields is the #Fields directive of the W3C extended format.
+var w3cFields = []string{
+	"date", "time", "c-ip", "cs-method", "cs-host", "cs-uri-stem", "cs-uri-query",
+	"sc-status", "sc-bytes", "time-taken", "cs(User-Agent)", "cs(Referer)",
+	"x-upstream", "x-upstream-time", "x-cache-status",
+}
+
+type w3cFormatter struct{}
+
+func (w3cFormatter) Header() []byte {
+	return []byte("#Version: 1.0\n#Software: CDNProxy\n#Fields: " + strings.Join(w3cFields, " ") + "\n")
+}
+
+func (w3cFormatter) Format(e Entry) []byte {
+	t := e.Time.UTC()
+	stem, query := e.URI, ""
+	if i := strings.IndexByte(e.URI, '?'); i >= 0 {
+		stem, query = e.URI[:i], e.URI[i+1:]
+	}
+
+	fields := []string{
+		t.Format("2006-01-02"),
+		t.Format("15:04:05"),
+		w3cValue(e.ClientIP),
+		w3cValue(e.Method),
+		w3cValue(e.Domain),
+		w3cValue(stem),
+		w3cValue(query),
+		strconv.Itoa(e.Status),
+		strconv.FormatInt(e.Bytes, 10),
+		seconds(e.Duration),
+		w3cValue(e.UserAgent),
+		w3cValue(e.Referer),
+		w3cValue(e.Upstream),
+		seconds(e.UpstreamLatency),
+		w3cValue(e.CacheStatus),
+	}
+	return []byte(strings.Join(fields, " ") + "\n")
+}
+
+type jsonFormatter struct{}
+
+func (jsonFormatter) Header() []byte { return nil }
+
+func (jsonFormatter) Format(e Entry) []byte {
+	line, err := json.Marshal(struct {
+		Entry
+		UpstreamLatencyMS float64 `json:"upstream_latency_ms"`
+		DurationMS        float64 `json:"duration_ms"`
+	}{
+		Entry:             e,
+		UpstreamLatencyMS: float64(e.UpstreamLatency) / float64(time.Millisecond),
+		DurationMS:        float64(e.Duration) / float64(time.Millisecond),
+	})
+	if err != nil {
+		return nil
+	}
+	return append(line, '\n')
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// escapeQuoted escapes a value written between double quotes. Values such as
+// the URI come from decoded client input, so control characters are escaped
+// too: a CR or LF must not end the line and forge another entry.
+func escapeQuoted(s string) string {
+	return escape(s, '"')
+}
+
+// w3cValue follows the IIS convention: spaces become '+' and empty is '-'.
+// Control characters are escaped as in escapeQuoted.
+func w3cValue(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return strings.ReplaceAll(escape(s, 0), " ", "+")
+}
+
+// escape prefixes backslashes and quote (when not zero) with a backslash and
+// writes control characters, DEL included, as \xNN.
+func escape(s string, quote byte) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' || (quote != 0 && c == quote):
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func seconds(d time.Duration) string {
+	if d <= 0 {
+		return "-"
+	}
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
@@ -0,0 +1,173 @@
+package requestlog
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entry is one proxied request as seen by the streaming handler.
+type Entry struct {
+	Time            time.Time     `json:"time"`
+	ClientIP        string        `json:"client_ip"`
+	Method          string        `json:"method"`
+	Domain          string        `json:"domain"`
+	URI             string        `json:"uri"`
+	Proto           string        `json:"proto"`
+	Status          int           `json:"status"`
+	Bytes           int64         `json:"bytes"`
+	Referer         string        `json:"referer"`
+	UserAgent       string        `json:"user_agent"`
+	Upstream        string        `json:"upstream"`
+	UpstreamLatency time.Duration `json:"-"`
+	Duration        time.Duration `json:"-"`
+	CacheStatus     string        `json:"cache_status"`
+}
+
+// Config selects the output format and where the lines go.
+type Config struct {
+	// Format is one of "common", "combined", "w3c" or "json". Empty disables logging.
+	Format string
+	// Outputs is a comma separated list of sinks: "stdout", "stderr" or a file
+	// path. Files are rotated by size.
+	Outputs string
+	// MaxSizeMB is the size at which a file sink is rotated.
+	MaxSizeMB int
+	// MaxBackups is how many rotated files are kept per sink.
+	MaxBackups int
+}
+
+// Logger writes formatted entries to one or more sinks.
+type Logger struct {
+	mu        sync.Mutex
+	formatter Formatter
+	sinks     []io.Writer
+	closers   []io.Closer
+}
+
+var (
+	defaultMu     sync.RWMutex
+	defaultLogger *Logger
+)
+
+// New builds a Logger from cfg. It returns nil, nil when logging is disabled.
+func New(cfg Config) (*Logger, error) {
+	if cfg.Format == "" || cfg.Format == "off" {
+		return nil, nil
+	}
+
+	formatter, err := NewFormatter(cfg.Format)
+	if err != nil {
+		return nil, err
+	}
+
+	outputs := cfg.Outputs
+	if strings.TrimSpace(outputs) == "" {
+		outputs = "stdout"
+	}
+
+	l := &Logger{formatter: formatter}
+	for _, out := range strings.Split(outputs, ",") {
+		out = strings.TrimSpace(out)
+		switch out {
+		case "":
+			continue
+		case "stdout":
+			l.sinks = append(l.sinks, os.Stdout)
+		case "stderr":
+			l.sinks = append(l.sinks, os.Stderr)
+		default:
+			f, err := NewRotatingFile(out, cfg.MaxSizeMB, cfg.MaxBackups, formatter.Header())
+			if err != nil {
+				l.Close()
+				return nil, err
+			}
+			l.sinks = append(l.sinks, f)
+			l.closers = append(l.closers, f)
+		}
+	}
+
+	// Cabeçalho W3C também é emitido uma vez nas saídas de console
+	if header := formatter.Header(); len(header) > 0 {
+		for _, sink := range l.sinks {
+			if sink == os.Stdout || sink == os.Stderr {
+				sink.Write(header)
+			}
+		}
+	}
+
+	return l, nil
+}
+
+// Log formats e and writes it to every sink.
+func (l *Logger) Log(e Entry) {
+	if l == nil {
+		return
+	}
+
+	line := l.formatter.Format(e)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, sink := range l.sinks {
+		if _, err := sink.Write(line); err != nil {
+			log.Printf("Request log: write failed: %v", err)
+		}
+	}
+}
+
+// Close closes every file sink.
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var firstErr error
+	for _, c := range l.closers {
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Setup configures the package-level logger used by Log.
+func Setup(cfg Config) error {
+	l, err := New(cfg)
+	if err != nil {
+		return fmt.Errorf("request log: %w", err)
+	}
+
+	defaultMu.Lock()
+	old := defaultLogger
+	defaultLogger = l
+	defaultMu.Unlock()
+
+	return old.Close()
+}
+
+// Log writes e to the package-level logger, if one is configured.
+func Log(e Entry) {
+	defaultMu.RLock()
+	l := defaultLogger
+	defaultMu.RUnlock()
+
+	l.Log(e)
+}
+
+// Close closes the package-level logger.
+func Close() error {
+	defaultMu.Lock()
+	l := defaultLogger
+	defaultLogger = nil
+	defaultMu.Unlock()
+
+	return l.Close()
+}
@@ -0,0 +1,148 @@
+package requestlog
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func sampleEntry() Entry {
+	return Entry{
+		Time:            time.Date(2025, 12, 14, 20, 15, 0, 0, time.FixedZone("BRT", -3*3600)),
+		ClientIP:        "177.12.34.56",
+		Method:          "GET",
+		Domain:          "power.cdnproxy.top",
+		URI:             "/live/stream.m3u8?token=abc",
+		Proto:           "HTTP/1.1",
+		Status:          200,
+		Bytes:           5120,
+		UserAgent:       "VLC/3.0.18 LibVLC/3.0.18",
+		Upstream:        "origin.example.com",
+		UpstreamLatency: 120 * time.Millisecond,
+		Duration:        250 * time.Millisecond,
+		CacheStatus:     "MISS",
+	}
+}
+
+func TestCombinedFormat(t *testing.T) {
+	f, _ := NewFormatter("combined")
+	got := string(f.Format(sampleEntry()))
+	want := `177.12.34.56 - - [14/Dec/2025:20:15:00 -0300] "GET /live/stream.m3u8?token=abc HTTP/1.1" 200 5120 "-" "VLC/3.0.18 LibVLC/3.0.18" "power.cdnproxy.top" "origin.example.com" 0.120 "MISS"` + "\n"
+	if got != want {
+		t.Errorf("combined:\n got %q\nwant %q", got, want)
+	}
+
+	common, _ := NewFormatter("common")
+	if line := string(common.Format(sampleEntry())); strings.Contains(line, "VLC") {
+		t.Errorf("common format must not include the user agent: %q", line)
+	}
+}
+
+func TestW3CFormat(t *testing.T) {
+	f, _ := NewFormatter("w3c")
+	if !strings.HasPrefix(string(f.Header()), "#Version: 1.0\n") {
+		t.Errorf("missing W3C header: %q", f.Header())
+	}
+
+	fields := strings.Fields(string(f.Format(sampleEntry())))
+	if len(fields) != len(w3cFields) {
+		t.Fatalf("expected %d fields, got %d: %v", len(w3cFields), len(fields), fields)
+	}
+	if fields[0] != "2025-12-14" || fields[1] != "23:15:00" {
+		t.Errorf("W3C date/time must be UTC, got %s %s", fields[0], fields[1])
+	}
+	if fields[5] != "/live/stream.m3u8" || fields[6] != "token=abc" {
+		t.Errorf("unexpected uri stem/query: %s %s", fields[5], fields[6])
+	}
+	if fields[10] != "VLC/3.0.18+LibVLC/3.0.18" {
+		t.Errorf("spaces must be encoded as '+', got %s", fields[10])
+	}
+}
+
+func TestFormatEscapesControlCharacters(t *testing.T) {
+	e := sampleEntry()
+	e.URI = "/live/a.m3u8?name=x\r\n1.2.3.4 - - [forged] \"GET / HTTP/1.1\" 200"
+	e.UserAgent = "agent\twith\x00nul\x7f\\"
+	e.Upstream = "origin.example.com\nforged"
+
+	for _, name := range []string{"combined", "w3c"} {
+		f, _ := NewFormatter(name)
+		line := string(f.Format(e))
+		if strings.Count(line, "\n") != 1 || !strings.HasSuffix(line, "\n") || strings.ContainsAny(line, "\r\t\x00\x7f") {
+			t.Errorf("%s: control characters must be escaped: %q", name, line)
+		}
+		for _, want := range []string{`x\x0d\x0a1.2.3.4`, `agent\x09with\x00nul\x7f\\`, `origin.example.com\x0aforged`} {
+			if !strings.Contains(line, want) {
+				t.Errorf("%s: expected %s in %q", name, want, line)
+			}
+		}
+	}
+
+	f, _ := NewFormatter("combined")
+	if line := string(f.Format(e)); !strings.Contains(line, `[forged] \"GET / HTTP/1.1\" 200`) {
+		t.Errorf("quotes must stay escaped: %q", line)
+	}
+	w3c, _ := NewFormatter("w3c")
+	if fields := strings.Fields(string(w3c.Format(e))); len(fields) != len(w3cFields) {
+		t.Errorf("expected %d W3C fields, got %d: %v", len(w3cFields), len(fields), fields)
+	}
+}
+
+func TestJSONFormat(t *testing.T) {
+	f, _ := NewFormatter("json")
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(f.Format(sampleEntry()), &decoded); err != nil {
+		t.Fatalf("invalid JSON line: %v", err)
+	}
+	for _, key := range []string{"domain", "upstream", "status", "bytes", "upstream_latency_ms", "cache_status"} {
+		if _, ok := decoded[key]; !ok {
+			t.Errorf("missing %q in JSON entry: %v", key, decoded)
+		}
+	}
+	if decoded["upstream_latency_ms"].(float64) != 120 {
+		t.Errorf("upstream_latency_ms = %v", decoded["upstream_latency_ms"])
+	}
+}
+
+func TestUnknownFormat(t *testing.T) {
+	if _, err := NewFormatter("xml"); err == nil {
+		t.Error("expected error for unknown format")
+	}
+	if l, err := New(Config{}); l != nil || err != nil {
+		t.Errorf("empty format must disable logging, got %v, %v", l, err)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+
+	l, err := New(Config{Format: "w3c", Outputs: path, MaxSizeMB: 1, MaxBackups: 2})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer l.Close()
+
+	rf := l.closers[0].(*RotatingFile)
+	rf.maxSize = 600 // força várias rotações
+
+	for i := 0; i < 20; i++ {
+		l.Log(sampleEntry())
+	}
+
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 2 {
+		t.Errorf("expected 2 backups to be kept, got %d", len(backups))
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "#Version: 1.0") {
+		t.Errorf("rotated file must start with the W3C header: %q", data)
+	}
+}
@@ -0,0 +1,348 @@
+// Package stripe implements payments.Provider with Stripe Checkout, for
+// customers paying by card in currencies other than BRL.
+package stripe
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"CDNProxy_v2/backend/services/payments"
+)
+
+// Name is the provider name, stored in payments.payment_method.
+const Name = "stripe"
+
+// BaseURL is the Stripe API root.
+const BaseURL = "https://api.stripe.com"
+
+// DefaultCurrency is charged when Config.Currency is empty.
+const DefaultCurrency = "USD"
+
+// Config configures a Provider.
+type Config struct {
+	Client *http.Client
+	// BaseURL is the API root; tests point it at a local server.
+	BaseURL string
+	// SecretKey is the API secret key (sk_live_... or sk_test_...).
+	SecretKey string
+	// WebhookSecret is the signing secret of the webhook endpoint (whsec_...).
+	WebhookSecret string
+	// Currency is the default checkout currency and Currencies every currency
+	// checkouts may use; Currency is always accepted.
+	Currency   string
+	Currencies []string
+}
+
+// Provider is the Stripe implementation of payments.Provider. Checkouts are
+// Checkout Sessions in payment mode, and the provider payment id is the
+// session's PaymentIntent, which also carries the local payment id in its
+// metadata.
+type Provider struct {
+	client        *http.Client
+	baseURL       string
+	secretKey     string
+	webhookSecret string
+	currency      string
+	currencies    []string
+	now           func() time.Time
+}
+
+var _ payments.MultiCurrencyProvider = (*Provider)(nil)
+
+// NewProvider returns a Stripe provider for cfg.
+func NewProvider(cfg Config) *Provider {
+	p := &Provider{
+		client:        cfg.Client,
+		baseURL:       cfg.BaseURL,
+		secretKey:     cfg.SecretKey,
+		webhookSecret: cfg.WebhookSecret,
+		currency:      strings.ToUpper(cfg.Currency),
+		now:           time.Now,
+	}
+	if p.client == nil {
+		p.client = &http.Client{Timeout: 30 * time.Second}
+	}
+	if p.baseURL == "" {
+		p.baseURL = BaseURL
+	}
+	if p.currency == "" {
+		p.currency = DefaultCurrency
+	}
+	p.currencies = []string{p.currency}
+	for _, c := range cfg.Currencies {
+		c = strings.ToUpper(strings.TrimSpace(c))
+		if c != "" && c != p.currency {
+			p.currencies = append(p.currencies, c)
+		}
+	}
+	return p
+}
+
+func (p *Provider) Name() string { return Name }
+
+func (p *Provider) Currency() string { return p.currency }
+
+func (p *Provider) Currencies() []string { return p.currencies }
+
+// metadataKey holds the local payment id in sessions and PaymentIntents.
+const metadataKey = "payment_id"
+
+func (p *Provider) CreateCheckout(ctx context.Context, req *payments.CheckoutRequest) (*payments.CheckoutSession, error) {
+	currency := req.Currency
+	if currency == "" {
+		currency = p.currency
+	}
+	form := url.Values{}
+	form.Set("mode", "payment")
+	form.Set("success_url", req.SuccessURL)
+	form.Set("cancel_url", req.FailureURL)
+	form.Set("client_reference_id", req.ExternalReference)
+	form.Set("metadata["+metadataKey+"]", req.ExternalReference)
+	form.Set("payment_intent_data[metadata]["+metadataKey+"]", req.ExternalReference)
+	if req.Payer.Email != "" {
+		form.Set("customer_email", req.Payer.Email)
+	}
+	for i, item := range req.Items {
+		prefix := fmt.Sprintf("line_items[%d]", i)
+		form.Set(prefix+"[quantity]", strconv.Itoa(item.Quantity))
+		form.Set(prefix+"[price_data][currency]", strings.ToLower(currency))
+		form.Set(prefix+"[price_data][unit_amount]", strconv.FormatInt(toMinor(item.UnitPrice, currency), 10))
+		form.Set(prefix+"[price_data][product_data][name]", item.Title)
+	}
+
+	var session struct {
+		ID  string `json:"id"`
+		URL string `json:"url"`
+	}
+	if err := p.call(ctx, "POST", "/v1/checkout/sessions", form, &session); err != nil {
+		return nil, err
+	}
+	return &payments.CheckoutSession{ID: session.ID, URL: session.URL}, nil
+}
+
+// paymentIntent is a PaymentIntent with latest_charge expanded.
+type paymentIntent struct {
+	ID               string            `json:"id"`
+	Status           string            `json:"status"`
+	Amount           int64             `json:"amount"`
+	AmountReceived   int64             `json:"amount_received"`
+	Currency         string            `json:"currency"`
+	Created          int64             `json:"created"`
+	Metadata         map[string]string `json:"metadata"`
+	LastPaymentError *struct {
+		Message string `json:"message"`
+	} `json:"last_payment_error"`
+	LatestCharge *struct {
+		Refunded       bool  `json:"refunded"`
+		AmountRefunded int64 `json:"amount_refunded"`
+	} `json:"latest_charge"`
+}
+
+func (p *Provider) GetPayment(ctx context.Context, id string) (*payments.Payment, error) {
+	q := url.Values{"expand[]": {"latest_charge"}}
+	var pi paymentIntent
+	if err := p.call(ctx, "GET", "/v1/payment_intents/"+url.PathEscape(id), q, &pi); err != nil {
+		return nil, err
+	}
+	return toPayment(&pi), nil
+}
+
+// FindPayment searches the PaymentIntents by the local payment id in their
+// metadata. Search results may lag a few seconds behind the payment.
+func (p *Provider) FindPayment(ctx context.Context, externalRef string) (*payments.Payment, error) {
+	q := url.Values{
+		"query":    {fmt.Sprintf("metadata['%s']:'%s'", metadataKey, strings.ReplaceAll(externalRef, "'", ""))},
+		"expand[]": {"data.latest_charge"},
+	}
+	var result struct {
+		Data []paymentIntent `json:"data"`
+	}
+	if err := p.call(ctx, "GET", "/v1/payment_intents/search", q, &result); err != nil {
+		return nil, err
+	}
+	var latest *paymentIntent
+	for i := range result.Data {
+		if latest == nil || result.Data[i].Created > latest.Created {
+			latest = &result.Data[i]
+		}
+	}
+	if latest == nil {
+		return nil, nil
+	}
+	return toPayment(latest), nil
+}
+
+func (p *Provider) Refund(ctx context.Context, paymentID string, amount float64) (*payments.Refund, error) {
+	form := url.Values{"payment_intent": {paymentID}}
+	if amount > 0 {
+		pi, err := p.GetPayment(ctx, paymentID)
+		if err != nil {
+			return nil, err
+		}
+		form.Set("amount", strconv.FormatInt(toMinor(amount, pi.Currency), 10))
+	}
+	var refund struct {
+		ID       string `json:"id"`
+		Amount   int64  `json:"amount"`
+		Currency string `json:"currency"`
+		Status   string `json:"status"`
+	}
+	if err := p.call(ctx, "POST", "/v1/refunds", form, &refund); err != nil {
+		return nil, err
+	}
+	return &payments.Refund{
+		ID:        refund.ID,
+		PaymentID: paymentID,
+		Amount:    fromMinor(refund.Amount, refund.Currency),
+		Status:    refund.Status,
+	}, nil
+}
+
+// paymentEvents are the event types reported under payments.TopicPayment;
+// each carries the PaymentIntent in data.object.payment_intent.
+var paymentEvents = map[string]bool{
+	"checkout.session.completed":               true,
+	"checkout.session.async_payment_succeeded": true,
+	"checkout.session.async_payment_failed":    true,
+	"charge.refunded":                          true,
+}
+
+// ParseWebhook reads a Stripe event and verifies its Stripe-Signature. The
+// event id is used as the request id.
+func (p *Provider) ParseWebhook(r *http.Request, body []byte) (*payments.WebhookEvent, error) {
+	ev := &payments.WebhookEvent{}
+	var payload struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+		Data struct {
+			Object struct {
+				ID            string          `json:"id"`
+				PaymentIntent json.RawMessage `json:"payment_intent"`
+			} `json:"object"`
+		} `json:"data"`
+	}
+	if json.Unmarshal(body, &payload) == nil {
+		ev.RequestID, ev.Topic, ev.ResourceID = payload.ID, payload.Type, payload.Data.Object.ID
+		if paymentEvents[payload.Type] {
+			// null until the session has a PaymentIntent
+			var pi string
+			json.Unmarshal(payload.Data.Object.PaymentIntent, &pi)
+			ev.Topic, ev.ResourceID = payments.TopicPayment, pi
+		}
+	}
+	if err := VerifySignature(p.webhookSecret, r.Header.Get("Stripe-Signature"), body, p.now()); err != nil {
+		return ev, fmt.Errorf("stripe: %w", err)
+	}
+	return ev, nil
+}
+
+// call sends form as the body of POST requests and as the query of GET
+// requests, and decodes the JSON response into out.
+func (p *Provider) call(ctx context.Context, method, path string, form url.Values, out interface{}) error {
+	if p.secretKey == "" {
+		return fmt.Errorf("stripe secret key not configured")
+	}
+	target := p.baseURL + path
+	var body *strings.Reader
+	if method == "GET" {
+		if len(form) > 0 {
+			target += "?" + form.Encode()
+		}
+		body = strings.NewReader("")
+	} else {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.secretKey)
+	if method != "GET" {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var errResp struct {
+			Error struct {
+				Type    string `json:"type"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&errResp)
+		return fmt.Errorf("stripe api error: %d - %s: %s", resp.StatusCode, errResp.Error.Type, errResp.Error.Message)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// toPayment maps a PaymentIntent onto the payment statuses.
+func toPayment(pi *paymentIntent) *payments.Payment {
+	payment := &payments.Payment{
+		ID:                pi.ID,
+		ExternalReference: pi.Metadata[metadataKey],
+		Amount:            fromMinor(pi.Amount, pi.Currency),
+		Currency:          strings.ToUpper(pi.Currency),
+		StatusDetail:      pi.Status,
+	}
+	switch pi.Status {
+	case "succeeded":
+		payment.Status = payments.StatusApproved
+		payment.Amount = fromMinor(pi.AmountReceived, pi.Currency)
+		if pi.LatestCharge != nil && pi.LatestCharge.Refunded {
+			payment.Status = payments.StatusRefunded
+		}
+	case "processing":
+		payment.Status = payments.StatusInProcess
+	case "requires_capture":
+		payment.Status = payments.StatusAuthorized
+	case "canceled":
+		payment.Status = payments.StatusCancelled
+	case "requires_payment_method":
+		// A failed attempt sends the intent back here
+		payment.Status = payments.StatusPending
+		if pi.LastPaymentError != nil {
+			payment.Status = payments.StatusRejected
+			payment.StatusDetail = pi.LastPaymentError.Message
+		}
+	default:
+		payment.Status = payments.StatusPending
+	}
+	return payment
+}
+
+// Stripe amounts are integers in the currency's minor unit; these currencies
+// have none or three decimal places instead of two.
+var (
+	zeroDecimal  = map[string]bool{"BIF": true, "CLP": true, "DJF": true, "GNF": true, "JPY": true, "KMF": true, "KRW": true, "MGA": true, "PYG": true, "RWF": true, "UGX": true, "VND": true, "VUV": true, "XAF": true, "XOF": true, "XPF": true}
+	threeDecimal = map[string]bool{"BHD": true, "JOD": true, "KWD": true, "OMR": true, "TND": true}
+)
+
+func minorFactor(currency string) float64 {
+	currency = strings.ToUpper(currency)
+	switch {
+	case zeroDecimal[currency]:
+		return 1
+	case threeDecimal[currency]:
+		return 1000
+	}
+	return 100
+}
+
+func toMinor(amount float64, currency string) int64 {
+	return int64(math.Round(amount * minorFactor(currency)))
+}
+
+func fromMinor(amount int64, currency string) float64 {
+	return float64(amount) / minorFactor(currency)
+}
@@ -0,0 +1,216 @@
+package stripe
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"CDNProxy_v2/backend/services/payments"
+)
+
+// fakeAPI answers the Stripe endpoints used by Provider and records the last
+// request form.
+type fakeAPI struct {
+	lastPath string
+	lastForm url.Values
+	intents  map[string]string
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer sk_test" {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error":{"type":"invalid_request_error","message":"Invalid API Key"}}`))
+		return
+	}
+	r.ParseForm()
+	f.lastPath, f.lastForm = r.URL.Path, r.Form
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/v1/checkout/sessions":
+		w.Write([]byte(`{"id":"cs_test_1","url":"https://checkout.stripe.test/c/cs_test_1"}`))
+	case r.Method == "GET" && r.URL.Path == "/v1/payment_intents/search":
+		w.Write([]byte(`{"data":[` + strings.Join([]string{f.intents["pi_old"], f.intents["pi_1"]}, ",") + `]}`))
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/v1/payment_intents/"):
+		pi, ok := f.intents[strings.TrimPrefix(r.URL.Path, "/v1/payment_intents/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":{"type":"invalid_request_error","message":"No such payment_intent"}}`))
+			return
+		}
+		w.Write([]byte(pi))
+	case r.Method == "POST" && r.URL.Path == "/v1/refunds":
+		amount := r.Form.Get("amount")
+		if amount == "" {
+			amount = "4900"
+		}
+		w.Write([]byte(`{"id":"re_1","amount":` + amount + `,"currency":"usd","status":"succeeded"}`))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newTestProvider(t *testing.T, cfg Config) (*Provider, *fakeAPI) {
+	t.Helper()
+	api := &fakeAPI{intents: map[string]string{
+		"pi_1":   `{"id":"pi_1","status":"succeeded","amount":4900,"amount_received":4900,"currency":"usd","created":200,"metadata":{"payment_id":"12"},"latest_charge":{"refunded":false}}`,
+		"pi_old": `{"id":"pi_old","status":"canceled","amount":4900,"currency":"usd","created":100,"metadata":{"payment_id":"12"}}`,
+		"pi_jpy": `{"id":"pi_jpy","status":"succeeded","amount":5000,"amount_received":5000,"currency":"jpy","metadata":{"payment_id":"13"},"latest_charge":{"refunded":true,"amount_refunded":5000}}`,
+		"pi_fail": `{"id":"pi_fail","status":"requires_payment_method","amount":4900,"currency":"usd","metadata":{"payment_id":"14"},` +
+			`"last_payment_error":{"message":"Your card was declined."}}`,
+	}}
+	srv := httptest.NewServer(api)
+	t.Cleanup(srv.Close)
+	cfg.Client, cfg.BaseURL, cfg.SecretKey = srv.Client(), srv.URL, "sk_test"
+	return NewProvider(cfg), api
+}
+
+func TestProviderCurrencies(t *testing.T) {
+	p := NewProvider(Config{Currency: "eur", Currencies: []string{"usd", "EUR", " gbp "}})
+	if p.Currency() != "EUR" {
+		t.Errorf("Currency = %s, want EUR", p.Currency())
+	}
+	if got := strings.Join(p.Currencies(), ","); got != "EUR,USD,GBP" {
+		t.Errorf("Currencies = %s", got)
+	}
+	if NewProvider(Config{}).Currency() != DefaultCurrency {
+		t.Errorf("default currency is not %s", DefaultCurrency)
+	}
+}
+
+func TestProviderCreateCheckout(t *testing.T) {
+	p, api := newTestProvider(t, Config{})
+	session, err := p.CreateCheckout(context.Background(), &payments.CheckoutRequest{
+		ExternalReference: "12",
+		Currency:          "EUR",
+		Payer:             payments.Payer{Email: "client@example.com"},
+		SuccessURL:        "https://app.test/ok",
+		FailureURL:        "https://app.test/fail",
+		Items: []payments.LineItem{
+			{ID: "ITEM-1", Title: "renewal", Quantity: 1, UnitPrice: 19.99},
+			{ID: "ITEM-2", Title: "renewal", Quantity: 2, UnitPrice: 5},
+		},
+	})
+	if err != nil {
+		t.Fatalf("CreateCheckout: %v", err)
+	}
+	if session.ID != "cs_test_1" || session.URL != "https://checkout.stripe.test/c/cs_test_1" {
+		t.Errorf("session = %+v", session)
+	}
+	want := map[string]string{
+		"mode":                 "payment",
+		"client_reference_id":  "12",
+		"metadata[payment_id]": "12",
+		"payment_intent_data[metadata][payment_id]": "12",
+		"customer_email":                         "client@example.com",
+		"cancel_url":                             "https://app.test/fail",
+		"line_items[0][price_data][currency]":    "eur",
+		"line_items[0][price_data][unit_amount]": "1999",
+		"line_items[1][price_data][unit_amount]": "500",
+		"line_items[1][quantity]":                "2",
+	}
+	for k, v := range want {
+		if got := api.lastForm.Get(k); got != v {
+			t.Errorf("%s = %q, want %q", k, got, v)
+		}
+	}
+}
+
+func TestProviderPayments(t *testing.T) {
+	p, api := newTestProvider(t, Config{})
+	ctx := context.Background()
+
+	tests := []struct {
+		id     string
+		status string
+		amount float64
+		ref    string
+	}{
+		{"pi_1", payments.StatusApproved, 49, "12"},
+		{"pi_jpy", payments.StatusRefunded, 5000, "13"},
+		{"pi_fail", payments.StatusRejected, 49, "14"},
+	}
+	for _, tt := range tests {
+		got, err := p.GetPayment(ctx, tt.id)
+		if err != nil {
+			t.Fatalf("GetPayment(%s): %v", tt.id, err)
+		}
+		if got.ID != tt.id || got.Status != tt.status || got.Amount != tt.amount || got.ExternalReference != tt.ref {
+			t.Errorf("GetPayment(%s) = %+v", tt.id, got)
+		}
+	}
+	if api.lastForm.Get("expand[]") != "latest_charge" {
+		t.Errorf("latest_charge not expanded: %v", api.lastForm)
+	}
+	if _, err := p.GetPayment(ctx, "pi_missing"); err == nil || !strings.Contains(err.Error(), "No such payment_intent") {
+		t.Errorf("GetPayment of a missing intent = %v", err)
+	}
+
+	found, err := p.FindPayment(ctx, "12")
+	if err != nil || found == nil || found.ID != "pi_1" || found.Currency != "USD" {
+		t.Errorf("FindPayment = %+v, %v; want the latest intent pi_1", found, err)
+	}
+	if q := api.lastForm.Get("query"); q != "metadata['payment_id']:'12'" {
+		t.Errorf("search query = %q", q)
+	}
+
+	refund, err := p.Refund(ctx, "pi_1", 20)
+	if err != nil || refund.Amount != 20 || refund.ID != "re_1" || api.lastForm.Get("amount") != "2000" || api.lastForm.Get("payment_intent") != "pi_1" {
+		t.Errorf("partial Refund = %+v, %v (form %v)", refund, err, api.lastForm)
+	}
+	refund, err = p.Refund(ctx, "pi_1", 0)
+	if err != nil || refund.Amount != 49 || api.lastForm.Has("amount") {
+		t.Errorf("full Refund = %+v, %v (form %v)", refund, err, api.lastForm)
+	}
+
+	unauthorized := NewProvider(Config{Client: p.client, BaseURL: p.baseURL, SecretKey: "sk_wrong"})
+	if _, err := unauthorized.GetPayment(ctx, "pi_1"); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("GetPayment with a wrong key = %v", err)
+	}
+}
+
+func TestProviderParseWebhook(t *testing.T) {
+	const secret = "whsec_test"
+	now := time.Unix(1704908010, 0)
+	event := func(typ, object string) string {
+		b, _ := json.Marshal(map[string]interface{}{"id": "evt_1", "type": typ, "data": map[string]json.RawMessage{"object": json.RawMessage(object)}})
+		return string(b)
+	}
+
+	tests := []struct {
+		name      string
+		body      string
+		signature bool
+		topic     string
+		resource  string
+		wantErr   error
+	}{
+		{"completed session", event("checkout.session.completed", `{"id":"cs_1","payment_intent":"pi_1"}`), true, payments.TopicPayment, "pi_1", nil},
+		{"async payment failed", event("checkout.session.async_payment_failed", `{"id":"cs_1","payment_intent":"pi_1"}`), true, payments.TopicPayment, "pi_1", nil},
+		{"refunded charge", event("charge.refunded", `{"id":"ch_1","payment_intent":"pi_1"}`), true, payments.TopicPayment, "pi_1", nil},
+		{"session without intent", event("checkout.session.completed", `{"id":"cs_1","payment_intent":null}`), true, payments.TopicPayment, "", nil},
+		{"other event", event("customer.created", `{"id":"cus_1"}`), true, "customer.created", "cus_1", nil},
+		{"unsigned", event("checkout.session.completed", `{"id":"cs_1","payment_intent":"pi_1"}`), false, payments.TopicPayment, "pi_1", payments.ErrSignatureMissing},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewProvider(Config{WebhookSecret: secret})
+			p.now = func() time.Time { return now }
+			r := httptest.NewRequest("POST", "/api/webhook/stripe", strings.NewReader(tt.body))
+			if tt.signature {
+				r.Header.Set("Stripe-Signature", "t=1704908010,v1="+sign(secret, now.Unix(), tt.body))
+			}
+			ev, err := p.ParseWebhook(r, []byte(tt.body))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if ev.Topic != tt.topic || ev.ResourceID != tt.resource || ev.RequestID != "evt_1" {
+				t.Errorf("event = %+v, want topic %q resource %q", ev, tt.topic, tt.resource)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package stripe
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+
+	"CDNProxy_v2/backend/services/payments"
+)
+
+// SignatureTolerance is how old a signed webhook may be; older requests are
+// treated as replays.
+const SignatureTolerance = 5 * time.Minute
+
+// VerifySignature checks the Stripe-Signature header ("t=...,v1=...,v1=...")
+// of a webhook: one of the v1 values must be the hex HMAC-SHA256, keyed with
+// the endpoint secret, of "<t>.<body>", and t must be within
+// SignatureTolerance of now.
+func VerifySignature(secret, header string, body []byte, now time.Time) error {
+	if secret == "" {
+		return payments.ErrSecretNotConfigured
+	}
+	var (
+		ts         string
+		signatures []string
+	)
+	for _, part := range strings.Split(header, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		switch k {
+		case "t":
+			ts = v
+		case "v1":
+			signatures = append(signatures, v)
+		}
+	}
+	if ts == "" || len(signatures) == 0 {
+		return payments.ErrSignatureMissing
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return payments.ErrInvalidSignature
+	}
+	if age := now.Sub(time.Unix(unix, 0)); age > SignatureTolerance || age < -SignatureTolerance {
+		return payments.ErrInvalidSignature
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	expected := mac.Sum(nil)
+	for _, sig := range signatures {
+		if got, err := hex.DecodeString(sig); err == nil && hmac.Equal(got, expected) {
+			return nil
+		}
+	}
+	return payments.ErrInvalidSignature
+}
@@ -0,0 +1,64 @@
+package stripe
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"CDNProxy_v2/backend/services/payments"
+)
+
+func sign(secret string, ts int64, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(ts, 10) + "." + body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifySignature(t *testing.T) {
+	const (
+		secret = "whsec_test"
+		body   = `{"id":"evt_1"}`
+	)
+	now := time.Unix(1704908010, 0)
+	ts := now.Unix()
+	header := func(ts int64, sigs ...string) string {
+		h := "t=" + strconv.FormatInt(ts, 10)
+		for _, s := range sigs {
+			h += ",v1=" + s
+		}
+		return h
+	}
+
+	tests := []struct {
+		name   string
+		secret string
+		header string
+		body   string
+		want   error
+	}{
+		{"valid", secret, header(ts, sign(secret, ts, body)), body, nil},
+		{"one of several v1 matches", secret, header(ts, sign("old", ts, body), sign(secret, ts, body)), body, nil},
+		{"v0 is ignored", secret, header(ts, sign(secret, ts, body)) + ",v0=abc", body, nil},
+		{"within tolerance", secret, header(ts-240, sign(secret, ts-240, body)), body, nil},
+		{"too old", secret, header(ts-600, sign(secret, ts-600, body)), body, payments.ErrInvalidSignature},
+		{"from the future", secret, header(ts+600, sign(secret, ts+600, body)), body, payments.ErrInvalidSignature},
+		{"other body", secret, header(ts, sign(secret, ts, body)), `{"id":"evt_2"}`, payments.ErrInvalidSignature},
+		{"wrong secret", "other", header(ts, sign(secret, ts, body)), body, payments.ErrInvalidSignature},
+		{"not hex", secret, header(ts, "zz"), body, payments.ErrInvalidSignature},
+		{"bad timestamp", secret, "t=abc,v1=" + sign(secret, ts, body), body, payments.ErrInvalidSignature},
+		{"missing header", secret, "", body, payments.ErrSignatureMissing},
+		{"missing v1", secret, header(ts), body, payments.ErrSignatureMissing},
+		{"no secret", "", header(ts, sign(secret, ts, body)), body, payments.ErrSecretNotConfigured},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := VerifySignature(tt.secret, tt.header, []byte(tt.body), now); !errors.Is(err, tt.want) {
+				t.Errorf("VerifySignature = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
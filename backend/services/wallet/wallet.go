@@ -0,0 +1,322 @@
+// Package wallet keeps the prepaid balance of each account: a ledger of
+// credits and debits in the base currency, with the balance after each
+// entry. Payments credit it (top-ups), checkouts and automatic renewals
+// debit it, and superadmins adjust it by hand.
+package wallet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"CDNProxy_v2/backend/database"
+	"CDNProxy_v2/backend/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Reasons of the ledger entries (wallet_entries.reason).
+const (
+	// ReasonTopUp credits an approved top-up payment.
+	ReasonTopUp = "top_up"
+	// ReasonAdjustment is a manual credit or debit by a superadmin.
+	ReasonAdjustment = "adjustment"
+	// ReasonCheckout debits the part of a checkout paid from the balance.
+	ReasonCheckout = "checkout"
+	// ReasonReversal gives back the balance taken by a checkout that was not
+	// paid.
+	ReasonReversal = "reversal"
+	// ReasonRefund gives back the balance taken by a checkout whose payment
+	// was refunded or charged back after it was fulfilled.
+	ReasonRefund = "refund"
+	// ReasonRenewal debits an automatic domain renewal.
+	ReasonRenewal = "renewal"
+	// ReasonTopUpReversal takes back a top-up whose payment was refunded or
+	// charged back.
+	ReasonTopUpReversal = "top_up_reversal"
+)
+
+// Currency is the currency of every wallet.
+const Currency = models.BaseCurrency
+
+// Limits of a single top-up.
+const (
+	MinTopUp = 1.0
+	MaxTopUp = 50000.0
+)
+
+// Page sizes of Statement.
+const (
+	DefaultLimit = 50
+	MaxLimit     = 500
+)
+
+var (
+	ErrInsufficientFunds = errors.New("insufficient wallet balance")
+	ErrInvalidAmount     = errors.New("amount must be non-zero, with at most 2 decimal places")
+	ErrInvalidTopUp      = fmt.Errorf("top-up amount must be between %.2f and %.2f, with at most 2 decimal places", MinTopUp, MaxTopUp)
+)
+
+// Wallet is the balance of an account. Accounts that never used the wallet
+// have an empty one.
+type Wallet struct {
+	UserID    int64      `json:"user_id"`
+	Balance   float64    `json:"balance"`
+	Currency  string     `json:"currency"`
+	AutoRenew bool       `json:"auto_renew"`
+	UpdatedAt *time.Time `json:"updated_at"`
+}
+
+// Entry is a ledger entry: a credit (Amount > 0) or a debit (Amount < 0),
+// with the balance right after it. Reference points at what caused it
+// (payment:<id>); CreatedBy is the superadmin of manual adjustments.
+type Entry struct {
+	ID          int64     `json:"id"`
+	UserID      int64     `json:"user_id"`
+	Amount      float64   `json:"amount"`
+	Balance     float64   `json:"balance"`
+	Reason      string    `json:"reason"`
+	Reference   *string   `json:"reference"`
+	Description *string   `json:"description"`
+	CreatedBy   *int64    `json:"created_by"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Page is a page of the statement, newest entries first. NextBeforeID is the
+// before_id of the next page, when there is one.
+type Page struct {
+	Items        []Entry `json:"items"`
+	NextBeforeID int64   `json:"next_before_id,omitempty"`
+}
+
+// PaymentReference is the reference of the entries caused by a payment.
+func PaymentReference(paymentID int64) string {
+	return "payment:" + strconv.FormatInt(paymentID, 10)
+}
+
+// ValidAmount reports whether amount is a non-zero amount of cents.
+func ValidAmount(amount float64) bool {
+	if amount == 0 || math.IsNaN(amount) || math.IsInf(amount, 0) {
+		return false
+	}
+	return math.Abs(amount*100-math.Round(amount*100)) < 1e-6
+}
+
+// ValidTopUp reports whether amount can be topped up at once.
+func ValidTopUp(amount float64) bool {
+	return ValidAmount(amount) && amount >= MinTopUp && amount <= MaxTopUp
+}
+
+// NextBalance returns the balance after adding amount to balance, or
+// ErrInsufficientFunds when a debit would make it negative.
+func NextBalance(balance, amount float64) (float64, error) {
+	next := math.Round((balance+amount)*100) / 100
+	if next < 0 {
+		return balance, ErrInsufficientFunds
+	}
+	return next, nil
+}
+
+// Lock creates the wallet of userID when needed, locks it until tx ends and
+// returns its balance. Every entry is posted under this lock.
+func Lock(ctx context.Context, tx pgx.Tx, userID int64) (float64, error) {
+	if _, err := tx.Exec(ctx, "INSERT INTO public.wallets (user_id) VALUES ($1) ON CONFLICT (user_id) DO NOTHING", userID); err != nil {
+		return 0, err
+	}
+	var balance float64
+	err := tx.QueryRow(ctx, "SELECT balance::float8 FROM public.wallets WHERE user_id = $1 FOR UPDATE", userID).Scan(&balance)
+	return balance, err
+}
+
+// Post records e in the ledger of e.UserID inside tx and updates the
+// balance, filling in e.ID, e.Balance and e.CreatedAt. A debit larger than
+// the balance fails with ErrInsufficientFunds.
+func Post(ctx context.Context, tx pgx.Tx, e *Entry) error {
+	if !ValidAmount(e.Amount) {
+		return ErrInvalidAmount
+	}
+	balance, err := Lock(ctx, tx, e.UserID)
+	if err != nil {
+		return err
+	}
+	next, err := NextBalance(balance, e.Amount)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, "UPDATE public.wallets SET balance = $2, updated_at = NOW() WHERE user_id = $1", e.UserID, next); err != nil {
+		return err
+	}
+	e.Balance = next
+	return tx.QueryRow(ctx, `
+		INSERT INTO public.wallet_entries (user_id, amount, balance, reason, reference, description, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id, created_at`,
+		e.UserID, e.Amount, e.Balance, e.Reason, e.Reference, e.Description, e.CreatedBy,
+	).Scan(&e.ID, &e.CreatedAt)
+}
+
+// Hold debits amount from the wallet of userID for the checkout of payment
+// paymentID and records it as the wallet part of the payment.
+func Hold(ctx context.Context, tx pgx.Tx, userID, paymentID int64, amount float64) error {
+	ref := PaymentReference(paymentID)
+	description := fmt.Sprintf("Saldo usado no pagamento #%d", paymentID)
+	if err := Post(ctx, tx, &Entry{UserID: userID, Amount: -amount, Reason: ReasonCheckout, Reference: &ref, Description: &description}); err != nil {
+		return err
+	}
+	_, err := tx.Exec(ctx,
+		"UPDATE public.payments SET wallet_amount = $2, wallet_released_at = NULL, updated_at = NOW() WHERE id = $1",
+		paymentID, amount)
+	return err
+}
+
+// Release gives back the wallet part of payment paymentID when the payment
+// was not approved. It does nothing once the payment was fulfilled or its
+// wallet part already released, so it is safe to call more than once.
+func Release(ctx context.Context, tx pgx.Tx, paymentID int64) error {
+	return giveBack(ctx, tx, paymentID, false)
+}
+
+// Refund gives back the wallet part of the fulfilled payment paymentID when
+// it is refunded or charged back. It does nothing for payments that were not
+// fulfilled (Release covers those) or whose wallet part was already given
+// back, so it is safe to call more than once.
+func Refund(ctx context.Context, tx pgx.Tx, paymentID int64) error {
+	return giveBack(ctx, tx, paymentID, true)
+}
+
+// returnable returns how much of a wallet part of amount goes back to the
+// wallet: by a refund only once the payment was fulfilled, by a release only
+// while it was not, and never twice.
+func returnable(amount float64, fulfilled, released, refund bool) float64 {
+	if amount <= 0 || released || fulfilled != refund {
+		return 0
+	}
+	return amount
+}
+
+func giveBack(ctx context.Context, tx pgx.Tx, paymentID int64, refund bool) error {
+	var (
+		userID      int64
+		amount      float64
+		fulfilledAt *time.Time
+		releasedAt  *time.Time
+	)
+	err := tx.QueryRow(ctx,
+		"SELECT user_id, wallet_amount::float8, fulfilled_at, wallet_released_at FROM public.payments WHERE id = $1 FOR UPDATE",
+		paymentID).Scan(&userID, &amount, &fulfilledAt, &releasedAt)
+	if err != nil {
+		return err
+	}
+	amount = returnable(amount, fulfilledAt != nil, releasedAt != nil, refund)
+	if amount == 0 {
+		return nil
+	}
+	ref := PaymentReference(paymentID)
+	reason := ReasonReversal
+	description := fmt.Sprintf("Devolução do saldo do pagamento #%d, não aprovado", paymentID)
+	if refund {
+		reason = ReasonRefund
+		description = fmt.Sprintf("Devolução do saldo do pagamento #%d, reembolsado", paymentID)
+	}
+	if err := Post(ctx, tx, &Entry{UserID: userID, Amount: amount, Reason: reason, Reference: &ref, Description: &description}); err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, "UPDATE public.payments SET wallet_released_at = NOW() WHERE id = $1", paymentID)
+	return err
+}
+
+// Retake debits again the wallet part of payment paymentID after it was
+// released, for payments the provider approves late (such as a PIX charge
+// paid after it expired). It fails with ErrInsufficientFunds when the
+// balance no longer covers it.
+func Retake(ctx context.Context, tx pgx.Tx, paymentID int64) error {
+	var (
+		userID     int64
+		amount     float64
+		releasedAt *time.Time
+	)
+	err := tx.QueryRow(ctx,
+		"SELECT user_id, wallet_amount::float8, wallet_released_at FROM public.payments WHERE id = $1 FOR UPDATE",
+		paymentID).Scan(&userID, &amount, &releasedAt)
+	if err != nil {
+		return err
+	}
+	if amount <= 0 || releasedAt == nil {
+		return nil
+	}
+	return Hold(ctx, tx, userID, paymentID, amount)
+}
+
+// Get returns the wallet of userID.
+func Get(ctx context.Context, userID int64) (*Wallet, error) {
+	w := &Wallet{UserID: userID, Currency: Currency}
+	err := database.DB.QueryRow(ctx,
+		"SELECT balance::float8, auto_renew, updated_at FROM public.wallets WHERE user_id = $1", userID,
+	).Scan(&w.Balance, &w.AutoRenew, &w.UpdatedAt)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return nil, err
+	}
+	return w, nil
+}
+
+// SetAutoRenew turns automatic renewals from the wallet of userID on or off.
+func SetAutoRenew(ctx context.Context, userID int64, enabled bool) (*Wallet, error) {
+	w := &Wallet{UserID: userID, Currency: Currency}
+	err := database.DB.QueryRow(ctx, `
+		INSERT INTO public.wallets (user_id, auto_renew) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET auto_renew = EXCLUDED.auto_renew, updated_at = NOW()
+		RETURNING balance::float8, auto_renew, updated_at`, userID, enabled,
+	).Scan(&w.Balance, &w.AutoRenew, &w.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Statement returns up to limit entries of the ledger of userID older than
+// beforeID (all when zero), newest first.
+func Statement(ctx context.Context, userID, beforeID int64, limit int) (*Page, error) {
+	rows, err := database.DB.Query(ctx, `
+		SELECT id, user_id, amount::float8, balance::float8, reason, reference, description, created_by, created_at
+		FROM public.wallet_entries
+		WHERE user_id = $1 AND ($2::bigint = 0 OR id < $2)
+		ORDER BY id DESC LIMIT $3`, userID, beforeID, limit+1)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	page := &Page{Items: []Entry{}}
+	for rows.Next() {
+		var e Entry
+		if err := rows.Scan(&e.ID, &e.UserID, &e.Amount, &e.Balance, &e.Reason, &e.Reference, &e.Description, &e.CreatedBy, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		page.Items = append(page.Items, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(page.Items) > limit {
+		page.Items = page.Items[:limit]
+		page.NextBeforeID = page.Items[limit-1].ID
+	}
+	return page, nil
+}
+
+// Adjust records a manual credit (amount > 0) or debit (amount < 0) by the
+// superadmin createdBy.
+func Adjust(ctx context.Context, userID int64, amount float64, description string, createdBy int64) (*Entry, error) {
+	tx, err := database.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	e := &Entry{UserID: userID, Amount: amount, Reason: ReasonAdjustment, Description: &description, CreatedBy: &createdBy}
+	if err := Post(ctx, tx, e); err != nil {
+		return nil, err
+	}
+	return e, tx.Commit(ctx)
+}
@@ -0,0 +1,108 @@
+package wallet
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestValidAmount(t *testing.T) {
+	tests := []struct {
+		amount float64
+		want   bool
+	}{
+		{10, true},
+		{-10, true},
+		{0.01, true},
+		{19.99, true},
+		{-0.1, true},
+		{0, false},
+		{10.005, false},
+		{math.NaN(), false},
+		{math.Inf(1), false},
+	}
+	for _, tt := range tests {
+		if got := ValidAmount(tt.amount); got != tt.want {
+			t.Errorf("ValidAmount(%v) = %v, want %v", tt.amount, got, tt.want)
+		}
+	}
+}
+
+func TestValidTopUp(t *testing.T) {
+	tests := []struct {
+		amount float64
+		want   bool
+	}{
+		{MinTopUp, true},
+		{MaxTopUp, true},
+		{150.5, true},
+		{0.99, false},
+		{MaxTopUp + 0.01, false},
+		{-10, false},
+		{10.001, false},
+	}
+	for _, tt := range tests {
+		if got := ValidTopUp(tt.amount); got != tt.want {
+			t.Errorf("ValidTopUp(%v) = %v, want %v", tt.amount, got, tt.want)
+		}
+	}
+}
+
+func TestNextBalance(t *testing.T) {
+	tests := []struct {
+		name    string
+		balance float64
+		amount  float64
+		want    float64
+		wantErr error
+	}{
+		{"credit", 10, 5.5, 15.5, nil},
+		{"debit", 10, -3.3, 6.7, nil},
+		{"debit of the whole balance", 0.3, -0.1 - 0.2, 0, nil},
+		{"rounds to cents", 0.1, 0.2, 0.3, nil},
+		{"debit larger than the balance", 10, -10.01, 10, ErrInsufficientFunds},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NextBalance(tt.balance, tt.amount)
+			if !errors.Is(err, tt.wantErr) || got != tt.want {
+				t.Errorf("NextBalance(%v, %v) = %v, %v; want %v, %v", tt.balance, tt.amount, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPaymentReference(t *testing.T) {
+	if got := PaymentReference(42); got != "payment:42" {
+		t.Errorf("PaymentReference(42) = %q", got)
+	}
+}
+
+func TestReturnable(t *testing.T) {
+	// A checkout of 30.00 paid with 12.50 from the wallet and 17.50 through
+	// the provider
+	tests := []struct {
+		name      string
+		fulfilled bool
+		released  bool
+		refund    bool
+		want      float64
+	}{
+		{"not approved", false, false, false, 12.5},
+		{"refunded after fulfilled", true, false, true, 12.5},
+		{"refunded twice", true, true, true, 0},
+		{"released twice", false, true, false, 0},
+		{"release of a fulfilled payment", true, false, false, 0},
+		{"refund of a payment not fulfilled", false, false, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := returnable(12.5, tt.fulfilled, tt.released, tt.refund); got != tt.want {
+				t.Errorf("returnable(12.5, %v, %v, %v) = %v, want %v", tt.fulfilled, tt.released, tt.refund, got, tt.want)
+			}
+		})
+	}
+	if got := returnable(0, true, false, true); got != 0 {
+		t.Errorf("a payment without a wallet part returned %v", got)
+	}
+}